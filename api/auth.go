@@ -6,13 +6,15 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api/auth_cache"
-	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/matrix"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// getUserId is swapped out by tests
+var getUserId = auth_cache.GetUserId
+
 type UserInfo struct {
 	UserId      string
 	AccessToken string
@@ -29,7 +31,7 @@ func AccessTokenRequiredRoute(next func(r *http.Request, rctx rcontext.RequestCo
 		accessToken := util.GetAccessTokenFromRequest(r)
 		if accessToken == "" {
 			rctx.Log.Error("Error: no token provided (required)")
-			return &ErrorResponse{common.ErrCodeMissingToken, "no token provided (required)", common.ErrCodeUnknownToken}
+			return MissingToken()
 		}
 		if config.Get().SharedSecret.Enabled && accessToken == config.Get().SharedSecret.Token {
 			log := rctx.Log.WithFields(logrus.Fields{"isRepoAdmin": true})
@@ -37,7 +39,7 @@ func AccessTokenRequiredRoute(next func(r *http.Request, rctx rcontext.RequestCo
 			return callUserNext(next, r, rctx, UserInfo{UserId: "@sharedsecret", AccessToken: accessToken, IsShared: true})
 		}
 		appserviceUserId := util.GetAppserviceUserIdFromRequest(r)
-		userId, err := auth_cache.GetUserId(rctx, accessToken, appserviceUserId)
+		userId, err := getUserId(rctx, accessToken, appserviceUserId)
 		if err != nil || userId == "" {
 			if err == matrix.ErrGuestToken {
 				return GuestAuthFailed()
@@ -69,7 +71,7 @@ func AccessTokenOptionalRoute(next func(r *http.Request, rctx rcontext.RequestCo
 			return callUserNext(next, r, rctx, UserInfo{UserId: "@sharedsecret", AccessToken: accessToken, IsShared: true})
 		}
 		appserviceUserId := util.GetAppserviceUserIdFromRequest(r)
-		userId, err := auth_cache.GetUserId(rctx, accessToken, appserviceUserId)
+		userId, err := getUserId(rctx, accessToken, appserviceUserId)
 		if err != nil {
 			if err != matrix.ErrInvalidToken {
 				rctx.Log.Error("Error verifying token: ", err)
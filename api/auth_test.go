@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-api-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestAccessTokenRequiredRoute(t *testing.T) {
+	defer func(original func(rcontext.RequestContext, string, string) (string, error)) {
+		getUserId = original
+	}(getUserId)
+	getUserId = func(ctx rcontext.RequestContext, accessToken string, appserviceUserId string) (string, error) {
+		if accessToken == "valid" {
+			return "@alice:example.org", nil
+		}
+		return "", matrix.ErrInvalidToken
+	}
+
+	tests := []struct {
+		name                 string
+		authorization        string
+		expectedUserId       string
+		expectedInternalCode string
+	}{
+		{name: "valid token", authorization: "Bearer valid", expectedUserId: "@alice:example.org"},
+		{name: "invalid token", authorization: "Bearer invalid", expectedInternalCode: common.ErrCodeUnknownToken},
+		{name: "no token", authorization: "", expectedInternalCode: common.ErrCodeUnknownToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			rctx := rcontext.RequestContext{Context: context.Background(), Log: logrus.NewEntry(logger)}
+
+			var called *UserInfo
+			route := AccessTokenRequiredRoute(func(r *http.Request, rctx rcontext.RequestContext, user UserInfo) interface{} {
+				called = &user
+				return &EmptyResponse{}
+			})
+
+			r := httptest.NewRequest("GET", "/_matrix/client/v1/media/download/example.org/abc123", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			res := route(r, rctx)
+
+			if tt.expectedInternalCode == "" {
+				if called == nil || called.UserId != tt.expectedUserId {
+					t.Errorf("got %#v, expected the route to be called for %s", res, tt.expectedUserId)
+				}
+				return
+			}
+			if called != nil {
+				t.Errorf("expected the route not to be called, got user %s", called.UserId)
+			}
+			errRes, ok := res.(*ErrorResponse)
+			if !ok || errRes.InternalCode != tt.expectedInternalCode {
+				t.Errorf("got %#v, expected an error with internal code %s", res, tt.expectedInternalCode)
+			}
+		})
+	}
+}
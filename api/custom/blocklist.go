@@ -0,0 +1,96 @@
+package custom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type BlockedHashResponse struct {
+	Sha256Hash string `json:"sha256"`
+	Reason     string `json:"reason"`
+	BlockedTs  int64  `json:"blocked_ts"`
+}
+
+func BlockHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+	hash := util.NormalizeHash(params["sha256"])
+	reason := r.URL.Query().Get("reason")
+
+	var err error
+	purge := true
+	purgeStr := r.URL.Query().Get("purge")
+	if purgeStr != "" {
+		purge, err = strconv.ParseBool(purgeStr)
+		if err != nil {
+			return api.BadRequest("Error parsing purge: " + err.Error())
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"sha256": hash,
+		"purge":  purge,
+	})
+
+	affected, err := maintenance_controller.BlockHash(hash, reason, purge, rctx)
+	if err != nil {
+		rctx.Log.Error("Error blocking hash: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error blocking hash")
+	}
+
+	mxcs := make([]string, 0)
+	for _, a := range affected {
+		mxcs = append(mxcs, a.MxcUri())
+	}
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"blocked": true, "purged": purge, "affected": mxcs}}
+}
+
+func UnblockHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+	hash := util.NormalizeHash(params["sha256"])
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"sha256": hash,
+	})
+
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+	err := db.UnblockHash(hash)
+	if err != nil {
+		rctx.Log.Error("Error unblocking hash: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unblocking hash")
+	}
+
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"blocked": false}}
+}
+
+func ListBlockedHashes(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	db := storage.GetDatabase().GetMetadataStore(rctx)
+	hashes, err := db.GetAllBlockedHashes()
+	if err != nil {
+		rctx.Log.Error("Error listing blocked hashes: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error listing blocked hashes")
+	}
+
+	results := make([]*BlockedHashResponse, 0)
+	for _, h := range hashes {
+		results = append(results, &BlockedHashResponse{
+			Sha256Hash: h.Sha256Hash,
+			Reason:     h.Reason,
+			BlockedTs:  h.BlockedTs,
+		})
+	}
+
+	return &api.DoNotCacheResponse{Payload: results}
+}
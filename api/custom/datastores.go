@@ -1,9 +1,12 @@
 package custom
 
 import (
+	"database/sql"
+
 	"github.com/getsentry/sentry-go"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -21,6 +24,13 @@ type DatastoreMigration struct {
 	TaskID int `json:"task_id"`
 }
 
+type MediaMovedResponse struct {
+	Origin      string `json:"origin"`
+	MediaId     string `json:"media_id"`
+	DatastoreId string `json:"datastore_id"`
+	Location    string `json:"location"`
+}
+
 func GetDatastores(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	datastores, err := storage.GetDatabase().GetMediaStore(rctx).GetAllDatastores()
 	if err != nil {
@@ -130,3 +140,179 @@ func GetDatastoreStorageEstimate(r *http.Request, rctx rcontext.RequestContext,
 	}
 	return &api.DoNotCacheResponse{Payload: result}
 }
+
+func GetDatastoreUsage(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	measure := r.URL.Query().Get("measure") == "true"
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"measure": measure,
+	})
+
+	usage, err := maintenance_controller.GetDatastoreUsage(measure, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error getting datastore usage")
+	}
+	return &api.DoNotCacheResponse{Payload: usage}
+}
+
+func GetStorageMigration(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	taskId, err := strconv.Atoi(params["taskId"])
+	if err != nil {
+		return api.BadRequest("invalid task ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"taskId": taskId,
+	})
+
+	job, err := storage.GetDatabase().GetMetadataStore(rctx).GetMigrationJob(taskId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	} else if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error getting migration")
+	}
+	return &api.DoNotCacheResponse{Payload: job}
+}
+
+func CancelStorageMigration(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	taskId, err := strconv.Atoi(params["taskId"])
+	if err != nil {
+		return api.BadRequest("invalid task ID")
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"taskId": taskId,
+	})
+
+	rctx.Log.Info("User ", user.UserId, " is cancelling a datastore media transfer")
+	cancelled, err := maintenance_controller.CancelStorageMigration(taskId, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error cancelling migration")
+	}
+	if !cancelled {
+		return api.BadRequest("Migration is not running")
+	}
+	return &api.EmptyResponse{}
+}
+
+func GetDeduplicationStats(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	refresh := r.URL.Query().Get("refresh") == "true"
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"refresh": refresh,
+	})
+
+	stats, err := maintenance_controller.GetDeduplicationStats(refresh, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error getting deduplication stats")
+	}
+	return &api.DoNotCacheResponse{Payload: stats}
+}
+
+func GetOrphanedFiles(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	graceMinutes := int64(60)
+	var err error
+	graceMinutesStr := r.URL.Query().Get("grace_minutes")
+	if graceMinutesStr != "" {
+		graceMinutes, err = strconv.ParseInt(graceMinutesStr, 10, 64)
+		if err != nil || graceMinutes < 0 {
+			return api.BadRequest("Error parsing grace_minutes")
+		}
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") != "false"
+
+	params := mux.Vars(r)
+
+	datastoreId := params["datastoreId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"graceMinutes": graceMinutes,
+		"dryRun":       dryRun,
+		"datastoreId":  datastoreId,
+	})
+
+	ds, err := datastore.LocateDatastore(rctx, datastoreId)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("Error getting datastore. Does it exist?")
+	}
+	if ds.Type == "ipfs" {
+		return api.BadRequest("IPFS datastores cannot be scanned for orphaned files")
+	}
+	if !dryRun && ds.MayContainForeignObjects() {
+		// Anything else in the bucket would look orphaned, so only allow deletions when it's known to be safe
+		return api.BadRequest("Orphaned files can only be removed from s3 datastores with dedicatedBucket enabled")
+	}
+
+	rctx.Log.Info("User ", user.UserId, " is looking for orphaned files")
+	report, err := maintenance_controller.FindOrphanedFiles(ds, time.Duration(graceMinutes)*time.Minute, !dryRun, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error finding orphaned files")
+	}
+
+	return &api.DoNotCacheResponse{Payload: report}
+}
+
+func MoveMediaToDatastore(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+	targetDsId := params["datastoreId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":     server,
+		"mediaId":    mediaId,
+		"targetDsId": targetDsId,
+	})
+
+	media, err := storage.GetDatabase().GetMediaStore(rctx).Get(server, mediaId)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error getting media")
+	}
+
+	if media.DatastoreId == targetDsId {
+		return api.BadRequest("Media is already in the target datastore")
+	}
+
+	targetDatastore, err := datastore.LocateDatastore(rctx, targetDsId)
+	if err != nil {
+		rctx.Log.Error(err)
+		return api.BadRequest("Error getting target datastore. Does it exist?")
+	}
+
+	rctx.Log.Info("User ", user.UserId, " is moving media to another datastore")
+	moved, err := maintenance_controller.MoveMediaToDatastore(media, targetDatastore, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error moving media")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &MediaMovedResponse{
+		Origin:      moved.Origin,
+		MediaId:     moved.MediaId,
+		DatastoreId: moved.DatastoreId,
+		Location:    moved.Location,
+	}}
+}
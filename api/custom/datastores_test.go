@@ -0,0 +1,47 @@
+package custom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestStorageMigrationInvalidTaskId(t *testing.T) {
+	// Only invalid task IDs are covered, as looking up the migration needs the database
+	handlers := []struct {
+		name    string
+		method  string
+		handler func(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{}
+	}{
+		{name: "get", method: "GET", handler: GetStorageMigration},
+		{name: "cancel", method: "POST", handler: CancelStorageMigration},
+	}
+	tests := []struct {
+		name   string
+		taskId string
+	}{
+		{name: "empty", taskId: ""},
+		{name: "too large", taskId: "99999999999999999999999"},
+		{name: "not a number", taskId: "abc"},
+	}
+	for _, h := range handlers {
+		for _, tt := range tests {
+			t.Run(h.name+" "+tt.name, func(t *testing.T) {
+				r := mux.SetURLVars(httptest.NewRequest(h.method, "/", nil), map[string]string{"taskId": tt.taskId})
+				res := h.handler(r, rcontext.RequestContext{}, api.UserInfo{})
+				errRes, ok := res.(*api.ErrorResponse)
+				if !ok {
+					t.Fatalf("got %#v, expected an error response", res)
+				}
+				if errRes.InternalCode != common.ErrCodeBadRequest {
+					t.Errorf("got %s, expected %s", errRes.InternalCode, common.ErrCodeBadRequest)
+				}
+			})
+		}
+	}
+}
@@ -259,7 +259,7 @@ func DownloadExportPart(r *http.Request, rctx rcontext.RequestContext, user api.
 		return api.InternalServerError("failed to get part")
 	}
 
-	s, err := datastore.DownloadStream(rctx, part.DatastoreID, part.Location)
+	s, err := datastore.DownloadStream(rctx, part.DatastoreID, part.Location, part.Encoded)
 	if err != nil {
 		rctx.Log.Error(err)
 		sentry.CaptureException(err)
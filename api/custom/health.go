@@ -1,10 +1,17 @@
 package custom
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
 )
 
 type HealthzResponse struct {
@@ -12,6 +19,24 @@ type HealthzResponse struct {
 	Status string `json:"status"`
 }
 
+type DependencyStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadyzResponse struct {
+	OK         bool                         `json:"ok"`
+	Database   *DependencyStatus            `json:"database"`
+	Datastores map[string]*DependencyStatus `json:"datastores"`
+}
+
+var errHealthCheckTimeout = errors.New("timed out")
+
+// The last readiness check, reused for a short while as anyone can request it
+var readyzLock = &sync.Mutex{}
+var lastReadyz *ReadyzResponse
+var lastReadyzTime time.Time
+
 func GetHealthz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	return &api.DoNotCacheResponse{
 		Payload: &HealthzResponse{
@@ -20,3 +45,97 @@ func GetHealthz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo
 		},
 	}
 }
+
+func GetReadyz(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	readyzLock.Lock()
+	defer readyzLock.Unlock()
+
+	cacheFor := time.Duration(config.Get().Health.CacheSeconds) * time.Second
+	response := lastReadyz
+	if response == nil || time.Since(lastReadyzTime) >= cacheFor {
+		response = checkReadiness(rctx)
+		lastReadyz = response
+		lastReadyzTime = time.Now()
+	}
+
+	if !response.OK {
+		rctx.Log.Warn("Readiness check failed")
+		return &api.StatusCodeResponse{StatusCode: http.StatusServiceUnavailable, Payload: response}
+	}
+	return &api.DoNotCacheResponse{Payload: response}
+}
+
+func checkReadiness(rctx rcontext.RequestContext) *ReadyzResponse {
+	timeout := time.Duration(config.Get().Health.TimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(rctx, timeout)
+	defer cancel()
+
+	checkWrites := config.Get().Health.CheckWrites
+	response := &ReadyzResponse{
+		OK:         true,
+		Datastores: make(map[string]*DependencyStatus),
+	}
+
+	response.Database = checkDependency(ctx, func() error {
+		return storage.GetDatabase().Ping(ctx)
+	})
+
+	if response.Database.OK {
+		datastores, err := datastore.GetAvailableDatastores(rctx)
+		if err != nil {
+			rctx.Log.Warn("Error listing datastores for readiness check: ", err)
+			response.OK = false
+		}
+
+		lock := &sync.Mutex{}
+		wg := &sync.WaitGroup{}
+		for _, ds := range datastores {
+			wg.Add(1)
+			go func(datastoreId string) {
+				defer wg.Done()
+				status := checkDependency(ctx, func() error {
+					ref, err := datastore.LocateDatastore(rctx, datastoreId)
+					if err != nil {
+						return err
+					}
+					return ref.CheckHealth(checkWrites)
+				})
+				lock.Lock()
+				response.Datastores[datastoreId] = status
+				lock.Unlock()
+			}(ds.DatastoreId)
+		}
+		wg.Wait()
+	}
+
+	if !response.Database.OK {
+		response.OK = false
+	}
+	for _, status := range response.Datastores {
+		if !status.OK {
+			response.OK = false
+		}
+	}
+
+	return response
+}
+
+// checkDependency runs the check, giving up once the context is done.
+func checkDependency(ctx context.Context, check func() error) *DependencyStatus {
+	result := make(chan error, 1)
+	go func() {
+		result <- check()
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = errHealthCheckTimeout
+	}
+
+	if err != nil {
+		return &DependencyStatus{OK: false, Error: err.Error()}
+	}
+	return &DependencyStatus{OK: true}
+}
@@ -0,0 +1,155 @@
+package custom
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type MediaInventoryEntry struct {
+	Origin       string `json:"origin"`
+	MediaId      string `json:"media_id"`
+	UploadedBy   string `json:"uploaded_by"`
+	ContentType  string `json:"content_type"`
+	SizeBytes    int64  `json:"size_bytes"`
+	Sha256Hash   string `json:"sha256_hash"`
+	DatastoreId  string `json:"datastore_id"`
+	CreatedTs    int64  `json:"created_ts"`
+	LastAccessTs int64  `json:"last_access_ts"`
+}
+
+var mediaInventoryCsvHeader = []string{"origin", "media_id", "uploaded_by", "content_type", "size_bytes", "sha256_hash", "datastore_id", "created_ts", "last_access_ts"}
+
+func ExportMediaInventory(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	origin := r.URL.Query().Get("origin")
+
+	var sinceTs int64
+	var beforeTs int64
+	var err error
+	if sinceTsStr := r.URL.Query().Get("since_ts"); sinceTsStr != "" {
+		sinceTs, err = strconv.ParseInt(sinceTsStr, 10, 64)
+		if err != nil {
+			return api.BadRequest("Error parsing since_ts: " + err.Error())
+		}
+	}
+	if beforeTsStr := r.URL.Query().Get("before_ts"); beforeTsStr != "" {
+		beforeTs, err = strconv.ParseInt(beforeTsStr, 10, 64)
+		if err != nil {
+			return api.BadRequest("Error parsing before_ts: " + err.Error())
+		}
+	}
+
+	asCsv := util.AcceptsContentType(r.Header.Get("Accept"), "text/csv")
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin":   origin,
+		"sinceTs":  sinceTs,
+		"beforeTs": beforeTs,
+		"csv":      asCsv,
+	})
+
+	// The records are written to the response as they are read from the database, so the whole
+	// table never has to be held in memory.
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		if asCsv {
+			err = writeMediaInventoryCsv(pw, origin, sinceTs, beforeTs, rctx)
+		} else {
+			err = writeMediaInventoryJson(pw, origin, sinceTs, beforeTs, rctx)
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			rctx.Log.Error("Error exporting media inventory: ", err)
+			sentry.CaptureException(err)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	contentType := "application/json"
+	if asCsv {
+		contentType = "text/csv; charset=utf-8"
+	}
+	return &api.StreamedResponse{ContentType: contentType, Stream: pr}
+}
+
+func toMediaInventoryEntry(media *types.Media, lastAccessTs int64) *MediaInventoryEntry {
+	return &MediaInventoryEntry{
+		Origin:       media.Origin,
+		MediaId:      media.MediaId,
+		UploadedBy:   media.UserId,
+		ContentType:  media.ContentType,
+		SizeBytes:    media.SizeBytes,
+		Sha256Hash:   media.Sha256Hash,
+		DatastoreId:  media.DatastoreId,
+		CreatedTs:    media.CreationTs,
+		LastAccessTs: lastAccessTs,
+	}
+}
+
+func writeMediaInventoryCsv(w io.Writer, origin string, sinceTs int64, beforeTs int64, ctx rcontext.RequestContext) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(mediaInventoryCsvHeader)
+	if err != nil {
+		return err
+	}
+
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	err = db.StreamInventory(origin, sinceTs, beforeTs, func(media *types.Media, lastAccessTs int64) error {
+		e := toMediaInventoryEntry(media, lastAccessTs)
+		return cw.Write([]string{
+			e.Origin,
+			e.MediaId,
+			e.UploadedBy,
+			e.ContentType,
+			strconv.FormatInt(e.SizeBytes, 10),
+			e.Sha256Hash,
+			e.DatastoreId,
+			strconv.FormatInt(e.CreatedTs, 10),
+			strconv.FormatInt(e.LastAccessTs, 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeMediaInventoryJson(w io.Writer, origin string, sinceTs int64, beforeTs int64, ctx rcontext.RequestContext) error {
+	_, err := w.Write([]byte("["))
+	if err != nil {
+		return err
+	}
+
+	first := true
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	err = db.StreamInventory(origin, sinceTs, beforeTs, func(media *types.Media, lastAccessTs int64) error {
+		b, err := json.Marshal(toMediaInventoryEntry(media, lastAccessTs))
+		if err != nil {
+			return err
+		}
+		if !first {
+			b = append([]byte(","), b...)
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("]"))
+	return err
+}
@@ -0,0 +1,68 @@
+package custom
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestExportMediaInventoryBadTimestamps(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "since_ts", url: "/admin/export?since_ts=yesterday"},
+		{name: "before_ts", url: "/admin/export?before_ts=1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			res := ExportMediaInventory(r, rcontext.RequestContext{}, api.UserInfo{})
+			errRes, ok := res.(*api.ErrorResponse)
+			if !ok {
+				t.Fatalf("expected an error response, got %T", res)
+			}
+			if errRes.InternalCode != common.ErrCodeBadRequest {
+				t.Errorf("InternalCode = %s, want %s", errRes.InternalCode, common.ErrCodeBadRequest)
+			}
+		})
+	}
+}
+
+func TestToMediaInventoryEntry(t *testing.T) {
+	media := &types.Media{
+		Origin:      "example.org",
+		MediaId:     "abc123",
+		UserId:      "@alice:example.org",
+		ContentType: "image/png",
+		SizeBytes:   1024,
+		Sha256Hash:  "0123456789abcdef",
+		DatastoreId: "ds1",
+		CreationTs:  1600000000000,
+	}
+
+	tests := []struct {
+		name         string
+		lastAccessTs int64
+		want         string
+	}{
+		{name: "accessed", lastAccessTs: 1600000005000, want: `{"origin":"example.org","media_id":"abc123","uploaded_by":"@alice:example.org","content_type":"image/png","size_bytes":1024,"sha256_hash":"0123456789abcdef","datastore_id":"ds1","created_ts":1600000000000,"last_access_ts":1600000005000}`},
+		{name: "never accessed", lastAccessTs: 0, want: `{"origin":"example.org","media_id":"abc123","uploaded_by":"@alice:example.org","content_type":"image/png","size_bytes":1024,"sha256_hash":"0123456789abcdef","datastore_id":"ds1","created_ts":1600000000000,"last_access_ts":0}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(toMediaInventoryEntry(media, tt.lastAccessTs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("entry = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// getMediaByHash and downloadStream are swapped out by tests
+var getMediaByHash = func(hash string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).GetByHash(hash)
+}
+var downloadStream = datastore.DownloadStream
+
+func DownloadMediaByHash(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+	hash := util.NormalizeHash(params["sha256"])
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"sha256": hash,
+	})
+
+	records, err := getMediaByHash(hash, rctx)
+	if err != nil {
+		rctx.Log.Error("Error looking up media by hash: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error looking up media")
+	}
+
+	// Records with the same hash normally share a file, but any of them will do if they don't
+	for _, media := range records {
+		stream, err := downloadStream(rctx, media.DatastoreId, media.Location, media.Encoded)
+		if err != nil {
+			rctx.Log.Warn("Error downloading ", media.MxcUri(), " - trying the next record: ", err)
+			continue
+		}
+
+		rctx.Log.Info("Serving hash from ", media.MxcUri())
+		return &r0.DownloadMediaResponse{
+			ContentType:       media.ContentType,
+			Filename:          hash,
+			SizeBytes:         media.SizeBytes,
+			Data:              stream,
+			TargetDisposition: "attachment",
+			Sha256Hash:        media.Sha256Hash,
+		}
+	}
+
+	return api.NotFoundError()
+}
@@ -0,0 +1,110 @@
+package custom
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestDownloadMediaByHash(t *testing.T) {
+	hash := strings.Repeat("0123456789abcdef", 4)
+	files := map[string]string{
+		"ab/cd/present": "hello world",
+	}
+	records := map[string][]*types.Media{
+		"sha256:" + hash: {
+			{Origin: "example.org", MediaId: "missing", ContentType: "text/plain", SizeBytes: 11, DatastoreId: "ds", Location: "ab/cd/missing", Sha256Hash: "sha256:" + hash},
+			{Origin: "example.org", MediaId: "present", ContentType: "text/plain", SizeBytes: 11, DatastoreId: "ds", Location: "ab/cd/present", Sha256Hash: "sha256:" + hash},
+		},
+		"sha256:" + strings.Repeat("f", 64): {
+			{Origin: "example.org", MediaId: "gone", ContentType: "text/plain", SizeBytes: 11, DatastoreId: "ds", Location: "ab/cd/gone"},
+		},
+	}
+
+	defer func(original func(string, rcontext.RequestContext) ([]*types.Media, error)) {
+		getMediaByHash = original
+	}(getMediaByHash)
+	getMediaByHash = func(hash string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+		return records[hash], nil
+	}
+	defer func(original func(rcontext.RequestContext, string, string, bool) (io.ReadCloser, error)) {
+		downloadStream = original
+	}(downloadStream)
+	downloadStream = func(ctx rcontext.RequestContext, datastoreId string, location string, encoded bool) (io.ReadCloser, error) {
+		contents, ok := files[location]
+		if !ok {
+			return nil, errors.New("file not found")
+		}
+		return ioutil.NopCloser(strings.NewReader(contents)), nil
+	}
+
+	tests := []struct {
+		name         string
+		hash         string
+		expectedBody string
+		expectedCode string
+	}{
+		{name: "known hash", hash: hash, expectedBody: "hello world"},
+		{name: "uppercase hash", hash: strings.ToUpper(hash), expectedBody: "hello world"},
+		{name: "prefixed hash", hash: "sha256:" + hash, expectedBody: "hello world"},
+		{name: "unknown hash", hash: strings.Repeat("a", 64), expectedCode: common.ErrCodeNotFound},
+		{name: "no readable files", hash: strings.Repeat("f", 64), expectedCode: common.ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_matrix/media/unstable/admin/by-hash/"+tt.hash, nil)
+			r = mux.SetURLVars(r, map[string]string{"sha256": tt.hash})
+			res := DownloadMediaByHash(r, testContext(), api.UserInfo{})
+
+			if tt.expectedCode != "" {
+				errRes, ok := res.(*api.ErrorResponse)
+				if !ok || errRes.InternalCode != tt.expectedCode {
+					t.Fatalf("got %#v, expected a %s error", res, tt.expectedCode)
+				}
+				return
+			}
+
+			download, ok := res.(*r0.DownloadMediaResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected a download", res)
+			}
+			b, err := ioutil.ReadAll(download.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expectedBody {
+				t.Errorf("got body %q, expected %q", b, tt.expectedBody)
+			}
+			if download.ContentType != "text/plain" {
+				t.Errorf("got content type %s, expected text/plain", download.ContentType)
+			}
+			if download.SizeBytes != int64(len(tt.expectedBody)) {
+				t.Errorf("got size %d, expected %d", download.SizeBytes, len(tt.expectedBody))
+			}
+			if download.TargetDisposition != "attachment" {
+				t.Errorf("got disposition %s, expected attachment", download.TargetDisposition)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package custom
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/getsentry/sentry-go"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
@@ -18,10 +21,29 @@ import (
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// The largest batch purge request body accepted, which is enough for several thousand MXC URIs
+const maxPurgeBatchBytes = 1024 * 1024
+
 type MediaPurgedResponse struct {
 	NumRemoved int `json:"total_removed"`
 }
 
+type RemoteOriginPurgedResponse struct {
+	Origin     string `json:"origin"`
+	DryRun     bool   `json:"dry_run"`
+	NumRemoved int    `json:"total_removed"`
+	BytesFreed int64  `json:"bytes_freed"`
+}
+
+type MediaPurgeResult struct {
+	MxcUri string `json:"mxc"`
+	Result string `json:"result"`
+}
+
+type MediaPurgeBatchResponse struct {
+	Results []*MediaPurgeResult `json:"results"`
+}
+
 func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	beforeTsStr := r.URL.Query().Get("before_ts")
 	if beforeTsStr == "" {
@@ -47,6 +69,37 @@ func PurgeRemoteMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	return &api.DoNotCacheResponse{Payload: &MediaPurgedResponse{NumRemoved: removed}}
 }
 
+func PurgeRemoteOrigin(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+
+	origin := params["origin"]
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"origin": origin,
+		"dryRun": dryRun,
+	})
+
+	if util.IsServerOurs(origin) {
+		return api.BadRequest("Media from a local server cannot be purged as remote media")
+	}
+
+	rctx.Log.Info("User ", user.UserId, " is purging all remote media from ", origin)
+	removed, freedBytes, err := maintenance_controller.PurgeRemoteOrigin(origin, dryRun, rctx)
+	if err != nil {
+		rctx.Log.Error("Error purging remote media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error purging remote media")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &RemoteOriginPurgedResponse{
+		Origin:     origin,
+		DryRun:     dryRun,
+		NumRemoved: removed,
+		BytesFreed: freedBytes,
+	}}
+}
+
 func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
 	localServerName := r.Host
@@ -61,30 +114,20 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 		"mediaId": mediaId,
 	})
 
-	// If the user is NOT a global admin, ensure they are speaking to the right server
-	if !isGlobalAdmin {
-		if server != localServerName {
-			return api.AuthFailed()
-		}
-		// If the user is NOT a local admin, ensure they uploaded the content in the first place
-		if !isLocalAdmin {
-			db := storage.GetDatabase().GetMediaStore(rctx)
-			m, err := db.Get(server, mediaId)
-			if err == sql.ErrNoRows {
-				return api.NotFoundError()
-			}
-			if err != nil {
-				rctx.Log.Error("Error checking ownership of media: " + err.Error())
-				sentry.CaptureException(err)
-				return api.InternalServerError("error checking media ownership")
-			}
-			if m.UserId != user.UserId {
-				return api.AuthFailed()
-			}
-		}
+	allowed, err := canPurgeRecord(server, mediaId, isGlobalAdmin, isLocalAdmin, localServerName, user, rctx)
+	if err == sql.ErrNoRows {
+		return api.NotFoundError()
+	}
+	if err != nil {
+		rctx.Log.Error("Error checking ownership of media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error checking media ownership")
+	}
+	if !allowed {
+		return api.AuthFailed()
 	}
 
-	err := maintenance_controller.PurgeMedia(server, mediaId, rctx)
+	err = maintenance_controller.PurgeMedia(server, mediaId, rctx)
 	if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
 		return api.NotFoundError()
 	}
@@ -97,6 +140,75 @@ func PurgeIndividualRecord(r *http.Request, rctx rcontext.RequestContext, user a
 	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true}}
 }
 
+func PurgeMediaBatch(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
+	localServerName := r.Host
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPurgeBatchBytes+1))
+	if err != nil {
+		rctx.Log.Error("Error reading request body: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Error reading request body")
+	}
+	if len(b) > maxPurgeBatchBytes {
+		return api.RequestTooLarge()
+	}
+	mxcs := make([]string, 0)
+	err = json.Unmarshal(b, &mxcs)
+	if err != nil {
+		return api.BadRequest("Request body must be an array of MXC URIs")
+	}
+
+	// Each record is purged on its own so one failure doesn't stop the others
+	results := make([]*MediaPurgeResult, 0)
+	for _, mxc := range mxcs {
+		result := &MediaPurgeResult{MxcUri: mxc}
+		results = append(results, result)
+
+		server, mediaId, err := util.SplitMxc(mxc)
+		if err != nil {
+			result.Result = "invalid"
+			continue
+		}
+
+		irctx := rctx.LogWithFields(logrus.Fields{
+			"server":  server,
+			"mediaId": mediaId,
+		})
+
+		allowed, err := canPurgeRecord(server, mediaId, isGlobalAdmin, isLocalAdmin, localServerName, user, irctx)
+		if err == sql.ErrNoRows {
+			result.Result = "not_found"
+			continue
+		}
+		if err != nil {
+			irctx.Log.Error("Error checking ownership of media: " + err.Error())
+			sentry.CaptureException(err)
+			result.Result = "error"
+			continue
+		}
+		if !allowed {
+			result.Result = "forbidden"
+			continue
+		}
+
+		kept, err := maintenance_controller.PurgeMediaRecord(server, mediaId, irctx)
+		if err == sql.ErrNoRows || err == common.ErrMediaNotFound {
+			result.Result = "not_found"
+		} else if err != nil {
+			irctx.Log.Error("Error purging media: " + err.Error())
+			sentry.CaptureException(err)
+			result.Result = "error"
+		} else if kept {
+			result.Result = "deleted_file_kept"
+		} else {
+			result.Result = "deleted"
+		}
+	}
+
+	return &api.DoNotCacheResponse{Payload: &MediaPurgeBatchResponse{Results: results}}
+}
+
 func PurgeQuarantined(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	isGlobalAdmin, isLocalAdmin := getPurgeRequestInfo(r, rctx, user)
 	localServerName := r.Host
@@ -203,7 +315,7 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		return api.AuthFailed()
 	}
 
-	affected, err := maintenance_controller.PurgeUserMedia(userId, beforeTs, rctx)
+	affected, freedBytes, err := maintenance_controller.PurgeUserMedia(userId, beforeTs, rctx)
 
 	if err != nil {
 		rctx.Log.Error("Error purging media: " + err.Error())
@@ -216,7 +328,7 @@ func PurgeUserMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		mxcs = append(mxcs, a.MxcUri())
 	}
 
-	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
+	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs, "freed_bytes": freedBytes}}
 }
 
 func PurgeRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -344,6 +456,27 @@ func PurgeDomainMedia(r *http.Request, rctx rcontext.RequestContext, user api.Us
 	return &api.DoNotCacheResponse{Payload: map[string]interface{}{"purged": true, "affected": mxcs}}
 }
 
+// canPurgeRecord determines if the user can purge the media. Global admins can purge anything, while
+// local admins can only purge media on their server and other users can only purge their own media.
+func canPurgeRecord(server string, mediaId string, isGlobalAdmin bool, isLocalAdmin bool, localServerName string, user api.UserInfo, rctx rcontext.RequestContext) (bool, error) {
+	if isGlobalAdmin {
+		return true, nil
+	}
+	if server != localServerName {
+		return false, nil
+	}
+	if isLocalAdmin {
+		return true, nil
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	m, err := db.Get(server, mediaId)
+	if err != nil {
+		return false, err
+	}
+	return m.UserId == user.UserId, nil
+}
+
 func getPurgeRequestInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) (bool, bool) {
 	isGlobalAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
 	isLocalAdmin, err := matrix.IsUserAdmin(rctx, r.Host, user.AccessToken, r.RemoteAddr)
@@ -0,0 +1,37 @@
+package custom
+
+import (
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestCanPurgeRecord(t *testing.T) {
+	// Cases which would need the uploader from the database aren't covered here
+	tests := []struct {
+		name          string
+		server        string
+		isGlobalAdmin bool
+		isLocalAdmin  bool
+		want          bool
+	}{
+		{name: "global admin on this server", server: "example.org", isGlobalAdmin: true, want: true},
+		{name: "global admin on another server", server: "other.example.org", isGlobalAdmin: true, want: true},
+		{name: "local admin on this server", server: "example.org", isLocalAdmin: true, want: true},
+		{name: "local admin on another server", server: "other.example.org", isLocalAdmin: true, want: false},
+		{name: "user on another server", server: "other.example.org", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := api.UserInfo{UserId: "@alice:example.org"}
+			allowed, err := canPurgeRecord(tt.server, "abc123", tt.isGlobalAdmin, tt.isLocalAdmin, "example.org", user, rcontext.RequestContext{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed = %v, want %v", allowed, tt.want)
+			}
+		})
+	}
+}
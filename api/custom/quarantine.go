@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"github.com/getsentry/sentry-go"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -20,6 +21,10 @@ type MediaQuarantinedResponse struct {
 	NumQuarantined int `json:"num_quarantined"`
 }
 
+type MediaUnquarantinedResponse struct {
+	NumUnquarantined int `json:"num_unquarantined"`
+}
+
 // Developer note: This isn't broken out into a dedicated controller class because the logic is slightly
 // too complex to do so. If anything, the logic should be improved and moved.
 
@@ -63,7 +68,7 @@ func QuarantineRoomMedia(r *http.Request, rctx rcontext.RequestContext, user api
 			continue
 		}
 
-		resp, ok := doQuarantine(rctx, server, mediaId, allowOtherHosts)
+		resp, ok := doQuarantine(rctx, server, mediaId, allowOtherHosts, true)
 		if !ok {
 			return resp
 		}
@@ -110,7 +115,7 @@ func QuarantineUserMedia(r *http.Request, rctx rcontext.RequestContext, user api
 
 	total := 0
 	for _, media := range userMedia {
-		resp, ok := doQuarantineOn(media, allowOtherHosts, rctx)
+		resp, ok := doQuarantineOn(media, allowOtherHosts, true, rctx)
 		if !ok {
 			return resp
 		}
@@ -150,7 +155,7 @@ func QuarantineDomainMedia(r *http.Request, rctx rcontext.RequestContext, user a
 
 	total := 0
 	for _, media := range userMedia {
-		resp, ok := doQuarantineOn(media, allowOtherHosts, rctx)
+		resp, ok := doQuarantineOn(media, allowOtherHosts, true, rctx)
 		if !ok {
 			return resp
 		}
@@ -182,11 +187,71 @@ func QuarantineMedia(r *http.Request, rctx rcontext.RequestContext, user api.Use
 		return api.BadRequest("unable to quarantine media on other homeservers")
 	}
 
-	resp, _ := doQuarantine(rctx, server, mediaId, allowOtherHosts)
+	cascade, err := parseCascade(r)
+	if err != nil {
+		return api.BadRequest("cascade flag does not appear to be a boolean")
+	}
+
+	resp, _ := doQuarantine(rctx, server, mediaId, allowOtherHosts, cascade)
 	return &api.DoNotCacheResponse{Payload: resp}
 }
 
-func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, allowOtherHosts bool) (interface{}, bool) {
+func UnquarantineMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	canQuarantine, allowOtherHosts, isLocalAdmin := getQuarantineRequestInfo(r, rctx, user)
+	if !canQuarantine {
+		return api.AuthFailed()
+	}
+
+	params := mux.Vars(r)
+
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":     server,
+		"mediaId":    mediaId,
+		"localAdmin": isLocalAdmin,
+	})
+
+	if !allowOtherHosts && r.Host != server {
+		return api.BadRequest("unable to unquarantine media on other homeservers")
+	}
+
+	cascade, err := parseCascade(r)
+	if err != nil {
+		return api.BadRequest("cascade flag does not appear to be a boolean")
+	}
+
+	db := storage.GetDatabase().GetMediaStore(rctx)
+	media, err := db.Get(server, mediaId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return api.NotFoundError()
+		}
+		rctx.Log.Error("Error fetching media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unquarantining media")
+	}
+
+	num, err := setMediaQuarantined(media, false, allowOtherHosts, cascade, rctx)
+	if err != nil {
+		rctx.Log.Error("Error unquarantining media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("error unquarantining media")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &MediaUnquarantinedResponse{NumUnquarantined: num}}
+}
+
+func parseCascade(r *http.Request) (bool, error) {
+	cascadeStr := r.URL.Query().Get("cascade")
+	if cascadeStr == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(cascadeStr)
+}
+
+func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, allowOtherHosts bool, cascade bool) (interface{}, bool) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 	media, err := db.Get(origin, mediaId)
 	if err != nil {
@@ -200,10 +265,10 @@ func doQuarantine(ctx rcontext.RequestContext, origin string, mediaId string, al
 		return api.InternalServerError("error quarantining media"), false
 	}
 
-	return doQuarantineOn(media, allowOtherHosts, ctx)
+	return doQuarantineOn(media, allowOtherHosts, cascade, ctx)
 }
 
-func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.RequestContext) (interface{}, bool) {
+func doQuarantineOn(media *types.Media, allowOtherHosts bool, cascade bool, ctx rcontext.RequestContext) (interface{}, bool) {
 	// Check to make sure the media doesn't have a purpose in staying
 	attrDb := storage.GetDatabase().GetMediaAttributesStore(ctx)
 	attr, err := attrDb.GetAttributesDefaulted(media.Origin, media.MediaId)
@@ -221,7 +286,7 @@ func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.Reque
 	// The reset is done before actually quarantining the media because that could fail for some reason
 	internal_cache.Get().Reset()
 
-	num, err := setMediaQuarantined(media, true, allowOtherHosts, ctx)
+	num, err := setMediaQuarantined(media, true, allowOtherHosts, cascade, ctx)
 	if err != nil {
 		ctx.Log.Error("Error quarantining media: " + err.Error())
 		sentry.CaptureException(err)
@@ -231,14 +296,18 @@ func doQuarantineOn(media *types.Media, allowOtherHosts bool, ctx rcontext.Reque
 	return &MediaQuarantinedResponse{NumQuarantined: num}, true
 }
 
-func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts bool, ctx rcontext.RequestContext) (int, error) {
+func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts bool, cascade bool, ctx rcontext.RequestContext) (int, error) {
 	db := storage.GetDatabase().GetMediaStore(ctx)
 	numQuarantined := 0
 
-	// Quarantine all media with the same hash, including the one requested
-	otherMedia, err := db.GetByHash(media.Sha256Hash)
-	if err != nil {
-		return numQuarantined, err
+	// When cascading, quarantine all media with the same hash, including the one requested
+	otherMedia := []*types.Media{media}
+	if cascade {
+		var err error
+		otherMedia, err = db.GetByHash(media.Sha256Hash)
+		if err != nil {
+			return numQuarantined, err
+		}
 	}
 	for _, m := range otherMedia {
 		if m.Origin != media.Origin && !allowOtherHosts {
@@ -252,7 +321,7 @@ func setMediaQuarantined(media *types.Media, isQuarantined bool, allowOtherHosts
 		}
 
 		numQuarantined++
-		ctx.Log.Warn("Media has been quarantined: " + m.Origin + "/" + m.MediaId)
+		ctx.Log.Warnf("Media quarantine state set to %t: %s/%s", isQuarantined, m.Origin, m.MediaId)
 	}
 
 	return numQuarantined, nil
@@ -0,0 +1,47 @@
+package custom
+
+import (
+	"net/http"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+)
+
+type ReadOnlyResponse struct {
+	ReadOnly          bool `json:"read_only"`
+	Overridden        bool `json:"overridden"`
+	RetryAfterSeconds int  `json:"retry_after_seconds"`
+}
+
+func GetReadOnly(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	return &api.DoNotCacheResponse{Payload: newReadOnlyResponse()}
+}
+
+func EnableReadOnly(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	readOnly := true
+	upload_controller.SetReadOnly(&readOnly)
+	rctx.Log.Info("Read-only mode enabled by " + user.UserId)
+	return &api.DoNotCacheResponse{Payload: newReadOnlyResponse()}
+}
+
+func DisableReadOnly(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	readOnly := false
+	upload_controller.SetReadOnly(&readOnly)
+	rctx.Log.Info("Read-only mode disabled by " + user.UserId)
+	return &api.DoNotCacheResponse{Payload: newReadOnlyResponse()}
+}
+
+func ResetReadOnly(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	upload_controller.SetReadOnly(nil)
+	rctx.Log.Info("Read-only mode reset to the config by " + user.UserId)
+	return &api.DoNotCacheResponse{Payload: newReadOnlyResponse()}
+}
+
+func newReadOnlyResponse() *ReadOnlyResponse {
+	return &ReadOnlyResponse{
+		ReadOnly:          upload_controller.IsReadOnly(),
+		Overridden:        upload_controller.IsReadOnlyOverridden(),
+		RetryAfterSeconds: int(upload_controller.ReadOnlyRetryAfter().Seconds()),
+	}
+}
@@ -0,0 +1,63 @@
+package custom
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+type ThumbnailRegeneration struct {
+	TaskID int `json:"task_id"`
+}
+
+func RegenerateThumbnails(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+	server := params["server"]
+	mediaId := params["mediaId"]
+
+	var err error
+	purgeFirst := false
+	purgeFirstStr := r.URL.Query().Get("purge_first")
+	if purgeFirstStr != "" {
+		purgeFirst, err = strconv.ParseBool(purgeFirstStr)
+		if err != nil {
+			return api.BadRequest("Error parsing purge_first: " + err.Error())
+		}
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":     server,
+		"mediaId":    mediaId,
+		"purgeFirst": purgeFirst,
+	})
+
+	if mediaId != "" {
+		_, err = storage.GetDatabase().GetMediaStore(rctx).Get(server, mediaId)
+		if err == sql.ErrNoRows {
+			return api.NotFoundError()
+		}
+		if err != nil {
+			rctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return api.InternalServerError("Unexpected error getting media")
+		}
+	}
+
+	rctx.Log.Info("User ", user.UserId, " has started regenerating thumbnails")
+	task, err := thumbnail_controller.StartThumbnailRegeneration(server, mediaId, purgeFirst, rctx)
+	if err != nil {
+		rctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected error starting thumbnail regeneration")
+	}
+
+	return &api.DoNotCacheResponse{Payload: &ThumbnailRegeneration{TaskID: task.ID}}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"mime"
+	"net/url"
+
+	"github.com/alioygur/is"
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// ContentDisposition builds the Content-Disposition header for media. Only types which are safe to
+// render in the browser may be shown inline. Everything else (such as SVG and HTML, which can run
+// scripts) is sent as an attachment.
+func ContentDisposition(inlineTypes []string, contentType string, filename string, targetDisposition string) string {
+	disposition := "attachment"
+	if targetDisposition != "attachment" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && util.GlobMatchesAny(inlineTypes, mediaType) {
+			disposition = "inline"
+		}
+	}
+
+	fname := filename
+	if fname == "" {
+		exts, err := mime.ExtensionsByType(contentType)
+		if err != nil {
+			exts = nil
+			logrus.Warn("Unexpected error inferring file extension: " + err.Error())
+			sentry.CaptureException(err)
+		}
+		ext := ""
+		if exts != nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+		fname = "file" + ext
+	}
+	if is.ASCII(filename) {
+		return disposition + "; filename=" + url.QueryEscape(fname)
+	}
+	return disposition + "; filename*=utf-8''" + url.QueryEscape(fname)
+}
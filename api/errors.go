@@ -0,0 +1,67 @@
+package api
+
+import (
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+// KnownErrorResponse converts one of the common media errors into its Matrix error response, or
+// returns nil if the error has no particular response (and so is an unexpected error). The status
+// code for each response is picked by its internal code when the response is written.
+func KnownErrorResponse(err error) *ErrorResponse {
+	switch err {
+	case common.ErrMediaNotFound:
+		return NotFoundError()
+	case common.ErrMediaQuarantined, common.ErrMediaBlocked:
+		return Forbidden("This file is not permitted on this server")
+	case common.ErrMediaInfected:
+		return Forbidden("This file failed a security scan and is not permitted on this server")
+	case common.ErrMediaTypeDenied:
+		return Forbidden("This type of file is not permitted on this server")
+	case common.ErrMediaReservationNotFound:
+		return NotFoundError()
+	case common.ErrMediaReservationNotOwned:
+		return Forbidden("This media was created by another user")
+	case common.ErrMediaAlreadyUploaded:
+		return CannotOverwriteMedia()
+	case common.ErrUploadInProgress:
+		return UploadInProgress()
+	case common.ErrTooManyMediaReservations, common.ErrTooManyResumableUploads:
+		return RateLimitReached()
+	case common.ErrMediaReservationsUnavailable:
+		return BadRequest("Media can't be created ahead of uploading it on this server")
+	case common.ErrMediaTooLarge, common.ErrMediaTooLargeForType:
+		return RequestTooLarge()
+	case common.ErrImageTooLarge:
+		return ImageTooLarge()
+	case common.ErrMediaEmpty:
+		return RequestTooSmall()
+	case common.ErrMediaExtensionMismatch:
+		return BadRequest("The file's extension does not match its contents")
+	case common.ErrContentTypeTooLong:
+		return BadRequest("The content type is too long")
+	case common.ErrInvalidContentType:
+		return BadRequest("The content type is not a valid MIME type")
+	case common.ErrInvalidUserId:
+		return BadRequest("The uploader's user ID is not valid")
+	case common.ErrInvalidImage:
+		return BadRequest("The uploaded image could not be read")
+	case common.ErrMediaCorrupt:
+		return BadRequest("The uploaded image is corrupt or incomplete")
+	case common.ErrSvgSanitizeFailed:
+		return BadRequest("The uploaded SVG could not be read")
+	case common.ErrMetadataStripFailed:
+		return BadRequest("Unable to process the uploaded file")
+	case common.ErrInvalidThumbnailSize:
+		return BadRequest("Requested thumbnail size is not allowed")
+	case common.ErrThumbnailQueueFull:
+		return TooBusy()
+	case common.ErrRemoteMediaTimeout:
+		return RemoteTimeout()
+	case common.ErrQuotaExceeded:
+		return QuotaExceeded()
+	case common.ErrShuttingDown:
+		return ShuttingDown()
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func TestKnownErrorResponse(t *testing.T) {
+	tests := []struct {
+		err                  error
+		expectedCode         string
+		expectedInternalCode string
+	}{
+		{err: common.ErrMediaNotFound, expectedCode: common.ErrCodeNotFound, expectedInternalCode: common.ErrCodeNotFound},
+		{err: common.ErrMediaQuarantined, expectedCode: common.ErrCodeForbidden, expectedInternalCode: common.ErrCodeForbidden},
+		{err: common.ErrMediaBlocked, expectedCode: common.ErrCodeForbidden, expectedInternalCode: common.ErrCodeForbidden},
+		{err: common.ErrMediaInfected, expectedCode: common.ErrCodeForbidden, expectedInternalCode: common.ErrCodeForbidden},
+		{err: common.ErrMediaTypeDenied, expectedCode: common.ErrCodeForbidden, expectedInternalCode: common.ErrCodeForbidden},
+		{err: common.ErrMediaTooLarge, expectedCode: common.ErrCodeTooLarge, expectedInternalCode: common.ErrCodeMediaTooLarge},
+		{err: common.ErrMediaTooLargeForType, expectedCode: common.ErrCodeTooLarge, expectedInternalCode: common.ErrCodeMediaTooLarge},
+		{err: common.ErrImageTooLarge, expectedCode: common.ErrCodeTooLarge, expectedInternalCode: common.ErrCodeMediaTooLarge},
+		{err: common.ErrMediaEmpty, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeMediaTooSmall},
+		{err: common.ErrMediaExtensionMismatch, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeBadRequest},
+		{err: common.ErrInvalidContentType, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeBadRequest},
+		{err: common.ErrMediaCorrupt, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeBadRequest},
+		{err: common.ErrThumbnailQueueFull, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeTooBusy},
+		{err: common.ErrRemoteMediaTimeout, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeRemoteTimeout},
+		{err: common.ErrQuotaExceeded, expectedCode: common.ErrCodeForbidden, expectedInternalCode: common.ErrCodeQuotaExceeded},
+		{err: common.ErrShuttingDown, expectedCode: common.ErrCodeUnknown, expectedInternalCode: common.ErrCodeShuttingDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			res := KnownErrorResponse(tt.err)
+			if res == nil {
+				t.Fatal("no response for a known error")
+			}
+			if res.Code != tt.expectedCode || res.InternalCode != tt.expectedInternalCode {
+				t.Errorf("got response %s/%s, expected %s/%s", res.Code, res.InternalCode, tt.expectedCode, tt.expectedInternalCode)
+			}
+		})
+	}
+}
+
+func TestKnownErrorResponseUnknownError(t *testing.T) {
+	tests := []error{
+		errors.New("something went wrong"),
+		nil,
+	}
+	for _, err := range tests {
+		if res := KnownErrorResponse(err); res != nil {
+			t.Errorf("got %+v for %v, expected nil", res, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package r0
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+type MediaCreatedResponse struct {
+	ContentUri      string `json:"content_uri"`
+	UnusedExpiresAt int64  `json:"unused_expires_at"`
+}
+
+func CreateMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	if !rctx.Config.Uploads.Reservations.Enabled {
+		return api.UnrecognizedRequest()
+	}
+	if upload_controller.IsReadOnly() {
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	mediaId, expiresTs, err := upload_controller.CreateMediaReservation(user.UserId, r.Host, rctx)
+	if err != nil {
+		if resp := api.KnownErrorResponse(err); resp != nil {
+			return resp
+		}
+		rctx.Log.Error("Unexpected error reserving media: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return &MediaCreatedResponse{
+		ContentUri:      (&types.Media{Origin: r.Host, MediaId: mediaId}).MxcUri(),
+		UnusedExpiresAt: expiresTs,
+	}
+}
+
+func UploadReservedMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Reservations.Enabled {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.UnrecognizedRequest()
+	}
+
+	params := mux.Vars(r)
+	server := params["server"]
+	mediaId := params["mediaId"]
+	filename := filepath.Base(r.URL.Query().Get("filename"))
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"server":   server,
+		"mediaId":  mediaId,
+		"filename": filename,
+	})
+
+	if server != r.Host {
+		// Media can only be reserved on this server, so there can't be a reservation to fill
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.KnownErrorResponse(common.ErrMediaReservationNotFound)
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	if resp := rejectUpload(r, rctx, user, contentLength); resp != nil {
+		return resp
+	}
+
+	err := upload_controller.ValidateUploadMetadata(contentType, user.UserId, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return UploadErrorResponse(err, rctx)
+	}
+
+	media, err := upload_controller.UploadMediaToReservation(r.Body, contentType, filename, user.UserId, server, mediaId, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return UploadErrorResponse(err, rctx)
+	}
+	if contentLength < 0 {
+		// We couldn't count the upload's size before it was stored, so count it now
+		ratelimit.TakeUploadBytes(rctx, user.UserId, r.RemoteAddr, media.SizeBytes)
+	}
+
+	return &api.EmptyResponse{}
+}
@@ -3,8 +3,12 @@ package r0
 import (
 	"github.com/getsentry/sentry-go"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -12,6 +16,13 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
 type DownloadMediaResponse struct {
@@ -20,6 +31,23 @@ type DownloadMediaResponse struct {
 	SizeBytes         int64
 	Data              io.ReadCloser
 	TargetDisposition string
+	Sha256Hash        string // used for the ETag, if set
+	VaryAccept        bool   // true if the response depends on the Accept header
+}
+
+// getMedia is swapped out by tests
+var getMedia = download_controller.GetMedia
+
+// findMedia is swapped out by tests
+var findMedia = download_controller.FindMediaRecord
+
+// presignDownload is swapped out by tests
+var presignDownload = func(media *types.Media, expiry time.Duration, disposition string, ctx rcontext.RequestContext) (string, error) {
+	ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+	if err != nil {
+		return "", err
+	}
+	return ds.PresignDownload(media, expiry, disposition)
 }
 
 func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
@@ -55,29 +83,234 @@ func DownloadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserI
 		"allowRemote": downloadRemote,
 	})
 
-	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, false, rctx)
+	// Other homeservers are limited separately from users, by their IP address and verified server name
+	federated := isFederationRequest(user, server, downloadRemote)
+	requestingServer := ""
+	if federated {
+		server, wait := limitFederationRequest(r, rctx)
+		if wait > 0 {
+			return api.RateLimitReachedRetryAfter(wait)
+		}
+		requestingServer = server
+	}
+	if requiresAccessToken(user, requestingServer, rctx) {
+		return api.MissingToken()
+	}
+
+	if r.Method == http.MethodHead {
+		if resp := headMedia(r, rctx, server, mediaId, filename, targetDisposition, downloadRemote); resp != nil {
+			return resp
+		}
+	}
+
+	if rctx.Config.Downloads.RedirectToDatastore {
+		// The redirect is decided from the record alone so that we don't open a stream we won't use
+		media, err := findMedia(server, mediaId, downloadRemote, rctx)
+		if err == nil && !media.Quarantined && !shouldTranscodeHeif(r, media.ContentType, rctx) {
+			if filename == "" {
+				filename = media.UploadName
+			}
+			if redirect := redirectToDatastore(media, filename, downloadDisposition(media.ContentType, media.Sanitized, targetDisposition), rctx); redirect != nil {
+				return redirect
+			}
+		}
+	}
+
+	streamedMedia, err := getMedia(server, mediaId, downloadRemote, false, rctx)
 	if err != nil {
-		if err == common.ErrMediaNotFound {
-			return api.NotFoundError()
-		} else if err == common.ErrMediaTooLarge {
-			return api.RequestTooLarge()
-		} else if err == common.ErrMediaQuarantined {
-			return api.NotFoundError() // We lie for security
+		return downloadErrorResponse(err, rctx)
+	}
+
+	if federated {
+		if wait := ratelimit.TakeFederationBytes(rctx, requestingServer, r.RemoteAddr, streamedMedia.SizeBytes); wait > 0 {
+			cleanup.DumpAndCloseStream(streamedMedia.Stream)
+			return api.RateLimitReachedRetryAfter(wait)
 		}
-		rctx.Log.Error("Unexpected error locating media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
 	}
 
 	if filename == "" {
 		filename = streamedMedia.UploadName
 	}
 
+	// Remote media which has only just been downloaded has no record yet, so can't be sanitized
+	sanitized := streamedMedia.KnownMedia != nil && streamedMedia.KnownMedia.Sanitized
+	targetDisposition = downloadDisposition(streamedMedia.ContentType, sanitized, targetDisposition)
+
+	varyAccept := isHeifTranscodable(streamedMedia.ContentType, rctx)
+	if shouldTranscodeHeif(r, streamedMedia.ContentType, rctx) {
+		return transcodeHeifDownload(streamedMedia, filename, targetDisposition, rctx)
+	}
+
+	sha256hash := ""
+	if streamedMedia.KnownMedia != nil && !streamedMedia.KnownMedia.Quarantined {
+		// Quarantined media is replaced, so it isn't the same content as the hash
+		sha256hash = streamedMedia.KnownMedia.Sha256Hash
+	}
+
 	return &DownloadMediaResponse{
 		ContentType:       streamedMedia.ContentType,
 		Filename:          filename,
 		SizeBytes:         streamedMedia.SizeBytes,
 		Data:              streamedMedia.Stream,
 		TargetDisposition: targetDisposition,
+		Sha256Hash:        sha256hash,
+		VaryAccept:        varyAccept,
+	}
+}
+
+// headMedia answers a HEAD request using the media's record, without reading the file. Nil is
+// returned if the response depends on the file's contents (such as when it would be transcoded or
+// replaced), in which case the download happens as normal and the body is left out of the response.
+func headMedia(r *http.Request, rctx rcontext.RequestContext, server string, mediaId string, filename string, targetDisposition string, downloadRemote bool) interface{} {
+	media, err := findMedia(server, mediaId, downloadRemote, rctx)
+	if err != nil {
+		return downloadErrorResponse(err, rctx)
+	}
+	if media.Quarantined || shouldTranscodeHeif(r, media.ContentType, rctx) {
+		return nil
+	}
+
+	if filename == "" {
+		filename = media.UploadName
+	}
+
+	return &DownloadMediaResponse{
+		ContentType:       media.ContentType,
+		Filename:          filename,
+		SizeBytes:         media.SizeBytes,
+		Data:              util.BytesToStream(nil),
+		TargetDisposition: downloadDisposition(media.ContentType, media.Sanitized, targetDisposition),
+		Sha256Hash:        media.Sha256Hash,
+		VaryAccept:        isHeifTranscodable(media.ContentType, rctx),
+	}
+}
+
+func downloadErrorResponse(err error, rctx rcontext.RequestContext) interface{} {
+	if err == common.ErrMediaQuarantined {
+		return api.NotFoundError() // We lie for security
+	} else if err == common.ErrRemoteDownloadQueueFull {
+		return api.RemoteDownloadsBusy()
+	} else if resp := api.KnownErrorResponse(err); resp != nil {
+		return resp
+	}
+	rctx.Log.Error("Unexpected error locating media: " + err.Error())
+	sentry.CaptureException(err)
+	return api.InternalServerError("Unexpected Error")
+}
+
+// downloadDisposition returns the disposition to serve the media with. SVGs can run scripts, so are
+// only shown inline if the file was produced by the SVG sanitizer.
+func downloadDisposition(contentType string, sanitized bool, targetDisposition string) string {
+	if util.IsSvgContentType(contentType) && !sanitized {
+		return "attachment"
+	}
+	return targetDisposition
+}
+
+// isHeifTranscodable determines if media of the content type is converted to a JPEG for clients
+// which don't list HEIF/HEIC in their Accept header, as they probably can't display it.
+func isHeifTranscodable(contentType string, rctx rcontext.RequestContext) bool {
+	heifConf := rctx.Config.Thumbnails.Heif
+	return heifConf.TranscodeDownloads && u.HeifDecoderEnabled(heifConf) && u.IsHeifContentType(contentType)
+}
+
+// shouldTranscodeHeif determines if the media should be converted to a JPEG for this request.
+func shouldTranscodeHeif(r *http.Request, contentType string, rctx rcontext.RequestContext) bool {
+	return isHeifTranscodable(contentType, rctx) && !util.AcceptsContentType(r.Header.Get("Accept"), contentType)
+}
+
+// transcodeHeifDownload serves HEIF/HEIC media converted to a JPEG, which is stored so that the
+// media is only converted once. The original is served if the media is too large to convert or
+// the conversion fails.
+func transcodeHeifDownload(media *types.MinimalMedia, filename string, targetDisposition string, rctx rcontext.RequestContext) interface{} {
+	original := &DownloadMediaResponse{
+		ContentType:       media.ContentType,
+		Filename:          filename,
+		SizeBytes:         media.SizeBytes,
+		Data:              media.Stream,
+		TargetDisposition: targetDisposition,
+		VaryAccept:        true,
+	}
+
+	maxBytes := rctx.Config.Thumbnails.MaxSourceBytes
+	if maxBytes > 0 && media.SizeBytes > maxBytes {
+		rctx.Log.Info("HEIF media is too large to transcode - serving the original")
+		return original
+	}
+
+	if media.KnownMedia != nil {
+		transcoded, err := thumbnail_controller.GetHeifTranscode(media.KnownMedia, rctx)
+		if err != nil {
+			rctx.Log.Warn("Error transcoding HEIF media - serving the original: ", err)
+			sentry.CaptureException(err)
+			return original
+		}
+		cleanup.DumpAndCloseStream(media.Stream)
+		return &DownloadMediaResponse{
+			ContentType:       transcoded.Thumbnail.ContentType,
+			Filename:          jpegFilename(filename),
+			SizeBytes:         transcoded.Thumbnail.SizeBytes,
+			Data:              transcoded.Stream,
+			TargetDisposition: targetDisposition,
+			VaryAccept:        true,
+		}
+	}
+
+	// Remote media which has only just been downloaded doesn't have a record to store the
+	// converted file against, so it is converted without being stored
+	b, err := ioutil.ReadAll(media.Stream)
+	cleanup.DumpAndCloseStream(media.Stream)
+	if err != nil {
+		rctx.Log.Error("Error reading media to transcode: ", err)
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	original.Data = util.BytesToStream(b)
+
+	jpg, err := u.TranscodeHeifToJpeg(b, rctx.Config.Thumbnails.Heif, u.ParseBackgroundColor(rctx.Config.Thumbnails.BackgroundColor))
+	if err != nil {
+		rctx.Log.Warn("Error transcoding HEIF media - serving the original: ", err)
+		sentry.CaptureException(err)
+		return original
+	}
+
+	return &DownloadMediaResponse{
+		ContentType:       "image/jpeg",
+		Filename:          jpegFilename(filename),
+		SizeBytes:         int64(len(jpg)),
+		Data:              util.BytesToStream(jpg),
+		TargetDisposition: targetDisposition,
+		VaryAccept:        true,
+	}
+}
+
+// jpegFilename replaces the filename's extension for media converted to a JPEG.
+func jpegFilename(filename string) string {
+	if ext := path.Ext(filename); ext != "" {
+		return strings.TrimSuffix(filename, ext) + ".jpg"
+	}
+	return filename
+}
+
+// redirectToDatastore sends the client to a presigned URL for the media in its datastore, if the
+// datastore supports it. Nil is returned if the media should be proxied instead.
+func redirectToDatastore(media *types.Media, filename string, targetDisposition string, rctx rcontext.RequestContext) *api.HeadersResponse {
+	disposition := api.ContentDisposition(rctx.Config.Downloads.InlineContentTypes, media.ContentType, filename, targetDisposition)
+	expiry := time.Duration(rctx.Config.Downloads.RedirectExpirySeconds) * time.Second
+	signedUrl, err := presignDownload(media, expiry, disposition, rctx)
+	if err != nil {
+		if err != datastore.ErrPresignUnsupported {
+			rctx.Log.Warn("Error presigning download, proxying instead: ", err)
+			sentry.CaptureException(err)
+		}
+		return nil
+	}
+
+	return &api.HeadersResponse{
+		StatusCode: http.StatusFound,
+		Headers: map[string]string{
+			"Location":      signedUrl,
+			"Cache-Control": "no-store", // the URL expires
+		},
 	}
 }
@@ -0,0 +1,433 @@
+package r0
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestDownloadQuarantined(t *testing.T) {
+	defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+		getMedia = original
+	}(getMedia)
+	getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+		return nil, common.ErrMediaQuarantined
+	}
+
+	r := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc", nil)
+	r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+	res := DownloadMedia(r, testContext(), api.UserInfo{})
+
+	errRes, ok := res.(*api.ErrorResponse)
+	if !ok || errRes.InternalCode != common.ErrCodeNotFound {
+		t.Errorf("got %#v, expected quarantined media to be not found", res)
+	}
+}
+
+func TestDownloadRequiresAccessToken(t *testing.T) {
+	defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+		getMedia = original
+	}(getMedia)
+	getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+		return &types.MinimalMedia{
+			Origin:      origin,
+			MediaId:     mediaId,
+			ContentType: "text/plain",
+			SizeBytes:   4,
+			Stream:      ioutil.NopCloser(bytes.NewReader([]byte("test"))),
+		}, nil
+	}
+
+	tests := []struct {
+		name          string
+		userId        string
+		allowLegacy   bool
+		query         string
+		expectedError bool
+	}{
+		{name: "authenticated", userId: "@alice:example.org"},
+		{name: "authenticated without legacy access", userId: "@alice:example.org", allowLegacy: false},
+		{name: "anonymous with legacy access", allowLegacy: true},
+		{name: "anonymous without legacy access", allowLegacy: false, expectedError: true},
+		{name: "unverified homeserver", allowLegacy: false, query: "?allow_remote=false", expectedError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Features.MSC3916AuthedMedia.AllowLegacyUnauthenticated = tt.allowLegacy
+
+			r := httptest.NewRequest("GET", "/_matrix/client/v1/media/download/example.org/abc"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+			res := DownloadMedia(r, ctx, api.UserInfo{UserId: tt.userId})
+
+			if tt.expectedError {
+				errRes, ok := res.(*api.ErrorResponse)
+				if !ok || errRes.Code != common.ErrCodeMissingToken {
+					t.Errorf("got %#v, expected a missing token error", res)
+				}
+				return
+			}
+			if _, ok := res.(*DownloadMediaResponse); !ok {
+				t.Errorf("got %#v, expected a download", res)
+			}
+		})
+	}
+}
+
+func TestDownloadRedirectToDatastore(t *testing.T) {
+	media := &types.Media{
+		Origin:      "example.org",
+		MediaId:     "abc",
+		UploadName:  "cat.png",
+		ContentType: "image/png",
+		SizeBytes:   4,
+		DatastoreId: "s3",
+		Location:    "ab/cd/efgh",
+	}
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		presignErr    error
+		quarantined   bool
+		transcodeHeif bool
+		wantRedirect  bool
+	}{
+		{name: "presigned", enabled: true, wantRedirect: true},
+		{name: "disabled", enabled: false},
+		{name: "datastore can't presign", enabled: true, presignErr: datastore.ErrPresignUnsupported},
+		{name: "quarantined", enabled: true, quarantined: true},
+		{name: "heif converted for the client", enabled: true, transcodeHeif: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+				getMedia = original
+			}(getMedia)
+			defer func(original func(string, string, bool, rcontext.RequestContext) (*types.Media, error)) {
+				findMedia = original
+			}(findMedia)
+			defer func(original func(*types.Media, time.Duration, string, rcontext.RequestContext) (string, error)) {
+				presignDownload = original
+			}(presignDownload)
+
+			record := *media
+			record.Quarantined = tt.quarantined
+			known := &record
+			if tt.transcodeHeif {
+				record.ContentType = "image/heic"
+				known = nil // converted without being stored, so the database isn't needed
+			}
+			findMedia = func(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.Media, error) {
+				return &record, nil
+			}
+			var gotDisposition string
+			var gotExpiry time.Duration
+			presignDownload = func(media *types.Media, expiry time.Duration, disposition string, ctx rcontext.RequestContext) (string, error) {
+				gotDisposition = disposition
+				gotExpiry = expiry
+				if tt.presignErr != nil {
+					return "", tt.presignErr
+				}
+				return "https://s3.example.org/bucket/ab/cd/efgh?X-Amz-Signature=abc", nil
+			}
+			streamOpened := false
+			getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+				streamOpened = true
+				if record.Quarantined {
+					return nil, common.ErrMediaQuarantined
+				}
+				return &types.MinimalMedia{
+					Origin:      record.Origin,
+					MediaId:     record.MediaId,
+					UploadName:  record.UploadName,
+					ContentType: record.ContentType,
+					SizeBytes:   record.SizeBytes,
+					Stream:      ioutil.NopCloser(bytes.NewReader([]byte("test"))),
+					KnownMedia:  known,
+				}, nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Downloads.RedirectToDatastore = tt.enabled
+			ctx.Config.Downloads.RedirectExpirySeconds = 300
+			ctx.Config.Downloads.InlineContentTypes = []string{"image/*"}
+			if tt.transcodeHeif {
+				ctx.Config.Thumbnails.Heif.Decoder = "heif-convert"
+				ctx.Config.Thumbnails.Heif.BinaryPath = "/nonexistent/heif-convert"
+				ctx.Config.Thumbnails.Heif.TranscodeDownloads = true
+			}
+
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc", nil)
+			r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+			res := DownloadMedia(r, ctx, api.UserInfo{})
+
+			if !tt.wantRedirect {
+				if _, ok := res.(*api.HeadersResponse); ok {
+					t.Fatalf("got %#v, expected the download to be proxied", res)
+				}
+				if !streamOpened {
+					t.Error("expected the media to be streamed")
+				}
+				return
+			}
+
+			redirect, ok := res.(*api.HeadersResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected a redirect", res)
+			}
+			if streamOpened {
+				t.Error("expected the redirect to be decided without opening a stream")
+			}
+			if redirect.StatusCode != http.StatusFound {
+				t.Errorf("got status %d, expected %d", redirect.StatusCode, http.StatusFound)
+			}
+			if redirect.Headers["Location"] != "https://s3.example.org/bucket/ab/cd/efgh?X-Amz-Signature=abc" {
+				t.Errorf("got Location %q, expected the presigned URL", redirect.Headers["Location"])
+			}
+			if gotDisposition != "inline; filename=cat.png" {
+				t.Errorf("got disposition %q, expected the upload name to be kept", gotDisposition)
+			}
+			if gotExpiry != 5*time.Minute {
+				t.Errorf("got expiry %s, expected 5m", gotExpiry)
+			}
+		})
+	}
+}
+
+func TestDownloadHeifTranscode(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+
+	// The decoded image is a 32x16 PNG with a transparent left half and a blue right half
+	dir := t.TempDir()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 16))
+	for x := 16; x < 32; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.NRGBA{B: 0xff, A: 0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded := path.Join(dir, "decoded.png")
+	if err := ioutil.WriteFile(decoded, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stand in for heif-convert, called as: heif-convert input.heic output.png
+	binary := path.Join(dir, "heif-convert")
+	script := "#!/bin/sh\ngrep -q ftypheic \"$1\" || exit 1\ncp " + decoded + " \"$2\"\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		transcode        bool
+		binaryPath       string
+		accept           string
+		expectedType     string
+		expectedFilename string
+		expectedBody     string // or empty if a jpeg is expected
+		expectedVary     bool
+	}{
+		{name: "client accepts heic", transcode: true, binaryPath: binary, accept: "image/heic, image/*;q=0.8", expectedType: "image/heic", expectedFilename: "photo.heic", expectedBody: string(heic), expectedVary: true},
+		{name: "client doesn't accept heic", transcode: true, binaryPath: binary, accept: "image/png, image/*;q=0.8", expectedType: "image/jpeg", expectedFilename: "photo.jpg", expectedVary: true},
+		{name: "decoder fails", transcode: true, binaryPath: "/nonexistent/heif-convert", expectedType: "image/heic", expectedFilename: "photo.heic", expectedBody: string(heic), expectedVary: true},
+		{name: "transcoding disabled", transcode: false, binaryPath: binary, expectedType: "image/heic", expectedFilename: "photo.heic", expectedBody: string(heic)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+				getMedia = original
+			}(getMedia)
+			getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+				// Without a record, the converted file isn't stored
+				return &types.MinimalMedia{
+					Origin:      origin,
+					MediaId:     mediaId,
+					UploadName:  "photo.heic",
+					ContentType: "image/heic",
+					SizeBytes:   int64(len(heic)),
+					Stream:      ioutil.NopCloser(bytes.NewReader(heic)),
+				}, nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Thumbnails.Heif.Decoder = "heif-convert"
+			ctx.Config.Thumbnails.Heif.BinaryPath = tt.binaryPath
+			ctx.Config.Thumbnails.Heif.TimeoutSeconds = 5
+			ctx.Config.Thumbnails.Heif.TranscodeDownloads = tt.transcode
+			ctx.Config.Thumbnails.BackgroundColor = "#ff0000"
+
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc", nil)
+			r.Header.Set("Accept", tt.accept)
+			r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+			res, ok := DownloadMedia(r, ctx, api.UserInfo{}).(*DownloadMediaResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected a download", res)
+			}
+
+			if res.ContentType != tt.expectedType {
+				t.Errorf("got content type %s, expected %s", res.ContentType, tt.expectedType)
+			}
+			if res.Filename != tt.expectedFilename {
+				t.Errorf("got filename %s, expected %s", res.Filename, tt.expectedFilename)
+			}
+			if res.VaryAccept != tt.expectedVary {
+				t.Errorf("got VaryAccept = %t, expected %t", res.VaryAccept, tt.expectedVary)
+			}
+			b, err := ioutil.ReadAll(res.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expectedBody != "" && string(b) != tt.expectedBody {
+				t.Errorf("got body %q, expected %q", b, tt.expectedBody)
+			}
+			if tt.expectedBody == "" {
+				converted, err := jpeg.Decode(bytes.NewReader(b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// JPEG is lossy, so the colors are only checked roughly
+				if r, g, b, _ := converted.At(4, 8).RGBA(); r < 0xc000 || g > 0x4000 || b > 0x4000 {
+					t.Errorf("got (%d, %d, %d) for the transparent pixel, expected the red background", r, g, b)
+				}
+				if r, g, b, _ := converted.At(27, 8).RGBA(); r > 0x4000 || g > 0x4000 || b < 0xc000 {
+					t.Errorf("got (%d, %d, %d) for the opaque pixel, expected it to stay blue", r, g, b)
+				}
+			}
+			if res.SizeBytes != int64(len(b)) {
+				t.Errorf("got size %d, expected %d", res.SizeBytes, len(b))
+			}
+		})
+	}
+}
+
+func TestDownloadHead(t *testing.T) {
+	tests := []struct {
+		name             string
+		contentType      string
+		quarantined      bool
+		findErr          error
+		expectedStreamed bool
+		expectedCode     string // or empty if a download is expected
+	}{
+		{name: "from the record", contentType: "image/png"},
+		{name: "not found", contentType: "image/png", findErr: common.ErrMediaNotFound, expectedCode: common.ErrCodeNotFound},
+		{name: "quarantined", contentType: "image/png", quarantined: true, expectedStreamed: true, expectedCode: common.ErrCodeNotFound},
+		{name: "heif converted for the client", contentType: "image/heic", expectedStreamed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+				getMedia = original
+			}(getMedia)
+			defer func(original func(string, string, bool, rcontext.RequestContext) (*types.Media, error)) {
+				findMedia = original
+			}(findMedia)
+
+			record := &types.Media{
+				Origin:      "example.org",
+				MediaId:     "abc",
+				UploadName:  "cat.png",
+				ContentType: tt.contentType,
+				SizeBytes:   4,
+				Sha256Hash:  "0123456789abcdef",
+				Quarantined: tt.quarantined,
+			}
+			findMedia = func(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.Media, error) {
+				if tt.findErr != nil {
+					return nil, tt.findErr
+				}
+				return record, nil
+			}
+			streamed := false
+			getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+				streamed = true
+				if record.Quarantined {
+					return nil, common.ErrMediaQuarantined
+				}
+				// Without a record, the converted file isn't stored
+				return &types.MinimalMedia{
+					Origin:      origin,
+					MediaId:     mediaId,
+					UploadName:  record.UploadName,
+					ContentType: record.ContentType,
+					SizeBytes:   record.SizeBytes,
+					Stream:      ioutil.NopCloser(bytes.NewReader([]byte("test"))),
+				}, nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Thumbnails.Heif.Decoder = "heif-convert"
+			ctx.Config.Thumbnails.Heif.BinaryPath = "/nonexistent/heif-convert"
+			ctx.Config.Thumbnails.Heif.TranscodeDownloads = true
+
+			r := httptest.NewRequest(http.MethodHead, "/_matrix/media/r0/download/example.org/abc", nil)
+			r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+			res := DownloadMedia(r, ctx, api.UserInfo{})
+
+			if streamed != tt.expectedStreamed {
+				t.Errorf("got streamed = %t, expected %t", streamed, tt.expectedStreamed)
+			}
+			if tt.expectedCode != "" {
+				errRes, ok := res.(*api.ErrorResponse)
+				if !ok || errRes.InternalCode != tt.expectedCode {
+					t.Errorf("got %#v, expected an error with code %s", res, tt.expectedCode)
+				}
+				return
+			}
+			download, ok := res.(*DownloadMediaResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected a download", res)
+			}
+			if tt.expectedStreamed {
+				return
+			}
+			if download.ContentType != record.ContentType || download.SizeBytes != record.SizeBytes || download.Filename != record.UploadName || download.Sha256Hash != record.Sha256Hash {
+				t.Errorf("got %+v, expected the headers from the record", download)
+			}
+		})
+	}
+}
+
+func TestDownloadDisposition(t *testing.T) {
+	tests := []struct {
+		name                string
+		contentType         string
+		sanitized           bool
+		targetDisposition   string
+		expectedDisposition string
+	}{
+		{name: "unsanitized svg", contentType: "image/svg+xml", sanitized: false, targetDisposition: "inline", expectedDisposition: "attachment"},
+		{name: "sanitized svg", contentType: "image/svg+xml", sanitized: true, targetDisposition: "inline", expectedDisposition: "inline"},
+		{name: "svg with parameters", contentType: "image/svg+xml; charset=utf-8", sanitized: false, targetDisposition: "inline", expectedDisposition: "attachment"},
+		{name: "png", contentType: "image/png", sanitized: false, targetDisposition: "inline", expectedDisposition: "inline"},
+		{name: "attachment", contentType: "image/svg+xml", sanitized: true, targetDisposition: "attachment", expectedDisposition: "attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disposition := downloadDisposition(tt.contentType, tt.sanitized, tt.targetDisposition)
+			if disposition != tt.expectedDisposition {
+				t.Errorf("got %q, expected %q", disposition, tt.expectedDisposition)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package r0
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/matrix"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// verifyFederationRequest is swapped out by tests
+var verifyFederationRequest = matrix.VerifyFederationRequest
+
+// isFederationRequest determines if the request looks like it is from another homeserver fetching
+// our media for its users. Homeservers don't send access tokens for media, and ask for remote media
+// not to be downloaded on their behalf. Anyone can do the same, so this is only used to apply the
+// federation rate limits; see getRequestingServer for who actually sent the request.
+func isFederationRequest(user api.UserInfo, server string, downloadRemote bool) bool {
+	return user.UserId == "" && !downloadRemote && util.IsServerOurs(server)
+}
+
+// requiresAccessToken determines if an unauthenticated download or thumbnail request has to be
+// rejected because the legacy endpoints no longer serve clients without an access token (MSC3916).
+// Other homeservers are still allowed once their X-Matrix signature is verified, as they don't send
+// one. Anything else claiming to be a homeserver, such as with allow_remote=false, is not exempt.
+func requiresAccessToken(user api.UserInfo, verifiedServer string, rctx rcontext.RequestContext) bool {
+	return user.UserId == "" && verifiedServer == "" && !rctx.Config.Features.MSC3916AuthedMedia.AllowLegacyUnauthenticated
+}
+
+// getRequestingServer returns the origin from the request's X-Matrix Authorization header once its
+// signature has been verified, or an empty string if there isn't one or it can't be verified. Until
+// the origin is verified, requests can only be limited by IP address.
+func getRequestingServer(r *http.Request, rctx rcontext.RequestContext) string {
+	origin, err := verifyFederationRequest(r, rctx)
+	if err != nil {
+		if err != matrix.ErrNoFederationAuth {
+			rctx.Log.Warn("Unable to verify X-Matrix authorization: ", err)
+		}
+		return ""
+	}
+	return origin
+}
+
+// limitFederationRequest applies the federation rate limits to the request, returning the verified
+// requesting server and how long to wait before trying again if a limit has been reached. The IP
+// address is limited before the signature is checked, as checking it can mean fetching signing keys
+// from whichever server the request claims to be from.
+func limitFederationRequest(r *http.Request, rctx rcontext.RequestContext) (string, time.Duration) {
+	if wait := ratelimit.TakeFederationRequest(rctx, "", r.RemoteAddr); wait > 0 {
+		return "", wait
+	}
+
+	requestingServer := getRequestingServer(r, rctx)
+	if requestingServer != "" {
+		if wait := ratelimit.TakeFederationRequest(rctx, requestingServer, ""); wait > 0 {
+			return requestingServer, wait
+		}
+	}
+	return requestingServer, 0
+}
@@ -0,0 +1,138 @@
+package r0
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestIsFederationRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		userId         string
+		server         string
+		downloadRemote bool
+		expected       bool
+	}{
+		{name: "homeserver", server: "example.org", expected: true},
+		{name: "user", userId: "@alice:example.org", server: "example.org"},
+		{name: "allowing remote", server: "example.org", downloadRemote: true},
+		{name: "remote media", server: "remote.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFederationRequest(api.UserInfo{UserId: tt.userId}, tt.server, tt.downloadRemote); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRequiresAccessToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		userId         string
+		verifiedServer string
+		allowLegacy    bool
+		expected       bool
+	}{
+		{name: "user", userId: "@alice:example.org"},
+		{name: "verified homeserver", verifiedServer: "remote.org"},
+		{name: "anonymous", expected: true},
+		{name: "anonymous allowed", allowLegacy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := rcontext.RequestContext{}
+			rctx.Config.Features.MSC3916AuthedMedia.AllowLegacyUnauthenticated = tt.allowLegacy
+			if got := requiresAccessToken(api.UserInfo{UserId: tt.userId}, tt.verifiedServer, rctx); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetRequestingServerUnverified(t *testing.T) {
+	// Verified requests need the origin's signing keys, which the matrix package tests cover
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	rctx := rcontext.RequestContext{Context: context.Background(), Log: logrus.NewEntry(logger)}
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "no authorization", header: ""},
+		{name: "access token", header: "Bearer abc123"},
+		{name: "invalid x-matrix", header: "X-Matrix origin=remote.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc123", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := getRequestingServer(r, rctx); got != "" {
+				t.Errorf("got %q, expected no server", got)
+			}
+		})
+	}
+}
+
+func TestLimitFederationRequest(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	rctx := rcontext.RequestContext{Context: context.Background(), Log: logrus.NewEntry(logger)}
+	rctx.Config.Downloads.FederationRateLimit.Enabled = true
+	rctx.Config.Downloads.FederationRateLimit.IntervalSeconds = 3600
+	rctx.Config.Downloads.FederationRateLimit.RequestsPerInterval = 2
+
+	verified := 0
+	defer func(original func(*http.Request, rcontext.RequestContext) (string, error)) {
+		verifyFederationRequest = original
+	}(verifyFederationRequest)
+	verifyFederationRequest = func(r *http.Request, rctx rcontext.RequestContext) (string, error) {
+		verified++
+		return r.Header.Get("X-Test-Origin"), nil
+	}
+
+	tests := []struct {
+		name             string
+		ip               string
+		origin           string
+		expectedServer   string
+		expectedLimited  bool
+		expectedVerified int
+	}{
+		{name: "first request", ip: "192.0.2.1:1000", origin: "limit-1.example.org", expectedServer: "limit-1.example.org", expectedVerified: 1},
+		{name: "second request", ip: "192.0.2.1:1000", origin: "limit-2.example.org", expectedServer: "limit-2.example.org", expectedVerified: 2},
+		// The signature isn't checked once the IP address is over its limit
+		{name: "ip over the limit", ip: "192.0.2.1:1000", origin: "limit-3.example.org", expectedLimited: true, expectedVerified: 2},
+		{name: "another ip", ip: "192.0.2.2:1000", origin: "limit-1.example.org", expectedServer: "limit-1.example.org", expectedVerified: 3},
+		{name: "server over the limit", ip: "192.0.2.3:1000", origin: "limit-1.example.org", expectedServer: "limit-1.example.org", expectedLimited: true, expectedVerified: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc123", nil)
+			r.RemoteAddr = tt.ip
+			r.Header.Set("X-Test-Origin", tt.origin)
+
+			server, wait := limitFederationRequest(r, rctx)
+			if server != tt.expectedServer {
+				t.Errorf("got server %q, expected %q", server, tt.expectedServer)
+			}
+			if (wait > 0) != tt.expectedLimited {
+				t.Errorf("got wait %s, expected limited = %t", wait, tt.expectedLimited)
+			}
+			if verified != tt.expectedVerified {
+				t.Errorf("got %d verifications, expected %d", verified, tt.expectedVerified)
+			}
+		})
+	}
+}
@@ -11,8 +11,14 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
+// getThumbnail is swapped out by tests
+var getThumbnail = thumbnail_controller.GetThumbnail
+
 func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	params := mux.Vars(r)
 
@@ -84,22 +90,58 @@ func ThumbnailMedia(r *http.Request, rctx rcontext.RequestContext, user api.User
 		return api.BadRequest("Width and height must be greater than zero")
 	}
 
-	streamedThumbnail, err := thumbnail_controller.GetThumbnail(server, mediaId, width, height, animated, method, downloadRemote, rctx)
+	format := thumbnailFormat(r, rctx)
+
+	// Other homeservers are limited separately from users, by their IP address and verified server name
+	federated := isFederationRequest(user, server, downloadRemote)
+	requestingServer := ""
+	if federated {
+		server, wait := limitFederationRequest(r, rctx)
+		if wait > 0 {
+			return api.RateLimitReachedRetryAfter(wait)
+		}
+		requestingServer = server
+	}
+	if requiresAccessToken(user, requestingServer, rctx) {
+		return api.MissingToken()
+	}
+
+	streamedThumbnail, err := getThumbnail(server, mediaId, width, height, animated, method, format, downloadRemote, rctx)
 	if err != nil {
-		if err == common.ErrMediaNotFound {
-			return api.NotFoundError()
-		} else if err == common.ErrMediaTooLarge {
-			return api.RequestTooLarge()
+		if err == common.ErrMediaQuarantined {
+			return api.NotFoundError() // We lie for security
+		} else if err == common.ErrRemoteDownloadQueueFull {
+			return api.RemoteDownloadsBusy()
+		} else if resp := api.KnownErrorResponse(err); resp != nil {
+			return resp
 		}
 		rctx.Log.Error("Unexpected error locating media: " + err.Error())
 		sentry.CaptureException(err)
 		return api.InternalServerError("Unexpected Error")
 	}
 
+	if federated {
+		if wait := ratelimit.TakeFederationBytes(rctx, requestingServer, r.RemoteAddr, streamedThumbnail.Thumbnail.SizeBytes); wait > 0 {
+			cleanup.DumpAndCloseStream(streamedThumbnail.Stream)
+			return api.RateLimitReachedRetryAfter(wait)
+		}
+	}
+
 	return &DownloadMediaResponse{
 		ContentType: streamedThumbnail.Thumbnail.ContentType,
 		SizeBytes:   streamedThumbnail.Thumbnail.SizeBytes,
 		Data:        streamedThumbnail.Stream,
-		Filename:    "thumbnail.png",
+		Filename:    "thumbnail" + util.ExtensionForContentType(streamedThumbnail.Thumbnail.ContentType),
+		Sha256Hash:  streamedThumbnail.Thumbnail.Sha256Hash,
+		VaryAccept:  rctx.Config.Thumbnails.AllowWebp,
+	}
+}
+
+// thumbnailFormat picks the format to convert thumbnails to, based upon the formats the client
+// accepts. An empty string means the thumbnail is served in the format it was generated in.
+func thumbnailFormat(r *http.Request, rctx rcontext.RequestContext) string {
+	if rctx.Config.Thumbnails.AllowWebp && util.AcceptsContentType(r.Header.Get("Accept"), "image/webp") {
+		return "webp"
 	}
+	return ""
 }
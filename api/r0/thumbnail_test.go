@@ -0,0 +1,98 @@
+package r0
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-r0-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	// Some tests need to know which servers are local
+	err = ioutil.WriteFile(config.Path, []byte("homeservers:\n  - name: example.org\n    csApi: \"https://example.org/\"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+	// Like the default config, the legacy endpoints don't need an access token
+	ctx.Config.Features.MSC3916AuthedMedia.AllowLegacyUnauthenticated = true
+	return ctx
+}
+
+func TestThumbnailFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowWebp  bool
+		accept     string
+		wantFormat string
+	}{
+		{name: "browser accepting webp", allowWebp: true, accept: "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", wantFormat: "webp"},
+		{name: "webp with a quality", allowWebp: true, accept: "image/png, image/webp;q=0.9", wantFormat: "webp"},
+		{name: "webp refused", allowWebp: true, accept: "image/webp;q=0, image/*", wantFormat: ""},
+		{name: "wildcards don't count", allowWebp: true, accept: "image/*,*/*", wantFormat: ""},
+		{name: "no accept header", allowWebp: true, accept: "", wantFormat: ""},
+		{name: "webp disabled", allowWebp: false, accept: "image/webp", wantFormat: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.AllowWebp = tt.allowWebp
+
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/thumbnail/example.org/abc?width=32&height=32", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			format := thumbnailFormat(r, ctx)
+			if format != tt.wantFormat {
+				t.Errorf("got %q, expected %q", format, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestThumbnailQuarantined(t *testing.T) {
+	defer func(original func(string, string, int, int, bool, string, string, bool, rcontext.RequestContext) (*types.StreamedThumbnail, error)) {
+		getThumbnail = original
+	}(getThumbnail)
+	getThumbnail = func(origin string, mediaId string, desiredWidth int, desiredHeight int, animated bool, method string, format string, downloadRemote bool, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+		return nil, common.ErrMediaQuarantined
+	}
+
+	r := httptest.NewRequest("GET", "/_matrix/media/r0/thumbnail/example.org/abc?width=96&height=96", nil)
+	r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+	res := ThumbnailMedia(r, testContext(), api.UserInfo{})
+
+	errRes, ok := res.(*api.ErrorResponse)
+	if !ok || errRes.InternalCode != common.ErrCodeNotFound {
+		t.Errorf("got %#v, expected quarantined media to be not found", res)
+	}
+}
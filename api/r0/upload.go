@@ -1,19 +1,24 @@
 package r0
 
 import (
+	"errors"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/api"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/info_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/metrics"
 	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
@@ -22,6 +27,12 @@ type MediaUploadedResponse struct {
 	Blurhash   string `json:"xyz.amorgan.blurhash,omitempty"`
 }
 
+type MediaUploadPendingResponse struct {
+	ContentUri string `json:"content_uri"`
+	JobId      string `json:"job_id"`
+	Status     string `json:"status"`
+}
+
 func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	filename := filepath.Base(r.URL.Query().Get("filename"))
 	defer cleanup.DumpAndCloseStream(r.Body)
@@ -35,13 +46,117 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		contentType = "application/octet-stream" // binary
 	}
 
+	// Retries of an upload which already succeeded get the original media back. The key is claimed
+	// before the upload is read so retries sent in the meantime don't create media of their own.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	existing, err := upload_controller.ClaimIdempotencyKey(user.UserId, idempotencyKey, rctx)
+	if err == common.ErrUploadInProgress {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.UploadInProgress()
+	}
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		rctx.Log.Error("Unexpected error checking idempotency key: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if existing != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "deduplicated"}).Inc()
+		return uploadedResponse(existing, r, rctx)
+	}
+
+	// If the upload doesn't create any media, the key is released so the upload can be retried
+	releaseKey := true
+	defer func() {
+		if !releaseKey {
+			return
+		}
+		if err := upload_controller.ReleaseIdempotencyKey(user.UserId, idempotencyKey, rctx); err != nil {
+			rctx.Log.Warn("Failed to release idempotency key: " + err.Error())
+			sentry.CaptureException(err)
+		}
+	}()
+
+	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
+	if resp := rejectUpload(r, rctx, user, contentLength); resp != nil {
+		return resp
+	}
+
+	err = upload_controller.ValidateUploadMetadata(contentType, user.UserId, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return UploadErrorResponse(err, rctx)
+	}
+
+	if rctx.Config.Uploads.Async.Enabled && r.URL.Query().Get("async") == "true" {
+		job, err := upload_controller.UploadMediaAsync(r.Body, contentType, filename, user.UserId, r.Host, idempotencyKey, rctx)
+		if err != nil {
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return UploadErrorResponse(err, rctx)
+		}
+		releaseKey = false // the job records or releases the key once it is done
+
+		if contentLength < 0 {
+			// We couldn't count the upload's size before it was read, so count it now
+			ratelimit.TakeUploadBytes(rctx, user.UserId, r.RemoteAddr, job.SizeBytes)
+		}
+
+		status, mxc, _ := job.Snapshot()
+		return &MediaUploadPendingResponse{
+			ContentUri: mxc,
+			JobId:      job.ID,
+			Status:     status,
+		}
+	}
+
+	media, err := upload_controller.UploadMedia(r.Body, contentLength, contentType, filename, user.UserId, r.Host, rctx)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return UploadErrorResponse(err, rctx)
+	}
+	if contentLength < 0 {
+		// We couldn't count the upload's size before it was stored, so count it now
+		ratelimit.TakeUploadBytes(rctx, user.UserId, r.RemoteAddr, media.SizeBytes)
+	}
+
+	err = upload_controller.RecordIdempotentUpload(user.UserId, idempotencyKey, media, rctx)
+	if err != nil {
+		// The upload itself succeeded, so only retries are affected
+		rctx.Log.Warn("Failed to record idempotency key: " + err.Error())
+		sentry.CaptureException(err)
+	} else {
+		releaseKey = false
+	}
+
+	return uploadedResponse(media, r, rctx)
+}
+
+// rejectUpload applies read-only mode, the rate limits, size limits, and quotas which can be checked
+// before the upload is read, returning the response to reject the upload with or nil if it can go ahead.
+func rejectUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo, contentLength int64) interface{} {
+	if upload_controller.IsReadOnly() {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	if wait := ratelimit.TakeUpload(rctx, user.UserId, r.RemoteAddr, contentLength); wait > 0 {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RateLimitReachedRetryAfter(wait)
+	}
+
 	if upload_controller.IsRequestTooLarge(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
 		return api.RequestTooLarge()
 	}
 
 	if upload_controller.IsRequestTooSmall(r.ContentLength, r.Header.Get("Content-Length"), rctx) {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
 		return api.RequestTooSmall()
 	}
 
@@ -54,24 +169,14 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 	}
 	if !inQuota {
 		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
 		return api.QuotaExceeded()
 	}
 
-	contentLength := upload_controller.EstimateContentLength(r.ContentLength, r.Header.Get("Content-Length"))
-
-	media, err := upload_controller.UploadMedia(r.Body, contentLength, contentType, filename, user.UserId, r.Host, rctx)
-	if err != nil {
-		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
-
-		if err == common.ErrMediaQuarantined {
-			return api.BadRequest("This file is not permitted on this server")
-		}
-
-		rctx.Log.Error("Unexpected error storing media: " + err.Error())
-		sentry.CaptureException(err)
-		return api.InternalServerError("Unexpected Error")
-	}
+	return nil
+}
 
+func uploadedResponse(media *types.Media, r *http.Request, rctx rcontext.RequestContext) *MediaUploadedResponse {
 	if rctx.Config.Features.MSC2448Blurhash.Enabled && r.URL.Query().Get("xyz.amorgan.generate_blurhash") == "true" {
 		hash, err := info_controller.GetOrCalculateBlurhash(media, rctx)
 		if err != nil {
@@ -89,3 +194,25 @@ func UploadMedia(r *http.Request, rctx rcontext.RequestContext, user api.UserInf
 		ContentUri: media.MxcUri(),
 	}
 }
+
+// UploadErrorResponse converts an error from the upload controller into an API response.
+func UploadErrorResponse(err error, rctx rcontext.RequestContext) *api.ErrorResponse {
+	var dsErr *common.DatastoreUnavailableError
+	if errors.As(err, &dsErr) {
+		rctx.Log.Error("Datastore " + dsErr.DatastoreId + " is unable to store media: " + err.Error())
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "failed"}).Inc()
+		if dsErr.OutOfStorage {
+			return api.InsufficientStorage()
+		}
+		return api.DatastoreUnavailable()
+	}
+
+	if resp := api.KnownErrorResponse(err); resp != nil {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return resp
+	}
+
+	rctx.Log.Error("Unexpected error storing media: " + err.Error())
+	sentry.CaptureException(err)
+	return api.InternalServerError("Unexpected Error")
+}
@@ -0,0 +1,46 @@
+package r0
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+)
+
+type UploadStatusResponse struct {
+	JobId      string `json:"job_id"`
+	Status     string `json:"status"`
+	ContentUri string `json:"content_uri,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func UploadStatus(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	params := mux.Vars(r)
+	jobId := params["jobId"]
+
+	job := upload_controller.GetUploadJob(jobId, user.UserId)
+	if job == nil {
+		return api.NotFoundError()
+	}
+
+	status, mxc, err := job.Snapshot()
+	resp := &UploadStatusResponse{
+		JobId:  job.ID,
+		Status: status,
+	}
+	if status == upload_controller.UploadJobComplete {
+		resp.ContentUri = mxc
+	}
+	if err != nil {
+		// Reuse the error message we'd have given during a regular upload. Unexpected errors
+		// were already logged by the worker.
+		resp.Error = "Unexpected Error"
+		if known := api.KnownErrorResponse(err); known != nil {
+			resp.Error = known.Message
+		}
+	}
+
+	return &api.DoNotCacheResponse{Payload: resp}
+}
@@ -0,0 +1,54 @@
+package r0
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestUploadReadOnly(t *testing.T) {
+	readOnly := true
+	upload_controller.SetReadOnly(&readOnly)
+	defer upload_controller.SetReadOnly(nil)
+
+	defer func(original func(string, string, bool, bool, rcontext.RequestContext) (*types.MinimalMedia, error)) {
+		getMedia = original
+	}(getMedia)
+	getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+		return &types.MinimalMedia{
+			Origin:      origin,
+			MediaId:     mediaId,
+			ContentType: "text/plain",
+			SizeBytes:   4,
+			Stream:      ioutil.NopCloser(bytes.NewReader([]byte("test"))),
+		}, nil
+	}
+
+	r := httptest.NewRequest("POST", "/_matrix/media/r0/upload?filename=test.txt", strings.NewReader("test"))
+	r.Header.Set("Content-Type", "text/plain")
+	res := UploadMedia(r, testContext(), api.UserInfo{UserId: "@alice:example.org"})
+	busy, ok := res.(*api.TooBusyResponse)
+	if !ok || busy.InternalCode != common.ErrCodeReadOnly {
+		t.Fatalf("got %#v, expected the upload to be rejected", res)
+	}
+	if busy.RetryAfterMs != (5 * time.Minute).Milliseconds() {
+		t.Errorf("got a retry after %dms, expected the default of 5 minutes", busy.RetryAfterMs)
+	}
+
+	r = httptest.NewRequest("GET", "/_matrix/media/r0/download/example.org/abc", nil)
+	r = mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc"})
+	res = DownloadMedia(r, testContext(), api.UserInfo{})
+	if _, ok = res.(*DownloadMediaResponse); !ok {
+		t.Errorf("got %#v, expected downloads to keep working", res)
+	}
+}
@@ -1,6 +1,11 @@
 package api
 
-import "github.com/turt2live/matrix-media-repo/common"
+import (
+	"io"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
 
 type EmptyResponse struct{}
 
@@ -12,24 +17,58 @@ type HtmlResponse struct {
 	HTML string
 }
 
+// HeadersResponse is a response without a body, consisting only of a status code and headers.
+type HeadersResponse struct {
+	StatusCode int
+	Headers    map[string]string
+}
+
+// StatusCodeResponse is a JSON response with a status code other than 200 OK.
+type StatusCodeResponse struct {
+	StatusCode int
+	Payload    interface{}
+}
+
+// StreamedResponse is a response whose body is written to the client as it is read from the stream,
+// for bodies which are generated on the fly and may be too large to buffer.
+type StreamedResponse struct {
+	ContentType string
+	Stream      io.ReadCloser
+}
+
 type ErrorResponse struct {
 	Code         string `json:"errcode"`
 	Message      string `json:"error"`
 	InternalCode string `json:"mr_errcode"`
 }
 
+type RateLimitedResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// TooBusyResponse is a 503 Service Unavailable error which tells the client when to try again.
+type TooBusyResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
 func InternalServerError(message string) *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeUnknown}
 }
 
 func MethodNotAllowed() *ErrorResponse {
-	return &ErrorResponse{common.ErrCodeUnknown, "Method Not Allowed", common.ErrCodeMethodNotAllowed}
+	return &ErrorResponse{common.ErrCodeUnrecognized, "Method Not Allowed", common.ErrCodeMethodNotAllowed}
 }
 
 func RateLimitReached() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeRateLimitExceeded, "Rate Limited", common.ErrCodeRateLimitExceeded}
 }
 
+func RateLimitReachedRetryAfter(retryAfter time.Duration) *RateLimitedResponse {
+	return &RateLimitedResponse{*RateLimitReached(), retryAfter.Milliseconds()}
+}
+
 func NotFoundError() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNotFound, "Not found", common.ErrCodeNotFound}
 }
@@ -38,10 +77,18 @@ func RequestTooLarge() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeTooLarge, "Too Large", common.ErrCodeMediaTooLarge}
 }
 
+func ImageTooLarge() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeTooLarge, "Image dimensions are too large to process", common.ErrCodeMediaTooLarge}
+}
+
 func RequestTooSmall() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, "Body too small or not provided", common.ErrCodeMediaTooSmall}
 }
 
+func MissingToken() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeMissingToken, "no token provided (required)", common.ErrCodeUnknownToken}
+}
+
 func AuthFailed() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknownToken, "Authentication Failed", common.ErrCodeUnknownToken}
 }
@@ -50,10 +97,61 @@ func GuestAuthFailed() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeNoGuests, "Guests cannot use this endpoint", common.ErrCodeNoGuests}
 }
 
+func Forbidden(message string) *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeForbidden, message, common.ErrCodeForbidden}
+}
+
+func CannotOverwriteMedia() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeCannotOverwriteMedia, "Media has already been uploaded", common.ErrCodeCannotOverwriteMedia}
+}
+
+func UploadInProgress() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "An upload with the same idempotency key is in progress", common.ErrCodeUploadInProgress}
+}
+
+func UnrecognizedRequest() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnrecognized, "Unrecognized request", common.ErrCodeUnrecognized}
+}
+
 func BadRequest(message string) *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeUnknown, message, common.ErrCodeBadRequest}
 }
 
+func InsufficientStorage() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "The server is out of storage space", common.ErrCodeInsufficientStorage}
+}
+
+func DatastoreUnavailable() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "The server is unable to store media right now", common.ErrCodeDatastoreUnavailable}
+}
+
+func TooBusy() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "The server is too busy, please try again later", common.ErrCodeTooBusy}
+}
+
+func TooBusyRetryAfter(retryAfter time.Duration) *TooBusyResponse {
+	return &TooBusyResponse{*TooBusy(), retryAfter.Milliseconds()}
+}
+
+// RemoteDownloadsBusy is returned when too many remote downloads are queued to accept another.
+func RemoteDownloadsBusy() *TooBusyResponse {
+	// Remote downloads are usually quick, so the queue should have moved along by then
+	return TooBusyRetryAfter(10 * time.Second)
+}
+
+func RemoteTimeout() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "Timed out waiting for the remote server to send the media", common.ErrCodeRemoteTimeout}
+}
+
+func ShuttingDown() *ErrorResponse {
+	return &ErrorResponse{common.ErrCodeUnknown, "The server is shutting down", common.ErrCodeShuttingDown}
+}
+
+// ReadOnly is returned for uploads while the media repo is in read-only mode.
+func ReadOnly(retryAfter time.Duration) *TooBusyResponse {
+	return &TooBusyResponse{ErrorResponse{common.ErrCodeUnknown, "The server is not accepting uploads right now, please try again later", common.ErrCodeReadOnly}, retryAfter.Milliseconds()}
+}
+
 func QuotaExceeded() *ErrorResponse {
 	return &ErrorResponse{common.ErrCodeForbidden, "Quota Exceeded", common.ErrCodeQuotaExceeded}
 }
@@ -0,0 +1,152 @@
+package unstable
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// How much of the request body may be used by everything other than the file's data
+const base64UploadOverheadBytes = 65536
+
+// The largest upload limit which can be base64-encoded without overflowing
+const maxBase64UploadLimit = (math.MaxInt32 - base64UploadOverheadBytes) / 4 * 3
+
+type Base64UploadRequest struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	Data        string `json:"data_base64"` // plain base64, or a data: URI
+}
+
+func UploadBase64Media(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if upload_controller.IsReadOnly() {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	var body io.Reader = r.Body
+	maxBodyBytes := int64(-1)
+	// Limits too large to encode can't be reached anyway, so are treated as no limit
+	if rctx.Config.Uploads.MaxSizeBytes > 0 && rctx.Config.Uploads.MaxSizeBytes <= maxBase64UploadLimit {
+		maxBodyBytes = int64(base64.StdEncoding.EncodedLen(int(rctx.Config.Uploads.MaxSizeBytes))) + base64UploadOverheadBytes
+		body = util.LimitPastMax(r.Body, maxBodyBytes)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		rctx.Log.Error("Error reading request body: " + err.Error())
+		return api.BadRequest("Error reading request body")
+	}
+	if maxBodyBytes >= 0 && int64(len(b)) > maxBodyBytes {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the rest of the request
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RequestTooLarge()
+	}
+
+	req := &Base64UploadRequest{}
+	err = json.Unmarshal(b, req)
+	if err != nil {
+		return api.BadRequest("Request body must be a JSON object")
+	}
+
+	uriType, data, ok := splitDataUri(req.Data)
+	if !ok {
+		return api.BadRequest("data_base64 must be base64 encoded")
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = uriType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+	filename := ""
+	if req.Filename != "" {
+		filename = filepath.Base(req.Filename)
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename": filename,
+	})
+
+	contentLength := int64(base64.StdEncoding.DecodedLen(len(data)) - strings.Count(data, "="))
+	if wait := ratelimit.TakeUpload(rctx, user.UserId, r.RemoteAddr, contentLength); wait > 0 {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RateLimitReachedRetryAfter(wait)
+	}
+
+	if upload_controller.IsRequestTooLarge(contentLength, "", rctx) {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RequestTooLarge()
+	}
+
+	if upload_controller.IsRequestTooSmall(contentLength, "", rctx) {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RequestTooSmall()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.QuotaExceeded()
+	}
+
+	err = upload_controller.ValidateUploadMetadata(contentType, user.UserId, rctx)
+	if err != nil {
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	// The data is decoded as it is read rather than all at once
+	decoder := ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	media, err := upload_controller.UploadMedia(decoder, contentLength, contentType, filename, user.UserId, r.Host, rctx)
+	if err != nil {
+		if _, ok := err.(base64.CorruptInputError); ok {
+			metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+			return api.BadRequest("data_base64 is not valid base64: " + err.Error())
+		}
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: media.MxcUri(),
+	}
+}
+
+// splitDataUri separates the content type from the data of a data: URI, returning plain base64 as
+// it is with no content type. False is returned for data: URIs which aren't base64 encoded.
+func splitDataUri(data string) (string, string, bool) {
+	if !strings.HasPrefix(data, "data:") {
+		return "", data, true
+	}
+
+	// data:[<content type>][;base64],<data>
+	idx := strings.Index(data, ",")
+	if idx < 0 || !strings.HasSuffix(data[:idx], ";base64") {
+		return "", "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(data[:idx], "data:"), ";base64"), data[idx+1:], true
+}
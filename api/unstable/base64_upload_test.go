@@ -0,0 +1,40 @@
+package unstable
+
+import (
+	"testing"
+)
+
+func TestSplitDataUri(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            string
+		wantContentType string
+		wantData        string
+		wantOk          bool
+	}{
+		{name: "plain base64", data: "aGVsbG8=", wantContentType: "", wantData: "aGVsbG8=", wantOk: true},
+		{name: "data uri", data: "data:image/png;base64,aGVsbG8=", wantContentType: "image/png", wantData: "aGVsbG8=", wantOk: true},
+		{name: "data uri with parameters", data: "data:text/plain;charset=utf-8;base64,aGVsbG8=", wantContentType: "text/plain;charset=utf-8", wantData: "aGVsbG8=", wantOk: true},
+		{name: "data uri without type", data: "data:;base64,aGVsbG8=", wantContentType: "", wantData: "aGVsbG8=", wantOk: true},
+		{name: "empty data", data: "data:image/png;base64,", wantContentType: "image/png", wantData: "", wantOk: true},
+		{name: "not base64", data: "data:text/plain,hello", wantOk: false},
+		{name: "no comma", data: "data:image/png;base64", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, data, ok := splitDataUri(tt.data)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if contentType != tt.wantContentType {
+				t.Errorf("content type = %q, want %q", contentType, tt.wantContentType)
+			}
+			if data != tt.wantData {
+				t.Errorf("data = %q, want %q", data, tt.wantData)
+			}
+		})
+	}
+}
@@ -16,9 +16,12 @@ import (
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/thumbnailing"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/i"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
@@ -40,13 +43,29 @@ type MediaInfoResponse struct {
 	Height          int                   `json:"height,omitempty"`
 	Size            int64                 `json:"size"`
 	Hashes          mediaInfoHashes       `json:"hashes"`
+	CreationTs      int64                 `json:"created_ts"`
+	Quarantined     bool                  `json:"quarantined"`
+	UploaderUserId  string                `json:"uploaded_by,omitempty"`         // admins only
+	UploaderToken   string                `json:"uploader_token_hash,omitempty"` // admins only
 	Thumbnails      []*mediaInfoThumbnail `json:"thumbnails,omitempty"`
+	Blurhash        string                `json:"xyz.amorgan.blurhash,omitempty"`
 	DurationSeconds float64               `json:"duration,omitempty"`
 	NumTotalSamples int                   `json:"num_total_samples,omitempty"`
 	KeySamples      [][2]float64          `json:"key_samples,omitempty"`
 	NumChannels     int                   `json:"num_channels,omitempty"`
 }
 
+// getMedia is swapped out by tests
+var getMedia = download_controller.GetMedia
+
+// findMediaRecord is swapped out by tests
+var findMediaRecord = download_controller.FindMediaRecord
+
+// getThumbnails is swapped out by tests
+var getThumbnails = func(origin string, mediaId string, ctx rcontext.RequestContext) ([]*types.Thumbnail, error) {
+	return storage.GetDatabase().GetThumbnailStore(ctx).GetAllForMedia(origin, mediaId)
+}
+
 func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
 	params := mux.Vars(r)
 
@@ -69,14 +88,23 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		"allowRemote": downloadRemote,
 	})
 
-	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, true, rctx)
+	isAdmin := util.IsGlobalAdmin(user.UserId) || user.IsShared
+
+	streamedMedia, err := getMedia(server, mediaId, downloadRemote, true, rctx)
 	if err != nil {
-		if err == common.ErrMediaNotFound {
-			return api.NotFoundError()
-		} else if err == common.ErrMediaTooLarge {
-			return api.RequestTooLarge()
+		if err == common.ErrRemoteDownloadQueueFull {
+			return api.RemoteDownloadsBusy()
 		} else if err == common.ErrMediaQuarantined {
+			if isAdmin {
+				// Admins can still see what was quarantined, but not the contents
+				media, err := findMediaRecord(server, mediaId, false, rctx)
+				if err == nil {
+					return newMediaInfoResponse(media, isAdmin)
+				}
+			}
 			return api.NotFoundError() // We lie for security
+		} else if resp := api.KnownErrorResponse(err); resp != nil {
+			return resp
 		}
 		rctx.Log.Error("Unexpected error locating media: " + err.Error())
 		sentry.CaptureException(err)
@@ -91,14 +119,7 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		return api.InternalServerError("Unexpected Error")
 	}
 
-	response := &MediaInfoResponse{
-		ContentUri:  streamedMedia.KnownMedia.MxcUri(),
-		ContentType: streamedMedia.KnownMedia.ContentType,
-		Size:        streamedMedia.KnownMedia.SizeBytes,
-		Hashes: mediaInfoHashes{
-			Sha256: streamedMedia.KnownMedia.Sha256Hash,
-		},
-	}
+	response := newMediaInfoResponse(streamedMedia.KnownMedia, isAdmin)
 
 	img, err := imaging.Decode(bytes.NewBuffer(b))
 	if err == nil {
@@ -106,8 +127,7 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		response.Height = img.Bounds().Max.Y
 	}
 
-	thumbsDb := storage.GetDatabase().GetThumbnailStore(rctx)
-	thumbs, err := thumbsDb.GetAllForMedia(streamedMedia.KnownMedia.Origin, streamedMedia.KnownMedia.MediaId)
+	thumbs, err := getThumbnails(streamedMedia.KnownMedia.Origin, streamedMedia.KnownMedia.MediaId, rctx)
 	if err != nil && err != sql.ErrNoRows {
 		rctx.Log.Error("Unexpected error locating media: " + err.Error())
 		sentry.CaptureException(err)
@@ -117,6 +137,9 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	if thumbs != nil && len(thumbs) > 0 {
 		infoThumbs := make([]*mediaInfoThumbnail, 0)
 		for _, thumb := range thumbs {
+			if thumb.Method == thumbnail_controller.TranscodeMethod {
+				continue // not a thumbnail clients can request
+			}
 			infoThumbs = append(infoThumbs, &mediaInfoThumbnail{
 				Width:  thumb.Width,
 				Height: thumb.Height,
@@ -126,6 +149,16 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 		response.Thumbnails = infoThumbs
 	}
 
+	if rctx.Config.Features.MSC2448Blurhash.Enabled {
+		// Only stored blurhashes are returned: calculating one here would make this endpoint much slower
+		blurhash, err := storage.GetDatabase().GetMetadataStore(rctx).GetBlurhash(streamedMedia.KnownMedia.Sha256Hash)
+		if err != nil {
+			rctx.Log.Warn("Unexpected error getting blurhash: " + err.Error())
+			sentry.CaptureException(err)
+		}
+		response.Blurhash = blurhash
+	}
+
 	if strings.HasPrefix(response.ContentType, "audio/") {
 		generator, err := thumbnailing.GetGenerator(util_byte_seeker.NewByteSeeker(b), response.ContentType, false)
 		if err == nil {
@@ -143,3 +176,25 @@ func MediaInfo(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 
 	return response
 }
+
+func newMediaInfoResponse(media *types.Media, isAdmin bool) *MediaInfoResponse {
+	response := &MediaInfoResponse{
+		ContentUri:  media.MxcUri(),
+		ContentType: media.ContentType,
+		Size:        media.SizeBytes,
+		Hashes: mediaInfoHashes{
+			Sha256: media.Sha256Hash,
+		},
+		CreationTs:  media.CreationTs,
+		Quarantined: media.Quarantined,
+	}
+	if media.Width != nil && media.Height != nil {
+		response.Width = *media.Width
+		response.Height = *media.Height
+	}
+	if isAdmin {
+		response.UploaderUserId = media.UserId
+		response.UploaderToken = media.UploaderTokenHash
+	}
+	return response
+}
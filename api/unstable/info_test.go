@@ -0,0 +1,200 @@
+package unstable
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestMain(m *testing.M) {
+	// Admins are read from the config, so give the tests a default config outside of the tree
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestNewMediaInfoResponse(t *testing.T) {
+	media := &types.Media{
+		Origin:      "example.org",
+		MediaId:     "abc123",
+		UserId:      "@alice:example.org",
+		ContentType: "image/png",
+		SizeBytes:   1024,
+		Sha256Hash:  "0123456789abcdef",
+		CreationTs:  1600000000000,
+		Quarantined: true,
+	}
+
+	tests := []struct {
+		name         string
+		isAdmin      bool
+		wantUploader string
+	}{
+		{name: "user", isAdmin: false, wantUploader: ""},
+		{name: "admin", isAdmin: true, wantUploader: "@alice:example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := newMediaInfoResponse(media, tt.isAdmin)
+			if response.ContentUri != "mxc://example.org/abc123" {
+				t.Errorf("ContentUri = %q", response.ContentUri)
+			}
+			if response.Size != 1024 || response.ContentType != "image/png" || response.Hashes.Sha256 != "0123456789abcdef" {
+				t.Errorf("unexpected file details: %+v", response)
+			}
+			if response.CreationTs != 1600000000000 {
+				t.Errorf("CreationTs = %d", response.CreationTs)
+			}
+			if !response.Quarantined {
+				t.Error("Quarantined = false, want true")
+			}
+			if response.UploaderUserId != tt.wantUploader {
+				t.Errorf("UploaderUserId = %q, want %q", response.UploaderUserId, tt.wantUploader)
+			}
+		})
+	}
+}
+
+// withMediaInfoLookups makes the media info handler find the media without a database. A nil media
+// record is reported with the given error instead.
+func withMediaInfoLookups(t *testing.T, media *types.Media, err error) {
+	origGetMedia, origFindMediaRecord, origGetThumbnails := getMedia, findMediaRecord, getThumbnails
+	t.Cleanup(func() {
+		getMedia, findMediaRecord, getThumbnails = origGetMedia, origFindMediaRecord, origGetThumbnails
+	})
+
+	getMedia = func(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &types.MinimalMedia{
+			Origin:      media.Origin,
+			MediaId:     media.MediaId,
+			ContentType: media.ContentType,
+			SizeBytes:   media.SizeBytes,
+			Stream:      ioutil.NopCloser(bytes.NewReader([]byte("media repo test file"))),
+			KnownMedia:  media,
+		}, nil
+	}
+	findMediaRecord = func(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.Media, error) {
+		if media == nil {
+			return nil, common.ErrMediaNotFound
+		}
+		return media, nil
+	}
+	getThumbnails = func(origin string, mediaId string, ctx rcontext.RequestContext) ([]*types.Thumbnail, error) {
+		return nil, nil
+	}
+}
+
+func withAdmins(t *testing.T, admins ...string) {
+	orig := config.Get().Admins
+	t.Cleanup(func() {
+		config.Get().Admins = orig
+	})
+	config.Get().Admins = admins
+}
+
+func mediaInfoRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/_matrix/media/unstable/info/example.org/abc123", nil)
+	return mux.SetURLVars(r, map[string]string{"server": "example.org", "mediaId": "abc123"})
+}
+
+func TestMediaInfoNotFound(t *testing.T) {
+	withAdmins(t, "@admin:example.org")
+	quarantined := &types.Media{Origin: "example.org", MediaId: "abc123", UserId: "@alice:example.org", Quarantined: true}
+
+	tests := []struct {
+		name  string
+		media *types.Media
+		err   error
+		user  api.UserInfo
+	}{
+		{name: "unknown media", err: common.ErrMediaNotFound, user: api.UserInfo{UserId: "@alice:example.org"}},
+		{name: "unknown media for admin", err: common.ErrMediaNotFound, user: api.UserInfo{UserId: "@admin:example.org"}},
+		{name: "quarantined media", media: quarantined, err: common.ErrMediaQuarantined, user: api.UserInfo{UserId: "@alice:example.org"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMediaInfoLookups(t, tt.media, tt.err)
+
+			res := MediaInfo(mediaInfoRequest(), testContext(t), tt.user)
+			errRes, ok := res.(*api.ErrorResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected an error response", res)
+			}
+			if errRes.InternalCode != common.ErrCodeNotFound {
+				t.Errorf("got %s, expected %s", errRes.InternalCode, common.ErrCodeNotFound)
+			}
+		})
+	}
+}
+
+func TestMediaInfoAdminFields(t *testing.T) {
+	withAdmins(t, "@admin:example.org")
+	media := &types.Media{
+		Origin:            "example.org",
+		MediaId:           "abc123",
+		UserId:            "@alice:example.org",
+		UploaderTokenHash: "tokenhash",
+		ContentType:       "text/plain",
+		SizeBytes:         20,
+	}
+	quarantined := *media
+	quarantined.Quarantined = true
+
+	tests := []struct {
+		name        string
+		media       *types.Media
+		err         error
+		user        api.UserInfo
+		expectAdmin bool
+	}{
+		{name: "user", media: media, user: api.UserInfo{UserId: "@bob:example.org"}, expectAdmin: false},
+		{name: "uploader", media: media, user: api.UserInfo{UserId: "@alice:example.org"}, expectAdmin: false},
+		{name: "admin", media: media, user: api.UserInfo{UserId: "@admin:example.org"}, expectAdmin: true},
+		{name: "shared secret", media: media, user: api.UserInfo{IsShared: true}, expectAdmin: true},
+		{name: "quarantined for admin", media: &quarantined, err: common.ErrMediaQuarantined, user: api.UserInfo{UserId: "@admin:example.org"}, expectAdmin: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMediaInfoLookups(t, tt.media, tt.err)
+
+			res := MediaInfo(mediaInfoRequest(), testContext(t), tt.user)
+			info, ok := res.(*MediaInfoResponse)
+			if !ok {
+				t.Fatalf("got %#v, expected a media info response", res)
+			}
+			if info.ContentUri != "mxc://example.org/abc123" {
+				t.Errorf("got %s, expected mxc://example.org/abc123", info.ContentUri)
+			}
+
+			expectedUserId, expectedTokenHash := "", ""
+			if tt.expectAdmin {
+				expectedUserId, expectedTokenHash = tt.media.UserId, tt.media.UploaderTokenHash
+			}
+			if info.UploaderUserId != expectedUserId {
+				t.Errorf("got uploader %q, expected %q", info.UploaderUserId, expectedUserId)
+			}
+			if info.UploaderToken != expectedTokenHash {
+				t.Errorf("got token hash %q, expected %q", info.UploaderToken, expectedTokenHash)
+			}
+		})
+	}
+}
@@ -42,12 +42,12 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 
 	streamedMedia, err := download_controller.GetMedia(server, mediaId, downloadRemote, true, rctx)
 	if err != nil {
-		if err == common.ErrMediaNotFound {
-			return api.NotFoundError()
-		} else if err == common.ErrMediaTooLarge {
-			return api.RequestTooLarge()
-		} else if err == common.ErrMediaQuarantined {
+		if err == common.ErrMediaQuarantined {
 			return api.NotFoundError() // We lie for security
+		} else if err == common.ErrRemoteDownloadQueueFull {
+			return api.RemoteDownloadsBusy()
+		} else if resp := api.KnownErrorResponse(err); resp != nil {
+			return resp
 		}
 		rctx.Log.Error("Unexpected error locating media: " + err.Error())
 		sentry.CaptureException(err)
@@ -59,6 +59,9 @@ func LocalCopy(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo)
 	if streamedMedia.KnownMedia.Origin == r.Host {
 		return &r0.MediaUploadedResponse{ContentUri: streamedMedia.KnownMedia.MxcUri()}
 	}
+	if upload_controller.IsReadOnly() {
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
 
 	newMedia, err := upload_controller.UploadMedia(streamedMedia.Stream, streamedMedia.KnownMedia.SizeBytes, streamedMedia.KnownMedia.ContentType, streamedMedia.KnownMedia.UploadName, user.UserId, r.Host, rctx)
 	if err != nil {
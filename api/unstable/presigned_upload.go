@@ -0,0 +1,175 @@
+package unstable
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// The largest request body accepted when creating or finalizing a presigned upload
+const maxPresignedRequestBytes = 65536
+
+type CreatePresignedUploadRequest struct {
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	SizeBytes   int64  `json:"size"`
+}
+
+type PresignedUploadResponse struct {
+	UploadId  string `json:"upload_id"`
+	UploadUrl string `json:"upload_url"`
+	ExpiresTs int64  `json:"expires_ts"`
+}
+
+type FinalizePresignedUploadRequest struct {
+	Sha256Hash string `json:"sha256"`
+}
+
+// readPresignedRequest reads the optional JSON body of a presigned upload request into req.
+func readPresignedRequest(r *http.Request, req interface{}) bool {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPresignedRequestBytes))
+	if err != nil {
+		return false
+	}
+	if len(b) == 0 {
+		return true
+	}
+	return json.Unmarshal(b, req) == nil
+}
+
+func CreatePresignedUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Presigned.Enabled {
+		return api.NotFoundError()
+	}
+	if upload_controller.IsReadOnly() {
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	req := &CreatePresignedUploadRequest{}
+	if !readPresignedRequest(r, req) {
+		return api.BadRequest("Request body must be a JSON object")
+	}
+	if req.SizeBytes <= 0 {
+		return api.BadRequest("size is required")
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+	filename := ""
+	if req.Filename != "" {
+		filename = filepath.Base(req.Filename)
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename":   filename,
+		"uploadSize": req.SizeBytes,
+	})
+
+	// The client may upload more than it says it will, but that is caught when finalizing
+	if wait := ratelimit.TakeUpload(rctx, user.UserId, r.RemoteAddr, req.SizeBytes); wait > 0 {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RateLimitReachedRetryAfter(wait)
+	}
+	if upload_controller.IsRequestTooLarge(req.SizeBytes, "", rctx) {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RequestTooLarge()
+	}
+	if upload_controller.IsRequestTooSmall(req.SizeBytes, "", rctx) {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.RequestTooSmall()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.QuotaExceeded()
+	}
+
+	err = upload_controller.ValidateUploadMetadata(contentType, user.UserId, rctx)
+	if err != nil {
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	upload, err := upload_controller.CreatePresignedUpload(req.SizeBytes, contentType, filename, user.UserId, r.Host, rctx)
+	if err == datastore.ErrPresignUploadUnsupported {
+		return api.BadRequest("This file can't be uploaded directly - use a regular upload instead")
+	}
+	if err != nil {
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	return &PresignedUploadResponse{
+		UploadId:  upload.ID,
+		UploadUrl: upload.UploadUrl,
+		ExpiresTs: upload.ExpiresTs,
+	}
+}
+
+func FinalizePresignedUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Presigned.Enabled {
+		return api.NotFoundError()
+	}
+
+	params := mux.Vars(r)
+	uploadId := params["uploadId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"uploadId": uploadId,
+	})
+
+	req := &FinalizePresignedUploadRequest{}
+	if !readPresignedRequest(r, req) {
+		return api.BadRequest("Request body must be a JSON object")
+	}
+
+	upload := upload_controller.GetPresignedUpload(uploadId, user.UserId)
+	if upload == nil {
+		return api.NotFoundError()
+	}
+	if upload_controller.IsReadOnly() {
+		// The upload is kept, so it can be finalized once uploads are accepted again
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	media, err := upload_controller.FinalizePresignedUpload(upload, req.Sha256Hash, rctx)
+	if err == upload_controller.ErrPresignedUploadMissing {
+		return api.BadRequest("Nothing has been uploaded yet")
+	}
+	if err == upload_controller.ErrPresignedUploadHashMismatch {
+		metrics.MediaUploaded.With(prometheus.Labels{"result": "rejected"}).Inc()
+		return api.BadRequest("The uploaded file does not match the expected hash")
+	}
+	if err != nil {
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	return &r0.MediaUploadedResponse{
+		ContentUri: media.MxcUri(),
+	}
+}
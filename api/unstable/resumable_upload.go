@@ -0,0 +1,234 @@
+package unstable
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/ratelimit"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// Resumable uploads implement the core, creation, expiration, and termination parts of the
+// tus protocol: https://tus.io/protocols/resumable-upload.html
+
+const tusVersion = "1.0.0"
+
+func tusHeaders(extra map[string]string) map[string]string {
+	headers := map[string]string{
+		"Tus-Resumable":                 tusVersion,
+		"Cache-Control":                 "no-store",
+		"Access-Control-Allow-Methods":  "POST, HEAD, PATCH, DELETE, OPTIONS",
+		"Access-Control-Allow-Headers":  "Origin, X-Requested-With, Content-Type, Accept, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset",
+		"Access-Control-Expose-Headers": "Location, Tus-Resumable, Upload-Offset, Upload-Length, Upload-Expires, X-Matrix-Content-Uri",
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	return headers
+}
+
+func tusResponse(statusCode int, extra map[string]string) *api.HeadersResponse {
+	return &api.HeadersResponse{StatusCode: statusCode, Headers: tusHeaders(extra)}
+}
+
+func formatExpiry(ts int64) string {
+	return time.Unix(0, ts*int64(time.Millisecond)).UTC().Format(http.TimeFormat)
+}
+
+func parseUploadMetadata(header string) map[string]string {
+	vals := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) == 1 {
+			vals[parts[0]] = ""
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		vals[parts[0]] = string(decoded)
+	}
+	return vals
+}
+
+func ResumableUploadOptions(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	if !rctx.Config.Uploads.Resumable.Enabled {
+		return api.NotFoundError()
+	}
+
+	headers := map[string]string{
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": "creation,expiration,termination",
+	}
+	if rctx.Config.Uploads.MaxSizeBytes > 0 {
+		headers["Tus-Max-Size"] = strconv.FormatInt(rctx.Config.Uploads.MaxSizeBytes, 10)
+	}
+	return tusResponse(http.StatusNoContent, headers)
+}
+
+func CreateResumableUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Resumable.Enabled {
+		return api.NotFoundError()
+	}
+	if upload_controller.IsReadOnly() {
+		return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return api.BadRequest("Upload-Length header is required")
+	}
+	if wait := ratelimit.TakeUpload(rctx, user.UserId, r.RemoteAddr, length); wait > 0 {
+		return api.RateLimitReachedRetryAfter(wait)
+	}
+	if upload_controller.IsRequestTooLarge(length, "", rctx) {
+		return api.RequestTooLarge()
+	}
+	if upload_controller.IsRequestTooSmall(length, "", rctx) {
+		return api.RequestTooSmall()
+	}
+
+	inQuota, err := quota.IsUserWithinQuota(rctx, user.UserId)
+	if err != nil {
+		rctx.Log.Error("Unexpected error checking quota: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+	if !inQuota {
+		return api.QuotaExceeded()
+	}
+
+	metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename != "" {
+		filename = filepath.Base(filename)
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = metadata["type"]
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"filename":     filename,
+		"uploadLength": length,
+	})
+
+	err = upload_controller.ValidateUploadMetadata(contentType, user.UserId, rctx)
+	if err != nil {
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	upload, err := upload_controller.CreateResumableUpload(length, contentType, filename, user.UserId, r.Host, rctx)
+	if err == common.ErrTooManyResumableUploads {
+		return api.RateLimitReached()
+	}
+	if err != nil {
+		rctx.Log.Error("Unexpected error creating resumable upload: " + err.Error())
+		sentry.CaptureException(err)
+		return api.InternalServerError("Unexpected Error")
+	}
+
+	return tusResponse(http.StatusCreated, map[string]string{
+		"Location":       strings.TrimSuffix(r.URL.Path, "/") + "/" + upload.ID,
+		"Upload-Expires": formatExpiry(upload.ExpiresTs),
+	})
+}
+
+func ResumableUpload(r *http.Request, rctx rcontext.RequestContext, user api.UserInfo) interface{} {
+	defer cleanup.DumpAndCloseStream(r.Body)
+
+	if !rctx.Config.Uploads.Resumable.Enabled {
+		return api.NotFoundError()
+	}
+
+	params := mux.Vars(r)
+	uploadId := params["uploadId"]
+
+	rctx = rctx.LogWithFields(logrus.Fields{
+		"uploadId": uploadId,
+	})
+
+	upload := upload_controller.GetResumableUpload(uploadId, user.UserId)
+	if upload == nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return tusResponse(http.StatusNotFound, nil)
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		return tusResponse(http.StatusOK, map[string]string{
+			"Upload-Offset":  strconv.FormatInt(upload.Offset, 10),
+			"Upload-Length":  strconv.FormatInt(upload.Length, 10),
+			"Upload-Expires": formatExpiry(upload.ExpiresTs),
+		})
+	case http.MethodDelete:
+		upload_controller.CancelResumableUpload(upload)
+		return tusResponse(http.StatusNoContent, nil)
+	case http.MethodPatch:
+		if upload_controller.IsReadOnly() {
+			// The upload is kept, so it can be resumed once uploads are accepted again
+			io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+			return api.ReadOnly(upload_controller.ReadOnlyRetryAfter())
+		}
+		break
+	default:
+		return api.MethodNotAllowed()
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return tusResponse(http.StatusUnsupportedMediaType, nil)
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return api.BadRequest("Upload-Offset header is required")
+	}
+
+	media, err := upload_controller.AppendToResumableUpload(upload, offset, r.Body, rctx)
+	if err == upload_controller.ErrResumableOffsetMismatch {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return tusResponse(http.StatusConflict, nil)
+	}
+	if err != nil {
+		io.Copy(ioutil.Discard, r.Body) // Ditch the entire request
+		return r0.UploadErrorResponse(err, rctx)
+	}
+
+	headers := map[string]string{
+		"Upload-Offset":  strconv.FormatInt(upload.Offset, 10),
+		"Upload-Expires": formatExpiry(upload.ExpiresTs),
+	}
+	if media != nil {
+		headers["X-Matrix-Content-Uri"] = media.MxcUri()
+	}
+	return tusResponse(http.StatusNoContent, headers)
+}
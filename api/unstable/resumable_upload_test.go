@@ -0,0 +1,117 @@
+package unstable
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func testContext(t *testing.T) rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+	ctx.Config.Uploads.Resumable.Enabled = true
+	ctx.Config.Uploads.Resumable.TempPath = t.TempDir()
+	ctx.Config.Uploads.Resumable.ExpireAfterMinutes = 60
+	return ctx
+}
+
+func tusRequest(method string, uploadId string, offset string, body string) *http.Request {
+	r := httptest.NewRequest(method, "/_matrix/media/unstable/upload/resumable/"+uploadId, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if offset != "" {
+		r.Header.Set("Upload-Offset", offset)
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	return mux.SetURLVars(r, map[string]string{"uploadId": uploadId})
+}
+
+func expectStatus(t *testing.T, res interface{}, statusCode int) *api.HeadersResponse {
+	t.Helper()
+	headers, ok := res.(*api.HeadersResponse)
+	if !ok {
+		t.Fatalf("got %#v, expected a headers response", res)
+	}
+	if headers.StatusCode != statusCode {
+		t.Fatalf("got status %d, expected %d", headers.StatusCode, statusCode)
+	}
+	return headers
+}
+
+func TestResumableUpload(t *testing.T) {
+	ctx := testContext(t)
+	user := api.UserInfo{UserId: "@alice:example.org"}
+
+	r := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/upload/resumable", nil)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("Upload-Length", "10")
+	r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("test.txt")))
+	res := expectStatus(t, CreateResumableUpload(r, ctx, user), http.StatusCreated)
+	location := res.Headers["Location"]
+	uploadId := location[strings.LastIndex(location, "/")+1:]
+	if location != "/_matrix/media/unstable/upload/resumable/"+uploadId || uploadId == "" {
+		t.Fatalf("unexpected location %q", location)
+	}
+
+	res = expectStatus(t, ResumableUpload(tusRequest(http.MethodPatch, uploadId, "0", "hello"), ctx, user), http.StatusNoContent)
+	if res.Headers["Upload-Offset"] != "5" {
+		t.Errorf("got offset %s after a partial patch, expected 5", res.Headers["Upload-Offset"])
+	}
+
+	// A client resuming the upload asks for the offset first
+	res = expectStatus(t, ResumableUpload(tusRequest(http.MethodHead, uploadId, "", ""), ctx, user), http.StatusOK)
+	if res.Headers["Upload-Offset"] != "5" || res.Headers["Upload-Length"] != "10" {
+		t.Errorf("got offset %s and length %s, expected 5 and 10", res.Headers["Upload-Offset"], res.Headers["Upload-Length"])
+	}
+
+	expectStatus(t, ResumableUpload(tusRequest(http.MethodPatch, uploadId, "3", "world"), ctx, user), http.StatusConflict)
+	expectStatus(t, ResumableUpload(tusRequest(http.MethodHead, uploadId, "", ""), ctx, api.UserInfo{UserId: "@bob:example.org"}), http.StatusNotFound)
+
+	expectStatus(t, ResumableUpload(tusRequest(http.MethodDelete, uploadId, "", ""), ctx, user), http.StatusNoContent)
+	expectStatus(t, ResumableUpload(tusRequest(http.MethodHead, uploadId, "", ""), ctx, user), http.StatusNotFound)
+
+	files, err := ioutil.ReadDir(ctx.Config.Uploads.Resumable.TempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected the temporary file to be removed, found %d files", len(files))
+	}
+}
+
+func TestCreateResumableUploadRateLimited(t *testing.T) {
+	ctx := testContext(t)
+	ctx.Config.Uploads.RateLimit.Enabled = true
+	ctx.Config.Uploads.RateLimit.IntervalSeconds = 3600
+	ctx.Config.Uploads.RateLimit.RequestsPerInterval = 1
+	user := api.UserInfo{UserId: "@ratelimited:example.org"}
+
+	create := func() interface{} {
+		r := httptest.NewRequest(http.MethodPost, "/_matrix/media/unstable/upload/resumable", nil)
+		r.Header.Set("Tus-Resumable", tusVersion)
+		r.Header.Set("Upload-Length", "10")
+		return CreateResumableUpload(r, ctx, user)
+	}
+
+	expectStatus(t, create(), http.StatusCreated)
+	if res := create(); !isRateLimited(res) {
+		t.Errorf("got %#v, expected the second upload to be rate limited", res)
+	}
+}
+
+func isRateLimited(res interface{}) bool {
+	_, ok := res.(*api.RateLimitedResponse)
+	return ok
+}
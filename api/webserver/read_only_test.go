@@ -0,0 +1,46 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestServeReadOnly(t *testing.T) {
+	tests := []struct {
+		name               string
+		retryAfter         time.Duration
+		expectedRetryAfter string
+	}{
+		{name: "minutes", retryAfter: 5 * time.Minute, expectedRetryAfter: "300"},
+		{name: "part of a second", retryAfter: 1500 * time.Millisecond, expectedRetryAfter: "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handler{func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+				return api.ReadOnly(tt.retryAfter)
+			}, "upload", &requestCounter{}, false}
+
+			r := httptest.NewRequest("POST", "http://127.0.0.1/_matrix/media/r0/upload", nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("got status %d, expected %d", w.Code, http.StatusServiceUnavailable)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.expectedRetryAfter {
+				t.Errorf("got Retry-After %q, expected %q", got, tt.expectedRetryAfter)
+			}
+			if !strings.Contains(w.Body.String(), common.ErrCodeReadOnly) {
+				t.Errorf("got %s, expected the read-only error code", w.Body.String())
+			}
+		})
+	}
+}
@@ -1,14 +1,33 @@
 package webserver
 
-import "strconv"
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+)
+
+// The header used to accept request IDs from callers, such as a reverse proxy, and to return them
+// so that the logs for a request can be correlated with those of the caller.
+const requestIdHeader = "X-Request-ID"
+
+// Request IDs from callers end up in the logs, so only accept reasonable looking ones
+var validRequestId = regexp.MustCompile(`^[a-zA-Z0-9._:\-]{1,128}$`)
 
 type requestCounter struct {
 	lastId uint64
 }
 
 func (c *requestCounter) GetNextId() string {
-	strId := strconv.FormatUint(c.lastId, 10)
-	c.lastId = c.lastId + 1
+	strId := strconv.FormatUint(atomic.AddUint64(&c.lastId, 1)-1, 10)
 
 	return "REQ-" + strId
 }
+
+// GetRequestId returns the request ID supplied by the caller, or a new one if there isn't a valid one.
+func (c *requestCounter) GetRequestId(r *http.Request) string {
+	if requestId := r.Header.Get(requestIdHeader); validRequestId.MatchString(requestId) {
+		return requestId
+	}
+	return c.GetNextId()
+}
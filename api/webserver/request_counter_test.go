@@ -0,0 +1,114 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestGetRequestId(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		expected  string
+		generated bool
+	}{
+		{name: "caller's id", header: "abc-123_DEF.456:7", expected: "abc-123_DEF.456:7"},
+		{name: "uuid", header: "5f0e4a4c-8c53-4f4e-9d6e-3b1e2b4a6c7d", expected: "5f0e4a4c-8c53-4f4e-9d6e-3b1e2b4a6c7d"},
+		{name: "no id", header: "", generated: true},
+		{name: "spaces", header: "abc 123", generated: true},
+		{name: "newline", header: "abc\n123", generated: true},
+		{name: "too long", header: strings.Repeat("a", 129), generated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := &requestCounter{}
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/config", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIdHeader, tt.header)
+			}
+
+			got := counter.GetRequestId(r)
+			if tt.generated {
+				if got != "REQ-0" {
+					t.Errorf("got %q, expected a generated id", got)
+				}
+			} else if got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetNextId(t *testing.T) {
+	counter := &requestCounter{}
+	for i, expected := range []string{"REQ-0", "REQ-1", "REQ-2"} {
+		if got := counter.GetNextId(); got != expected {
+			t.Errorf("got id %d as %q, expected %q", i, got, expected)
+		}
+	}
+}
+
+func TestRequestIdInLogs(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "caller's id", header: "abc-123", expected: "abc-123"},
+		{name: "generated id", header: "", expected: "REQ-0"},
+	}
+	// Load the config now so its log entries aren't caught by the hook
+	config.Get()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+			srv := httptest.NewServer(handler{
+				h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+					ctx.Log.Info("Handling request")
+					ctx.Log.WithField("mediaId", "abc").Info("Storing media")
+					return &api.EmptyResponse{}
+				},
+				action:     "test",
+				reqCounter: &requestCounter{},
+			})
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set(requestIdHeader, tt.header)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.Header.Get(requestIdHeader) != tt.expected {
+				t.Errorf("got %s header %q, expected %q", requestIdHeader, res.Header.Get(requestIdHeader), tt.expected)
+			}
+			entries := hook.AllEntries()
+			if len(entries) < 3 {
+				t.Fatalf("got %d log entries, expected at least 3", len(entries))
+			}
+			for _, entry := range entries {
+				if entry.Data["requestId"] != tt.expected {
+					t.Errorf("got requestId %v on %q, expected %q", entry.Data["requestId"], entry.Message, tt.expected)
+				}
+			}
+		})
+	}
+}
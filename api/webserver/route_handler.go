@@ -1,21 +1,24 @@
 package webserver
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
+	"io/ioutil"
 	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
-	"net/url"
+	"net/textproto"
 	"strconv"
 	"strings"
 
-	"github.com/alioygur/is"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sebest/xff"
 	"github.com/sirupsen/logrus"
@@ -25,6 +28,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/tracing"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
@@ -61,6 +65,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	r.RemoteAddr = host
 
+	requestId := h.reqCounter.GetRequestId(r)
 	contextLog := logrus.WithFields(logrus.Fields{
 		"method":             r.Method,
 		"host":               r.Host,
@@ -69,7 +74,7 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"contentType":        r.Header.Get("Content-Type"),
 		"contentLength":      r.ContentLength,
 		"queryString":        util.GetLogSafeQueryString(r),
-		"requestId":          h.reqCounter.GetNextId(),
+		"requestId":          requestId,
 		"remoteAddr":         r.RemoteAddr,
 	})
 	contextLog.Info("Received request")
@@ -80,13 +85,17 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; script-src 'none'; plugin-types application/pdf; style-src 'unsafe-inline'; media-src 'self'; object-src 'self';")
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow, noarchive, noimageindex")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Server", "matrix-media-repo")
+	w.Header().Set(requestIdHeader, requestId)
+	w.Header().Set("Access-Control-Expose-Headers", requestIdHeader)
 
 	// Process response
 	var res interface{} = api.AuthFailed()
+	var cfg *config.DomainRepoConfig // only set if the request was processed
 	if util.IsServerOurs(r.Host) || h.ignoreHost {
 		contextLog.Info("Host is valid - processing request")
-		cfg := config.GetDomain(r.Host)
+		cfg = config.GetDomain(r.Host)
 		if h.ignoreHost {
 			dc := config.DomainConfigFrom(*config.Get())
 			cfg = &dc
@@ -95,11 +104,16 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Build a context that can be used throughout the remainder of the app
 		// This is kinda annoying, but it's better than trying to pass our own
 		// thing throughout the layers.
-		ctx := r.Context()
+		ctx, span := tracing.StartRequestSpan(r, h.action)
+		defer span.End()
+		if traceId := tracing.TraceIdOf(ctx); traceId != "" {
+			contextLog = contextLog.WithField("traceId", traceId)
+		}
 		ctx = context.WithValue(ctx, "mr.logger", contextLog)
 		ctx = context.WithValue(ctx, "mr.serverConfig", cfg)
 		ctx = context.WithValue(ctx, "mr.request", r)
 		rctx := rcontext.RequestContext{Context: ctx, Log: contextLog, Config: *cfg, Request: r}
+		rctx.Config.Uploads = config.UploadsForOrigin(cfg.Uploads, r.Host)
 		r = r.WithContext(rctx)
 
 		metrics.HttpRequests.With(prometheus.Labels{
@@ -151,25 +165,70 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case common.ErrCodeBadRequest:
 			statusCode = http.StatusBadRequest
 			break
+		case common.ErrCodeMediaTooSmall:
+			statusCode = http.StatusBadRequest
+			break
 		case common.ErrCodeMethodNotAllowed:
 			statusCode = http.StatusMethodNotAllowed
 			break
+		case common.ErrCodeUnrecognized:
+			statusCode = http.StatusNotFound
+			break
+		case common.ErrCodeCannotOverwriteMedia:
+			statusCode = http.StatusConflict
+			break
+		case common.ErrCodeUploadInProgress:
+			statusCode = http.StatusConflict
+			break
 		case common.ErrCodeForbidden:
 			statusCode = http.StatusForbidden
 			break
+		case common.ErrCodeNoGuests:
+			statusCode = http.StatusForbidden
+			break
+		case common.ErrCodeQuotaExceeded:
+			statusCode = http.StatusForbidden
+			break
+		case common.ErrCodeRateLimitExceeded:
+			statusCode = http.StatusTooManyRequests
+			break
+		case common.ErrCodeInsufficientStorage:
+			statusCode = http.StatusInsufficientStorage
+			break
+		case common.ErrCodeDatastoreUnavailable:
+			statusCode = http.StatusServiceUnavailable
+			break
+		case common.ErrCodeShuttingDown:
+			statusCode = http.StatusServiceUnavailable
+			break
+		case common.ErrCodeTooBusy:
+			statusCode = http.StatusServiceUnavailable
+			break
+		case common.ErrCodeReadOnly:
+			statusCode = http.StatusServiceUnavailable
+			break
+		case common.ErrCodeRemoteTimeout:
+			statusCode = http.StatusGatewayTimeout
+			break
 		default: // Treat as unknown (a generic server error)
 			statusCode = http.StatusInternalServerError
 			break
 		}
 		break
+	case *api.StatusCodeResponse:
+		statusCode = result.StatusCode
+		res = result.Payload
+		break
+	case *api.RateLimitedResponse:
+		statusCode = http.StatusTooManyRequests
+		// Retry-After is in whole seconds, so round up to avoid clients retrying too early
+		w.Header().Set("Retry-After", strconv.FormatInt((result.RetryAfterMs+999)/1000, 10))
+		break
+	case *api.TooBusyResponse:
+		statusCode = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", strconv.FormatInt((result.RetryAfterMs+999)/1000, 10))
+		break
 	case *r0.DownloadMediaResponse:
-		metrics.HttpResponses.With(prometheus.Labels{
-			"host":       r.Host,
-			"action":     h.action,
-			"method":     r.Method,
-			"statusCode": strconv.Itoa(http.StatusOK),
-		}).Inc()
-
 		contentType := result.ContentType
 		mediaType, params, err := mime.ParseMediaType(result.ContentType)
 		if err != nil {
@@ -183,46 +242,135 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			contentType = mime.FormatMediaType(mediaType, params)
 		}
 
-		w.Header().Set("Cache-Control", "private, max-age=259200") // 3 days
+		// Compressing only part of the media isn't worth the complexity
+		compressTypes := cfg.Downloads.CompressTypes
+		compressible := mediaType != "" && r.Header.Get("Range") == "" && util.GlobMatchesAny(compressTypes, mediaType)
+
+		// 304 responses need the Vary header too, so caches know which representation they apply to
+		if result.VaryAccept {
+			w.Header().Set("Vary", "Accept")
+		}
+		if compressible {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+
+		if result.Sha256Hash != "" {
+			// Media can't change once stored, so we can be fairly aggressive with caching
+			maxAge := cfg.Downloads.CacheMaxAgeSeconds
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, immutable, max-age=%d", maxAge))
+			w.Header().Set("ETag", "\""+result.Sha256Hash+"\"")
+
+			if util.ETagMatches(r.Header.Get("If-None-Match"), result.Sha256Hash) {
+				metrics.HttpResponses.With(prometheus.Labels{
+					"host":       r.Host,
+					"action":     h.action,
+					"method":     r.Method,
+					"statusCode": strconv.Itoa(http.StatusNotModified),
+				}).Inc()
+				result.Data.Close()
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else {
+			w.Header().Set("Cache-Control", "private, max-age=259200") // 3 days
+		}
 		w.Header().Set("Content-Type", contentType)
 		if result.SizeBytes > 0 {
 			w.Header().Set("Content-Length", fmt.Sprint(result.SizeBytes))
 		}
-		disposition := result.TargetDisposition
-		if disposition == "" {
-			disposition = "inline"
-		} else if disposition == "infer" {
-			if result.ContentType == "" {
-				disposition = "attachment"
-			} else {
-				if util.HasAnyPrefix(result.ContentType, []string{"image/", "audio/", "video/", "text/plain"}) {
-					disposition = "inline"
-				} else {
-					disposition = "attachment"
+		inlineTypes := cfg.Downloads.InlineContentTypes
+		w.Header().Set("Content-Disposition", api.ContentDisposition(inlineTypes, result.ContentType, result.Filename, result.TargetDisposition))
+		defer result.Data.Close()
+
+		var ranges []util.ByteRange
+		if result.SizeBytes > 0 {
+			w.Header().Set("Accept-Ranges", "bytes")
+			if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+				ranges, err = util.ParseRangeHeader(rangeHeader, result.SizeBytes)
+				if err == util.ErrRangeNotSatisfiable {
+					metrics.HttpResponses.With(prometheus.Labels{
+						"host":       r.Host,
+						"action":     h.action,
+						"method":     r.Method,
+						"statusCode": strconv.Itoa(http.StatusRequestedRangeNotSatisfiable),
+					}).Inc()
+					w.Header().Del("Content-Length")
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", result.SizeBytes))
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				} else if err != nil || !util.RangesAreSequential(ranges) {
+					// We're allowed to ignore the Range header and send the whole thing instead. Ranges
+					// which overlap or aren't in ascending order would need the stream to be read more
+					// than once, so those requests get a 200 with the whole file.
+					ranges = nil
 				}
 			}
 		}
-		fname := result.Filename
-		if fname == "" {
-			exts, err := mime.ExtensionsByType(result.ContentType)
-			if err != nil {
-				exts = nil
-				contextLog.Warn("Unexpected error inferring file extension: " + err.Error())
-				sentry.CaptureException(err)
-			}
-			ext := ""
-			if exts != nil && len(exts) > 0 {
-				ext = exts[0]
+
+		if r.Method == http.MethodHead && len(ranges) > 1 {
+			// The multipart boundary is only picked when the body is written, so describe the whole media instead
+			ranges = nil
+		}
+
+		if len(ranges) > 0 {
+			statusCode = http.StatusPartialContent
+		}
+		metrics.HttpResponses.With(prometheus.Labels{
+			"host":       r.Host,
+			"action":     h.action,
+			"method":     r.Method,
+			"statusCode": strconv.Itoa(statusCode),
+		}).Inc()
+
+		if r.Method == http.MethodHead {
+			// The headers are the same as for a GET, without the body
+			if len(ranges) == 1 {
+				w.Header().Set("Content-Range", ranges[0].ContentRange(result.SizeBytes))
+				w.Header().Set("Content-Length", fmt.Sprint(ranges[0].Length))
 			}
-			fname = "file" + ext
+			w.WriteHeader(statusCode)
+			return
 		}
-		if is.ASCII(result.Filename) {
-			w.Header().Set("Content-Disposition", disposition+"; filename="+url.QueryEscape(fname))
+
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Range", ranges[0].ContentRange(result.SizeBytes))
+			w.Header().Set("Content-Length", fmt.Sprint(ranges[0].Length))
+			w.WriteHeader(statusCode)
+			writeRangeData(w, result.Data, ranges[0], 0)
+			metrics.BytesServed.With(prometheus.Labels{"host": r.Host, "action": h.action}).Add(float64(ranges[0].Length))
+		} else if len(ranges) > 1 {
+			mw := multipart.NewWriter(w)
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+			w.WriteHeader(statusCode)
+			writeMultipartRangeData(mw, result.Data, ranges, contentType, result.SizeBytes)
+			for _, byteRange := range ranges {
+				metrics.BytesServed.With(prometheus.Labels{"host": r.Host, "action": h.action}).Add(float64(byteRange.Length))
+			}
+		} else if compressible && util.AcceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+			data := bufio.NewReader(result.Data)
+			if isGzipped(data) {
+				writeResponseData(w, data, result.SizeBytes, r.Host, h.action)
+				return
+			}
+
+			w.Header().Del("Content-Length")
+			w.Header().Del("Accept-Ranges")
+			w.Header().Set("Content-Encoding", "gzip")
+			if result.Sha256Hash != "" {
+				// The compressed bytes aren't identical to the media, so the ETag can only be weak
+				w.Header().Set("ETag", "W/\""+result.Sha256Hash+"\"")
+			}
+			gz := gzip.NewWriter(w)
+			writeResponseData(gz, data, result.SizeBytes, r.Host, h.action)
+			err = gz.Close()
+			if err != nil {
+				// Should only blow up this request
+				panic(err)
+			}
 		} else {
-			w.Header().Set("Content-Disposition", disposition+"; filename*=utf-8''"+url.QueryEscape(fname))
+			writeResponseData(w, result.Data, result.SizeBytes, r.Host, h.action)
 		}
-		defer result.Data.Close()
-		writeResponseData(w, result.Data, result.SizeBytes)
 		return // Prevent sending conflicting responses
 	case *r0.IdenticonResponse:
 		metrics.HttpResponses.With(prometheus.Labels{
@@ -233,8 +381,20 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}).Inc()
 		w.Header().Set("Cache-Control", "private, max-age=604800") // 7 days
 		w.Header().Set("Content-Type", "image/png")
-		writeResponseData(w, result.Avatar, 0)
+		writeResponseData(w, result.Avatar, 0, r.Host, h.action)
 		return // Prevent sending conflicting responses
+	case *api.HeadersResponse:
+		metrics.HttpResponses.With(prometheus.Labels{
+			"host":       r.Host,
+			"action":     h.action,
+			"method":     r.Method,
+			"statusCode": strconv.Itoa(result.StatusCode),
+		}).Inc()
+		for k, v := range result.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(result.StatusCode)
+		return
 	case *api.HtmlResponse:
 		metrics.HttpResponses.With(prometheus.Labels{
 			"host":       r.Host,
@@ -247,6 +407,22 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Security-Policy", "") // We're serving HTML, so take away the CSP
 		io.Copy(w, bytes.NewBuffer([]byte(result.HTML)))
 		return
+	case *api.StreamedResponse:
+		metrics.HttpResponses.With(prometheus.Labels{
+			"host":       r.Host,
+			"action":     h.action,
+			"method":     r.Method,
+			"statusCode": strconv.Itoa(http.StatusOK),
+		}).Inc()
+		defer result.Stream.Close()
+		w.Header().Set("Content-Type", result.ContentType)
+		w.WriteHeader(http.StatusOK)
+		_, err := io.Copy(w, result.Stream)
+		if err != nil {
+			// The status has already been sent, so all we can do is cut the response short
+			contextLog.Warn("Error streaming response: ", err)
+		}
+		return
 	default:
 		break
 	}
@@ -266,8 +442,16 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(res)
 }
 
-func writeResponseData(w http.ResponseWriter, s io.Reader, expectedBytes int64) {
+// isGzipped determines if the stream starts with the gzip magic number, such as for SVGZ images,
+// without consuming any of it.
+func isGzipped(s *bufio.Reader) bool {
+	b, _ := s.Peek(2)
+	return len(b) == 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func writeResponseData(w io.Writer, s io.Reader, expectedBytes int64, host string, action string) {
 	b, err := io.Copy(w, s)
+	metrics.BytesServed.With(prometheus.Labels{"host": host, "action": action}).Add(float64(b))
 	if err != nil {
 		// Should only blow up this request
 		panic(err)
@@ -277,3 +461,46 @@ func writeResponseData(w http.ResponseWriter, s io.Reader, expectedBytes int64)
 		panic(errors.New("mismatch transfer size"))
 	}
 }
+
+// writeRangeData writes the range of the stream to the writer, given the current position of the
+// stream. Streams which can seek (such as s3 objects, where this becomes a ranged request) will be
+// seeked, and others will have the bytes before the range discarded.
+func writeRangeData(w io.Writer, s io.Reader, byteRange util.ByteRange, position int64) {
+	var err error
+	if seeker, ok := s.(io.Seeker); ok {
+		_, err = seeker.Seek(byteRange.Start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, s, byteRange.Start-position)
+	}
+	if err != nil {
+		// Should only blow up this request
+		panic(err)
+	}
+
+	_, err = io.CopyN(w, s, byteRange.Length)
+	if err != nil {
+		// Should only blow up this request
+		panic(err)
+	}
+}
+
+func writeMultipartRangeData(mw *multipart.Writer, s io.Reader, ranges []util.ByteRange, contentType string, size int64) {
+	position := int64(0)
+	for _, byteRange := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {byteRange.ContentRange(size)},
+		})
+		if err != nil {
+			// Should only blow up this request
+			panic(err)
+		}
+		writeRangeData(part, s, byteRange, position)
+		position = byteRange.Start + byteRange.Length
+	}
+	err := mw.Close()
+	if err != nil {
+		// Should only blow up this request
+		panic(err)
+	}
+}
@@ -0,0 +1,717 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/api"
+	"github.com/turt2live/matrix-media-repo/api/r0"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-webserver-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	conf := "homeservers:\n  - name: 127.0.0.1\n    csApi: http://127.0.0.1\ndownloads:\n  cacheMaxAgeSeconds: 600\n  compressTypes: [\"image/svg+xml\"]\n"
+	if err = ioutil.WriteFile(config.Path, []byte(conf), 0644); err != nil {
+		panic(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func downloadServer(t *testing.T, contents []byte, sha256Hash string) *httptest.Server {
+	srv := httptest.NewServer(handler{
+		h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return &r0.DownloadMediaResponse{
+				ContentType: "video/mp4",
+				Filename:    "video.mp4",
+				SizeBytes:   int64(len(contents)),
+				Data:        ioutil.NopCloser(bytes.NewReader(contents)),
+				Sha256Hash:  sha256Hash,
+			}
+		},
+		action:     "download",
+		reqCounter: &requestCounter{},
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadRanges(t *testing.T) {
+	contents := make([]byte, 1000)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name             string
+		method           string
+		rangeHeader      string
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{name: "no range", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: contents},
+		{name: "single range", method: http.MethodGet, rangeHeader: "bytes=100-199", wantStatus: http.StatusPartialContent, wantContentRange: "bytes 100-199/1000", wantBody: contents[100:200]},
+		{name: "open ended range", method: http.MethodGet, rangeHeader: "bytes=500-", wantStatus: http.StatusPartialContent, wantContentRange: "bytes 500-999/1000", wantBody: contents[500:]},
+		{name: "suffix range", method: http.MethodGet, rangeHeader: "bytes=-100", wantStatus: http.StatusPartialContent, wantContentRange: "bytes 900-999/1000", wantBody: contents[900:]},
+		{name: "range past the end is clamped", method: http.MethodGet, rangeHeader: "bytes=900-5000", wantStatus: http.StatusPartialContent, wantContentRange: "bytes 900-999/1000", wantBody: contents[900:]},
+		{name: "unsatisfiable range", method: http.MethodGet, rangeHeader: "bytes=1000-1100", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */1000", wantBody: []byte{}},
+		{name: "invalid range is ignored", method: http.MethodGet, rangeHeader: "bytes=abc", wantStatus: http.StatusOK, wantBody: contents},
+		{name: "out of order ranges get the whole file", method: http.MethodGet, rangeHeader: "bytes=500-599,0-99", wantStatus: http.StatusOK, wantBody: contents},
+		{name: "overlapping ranges get the whole file", method: http.MethodGet, rangeHeader: "bytes=0-199,100-299", wantStatus: http.StatusOK, wantBody: contents},
+		{name: "head with a range", method: http.MethodHead, rangeHeader: "bytes=100-199", wantStatus: http.StatusPartialContent, wantContentRange: "bytes 100-199/1000", wantBody: []byte{}},
+		{name: "head with an unsatisfiable range", method: http.MethodHead, rangeHeader: "bytes=2000-", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */1000", wantBody: []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := downloadServer(t, contents, "")
+
+			req, err := http.NewRequest(tt.method, srv.URL+"/download", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, expected %d", res.StatusCode, tt.wantStatus)
+			}
+			if res.Header.Get("Accept-Ranges") != "bytes" {
+				t.Errorf("got Accept-Ranges %q, expected bytes", res.Header.Get("Accept-Ranges"))
+			}
+			if res.Header.Get("Content-Range") != tt.wantContentRange {
+				t.Errorf("got Content-Range %q, expected %q", res.Header.Get("Content-Range"), tt.wantContentRange)
+			}
+			if !bytes.Equal(body, tt.wantBody) {
+				t.Errorf("got %d bytes, expected %d", len(body), len(tt.wantBody))
+			}
+			if tt.wantStatus != http.StatusRequestedRangeNotSatisfiable && tt.method == http.MethodGet && res.ContentLength != int64(len(tt.wantBody)) {
+				t.Errorf("got Content-Length %d, expected %d", res.ContentLength, len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestDownloadMultipleRanges(t *testing.T) {
+	contents := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	srv := downloadServer(t, contents, "")
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-9,20-")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got content type %q, expected multipart/byteranges", res.Header.Get("Content-Type"))
+	}
+
+	wantParts := []struct {
+		contentRange string
+		body         string
+	}{
+		{contentRange: "bytes 0-9/36", body: "0123456789"},
+		{contentRange: "bytes 20-35/36", body: "klmnopqrstuvwxyz"},
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for i, want := range wantParts {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("reading part %d: %v", i, err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Range") != want.contentRange || string(body) != want.body {
+			t.Errorf("got part %d as %q %q, expected %q %q", i, part.Header.Get("Content-Range"), body, want.contentRange, want.body)
+		}
+		if part.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("got part %d content type %q, expected video/mp4", i, part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err = mr.NextPart(); err == nil {
+		t.Error("expected exactly two parts")
+	}
+}
+
+func TestDownloadETag(t *testing.T) {
+	contents := []byte("an avatar which is fetched a lot")
+	const hash = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	tests := []struct {
+		name        string
+		sha256Hash  string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+		wantCache   string
+	}{
+		{name: "etag", sha256Hash: hash, wantStatus: http.StatusOK, wantETag: "\"" + hash + "\"", wantCache: "public, immutable, max-age=600"},
+		{name: "matching etag", sha256Hash: hash, ifNoneMatch: "\"" + hash + "\"", wantStatus: http.StatusNotModified, wantETag: "\"" + hash + "\"", wantCache: "public, immutable, max-age=600"},
+		{name: "one of many etags", sha256Hash: hash, ifNoneMatch: "\"other\", W/\"" + hash + "\"", wantStatus: http.StatusNotModified, wantETag: "\"" + hash + "\"", wantCache: "public, immutable, max-age=600"},
+		{name: "any etag", sha256Hash: hash, ifNoneMatch: "*", wantStatus: http.StatusNotModified, wantETag: "\"" + hash + "\"", wantCache: "public, immutable, max-age=600"},
+		{name: "different etag", sha256Hash: hash, ifNoneMatch: "\"other\"", wantStatus: http.StatusOK, wantETag: "\"" + hash + "\"", wantCache: "public, immutable, max-age=600"},
+		{name: "unknown hash", ifNoneMatch: "*", wantStatus: http.StatusOK, wantCache: "private, max-age=259200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := downloadServer(t, contents, tt.sha256Hash)
+
+			// The ETag must be the same every time the media is requested
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest(http.MethodGet, srv.URL+"/download", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.ifNoneMatch != "" {
+					req.Header.Set("If-None-Match", tt.ifNoneMatch)
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if res.StatusCode != tt.wantStatus {
+					t.Errorf("got status %d, expected %d", res.StatusCode, tt.wantStatus)
+				}
+				if res.Header.Get("ETag") != tt.wantETag {
+					t.Errorf("got ETag %q, expected %q", res.Header.Get("ETag"), tt.wantETag)
+				}
+				if res.Header.Get("Cache-Control") != tt.wantCache {
+					t.Errorf("got Cache-Control %q, expected %q", res.Header.Get("Cache-Control"), tt.wantCache)
+				}
+				if tt.wantStatus == http.StatusNotModified && len(body) != 0 {
+					t.Errorf("expected no body, got %d bytes", len(body))
+				}
+				if tt.wantStatus == http.StatusOK && !bytes.Equal(body, contents) {
+					t.Errorf("got %d bytes, expected %d", len(body), len(contents))
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadHead(t *testing.T) {
+	contents := []byte("media repo test file")
+	const hash = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	srv := downloadServer(t, contents, hash)
+
+	tests := []struct {
+		name           string
+		method         string
+		rangeHeader    string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "get", method: http.MethodGet, expectedStatus: http.StatusOK, expectedBody: string(contents)},
+		{name: "head", method: http.MethodHead, expectedStatus: http.StatusOK},
+		{name: "head with several ranges", method: http.MethodHead, rangeHeader: "bytes=0-4,10-14", expectedStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+"/download", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != tt.expectedStatus {
+				t.Errorf("got status %d, expected %d", res.StatusCode, tt.expectedStatus)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("got body %q, expected %q", body, tt.expectedBody)
+			}
+
+			// The headers describe the whole media, whether or not the body is sent
+			expectedHeaders := map[string]string{
+				"Content-Type":   "video/mp4",
+				"Content-Length": strconv.Itoa(len(contents)),
+				"Accept-Ranges":  "bytes",
+				"ETag":           "\"" + hash + "\"",
+			}
+			for k, expected := range expectedHeaders {
+				if got := res.Header.Get(k); got != expected {
+					t.Errorf("got %s %q, expected %q", k, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadIgnoredHost(t *testing.T) {
+	contents := []byte("media repo test file")
+	const hash = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	srv := httptest.NewServer(handler{
+		h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return &r0.DownloadMediaResponse{
+				ContentType: "image/svg+xml",
+				SizeBytes:   int64(len(contents)),
+				Data:        ioutil.NopCloser(bytes.NewReader(contents)),
+				Sha256Hash:  hash,
+			}
+		},
+		action:     "download",
+		reqCounter: &requestCounter{},
+		ignoreHost: true,
+	})
+	defer srv.Close()
+
+	// Hosts which aren't configured have no domain config, so the main config is used
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/download", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "unknown.example.org"
+	req.Header.Set("Accept-Encoding", "identity")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK || string(body) != string(contents) {
+		t.Fatalf("got status %d with body %q, expected %d with %q", res.StatusCode, body, http.StatusOK, contents)
+	}
+	expectedHeaders := map[string]string{
+		"Cache-Control": "public, immutable, max-age=600",
+		"Vary":          "Accept-Encoding",
+	}
+	for k, expected := range expectedHeaders {
+		if got := res.Header.Get(k); got != expected {
+			t.Errorf("got %s %q, expected %q", k, got, expected)
+		}
+	}
+}
+
+func TestThumbnailVaryAccept(t *testing.T) {
+	const hash = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	srv := httptest.NewServer(handler{
+		h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return &r0.DownloadMediaResponse{
+				ContentType: "image/webp",
+				SizeBytes:   4,
+				Data:        ioutil.NopCloser(bytes.NewReader([]byte("RIFF"))),
+				Sha256Hash:  hash,
+				VaryAccept:  true,
+			}
+		},
+		action:     "thumbnail",
+		reqCounter: &requestCounter{},
+	})
+	defer srv.Close()
+
+	for _, ifNoneMatch := range []string{"", "\"" + hash + "\""} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/thumbnail", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.Header.Get("Vary") != "Accept" {
+			t.Errorf("got Vary %q with status %d, expected Accept", res.Header.Get("Vary"), res.StatusCode)
+		}
+	}
+}
+
+// scrapeMetric returns the value of the metric with the given name and labels from the metrics endpoint.
+func TestDownloadContentDisposition(t *testing.T) {
+	tests := []struct {
+		name              string
+		contentType       string
+		filename          string
+		targetDisposition string
+		wantDisposition   string
+	}{
+		{name: "image", contentType: "image/png", filename: "cat.png", wantDisposition: "inline; filename=cat.png"},
+		{name: "svg", contentType: "image/svg+xml", filename: "cat.svg", wantDisposition: "attachment; filename=cat.svg"},
+		{name: "html", contentType: "text/html; charset=utf-8", filename: "page.html", wantDisposition: "attachment; filename=page.html"},
+		{name: "image requested as an attachment", contentType: "image/png", filename: "cat.png", targetDisposition: "attachment", wantDisposition: "attachment; filename=cat.png"},
+		{name: "svg requested inline", contentType: "image/svg+xml", filename: "cat.svg", targetDisposition: "inline", wantDisposition: "attachment; filename=cat.svg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(handler{
+				h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+					return &r0.DownloadMediaResponse{
+						ContentType:       tt.contentType,
+						Filename:          tt.filename,
+						SizeBytes:         4,
+						Data:              ioutil.NopCloser(bytes.NewReader([]byte("test"))),
+						TargetDisposition: tt.targetDisposition,
+					}
+				},
+				action:     "download",
+				reqCounter: &requestCounter{},
+			})
+			defer srv.Close()
+
+			res, err := http.Get(srv.URL + "/download")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.Header.Get("Content-Disposition") != tt.wantDisposition {
+				t.Errorf("got Content-Disposition %q, expected %q", res.Header.Get("Content-Disposition"), tt.wantDisposition)
+			}
+			if res.Header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("got X-Content-Type-Options %q, expected nosniff", res.Header.Get("X-Content-Type-Options"))
+			}
+		})
+	}
+}
+
+func scrapeMetric(t *testing.T, name string, labels string) float64 {
+	srv := httptest.NewServer(promhttp.Handler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := name + "{" + labels + "} "
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			val, err := strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return val
+		}
+	}
+	return 0
+}
+
+func TestMetricsAfterTraffic(t *testing.T) {
+	contents := make([]byte, 1000)
+	download := downloadServer(t, contents, "")
+	upload := httptest.NewServer(handler{
+		h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			return r0.UploadMedia(r, ctx, api.UserInfo{UserId: "@alice:127.0.0.1"})
+		},
+		action:     "upload",
+		reqCounter: &requestCounter{},
+	})
+	defer upload.Close()
+
+	servedBefore := scrapeMetric(t, "media_bytes_served_total", `action="download",host="127.0.0.1"`)
+	rejectedBefore := scrapeMetric(t, "media_uploads_total", `result="rejected"`)
+
+	res, err := http.Get(download.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	req, _ := http.NewRequest("GET", download.URL, nil)
+	req.Header.Set("Range", "bytes=0-99")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	// Smaller than the minimum upload size
+	res, err = http.Post(upload.URL, "text/plain", bytes.NewReader([]byte("tiny")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(b), common.ErrCodeMediaTooSmall) {
+		t.Fatalf("got %s, expected the upload to be rejected", b)
+	}
+
+	if served := scrapeMetric(t, "media_bytes_served_total", `action="download",host="127.0.0.1"`) - servedBefore; served != 1100 {
+		t.Errorf("got %v bytes served, expected 1100", served)
+	}
+	if rejected := scrapeMetric(t, "media_uploads_total", `result="rejected"`) - rejectedBefore; rejected != 1 {
+		t.Errorf("got %v uploads rejected, expected 1", rejected)
+	}
+}
+
+func TestUploadRateLimited(t *testing.T) {
+	upload := httptest.NewServer(handler{
+		h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+			ctx.Config.Uploads.RateLimit = config.UploadRateLimitConfig{Enabled: true, IntervalSeconds: 90, RequestsPerInterval: 2}
+			return r0.UploadMedia(r, ctx, api.UserInfo{UserId: "@ratelimited:127.0.0.1"})
+		},
+		action:     "upload",
+		reqCounter: &requestCounter{},
+	})
+	defer upload.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Post(upload.URL, "text/plain", bytes.NewReader([]byte("tiny")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if i < 2 {
+			// Allowed through the rate limiter, but too small to be stored
+			if res.StatusCode == http.StatusTooManyRequests {
+				t.Fatalf("upload %d was rate limited", i)
+			}
+			continue
+		}
+
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("got status %d, expected %d", res.StatusCode, http.StatusTooManyRequests)
+		}
+		// One request refills every 45 seconds, which is rounded up to whole seconds
+		if res.Header.Get("Retry-After") != "45" {
+			t.Errorf("got Retry-After %q, expected 45", res.Header.Get("Retry-After"))
+		}
+		if !strings.Contains(string(b), common.ErrCodeRateLimitExceeded) || !strings.Contains(string(b), `"retry_after_ms":`) {
+			t.Errorf("got %s, expected a rate limit error", b)
+		}
+	}
+}
+
+func TestIsGzipped(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	if _, err := gz.Write([]byte("<svg></svg>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		b        []byte
+		expected bool
+	}{
+		{name: "gzipped", b: gzipped.Bytes(), expected: true},
+		{name: "plain text", b: []byte("<svg></svg>"), expected: false},
+		{name: "one byte", b: []byte{0x1f}, expected: false},
+		{name: "empty", b: []byte{}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.b))
+			if got := isGzipped(r); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+
+			// Nothing may be consumed, as the whole stream is sent afterwards
+			rest, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, tt.b) {
+				t.Error("isGzipped consumed some of the stream")
+			}
+		})
+	}
+}
+
+func TestDownloadCompression(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`)
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F'}
+
+	tests := []struct {
+		name             string
+		contentType      string
+		contents         []byte
+		acceptEncoding   string
+		rangeHeader      string
+		expectedEncoding string
+		expectedVary     string
+	}{
+		{name: "svg", contentType: "image/svg+xml", contents: svg, acceptEncoding: "gzip", expectedEncoding: "gzip", expectedVary: "Accept-Encoding"},
+		{name: "svg without gzip support", contentType: "image/svg+xml", contents: svg, acceptEncoding: "identity", expectedVary: "Accept-Encoding"},
+		{name: "svg range", contentType: "image/svg+xml", contents: svg, acceptEncoding: "gzip", rangeHeader: "bytes=0-9"},
+		{name: "jpeg", contentType: "image/jpeg", contents: jpeg, acceptEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(handler{
+				h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+					return &r0.DownloadMediaResponse{
+						ContentType: tt.contentType,
+						SizeBytes:   int64(len(tt.contents)),
+						Data:        ioutil.NopCloser(bytes.NewReader(tt.contents)),
+					}
+				},
+				action:     "download",
+				reqCounter: &requestCounter{},
+			})
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/download", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Setting the header ourselves stops the client from decompressing the response
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.Header.Get("Content-Encoding") != tt.expectedEncoding {
+				t.Errorf("got Content-Encoding %q, expected %q", res.Header.Get("Content-Encoding"), tt.expectedEncoding)
+			}
+			if res.Header.Get("Vary") != tt.expectedVary {
+				t.Errorf("got Vary %q, expected %q", res.Header.Get("Vary"), tt.expectedVary)
+			}
+
+			var body []byte
+			if tt.expectedEncoding == "gzip" {
+				gz, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err = ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				body, err = ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected := tt.contents
+			if tt.rangeHeader != "" {
+				expected = tt.contents[:10]
+			}
+			if !bytes.Equal(body, expected) {
+				t.Errorf("got %q, expected %q", body, expected)
+			}
+		})
+	}
+}
+
+func TestKnownErrorResponses(t *testing.T) {
+	tests := []struct {
+		err             error
+		expectedStatus  int
+		expectedErrcode string
+	}{
+		{err: common.ErrMediaNotFound, expectedStatus: http.StatusNotFound, expectedErrcode: common.ErrCodeNotFound},
+		{err: common.ErrMediaTypeDenied, expectedStatus: http.StatusForbidden, expectedErrcode: common.ErrCodeForbidden},
+		{err: common.ErrMediaBlocked, expectedStatus: http.StatusForbidden, expectedErrcode: common.ErrCodeForbidden},
+		{err: common.ErrMediaTooLarge, expectedStatus: http.StatusRequestEntityTooLarge, expectedErrcode: common.ErrCodeTooLarge},
+		{err: common.ErrMediaEmpty, expectedStatus: http.StatusBadRequest, expectedErrcode: common.ErrCodeUnknown},
+		{err: common.ErrQuotaExceeded, expectedStatus: http.StatusForbidden, expectedErrcode: common.ErrCodeForbidden},
+		{err: common.ErrRemoteMediaTimeout, expectedStatus: http.StatusGatewayTimeout, expectedErrcode: common.ErrCodeUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			srv := httptest.NewServer(handler{
+				h: func(r *http.Request, ctx rcontext.RequestContext) interface{} {
+					return api.KnownErrorResponse(tt.err)
+				},
+				action:     "test",
+				reqCounter: &requestCounter{},
+			})
+			defer srv.Close()
+
+			res, err := http.Get(srv.URL + "/test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.expectedStatus {
+				t.Errorf("got status %d, expected %d", res.StatusCode, tt.expectedStatus)
+			}
+			body := make(map[string]interface{})
+			if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body["errcode"] != tt.expectedErrcode {
+				t.Errorf("got errcode %v, expected %s", body["errcode"], tt.expectedErrcode)
+			}
+			if message, ok := body["error"].(string); !ok || message == "" {
+				t.Errorf("got error %v, expected a message", body["error"])
+			}
+		})
+	}
+}
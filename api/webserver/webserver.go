@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,6 +31,9 @@ type route struct {
 	handler handler
 }
 
+// Hashes are bare hex for SHA-256, or prefixed with the algorithm's name for other algorithms
+const hashPattern = "(?:[a-z0-9]+:)?[a-fA-F0-9]{64,128}"
+
 var srv *http.Server
 var waitGroup = &sync.WaitGroup{}
 var reload = false
@@ -40,35 +44,52 @@ func Init() *sync.WaitGroup {
 
 	optionsHandler := handler{api.EmptyResponseHandler, "options_request", counter, false}
 	uploadHandler := handler{api.AccessTokenRequiredRoute(r0.UploadMedia), "upload", counter, false}
+	createMediaHandler := handler{api.AccessTokenRequiredRoute(r0.CreateMedia), "create_media", counter, false}
+	uploadReservedHandler := handler{api.AccessTokenRequiredRoute(r0.UploadReservedMedia), "upload_reserved", counter, false}
 	downloadHandler := handler{api.AccessTokenOptionalRoute(r0.DownloadMedia), "download", counter, false}
 	thumbnailHandler := handler{api.AccessTokenOptionalRoute(r0.ThumbnailMedia), "thumbnail", counter, false}
 	previewUrlHandler := handler{api.AccessTokenRequiredRoute(r0.PreviewUrl), "url_preview", counter, false}
 	identiconHandler := handler{api.AccessTokenOptionalRoute(r0.Identicon), "identicon", counter, false}
 	purgeRemote := handler{api.RepoAdminRoute(custom.PurgeRemoteMedia), "purge_remote_media", counter, false}
+	purgeRemoteOriginHandler := handler{api.RepoAdminRoute(custom.PurgeRemoteOrigin), "purge_remote_origin", counter, false}
 	purgeOneHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeIndividualRecord), "purge_individual_media", counter, false}
+	purgeBatchHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeMediaBatch), "purge_media_batch", counter, false}
 	purgeQuarantinedHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeQuarantined), "purge_quarantined", counter, false}
 	purgeUserMediaHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeUserMedia), "purge_user_media", counter, false}
 	purgeRoomHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeRoomMedia), "purge_room_media", counter, false}
 	purgeDomainHandler := handler{api.AccessTokenRequiredRoute(custom.PurgeDomainMedia), "purge_domain_media", counter, false}
 	purgeOldHandler := handler{api.RepoAdminRoute(custom.PurgeOldMedia), "purge_old_media", counter, false}
 	quarantineHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineMedia), "quarantine_media", counter, false}
+	unquarantineHandler := handler{api.AccessTokenRequiredRoute(custom.UnquarantineMedia), "unquarantine_media", counter, false}
 	quarantineRoomHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineRoomMedia), "quarantine_room", counter, false}
 	quarantineUserHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineUserMedia), "quarantine_user", counter, false}
 	quarantineDomainHandler := handler{api.AccessTokenRequiredRoute(custom.QuarantineDomainMedia), "quarantine_domain", counter, false}
 	localCopyHandler := handler{api.AccessTokenRequiredRoute(unstable.LocalCopy), "local_copy", counter, false}
 	infoHandler := handler{api.AccessTokenRequiredRoute(unstable.MediaInfo), "info", counter, false}
 	configHandler := handler{api.AccessTokenRequiredRoute(r0.PublicConfig), "config", counter, false}
+	authedDownloadHandler := handler{api.AccessTokenRequiredRoute(r0.DownloadMedia), "authed_download", counter, false}
+	authedThumbnailHandler := handler{api.AccessTokenRequiredRoute(r0.ThumbnailMedia), "authed_thumbnail", counter, false}
 	storageEstimateHandler := handler{api.RepoAdminRoute(custom.GetDatastoreStorageEstimate), "get_storage_estimate", counter, false}
 	datastoreListHandler := handler{api.RepoAdminRoute(custom.GetDatastores), "list_datastores", counter, false}
 	dsTransferHandler := handler{api.RepoAdminRoute(custom.MigrateBetweenDatastores), "datastore_transfer", counter, false}
+	getMigrationHandler := handler{api.RepoAdminRoute(custom.GetStorageMigration), "get_datastore_transfer", counter, false}
+	cancelMigrationHandler := handler{api.RepoAdminRoute(custom.CancelStorageMigration), "cancel_datastore_transfer", counter, false}
+	datastoreUsageHandler := handler{api.RepoAdminRoute(custom.GetDatastoreUsage), "datastore_usage", counter, false}
+	deduplicationStatsHandler := handler{api.RepoAdminRoute(custom.GetDeduplicationStats), "deduplication_stats", counter, false}
+	orphanedFilesHandler := handler{api.RepoAdminRoute(custom.GetOrphanedFiles), "datastore_orphaned_files", counter, false}
+	moveMediaHandler := handler{api.RepoAdminRoute(custom.MoveMediaToDatastore), "move_media_to_datastore", counter, false}
 	fedTestHandler := handler{api.RepoAdminRoute(custom.GetFederationInfo), "federation_test", counter, false}
 	healthzHandler := handler{api.AccessTokenOptionalRoute(custom.GetHealthz), "healthz", counter, true}
+	readyzHandler := handler{api.AccessTokenOptionalRoute(custom.GetReadyz), "readyz", counter, true}
 	domainUsageHandler := handler{api.RepoAdminRoute(custom.GetDomainUsage), "domain_usage", counter, false}
 	userUsageHandler := handler{api.RepoAdminRoute(custom.GetUserUsage), "user_usage", counter, false}
 	uploadsUsageHandler := handler{api.RepoAdminRoute(custom.GetUploadsUsage), "uploads_usage", counter, false}
+	mediaInventoryHandler := handler{api.RepoAdminRoute(custom.ExportMediaInventory), "export_media_inventory", counter, false}
+	mediaByHashHandler := handler{api.RepoAdminRoute(custom.DownloadMediaByHash), "download_media_by_hash", counter, false}
 	getBackgroundTaskHandler := handler{api.RepoAdminRoute(custom.GetTask), "get_background_task", counter, false}
 	listAllBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListAllTasks), "list_all_background_tasks", counter, false}
 	listUnfinishedBackgroundTasksHandler := handler{api.RepoAdminRoute(custom.ListUnfinishedTasks), "list_unfinished_background_tasks", counter, false}
+	regenerateThumbnailsHandler := handler{api.RepoAdminRoute(custom.RegenerateThumbnails), "regenerate_thumbnails", counter, false}
 	exportUserDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportUserData), "export_user_data", counter, false}
 	exportServerDataHandler := handler{api.AccessTokenRequiredRoute(custom.ExportServerData), "export_server_data", counter, false}
 	viewExportHandler := handler{api.AccessTokenOptionalRoute(custom.ViewExport), "view_export", counter, false}
@@ -84,6 +105,20 @@ func Init() *sync.WaitGroup {
 	logoutAllHandler := handler{api.AccessTokenRequiredRoute(r0.LogoutAll), "logout_all", counter, false}
 	getMediaAttrsHandler := handler{api.AccessTokenRequiredRoute(custom.GetAttributes), "get_media_attributes", counter, false}
 	setMediaAttrsHandler := handler{api.AccessTokenRequiredRoute(custom.SetAttributes), "set_media_attributes", counter, false}
+	uploadStatusHandler := handler{api.AccessTokenRequiredRoute(r0.UploadStatus), "upload_status", counter, false}
+	base64UploadHandler := handler{api.AccessTokenRequiredRoute(unstable.UploadBase64Media), "upload_base64", counter, false}
+	blockHashHandler := handler{api.RepoAdminRoute(custom.BlockHash), "block_hash", counter, false}
+	unblockHashHandler := handler{api.RepoAdminRoute(custom.UnblockHash), "unblock_hash", counter, false}
+	listBlockedHashesHandler := handler{api.RepoAdminRoute(custom.ListBlockedHashes), "list_blocked_hashes", counter, false}
+	getReadOnlyHandler := handler{api.RepoAdminRoute(custom.GetReadOnly), "get_read_only", counter, false}
+	enableReadOnlyHandler := handler{api.RepoAdminRoute(custom.EnableReadOnly), "enable_read_only", counter, false}
+	disableReadOnlyHandler := handler{api.RepoAdminRoute(custom.DisableReadOnly), "disable_read_only", counter, false}
+	resetReadOnlyHandler := handler{api.RepoAdminRoute(custom.ResetReadOnly), "reset_read_only", counter, false}
+	resumableOptionsHandler := handler{api.AccessTokenOptionalRoute(unstable.ResumableUploadOptions), "resumable_upload_options", counter, false}
+	createResumableHandler := handler{api.AccessTokenRequiredRoute(unstable.CreateResumableUpload), "create_resumable_upload", counter, false}
+	resumableHandler := handler{api.AccessTokenRequiredRoute(unstable.ResumableUpload), "resumable_upload", counter, false}
+	createPresignedHandler := handler{api.AccessTokenRequiredRoute(unstable.CreatePresignedUpload), "create_presigned_upload", counter, false}
+	finalizePresignedHandler := handler{api.AccessTokenRequiredRoute(unstable.FinalizePresignedUpload), "finalize_presigned_upload", counter, false}
 
 	routes := make(map[string]route)
 	// r0 is typically clients and v1 is typically servers. v1 is deprecated.
@@ -96,6 +131,8 @@ func Init() *sync.WaitGroup {
 	for _, version := range versions {
 		// Standard routes we have to handle
 		routes["/_matrix/media/"+version+"/upload"] = route{"POST", uploadHandler}
+		routes["/_matrix/media/"+version+"/create"] = route{"POST", createMediaHandler}
+		routes["/_matrix/media/"+version+"/upload/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"PUT", uploadReservedHandler}
 		routes["/_matrix/media/"+version+"/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", downloadHandler}
 		routes["/_matrix/media/"+version+"/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/{filename:.+}"] = route{"GET", downloadHandler}
 		routes["/_matrix/media/"+version+"/thumbnail/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", thumbnailHandler}
@@ -108,8 +145,10 @@ func Init() *sync.WaitGroup {
 		// Routes that we define but are not part of the spec (management)
 		routes["/_matrix/media/"+version+"/admin/purge_remote"] = route{"POST", purgeRemote} // deprecated
 		routes["/_matrix/media/"+version+"/admin/purge/remote"] = route{"POST", purgeRemote}
+		routes["/_matrix/media/"+version+"/admin/purge/remote/{origin:[a-zA-Z0-9.:\\-_]+}"] = route{"POST", purgeRemoteOriginHandler}
 		routes["/_matrix/media/"+version+"/admin/purge/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", purgeOneHandler}
 		routes["/_matrix/media/"+version+"/admin/purge/quarantined"] = route{"POST", purgeQuarantinedHandler}
+		routes["/_matrix/media/"+version+"/admin/delete"] = route{"POST", purgeBatchHandler}
 		routes["/_matrix/media/"+version+"/admin/purge/user/{userId:[^/]+}"] = route{"POST", purgeUserMediaHandler}
 		routes["/_matrix/media/"+version+"/admin/purge/room/{roomId:[^/]+}"] = route{"POST", purgeRoomHandler}
 		routes["/_matrix/media/"+version+"/admin/purge/server/{serverName:[^/]+}"] = route{"POST", purgeDomainHandler}
@@ -117,18 +156,30 @@ func Init() *sync.WaitGroup {
 		routes["/_matrix/media/"+version+"/admin/room/{roomId:[^/]+}/quarantine"] = route{"POST", quarantineRoomHandler} // deprecated
 		routes["/_matrix/media/"+version+"/admin/quarantine/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", quarantineHandler}
 		routes["/_matrix/media/"+version+"/admin/quarantine/room/{roomId:[^/]+}"] = route{"POST", quarantineRoomHandler}
+		routes["/_matrix/media/"+version+"/admin/unquarantine/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", unquarantineHandler}
 		routes["/_matrix/media/"+version+"/admin/quarantine/user/{userId:[^/]+}"] = route{"POST", quarantineUserHandler}
 		routes["/_matrix/media/"+version+"/admin/quarantine/server/{serverName:[^/]+}"] = route{"POST", quarantineDomainHandler}
 		routes["/_matrix/media/"+version+"/admin/datastores/{datastoreId:[^/]+}/size_estimate"] = route{"GET", storageEstimateHandler}
 		routes["/_matrix/media/"+version+"/admin/datastores"] = route{"GET", datastoreListHandler}
+		routes["/_matrix/media/"+version+"/admin/datastores/usage"] = route{"GET", datastoreUsageHandler}
+		routes["/_matrix/media/"+version+"/admin/datastores/deduplication"] = route{"GET", deduplicationStatsHandler}
 		routes["/_matrix/media/"+version+"/admin/datastores/{sourceDsId:[^/]+}/transfer_to/{targetDsId:[^/]+}"] = route{"POST", dsTransferHandler}
+		routes["/_matrix/media/"+version+"/admin/migrations/{taskId:[0-9]+}"] = route{"GET", getMigrationHandler}
+		routes["/_matrix/media/"+version+"/admin/migrations/{taskId:[0-9]+}/cancel"] = route{"POST", cancelMigrationHandler}
+		routes["/_matrix/media/"+version+"/admin/datastores/{datastoreId:[^/]+}/orphans"] = route{"POST", orphanedFilesHandler}
+		routes["/_matrix/media/"+version+"/admin/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/datastore/{datastoreId:[^/]+}"] = route{"POST", moveMediaHandler}
 		routes["/_matrix/media/"+version+"/admin/federation/test/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", fedTestHandler}
 		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}"] = route{"GET", domainUsageHandler}
 		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/users"] = route{"GET", userUsageHandler}
 		routes["/_matrix/media/"+version+"/admin/usage/{serverName:[a-zA-Z0-9.:\\-_]+}/uploads"] = route{"GET", uploadsUsageHandler}
+		routes["/_matrix/media/"+version+"/admin/export"] = route{"GET", mediaInventoryHandler}
+		routes["/_matrix/media/"+version+"/admin/by-hash/{sha256:"+hashPattern+"}"] = route{"GET", mediaByHashHandler}
 		routes["/_matrix/media/"+version+"/admin/tasks/{taskId:[0-9]+}"] = route{"GET", getBackgroundTaskHandler}
 		routes["/_matrix/media/"+version+"/admin/tasks/all"] = route{"GET", listAllBackgroundTasksHandler}
 		routes["/_matrix/media/"+version+"/admin/tasks/unfinished"] = route{"GET", listUnfinishedBackgroundTasksHandler}
+		routes["/_matrix/media/"+version+"/admin/thumbnails/regenerate"] = route{"POST", regenerateThumbnailsHandler}
+		routes["/_matrix/media/"+version+"/admin/thumbnails/regenerate/{server:[a-zA-Z0-9.:\\-_]+}"] = route{"POST", regenerateThumbnailsHandler}
+		routes["/_matrix/media/"+version+"/admin/thumbnails/regenerate/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"POST", regenerateThumbnailsHandler}
 		routes["/_matrix/media/"+version+"/admin/user/{userId:[^/]+}/export"] = route{"POST", exportUserDataHandler}
 		routes["/_matrix/media/"+version+"/admin/server/{serverName:[^/]+}/export"] = route{"POST", exportServerDataHandler}
 		routes["/_matrix/media/"+version+"/admin/export/{exportId:[a-zA-Z0-9.:\\-_]+}/view"] = route{"GET", viewExportHandler}
@@ -140,6 +191,13 @@ func Init() *sync.WaitGroup {
 		routes["/_matrix/media/"+version+"/admin/import/{importId:[a-zA-Z0-9.:\\-_]+}/close"] = route{"POST", stopImportHandler}
 		routes["/_matrix/media/"+version+"/admin/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes"] = route{"GET", getMediaAttrsHandler}
 		routes["/_matrix/media/"+version+"/admin/media/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/attributes/set"] = route{"POST", setMediaAttrsHandler}
+		routes["/_matrix/media/"+version+"/admin/blocklist/hashes"] = route{"GET", listBlockedHashesHandler}
+		routes["/_matrix/media/"+version+"/admin/blocklist/hashes/{sha256:"+hashPattern+"}/block"] = route{"POST", blockHashHandler}
+		routes["/_matrix/media/"+version+"/admin/blocklist/hashes/{sha256:"+hashPattern+"}/unblock"] = route{"POST", unblockHashHandler}
+		routes["/_matrix/media/"+version+"/admin/read_only"] = route{"GET", getReadOnlyHandler}
+		routes["/_matrix/media/"+version+"/admin/read_only/enable"] = route{"POST", enableReadOnlyHandler}
+		routes["/_matrix/media/"+version+"/admin/read_only/disable"] = route{"POST", disableReadOnlyHandler}
+		routes["/_matrix/media/"+version+"/admin/read_only/reset"] = route{"POST", resetReadOnlyHandler}
 
 		// Routes that we should handle but aren't in the media namespace (synapse compat)
 		routes["/_matrix/client/"+version+"/admin/purge_media_cache"] = route{"POST", purgeRemote}
@@ -148,10 +206,25 @@ func Init() *sync.WaitGroup {
 		if strings.Index(version, "unstable") == 0 {
 			routes["/_matrix/media/"+version+"/local_copy/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", localCopyHandler}
 			routes["/_matrix/media/"+version+"/info/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", infoHandler}
+			routes["/_matrix/media/"+version+"/upload/status/{jobId:[a-zA-Z0-9]+}"] = route{"GET", uploadStatusHandler}
+			routes["/_matrix/media/"+version+"/upload/base64"] = route{"POST", base64UploadHandler}
+			routes["/_matrix/media/"+version+"/upload/presigned"] = route{"POST", createPresignedHandler}
+			routes["/_matrix/media/"+version+"/upload/presigned/{uploadId:[a-zA-Z0-9]+}/finalize"] = route{"POST", finalizePresignedHandler}
 			routes["/_matrix/media/"+version+"/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"DELETE", purgeOneHandler}
 		}
 	}
 
+	// MSC2246 clients may use its unstable prefix rather than one of the versions above
+	routes["/_matrix/media/unstable/fi.mau.msc2246/create"] = route{"POST", createMediaHandler}
+	routes["/_matrix/media/unstable/fi.mau.msc2246/upload/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"PUT", uploadReservedHandler}
+
+	// MSC3916 moves the client media endpoints into the client namespace, where an access token is required
+	routes["/_matrix/client/v1/media/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", authedDownloadHandler}
+	routes["/_matrix/client/v1/media/download/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}/{filename:.+}"] = route{"GET", authedDownloadHandler}
+	routes["/_matrix/client/v1/media/thumbnail/{server:[a-zA-Z0-9.:\\-_]+}/{mediaId:[^/]+}"] = route{"GET", authedThumbnailHandler}
+	routes["/_matrix/client/v1/media/preview_url"] = route{"GET", previewUrlHandler}
+	routes["/_matrix/client/v1/media/config"] = route{"GET", configHandler}
+
 	if config.Get().Features.IPFS.Enabled {
 		routes[features.IPFSDownloadRoute] = route{"GET", ipfsDownloadHandler}
 		routes[features.IPFSLiveDownloadRouteR0] = route{"GET", ipfsDownloadHandler}
@@ -159,7 +232,16 @@ func Init() *sync.WaitGroup {
 		routes[features.IPFSLiveDownloadRouteUnstable] = route{"GET", ipfsDownloadHandler}
 	}
 
-	for routePath, route := range routes {
+	// Register the routes in order so that fixed path segments take priority over variables (which
+	// start with '{' and so sort after them), as the first matching route is used. For example,
+	// "purge/remote/{origin}" has to be matched before "purge/{server}/{mediaId}".
+	routePaths := make([]string, 0, len(routes))
+	for routePath := range routes {
+		routePaths = append(routePaths, routePath)
+	}
+	sort.Strings(routePaths)
+	for _, routePath := range routePaths {
+		route := routes[routePath]
 		logrus.Info("Registering route: " + route.method + " " + routePath)
 		rtr.Handle(routePath, route.handler).Methods(route.method)
 		rtr.Handle(routePath, optionsHandler).Methods("OPTIONS")
@@ -169,8 +251,33 @@ func Init() *sync.WaitGroup {
 		rtr.Handle(routePath+"/", optionsHandler).Methods("OPTIONS")
 	}
 
+	// Downloads also answer HEAD requests, with the same headers as a GET but no body
+	for _, routePath := range routePaths {
+		route := routes[routePath]
+		if route.method == "GET" && (route.handler.action == "download" || route.handler.action == "authed_download") {
+			rtr.Handle(routePath, route.handler).Methods("HEAD")
+			rtr.Handle(routePath+"/", route.handler).Methods("HEAD")
+		}
+	}
+
+	// Resumable uploads need several methods on the same path, so are registered separately
+	for _, version := range versions {
+		if strings.Index(version, "unstable") != 0 {
+			continue
+		}
+		tusPath := "/_matrix/media/" + version + "/tus"
+		tusUploadPath := tusPath + "/{uploadId:[a-zA-Z0-9]+}"
+		for _, suffix := range []string{"", "/"} {
+			rtr.Handle(tusPath+suffix, createResumableHandler).Methods("POST")
+			rtr.Handle(tusPath+suffix, resumableOptionsHandler).Methods("OPTIONS")
+			rtr.Handle(tusUploadPath+suffix, resumableHandler).Methods("HEAD", "PATCH", "DELETE")
+			rtr.Handle(tusUploadPath+suffix, resumableOptionsHandler).Methods("OPTIONS")
+		}
+	}
+
 	// Health check endpoints
 	rtr.Handle("/healthz", healthzHandler).Methods("OPTIONS", "GET", "HEAD")
+	rtr.Handle("/readyz", readyzHandler).Methods("OPTIONS", "GET", "HEAD")
 
 	rtr.NotFoundHandler = handler{api.NotFoundHandler, "not_found", counter, true}
 	rtr.MethodNotAllowedHandler = handler{api.MethodNotAllowedHandler, "method_not_allowed", counter, true}
@@ -232,12 +339,17 @@ func Reload() {
 	Init()
 }
 
+// Stop stops accepting new requests and waits for in-flight requests to finish, up to the
+// configured shutdown timeout.
 func Stop() {
 	if srv != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Get().General.ShutdownSeconds)*time.Second)
 		defer cancel()
 		if err := srv.Shutdown(ctx); err != nil {
-			panic(err)
+			logrus.Warn("Timed out waiting for requests to finish - closing remaining connections: ", err)
+			if err = srv.Close(); err != nil {
+				logrus.Error(err)
+			}
 		}
 	}
 }
@@ -58,7 +58,7 @@ func main() {
 		realPsqlPassword = *postgresPassword
 	}
 
-	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 	if err != nil {
 		panic(err)
 	}
@@ -121,12 +121,12 @@ func main() {
 		_ = f.Close()
 
 		temp := bytes.NewBuffer(d.Bytes())
-		sha256, err := util.GetSha256HashOfStream(ioutil.NopCloser(temp))
+		hash, err := util.GetHashOfStream(ioutil.NopCloser(temp))
 		if err != nil {
 			logrus.Fatal(err)
 		}
 
-		err = exporter.AppendMedia(*serverName, r.MediaId, r.UploadName, r.ContentType, util.FromMillis(r.CreatedTs), d, sha256, "", r.UserId)
+		err = exporter.AppendMedia(*serverName, r.MediaId, r.UploadName, r.ContentType, util.FromMillis(r.CreatedTs), d, hash, "", r.UserId)
 		if err != nil {
 			logrus.Fatal(err)
 		}
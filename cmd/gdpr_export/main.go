@@ -45,7 +45,7 @@ func main() {
 	assets.SetupTemplates(*templatesPath)
 
 	var err error
-	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 	if err != nil {
 		panic(err)
 	}
@@ -103,7 +103,7 @@ func main() {
 	_ = os.MkdirAll(*destination, os.ModePerm)
 
 	for _, p := range parts {
-		s, err := datastore.DownloadStream(ctx, p.DatastoreID, p.Location)
+		s, err := datastore.DownloadStream(ctx, p.DatastoreID, p.Location, p.Encoded)
 		if err != nil {
 			panic(err)
 		}
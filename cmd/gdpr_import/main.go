@@ -35,7 +35,7 @@ func main() {
 	assets.SetupMigrations(*migrationsPath)
 
 	var err error
-	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	err = logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Jeffail/tunny"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/assets"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/logging"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/common/runtime"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type manifestEntry struct {
+	File        string `json:"file"`
+	MxcUri      string `json:"mxc"`
+	UserId      string `json:"user_id"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+}
+
+type importRequest struct {
+	entry     *manifestEntry
+	directory string
+}
+
+type importResult int
+
+// getMedia and storeDirect are swapped out by tests
+var getMedia = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+}
+var storeDirect = upload_controller.StoreDirect
+
+const (
+	resultImported importResult = iota
+	resultSkipped
+	resultFailed
+)
+
+func main() {
+	configPath := flag.String("config", "media-repo.yaml", "The path to the configuration")
+	migrationsPath := flag.String("migrations", config.DefaultMigrationsPath, "The absolute path for the migrations folder")
+	filesDir := flag.String("directory", "./media", "The directory the manifest's files are relative to")
+	manifestPath := flag.String("manifest", "./manifest.json", "The path to the manifest describing the files to import")
+	numWorkers := flag.Int("workers", 1, "The number of files to import at the same time")
+	flag.Parse()
+
+	// Override config path with config for Docker users
+	configEnv := os.Getenv("REPO_CONFIG")
+	if configEnv != "" {
+		configPath = &configEnv
+	}
+
+	config.Path = *configPath
+	assets.SetupMigrations(*migrationsPath)
+
+	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info("Starting up...")
+	runtime.RunStartupSequence()
+
+	logrus.Info("Reading manifest...")
+	entries, err := readManifest(*manifestPath)
+	if err != nil {
+		panic(err)
+	}
+
+	logrus.Info(fmt.Sprintf("Importing %d files", len(entries)))
+
+	pool := tunny.NewFunc(*numWorkers, importFile)
+	defer pool.Close()
+
+	counts := make(map[importResult]int)
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, entry := range entries {
+		wg.Add(1)
+		go func(entry *manifestEntry) {
+			defer wg.Done()
+			result := pool.Process(&importRequest{entry: entry, directory: *filesDir}).(importResult)
+
+			lock.Lock()
+			counts[result]++
+			done := counts[resultImported] + counts[resultSkipped] + counts[resultFailed]
+			percent := int((float32(done) / float32(len(entries))) * 100)
+			logrus.Info(fmt.Sprintf("%d/%d processed (%d%%)", done, len(entries), percent))
+			lock.Unlock()
+		}(entry)
+	}
+	wg.Wait()
+
+	// Clean up
+	assets.Cleanup()
+
+	logrus.Info(fmt.Sprintf("Import completed: %d imported, %d already imported, %d failed", counts[resultImported], counts[resultSkipped], counts[resultFailed]))
+	if counts[resultFailed] > 0 {
+		os.Exit(1)
+	}
+}
+
+func readManifest(manifestPath string) ([]*manifestEntry, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]*manifestEntry, 0)
+	err = json.NewDecoder(f).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func importFile(req interface{}) interface{} {
+	payload := req.(*importRequest)
+	entry := payload.entry
+
+	origin, mediaId, err := util.SplitMxc(entry.MxcUri)
+	if err != nil {
+		logrus.Error(entry.MxcUri + ": " + err.Error())
+		return resultFailed
+	}
+
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{
+		"origin":  origin,
+		"mediaId": mediaId,
+		"file":    entry.File,
+	})
+
+	// Media which is already known was imported by an earlier run (or uploaded normally), so leave it alone
+	_, err = getMedia(origin, mediaId, ctx)
+	if err == nil {
+		ctx.Log.Info("Media already imported - skipping")
+		return resultSkipped
+	} else if err != sql.ErrNoRows {
+		ctx.Log.Error("Error checking for existing media: " + err.Error())
+		return resultFailed
+	}
+
+	f, err := os.Open(filepath.Join(payload.directory, filepath.FromSlash(entry.File)))
+	if err != nil {
+		ctx.Log.Error("Error opening file: " + err.Error())
+		return resultFailed
+	}
+	defer f.Close()
+
+	contentType := entry.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream" // binary
+	}
+
+	kind := common.KindRemoteMedia
+	if util.IsServerOurs(origin) {
+		kind = common.KindLocalMedia
+	}
+
+	_, err = storeDirect(nil, f, -1, contentType, entry.Filename, entry.UserId, origin, mediaId, kind, ctx, false)
+	if err != nil {
+		ctx.Log.Error("Error importing file: " + err.Error())
+		return resultFailed
+	}
+
+	return resultImported
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-import-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	// Media is imported as local or remote depending on the origin
+	err = ioutil.WriteFile(config.Path, []byte("homeservers:\n  - name: example.org\n    csApi: \"https://example.org/\"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name            string
+		manifest        string
+		expectedEntries []*manifestEntry
+		wantErr         bool
+	}{
+		{
+			name:     "entries",
+			manifest: `[{"file":"a/b.png","mxc":"mxc://example.org/abc123","user_id":"@alice:example.org","content_type":"image/png","filename":"b.png"},{"file":"c","mxc":"mxc://remote.org/def456"}]`,
+			expectedEntries: []*manifestEntry{
+				{File: "a/b.png", MxcUri: "mxc://example.org/abc123", UserId: "@alice:example.org", ContentType: "image/png", Filename: "b.png"},
+				{File: "c", MxcUri: "mxc://remote.org/def456"},
+			},
+		},
+		{name: "empty", manifest: `[]`, expectedEntries: []*manifestEntry{}},
+		{name: "not a list", manifest: `{"file":"c"}`, wantErr: true},
+		{name: "not json", manifest: `file,mxc`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifestPath := path.Join(t.TempDir(), "manifest.json")
+			if err := ioutil.WriteFile(manifestPath, []byte(tt.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readManifest(manifestPath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(entries, tt.expectedEntries) {
+				t.Errorf("got %+v, expected %+v", entries, tt.expectedEntries)
+			}
+		})
+	}
+
+	if _, err := readManifest(path.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing manifest")
+	}
+}
+
+// fakeMediaStore keeps imported media in memory, de-duplicating files by hash like StoreDirect does.
+type fakeMediaStore struct {
+	media map[string]*types.Media // MXC URI -> media
+	kinds map[string]string       // MXC URI -> kind
+	files map[string]string       // hash -> location
+}
+
+func withFakeMediaStore(t *testing.T) *fakeMediaStore {
+	store := &fakeMediaStore{media: map[string]*types.Media{}, kinds: map[string]string{}, files: map[string]string{}}
+
+	originalGet, originalStore := getMedia, storeDirect
+	t.Cleanup(func() {
+		getMedia, storeDirect = originalGet, originalStore
+	})
+	getMedia = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+		if m, ok := store.media["mxc://"+origin+"/"+mediaId]; ok {
+			return m, nil
+		}
+		return nil, sql.ErrNoRows
+	}
+	storeDirect = func(f *upload_controller.AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool) (*types.Media, error) {
+		b, err := ioutil.ReadAll(contents)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		hash := hex.EncodeToString(sum[:])
+		if _, ok := store.files[hash]; !ok {
+			store.files[hash] = "files/" + hash
+		}
+		m := &types.Media{Origin: origin, MediaId: mediaId, UploadName: filename, ContentType: contentType, UserId: userId, Sha256Hash: hash, SizeBytes: int64(len(b)), Location: store.files[hash]}
+		store.media[m.MxcUri()] = m
+		store.kinds[m.MxcUri()] = kind
+		return m, nil
+	}
+	return store
+}
+
+func TestImportFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.png": "first file", "b.png": "first file", "c.txt": "second file"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := []*manifestEntry{
+		{File: "a.png", MxcUri: "mxc://example.org/aaa", UserId: "@alice:example.org", ContentType: "image/png", Filename: "a.png"},
+		{File: "b.png", MxcUri: "mxc://example.org/bbb", UserId: "@bob:example.org", ContentType: "image/png", Filename: "b.png"},
+		{File: "c.txt", MxcUri: "mxc://remote.org/ccc"},
+		{File: "missing.txt", MxcUri: "mxc://example.org/ddd"},
+		{File: "c.txt", MxcUri: "https://example.org/eee"},
+	}
+	store := withFakeMediaStore(t)
+
+	tests := []struct {
+		name            string
+		expectedResults []importResult
+	}{
+		{name: "first run", expectedResults: []importResult{resultImported, resultImported, resultImported, resultFailed, resultFailed}},
+		{name: "second run", expectedResults: []importResult{resultSkipped, resultSkipped, resultSkipped, resultFailed, resultFailed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, entry := range manifest {
+				result := importFile(&importRequest{entry: entry, directory: dir})
+				if result != tt.expectedResults[i] {
+					t.Errorf("got %v for %s, expected %v", result, entry.MxcUri, tt.expectedResults[i])
+				}
+			}
+
+			if len(store.media) != 3 {
+				t.Errorf("got %d media records, expected 3", len(store.media))
+			}
+			if len(store.files) != 2 {
+				t.Errorf("got %d files, expected the duplicates to share one", len(store.files))
+			}
+		})
+	}
+
+	a, b, c := store.media["mxc://example.org/aaa"], store.media["mxc://example.org/bbb"], store.media["mxc://remote.org/ccc"]
+	if a == nil || b == nil || c == nil {
+		t.Fatalf("got %v, expected records with the media IDs from the manifest", store.media)
+	}
+	if a.UserId != "@alice:example.org" || a.ContentType != "image/png" || a.UploadName != "a.png" {
+		t.Errorf("got %+v, expected the uploader, content type and filename from the manifest", a)
+	}
+	if a.Location != b.Location || a.Location == c.Location {
+		t.Errorf("got locations %s, %s and %s, expected only the identical files to share one", a.Location, b.Location, c.Location)
+	}
+	if c.ContentType != "application/octet-stream" {
+		t.Errorf("got %s, expected files without a content type to be binary", c.ContentType)
+	}
+	if store.kinds[a.MxcUri()] != common.KindLocalMedia || store.kinds[c.MxcUri()] != common.KindRemoteMedia {
+		t.Errorf("got %v, expected media from other servers to be imported as remote media", store.kinds)
+	}
+}
@@ -72,7 +72,7 @@ func main() {
 		realPsqlPassword = *postgresPassword
 	}
 
-	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 	if err != nil {
 		panic(err)
 	}
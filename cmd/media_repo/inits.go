@@ -1,13 +1,16 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/thumbnail_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
 )
 
 func scanAndStartUnfinishedTasks() error {
@@ -28,9 +31,24 @@ func scanAndStartUnfinishedTasks() error {
 		})
 
 		if task.Name == "storage_migration" {
-			beforeTs := int64(task.Params["before_ts"].(float64))
-			sourceDsId := task.Params["source_datastore_id"].(string)
-			targetDsId := task.Params["target_datastore_id"].(string)
+			// Migrations which saved their progress are resumed by a recurring task instead
+			_, err = db.GetMigrationJob(task.ID)
+			if err == nil {
+				continue
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+
+			beforeTs, ok1 := task.Params["before_ts"].(float64)
+			sourceDsId, ok2 := task.Params["source_datastore_id"].(string)
+			targetDsId, ok3 := task.Params["target_datastore_id"].(string)
+			if !ok1 || !ok2 || !ok3 {
+				err = failInvalidTask(task, taskCtx)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 
 			sourceDs, err := datastore.LocateDatastore(taskCtx, sourceDsId)
 			if err != nil {
@@ -41,7 +59,7 @@ func scanAndStartUnfinishedTasks() error {
 				return err
 			}
 
-			newTask, err := maintenance_controller.StartStorageMigration(sourceDs, targetDs, beforeTs, taskCtx)
+			newTask, err := maintenance_controller.StartStorageMigration(sourceDs, targetDs, int64(beforeTs), taskCtx)
 			if err != nil {
 				return err
 			}
@@ -52,6 +70,49 @@ func scanAndStartUnfinishedTasks() error {
 			}
 
 			taskCtx.Log.Infof("Started replacement task ID %d for unfinished task %d (%s)", newTask.ID, task.ID, task.Name)
+		} else if task.Name == "regenerate_thumbnails" {
+			origin, ok1 := task.Params["origin"].(string)
+			mediaId, ok2 := task.Params["media_id"].(string)
+			purgeFirst, ok3 := task.Params["purge_first"].(bool)
+			if !ok1 || !ok2 || !ok3 {
+				err = failInvalidTask(task, taskCtx)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Media which was already done is regenerated again, which is harmless
+			newTask, err := thumbnail_controller.StartThumbnailRegeneration(origin, mediaId, purgeFirst, taskCtx)
+			if err != nil {
+				return err
+			}
+
+			err = db.FinishedBackgroundTask(task.ID)
+			if err != nil {
+				return err
+			}
+
+			taskCtx.Log.Infof("Started replacement task ID %d for unfinished task %d (%s)", newTask.ID, task.ID, task.Name)
+		} else if task.Name == "delete_moved_file" {
+			datastoreId, ok1 := task.Params["datastore_id"].(string)
+			location, ok2 := task.Params["location"].(string)
+			if !ok1 || !ok2 {
+				err = failInvalidTask(task, taskCtx)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Downloads from the old file ended when the media repo stopped, so it can go now
+			err = maintenance_controller.DeleteMovedFile(task.ID, datastoreId, location, taskCtx)
+			if err != nil {
+				// Not fatal - the deletion is tried again on the next startup
+				taskCtx.Log.Warn("Failed to delete moved file: ", err)
+				continue
+			}
+			taskCtx.Log.Infof("Deleted moved file for unfinished task %d (%s)", task.ID, task.Name)
 		} else {
 			taskCtx.Log.Warn(fmt.Sprintf("Unknown task %s at ID %d - ignoring", task.Name, task.ID))
 		}
@@ -60,3 +121,9 @@ func scanAndStartUnfinishedTasks() error {
 	return nil
 }
 
+// failInvalidTask marks a task with params that can't be understood as finished, so it isn't
+// retried on every startup.
+func failInvalidTask(task *types.BackgroundTask, ctx rcontext.RequestContext) error {
+	ctx.Log.Errorf("Unfinished task %d (%s) has invalid params - marking it as finished without resuming it", task.ID, task.Name)
+	return storage.GetDatabase().GetMetadataStore(ctx).FinishedBackgroundTask(task.ID)
+}
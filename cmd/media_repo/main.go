@@ -11,11 +11,14 @@ import (
 	"github.com/turt2live/matrix-media-repo/common/logging"
 	"github.com/turt2live/matrix-media-repo/common/runtime"
 	"github.com/turt2live/matrix-media-repo/common/version"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/metrics"
 	"github.com/turt2live/matrix-media-repo/tasks"
+	"github.com/turt2live/matrix-media-repo/tracing"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -59,7 +62,7 @@ func main() {
 	assets.SetupTemplates(*templatesPath)
 	assets.SetupAssets(*assetsPath)
 
-	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs)
+	err := logging.Setup(config.Get().General.LogDirectory, config.Get().General.LogColors, config.Get().General.JsonLogs, config.Get().General.RedactLogs, config.Get().General.RedactLogsKey)
 	if err != nil {
 		panic(err)
 	}
@@ -68,6 +71,9 @@ func main() {
 	runtime.RunStartupSequence()
 	internal_cache.ReplaceInstance() // init the cache as we may be using Redis, and it'd be good to get going sooner
 
+	logrus.Info("Removing leftover asynchronous uploads...")
+	upload_controller.RemoveOrphanedAsyncUploads()
+
 	logrus.Info("Checking background tasks...")
 	err = scanAndStartUnfinishedTasks()
 	if err != nil {
@@ -85,6 +91,7 @@ func main() {
 
 	logrus.Info("Starting media repository...")
 	metrics.Init()
+	tracing.Init()
 	web := webserver.Init()
 
 	// Set up a function to stop everything
@@ -95,33 +102,47 @@ func main() {
 		logrus.Info("Stopping metrics...")
 		metrics.Stop()
 
+		logrus.Info("Stopping tracing...")
+		tracing.Stop()
+
 		logrus.Info("Stopping recurring tasks...")
 		tasks.StopAll()
 	}
 
-	// Set up a listener for SIGINT
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt, os.Kill)
+	// Set up a listener for SIGINT and SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan bool)
 	selfStop := false
 	go func() {
-		defer close(stop)
+		defer close(stopped)
 		<-stop
 		selfStop = true
 
 		logrus.Warn("Stop signal received")
-		stopAllButWeb()
+		deadline := time.Now().Add(time.Duration(config.Get().General.ShutdownSeconds) * time.Second)
 
+		// Stop accepting requests first so in-flight uploads can finish
 		logrus.Info("Stopping web server...")
 		webserver.Stop()
+
+		logrus.Info("Waiting for in-flight uploads to finish...")
+		if !upload_controller.Drain(time.Until(deadline)) {
+			logrus.Warn("Timed out waiting for in-flight uploads to finish")
+		}
+
+		stopAllButWeb()
 	}()
 
 	// Wait for the web server to exit nicely
 	web.Add(1)
 	web.Wait()
 
-	// Stop everything else if we have to
+	// Stop everything else if we have to, otherwise wait for the stop sequence to finish
 	if !selfStop {
 		stopAllButWeb()
+	} else {
+		<-stopped
 	}
 
 	// Clean up
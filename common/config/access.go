@@ -3,11 +3,15 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"os"
 	"path"
+	"regexp"
 	"sort"
+	"strings"
 	"sync"
 
+	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"gopkg.in/yaml.v2"
@@ -23,6 +27,24 @@ const DefaultMigrationsPath = "./migrations"
 const DefaultTemplatesPath = "./templates"
 const DefaultAssetsPath = "./assets"
 
+// Custom media IDs need to be long enough, and use enough characters, to make collisions unlikely
+const MinMediaIdLength = 12
+const MinMediaIdAlphabetSize = 16
+
+// The characters the Matrix spec allows in media IDs
+const mediaIdCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"
+
+// What the age of media is measured from for the retention policy
+const RetentionBasisCreated = "created"
+const RetentionBasisLastAccess = "lastAccess"
+
+// The algorithms files can be hashed with
+const HashAlgorithmSha256 = "sha256"
+const HashAlgorithmSha512 = "sha512"
+const HashAlgorithmBlake2b = "blake2b"
+
+var backgroundColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
 var Runtime = &runtimeConfig{}
 var Path = "media-repo.yaml"
 
@@ -188,9 +210,111 @@ func reloadConfig() (*MainRepoConfig, map[string]*DomainRepoConfig, error) {
 		domainConfs[hs].Name = hs
 	}
 
+	err = validateThumbnails(c.Thumbnails.ThumbnailsConfig, "main config")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = validateUploads(c.Uploads, "main config")
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.General.RedactLogs && c.General.RedactLogsKey == "" {
+		return nil, nil, fmt.Errorf("invalid repo.redactLogsKey: must be set when redactLogs is enabled")
+	}
+	if c.HashAlgorithm != HashAlgorithmSha256 && c.HashAlgorithm != HashAlgorithmSha512 && c.HashAlgorithm != HashAlgorithmBlake2b {
+		return nil, nil, fmt.Errorf("invalid hashAlgorithm: must be %q, %q, or %q", HashAlgorithmSha256, HashAlgorithmSha512, HashAlgorithmBlake2b)
+	}
+	err = validateRetention(c.Retention)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Maintenance.RetryAfterSeconds < 0 {
+		return nil, nil, fmt.Errorf("invalid maintenance.retryAfterSeconds: must not be negative")
+	}
+	for hs, d := range domainConfs {
+		err = validateThumbnails(d.Thumbnails, hs)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = validateUploads(d.Uploads, hs)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	return &c, domainConfs, nil
 }
 
+func validateUploads(u UploadsConfig, where string) error {
+	if u.TokenAudit.Enabled && u.TokenAudit.Salt == "" {
+		return fmt.Errorf("invalid uploads.tokenAudit in %s: a salt is required when enabled", where)
+	}
+	if u.IdempotencyKeys.Enabled && u.IdempotencyKeys.ExpireAfterMinutes <= 0 {
+		return fmt.Errorf("invalid uploads.idempotencyKeys in %s: expireAfterMinutes must be positive", where)
+	}
+	if u.Reservations.Enabled && u.Reservations.ExpireAfterMinutes <= 0 {
+		return fmt.Errorf("invalid uploads.reservations in %s: expireAfterMinutes must be positive", where)
+	}
+	if u.UnknownTypeFallback != "" {
+		if _, _, err := mime.ParseMediaType(u.UnknownTypeFallback); err != nil {
+			return fmt.Errorf("invalid uploads.unknownTypeFallback in %s: %s", where, err.Error())
+		}
+	}
+	if u.MediaIdLength != 0 {
+		if u.MediaIdLength < MinMediaIdLength {
+			return fmt.Errorf("invalid uploads.mediaIdLength in %s: must be at least %d, or 0 for the default", where, MinMediaIdLength)
+		}
+		seen := make(map[rune]bool)
+		for _, c := range u.MediaIdAlphabet {
+			if !strings.ContainsRune(mediaIdCharacters, c) {
+				return fmt.Errorf("invalid uploads.mediaIdAlphabet in %s: %q is not allowed in media IDs", where, c)
+			}
+			if seen[c] {
+				return fmt.Errorf("invalid uploads.mediaIdAlphabet in %s: %q is listed more than once", where, c)
+			}
+			seen[c] = true
+		}
+		if len(seen) < MinMediaIdAlphabetSize {
+			return fmt.Errorf("invalid uploads.mediaIdAlphabet in %s: must have at least %d characters", where, MinMediaIdAlphabetSize)
+		}
+	}
+	return nil
+}
+
+func validateThumbnails(t ThumbnailsConfig, where string) error {
+	if t.Pdf.TimeoutSeconds <= 0 {
+		return fmt.Errorf("invalid thumbnails.pdf.timeoutSeconds in %s: must be positive", where)
+	}
+	if t.Video.TimeoutSeconds <= 0 {
+		return fmt.Errorf("invalid thumbnails.video.timeoutSeconds in %s: must be positive", where)
+	}
+	if t.Heif.TimeoutSeconds <= 0 {
+		return fmt.Errorf("invalid thumbnails.heif.timeoutSeconds in %s: must be positive", where)
+	}
+	if t.JpegQuality < 0 || t.JpegQuality > 100 {
+		return fmt.Errorf("invalid thumbnails.jpegQuality in %s: must be between 1 and 100, or 0 for the default", where)
+	}
+	if t.WebpQuality < 0 || t.WebpQuality > 100 {
+		return fmt.Errorf("invalid thumbnails.webpQuality in %s: must be between 1 and 100, or 0 for the default", where)
+	}
+	if t.BackgroundColor != "" && !backgroundColorRegex.MatchString(t.BackgroundColor) {
+		return fmt.Errorf("invalid thumbnails.backgroundColor in %s: must be a hex color like #ffffff", where)
+	}
+	return nil
+}
+
+func validateRetention(r RetentionConfig) error {
+	if r.Basis != RetentionBasisCreated && r.Basis != RetentionBasisLastAccess {
+		return fmt.Errorf("invalid retention.basis: must be %q or %q", RetentionBasisCreated, RetentionBasisLastAccess)
+	}
+	for i, rule := range r.Rules {
+		if rule.MaxAgeDays <= 0 {
+			return fmt.Errorf("invalid retention.rules[%d]: maxAgeDays must be positive", i)
+		}
+	}
+	return nil
+}
+
 func Get() *MainRepoConfig {
 	if instance == nil {
 		singletonLock.Do(func() {
@@ -222,6 +346,7 @@ func DomainConfigFrom(c MainRepoConfig) DomainRepoConfig {
 	// HACK: We should be better at this kind of inheritance
 	dc := NewDefaultDomainConfig()
 	dc.DataStores = c.DataStores
+	dc.DatastoreRules = c.DatastoreRules
 	dc.Archiving = c.Archiving
 	dc.Uploads = c.Uploads
 	dc.Identicons = c.Identicons
@@ -235,6 +360,54 @@ func DomainConfigFrom(c MainRepoConfig) DomainRepoConfig {
 	return dc
 }
 
+// UploadsForOrigin applies any per-origin overrides to the uploads config. An exact match for the
+// origin is preferred, otherwise the longest matching glob is used.
+func UploadsForOrigin(c UploadsConfig, origin string) UploadsConfig {
+	policy, ok := c.PerOrigin[origin]
+	if !ok {
+		matched := ""
+		for originGlob, p := range c.PerOrigin {
+			if !glob.Glob(originGlob, origin) {
+				continue
+			}
+			if !ok || len(originGlob) > len(matched) || (len(originGlob) == len(matched) && originGlob < matched) {
+				policy = p
+				matched = originGlob
+				ok = true
+			}
+		}
+	}
+	if !ok {
+		return c
+	}
+	return applyUploadsPolicy(c, policy)
+}
+
+// UploadsForAnonymous applies the anonymous upload policy, if there is one, to the uploads config.
+// This is for uploads which aren't made by a user, such as those made by automated processes.
+func UploadsForAnonymous(c UploadsConfig) UploadsConfig {
+	if c.AnonymousPolicy == nil {
+		return c
+	}
+	return applyUploadsPolicy(c, *c.AnonymousPolicy)
+}
+
+func applyUploadsPolicy(c UploadsConfig, policy OriginUploadsConfig) UploadsConfig {
+	if policy.MaxSizeBytes != nil {
+		c.MaxSizeBytes = *policy.MaxSizeBytes
+	}
+	if policy.MinSizeBytes != nil {
+		c.MinSizeBytes = *policy.MinSizeBytes
+	}
+	if policy.MaxSizeByType != nil {
+		c.MaxSizeByType = policy.MaxSizeByType
+	}
+	if policy.DeniedTypes != nil {
+		c.DeniedTypes = policy.DeniedTypes
+	}
+	return c
+}
+
 func UniqueDatastores() []DatastoreConfig {
 	confs := make([]DatastoreConfig, 0)
 
@@ -253,6 +426,9 @@ func UniqueDatastores() []DatastoreConfig {
 					} else if dsc.Type == "s3" && edsc.Options["endpoint"] == dsc.Options["endpoint"] && edsc.Options["bucketName"] == dsc.Options["bucketName"] {
 						found = true
 						break
+					} else if dsc.Type == "azure" && edsc.Options["accountName"] == dsc.Options["accountName"] && edsc.Options["endpoint"] == dsc.Options["endpoint"] && edsc.Options["container"] == dsc.Options["container"] {
+						found = true
+						break
 					}
 				}
 			}
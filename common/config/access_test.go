@@ -0,0 +1,204 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUploadsForOrigin(t *testing.T) {
+	stricter := int64(1000)
+	looser := int64(50000)
+	global := UploadsConfig{
+		MaxSizeBytes:  10000,
+		MaxSizeByType: map[string]int64{"video/*": 5000},
+		DeniedTypes:   []string{"application/x-msdownload"},
+		PerOrigin: map[string]OriginUploadsConfig{
+			"strict.example.org": {MaxSizeBytes: &stricter},
+			"*.example.org":      {MaxSizeBytes: &looser, DeniedTypes: []string{}},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		origin        string
+		wantMaxSize   int64
+		wantByType    int64
+		wantDenyCount int
+	}{
+		{name: "stricter size limit", origin: "strict.example.org", wantMaxSize: 1000, wantByType: 5000, wantDenyCount: 1},
+		{name: "matched by glob", origin: "other.example.org", wantMaxSize: 50000, wantByType: 5000, wantDenyCount: 0},
+		{name: "no override", origin: "example.com", wantMaxSize: 10000, wantByType: 5000, wantDenyCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := UploadsForOrigin(global, tt.origin)
+			if c.MaxSizeBytes != tt.wantMaxSize {
+				t.Errorf("got a max size of %d, expected %d", c.MaxSizeBytes, tt.wantMaxSize)
+			}
+			if c.MaxSizeByType["video/*"] != tt.wantByType {
+				t.Errorf("got a video limit of %d, expected %d", c.MaxSizeByType["video/*"], tt.wantByType)
+			}
+			if len(c.DeniedTypes) != tt.wantDenyCount {
+				t.Errorf("got denied types %v, expected %d of them", c.DeniedTypes, tt.wantDenyCount)
+			}
+		})
+	}
+
+	if global.MaxSizeBytes != 10000 {
+		t.Errorf("expected the global config to be left alone, got a max size of %d", global.MaxSizeBytes)
+	}
+}
+
+func TestValidateThumbnails(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *ThumbnailsConfig)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *ThumbnailsConfig) {}},
+		{name: "jpeg quality", modify: func(c *ThumbnailsConfig) { c.JpegQuality = 85 }},
+		{name: "jpeg quality of 100", modify: func(c *ThumbnailsConfig) { c.JpegQuality = 100 }},
+		{name: "negative jpeg quality", modify: func(c *ThumbnailsConfig) { c.JpegQuality = -1 }, wantErr: true},
+		{name: "jpeg quality over 100", modify: func(c *ThumbnailsConfig) { c.JpegQuality = 101 }, wantErr: true},
+		{name: "webp quality", modify: func(c *ThumbnailsConfig) { c.WebpQuality = 1 }},
+		{name: "negative webp quality", modify: func(c *ThumbnailsConfig) { c.WebpQuality = -5 }, wantErr: true},
+		{name: "webp quality over 100", modify: func(c *ThumbnailsConfig) { c.WebpQuality = 200 }, wantErr: true},
+		{name: "background color", modify: func(c *ThumbnailsConfig) { c.BackgroundColor = "#1A2b3c" }},
+		{name: "no background color", modify: func(c *ThumbnailsConfig) { c.BackgroundColor = "" }},
+		{name: "short background color", modify: func(c *ThumbnailsConfig) { c.BackgroundColor = "#fff" }, wantErr: true},
+		{name: "background color without hash", modify: func(c *ThumbnailsConfig) { c.BackgroundColor = "ffffff" }, wantErr: true},
+		{name: "named background color", modify: func(c *ThumbnailsConfig) { c.BackgroundColor = "white" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDefaultMainConfig().Thumbnails.ThumbnailsConfig
+			tt.modify(&c)
+			err := validateThumbnails(c, "main config")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUploads(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *UploadsConfig)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *UploadsConfig) {}},
+		{name: "token audit with a salt", modify: func(c *UploadsConfig) {
+			c.TokenAudit.Enabled = true
+			c.TokenAudit.Salt = "pepper"
+		}},
+		{name: "token audit without a salt", modify: func(c *UploadsConfig) { c.TokenAudit.Enabled = true }, wantErr: true},
+		{name: "salt while disabled", modify: func(c *UploadsConfig) { c.TokenAudit.Salt = "pepper" }},
+		{name: "idempotency keys", modify: func(c *UploadsConfig) { c.IdempotencyKeys.Enabled = true }},
+		{name: "idempotency keys without expiry", modify: func(c *UploadsConfig) {
+			c.IdempotencyKeys.Enabled = true
+			c.IdempotencyKeys.ExpireAfterMinutes = 0
+		}, wantErr: true},
+		{name: "reservations", modify: func(c *UploadsConfig) { c.Reservations.Enabled = true }},
+		{name: "reservations without expiry", modify: func(c *UploadsConfig) {
+			c.Reservations.Enabled = true
+			c.Reservations.ExpireAfterMinutes = 0
+		}, wantErr: true},
+		{name: "unknown type fallback", modify: func(c *UploadsConfig) { c.UnknownTypeFallback = "application/x-unknown" }},
+		{name: "invalid unknown type fallback", modify: func(c *UploadsConfig) { c.UnknownTypeFallback = "not a type" }, wantErr: true},
+		{name: "media id length", modify: func(c *UploadsConfig) { c.MediaIdLength = 12 }},
+		{name: "short media id length", modify: func(c *UploadsConfig) { c.MediaIdLength = 11 }, wantErr: true},
+		{name: "media id alphabet", modify: func(c *UploadsConfig) {
+			c.MediaIdLength = 16
+			c.MediaIdAlphabet = "0123456789abcdef"
+		}},
+		{name: "small media id alphabet", modify: func(c *UploadsConfig) {
+			c.MediaIdLength = 16
+			c.MediaIdAlphabet = "0123456789abcde"
+		}, wantErr: true},
+		{name: "repeated media id characters", modify: func(c *UploadsConfig) {
+			c.MediaIdLength = 16
+			c.MediaIdAlphabet = "0123456789abcdeff"
+		}, wantErr: true},
+		{name: "disallowed media id characters", modify: func(c *UploadsConfig) {
+			c.MediaIdLength = 16
+			c.MediaIdAlphabet = "0123456789abcdef/"
+		}, wantErr: true},
+		{name: "alphabet ignored without a length", modify: func(c *UploadsConfig) { c.MediaIdAlphabet = "ab" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDefaultMainConfig().Uploads
+			tt.modify(&c)
+			err := validateUploads(c, "main config")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadsForAnonymous(t *testing.T) {
+	smaller := int64(1024)
+	larger := int64(0)
+
+	tests := []struct {
+		name                string
+		policy              *OriginUploadsConfig
+		expectedMaxBytes    int64
+		expectedMinBytes    int64
+		expectedDeniedTypes []string
+	}{
+		{name: "no policy", policy: nil, expectedMaxBytes: 104857600, expectedDeniedTypes: []string{"text/html"}},
+		{name: "size limits", policy: &OriginUploadsConfig{MaxSizeBytes: &smaller, MinSizeBytes: &smaller}, expectedMaxBytes: 1024, expectedMinBytes: 1024, expectedDeniedTypes: []string{"text/html"}},
+		{name: "no limit", policy: &OriginUploadsConfig{MaxSizeBytes: &larger}, expectedMaxBytes: 0, expectedDeniedTypes: []string{"text/html"}},
+		{name: "denied types", policy: &OriginUploadsConfig{DeniedTypes: []string{"image/*"}}, expectedMaxBytes: 104857600, expectedDeniedTypes: []string{"image/*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := UploadsConfig{MaxSizeBytes: 104857600, DeniedTypes: []string{"text/html"}, AnonymousPolicy: tt.policy}
+			got := UploadsForAnonymous(c)
+			if got.MaxSizeBytes != tt.expectedMaxBytes || got.MinSizeBytes != tt.expectedMinBytes {
+				t.Errorf("got limits %d-%d, expected %d-%d", got.MinSizeBytes, got.MaxSizeBytes, tt.expectedMinBytes, tt.expectedMaxBytes)
+			}
+			if !reflect.DeepEqual(got.DeniedTypes, tt.expectedDeniedTypes) {
+				t.Errorf("got DeniedTypes %v, expected %v", got.DeniedTypes, tt.expectedDeniedTypes)
+			}
+			if c.MaxSizeBytes != 104857600 || c.DeniedTypes[0] != "text/html" {
+				t.Error("the original config was changed")
+			}
+		})
+	}
+}
+
+func TestValidateRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *RetentionConfig)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *RetentionConfig) {}},
+		{name: "last access", modify: func(c *RetentionConfig) { c.Basis = RetentionBasisLastAccess }},
+		{name: "unknown basis", modify: func(c *RetentionConfig) { c.Basis = "modified" }, wantErr: true},
+		{name: "no basis", modify: func(c *RetentionConfig) { c.Basis = "" }, wantErr: true},
+		{name: "rules", modify: func(c *RetentionConfig) {
+			c.Rules = []RetentionRule{{Origins: []string{"*.example.org"}, MaxAgeDays: 30}, {MaxAgeDays: 365}}
+		}},
+		{name: "zero age", modify: func(c *RetentionConfig) {
+			c.Rules = []RetentionRule{{Origins: []string{"*"}, MaxAgeDays: 0}}
+		}, wantErr: true},
+		{name: "negative age", modify: func(c *RetentionConfig) {
+			c.Rules = []RetentionRule{{MaxAgeDays: 30}, {MaxAgeDays: -1}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewDefaultMainConfig().Retention
+			tt.modify(&c)
+			err := validateRetention(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
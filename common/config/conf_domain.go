@@ -18,8 +18,31 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 			AdminApiKind:    "matrix",
 		},
 		Downloads: DownloadsConfig{
-			MaxSizeBytes:        104857600, // 100mb
-			FailureCacheMinutes: 15,
+			MaxSizeBytes:             104857600, // 100mb
+			FailureCacheMinutes:      15,
+			RemoteWaitTimeoutSeconds: 0,
+			CacheMaxAgeSeconds:       259200, // 3 days
+			InlineContentTypes: []string{
+				"image/png",
+				"image/jpeg",
+				"image/gif",
+				"image/webp",
+				"image/apng",
+				"image/avif",
+				"audio/*",
+				"video/*",
+				"text/plain",
+			},
+			RedirectToDatastore:   false,
+			RedirectExpirySeconds: 300, // 5 minutes
+			CompressTypes:         []string{},
+			FederationRateLimit: FederationRateLimitConfig{
+				Enabled:             false,
+				IntervalSeconds:     60,
+				RequestsPerInterval: 600,
+				BytesPerInterval:    1073741824, // 1gb
+				UseRedis:            false,
+			},
 		},
 		UrlPreviews: UrlPreviewsConfig{
 			Enabled:          true,
@@ -51,16 +74,37 @@ func NewDefaultDomainConfig() DomainRepoConfig {
 		Thumbnails: ThumbnailsConfig{
 			MaxSourceBytes:      10485760, // 10mb
 			MaxAnimateSizeBytes: 10485760, // 10mb
+			MaxAnimateFrames:    300,
 			MaxPixels:           32000000, // 32M
 			AllowAnimated:       true,
 			DefaultAnimated:     false,
+			AllowWebp:           false,
+			JpegQuality:         0,
+			WebpQuality:         0,
+			BackgroundColor:     "#ffffff",
+			Datastore:           "",
 			StillFrame:          0.5,
+			Pdf: PdfConfig{
+				Renderer:       "",
+				TimeoutSeconds: 30,
+			},
+			Video: VideoConfig{
+				Enabled:        false,
+				TimeoutSeconds: 30,
+			},
+			Heif: HeifConfig{
+				TimeoutSeconds: 30,
+			},
+			Placeholders: PlaceholderConfig{
+				Enabled: false,
+				Icons:   []PlaceholderIconConfig{},
+			},
 			Sizes: []ThumbnailSize{
-				{32, 32},
-				{96, 96},
-				{320, 240},
-				{640, 480},
-				{800, 600},
+				{32, 32, ""},
+				{96, 96, ""},
+				{320, 240, ""},
+				{640, 480, ""},
+				{800, 600, ""},
 			},
 			DynamicSizing: false,
 			Types: []string{
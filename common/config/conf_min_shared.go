@@ -1,19 +1,21 @@
 package config
 
 type MinimumRepoConfig struct {
-	DataStores     []DatastoreConfig `yaml:"datastores"`
-	Archiving      ArchivingConfig   `yaml:"archiving"`
-	Uploads        UploadsConfig     `yaml:"uploads"`
-	Identicons     IdenticonsConfig  `yaml:"identicons"`
-	Quarantine     QuarantineConfig  `yaml:"quarantine"`
-	TimeoutSeconds TimeoutsConfig    `yaml:"timeouts"`
-	Features       FeatureConfig     `yaml:"featureSupport"`
-	AccessTokens   AccessTokenConfig `yaml:"accessTokens"`
+	DataStores     []DatastoreConfig        `yaml:"datastores"`
+	DatastoreRules []DatastoreSelectionRule `yaml:"datastoreRules,flow"`
+	Archiving      ArchivingConfig          `yaml:"archiving"`
+	Uploads        UploadsConfig            `yaml:"uploads"`
+	Identicons     IdenticonsConfig         `yaml:"identicons"`
+	Quarantine     QuarantineConfig         `yaml:"quarantine"`
+	TimeoutSeconds TimeoutsConfig           `yaml:"timeouts"`
+	Features       FeatureConfig            `yaml:"featureSupport"`
+	AccessTokens   AccessTokenConfig        `yaml:"accessTokens"`
 }
 
 func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 	return MinimumRepoConfig{
-		DataStores: []DatastoreConfig{},
+		DataStores:     []DatastoreConfig{},
+		DatastoreRules: []DatastoreSelectionRule{},
 		Archiving: ArchivingConfig{
 			Enabled:            true,
 			SelfService:        false,
@@ -24,8 +26,66 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 			MinSizeBytes:         100,
 			ReportedMaxSizeBytes: 0,
 			Quota: QuotasConfig{
+				Enabled:          false,
+				UserQuotas:       []QuotaUserConfig{},
+				IgnoreDuplicates: false,
+			},
+			StripMetadata:            false,
+			MaxSizeByType:            map[string]int64{},
+			DeniedTypes:              []string{},
+			PerOrigin:                map[string]OriginUploadsConfig{},
+			TempPath:                 "",
+			EnforceExtensionMatch:    false,
+			ExtensionMatchExemptions: []string{},
+			UseDetectedContentType:   false,
+			MimeDetection:            "go",
+			UnknownTypeFallback:      "",
+			Scanner: ScannerConfig{
+				Type:           "",
+				Address:        "127.0.0.1:3310",
+				TimeoutSeconds: 30,
+			},
+			Resumable: ResumableUploadsConfig{
+				Enabled:            false,
+				TempPath:           "/tmp/mediarepo_resumable",
+				ExpireAfterMinutes: 60,
+				MaxPending:         5,
+			},
+			Presigned: PresignedUploadsConfig{
+				Enabled:            false,
+				ExpireAfterMinutes: 15,
+			},
+			IdempotencyKeys: IdempotencyKeysConfig{
+				Enabled:            false,
+				ExpireAfterMinutes: 1440,
+			},
+			Reservations: MediaReservationsConfig{
+				Enabled:            false,
+				ExpireAfterMinutes: 1440,
+				MaxPending:         5,
+			},
+			DeduplicationScope:    "global",
+			NoDedupTypes:          []string{},
+			MaxFilenameLength:     255,
+			MaxContentTypeLength:  255,
+			ContentTypeParameters: []string{"codecs"},
+			RecompressImages:      false,
+			ValidateImages:        false,
+			SanitizeSvg:           false,
+			PregenerateThumbnails: false,
+			MediaIdLength:         0,
+			MediaIdAlphabet:       "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+			Async: AsyncUploadsConfig{
 				Enabled:    false,
-				UserQuotas: []QuotaUserConfig{},
+				NumWorkers: 10,
+				TempPath:   "/tmp/mediarepo_async",
+			},
+			RateLimit: UploadRateLimitConfig{
+				Enabled:             false,
+				IntervalSeconds:     60,
+				RequestsPerInterval: 30,
+				BytesPerInterval:    524288000, // 500mb
+				UseRedis:            false,
 			},
 		},
 		Identicons: IdenticonsConfig{
@@ -44,17 +104,22 @@ func NewDefaultMinimumRepoConfig() MinimumRepoConfig {
 		},
 		Features: FeatureConfig{
 			MSC2448Blurhash: MSC2448Config{
-				Enabled:         false,
-				MaxRenderWidth:  1024,
-				MaxRenderHeight: 1024,
-				GenerateWidth:   64,
-				GenerateHeight:  64,
-				XComponents:     4,
-				YComponents:     3,
-				Punch:           1,
+				Enabled:          false,
+				MaxRenderWidth:   1024,
+				MaxRenderHeight:  1024,
+				GenerateWidth:    64,
+				GenerateHeight:   64,
+				XComponents:      4,
+				YComponents:      3,
+				Punch:            1,
+				GenerateOnUpload: false,
+			},
+			MSC3916AuthedMedia: MSC3916Config{
+				AllowLegacyUnauthenticated: true,
 			},
 			IPFS: IPFSConfig{
 				Enabled: false,
+				ApiUrl:  "",
 				Daemon: IPFSDaemonConfig{
 					Enabled:  true,
 					RepoPath: "./ipfs",
@@ -7,49 +7,216 @@ type ArchivingConfig struct {
 }
 
 type QuotaUserConfig struct {
-	Glob     string `yaml:"glob"`
-	MaxBytes int64  `yaml:"maxBytes"`
+	Glob          string `yaml:"glob"`
+	MaxBytes      int64  `yaml:"maxBytes"`
+	WindowSeconds int64  `yaml:"windowSeconds"`
 }
 
 type QuotasConfig struct {
-	Enabled    bool              `yaml:"enabled"`
-	UserQuotas []QuotaUserConfig `yaml:"users,flow"`
+	Enabled          bool              `yaml:"enabled"`
+	UserQuotas       []QuotaUserConfig `yaml:"users,flow"`
+	IgnoreDuplicates bool              `yaml:"ignoreDuplicates"`
+}
+
+type ScannerConfig struct {
+	Type           string `yaml:"type"`
+	Address        string `yaml:"address"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+type ResumableUploadsConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	TempPath           string `yaml:"tempPath"`
+	ExpireAfterMinutes int    `yaml:"expireAfterMinutes"`
+	MaxPending         int    `yaml:"maxPending"`
+}
+
+type PresignedUploadsConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	ExpireAfterMinutes int  `yaml:"expireAfterMinutes"`
+}
+
+type IdempotencyKeysConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	ExpireAfterMinutes int  `yaml:"expireAfterMinutes"`
+}
+
+type MediaReservationsConfig struct {
+	Enabled            bool  `yaml:"enabled"`
+	ExpireAfterMinutes int   `yaml:"expireAfterMinutes"`
+	MaxPending         int64 `yaml:"maxPending"`
+}
+
+type AsyncUploadsConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	NumWorkers int    `yaml:"numWorkers"`
+	TempPath   string `yaml:"tempPath"`
+}
+
+type UploadRateLimitConfig struct {
+	Enabled             bool  `yaml:"enabled"`
+	IntervalSeconds     int   `yaml:"intervalSeconds"`
+	RequestsPerInterval int64 `yaml:"requestsPerInterval"`
+	BytesPerInterval    int64 `yaml:"bytesPerInterval"`
+	UseRedis            bool  `yaml:"useRedis"`
 }
 
 type UploadsConfig struct {
-	MaxSizeBytes         int64        `yaml:"maxBytes"`
-	MinSizeBytes         int64        `yaml:"minBytes"`
-	ReportedMaxSizeBytes int64        `yaml:"reportedMaxBytes"`
-	Quota                QuotasConfig `yaml:"quotas"`
+	MaxSizeBytes             int64                          `yaml:"maxBytes"`
+	MinSizeBytes             int64                          `yaml:"minBytes"`
+	ReportedMaxSizeBytes     int64                          `yaml:"reportedMaxBytes"`
+	Quota                    QuotasConfig                   `yaml:"quotas"`
+	StripMetadata            bool                           `yaml:"stripMetadata"`
+	MaxSizeByType            map[string]int64               `yaml:"maxBytesByType,flow"`
+	DeniedTypes              []string                       `yaml:"deniedTypes,flow"`
+	UseDetectedContentType   bool                           `yaml:"useDetectedContentType"`
+	MimeDetection            string                         `yaml:"mimeDetection"`
+	Scanner                  ScannerConfig                  `yaml:"scanner"`
+	Resumable                ResumableUploadsConfig         `yaml:"resumable"`
+	Presigned                PresignedUploadsConfig         `yaml:"presigned"`
+	DeduplicationScope       string                         `yaml:"deduplicationScope"`
+	MaxFilenameLength        int                            `yaml:"maxFilenameLength"`
+	MaxContentTypeLength     int                            `yaml:"maxContentTypeLength"`
+	ContentTypeParameters    []string                       `yaml:"contentTypeParameters,flow"`
+	RecompressImages         bool                           `yaml:"recompressImages"`
+	ValidateImages           bool                           `yaml:"validateImages"`
+	SanitizeSvg              bool                           `yaml:"sanitizeSvg"`
+	PregenerateThumbnails    bool                           `yaml:"pregenerateThumbnails"`
+	Async                    AsyncUploadsConfig             `yaml:"async"`
+	RateLimit                UploadRateLimitConfig          `yaml:"rateLimit"`
+	PerOrigin                map[string]OriginUploadsConfig `yaml:"perOrigin"`
+	AnonymousPolicy          *OriginUploadsConfig           `yaml:"anonymousPolicy"`
+	TempPath                 string                         `yaml:"tempPath"`
+	EnforceExtensionMatch    bool                           `yaml:"enforceExtensionMatch"`
+	ExtensionMatchExemptions []string                       `yaml:"extensionMatchExemptions,flow"`
+	NoDedupTypes             []string                       `yaml:"noDedupTypes,flow"`
+	TokenAudit               TokenAuditConfig               `yaml:"tokenAudit"`
+	MediaIdLength            int                            `yaml:"mediaIdLength"`
+	MediaIdAlphabet          string                         `yaml:"mediaIdAlphabet"`
+	UnknownTypeFallback      string                         `yaml:"unknownTypeFallback"`
+	IdempotencyKeys          IdempotencyKeysConfig          `yaml:"idempotencyKeys"`
+	Reservations             MediaReservationsConfig        `yaml:"reservations"`
+}
+
+type TokenAuditConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Salt    string `yaml:"salt"`
+}
+
+// OriginUploadsConfig overrides parts of the uploads config for specific origins, or for uploads
+// which aren't made by a user. Options which are not set use the value from the uploads config.
+type OriginUploadsConfig struct {
+	MaxSizeBytes  *int64           `yaml:"maxBytes"`
+	MinSizeBytes  *int64           `yaml:"minBytes"`
+	MaxSizeByType map[string]int64 `yaml:"maxBytesByType,flow"`
+	DeniedTypes   []string         `yaml:"deniedTypes,flow"`
 }
 
 type DatastoreConfig struct {
-	Type       string            `yaml:"type"`
-	Enabled    bool              `yaml:"enabled"`
-	MediaKinds []string          `yaml:"forKinds,flow"`
-	Options    map[string]string `yaml:"opts,flow"`
+	Type         string                     `yaml:"type"`
+	Enabled      bool                       `yaml:"enabled"`
+	MediaKinds   []string                   `yaml:"forKinds,flow"`
+	Options      map[string]string          `yaml:"opts,flow"`
+	Compression  DatastoreCompressionConfig `yaml:"compression"`
+	Retries      DatastoreRetriesConfig     `yaml:"retries"`
+	MinFreeBytes int64                      `yaml:"minFreeBytes"`
+}
+
+type DatastoreRetriesConfig struct {
+	MaxRetries  int `yaml:"maxRetries"`
+	BaseDelayMs int `yaml:"baseDelayMs"`
+}
+
+type DatastoreCompressionConfig struct {
+	Algorithm    string   `yaml:"algorithm"`
+	ContentTypes []string `yaml:"contentTypes,flow"`
+}
+
+type DatastoreSelectionRule struct {
+	DatastoreId  string   `yaml:"datastoreId"`
+	MinBytes     int64    `yaml:"minBytes"`
+	MaxBytes     int64    `yaml:"maxBytes"`
+	ContentTypes []string `yaml:"contentTypes,flow"`
+	Origins      []string `yaml:"origins,flow"`
+}
+
+type FederationRateLimitConfig struct {
+	Enabled             bool  `yaml:"enabled"`
+	IntervalSeconds     int   `yaml:"intervalSeconds"`
+	RequestsPerInterval int64 `yaml:"requestsPerInterval"`
+	BytesPerInterval    int64 `yaml:"bytesPerInterval"`
+	UseRedis            bool  `yaml:"useRedis"`
 }
 
 type DownloadsConfig struct {
-	MaxSizeBytes        int64 `yaml:"maxBytes"`
-	FailureCacheMinutes int   `yaml:"failureCacheMinutes"`
+	MaxSizeBytes             int64                     `yaml:"maxBytes"`
+	FailureCacheMinutes      int                       `yaml:"failureCacheMinutes"`
+	RemoteWaitTimeoutSeconds int                       `yaml:"remoteWaitTimeoutSeconds"`
+	CacheMaxAgeSeconds       int                       `yaml:"cacheMaxAgeSeconds"`
+	InlineContentTypes       []string                  `yaml:"inlineContentTypes,flow"`
+	RedirectToDatastore      bool                      `yaml:"redirectToDatastore"`
+	RedirectExpirySeconds    int                       `yaml:"redirectExpirySeconds"`
+	CompressTypes            []string                  `yaml:"compressTypes,flow"`
+	FederationRateLimit      FederationRateLimitConfig `yaml:"federationRateLimit"`
 }
 
 type ThumbnailsConfig struct {
-	MaxSourceBytes      int64           `yaml:"maxSourceBytes"`
-	MaxPixels           int             `yaml:"maxPixels"`
-	Types               []string        `yaml:"types,flow"`
-	MaxAnimateSizeBytes int64           `yaml:"maxAnimateSizeBytes"`
-	Sizes               []ThumbnailSize `yaml:"sizes,flow"`
-	DynamicSizing       bool            `yaml:"dynamicSizing"`
-	AllowAnimated       bool            `yaml:"allowAnimated"`
-	DefaultAnimated     bool            `yaml:"defaultAnimated"`
-	StillFrame          float32         `yaml:"stillFrame"`
+	MaxSourceBytes      int64             `yaml:"maxSourceBytes"`
+	MaxPixels           int               `yaml:"maxPixels"`
+	Types               []string          `yaml:"types,flow"`
+	MaxAnimateSizeBytes int64             `yaml:"maxAnimateSizeBytes"`
+	MaxAnimateFrames    int               `yaml:"maxAnimateFrames"`
+	Sizes               []ThumbnailSize   `yaml:"sizes,flow"`
+	DynamicSizing       bool              `yaml:"dynamicSizing"`
+	StrictSizes         bool              `yaml:"strictSizes"`
+	AllowAnimated       bool              `yaml:"allowAnimated"`
+	AllowWebp           bool              `yaml:"allowWebp"`
+	JpegQuality         int               `yaml:"jpegQuality"`
+	WebpQuality         int               `yaml:"webpQuality"`
+	BackgroundColor     string            `yaml:"backgroundColor"`
+	Datastore           string            `yaml:"datastore"`
+	DefaultAnimated     bool              `yaml:"defaultAnimated"`
+	StillFrame          float32           `yaml:"stillFrame"`
+	Pdf                 PdfConfig         `yaml:"pdf"`
+	Heif                HeifConfig        `yaml:"heif"`
+	Video               VideoConfig       `yaml:"video"`
+	Placeholders        PlaceholderConfig `yaml:"placeholders"`
+}
+
+type PdfConfig struct {
+	Renderer       string `yaml:"renderer"`
+	BinaryPath     string `yaml:"binaryPath"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+type HeifConfig struct {
+	Decoder            string `yaml:"decoder"`
+	BinaryPath         string `yaml:"binaryPath"`
+	TranscodeDownloads bool   `yaml:"transcodeDownloads"`
+	TimeoutSeconds     int    `yaml:"timeoutSeconds"`
+}
+
+type VideoConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	FfmpegPath     string `yaml:"ffmpegPath"`
+	FfprobePath    string `yaml:"ffprobePath"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+type PlaceholderConfig struct {
+	Enabled bool                    `yaml:"enabled"`
+	Icons   []PlaceholderIconConfig `yaml:"icons,flow"`
+}
+
+type PlaceholderIconConfig struct {
+	ContentType string `yaml:"contentType"`
+	Path        string `yaml:"path"`
 }
 
 type ThumbnailSize struct {
-	Width  int `yaml:"width"`
-	Height int `yaml:"height"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+	Method string `yaml:"method"`
 }
 
 type UrlPreviewsConfig struct {
@@ -85,24 +252,31 @@ type TimeoutsConfig struct {
 }
 
 type FeatureConfig struct {
-	MSC2448Blurhash MSC2448Config `yaml:"MSC2448"`
-	IPFS            IPFSConfig    `yaml:"IPFS"`
-	Redis           RedisConfig   `yaml:"redis"`
+	MSC2448Blurhash    MSC2448Config `yaml:"MSC2448"`
+	MSC3916AuthedMedia MSC3916Config `yaml:"MSC3916"`
+	IPFS               IPFSConfig    `yaml:"IPFS"`
+	Redis              RedisConfig   `yaml:"redis"`
+}
+
+type MSC3916Config struct {
+	AllowLegacyUnauthenticated bool `yaml:"allowLegacyUnauthenticated"`
 }
 
 type MSC2448Config struct {
-	Enabled         bool `yaml:"enabled"`
-	MaxRenderWidth  int  `yaml:"maxWidth"`
-	MaxRenderHeight int  `yaml:"maxHeight"`
-	GenerateWidth   int  `yaml:"thumbWidth"`
-	GenerateHeight  int  `yaml:"thumbHeight"`
-	XComponents     int  `yaml:"xComponents"`
-	YComponents     int  `yaml:"yComponents"`
-	Punch           int  `yaml:"punch"`
+	Enabled          bool `yaml:"enabled"`
+	MaxRenderWidth   int  `yaml:"maxWidth"`
+	MaxRenderHeight  int  `yaml:"maxHeight"`
+	GenerateWidth    int  `yaml:"thumbWidth"`
+	GenerateHeight   int  `yaml:"thumbHeight"`
+	XComponents      int  `yaml:"xComponents"`
+	YComponents      int  `yaml:"yComponents"`
+	Punch            int  `yaml:"punch"`
+	GenerateOnUpload bool `yaml:"generateOnUpload"`
 }
 
 type IPFSConfig struct {
 	Enabled bool             `yaml:"enabled"`
+	ApiUrl  string           `yaml:"apiUrl"`
 	Daemon  IPFSDaemonConfig `yaml:"builtInDaemon"`
 }
 
@@ -6,8 +6,11 @@ type GeneralConfig struct {
 	LogDirectory     string `yaml:"logDirectory"`
 	LogColors        bool   `yaml:"logColors"`
 	JsonLogs         bool   `yaml:"jsonLogs"`
+	RedactLogs       bool   `yaml:"redactLogs"`
+	RedactLogsKey    string `yaml:"redactLogsKey"`
 	TrustAnyForward  bool   `yaml:"trustAnyForwardedAddress"`
 	UseForwardedHost bool   `yaml:"useForwardedHost"`
+	ShutdownSeconds  int    `yaml:"shutdownTimeoutSeconds"`
 }
 
 type HomeserverConfig struct {
@@ -30,8 +33,10 @@ type DbPoolConfig struct {
 type MainDownloadsConfig struct {
 	DownloadsConfig `yaml:",inline"`
 	NumWorkers      int         `yaml:"numWorkers"`
+	MaxQueued       int         `yaml:"maxQueued"`
 	Cache           CacheConfig `yaml:"cache"`
 	ExpireDays      int         `yaml:"expireAfterDays"`
+	MaxRemoteBytes  int64       `yaml:"maxRemoteBytes"`
 }
 
 type CacheConfig struct {
@@ -45,9 +50,11 @@ type CacheConfig struct {
 }
 
 type MainThumbnailsConfig struct {
-	ThumbnailsConfig `yaml:",inline"`
-	NumWorkers       int `yaml:"numWorkers"`
-	ExpireDays       int `yaml:"expireAfterDays"`
+	ThumbnailsConfig    `yaml:",inline"`
+	NumWorkers          int `yaml:"numWorkers"`
+	MaxConcurrent       int `yaml:"maxConcurrent"`
+	QueueTimeoutSeconds int `yaml:"queueTimeoutSeconds"`
+	ExpireDays          int `yaml:"expireAfterDays"`
 }
 
 type MainUrlPreviewsConfig struct {
@@ -62,12 +69,66 @@ type RateLimitConfig struct {
 	BurstCount        int     `yaml:"burst"`
 }
 
+type HealthConfig struct {
+	TimeoutSeconds int  `yaml:"timeoutSeconds"`
+	CheckWrites    bool `yaml:"checkWrites"`
+	CacheSeconds   int  `yaml:"cacheSeconds"`
+}
+
+type WebhooksConfig struct {
+	Hooks          []WebhookConfig `yaml:"hooks,flow"`
+	MaxAttempts    int             `yaml:"maxAttempts"`
+	TimeoutSeconds int             `yaml:"timeoutSeconds"`
+}
+
+type WebhookConfig struct {
+	Url    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+}
+
+type MetadataConfig struct {
+	TrackLastAccess      bool `yaml:"trackLastAccess"`
+	FlushIntervalSeconds int  `yaml:"flushIntervalSeconds"`
+}
+
+type RetentionConfig struct {
+	Enabled          bool            `yaml:"enabled"`
+	Basis            string          `yaml:"basis"`
+	ExemptLocalMedia bool            `yaml:"exemptLocalMedia"`
+	Rules            []RetentionRule `yaml:"rules,flow"`
+}
+
+type RetentionRule struct {
+	Origins    []string `yaml:"origins,flow"`
+	MaxAgeDays int      `yaml:"maxAgeDays"`
+}
+
+type MaintenanceConfig struct {
+	BatchSize         int  `yaml:"batchSize"`
+	Workers           int  `yaml:"workers"`
+	ReadOnly          bool `yaml:"readOnly"`
+	RetryAfterSeconds int  `yaml:"retryAfterSeconds"`
+}
+
 type MetricsConfig struct {
 	Enabled     bool   `yaml:"enabled"`
 	BindAddress string `yaml:"bindAddress"`
 	Port        int    `yaml:"port"`
 }
 
+type EncryptionConfig struct {
+	Enabled bool              `yaml:"enabled"`
+	KeyId   string            `yaml:"keyId"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+type TracingConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	Exporter   string  `yaml:"exporter"`
+	Endpoint   string  `yaml:"endpoint"`
+	SampleRate float64 `yaml:"sampleRate"`
+}
+
 type SharedSecretConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	Token   string `yaml:"token"`
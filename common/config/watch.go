@@ -87,14 +87,15 @@ func onFileChanged() {
 		globals.DatabaseReloadChan <- true
 	}
 
-	logChange := configNew.General.LogDirectory != configNow.General.LogDirectory
+	logChange := configNew.General.LogDirectory != configNow.General.LogDirectory || configNew.General.RedactLogs != configNow.General.RedactLogs || configNew.General.RedactLogsKey != configNow.General.RedactLogsKey
 	if logChange {
 		logrus.Warn("Log configuration changed - restart the media repo to apply changes")
 	}
 
 	ipfsDaemonChange := configNew.Features.IPFS.Daemon.Enabled != configNow.Features.IPFS.Daemon.Enabled
 	ipfsDaemonPathChange := configNew.Features.IPFS.Daemon.RepoPath != configNow.Features.IPFS.Daemon.RepoPath
-	if ipfsDaemonChange || ipfsDaemonPathChange {
+	ipfsApiChange := configNew.Features.IPFS.ApiUrl != configNow.Features.IPFS.ApiUrl
+	if ipfsDaemonChange || ipfsDaemonPathChange || ipfsApiChange {
 		logrus.Warn("IPFS Daemon options changed - reloading")
 		globals.IPFSReloadChan <- true
 	}
@@ -0,0 +1,5 @@
+package common
+
+const DedupeScopeGlobal = "global"
+const DedupeScopeOrigin = "origin"
+const DedupeScopeUser = "user"
@@ -15,4 +15,13 @@ const ErrCodeBadRequest = "M_BAD_REQUEST"
 const ErrCodeRateLimitExceeded = "M_LIMIT_EXCEEDED"
 const ErrCodeUnknown = "M_UNKNOWN"
 const ErrCodeForbidden = "M_FORBIDDEN"
+const ErrCodeUnrecognized = "M_UNRECOGNIZED"
 const ErrCodeQuotaExceeded = "M_QUOTA_EXCEEDED"
+const ErrCodeInsufficientStorage = "M_INSUFFICIENT_STORAGE"
+const ErrCodeDatastoreUnavailable = "M_DATASTORE_UNAVAILABLE"
+const ErrCodeShuttingDown = "M_SHUTTING_DOWN"
+const ErrCodeTooBusy = "M_TOO_BUSY"
+const ErrCodeReadOnly = "M_READ_ONLY"
+const ErrCodeRemoteTimeout = "M_REMOTE_TIMEOUT"
+const ErrCodeCannotOverwriteMedia = "M_CANNOT_OVERWRITE_MEDIA"
+const ErrCodeUploadInProgress = "M_UPLOAD_IN_PROGRESS"
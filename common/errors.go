@@ -6,7 +6,55 @@ import (
 
 var ErrMediaNotFound = errors.New("media not found")
 var ErrMediaTooLarge = errors.New("media too large")
+var ErrMediaEmpty = errors.New("file has no contents")
+var ErrMediaTooLargeForType = errors.New("media too large for content type")
+var ErrMediaTypeDenied = errors.New("media type not allowed")
+var ErrMediaExtensionMismatch = errors.New("media extension does not match content type")
+var ErrContentTypeTooLong = errors.New("content type too long")
+var ErrInvalidContentType = errors.New("invalid content type")
+var ErrInvalidUserId = errors.New("invalid user id")
 var ErrInvalidHost = errors.New("invalid host")
 var ErrHostNotFound = errors.New("host not found")
 var ErrHostBlacklisted = errors.New("host not allowed")
 var ErrMediaQuarantined = errors.New("media quarantined")
+var ErrMediaBlocked = errors.New("media blocked")
+var ErrMediaInfected = errors.New("media infected")
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrInvalidImage = errors.New("invalid image")
+var ErrMediaCorrupt = errors.New("media is corrupt or incomplete")
+var ErrImageTooLarge = errors.New("image dimensions too large")
+var ErrInvalidThumbnailSize = errors.New("thumbnail size not allowed")
+var ErrThumbnailQueueFull = errors.New("too many thumbnails are being generated")
+var ErrSvgSanitizeFailed = errors.New("failed to sanitize svg")
+var ErrMetadataStripFailed = errors.New("failed to strip metadata from media")
+var ErrDatastoreUnavailable = errors.New("datastore unavailable")
+var ErrShuttingDown = errors.New("media repo is shutting down")
+var ErrRemoteMediaTimeout = errors.New("timed out waiting for remote media")
+var ErrRemoteDownloadQueueFull = errors.New("too many remote downloads are queued")
+var ErrMediaReservationNotFound = errors.New("media reservation not found or expired")
+var ErrMediaReservationNotOwned = errors.New("media reservation belongs to another user")
+var ErrMediaAlreadyUploaded = errors.New("media has already been uploaded")
+var ErrTooManyMediaReservations = errors.New("too many pending media reservations")
+var ErrMediaReservationsUnavailable = errors.New("media reservations are not available on this server")
+var ErrTooManyResumableUploads = errors.New("too many resumable uploads in progress")
+var ErrUploadInProgress = errors.New("an upload with the same idempotency key is in progress")
+
+// DatastoreUnavailableError is returned when a datastore cannot be written to, such as when
+// it is out of space or mounted read-only. It matches ErrDatastoreUnavailable with errors.Is.
+type DatastoreUnavailableError struct {
+	DatastoreId  string
+	OutOfStorage bool
+	Err          error
+}
+
+func (e *DatastoreUnavailableError) Error() string {
+	return "datastore " + e.DatastoreId + " unavailable: " + e.Err.Error()
+}
+
+func (e *DatastoreUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DatastoreUnavailableError) Is(target error) bool {
+	return target == ErrDatastoreUnavailable
+}
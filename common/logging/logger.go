@@ -19,7 +19,7 @@ func (f utcFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return f.Formatter.Format(entry)
 }
 
-func Setup(dir string, colors bool, json bool) error {
+func Setup(dir string, colors bool, json bool, redact bool, redactKey string) error {
 	var lineFormatter logrus.Formatter
 	if json {
 		lineFormatter = &logrus.JSONFormatter{
@@ -36,6 +36,9 @@ func Setup(dir string, colors bool, json bool) error {
 			QuoteEmptyFields: true,
 		}
 	}
+	if redact {
+		lineFormatter = &redactingFormatter{Formatter: lineFormatter, key: []byte(redactKey)}
+	}
 	formatter := &utcFormatter{lineFormatter}
 	logrus.SetFormatter(formatter)
 	logrus.SetOutput(os.Stdout)
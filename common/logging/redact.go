@@ -0,0 +1,80 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields which hold a filename supplied by a user
+var filenameFields = map[string]bool{
+	"filename":         true,
+	"originalFilename": true,
+}
+
+var userIdRegex = regexp.MustCompile(`@[a-zA-Z0-9._=\-/+]+:[a-zA-Z0-9.\-]+(:[0-9]+)?`)
+var downloadFilenameRegex = regexp.MustCompile(`(/download/[^/]+/[^/]+/)(.+)$`)
+
+// redactingFormatter replaces user IDs and filenames with short hashes before the entry is formatted.
+// The same value always gets the same hash, so a user's requests can still be followed through the
+// logs. The server name of user IDs and the extension of filenames are kept. The hashes are keyed so
+// that they can't be reversed by hashing a list of likely values.
+type redactingFormatter struct {
+	logrus.Formatter
+	key []byte
+}
+
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// The entry is formatted once per output, so it can't be changed in place
+	redacted := *entry
+	redacted.Message = f.redactUserIds(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if s, ok := v.(string); ok {
+			if filenameFields[k] {
+				v = f.redactFilename(s)
+			} else if k == "resource" {
+				v = f.redactUserIds(f.redactDownloadFilename(s))
+			} else {
+				v = f.redactUserIds(s)
+			}
+		} else if err, ok := v.(error); ok {
+			v = f.redactUserIds(err.Error())
+		}
+		redacted.Data[k] = v
+	}
+	return f.Formatter.Format(&redacted)
+}
+
+func (f redactingFormatter) shortHash(s string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (f redactingFormatter) redactUserIds(s string) string {
+	return userIdRegex.ReplaceAllStringFunc(s, func(userId string) string {
+		// Localparts can't contain colons, so the first one starts the server name
+		return "@redacted-" + f.shortHash(userId) + userId[strings.Index(userId, ":"):]
+	})
+}
+
+func (f redactingFormatter) redactFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	return "redacted-" + f.shortHash(filename) + path.Ext(filename)
+}
+
+// redactDownloadFilename redacts the filename part of a download URL's path.
+func (f redactingFormatter) redactDownloadFilename(resource string) string {
+	return downloadFilenameRegex.ReplaceAllStringFunc(resource, func(s string) string {
+		m := downloadFilenameRegex.FindStringSubmatch(s)
+		return m[1] + f.redactFilename(m[2])
+	})
+}
@@ -0,0 +1,155 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testHash(key string, s string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	f := redactingFormatter{Formatter: &logrus.JSONFormatter{DisableTimestamp: true}, key: []byte("secret")}
+	alice := "@redacted-" + testHash("secret", "@alice:example.org") + ":example.org"
+	bob := "@redacted-" + testHash("secret", "@bob.smith:remote.org:8448") + ":remote.org:8448"
+	photo := "redacted-" + testHash("secret", "holiday photo.jpg") + ".jpg"
+
+	tests := []struct {
+		name           string
+		message        string
+		data           logrus.Fields
+		expectedMsg    string
+		expectedFields map[string]string
+	}{
+		{
+			name:        "user ids in the message",
+			message:     "Upload by @alice:example.org for @bob.smith:remote.org:8448",
+			expectedMsg: "Upload by " + alice + " for " + bob,
+		},
+		{
+			name:           "user id fields",
+			message:        "Uploading",
+			data:           logrus.Fields{"user_id": "@alice:example.org", "contentType": "image/jpeg"},
+			expectedMsg:    "Uploading",
+			expectedFields: map[string]string{"user_id": alice, "contentType": "image/jpeg"},
+		},
+		{
+			name:           "error fields",
+			message:        "Failed",
+			data:           logrus.Fields{"error": errors.New("quota exceeded for @alice:example.org")},
+			expectedMsg:    "Failed",
+			expectedFields: map[string]string{"error": "quota exceeded for " + alice},
+		},
+		{
+			name:           "filename fields",
+			message:        "Uploading",
+			data:           logrus.Fields{"filename": "holiday photo.jpg", "originalFilename": ""},
+			expectedMsg:    "Uploading",
+			expectedFields: map[string]string{"filename": photo, "originalFilename": ""},
+		},
+		{
+			name:           "download resource",
+			message:        "Request",
+			data:           logrus.Fields{"resource": "/_matrix/media/r0/download/example.org/abc123/holiday photo.jpg"},
+			expectedMsg:    "Request",
+			expectedFields: map[string]string{"resource": "/_matrix/media/r0/download/example.org/abc123/" + photo},
+		},
+		{
+			name:           "download resource without a filename",
+			message:        "Request",
+			data:           logrus.Fields{"resource": "/_matrix/media/r0/download/example.org/abc123"},
+			expectedMsg:    "Request",
+			expectedFields: map[string]string{"resource": "/_matrix/media/r0/download/example.org/abc123"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := logrus.NewEntry(logrus.New()).WithFields(tt.data)
+			entry.Message = tt.message
+			b, err := f.Format(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := make(map[string]interface{})
+			if err = json.Unmarshal(b, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out["msg"] != tt.expectedMsg {
+				t.Errorf("got message %q, expected %q", out["msg"], tt.expectedMsg)
+			}
+			for k, expected := range tt.expectedFields {
+				if out[k] != expected {
+					t.Errorf("got %s = %q, expected %q", k, out[k], expected)
+				}
+			}
+
+			// The entry may be formatted again for other outputs, so it must not be changed
+			if entry.Message != tt.message {
+				t.Errorf("got entry message %q, expected it to be unchanged", entry.Message)
+			}
+			for k, v := range tt.data {
+				if entry.Data[k] != v {
+					t.Errorf("got entry field %s = %v, expected it to be unchanged", k, entry.Data[k])
+				}
+			}
+		})
+	}
+}
+
+func TestRedactingFormatterKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		keyA          string
+		keyB          string
+		expectedEqual bool
+	}{
+		{name: "same key", keyA: "secret", keyB: "secret", expectedEqual: true},
+		{name: "different keys", keyA: "secret", keyB: "other secret", expectedEqual: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := redactingFormatter{key: []byte(tt.keyA)}.redactUserIds("@alice:example.org")
+			b := redactingFormatter{key: []byte(tt.keyB)}.redactUserIds("@alice:example.org")
+			if (a == b) != tt.expectedEqual {
+				t.Errorf("got %q and %q, expected equal = %t", a, b, tt.expectedEqual)
+			}
+		})
+	}
+}
+
+func TestRedactedLogOutput(t *testing.T) {
+	out := &strings.Builder{}
+	logger := logrus.New()
+	logger.Out = out
+	logger.Formatter = redactingFormatter{Formatter: &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}, key: []byte("secret")}
+
+	logger.WithFields(logrus.Fields{
+		"user_id":     "@alice:example.org",
+		"filename":    "holiday photo.jpg",
+		"contentType": "image/jpeg",
+		"resource":    "/_matrix/media/r0/download/example.org/abc123/holiday photo.jpg",
+	}).Info("Upload by @alice:example.org detected as image/jpeg, reported as image/png")
+	logger.WithError(errors.New("quota exceeded for @alice:example.org")).Warn("Upload failed")
+
+	for _, raw := range []string{"@alice:example.org", "alice", "holiday photo"} {
+		if strings.Contains(out.String(), raw) {
+			t.Errorf("got %q in the log output, expected it to be redacted:\n%s", raw, out.String())
+		}
+	}
+	for _, kept := range []string{"image/jpeg", "image/png", "example.org", ".jpg", "abc123"} {
+		if !strings.Contains(out.String(), kept) {
+			t.Errorf("expected %q to be kept in the log output:\n%s", kept, out.String())
+		}
+	}
+}
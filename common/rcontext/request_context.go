@@ -51,3 +51,14 @@ func (c RequestContext) ReplaceLogger(log *logrus.Entry) RequestContext {
 func (c RequestContext) LogWithFields(fields logrus.Fields) RequestContext {
 	return c.ReplaceLogger(c.Log.WithFields(fields))
 }
+
+// Detached creates a copy of the context which is not bound to the lifetime of the request,
+// for use in work which continues after the response has been sent.
+func (c RequestContext) Detached() RequestContext {
+	return RequestContext{
+		Context: context.Background(),
+		Log:     c.Log,
+		Config:  c.Config,
+		Request: nil,
+	}.populate()
+}
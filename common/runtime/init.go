@@ -12,6 +12,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/plugins"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
 )
 
@@ -68,6 +69,7 @@ func LoadDatastores() {
 
 			s3, err := ds_s3.GetOrCreateS3Datastore(ds.DatastoreId, conf)
 			if err != nil {
+				logrus.Warn("\t\tInvalid s3 configuration: ", err)
 				continue
 			}
 
@@ -80,6 +82,22 @@ func LoadDatastores() {
 			if err != nil {
 				logrus.Warn("\t\tTemporary path does not exist!")
 			}
+		} else if ds.Type == "azure" {
+			conf, err := datastore.GetDatastoreConfig(ds)
+			if err != nil {
+				continue
+			}
+
+			azure, err := ds_azure.GetOrCreateAzureDatastore(ds.DatastoreId, conf)
+			if err != nil {
+				logrus.Warn("\t\tInvalid azure configuration: ", err)
+				continue
+			}
+
+			err = azure.EnsureContainerExists()
+			if err != nil {
+				logrus.Warn("\t\tContainer does not exist!")
+			}
 		}
 	}
 }
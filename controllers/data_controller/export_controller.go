@@ -122,7 +122,7 @@ func StartUserExport(userId string, s3urls bool, includeData bool, ctx rcontext.
 		ctx.Context = context.Background()
 		db := storage.GetDatabase().GetMetadataStore(ctx)
 
-		ds, err := datastore.PickDatastore(common.KindArchives, ctx, )
+		ds, err := datastore.PickDatastore(common.KindArchives, ctx)
 		if err != nil {
 			ctx.Log.Error(err)
 			sentry.CaptureException(err)
@@ -191,7 +191,7 @@ func compileArchive(exportId string, entityId string, archiveDs *datastore.Datas
 		parts = append(parts, obj)
 
 		fname := fmt.Sprintf("export-part-%d.tgz", part)
-		err = exportDb.InsertExportPart(exportId, part, size, fname, archiveDs.DatastoreId, obj.Location)
+		err = exportDb.InsertExportPart(exportId, part, size, fname, archiveDs.DatastoreId, obj.Location, obj.Encoded)
 		if err != nil {
 			return err
 		}
@@ -265,7 +265,8 @@ func compileArchive(exportId string, entityId string, archiveDs *datastore.Datas
 	mediaManifest := make(map[string]*ManifestRecord)
 	for _, m := range media {
 		var s3url string
-		if s3urls {
+		// Encoded files can't be used directly from the bucket, so only the archived copy is usable
+		if s3urls && !m.Encoded {
 			s3url, err = ds_s3.GetS3URL(m.DatastoreId, m.Location)
 			if err != nil {
 				ctx.Log.Warn(err)
@@ -344,7 +345,7 @@ func compileArchive(exportId string, entityId string, archiveDs *datastore.Datas
 		ctx.Log.Info("Including data in the archive")
 		for _, m := range media {
 			ctx.Log.Info("Downloading ", m.MxcUri())
-			s, err := datastore.DownloadStream(ctx, m.DatastoreId, m.Location)
+			s, err := datastore.DownloadStream(ctx, m.DatastoreId, m.Location, m.Encoded)
 			if err != nil {
 				ctx.Log.Error(err)
 				sentry.CaptureException(err)
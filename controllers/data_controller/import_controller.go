@@ -399,7 +399,7 @@ func doImport(updateChannel chan *importUpdate, taskId int, importId string, ctx
 							UploadName:  record.FileName,
 							ContentType: record.ContentType,
 							UserId:      uploader,
-							Sha256Hash:  record.Sha256,
+							Sha256Hash:  util.NormalizeHash(record.Sha256),
 							SizeBytes:   record.SizeBytes,
 							DatastoreId: ds.DatastoreId,
 							Location:    location,
@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"time"
 
@@ -18,6 +17,7 @@ import (
 	"github.com/turt2live/matrix-media-repo/internal_cache"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/last_access"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
@@ -25,6 +25,11 @@ import (
 
 var localCache = cache.New(30*time.Second, 60*time.Second)
 
+// getMediaRecord is swapped out by tests
+var getMediaRecord = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+}
+
 func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
 	cacheKey := fmt.Sprintf("%s/%s?r=%t&b=%t", origin, mediaId, downloadRemote, blockForMedia)
 	v, _, err := globals.DefaultRequestGroup.Do(cacheKey, func() (interface{}, error) {
@@ -71,36 +76,10 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 				ctx.Log.Warn("Quarantined media accessed")
 				defer cleanup.DumpAndCloseStream(minMedia.Stream)
 
-				if ctx.Config.Quarantine.ReplaceDownloads {
-					ctx.Log.Info("Replacing thumbnail with a quarantined one")
-
-					img, err := quarantine_controller.GenerateQuarantineThumbnail(512, 512, ctx)
-					if err != nil {
-						return nil, err
-					}
-
-					data := &bytes.Buffer{}
-					imaging.Encode(data, img, imaging.PNG)
-					return &types.MinimalMedia{
-						// Lie about all the details
-						Stream:      util.BufferToStream(data),
-						ContentType: "image/png",
-						UploadName:  "quarantine.png",
-						SizeBytes:   int64(data.Len()),
-						MediaId:     mediaId,
-						Origin:      origin,
-						KnownMedia:  media,
-					}, nil
-				}
-
-				return nil, common.ErrMediaQuarantined
+				return quarantinedMedia(media, origin, mediaId, ctx)
 			}
 
-			err = storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
-			if err != nil {
-				sentry.CaptureException(err)
-				ctx.Log.Warn("Failed to upsert the last access time: ", err)
-			}
+			last_access.Track(media.Sha256Hash, ctx)
 
 			localCache.Set(origin+"/"+mediaId, media, cache.DefaultExpiration)
 
@@ -126,7 +105,7 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 		}
 
 		ctx.Log.Info("Reading media from disk")
-		mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+		mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location, media.Encoded)
 		if err != nil {
 			return nil, err
 		}
@@ -169,15 +148,13 @@ func GetMedia(origin string, mediaId string, downloadRemote bool, blockForMedia
 }
 
 func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
-	db := storage.GetDatabase().GetMediaStore(ctx)
-
 	var media *types.Media
 	item, found := localCache.Get(origin + "/" + mediaId)
 	if found {
 		media = item.(*types.Media)
 	} else {
 		ctx.Log.Info("Getting media record from database")
-		dbMedia, err := db.Get(origin, mediaId)
+		dbMedia, err := getMediaRecord(origin, mediaId, ctx)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				if util.IsServerOurs(origin) {
@@ -195,10 +172,10 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 				return nil, common.ErrMediaNotFound
 			}
 
-			mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
-			defer close(mediaChan)
-
-			result := <-mediaChan
+			result, err := waitForRemoteMedia(origin, mediaId, ctx)
+			if err != nil {
+				return nil, err
+			}
 			if result.err != nil {
 				return nil, result.err
 			}
@@ -209,7 +186,7 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 					return nil, errors.New("no stream available")
 				}
 
-				stream, err := datastore.DownloadStream(ctx, result.media.DatastoreId, result.media.Location)
+				stream, err := datastore.DownloadStream(ctx, result.media.DatastoreId, result.media.Location, result.media.Encoded)
 				if err != nil {
 					return nil, err
 				}
@@ -235,7 +212,7 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 		return nil, common.ErrMediaNotFound
 	}
 
-	mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+	mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location, media.Encoded)
 	if err != nil {
 		return nil, err
 	}
@@ -254,15 +231,13 @@ func FindMinimalMediaRecord(origin string, mediaId string, downloadRemote bool,
 func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rcontext.RequestContext) (*types.Media, error) {
 	cacheKey := origin + "/" + mediaId
 	v, _, err := globals.DefaultRequestGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
-		db := storage.GetDatabase().GetMediaStore(ctx)
-
 		var media *types.Media
 		item, found := localCache.Get(cacheKey)
 		if found {
 			media = item.(*types.Media)
 		} else {
 			ctx.Log.Info("Getting media record from database")
-			dbMedia, err := db.Get(origin, mediaId)
+			dbMedia, err := getMediaRecord(origin, mediaId, ctx)
 			if err != nil {
 				if err == sql.ErrNoRows {
 					if util.IsServerOurs(origin) {
@@ -280,10 +255,10 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 					return nil, common.ErrMediaNotFound
 				}
 
-				mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
-				defer close(mediaChan)
-
-				result := <-mediaChan
+				result, err := waitForRemoteMedia(origin, mediaId, ctx)
+				if err != nil {
+					return nil, err
+				}
 				if result.err != nil {
 					return nil, result.err
 				}
@@ -308,3 +283,56 @@ func FindMediaRecord(origin string, mediaId string, downloadRemote bool, ctx rco
 
 	return value, err
 }
+
+// quarantinedMedia returns the replacement for quarantined media, or ErrMediaQuarantined if it
+// shouldn't be replaced.
+func quarantinedMedia(media *types.Media, origin string, mediaId string, ctx rcontext.RequestContext) (*types.MinimalMedia, error) {
+	if ctx.Config.Quarantine.ReplaceDownloads {
+		ctx.Log.Info("Replacing thumbnail with a quarantined one")
+
+		img, err := quarantine_controller.GenerateQuarantineThumbnail(512, 512, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		data := &bytes.Buffer{}
+		imaging.Encode(data, img, imaging.PNG)
+		return &types.MinimalMedia{
+			// Lie about all the details
+			Stream:      util.BufferToStream(data),
+			ContentType: "image/png",
+			UploadName:  "quarantine.png",
+			SizeBytes:   int64(data.Len()),
+			MediaId:     mediaId,
+			Origin:      origin,
+			KnownMedia:  media,
+		}, nil
+	}
+
+	return nil, common.ErrMediaQuarantined
+}
+
+// waitForRemoteMedia downloads the remote media, waiting up to downloads.remoteWaitTimeoutSeconds
+// for it. Concurrent requests for the same media share a single download, which carries on in the
+// background after a timeout so the media can be served once it has been persisted.
+func waitForRemoteMedia(origin string, mediaId string, ctx rcontext.RequestContext) (*downloadResponse, error) {
+	mediaChan := getResourceHandler().DownloadRemoteMedia(origin, mediaId, true)
+
+	timeoutSeconds := ctx.Config.Downloads.RemoteWaitTimeoutSeconds
+	if timeoutSeconds <= 0 {
+		defer close(mediaChan)
+		return <-mediaChan, nil
+	}
+
+	timer := time.NewTimer(time.Duration(timeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case result := <-mediaChan:
+		close(mediaChan)
+		return result, nil
+	case <-timer.C:
+		// The channel is buffered, so the download can still complete without us
+		ctx.Log.Warn("Timed out waiting for remote media to download")
+		return nil, common.ErrRemoteMediaTimeout
+	}
+}
@@ -0,0 +1,246 @@
+package download_controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/resource_handler"
+)
+
+func TestMain(m *testing.M) {
+	// Remote downloads use the main config, which shouldn't be generated in the package
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	err = ioutil.WriteFile(config.Path, []byte("homeservers:\n  - name: example.org\n    csApi: \"https://example.org/\"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestQuarantinedMedia(t *testing.T) {
+	media := &types.Media{
+		Origin:      "example.org",
+		MediaId:     "abc",
+		ContentType: "text/plain",
+		UploadName:  "abuse.txt",
+		Quarantined: true,
+	}
+
+	ctx := testContext()
+	ctx.Config.Quarantine.ReplaceDownloads = false
+	replacement, err := quarantinedMedia(media, media.Origin, media.MediaId, ctx)
+	if err != common.ErrMediaQuarantined || replacement != nil {
+		t.Errorf("got %v, expected ErrMediaQuarantined", err)
+	}
+
+	ctx.Config.Quarantine.ReplaceDownloads = true
+	replacement, err = quarantinedMedia(media, media.Origin, media.MediaId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Stream.Close()
+	if replacement.ContentType != "image/png" || replacement.UploadName != "quarantine.png" {
+		t.Errorf("got %s named %s, expected the quarantine image", replacement.ContentType, replacement.UploadName)
+	}
+	if replacement.Origin != media.Origin || replacement.MediaId != media.MediaId {
+		t.Errorf("got %s/%s, expected the replacement to keep the media's identity", replacement.Origin, replacement.MediaId)
+	}
+	img, err := png.Decode(replacement.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 512 || img.Bounds().Dy() != 512 {
+		t.Errorf("got %v, expected a 512x512 image", img.Bounds())
+	}
+}
+
+var errTestDownload = errors.New("test download finished")
+
+// useTestResourceHandler makes remote downloads take as long as their media ID says rather than
+// going over federation.
+func useTestResourceHandler(t *testing.T) {
+	resHandlerLock.Do(func() {})
+	handler, err := resource_handler.New(5, func(r *resource_handler.WorkRequest) interface{} {
+		req := r.Metadata.(*downloadRequest)
+		delay, err := time.ParseDuration(req.mediaId)
+		if err != nil {
+			panic(err)
+		}
+		time.Sleep(delay)
+		return &workerDownloadResponse{err: errTestDownload}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resHandler = &mediaResourceHandler{handler}
+}
+
+func TestWaitForRemoteMedia(t *testing.T) {
+	useTestResourceHandler(t)
+
+	tests := []struct {
+		name           string
+		timeoutSeconds int
+		mediaId        string
+		expectedErr    error
+	}{
+		{name: "no timeout", timeoutSeconds: 0, mediaId: "100ms"},
+		{name: "within the timeout", timeoutSeconds: 1, mediaId: "10ms"},
+		{name: "past the timeout", timeoutSeconds: 1, mediaId: "1500ms", expectedErr: common.ErrRemoteMediaTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Downloads.RemoteWaitTimeoutSeconds = tt.timeoutSeconds
+
+			result, err := waitForRemoteMedia("example.org", tt.mediaId, ctx)
+			if err != tt.expectedErr {
+				t.Fatalf("got error %v, expected %v", err, tt.expectedErr)
+			}
+			if tt.expectedErr == nil && result.err != errTestDownload {
+				t.Errorf("got %v, expected the download's result", result.err)
+			}
+		})
+	}
+}
+
+// useTestRemote sends remote downloads to the handler instead of over federation, with a fresh
+// failure cache, for the rest of the test. Media is never found in the database. Returns the
+// number of requests the remote has received.
+func useTestRemote(t *testing.T, handler http.HandlerFunc) *int32 {
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	originalApiUrl := getServerApiUrl
+	originalGet := federatedGet
+	originalMedia := getMediaRecord
+	originalHandler := resHandler
+	originalErrors := downloadErrorsCache
+	t.Cleanup(func() {
+		getServerApiUrl = originalApiUrl
+		federatedGet = originalGet
+		getMediaRecord = originalMedia
+		resHandler = originalHandler
+		downloadErrorsCache = originalErrors
+	})
+
+	getServerApiUrl = func(hostname string) (string, string, error) {
+		return srv.URL, strings.TrimPrefix(srv.URL, "http://"), nil
+	}
+	federatedGet = func(url string, realHost string, ctx rcontext.RequestContext) (*http.Response, error) {
+		return http.Get(url)
+	}
+	getMediaRecord = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+		return nil, sql.ErrNoRows
+	}
+	downloadErrorCacheSingletonLock.Do(func() {})
+	downloadErrorsCache = cache.New(time.Minute, time.Minute)
+	useRemoteResourceHandler(t)
+	return &requests
+}
+
+// useRemoteResourceHandler replaces the resource handler with one which downloads remote media,
+// and hasn't remembered any earlier downloads.
+func useRemoteResourceHandler(t *testing.T) {
+	resHandlerLock.Do(func() {})
+	handler, err := resource_handler.New(5, func(r *resource_handler.WorkRequest) interface{} {
+		return downloadResourceWorkFn(r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resHandler = &mediaResourceHandler{handler}
+}
+
+func TestFindMediaRecordCoalescesRemoteDownloads(t *testing.T) {
+	release := make(chan bool)
+	requests := useTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	const concurrent = 10
+	errs := make(chan error, concurrent)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := FindMediaRecord("remote.example.org", "coalesced", true, testContext())
+			errs <- err
+		}()
+	}
+
+	// The remote doesn't answer until everyone is waiting on it, so each download that wasn't
+	// shared would reach it
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != common.ErrMediaNotFound {
+			t.Errorf("got error %v, expected %v", err, common.ErrMediaNotFound)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("got %d requests to the remote, expected 1", n)
+	}
+}
+
+func TestFindMediaRecordCachesRemoteFailure(t *testing.T) {
+	requests := useTestRemote(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	if _, err := FindMediaRecord("remote.example.org", "missing", true, testContext()); err != common.ErrMediaNotFound {
+		t.Fatalf("got error %v, expected %v", err, common.ErrMediaNotFound)
+	}
+
+	// A fresh resource handler doesn't remember the first download, so only the failure cache can
+	// stop the remote being asked again
+	useRemoteResourceHandler(t)
+	if _, err := FindMediaRecord("remote.example.org", "missing", true, testContext()); err != common.ErrMediaNotFound {
+		t.Fatalf("got error %v the second time, expected %v", err, common.ErrMediaNotFound)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("got %d requests to the remote, expected the second to be served from the failure cache", n)
+	}
+}
@@ -72,10 +72,15 @@ var resHandlerLock = &sync.Once{}
 var downloadErrorsCache *cache.Cache
 var downloadErrorCacheSingletonLock = &sync.Once{}
 
+// getServerApiUrl and federatedGet are swapped out by tests
+var getServerApiUrl = matrix.GetServerApiUrl
+var federatedGet = matrix.FederatedGet
+
 func getResourceHandler() *mediaResourceHandler {
 	if resHandler == nil {
 		resHandlerLock.Do(func() {
-			handler, err := resource_handler.New(config.Get().Downloads.NumWorkers, func(r *resource_handler.WorkRequest) interface{} {
+			downloadsConfig := config.Get().Downloads
+			handler, err := resource_handler.NewWithQueueLimit(downloadsConfig.NumWorkers, downloadsConfig.MaxQueued, func(r *resource_handler.WorkRequest) interface{} {
 				return downloadResourceWorkFn(r)
 			})
 			if err != nil {
@@ -91,10 +96,15 @@ func getResourceHandler() *mediaResourceHandler {
 }
 
 func (h *mediaResourceHandler) DownloadRemoteMedia(origin string, mediaId string, blockForMedia bool) chan *downloadResponse {
-	resultChan := make(chan *downloadResponse)
+	resultChan := make(chan *downloadResponse, 1)
 	go func() {
 		reqId := "remote_download:" + origin + "_" + mediaId
-		c := h.resourceHandler.GetResource(reqId, &downloadRequest{origin, mediaId, blockForMedia})
+		c, err := h.resourceHandler.TryGetResource(reqId, &downloadRequest{origin, mediaId, blockForMedia})
+		if err == resource_handler.ErrQueueFull {
+			logrus.Warn("Too many remote downloads are queued - refusing to download ", origin, "/", mediaId)
+			resultChan <- &downloadResponse{err: common.ErrRemoteDownloadQueueFull}
+			return
+		}
 		defer close(c)
 		result := <-c
 
@@ -221,14 +231,14 @@ func DownloadRemoteMediaDirect(server string, mediaId string, ctx rcontext.Reque
 		return nil, item.(error)
 	}
 
-	baseUrl, realHost, err := matrix.GetServerApiUrl(server)
+	baseUrl, realHost, err := getServerApiUrl(server)
 	if err != nil {
 		downloadErrorsCache.Set(cacheKey, err, cache.DefaultExpiration)
 		return nil, err
 	}
 
 	downloadUrl := baseUrl + "/_matrix/media/r0/download/" + server + "/" + mediaId + "?allow_remote=false"
-	resp, err := matrix.FederatedGet(downloadUrl, realHost, ctx)
+	resp, err := federatedGet(downloadUrl, realHost, ctx)
 	if err != nil {
 		downloadErrorsCache.Set(cacheKey, err, cache.DefaultExpiration)
 		return nil, err
@@ -1,15 +1,14 @@
 package info_controller
 
 import (
-	"bytes"
-	"image/png"
+	"io/ioutil"
 
-	"github.com/buckket/go-blurhash"
-	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
@@ -34,27 +33,18 @@ func GetOrCalculateBlurhash(media *types.Media, rctx rcontext.RequestContext) (s
 	defer cleanup.DumpAndCloseStream(minMedia.Stream)
 
 	// No cached blurhash: calculate one
-	rctx.Log.Info("Decoding image for blurhash calculation")
-	imgSrc, err := imaging.Decode(minMedia.Stream)
+	b, err := ioutil.ReadAll(minMedia.Stream)
 	if err != nil {
 		return "", err
 	}
-
-	// Resize the image to make the blurhash a bit more reasonable to calculate
-	rctx.Log.Info("Resizing image for blurhash (faster calculation)")
-	smallImg := imaging.Fill(imgSrc, rctx.Config.Features.MSC2448Blurhash.GenerateWidth, rctx.Config.Features.MSC2448Blurhash.GenerateHeight, imaging.Center, imaging.Lanczos)
-	imgBuf := &bytes.Buffer{}
-	err = imaging.Encode(imgBuf, smallImg, imaging.PNG)
-	if err != nil {
-		return "", err
-	}
-	decoded, err := png.Decode(imgBuf)
-	if err != nil {
-		return "", err
+	width, height, err := util.GetImageDimensions(b)
+	if err == nil && util.ExceedsMaxPixels(width, height, rctx.Config.Thumbnails.MaxPixels) {
+		rctx.Log.Warnf("Image declares dimensions of %dx%d, which is more than the maximum of %d pixels - refusing to decode", width, height, rctx.Config.Thumbnails.MaxPixels)
+		return "", common.ErrImageTooLarge
 	}
 
 	rctx.Log.Info("Calculating blurhash")
-	encoded, err := blurhash.Encode(rctx.Config.Features.MSC2448Blurhash.XComponents, rctx.Config.Features.MSC2448Blurhash.YComponents, decoded)
+	encoded, err := util.CalculateBlurhash(b, rctx.Config.Features.MSC2448Blurhash)
 	if err != nil {
 		return "", err
 	}
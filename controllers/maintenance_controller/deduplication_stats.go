@@ -0,0 +1,63 @@
+package maintenance_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/metrics"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Calculating the stats scans every media record, so the result is reused for a while
+const deduplicationStatsTtl = 10 * time.Minute
+
+var deduplicationStats *types.DeduplicationStats
+var deduplicationStatsLock = &sync.Mutex{}
+
+// getMediaUsageByDatastore is swapped out by tests
+var getMediaUsageByDatastore = func(ctx rcontext.RequestContext) ([]*types.DatastoreUsage, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).GetMediaUsageByDatastore()
+}
+
+// GetDeduplicationStats reports how much storage de-duplication of identical uploads is saving across
+// all datastores. The result is cached for a few minutes unless refresh is set. The stats are also
+// exported as metrics whenever they are calculated.
+func GetDeduplicationStats(refresh bool, ctx rcontext.RequestContext) (*types.DeduplicationStats, error) {
+	deduplicationStatsLock.Lock()
+	defer deduplicationStatsLock.Unlock()
+
+	if !refresh && deduplicationStats != nil && time.Since(util.FromMillis(deduplicationStats.CalculatedTs)) < deduplicationStatsTtl {
+		return deduplicationStats, nil
+	}
+
+	records, err := getMediaUsageByDatastore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := calculateDeduplicationStats(records)
+
+	metrics.DeduplicationLogicalBytes.Set(float64(stats.LogicalBytes))
+	metrics.DeduplicationPhysicalBytes.Set(float64(stats.PhysicalBytes))
+	metrics.DeduplicationRatio.Set(stats.Ratio)
+
+	deduplicationStats = stats
+	return stats, nil
+}
+
+// calculateDeduplicationStats adds up the usage of each datastore.
+func calculateDeduplicationStats(records []*types.DatastoreUsage) *types.DeduplicationStats {
+	stats := &types.DeduplicationStats{Ratio: 1, CalculatedTs: util.NowMillis()}
+	for _, record := range records {
+		stats.LogicalBytes += record.MediaBytes
+		stats.PhysicalBytes += record.UniqueBytes
+	}
+	stats.SavedBytes = stats.LogicalBytes - stats.PhysicalBytes
+	if stats.PhysicalBytes > 0 {
+		stats.Ratio = float64(stats.LogicalBytes) / float64(stats.PhysicalBytes)
+	}
+	return stats
+}
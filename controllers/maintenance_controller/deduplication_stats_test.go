@@ -0,0 +1,103 @@
+package maintenance_controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestCalculateDeduplicationStats(t *testing.T) {
+	tests := []struct {
+		name          string
+		records       []*types.DatastoreUsage
+		expectedStats types.DeduplicationStats
+	}{
+		{name: "no media", records: []*types.DatastoreUsage{}, expectedStats: types.DeduplicationStats{Ratio: 1}},
+		{
+			name:          "no duplicates",
+			records:       []*types.DatastoreUsage{{DatastoreId: "ds1", MediaBytes: 1000, UniqueBytes: 1000}},
+			expectedStats: types.DeduplicationStats{LogicalBytes: 1000, PhysicalBytes: 1000, Ratio: 1},
+		},
+		{
+			name: "several datastores",
+			records: []*types.DatastoreUsage{
+				{DatastoreId: "ds1", MediaBytes: 4096, UniqueBytes: 2048},
+				{DatastoreId: "ds2", MediaBytes: 2000, UniqueBytes: 1000},
+			},
+			expectedStats: types.DeduplicationStats{LogicalBytes: 6096, PhysicalBytes: 3048, SavedBytes: 3048, Ratio: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := calculateDeduplicationStats(tt.records)
+			if stats.CalculatedTs <= 0 {
+				t.Errorf("got CalculatedTs %d, expected the current time", stats.CalculatedTs)
+			}
+			stats.CalculatedTs = 0
+			if *stats != tt.expectedStats {
+				t.Errorf("got %+v, expected %+v", stats, tt.expectedStats)
+			}
+		})
+	}
+}
+
+func TestGetDeduplicationStats(t *testing.T) {
+	// A 300 byte file uploaded three times and a 100 byte file uploaded once to ds1, plus a copy of
+	// the 100 byte file in ds2 which can't share the file in ds1
+	lookups := 0
+	defer func(original func(rcontext.RequestContext) ([]*types.DatastoreUsage, error)) {
+		getMediaUsageByDatastore = original
+	}(getMediaUsageByDatastore)
+	getMediaUsageByDatastore = func(ctx rcontext.RequestContext) ([]*types.DatastoreUsage, error) {
+		lookups++
+		return []*types.DatastoreUsage{
+			{DatastoreId: "ds1", MediaBytes: 3*300 + 100, UniqueBytes: 300 + 100},
+			{DatastoreId: "ds2", MediaBytes: 100, UniqueBytes: 100},
+		}, nil
+	}
+	defer func() {
+		deduplicationStatsLock.Lock()
+		deduplicationStats = nil
+		deduplicationStatsLock.Unlock()
+	}()
+
+	tests := []struct {
+		name            string
+		cached          *types.DeduplicationStats
+		refresh         bool
+		expectedLookups int
+	}{
+		{name: "nothing cached", expectedLookups: 1},
+		{name: "cached", cached: &types.DeduplicationStats{Ratio: 1, CalculatedTs: util.NowMillis()}, expectedLookups: 0},
+		{name: "cache expired", cached: &types.DeduplicationStats{Ratio: 1, CalculatedTs: util.NowMillis() - (deduplicationStatsTtl + time.Minute).Milliseconds()}, expectedLookups: 1},
+		{name: "refresh", cached: &types.DeduplicationStats{Ratio: 1, CalculatedTs: util.NowMillis()}, refresh: true, expectedLookups: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups = 0
+			deduplicationStatsLock.Lock()
+			deduplicationStats = tt.cached
+			deduplicationStatsLock.Unlock()
+
+			stats, err := GetDeduplicationStats(tt.refresh, testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lookups != tt.expectedLookups {
+				t.Errorf("got %d lookups, expected %d", lookups, tt.expectedLookups)
+			}
+			if tt.expectedLookups == 0 {
+				if stats != tt.cached {
+					t.Errorf("got %+v, expected the cached stats", stats)
+				}
+				return
+			}
+			if stats.LogicalBytes != 1100 || stats.PhysicalBytes != 500 || stats.SavedBytes != 600 || stats.Ratio != 2.2 {
+				t.Errorf("got %+v, expected 1100 logical bytes, 500 physical bytes, 600 saved and a ratio of 2.2", stats)
+			}
+		})
+	}
+}
@@ -1,14 +1,21 @@
 package maintenance_controller
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/types"
@@ -27,80 +34,383 @@ func StartStorageMigration(sourceDs *datastore.DatastoreRef, targetDs *datastore
 		return nil, err
 	}
 
-	go func() {
-		ctx.Log.Info("Starting transfer")
+	job := &types.MigrationJob{
+		TaskID:            task.ID,
+		SourceDatastoreId: sourceDs.DatastoreId,
+		TargetDatastoreId: targetDs.DatastoreId,
+		BeforeTs:          beforeTs,
+		Status:            types.MigrationJobRunning,
+		Phase:             types.MigrationPhaseMedia,
+		UpdatedTs:         util.NowMillis(),
+	}
+	err = db.InsertMigrationJob(job)
+	if err != nil {
+		return nil, err
+	}
 
-		db := storage.GetDatabase().GetMetadataStore(ctx)
+	// The migration outlives the request which started it
+	ctx = ctx.Detached()
+	go runStorageMigration(job, sourceDs, targetDs, storage.GetDatabase().GetMetadataStore(ctx), ctx)
 
-		doUpdate := func(records []*types.MinimalMediaMetadata) {
-			for _, record := range records {
-				rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash})
+	return task, nil
+}
 
-				rctx.Log.Info("Starting transfer of media")
-				sourceStream, err := sourceDs.DownloadFile(record.Location)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to start download from source datastore")
-					sentry.CaptureException(err)
-					continue
-				}
+// How often a running migration marks itself as alive, and how long one can go without doing so
+// before another process assumes it stopped and resumes it.
+const migrationHeartbeatInterval = 1 * time.Minute
+const migrationStaleAfter = 5 * time.Minute
 
-				newLocation, err := targetDs.UploadFile(sourceStream, record.SizeBytes, rctx)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to upload file to target datastore")
-					sentry.CaptureException(err)
-					continue
-				}
+// ResumeStorageMigrations resumes migrations which were interrupted, such as by a restart, from where
+// they last saved their progress.
+func ResumeStorageMigrations(ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	jobs, err := db.GetStaleMigrationJobs(util.NowMillis() - migrationStaleAfter.Milliseconds())
+	if err != nil {
+		return err
+	}
 
-				rctx.Log.Info("Updating media records...")
-				err = db.ChangeDatastoreOfHash(targetDs.DatastoreId, newLocation.Location, record.Sha256Hash)
-				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to update database records")
-					sentry.CaptureException(err)
-					continue
-				}
+	for _, job := range jobs {
+		rctx := ctx.LogWithFields(logrus.Fields{"taskId": job.TaskID})
+
+		// Other processes may be looking at the same jobs
+		claimed, err := db.ClaimStaleMigrationJob(job)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
 
-				rctx.Log.Info("Deleting media from old datastore")
-				err = sourceDs.DeleteObject(record.Location)
+		sourceDs, err := datastore.LocateDatastore(rctx, job.SourceDatastoreId)
+		if err != nil {
+			rctx.Log.Error("Failed to locate source datastore to resume migration: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		targetDs, err := datastore.LocateDatastore(rctx, job.TargetDatastoreId)
+		if err != nil {
+			rctx.Log.Error("Failed to locate target datastore to resume migration: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+
+		rctx.Log.Infof("Resuming migration in the %s phase after hash %q", job.Phase, job.LastSha256Hash)
+		go runStorageMigration(job, sourceDs, targetDs, db, rctx)
+	}
+
+	return nil
+}
+
+// CancelStorageMigration stops a running migration after the file it is currently moving. False is
+// returned if the migration wasn't running.
+func CancelStorageMigration(taskId int, ctx rcontext.RequestContext) (bool, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	cancelled, err := db.SetMigrationJobStatus(taskId, types.MigrationJobCancelled)
+	if err != nil || !cancelled {
+		return false, err
+	}
+	return true, db.FinishedBackgroundTask(taskId)
+}
+
+// migrationStore is the part of the metadata store needed to run a migration.
+type migrationStore interface {
+	locationChanger
+	GetOldMediaInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error)
+	GetOldThumbnailsInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error)
+	UpdateMigrationJobProgress(job *types.MigrationJob) (bool, error)
+	SetMigrationJobStatus(taskId int, status string) (bool, error)
+	FinishedBackgroundTask(id int) error
+}
+
+// runStorageMigration moves the media and then the thumbnails of the job to the target datastore,
+// saving its progress after each file so it can be resumed. It stops early if the job is cancelled.
+func runStorageMigration(job *types.MigrationJob, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, db migrationStore, ctx rcontext.RequestContext) {
+	ctx.Log.Info("Starting transfer")
+
+	// Keep the job from looking stale while large files are copied
+	jobLock := &sync.Mutex{}
+	heartbeatDone := make(chan bool)
+	defer close(heartbeatDone)
+	go func() {
+		ticker := time.NewTicker(migrationHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatDone:
+				return
+			case <-ticker.C:
+				jobLock.Lock()
+				_, err := db.UpdateMigrationJobProgress(job)
+				jobLock.Unlock()
 				if err != nil {
-					rctx.Log.Error(err)
-					rctx.Log.Error("Failed to delete old media")
-					sentry.CaptureException(err)
-					continue
+					ctx.Log.Warn("Failed to update migration heartbeat: ", err)
 				}
+			}
+		}
+	}()
+
+	// Media and thumbnails can share a file, so only move each file once. Records with the same
+	// hash can still have their own files when de-duplication is scoped, so files are tracked by
+	// location rather than hash. Records which are skipped due to errors will be picked up again
+	// if the migration is re-run.
+	movedLocations := make(map[string]bool)
+	doUpdate := func(records []*types.MinimalMediaMetadata) bool {
+		sort.Slice(records, func(i int, j int) bool {
+			if records[i].Sha256Hash == records[j].Sha256Hash {
+				return records[i].Location < records[j].Location
+			}
+			return records[i].Sha256Hash < records[j].Sha256Hash
+		})
+		for _, record := range records {
+			// Files for the last hash may not have all been moved before the migration was
+			// interrupted. The ones which were no longer show up in the source datastore.
+			if record.Sha256Hash < job.LastSha256Hash {
+				continue // handled before the migration was interrupted
+			}
+			if _, moved := movedLocations[record.Location]; moved {
+				continue
+			}
 
-				rctx.Log.Info("Media updated!")
+			rctx := ctx.LogWithFields(logrus.Fields{"mediaSha256": record.Sha256Hash})
+			err := migrateFile(record, sourceDs, targetDs, db, rctx)
+			jobLock.Lock()
+			if err != nil {
+				rctx.Log.Error(err)
+				sentry.CaptureException(err)
+				job.FailedCount++
+			} else {
+				movedLocations[record.Location] = true
+				job.MigratedCount++
+				job.MigratedBytes += record.SizeBytes
+			}
+			job.LastSha256Hash = record.Sha256Hash
+			running, err := db.UpdateMigrationJobProgress(job)
+			jobLock.Unlock()
+			if err != nil {
+				rctx.Log.Warn("Failed to save migration progress: ", err)
+				sentry.CaptureException(err)
+			} else if !running {
+				ctx.Log.Info("Migration was cancelled")
+				return false
 			}
 		}
+		return true
+	}
 
-		media, err := db.GetOldMediaInDatastore(sourceDs.DatastoreId, beforeTs)
+	if job.Phase == types.MigrationPhaseMedia {
+		media, err := db.GetOldMediaInDatastore(job.SourceDatastoreId, job.BeforeTs)
 		if err != nil {
 			ctx.Log.Error(err)
 			sentry.CaptureException(err)
 			return
 		}
-		doUpdate(media)
+		if !doUpdate(media) {
+			return
+		}
 
-		thumbs, err := db.GetOldThumbnailsInDatastore(sourceDs.DatastoreId, beforeTs)
+		jobLock.Lock()
+		job.Phase = types.MigrationPhaseThumbnails
+		job.LastSha256Hash = ""
+		running, err := db.UpdateMigrationJobProgress(job)
+		jobLock.Unlock()
 		if err != nil {
-			ctx.Log.Error(err)
+			ctx.Log.Warn("Failed to save migration progress: ", err)
 			sentry.CaptureException(err)
+		} else if !running {
+			ctx.Log.Info("Migration was cancelled")
 			return
 		}
-		doUpdate(thumbs)
+	}
+
+	thumbs, err := db.GetOldThumbnailsInDatastore(job.SourceDatastoreId, job.BeforeTs)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+	if !doUpdate(thumbs) {
+		return
+	}
+
+	_, err = db.SetMigrationJobStatus(job.TaskID, types.MigrationJobFinished)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+	err = db.FinishedBackgroundTask(job.TaskID)
+	if err != nil {
+		ctx.Log.Error(err)
+		ctx.Log.Error("Failed to flag task as finished")
+		sentry.CaptureException(err)
+	}
+	ctx.Log.Info("Finished transfer")
+}
+
+// locationChanger is the part of the metadata store needed to point records at a migrated file.
+type locationChanger interface {
+	ChangeDatastoreOfLocation(oldDatastoreId string, oldLocation string, datastoreId string, location string, storedSizeBytes int64, encoded bool) error
+}
+
+// migrateFile copies the file for the record to the target datastore, and only once the copy is
+// verified are the database records changed and the source file deleted. Until then, downloads
+// continue to be served from the source datastore.
+func migrateFile(record *types.MinimalMediaMetadata, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, db locationChanger, ctx rcontext.RequestContext) error {
+	ctx.Log.Info("Starting transfer of media")
+	newLocation, err := copyFileToDatastore(record.Location, record.Encoded, record.Sha256Hash, record.SizeBytes, sourceDs, targetDs, ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only the records using this file are moved. With per-user or per-origin de-duplication, other
+	// records with the same hash have their own files.
+	ctx.Log.Info("Updating media records...")
+	err = db.ChangeDatastoreOfLocation(sourceDs.DatastoreId, record.Location, targetDs.DatastoreId, newLocation.Location, newLocation.StoredSizeBytes, newLocation.Encoded)
+	if err != nil {
+		// The records still point at the source, so the copy would otherwise be orphaned
+		deleteErr := targetDs.DeleteObject(newLocation.Location)
+		if deleteErr != nil {
+			ctx.Log.Warn("Failed to delete copy from target datastore: ", deleteErr)
+		}
+		return fmt.Errorf("failed to update database records: %s", err.Error())
+	}
+
+	ctx.Log.Info("Deleting media from old datastore")
+	err = sourceDs.DeleteObject(record.Location)
+	if err != nil {
+		return fmt.Errorf("failed to delete old media: %s", err.Error())
+	}
+
+	ctx.Log.Info("Media updated!")
+	return nil
+}
+
+// copyFileToDatastore copies the file at the location in the source datastore to the target
+// datastore, verifying that the copy has the expected hash. A copy which fails verification is
+// deleted again, leaving the source file untouched.
+func copyFileToDatastore(location string, encoded bool, sha256Hash string, sizeBytes int64, sourceDs *datastore.DatastoreRef, targetDs *datastore.DatastoreRef, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	sourceStream, err := sourceDs.DownloadFile(location, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start download from source datastore: %s", err.Error())
+	}
 
-		err = db.FinishedBackgroundTask(task.ID)
+	newLocation, err := targetDs.UploadFile(sourceStream, sizeBytes, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file to target datastore: %s", err.Error())
+	}
+
+	ctx.Log.Info("Verifying copied media...")
+	targetStream, err := targetDs.DownloadFile(newLocation.Location, newLocation.Encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start download from target datastore: %s", err.Error())
+	}
+	// The file keeps its hash, which may be from a different algorithm than is configured now
+	targetHash, err := util.GetHashOfStreamWith(util.HashAlgorithmOf(sha256Hash), targetStream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file in target datastore: %s", err.Error())
+	}
+	if targetHash != sha256Hash {
+		// Leave the source alone and clean up the bad copy so a later run can try again
+		err = targetDs.DeleteObject(newLocation.Location)
 		if err != nil {
-			ctx.Log.Error(err)
-			ctx.Log.Error("Failed to flag task as finished")
+			ctx.Log.Warn("Failed to delete mismatched copy from target datastore: ", err)
+		}
+		return nil, fmt.Errorf("hash mismatch after copying to target datastore: got %s", targetHash)
+	}
+
+	return newLocation, nil
+}
+
+// How long to keep the old file of moved media around, so downloads which started from it (or
+// from a cached media record) can finish. This must outlast the download controller's cache.
+const movedFileDeleteDelay = 2 * time.Minute
+
+// The background task which records a moved file waiting to be deleted
+const deleteMovedFileTask = "delete_moved_file"
+
+// MoveMediaToDatastore moves the file for a single media item to the target datastore, returning
+// the updated media. Any other media or thumbnails which share the file are moved with it.
+func MoveMediaToDatastore(media *types.Media, targetDs *datastore.DatastoreRef, ctx rcontext.RequestContext) (*types.Media, error) {
+	sourceDs, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate source datastore: %s", err.Error())
+	}
+
+	ctx.Log.Info("Starting move of media")
+	newLocation, err := copyFileToDatastore(media.Location, media.Encoded, media.Sha256Hash, media.SizeBytes, sourceDs, targetDs, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop uploads of the same content from linking to the old file while the records are updated
+	unlockHash, locked := upload_controller.LockHash(media.Sha256Hash)
+	defer unlockHash()
+	if !locked {
+		if err2 := targetDs.DeleteObject(newLocation.Location); err2 != nil {
+			ctx.Log.Warn("Failed to delete copy from target datastore: ", err2)
+		}
+		return nil, errors.New("timed out waiting for uploads of the same content to finish")
+	}
+
+	ctx.Log.Info("Updating media records...")
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	err = db.ChangeDatastoreOfLocation(sourceDs.DatastoreId, media.Location, targetDs.DatastoreId, newLocation.Location, newLocation.StoredSizeBytes, newLocation.Encoded)
+	if err != nil {
+		// The records still point at the source, so the copy would otherwise be orphaned
+		deleteErr := targetDs.DeleteObject(newLocation.Location)
+		if deleteErr != nil {
+			ctx.Log.Warn("Failed to delete copy from target datastore: ", deleteErr)
+		}
+		return nil, fmt.Errorf("failed to update database records: %s", err.Error())
+	}
+
+	moved := media.Clone()
+	moved.DatastoreId = targetDs.DatastoreId
+	moved.Location = newLocation.Location
+	moved.StoredSizeBytes = newLocation.StoredSizeBytes
+	moved.Encoded = newLocation.Encoded
+
+	// The deletion is recorded so that it still happens if the media repo stops before then
+	task, err := db.CreateBackgroundTask(deleteMovedFileTask, map[string]interface{}{
+		"datastore_id": sourceDs.DatastoreId,
+		"location":     media.Location,
+	})
+	if err != nil {
+		ctx.Log.Error("Failed to record moved media for deletion: ", err)
+		sentry.CaptureException(err)
+		task = &types.BackgroundTask{ID: -1}
+	}
+	ctx = ctx.Detached()
+	go func() {
+		time.Sleep(movedFileDeleteDelay)
+		err := DeleteMovedFile(task.ID, sourceDs.DatastoreId, media.Location, ctx)
+		if err != nil {
+			ctx.Log.Error("Failed to delete moved media from old datastore: ", err)
 			sentry.CaptureException(err)
 		}
-		ctx.Log.Info("Finished transfer")
 	}()
 
-	return task, nil
+	ctx.Log.Info("Media moved!")
+	return moved, nil
+}
+
+// DeleteMovedFile deletes the old file of moved media from its datastore, then marks the task
+// which recorded the deletion as finished. A negative task ID means the deletion wasn't recorded.
+func DeleteMovedFile(taskId int, datastoreId string, location string, ctx rcontext.RequestContext) error {
+	ds, err := datastore.LocateDatastore(ctx, datastoreId)
+	if err != nil {
+		return err
+	}
+
+	ctx.Log.Info("Deleting moved media from old datastore")
+	err = ds.DeleteObject(location)
+	if err != nil {
+		return err
+	}
+
+	if taskId < 0 {
+		return nil
+	}
+	return storage.GetDatabase().GetMetadataStore(ctx).FinishedBackgroundTask(taskId)
 }
 
 func EstimateDatastoreSizeWithAge(beforeTs int64, datastoreId string, ctx rcontext.RequestContext) (*types.DatastoreMigrationEstimate, error) {
@@ -155,20 +465,67 @@ func EstimateDatastoreSizeWithAge(beforeTs int64, datastoreId string, ctx rconte
 	return estimates, nil
 }
 
-func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, error) {
-	db := storage.GetDatabase().GetMediaStore(ctx)
-	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
+// GetDatastoreUsage reports how much media each known datastore holds according to the database,
+// keyed by datastore ID. If measure is set, the objects in each datastore are also listed to find
+// how much is actually stored there, which can take a while for large datastores. IPFS datastores
+// can't be listed, so are never measured.
+func GetDatastoreUsage(measure bool, ctx rcontext.RequestContext) (map[string]*types.DatastoreUsage, error) {
+	datastores, err := storage.GetDatabase().GetMediaStore(ctx).GetAllDatastores()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]*types.DatastoreUsage)
+	for _, ds := range datastores {
+		usage[ds.DatastoreId] = &types.DatastoreUsage{DatastoreId: ds.DatastoreId}
+	}
 
-	origins, err := db.GetOrigins()
+	records, err := storage.GetDatabase().GetMetadataStore(ctx).GetMediaUsageByDatastore()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	for _, record := range records {
+		record.DeduplicatedBytes = record.MediaBytes - record.UniqueBytes
+		usage[record.DatastoreId] = record
 	}
 
-	var excludedOrigins []string
-	for _, origin := range origins {
-		if util.IsServerOurs(origin) {
-			excludedOrigins = append(excludedOrigins, origin)
+	if !measure {
+		return usage, nil
+	}
+
+	for _, ds := range datastores {
+		if ds.Type == "ipfs" {
+			continue
+		}
+
+		ref, err := datastore.LocateDatastore(ctx, ds.DatastoreId)
+		if err != nil {
+			return nil, err
+		}
+
+		objects := int64(0)
+		bytes := int64(0)
+		err = ref.ListObjects(func(location string, sizeBytes int64, modified time.Time) error {
+			objects++
+			bytes += sizeBytes
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
+		usage[ds.DatastoreId].StoredObjects = &objects
+		usage[ds.DatastoreId].StoredBytes = &bytes
+	}
+
+	return usage, nil
+}
+
+func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, error) {
+	db := storage.GetDatabase().GetMediaStore(ctx)
+
+	excludedOrigins, err := getLocalOrigins(ctx)
+	if err != nil {
+		return 0, err
 	}
 
 	oldMedia, err := db.GetOldMedia(excludedOrigins, beforeTs)
@@ -180,66 +537,196 @@ func PurgeRemoteMediaBefore(beforeTs int64, ctx rcontext.RequestContext) (int, e
 
 	removed := 0
 	for _, media := range oldMedia {
-		if media.Quarantined {
-			ctx.Log.Warn("Not removing quarantined media to maintain quarantined status: " + media.Origin + "/" + media.MediaId)
-			continue
+		if purgeRemoteMediaRecord(media, ctx) {
+			removed++
 		}
+	}
+
+	return removed, nil
+}
+
+// PurgeRemoteMediaOverSize removes the least recently accessed remote media until the remote media
+// takes up no more than maxBytes. Media which shares a file with local media is never removed.
+func PurgeRemoteMediaOverSize(maxBytes int64, ctx rcontext.RequestContext) (int, error) {
+	db := storage.GetDatabase().GetMediaStore(ctx)
+
+	excludedOrigins, err := getLocalOrigins(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// How many media records are fetched at a time
+	batchSize := config.Get().Maintenance.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	return evictRemoteMedia(db, excludedOrigins, maxBytes, batchSize, func(media *types.Media) bool {
+		return purgeRemoteMediaRecord(media, ctx)
+	}, ctx)
+}
+
+// remoteMediaPager is the part of the media store needed to evict media from the remote media cache.
+type remoteMediaPager interface {
+	GetRemoteMediaSize(exceptOrigins []string) (int64, error)
+	GetRemoteMediaPageByLastAccess(exceptOrigins []string, afterAccessTs int64, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, int64, error)
+}
+
+// evictRemoteMedia purges remote media, least recently accessed first, until the files it uses take
+// up no more than maxBytes. Quarantined media is never purged, so it doesn't count towards the size
+// of the cache. Returns the number of files removed.
+func evictRemoteMedia(db remoteMediaPager, localOrigins []string, maxBytes int64, batchSize int, purge func(media *types.Media) bool, ctx rcontext.RequestContext) (int, error) {
+	// Media can share a file, which only takes up space once
+	totalBytes, err := db.GetRemoteMediaSize(localOrigins)
+	if err != nil {
+		return 0, err
+	}
+	if totalBytes <= maxBytes {
+		return 0, nil
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Remote media is using %d bytes, removing media to get under %d bytes", totalBytes, maxBytes))
 
-		ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+	// The media is fetched in batches so that every record doesn't need to be held in memory
+	removed := 0
+	afterAccessTs := int64(-1)
+	afterOrigin := ""
+	afterMediaId := ""
+	for totalBytes > maxBytes {
+		records, lastAccessTs, err := db.GetRemoteMediaPageByLastAccess(localOrigins, afterAccessTs, afterOrigin, afterMediaId, batchSize)
 		if err != nil {
-			ctx.Log.Error("Error finding datastore for media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
-			sentry.CaptureException(err)
-			continue
+			return removed, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		afterAccessTs = lastAccessTs
+		afterOrigin = records[len(records)-1].Origin
+		afterMediaId = records[len(records)-1].MediaId
+
+		for _, media := range records {
+			if totalBytes <= maxBytes {
+				break
+			}
+			// Local media is never evicted, so it doesn't count towards the size of the cache either
+			if util.ArrayContains(localOrigins, media.Origin) {
+				ctx.Log.Warn("Not evicting local media from the remote media cache: " + media.Origin + "/" + media.MediaId)
+				continue
+			}
+			if purge(media) {
+				removed++
+				totalBytes -= media.SizeBytes
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+func getLocalOrigins(ctx rcontext.RequestContext) ([]string, error) {
+	origins, err := storage.GetDatabase().GetMediaStore(ctx).GetOrigins()
+	if err != nil {
+		return nil, err
+	}
+
+	var localOrigins []string
+	for _, origin := range origins {
+		if util.IsServerOurs(origin) {
+			localOrigins = append(localOrigins, origin)
+		}
+	}
+	return localOrigins, nil
+}
+
+// purgeRemoteMediaRecord removes the remote media's file, database record, and thumbnails. The file
+// is kept if other media still uses it. Returns true if the file was removed.
+func purgeRemoteMediaRecord(media *types.Media, ctx rcontext.RequestContext) bool {
+	db := storage.GetDatabase().GetMediaStore(ctx)
+	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
+	removed := false
+
+	if media.Quarantined {
+		ctx.Log.Warn("Not removing quarantined media to maintain quarantined status: " + media.Origin + "/" + media.MediaId)
+		return false
+	}
+
+	ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
+	if err != nil {
+		ctx.Log.Error("Error finding datastore for media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
+		sentry.CaptureException(err)
+		return false
+	}
+
+	similarMedia, err := db.GetByHash(media.Sha256Hash)
+	if err != nil {
+		ctx.Log.Error("Error finding similar media for " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
+		sentry.CaptureException(err)
+		return false
+	}
+	shared := false
+	for _, m := range similarMedia {
+		if m.DatastoreId == media.DatastoreId && m.Location == media.Location && (m.Origin != media.Origin || m.MediaId != media.MediaId) {
+			shared = true
+			break
 		}
+	}
 
-		// Delete the file first
+	// Delete the file first, unless something else still needs it
+	if shared {
+		ctx.Log.Info("Not removing remote media file for " + media.Origin + "/" + media.MediaId + ": the file is shared with other media")
+	} else {
 		err = ds.DeleteObject(media.Location)
 		if err != nil {
 			ctx.Log.Warn("Cannot remove media " + media.Origin + "/" + media.MediaId + " because: " + err.Error())
 			sentry.CaptureException(err)
 		} else {
-			removed++
+			removed = true
 			ctx.Log.Info("Removed remote media file: " + media.Origin + "/" + media.MediaId)
 		}
+	}
 
-		// Try to remove the record from the database now
-		err = db.Delete(media.Origin, media.MediaId)
-		if err != nil {
-			ctx.Log.Warn("Error removing media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
-			sentry.CaptureException(err)
+	// Try to remove the record from the database now
+	err = db.Delete(media.Origin, media.MediaId)
+	if err != nil {
+		ctx.Log.Warn("Error removing media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+		sentry.CaptureException(err)
+	}
+
+	// Delete the thumbnails too
+	thumbs, err := thumbsDb.GetAllForMedia(media.Origin, media.MediaId)
+	if err != nil {
+		ctx.Log.Warn("Error getting thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+		sentry.CaptureException(err)
+		return removed
+	}
+	for _, thumb := range thumbs {
+		if thumb.DatastoreId == media.DatastoreId && thumb.Location == media.Location {
+			// The thumbnail is the media itself, which is handled above
+			continue
 		}
 
-		// Delete the thumbnails too
-		thumbs, err := thumbsDb.GetAllForMedia(media.Origin, media.MediaId)
+		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
+		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
 		if err != nil {
-			ctx.Log.Warn("Error getting thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+			ctx.Log.Warn("Error removing thumbnail for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
 			sentry.CaptureException(err)
 			continue
 		}
-		for _, thumb := range thumbs {
-			ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
-			ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
-			if err != nil {
-				ctx.Log.Warn("Error removing thumbnail for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
-				sentry.CaptureException(err)
-				continue
-			}
 
-			err = ds.DeleteObject(thumb.Location)
-			if err != nil {
-				ctx.Log.Warn("Error removing thumbnail for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
-				sentry.CaptureException(err)
-				continue
-			}
-		}
-		err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
+		err = ds.DeleteObject(thumb.Location)
 		if err != nil {
-			ctx.Log.Warn("Error removing thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+			ctx.Log.Warn("Error removing thumbnail for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
 			sentry.CaptureException(err)
+			continue
 		}
 	}
+	err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
+	if err != nil {
+		ctx.Log.Warn("Error removing thumbnails for media " + media.Origin + "/" + media.MediaId + " from database: " + err.Error())
+		sentry.CaptureException(err)
+	}
 
-	return removed, nil
+	return removed
 }
 
 func PurgeQuarantined(ctx rcontext.RequestContext) ([]*types.Media, error) {
@@ -250,7 +737,7 @@ func PurgeQuarantined(ctx rcontext.RequestContext) ([]*types.Media, error) {
 	}
 
 	for _, r := range records {
-		err = doPurge(r, ctx)
+		_, err = doPurge(r, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -267,7 +754,7 @@ func PurgeQuarantinedFor(serverName string, ctx rcontext.RequestContext) ([]*typ
 	}
 
 	for _, r := range records {
-		err = doPurge(r, ctx)
+		_, err = doPurge(r, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -276,15 +763,44 @@ func PurgeQuarantinedFor(serverName string, ctx rcontext.RequestContext) ([]*typ
 	return records, nil
 }
 
-func PurgeUserMedia(userId string, beforeTs int64, ctx rcontext.RequestContext) ([]*types.Media, error) {
+// hashBlocklist is the part of the metadata store needed to block hashes.
+type hashBlocklist interface {
+	BlockHash(sha256Hash string, reason string) error
+}
+
+// mediaByHash is the part of the media store needed to find media to purge for a blocked hash.
+type mediaByHash interface {
+	GetByHash(hash string) ([]*types.Media, error)
+}
+
+// BlockHash prevents media with the given hash from being stored in the future, optionally
+// purging any media which already has the hash.
+func BlockHash(sha256Hash string, reason string, purge bool, ctx rcontext.RequestContext) ([]*types.Media, error) {
+	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
-	records, err := mediaDb.GetMediaByUserBefore(userId, beforeTs)
+	return blockHash(sha256Hash, reason, purge, metadataDb, mediaDb, func(media *types.Media) error {
+		_, err := doPurge(media, ctx)
+		return err
+	})
+}
+
+func blockHash(sha256Hash string, reason string, purge bool, blocklist hashBlocklist, mediaDb mediaByHash, doPurge func(media *types.Media) error) ([]*types.Media, error) {
+	err := blocklist.BlockHash(sha256Hash, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	if !purge {
+		return []*types.Media{}, nil
+	}
+
+	records, err := mediaDb.GetByHash(sha256Hash)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, r := range records {
-		err = doPurge(r, ctx)
+		err = doPurge(r)
 		if err != nil {
 			return nil, err
 		}
@@ -293,6 +809,28 @@ func PurgeUserMedia(userId string, beforeTs int64, ctx rcontext.RequestContext)
 	return records, nil
 }
 
+// PurgeUserMedia purges all media uploaded by the user before the given time, returning the purged
+// records and the number of bytes freed from the datastores. Files which are shared with media not
+// being purged are kept.
+func PurgeUserMedia(userId string, beforeTs int64, ctx rcontext.RequestContext) ([]*types.Media, int64, error) {
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	records, err := mediaDb.GetMediaByUserBefore(userId, beforeTs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	freedBytes := int64(0)
+	for _, r := range records {
+		freed, err := doPurge(r, ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		freedBytes += freed
+	}
+
+	return records, freedBytes, nil
+}
+
 func PurgeOldMedia(beforeTs int64, includeLocal bool, ctx rcontext.RequestContext) ([]*types.Media, error) {
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
@@ -304,7 +842,15 @@ func PurgeOldMedia(beforeTs int64, includeLocal bool, ctx rcontext.RequestContex
 
 	purged := make([]*types.Media, 0)
 
+	// Media with the same hash can have separate files (and so appear more than once), but every
+	// record for the hash is purged the first time the hash is seen
+	seenHashes := make(map[string]bool)
 	for _, r := range oldHashes {
+		if seenHashes[r.Sha256Hash] {
+			continue
+		}
+		seenHashes[r.Sha256Hash] = true
+
 		media, err := mediaDb.GetByHash(r.Sha256Hash)
 		if err != nil {
 			return nil, err
@@ -315,7 +861,7 @@ func PurgeOldMedia(beforeTs int64, includeLocal bool, ctx rcontext.RequestContex
 				continue
 			}
 
-			err = doPurge(m, ctx)
+			_, err = doPurge(m, ctx)
 			if err != nil {
 				return nil, err
 			}
@@ -351,7 +897,7 @@ func PurgeRoomMedia(mxcs []string, beforeTs int64, ctx rcontext.RequestContext)
 			continue
 		}
 
-		err = doPurge(record, ctx)
+		_, err = doPurge(record, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -370,7 +916,7 @@ func PurgeDomainMedia(serverName string, beforeTs int64, ctx rcontext.RequestCon
 	}
 
 	for _, r := range records {
-		err = doPurge(r, ctx)
+		_, err = doPurge(r, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -379,90 +925,394 @@ func PurgeDomainMedia(serverName string, beforeTs int64, ctx rcontext.RequestCon
 	return records, nil
 }
 
+// mediaPager is the part of the media store needed to purge a remote origin's media.
+type mediaPager interface {
+	GetMediaPage(serverName string, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, error)
+}
+
+// PurgeRemoteOrigin purges all the cached media from a remote server, returning how many media
+// records were purged and how many bytes were freed. As with other purges, files shared with media
+// from other servers are kept. The media IDs aren't reserved, so the media can be downloaded again
+// if it is requested later. With dryRun set, nothing is deleted and the returned values are what
+// would be purged.
+func PurgeRemoteOrigin(origin string, dryRun bool, ctx rcontext.RequestContext) (int, int64, error) {
+	if util.IsServerOurs(origin) {
+		return 0, 0, errors.New("refusing to purge remote media for a local origin")
+	}
+
+	// How many media records are purged at a time
+	batchSize := config.Get().Maintenance.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	seen := make(map[string]bool)
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	return purgeRemoteOrigin(origin, dryRun, mediaDb, batchSize, func(records []*types.Media) (int64, error) {
+		return estimateOriginPurge(origin, records, seen, ctx)
+	}, func(media *types.Media) (int64, error) {
+		freed, _, err := purgeRecordWith(media, false, ctx)
+		return freed, err
+	})
+}
+
+func purgeRemoteOrigin(origin string, dryRun bool, mediaDb mediaPager, batchSize int, estimate func(records []*types.Media) (int64, error), purge func(media *types.Media) (int64, error)) (int, int64, error) {
+	// The media is fetched in batches so that every record doesn't need to be held in memory
+	purged := 0
+	freedBytes := int64(0)
+	afterMediaId := ""
+	for {
+		records, err := mediaDb.GetMediaPage(origin, origin, afterMediaId, batchSize)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		afterMediaId = records[len(records)-1].MediaId
+		purged += len(records)
+
+		if dryRun {
+			freed, err := estimate(records)
+			if err != nil {
+				return 0, 0, err
+			}
+			freedBytes += freed
+			continue
+		}
+
+		for _, r := range records {
+			freed, err := purge(r)
+			if err != nil {
+				return 0, 0, err
+			}
+			freedBytes += freed
+		}
+	}
+
+	return purged, freedBytes, nil
+}
+
+// estimateOriginPurge works out how many bytes purging the origin's media would free, the same
+// way purgeRecord decides which files to delete. Files in seen have already been counted.
+func estimateOriginPurge(origin string, records []*types.Media, seen map[string]bool, ctx rcontext.RequestContext) (int64, error) {
+	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
+	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
+
+	freedBytes := int64(0)
+	for _, media := range records {
+		thumbs, err := thumbsDb.GetAllForMedia(media.Origin, media.MediaId)
+		if err != nil {
+			return 0, err
+		}
+		for _, thumb := range thumbs {
+			if thumb.DatastoreId != media.DatastoreId || thumb.Location != media.Location {
+				freedBytes += thumb.SizeBytes
+			}
+		}
+
+		// Files shared between the origin's media are only deleted once
+		key := media.DatastoreId + "/" + media.Location
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		shared := false
+		if !media.Quarantined {
+			similarMedia, err := mediaDb.GetByHash(media.Sha256Hash)
+			if err != nil {
+				return 0, err
+			}
+			for _, m := range similarMedia {
+				if m.DatastoreId == media.DatastoreId && m.Location == media.Location && m.Origin != origin {
+					shared = true
+					break
+				}
+			}
+		}
+		if !shared {
+			freedBytes += media.SizeBytes
+		}
+	}
+
+	return freedBytes, nil
+}
+
 func PurgeMedia(origin string, mediaId string, ctx rcontext.RequestContext) error {
 	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
 	if err != nil {
 		return err
 	}
 
-	return doPurge(media, ctx)
+	_, err = doPurge(media, ctx)
+	return err
 }
 
-func doPurge(media *types.Media, ctx rcontext.RequestContext) error {
+// PurgeMediaRecord purges the media like PurgeMedia, returning whether the media's file was kept
+// because it is shared with other media.
+func PurgeMediaRecord(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+	media, err := download_controller.FindMediaRecord(origin, mediaId, false, ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, kept, err := purgeRecord(media, ctx)
+	return kept, err
+}
+
+// doPurge removes the media and its thumbnails, returning the number of bytes freed from the datastores.
+func doPurge(media *types.Media, ctx rcontext.RequestContext) (int64, error) {
+	freedBytes, _, err := purgeRecord(media, ctx)
+	return freedBytes, err
+}
+
+// purgeRecord is doPurge, additionally returning whether the media's file was kept due to being shared.
+func purgeRecord(media *types.Media, ctx rcontext.RequestContext) (int64, bool, error) {
+	return purgeRecordWith(media, true, ctx)
+}
+
+// purgeRecordWith is purgeRecord, optionally without reserving the media ID. Media IDs which aren't
+// reserved can be used again, such as for remote media which is downloaded again.
+func purgeRecordWith(media *types.Media, reserve bool, ctx rcontext.RequestContext) (int64, bool, error) {
+	freedBytes := int64(0)
+
 	// Delete all the thumbnails first
 	thumbsDb := storage.GetDatabase().GetThumbnailStore(ctx)
 	thumbs, err := thumbsDb.GetAllForMedia(media.Origin, media.MediaId)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	for _, thumb := range thumbs {
+		if thumb.DatastoreId == media.DatastoreId && thumb.Location == media.Location {
+			// The thumbnail is the media itself, which is handled below
+			continue
+		}
+
 		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
 		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
 		if err != nil {
-			return err
+			return 0, false, err
 		}
 
 		err = ds.DeleteObject(thumb.Location)
 		if err != nil {
-			return err
+			return 0, false, err
 		}
+		freedBytes += thumb.SizeBytes
 	}
 	err = thumbsDb.DeleteAllForMedia(media.Origin, media.MediaId)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
 	ds, err := datastore.LocateDatastore(ctx, media.DatastoreId)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
 	mediaDb := storage.GetDatabase().GetMediaStore(ctx)
 	similarMedia, err := mediaDb.GetByHash(media.Sha256Hash)
 	if err != nil {
-		return err
+		return 0, false, err
+	}
+	freed, kept, err := purgeMediaFile(media, similarMedia, ds, ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	freedBytes += freed
+
+	if reserve {
+		metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+
+		reserved, err := metadataDb.IsReserved(media.Origin, media.MediaId)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if !reserved {
+			err = metadataDb.ReserveMediaId(media.Origin, media.MediaId, "purged / deleted")
+			if err != nil {
+				return 0, false, err
+			}
+		}
+	}
+
+	// Don't delete the media record itself if it is quarantined. If we delete it, the media
+	// becomes not-quarantined so we'll leave it and let it 404 in the datastores.
+	if media.Quarantined {
+		return freedBytes, false, nil
 	}
+
+	err = mediaDb.Delete(media.Origin, media.MediaId)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return freedBytes, kept, nil
+}
+
+// purgeMediaFile deletes the media's file from the datastore unless other media (in similarMedia)
+// shares it, returning the number of bytes freed and whether the file was kept. Quarantined media
+// is always deleted.
+func purgeMediaFile(media *types.Media, similarMedia []*types.Media, ds *datastore.DatastoreRef, ctx rcontext.RequestContext) (int64, bool, error) {
 	hasSimilar := false
 	for _, m := range similarMedia {
-		if m.Origin != media.Origin && m.MediaId != media.MediaId {
+		// Media can have the same hash without sharing a file, depending on the de-duplication scope
+		if m.DatastoreId != media.DatastoreId || m.Location != media.Location {
+			continue
+		}
+		if m.Origin != media.Origin || m.MediaId != media.MediaId {
 			hasSimilar = true
 			break
 		}
 	}
 
-	if !hasSimilar || media.Quarantined {
-		err = ds.DeleteObject(media.Location)
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
-	} else {
+	if hasSimilar && !media.Quarantined {
 		ctx.Log.Warnf("Not deleting media from datastore: media is shared over %d objects", len(similarMedia))
+		return 0, true, nil
 	}
 
-	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	err := ds.DeleteObject(media.Location)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	return media.SizeBytes, false, nil
+}
 
-	reserved, err := metadataDb.IsReserved(media.Origin, media.MediaId)
-	if err != nil {
-		return err
+// FindOrphanedFiles finds the files in the datastore which aren't referenced by any media, thumbnail,
+// or export, deleting them if requested. Files modified within the grace period are ignored because
+// they may belong to an upload which hasn't been recorded yet. Files are looked up in the database
+// in batches, and deleted by a few workers at a time, as configured by the maintenance config. The
+// scan stops early if the context is cancelled.
+func FindOrphanedFiles(ds *datastore.DatastoreRef, gracePeriod time.Duration, remove bool, ctx rcontext.RequestContext) (*types.OrphanedFilesReport, error) {
+	batchSize := config.Get().Maintenance.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
 	}
 
-	if !reserved {
-		err = metadataDb.ReserveMediaId(media.Origin, media.MediaId, "purged / deleted")
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	return findOrphanedFiles(ds, db, batchSize, gracePeriod, remove, ctx)
+}
+
+// datastoreLocations is the part of the metadata store needed to find orphaned files.
+type datastoreLocations interface {
+	GetReferencedLocationsInDatastore(datastoreId string, locations []string) ([]string, error)
+}
+
+func findOrphanedFiles(ds *datastore.DatastoreRef, db datastoreLocations, batchSize int, gracePeriod time.Duration, remove bool, ctx rcontext.RequestContext) (*types.OrphanedFilesReport, error) {
+	cutoff := time.Now().Add(-gracePeriod)
+	report := &types.OrphanedFilesReport{Files: make([]*types.OrphanedFile, 0)}
+	batch := make([]*types.OrphanedFile, 0, batchSize)
+	checkBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		locations := make([]string, 0, len(batch))
+		for _, file := range batch {
+			locations = append(locations, file.Location)
+		}
+		referencedLocations, err := db.GetReferencedLocationsInDatastore(ds.DatastoreId, locations)
 		if err != nil {
 			return err
 		}
+		referenced := make(map[string]bool)
+		for _, location := range referencedLocations {
+			referenced[location] = true
+		}
+
+		for _, file := range batch {
+			if !referenced[file.Location] {
+				report.Files = append(report.Files, file)
+				report.TotalBytes += file.SizeBytes
+			}
+		}
+		report.ScannedFiles += int64(len(batch))
+		batch = batch[:0]
+
+		ctx.Log.Infof("Checked %d files so far, %d of which are orphaned", report.ScannedFiles, len(report.Files))
+		return nil
 	}
 
-	// Don't delete the media record itself if it is quarantined. If we delete it, the media
-	// becomes not-quarantined so we'll leave it and let it 404 in the datastores.
-	if media.Quarantined {
+	err := ds.ListObjects(func(location string, sizeBytes int64, modified time.Time) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if modified.After(cutoff) {
+			return nil
+		}
+		batch = append(batch, &types.OrphanedFile{Location: location, SizeBytes: sizeBytes})
+		if len(batch) >= batchSize {
+			return checkBatch()
+		}
 		return nil
+	})
+	if err == nil {
+		err = checkBatch()
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	err = mediaDb.Delete(media.Origin, media.MediaId)
+	if !remove {
+		return report, nil
+	}
+
+	err = deleteOrphanedFiles(ds, report.Files, ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	report.Deleted = true
 
-	return nil
+	return report, nil
+}
+
+// deleteOrphanedFiles deletes the files using the configured number of workers, stopping at the first
+// error or when the context is cancelled.
+func deleteOrphanedFiles(ds *datastore.DatastoreRef, files []*types.OrphanedFile, ctx rcontext.RequestContext) error {
+	workers := config.Get().Maintenance.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	stopCtx, stop := context.WithCancel(ctx.Context)
+	defer stop()
+	var firstErr error
+	errOnce := &sync.Once{}
+
+	locations := make(chan string)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for location := range locations {
+				ctx.Log.Info("Deleting orphaned file: ", location)
+				err := ds.DeleteObject(location)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						stop()
+					})
+				}
+			}
+		}()
+	}
+
+queue:
+	for _, file := range files {
+		select {
+		case locations <- file.Location:
+		case <-stopCtx.Done():
+			break queue
+		}
+	}
+	close(locations)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
 }
@@ -0,0 +1,799 @@
+package maintenance_controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-maintenance-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	// Some tests need to know which servers are local
+	err = ioutil.WriteFile(config.Path, []byte("homeservers:\n  - name: example.org\n    csApi: \"https://example.org/\"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+type fakeBlocklist struct {
+	blocked map[string]string
+}
+
+func (b *fakeBlocklist) BlockHash(sha256Hash string, reason string) error {
+	b.blocked[sha256Hash] = reason
+	return nil
+}
+
+type fakeMediaByHash struct {
+	media []*types.Media
+}
+
+func (d *fakeMediaByHash) GetByHash(hash string) ([]*types.Media, error) {
+	matches := make([]*types.Media, 0)
+	for _, m := range d.media {
+		if m.Sha256Hash == hash {
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+func TestBlockHash(t *testing.T) {
+	media := []*types.Media{
+		{Origin: "example.org", MediaId: "a", Sha256Hash: "blocked"},
+		{Origin: "other.example.org", MediaId: "b", Sha256Hash: "blocked"},
+		{Origin: "example.org", MediaId: "c", Sha256Hash: "fine"},
+	}
+
+	tests := []struct {
+		name       string
+		purge      bool
+		wantPurged []string
+	}{
+		{name: "purge existing media", purge: true, wantPurged: []string{"a", "b"}},
+		{name: "only block future uploads", purge: false, wantPurged: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocklist := &fakeBlocklist{blocked: make(map[string]string)}
+			purged := make([]string, 0)
+
+			affected, err := blockHash("blocked", "takedown", tt.purge, blocklist, &fakeMediaByHash{media: media}, func(m *types.Media) error {
+				purged = append(purged, m.MediaId)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reason, ok := blocklist.blocked["blocked"]; !ok || reason != "takedown" {
+				t.Errorf("expected the hash to be blocked with its reason, got %v", blocklist.blocked)
+			}
+			if len(purged) != len(tt.wantPurged) || len(affected) != len(tt.wantPurged) {
+				t.Fatalf("got %v purged and %d affected, expected %v", purged, len(affected), tt.wantPurged)
+			}
+			for i, id := range tt.wantPurged {
+				if purged[i] != id || affected[i].MediaId != id {
+					t.Errorf("got %s purged at %d, expected %s", purged[i], i, id)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockHashPurgeFailure(t *testing.T) {
+	media := []*types.Media{{Origin: "example.org", MediaId: "a", Sha256Hash: "blocked"}}
+	blocklist := &fakeBlocklist{blocked: make(map[string]string)}
+
+	_, err := blockHash("blocked", "", true, blocklist, &fakeMediaByHash{media: media}, func(m *types.Media) error {
+		return errors.New("datastore unavailable")
+	})
+	if err == nil {
+		t.Errorf("expected the purge error to be returned")
+	}
+	if _, ok := blocklist.blocked["blocked"]; !ok {
+		t.Errorf("expected the hash to stay blocked when the purge fails")
+	}
+}
+
+type fakeLocations struct {
+	err     error
+	records map[string]string // location -> datastore ID
+}
+
+func (d *fakeLocations) ChangeDatastoreOfLocation(oldDatastoreId string, oldLocation string, datastoreId string, location string, storedSizeBytes int64, encoded bool) error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.records[oldLocation] == oldDatastoreId {
+		delete(d.records, oldLocation)
+		d.records[location] = datastoreId
+	}
+	return nil
+}
+
+func countFiles(t *testing.T, dir string) int {
+	count := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestMigrateFileResumes(t *testing.T) {
+	contents := []byte("media which is being moved to a new datastore")
+
+	tests := []struct {
+		name      string
+		interrupt func(t *testing.T, targetDs *datastore.DatastoreRef, db *fakeLocations) func()
+	}{
+		{
+			name: "killed while copying",
+			interrupt: func(t *testing.T, targetDs *datastore.DatastoreRef, db *fakeLocations) func() {
+				// Writing into a regular file rather than a directory fails part way through the copy
+				uri := targetDs.Uri
+				targetDs.Uri = filepath.Join(uri, "not-a-directory")
+				if err := ioutil.WriteFile(targetDs.Uri, []byte{}, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return func() {
+					_ = os.Remove(targetDs.Uri)
+					targetDs.Uri = uri
+				}
+			},
+		},
+		{
+			name: "killed before the records are updated",
+			interrupt: func(t *testing.T, targetDs *datastore.DatastoreRef, db *fakeLocations) func() {
+				db.err = errors.New("database went away")
+				return func() {
+					db.err = nil
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			sourceDs := &datastore.DatastoreRef{DatastoreId: "source", Type: "file", Uri: t.TempDir()}
+			targetDs := &datastore.DatastoreRef{DatastoreId: "target", Type: "file", Uri: t.TempDir()}
+
+			info, err := sourceDs.UploadFile(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := &types.MinimalMediaMetadata{Location: info.Location, Sha256Hash: info.Sha256Hash, SizeBytes: info.SizeBytes, DatastoreId: "source"}
+			db := &fakeLocations{records: map[string]string{info.Location: "source"}}
+
+			resume := tt.interrupt(t, targetDs, db)
+			if err = migrateFile(record, sourceDs, targetDs, db, ctx); err == nil {
+				t.Fatal("expected the interrupted migration to fail")
+			}
+			resume()
+
+			// Nothing has moved, so the media is still served from the source
+			if db.records[info.Location] != "source" {
+				t.Errorf("expected the record to still point at the source, got %v", db.records)
+			}
+			if !sourceDs.ObjectExists(info.Location) {
+				t.Error("expected the source file to be kept")
+			}
+			if n := countFiles(t, targetDs.Uri); n != 0 {
+				t.Errorf("expected no partial copies in the target datastore, found %d", n)
+			}
+
+			if err = migrateFile(record, sourceDs, targetDs, db, ctx); err != nil {
+				t.Fatalf("re-running the migration failed: %v", err)
+			}
+			if len(db.records) != 1 {
+				t.Fatalf("expected a single record, got %v", db.records)
+			}
+			for location, datastoreId := range db.records {
+				if datastoreId != "target" {
+					t.Errorf("got the record in %s, expected it to be in the target datastore", datastoreId)
+				}
+				b, err := ioutil.ReadFile(filepath.Join(targetDs.Uri, location))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, contents) {
+					t.Errorf("the migrated file doesn't match the original")
+				}
+			}
+			if n := countFiles(t, sourceDs.Uri); n != 0 {
+				t.Errorf("expected the source file to be deleted, found %d files", n)
+			}
+
+			// Running it again is harmless
+			if err = migrateFile(record, sourceDs, targetDs, db, ctx); err == nil {
+				t.Error("expected migrating an already moved file to fail")
+			}
+			if n := countFiles(t, targetDs.Uri); n != 1 {
+				t.Errorf("expected the migrated file to be left alone, found %d files", n)
+			}
+		})
+	}
+}
+
+func TestMigrateFileHashMismatch(t *testing.T) {
+	ctx := testContext()
+	sourceDs := &datastore.DatastoreRef{DatastoreId: "source", Type: "file", Uri: t.TempDir()}
+	targetDs := &datastore.DatastoreRef{DatastoreId: "target", Type: "file", Uri: t.TempDir()}
+
+	info, err := sourceDs.UploadFile(ioutil.NopCloser(bytes.NewReader([]byte("corrupted"))), 9, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &types.MinimalMediaMetadata{Location: info.Location, Sha256Hash: "not the hash", SizeBytes: info.SizeBytes, DatastoreId: "source"}
+	db := &fakeLocations{records: map[string]string{info.Location: "source"}}
+
+	if err = migrateFile(record, sourceDs, targetDs, db, ctx); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if db.records[info.Location] != "source" || !sourceDs.ObjectExists(info.Location) {
+		t.Error("expected the media to be left in the source datastore")
+	}
+	if n := countFiles(t, targetDs.Uri); n != 0 {
+		t.Errorf("expected the bad copy to be deleted, found %d files", n)
+	}
+}
+
+// fakeMigrationStore keeps a migration's records and checkpoint in memory. The process running the
+// migration can be made to stop after a number of checkpoints, as if it were restarted.
+type fakeMigrationStore struct {
+	fakeLocations
+	media       []*types.MinimalMediaMetadata
+	thumbnails  []*types.MinimalMediaMetadata
+	moves       map[string]int // location -> times moved
+	checkpoint  types.MigrationJob
+	checkpoints int
+	stopAfter   int
+	status      string
+	finished    bool
+}
+
+func (d *fakeMigrationStore) ChangeDatastoreOfLocation(oldDatastoreId string, oldLocation string, datastoreId string, location string, storedSizeBytes int64, encoded bool) error {
+	d.moves[oldLocation]++
+	return d.fakeLocations.ChangeDatastoreOfLocation(oldDatastoreId, oldLocation, datastoreId, location, storedSizeBytes, encoded)
+}
+
+func (d *fakeMigrationStore) inDatastore(records []*types.MinimalMediaMetadata, datastoreId string) []*types.MinimalMediaMetadata {
+	matches := make([]*types.MinimalMediaMetadata, 0)
+	for _, r := range records {
+		if d.records[r.Location] == datastoreId {
+			record := *r
+			matches = append(matches, &record)
+		}
+	}
+	return matches
+}
+
+func (d *fakeMigrationStore) GetOldMediaInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error) {
+	return d.inDatastore(d.media, datastoreId), nil
+}
+
+func (d *fakeMigrationStore) GetOldThumbnailsInDatastore(datastoreId string, beforeTs int64) ([]*types.MinimalMediaMetadata, error) {
+	return d.inDatastore(d.thumbnails, datastoreId), nil
+}
+
+func (d *fakeMigrationStore) UpdateMigrationJobProgress(job *types.MigrationJob) (bool, error) {
+	d.checkpoint = *job
+	d.checkpoints++
+	return d.stopAfter <= 0 || d.checkpoints < d.stopAfter, nil
+}
+
+func (d *fakeMigrationStore) SetMigrationJobStatus(taskId int, status string) (bool, error) {
+	d.status = status
+	return true, nil
+}
+
+func (d *fakeMigrationStore) FinishedBackgroundTask(id int) error {
+	d.finished = true
+	return nil
+}
+
+func TestRunStorageMigrationResumes(t *testing.T) {
+	ctx := testContext()
+	sourceDs := &datastore.DatastoreRef{DatastoreId: "source", Type: "file", Uri: t.TempDir()}
+	targetDs := &datastore.DatastoreRef{DatastoreId: "target", Type: "file", Uri: t.TempDir()}
+	db := &fakeMigrationStore{
+		fakeLocations: fakeLocations{records: map[string]string{}},
+		moves:         map[string]int{},
+	}
+
+	// A record whose file is missing sorts first, so it fails before the checkpoint
+	db.records["missing"] = "source"
+	db.media = append(db.media, &types.MinimalMediaMetadata{Location: "missing", Sha256Hash: "0", SizeBytes: 1, DatastoreId: "source"})
+	upload := func(contents string) *types.MinimalMediaMetadata {
+		info, err := sourceDs.UploadFile(ioutil.NopCloser(bytes.NewReader([]byte(contents))), int64(len(contents)), ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.records[info.Location] = "source"
+		return &types.MinimalMediaMetadata{Location: info.Location, Sha256Hash: info.Sha256Hash, SizeBytes: info.SizeBytes, DatastoreId: "source"}
+	}
+	db.media = append(db.media, upload("first media"), upload("second media"), upload("third media"))
+	db.thumbnails = append(db.thumbnails, upload("a thumbnail"))
+
+	// The process stops after checkpointing the missing file and one real file
+	job := &types.MigrationJob{TaskID: 1, SourceDatastoreId: "source", TargetDatastoreId: "target", Status: types.MigrationJobRunning, Phase: types.MigrationPhaseMedia}
+	db.stopAfter = 2
+	runStorageMigration(job, sourceDs, targetDs, db, ctx)
+	if db.finished {
+		t.Fatal("expected the migration to stop before finishing")
+	}
+	if db.checkpoint.MigratedCount != 1 || db.checkpoint.FailedCount != 1 {
+		t.Fatalf("got %d migrated and %d failed at the checkpoint, expected 1 and 1", db.checkpoint.MigratedCount, db.checkpoint.FailedCount)
+	}
+	if n := countFiles(t, targetDs.Uri); n != 1 {
+		t.Fatalf("got %d files in the target datastore, expected 1", n)
+	}
+
+	// Resume from the saved checkpoint, as ResumeStorageMigrations would after a restart
+	resumed := db.checkpoint
+	db.stopAfter = 0
+	runStorageMigration(&resumed, sourceDs, targetDs, db, ctx)
+
+	if !db.finished || db.status != types.MigrationJobFinished {
+		t.Errorf("got status %s (task finished = %t), expected the migration to finish", db.status, db.finished)
+	}
+	if resumed.MigratedCount != 4 || resumed.FailedCount != 1 {
+		t.Errorf("got %d migrated and %d failed, expected 4 and 1", resumed.MigratedCount, resumed.FailedCount)
+	}
+	if resumed.MigratedBytes != int64(len("first media")+len("second media")+len("third media")+len("a thumbnail")) {
+		t.Errorf("got %d migrated bytes, expected the size of every file", resumed.MigratedBytes)
+	}
+	for location, moves := range db.moves {
+		if moves != 1 {
+			t.Errorf("got %d moves of %s, expected each file to be moved once", moves, location)
+		}
+	}
+	if len(db.moves) != 4 {
+		t.Errorf("got %d files moved, expected 4", len(db.moves))
+	}
+	if n := countFiles(t, targetDs.Uri); n != 4 {
+		t.Errorf("got %d files in the target datastore, expected 4", n)
+	}
+	if n := countFiles(t, sourceDs.Uri); n != 0 {
+		t.Errorf("got %d files left in the source datastore, expected 0", n)
+	}
+}
+
+func TestPurgeMediaFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		quarantined bool
+		others      []*types.Media
+		wantDeleted bool
+	}{
+		{name: "sole owner", wantDeleted: true},
+		{
+			name:        "shared with another user",
+			others:      []*types.Media{{Origin: "example.org", MediaId: "theirs", UserId: "@bob:example.org"}},
+			wantDeleted: false,
+		},
+		{
+			name:        "same hash in another datastore",
+			others:      []*types.Media{{Origin: "example.org", MediaId: "theirs", DatastoreId: "elsewhere"}},
+			wantDeleted: true,
+		},
+		{
+			name:        "shared but quarantined",
+			quarantined: true,
+			others:      []*types.Media{{Origin: "example.org", MediaId: "theirs", UserId: "@bob:example.org"}},
+			wantDeleted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+			contents := []byte("uploaded by alice")
+			info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			media := &types.Media{
+				Origin:      "example.org",
+				MediaId:     "mine",
+				UserId:      "@alice:example.org",
+				Sha256Hash:  info.Sha256Hash,
+				SizeBytes:   info.SizeBytes,
+				DatastoreId: ds.DatastoreId,
+				Location:    info.Location,
+				Quarantined: tt.quarantined,
+			}
+			similar := []*types.Media{media}
+			for _, o := range tt.others {
+				if o.DatastoreId == "" {
+					o.DatastoreId = ds.DatastoreId
+				}
+				if o.DatastoreId == ds.DatastoreId {
+					o.Location = info.Location
+				}
+				o.Sha256Hash = info.Sha256Hash
+				similar = append(similar, o)
+			}
+
+			freed, kept, err := purgeMediaFile(media, similar, ds, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remaining := countFiles(t, ds.Uri)
+			if kept == tt.wantDeleted {
+				t.Errorf("got kept = %t, expected %t", kept, !tt.wantDeleted)
+			}
+			if tt.wantDeleted {
+				if remaining != 0 || freed != int64(len(contents)) {
+					t.Errorf("got %d files left and %d bytes freed, expected the file to be deleted", remaining, freed)
+				}
+			} else {
+				if remaining != 1 || freed != 0 {
+					t.Errorf("got %d files left and %d bytes freed, expected the shared file to be kept", remaining, freed)
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeMediaFileAlreadyGone(t *testing.T) {
+	ctx := testContext()
+	ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+	media := &types.Media{Origin: "example.org", MediaId: "mine", DatastoreId: "test", Location: "ab/cd/efgh", SizeBytes: 10}
+
+	_, _, err := purgeMediaFile(media, []*types.Media{media}, ds, ctx)
+	if err != nil {
+		t.Errorf("expected a missing file not to stop the purge, got %v", err)
+	}
+}
+
+// fakeRemoteMediaPager keeps the remote media cache in memory, least recently accessed first. The
+// position of each record stands in for its access time.
+type fakeRemoteMediaPager struct {
+	media []*types.Media
+	pages int
+}
+
+func isEvictable(m *types.Media, exceptOrigins []string) bool {
+	return !m.Quarantined && !util.ArrayContains(exceptOrigins, m.Origin)
+}
+
+func (d *fakeRemoteMediaPager) GetRemoteMediaSize(exceptOrigins []string) (int64, error) {
+	size := int64(0)
+	seen := make(map[string]bool)
+	for _, m := range d.media {
+		if isEvictable(m, exceptOrigins) && !seen[m.DatastoreId+"/"+m.Location] {
+			seen[m.DatastoreId+"/"+m.Location] = true
+			size += m.SizeBytes
+		}
+	}
+	return size, nil
+}
+
+func (d *fakeRemoteMediaPager) GetRemoteMediaPageByLastAccess(exceptOrigins []string, afterAccessTs int64, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, int64, error) {
+	d.pages++
+	page := make([]*types.Media, 0)
+	lastAccessTs := afterAccessTs
+	for i, m := range d.media {
+		if int64(i) <= afterAccessTs || !isEvictable(m, exceptOrigins) || len(page) >= limit {
+			continue
+		}
+		page = append(page, m)
+		lastAccessTs = int64(i)
+	}
+	return page, lastAccessTs, nil
+}
+
+func TestEvictRemoteMedia(t *testing.T) {
+	// Least recently accessed first, as the database returns them
+	cached := []*types.Media{
+		{Origin: "remote.example.org", MediaId: "oldest", DatastoreId: "ds", Location: "a", SizeBytes: 40},
+		{Origin: "example.org", MediaId: "local", DatastoreId: "ds", Location: "b", SizeBytes: 500},
+		{Origin: "remote.example.org", MediaId: "older", DatastoreId: "ds", Location: "c", SizeBytes: 30},
+		{Origin: "remote.example.org", MediaId: "quarantined", DatastoreId: "ds", Location: "q", SizeBytes: 1000, Quarantined: true},
+		{Origin: "other.example.org", MediaId: "recent", DatastoreId: "ds", Location: "d", SizeBytes: 20},
+		{Origin: "remote.example.org", MediaId: "newest", DatastoreId: "ds", Location: "e", SizeBytes: 10},
+	}
+
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		batchSize   int
+		wantEvicted []string
+		wantPages   int
+	}{
+		{name: "under the limit", maxBytes: 100, batchSize: 10, wantEvicted: []string{}, wantPages: 0},
+		{name: "just over the limit", maxBytes: 90, batchSize: 10, wantEvicted: []string{"oldest"}, wantPages: 1},
+		{name: "well over the limit", maxBytes: 25, batchSize: 10, wantEvicted: []string{"oldest", "older", "recent"}, wantPages: 1},
+		{name: "no space at all", maxBytes: 0, batchSize: 10, wantEvicted: []string{"oldest", "older", "recent", "newest"}, wantPages: 1},
+		{name: "in batches", maxBytes: 25, batchSize: 1, wantEvicted: []string{"oldest", "older", "recent"}, wantPages: 3},
+		{name: "running out of media", maxBytes: 0, batchSize: 3, wantEvicted: []string{"oldest", "older", "recent", "newest"}, wantPages: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeRemoteMediaPager{media: cached}
+			evicted := make([]string, 0)
+			removed, err := evictRemoteMedia(db, []string{"example.org"}, tt.maxBytes, tt.batchSize, func(m *types.Media) bool {
+				evicted = append(evicted, m.MediaId)
+				return true
+			}, testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if removed != len(tt.wantEvicted) || len(evicted) != len(tt.wantEvicted) {
+				t.Fatalf("got %v evicted (%d removed), expected %v", evicted, removed, tt.wantEvicted)
+			}
+			for i, id := range tt.wantEvicted {
+				if evicted[i] != id {
+					t.Errorf("got %s evicted at %d, expected %s", evicted[i], i, id)
+				}
+			}
+			if db.pages != tt.wantPages {
+				t.Errorf("got %d pages fetched, expected %d", db.pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestEvictRemoteMediaSharedFiles(t *testing.T) {
+	db := &fakeRemoteMediaPager{media: []*types.Media{
+		{Origin: "remote.example.org", MediaId: "copy1", DatastoreId: "ds", Location: "a", SizeBytes: 50},
+		{Origin: "remote.example.org", MediaId: "copy2", DatastoreId: "ds", Location: "a", SizeBytes: 50},
+		{Origin: "remote.example.org", MediaId: "other", DatastoreId: "ds", Location: "b", SizeBytes: 50},
+	}}
+
+	// The shared file only counts once, and only frees space once the last copy is purged
+	evicted := make([]string, 0)
+	stillShared := map[string]bool{"copy1": true}
+	removed, err := evictRemoteMedia(db, nil, 60, 10, func(m *types.Media) bool {
+		evicted = append(evicted, m.MediaId)
+		return !stillShared[m.MediaId]
+	}, testContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 || len(evicted) != 2 || evicted[0] != "copy1" || evicted[1] != "copy2" {
+		t.Errorf("got %v evicted (%d files removed), expected both copies of the shared file", evicted, removed)
+	}
+}
+
+type fakeDatastoreLocations struct {
+	locations []string
+	lookups   int
+}
+
+func (d *fakeDatastoreLocations) GetReferencedLocationsInDatastore(datastoreId string, locations []string) ([]string, error) {
+	d.lookups++
+	referenced := make([]string, 0)
+	for _, location := range locations {
+		for _, known := range d.locations {
+			if location == known {
+				referenced = append(referenced, location)
+			}
+		}
+	}
+	return referenced, nil
+}
+
+func TestFindOrphanedFiles(t *testing.T) {
+	ctx := testContext()
+	ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+	files := []struct {
+		location   string
+		contents   string
+		age        time.Duration
+		referenced bool
+		wantOrphan bool
+	}{
+		{location: "aa/bb/referenced", contents: "still used by some media", age: 48 * time.Hour, referenced: true},
+		{location: "aa/cc/orphaned", contents: "nothing points here", age: 48 * time.Hour, wantOrphan: true},
+		{location: "dd/ee/also-orphaned", contents: "or here", age: 2 * time.Hour, wantOrphan: true},
+		{location: "dd/ff/recent", contents: "an upload which isn't recorded yet", age: time.Minute},
+	}
+	db := &fakeDatastoreLocations{}
+	wantBytes := int64(0)
+	for _, f := range files {
+		p := filepath.Join(ds.Uri, filepath.FromSlash(f.location))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(f.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-f.age)
+		if err := os.Chtimes(p, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		if f.referenced {
+			db.locations = append(db.locations, f.location)
+		}
+		if f.wantOrphan {
+			wantBytes += int64(len(f.contents))
+		}
+	}
+
+	checkReport := func(t *testing.T, report *types.OrphanedFilesReport) {
+		found := make(map[string]bool)
+		for _, f := range report.Files {
+			found[f.Location] = true
+		}
+		for _, f := range files {
+			if found[f.location] != f.wantOrphan {
+				t.Errorf("got %s reported as orphaned: %t, expected %t", f.location, found[f.location], f.wantOrphan)
+			}
+		}
+		if report.TotalBytes != wantBytes {
+			t.Errorf("got %d bytes, expected %d", report.TotalBytes, wantBytes)
+		}
+	}
+
+	report, err := findOrphanedFiles(ds, db, 1000, time.Hour, false, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReport(t, report)
+	if report.Deleted || countFiles(t, ds.Uri) != len(files) {
+		t.Error("expected a dry run to leave the files alone")
+	}
+
+	report, err = findOrphanedFiles(ds, db, 1000, time.Hour, true, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReport(t, report)
+	if !report.Deleted {
+		t.Error("expected the report to say the files were deleted")
+	}
+	for _, f := range files {
+		_, err = os.Stat(filepath.Join(ds.Uri, filepath.FromSlash(f.location)))
+		if exists := err == nil; exists == f.wantOrphan {
+			t.Errorf("got %s existing: %t, expected only orphans outside the grace period to be deleted", f.location, exists)
+		}
+	}
+}
+
+type fakeMediaPager struct {
+	media []*types.Media
+	pages int
+}
+
+func (d *fakeMediaPager) GetMediaPage(serverName string, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, error) {
+	d.pages++
+	page := make([]*types.Media, 0)
+	for _, m := range d.media {
+		if serverName != "" && m.Origin != serverName {
+			continue
+		}
+		if m.Origin < afterOrigin || (m.Origin == afterOrigin && m.MediaId <= afterMediaId) {
+			continue
+		}
+		if len(page) < limit {
+			page = append(page, m)
+		}
+	}
+	return page, nil
+}
+
+func TestPurgeRemoteOrigin(t *testing.T) {
+	tests := []struct {
+		name              string
+		dryRun            bool
+		expectedPurged    []string
+		expectedFreed     int64
+		expectedEstimated []string
+	}{
+		{name: "purge", expectedPurged: []string{"a", "b", "c"}, expectedFreed: 60},
+		{name: "dry run", dryRun: true, expectedEstimated: []string{"a", "b", "c"}, expectedFreed: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Sorted by origin and media ID, as the database returns them
+			mediaDb := &fakeMediaPager{media: []*types.Media{
+				{Origin: "example.org", MediaId: "a", SizeBytes: 1000},
+				{Origin: "example.org", MediaId: "z", SizeBytes: 1000},
+				{Origin: "other.example.org", MediaId: "a", SizeBytes: 1000},
+				{Origin: "remote.example.org", MediaId: "a", SizeBytes: 10},
+				{Origin: "remote.example.org", MediaId: "b", SizeBytes: 20},
+				{Origin: "remote.example.org", MediaId: "c", SizeBytes: 30},
+				{Origin: "zzz.example.org", MediaId: "a", SizeBytes: 1000},
+			}}
+
+			purged := make([]string, 0)
+			estimated := make([]string, 0)
+			count, freed, err := purgeRemoteOrigin("remote.example.org", tt.dryRun, mediaDb, 2, func(records []*types.Media) (int64, error) {
+				size := int64(0)
+				for _, m := range records {
+					estimated = append(estimated, m.MediaId)
+					size += m.SizeBytes
+				}
+				return size, nil
+			}, func(media *types.Media) (int64, error) {
+				if media.Origin != "remote.example.org" {
+					t.Errorf("got %s/%s purged, expected only remote.example.org's media", media.Origin, media.MediaId)
+				}
+				purged = append(purged, media.MediaId)
+				return media.SizeBytes, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if count != 3 || freed != tt.expectedFreed {
+				t.Errorf("got %d purged and %d bytes freed, expected 3 and %d", count, freed, tt.expectedFreed)
+			}
+			if len(purged) != len(tt.expectedPurged) || len(estimated) != len(tt.expectedEstimated) {
+				t.Errorf("got %v purged and %v estimated, expected %v and %v", purged, estimated, tt.expectedPurged, tt.expectedEstimated)
+			}
+			if mediaDb.pages != 3 {
+				t.Errorf("got %d pages, expected the media to be fetched in 3 batches", mediaDb.pages)
+			}
+		})
+	}
+}
+
+func TestPurgeRemoteOriginRefusesLocalOrigin(t *testing.T) {
+	// Local origins are refused before the database is touched
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{name: "purge", dryRun: false},
+		{name: "dry run", dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purged, freed, err := PurgeRemoteOrigin("example.org", tt.dryRun, testContext())
+			if err == nil {
+				t.Error("expected the local origin to be refused")
+			}
+			if purged != 0 || freed != 0 {
+				t.Errorf("got %d records and %d bytes purged, expected nothing", purged, freed)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package maintenance_controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+func TestCopyFileToDatastore(t *testing.T) {
+	contents := []byte("media repo test file")
+	hash := sha256.Sum256(contents)
+	goodHash := "sha256:" + hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		name     string
+		location string
+		hash     string
+		wantErr  bool
+	}{
+		{name: "matching hash", location: "ab/cd/file", hash: goodHash},
+		{name: "mismatched hash", location: "ab/cd/file", hash: "0000", wantErr: true},
+		{name: "missing source", location: "ab/cd/missing", hash: goodHash, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceDir := t.TempDir()
+			targetDir := t.TempDir()
+			if err := os.MkdirAll(path.Join(sourceDir, "ab", "cd"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(sourceDir, "ab", "cd", "file"), contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+			sourceDs := &datastore.DatastoreRef{DatastoreId: "source", Type: "file", Uri: sourceDir}
+			targetDs := &datastore.DatastoreRef{DatastoreId: "target", Type: "file", Uri: targetDir}
+
+			info, err := copyFileToDatastore(tt.location, false, tt.hash, int64(len(contents)), sourceDs, targetDs, testContext())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+
+			// The source is never touched, and bad copies are cleaned up
+			if _, err := os.Stat(path.Join(sourceDir, "ab", "cd", "file")); err != nil {
+				t.Errorf("source file is gone: %v", err)
+			}
+			copies := countObjects(t, targetDs)
+			if tt.wantErr {
+				if copies != 0 {
+					t.Errorf("got %d files in target datastore, expected none", copies)
+				}
+				return
+			}
+			if copies != 1 {
+				t.Errorf("got %d files in target datastore, expected 1", copies)
+			}
+			if info.Location == "" {
+				t.Fatal("copy has no location")
+			}
+
+			// The copy must still download from its new datastore
+			f, err := targetDs.DownloadFile(info.Location, info.Encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != string(contents) {
+				t.Error("copied file does not match the source")
+			}
+		})
+	}
+}
+
+func countObjects(t *testing.T, ds *datastore.DatastoreRef) int {
+	count := 0
+	err := ds.ListObjects(func(location string, sizeBytes int64, modified time.Time) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
@@ -0,0 +1,153 @@
+package maintenance_controller
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestDeleteOrphanedFiles(t *testing.T) {
+	tests := []struct {
+		name              string
+		missing           bool // whether one of the files has already been deleted
+		cancelled         bool
+		wantErr           bool
+		expectedRemaining int
+	}{
+		{name: "all files", expectedRemaining: 0},
+		{name: "missing file", missing: true, wantErr: true},
+		{name: "cancelled", cancelled: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := make([]*types.OrphanedFile, 0)
+			for i := 0; i < 20; i++ {
+				location := fmt.Sprintf("file%d", i)
+				if err := ioutil.WriteFile(path.Join(dir, location), []byte("orphan"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, &types.OrphanedFile{Location: location, SizeBytes: 6})
+			}
+			if tt.missing {
+				files = append(files, &types.OrphanedFile{Location: "missing", SizeBytes: 6})
+			}
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: dir}
+
+			ctx := testContext()
+			if tt.cancelled {
+				cancelCtx, cancel := context.WithCancel(ctx.Context)
+				cancel()
+				ctx.Context = cancelCtx
+			}
+
+			err := deleteOrphanedFiles(ds, files, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// Some files may have been deleted before the workers were stopped
+				return
+			}
+			remaining, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining) != tt.expectedRemaining {
+				t.Errorf("got %d files remaining, expected %d", len(remaining), tt.expectedRemaining)
+			}
+		})
+	}
+}
+
+// cancellingLocations cancels the scan when the first batch is looked up.
+type cancellingLocations struct {
+	fakeDatastoreLocations
+	cancel context.CancelFunc
+}
+
+func (d *cancellingLocations) GetReferencedLocationsInDatastore(datastoreId string, locations []string) ([]string, error) {
+	d.cancel()
+	return d.fakeDatastoreLocations.GetReferencedLocationsInDatastore(datastoreId, locations)
+}
+
+func writeOldFiles(t *testing.T, dir string, count int) {
+	modified := time.Now().Add(-48 * time.Hour)
+	for i := 0; i < count; i++ {
+		p := path.Join(dir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(p, []byte("orphan"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindOrphanedFilesBatches(t *testing.T) {
+	tests := []struct {
+		name            string
+		files           int
+		batchSize       int
+		expectedLookups int
+	}{
+		{name: "partial last batch", files: 25, batchSize: 10, expectedLookups: 3},
+		{name: "exact batches", files: 20, batchSize: 10, expectedLookups: 2},
+		{name: "one batch", files: 5, batchSize: 1000, expectedLookups: 1},
+		{name: "no files", files: 0, batchSize: 10, expectedLookups: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+			writeOldFiles(t, ds.Uri, tt.files)
+			db := &fakeDatastoreLocations{locations: []string{"file0"}}
+
+			report, err := findOrphanedFiles(ds, db, tt.batchSize, time.Hour, false, testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if db.lookups != tt.expectedLookups {
+				t.Errorf("got %d lookups, expected %d", db.lookups, tt.expectedLookups)
+			}
+			if report.ScannedFiles != int64(tt.files) {
+				t.Errorf("got %d scanned files, expected %d", report.ScannedFiles, tt.files)
+			}
+			expectedOrphans := tt.files - 1
+			if tt.files == 0 {
+				expectedOrphans = 0
+			}
+			if len(report.Files) != expectedOrphans {
+				t.Errorf("got %d orphaned files, expected %d", len(report.Files), expectedOrphans)
+			}
+		})
+	}
+}
+
+func TestFindOrphanedFilesCancelled(t *testing.T) {
+	ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+	writeOldFiles(t, ds.Uri, 50)
+
+	ctx := testContext()
+	cancelCtx, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
+	ctx.Context = cancelCtx
+	db := &cancellingLocations{cancel: cancel}
+
+	_, err := findOrphanedFiles(ds, db, 10, time.Hour, true, ctx)
+	if err != context.Canceled {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	if db.lookups != 1 {
+		t.Errorf("got %d lookups, expected the scan to stop after the first batch", db.lookups)
+	}
+	if n := countFiles(t, ds.Uri); n != 50 {
+		t.Errorf("got %d files remaining, expected none to be deleted", n)
+	}
+}
@@ -0,0 +1,94 @@
+package maintenance_controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// retentionStore is the part of the media store needed to find expired media
+type retentionStore interface {
+	GetOrigins() ([]string, error)
+	StreamInventory(origin string, sinceTs int64, beforeTs int64, fn func(media *types.Media, lastAccessTs int64) error) error
+}
+
+// purgeExpiredRecord is swapped out by tests
+var purgeExpiredRecord = purgeRecordWith
+
+// PurgeExpiredMedia deletes media which is older than the retention policy allows for its origin,
+// returning how many media records were purged. Files shared with media which isn't being purged
+// are kept. Local media IDs are reserved so they can't be used again, while remote media can be
+// downloaded again if it is requested.
+func PurgeExpiredMedia(ctx rcontext.RequestContext) (int, error) {
+	return purgeExpiredMedia(config.Get().Retention, storage.GetDatabase().GetMediaStore(ctx), ctx)
+}
+
+func purgeExpiredMedia(conf config.RetentionConfig, db retentionStore, ctx rcontext.RequestContext) (int, error) {
+	origins, err := db.GetOrigins()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, origin := range origins {
+		isLocal := util.IsServerOurs(origin)
+		if isLocal && conf.ExemptLocalMedia {
+			continue
+		}
+		rule := retentionRuleFor(conf.Rules, origin)
+		if rule == nil {
+			continue
+		}
+
+		beforeTs := util.NowMillis() - (time.Duration(rule.MaxAgeDays) * 24 * time.Hour).Milliseconds()
+
+		// Media can't have been accessed before it was created, so only older media needs checking
+		expired := make([]*types.Media, 0)
+		err = db.StreamInventory(origin, 0, beforeTs, func(media *types.Media, lastAccessTs int64) error {
+			if media.Quarantined {
+				return nil // purging would lose the quarantine
+			}
+			if conf.Basis == config.RetentionBasisLastAccess && lastAccessTs >= beforeTs {
+				return nil
+			}
+			expired = append(expired, media)
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+		if len(expired) == 0 {
+			continue
+		}
+
+		ctx.Log.Info(fmt.Sprintf("Purging %d media from %s older than %d days", len(expired), origin, rule.MaxAgeDays))
+		for _, media := range expired {
+			_, _, err = purgeExpiredRecord(media, isLocal, ctx)
+			if err != nil {
+				ctx.Log.Warn("Error purging expired media " + media.MxcUri() + ": " + err.Error())
+				sentry.CaptureException(err)
+				continue
+			}
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// retentionRuleFor returns the first retention rule to match the origin, or nil if the origin's
+// media is kept forever. Rules without origins match every origin.
+func retentionRuleFor(rules []config.RetentionRule, origin string) *config.RetentionRule {
+	for i, rule := range rules {
+		if len(rule.Origins) == 0 || util.GlobMatchesAny(rule.Origins, origin) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
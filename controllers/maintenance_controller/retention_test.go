@@ -0,0 +1,158 @@
+package maintenance_controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestRetentionRuleFor(t *testing.T) {
+	rules := []config.RetentionRule{
+		{Origins: []string{"*.example.org", "example.org"}, MaxAgeDays: 30},
+		{Origins: []string{"matrix.org"}, MaxAgeDays: 90},
+		{Origins: []string{"matrix.org", "*.matrix.org"}, MaxAgeDays: 180},
+	}
+	catchAll := append(rules, config.RetentionRule{MaxAgeDays: 365})
+
+	tests := []struct {
+		name            string
+		rules           []config.RetentionRule
+		origin          string
+		expectedMaxDays int // or zero for no rule
+	}{
+		{name: "exact", rules: rules, origin: "example.org", expectedMaxDays: 30},
+		{name: "glob", rules: rules, origin: "media.example.org", expectedMaxDays: 30},
+		{name: "first match", rules: rules, origin: "matrix.org", expectedMaxDays: 90},
+		{name: "later rule", rules: rules, origin: "sub.matrix.org", expectedMaxDays: 180},
+		{name: "no match", rules: rules, origin: "remote.org"},
+		{name: "catch all", rules: catchAll, origin: "remote.org", expectedMaxDays: 365},
+		{name: "no rules", rules: nil, origin: "example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := retentionRuleFor(tt.rules, tt.origin)
+			if tt.expectedMaxDays == 0 {
+				if rule != nil {
+					t.Errorf("got %+v, expected no rule", rule)
+				}
+				return
+			}
+			if rule == nil {
+				t.Fatal("got no rule, expected one")
+			}
+			if rule.MaxAgeDays != tt.expectedMaxDays {
+				t.Errorf("got %d days, expected %d", rule.MaxAgeDays, tt.expectedMaxDays)
+			}
+		})
+	}
+}
+
+type inventoryRecord struct {
+	media        *types.Media
+	lastAccessTs int64
+}
+
+type fakeRetentionStore struct {
+	records []inventoryRecord
+}
+
+func (s *fakeRetentionStore) GetOrigins() ([]string, error) {
+	origins := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, r := range s.records {
+		if !seen[r.media.Origin] {
+			seen[r.media.Origin] = true
+			origins = append(origins, r.media.Origin)
+		}
+	}
+	return origins, nil
+}
+
+func (s *fakeRetentionStore) StreamInventory(origin string, sinceTs int64, beforeTs int64, fn func(media *types.Media, lastAccessTs int64) error) error {
+	for _, r := range s.records {
+		if r.media.Origin == origin && r.media.CreationTs >= sinceTs && r.media.CreationTs < beforeTs {
+			if err := fn(r.media, r.lastAccessTs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestPurgeExpiredMedia(t *testing.T) {
+	now := util.NowMillis()
+	daysAgo := func(days int) int64 {
+		return now - (time.Duration(days) * 24 * time.Hour).Milliseconds()
+	}
+	record := func(origin string, mediaId string, createdDaysAgo int, accessedDaysAgo int, quarantined bool) inventoryRecord {
+		return inventoryRecord{
+			media:        &types.Media{Origin: origin, MediaId: mediaId, CreationTs: daysAgo(createdDaysAgo), Quarantined: quarantined},
+			lastAccessTs: daysAgo(accessedDaysAgo),
+		}
+	}
+	db := &fakeRetentionStore{records: []inventoryRecord{
+		record("example.org", "old", 40, 40, false),
+		record("example.org", "new", 1, 1, false),
+		record("remote.org", "old", 40, 40, false),
+		record("remote.org", "new", 5, 5, false),
+		record("remote.org", "recently-accessed", 40, 1, false),
+		record("remote.org", "quarantined", 40, 40, true),
+		record("kept.org", "ancient", 400, 400, false),
+	}}
+	rules := []config.RetentionRule{{Origins: []string{"example.org", "remote.org"}, MaxAgeDays: 30}}
+
+	tests := []struct {
+		name           string
+		conf           config.RetentionConfig
+		expectedPurged map[string]bool // MXC URI -> whether the media ID is reserved
+	}{
+		{
+			name:           "creation time",
+			conf:           config.RetentionConfig{Basis: config.RetentionBasisCreated, ExemptLocalMedia: true, Rules: rules},
+			expectedPurged: map[string]bool{"mxc://remote.org/old": false, "mxc://remote.org/recently-accessed": false},
+		},
+		{
+			name:           "last access",
+			conf:           config.RetentionConfig{Basis: config.RetentionBasisLastAccess, ExemptLocalMedia: true, Rules: rules},
+			expectedPurged: map[string]bool{"mxc://remote.org/old": false},
+		},
+		{
+			name:           "local media not exempt",
+			conf:           config.RetentionConfig{Basis: config.RetentionBasisCreated, ExemptLocalMedia: false, Rules: rules},
+			expectedPurged: map[string]bool{"mxc://example.org/old": true, "mxc://remote.org/old": false, "mxc://remote.org/recently-accessed": false},
+		},
+		{
+			name:           "no rules",
+			conf:           config.RetentionConfig{Basis: config.RetentionBasisCreated},
+			expectedPurged: map[string]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purged := make(map[string]bool)
+			defer func(original func(*types.Media, bool, rcontext.RequestContext) (int64, bool, error)) {
+				purgeExpiredRecord = original
+			}(purgeExpiredRecord)
+			purgeExpiredRecord = func(media *types.Media, reserve bool, ctx rcontext.RequestContext) (int64, bool, error) {
+				purged[media.MxcUri()] = reserve
+				return 0, true, nil
+			}
+
+			count, err := purgeExpiredMedia(tt.conf, db, testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(tt.expectedPurged) {
+				t.Errorf("got %d purged, expected %d", count, len(tt.expectedPurged))
+			}
+			if !reflect.DeepEqual(purged, tt.expectedPurged) {
+				t.Errorf("got %v, expected %v", purged, tt.expectedPurged)
+			}
+		})
+	}
+}
@@ -138,7 +138,7 @@ func urlPreviewWorkFn(request *resource_handler.WorkRequest) (resp *urlPreviewRe
 			ctx.Log.Warn("Non-fatal error storing preview thumbnail: " + err.Error())
 			sentry.CaptureException(err)
 		} else {
-			mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+			mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location, media.Encoded)
 			if err != nil {
 				ctx.Log.Warn("Non-fatal error streaming datastore file: " + err.Error())
 				sentry.CaptureException(err)
@@ -0,0 +1,52 @@
+package thumbnail_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+var generationSlots chan bool
+var generationSlotsLock = &sync.Mutex{}
+
+func getGenerationSlots() chan bool {
+	generationSlotsLock.Lock()
+	defer generationSlotsLock.Unlock()
+
+	maxConcurrent := config.Get().Thumbnails.MaxConcurrent
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	if generationSlots == nil || cap(generationSlots) != maxConcurrent {
+		// Generations holding a slot from before a config change release into the old channel
+		generationSlots = make(chan bool, maxConcurrent)
+	}
+	return generationSlots
+}
+
+// acquireGenerationSlot waits for one of the thumbnails.maxConcurrent slots to be free, returning
+// false if none became free before the configured queue timeout. The returned function must be
+// called to release the slot.
+func acquireGenerationSlot() (func(), bool) {
+	slots := getGenerationSlots()
+	if slots == nil {
+		return func() {}, true
+	}
+	release := func() { <-slots }
+
+	timeoutSeconds := config.Get().Thumbnails.QueueTimeoutSeconds
+	if timeoutSeconds <= 0 {
+		slots <- true
+		return release, true
+	}
+
+	timer := time.NewTimer(time.Duration(timeoutSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case slots <- true:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	}
+}
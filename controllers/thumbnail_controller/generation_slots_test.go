@@ -0,0 +1,69 @@
+package thumbnail_controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func TestMain(m *testing.M) {
+	// Allow two concurrent generations, and only wait a second for a slot
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	err = ioutil.WriteFile(config.Path, []byte("thumbnails:\n  maxConcurrent: 2\n  queueTimeoutSeconds: 1\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestAcquireGenerationSlot(t *testing.T) {
+	releases := make([]func(), 0)
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	tests := []struct {
+		name        string
+		releaseOne  bool // release a held slot before acquiring
+		wantOk      bool
+		wantWaitMin time.Duration
+	}{
+		{name: "first slot", wantOk: true},
+		{name: "second slot", wantOk: true},
+		{name: "no slots free", wantOk: false, wantWaitMin: time.Second},
+		{name: "slot released", releaseOne: true, wantOk: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.releaseOne {
+				releases[0]()
+				releases = releases[1:]
+			}
+
+			start := time.Now()
+			release, ok := acquireGenerationSlot()
+			waited := time.Since(start)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok {
+				releases = append(releases, release)
+			}
+			if waited < tt.wantWaitMin {
+				t.Errorf("waited %s, want at least %s", waited, tt.wantWaitMin)
+			}
+		})
+	}
+}
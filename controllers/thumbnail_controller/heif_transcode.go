@@ -0,0 +1,52 @@
+package thumbnail_controller
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// TranscodeMethod is the thumbnail method for HEIF/HEIC media converted to a JPEG for downloading.
+// The converted file is stored as a thumbnail without dimensions so that it is only converted once,
+// and is regenerated and purged along with the media's other thumbnails.
+const TranscodeMethod = "transcode"
+
+// GetHeifTranscode returns the HEIF/HEIC media converted to a JPEG, converting it if this hasn't
+// been done before.
+func GetHeifTranscode(media *types.Media, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+	thumbnail, err := GetOrGenerateThumbnail(media, 0, 0, false, TranscodeMethod, "", ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := datastore.DownloadStream(ctx, thumbnail.DatastoreId, thumbnail.Location, thumbnail.Encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &types.StreamedThumbnail{Thumbnail: thumbnail, Stream: stream}, nil
+}
+
+func transcodeHeif(mediaStream io.ReadCloser, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	b, err := ioutil.ReadAll(mediaStream)
+	cleanup.DumpAndCloseStream(mediaStream)
+	if err != nil {
+		return nil, err
+	}
+
+	jpg, err := u.TranscodeHeifToJpeg(b, ctx.Config.Thumbnails.Heif, u.ParseBackgroundColor(ctx.Config.Thumbnails.BackgroundColor))
+	if err != nil {
+		return nil, err
+	}
+	return &m.Thumbnail{
+		Animated:    false,
+		ContentType: "image/jpeg",
+		Reader:      util.BytesToStream(jpg),
+	}, nil
+}
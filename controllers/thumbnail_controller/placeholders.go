@@ -0,0 +1,201 @@
+package thumbnail_controller
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"github.com/ryanuber/go-glob"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"golang.org/x/image/font/gofont/gosmallcaps"
+)
+
+type placeholderIcon struct {
+	label  string
+	colour color.RGBA
+	glyph  func(c *gg.Context, x float64, y float64)
+}
+
+var audioIcon = placeholderIcon{"audio", color.RGBA{R: 142, G: 68, B: 173, A: 255}, drawAudioGlyph}
+var videoIcon = placeholderIcon{"video", color.RGBA{R: 192, G: 57, B: 43, A: 255}, drawVideoGlyph}
+var archiveIcon = placeholderIcon{"archive", color.RGBA{R: 211, G: 130, B: 0, A: 255}, drawArchiveGlyph}
+var documentIcon = placeholderIcon{"document", color.RGBA{R: 41, G: 128, B: 185, A: 255}, drawDocumentGlyph}
+var fileIcon = placeholderIcon{"file", color.RGBA{R: 127, G: 140, B: 141, A: 255}, nil}
+
+// The built in icons, in the order they are checked
+var builtInPlaceholders = []struct {
+	contentTypes []string
+	icon         placeholderIcon
+}{
+	{[]string{"audio/*", "application/ogg"}, audioIcon},
+	{[]string{"video/*"}, videoIcon},
+	{[]string{"application/zip", "application/gzip", "application/x-gzip", "application/x-tar", "application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz"}, archiveIcon},
+	{[]string{"text/*", "application/pdf", "application/msword", "application/rtf", "application/vnd.openxmlformats-officedocument.*", "application/vnd.oasis.opendocument.*", "application/vnd.ms-*"}, documentIcon},
+	{[]string{"*"}, fileIcon},
+}
+
+var placeholderCache = make(map[string]image.Image)
+var placeholderCacheLock = &sync.Mutex{}
+
+// generatePlaceholderThumbnail creates a generic icon for media which can't be thumbnailed, using
+// the configured icons before the built in ones.
+func generatePlaceholderThumbnail(media *types.Media, contentType string, width int, height int, method string, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+	icon, err := getPlaceholderIcon(contentType, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := gg.NewContext(width, height)
+	icon = imaging.Fit(icon, width, height, imaging.Lanczos)
+	c.DrawImageAnchored(icon, width/2, height/2, 0.5, 0.5)
+
+	data := &bytes.Buffer{}
+	if err = c.EncodePNG(data); err != nil {
+		return nil, err
+	}
+
+	return &types.StreamedThumbnail{
+		Stream: util.BufferToStream(data),
+		Thumbnail: &types.Thumbnail{
+			Width:       width,
+			Height:      height,
+			MediaId:     media.MediaId,
+			Origin:      media.Origin,
+			Location:    "",
+			ContentType: "image/png",
+			Animated:    false,
+			Method:      method,
+			CreationTs:  util.NowMillis(),
+			SizeBytes:   int64(data.Len()),
+		},
+	}, nil
+}
+
+func getPlaceholderIcon(contentType string, ctx rcontext.RequestContext) (image.Image, error) {
+	for _, conf := range ctx.Config.Thumbnails.Placeholders.Icons {
+		if glob.Glob(conf.ContentType, contentType) {
+			return getCachedPlaceholder("file:"+conf.Path, func() (image.Image, error) {
+				return imaging.Open(conf.Path)
+			})
+		}
+	}
+
+	for _, placeholder := range builtInPlaceholders {
+		if util.GlobMatchesAny(placeholder.contentTypes, contentType) {
+			icon := placeholder.icon
+			return getCachedPlaceholder("builtin:"+icon.label, func() (image.Image, error) {
+				return drawPlaceholderIcon(icon)
+			})
+		}
+	}
+
+	return nil, nil // not possible: the last built in icon matches everything
+}
+
+func getCachedPlaceholder(key string, fn func() (image.Image, error)) (image.Image, error) {
+	placeholderCacheLock.Lock()
+	defer placeholderCacheLock.Unlock()
+
+	if img, ok := placeholderCache[key]; ok {
+		return img, nil
+	}
+	img, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	placeholderCache[key] = img
+	return img, nil
+}
+
+// drawPlaceholderIcon draws a page with a folded corner, the icon's glyph, and its label.
+func drawPlaceholderIcon(icon placeholderIcon) (image.Image, error) {
+	c := gg.NewContext(600, 700)
+	c.Clear()
+
+	left := 90.0
+	top := 40.0
+	right := 510.0
+	bottom := 660.0
+	fold := 120.0
+
+	c.SetColor(color.RGBA{R: 245, G: 245, B: 245, A: 255})
+	c.MoveTo(left, top)
+	c.LineTo(right-fold, top)
+	c.LineTo(right, top+fold)
+	c.LineTo(right, bottom)
+	c.LineTo(left, bottom)
+	c.ClosePath()
+	c.FillPreserve()
+	c.SetColor(icon.colour)
+	c.SetLineWidth(16)
+	c.Stroke()
+
+	c.MoveTo(right-fold, top)
+	c.LineTo(right-fold, top+fold)
+	c.LineTo(right, top+fold)
+	c.Stroke()
+
+	if icon.glyph != nil {
+		c.SetColor(icon.colour)
+		icon.glyph(c, (left+right)/2, 330)
+	}
+
+	f, err := truetype.Parse(gosmallcaps.TTF)
+	if err != nil {
+		return nil, err
+	}
+	c.SetColor(icon.colour)
+	c.SetFontFace(truetype.NewFace(f, &truetype.Options{Size: 72}))
+	c.DrawStringAnchored(icon.label, (left+right)/2, 560, 0.5, 0.5)
+
+	return c.Image(), nil
+}
+
+func drawAudioGlyph(c *gg.Context, x float64, y float64) {
+	c.DrawEllipse(x-60, y+80, 45, 35)
+	c.Fill()
+	c.DrawRectangle(x-23, y-100, 18, 180)
+	c.Fill()
+	c.MoveTo(x-23, y-100)
+	c.LineTo(x+80, y-60)
+	c.LineTo(x+80, y-20)
+	c.LineTo(x-23, y-60)
+	c.ClosePath()
+	c.Fill()
+}
+
+func drawVideoGlyph(c *gg.Context, x float64, y float64) {
+	c.MoveTo(x-70, y-100)
+	c.LineTo(x+100, y)
+	c.LineTo(x-70, y+100)
+	c.ClosePath()
+	c.Fill()
+}
+
+func drawArchiveGlyph(c *gg.Context, x float64, y float64) {
+	for i := 0; i < 6; i++ {
+		offset := float64(i) * 30
+		c.DrawRectangle(x-30, y-130+offset, 30, 15)
+		c.DrawRectangle(x, y-115+offset, 30, 15)
+	}
+	c.Fill()
+	c.DrawRoundedRectangle(x-40, y+55, 80, 70, 10)
+	c.Fill()
+}
+
+func drawDocumentGlyph(c *gg.Context, x float64, y float64) {
+	for i := 0; i < 5; i++ {
+		width := 260.0
+		if i == 4 {
+			width = 160
+		}
+		c.DrawRectangle(x-130, y-120+float64(i)*55, width, 22)
+	}
+	c.Fill()
+}
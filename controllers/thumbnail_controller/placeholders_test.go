@@ -0,0 +1,100 @@
+package thumbnail_controller
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestGetPlaceholderIcon(t *testing.T) {
+	customPath := path.Join(t.TempDir(), "custom.png")
+	f, err := os.Create(customPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := image.NewRGBA(image.Rect(0, 0, 10, 20))
+	custom.Set(0, 0, color.Black)
+	err = png.Encode(f, custom)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := rcontext.RequestContext{}
+	ctx.Config.Thumbnails.Placeholders.Icons = []config.PlaceholderIconConfig{
+		{ContentType: "application/x-custom*", Path: customPath},
+	}
+
+	tests := []struct {
+		contentType string
+		wantKey     string
+	}{
+		{contentType: "audio/mpeg", wantKey: "builtin:audio"},
+		{contentType: "application/ogg", wantKey: "builtin:audio"},
+		{contentType: "video/mp4", wantKey: "builtin:video"},
+		{contentType: "application/zip", wantKey: "builtin:archive"},
+		{contentType: "text/plain", wantKey: "builtin:document"},
+		{contentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", wantKey: "builtin:document"},
+		{contentType: "application/octet-stream", wantKey: "builtin:file"},
+		{contentType: "application/x-custom-type", wantKey: "file:" + customPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			icon, err := getPlaceholderIcon(tt.contentType, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if icon == nil {
+				t.Fatal("no icon was returned")
+			}
+
+			placeholderCacheLock.Lock()
+			cached := placeholderCache[tt.wantKey]
+			placeholderCacheLock.Unlock()
+			if cached != icon {
+				t.Errorf("icon for %s is not the %s icon", tt.contentType, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestGeneratePlaceholderThumbnail(t *testing.T) {
+	media := &types.Media{Origin: "example.org", MediaId: "abc123"}
+
+	tests := []struct {
+		width  int
+		height int
+		method string
+	}{
+		{width: 32, height: 32, method: "crop"},
+		{width: 320, height: 240, method: "scale"},
+		{width: 100, height: 400, method: "scale"},
+	}
+	for _, tt := range tests {
+		thumbnail, err := generatePlaceholderThumbnail(media, "audio/mpeg", tt.width, tt.height, tt.method, rcontext.RequestContext{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(thumbnail.Stream)
+		thumbnail.Stream.Close()
+		if err != nil {
+			t.Fatalf("placeholder is not a PNG: %v", err)
+		}
+		if img.Bounds().Dx() != tt.width || img.Bounds().Dy() != tt.height {
+			t.Errorf("placeholder is %dx%d, want %dx%d", img.Bounds().Dx(), img.Bounds().Dy(), tt.width, tt.height)
+		}
+		if thumbnail.Thumbnail.Width != tt.width || thumbnail.Thumbnail.Height != tt.height || thumbnail.Thumbnail.Method != tt.method {
+			t.Errorf("unexpected thumbnail record: %+v", thumbnail.Thumbnail)
+		}
+		if thumbnail.Thumbnail.ContentType != "image/png" {
+			t.Errorf("ContentType = %s, want image/png", thumbnail.Thumbnail.ContentType)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package thumbnail_controller
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/upload_controller"
+	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func init() {
+	upload_controller.AddUploadListener(PregenerateThumbnails)
+}
+
+// getOrGenerateThumbnail is swapped out by tests
+var getOrGenerateThumbnail = GetOrGenerateThumbnail
+
+// PregenerateThumbnails generates a thumbnail of the media for each of the configured sizes, if the
+// uploads.pregenerateThumbnails option is enabled, so that the first request for one doesn't have to
+// wait. Media which can't be thumbnailed is skipped.
+func PregenerateThumbnails(media *types.Media, ctx rcontext.RequestContext) {
+	if !ctx.Config.Uploads.PregenerateThumbnails {
+		return
+	}
+
+	contentType := util.FixContentType(media.ContentType)
+	if !thumbnailing.IsSupported(contentType) || !util.ArrayContains(ctx.Config.Thumbnails.Types, contentType) {
+		return
+	}
+	if ctx.Config.Thumbnails.MaxSourceBytes > 0 && media.SizeBytes > ctx.Config.Thumbnails.MaxSourceBytes {
+		return
+	}
+
+	animated := ctx.Config.Thumbnails.AllowAnimated && ctx.Config.Thumbnails.DefaultAnimated
+	if animated && (!thumbnailing.IsAnimationSupported(contentType) || (ctx.Config.Thumbnails.MaxAnimateSizeBytes > 0 && media.SizeBytes > ctx.Config.Thumbnails.MaxAnimateSizeBytes)) {
+		animated = false
+	}
+
+	ctx = ctx.LogWithFields(logrus.Fields{
+		"pregenerate_media": media.MxcUri(),
+	})
+
+	for _, size := range ctx.Config.Thumbnails.Sizes {
+		if media.Width != nil && media.Height != nil && size.Width >= *media.Width && size.Height >= *media.Height && !thumbnailing.IsAnimationSupported(contentType) {
+			continue // the original image is served for sizes this large
+		}
+
+		methods := []string{"crop", "scale"}
+		if size.Method != "" {
+			methods = []string{size.Method}
+		}
+		for _, method := range methods {
+			_, err := getOrGenerateThumbnail(media, size.Width, size.Height, animated, method, "", ctx)
+			if err == common.ErrThumbnailQueueFull {
+				// Requests from users are more important than warming the cache
+				ctx.Log.Warn("Thumbnailer is busy - skipping the remaining pre-generated thumbnails")
+				return
+			} else if err != nil {
+				ctx.Log.Warnf("Error pre-generating %dx%d (%s) thumbnail: %s", size.Width, size.Height, method, err.Error())
+				sentry.CaptureException(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package thumbnail_controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func pregenerateContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{Context: context.Background(), Log: logrus.NewEntry(logger)}
+	ctx.Config.Uploads.PregenerateThumbnails = true
+	ctx.Config.Thumbnails.Types = []string{"image/png"}
+	ctx.Config.Thumbnails.Sizes = []config.ThumbnailSize{{Width: 32, Height: 32}}
+	return ctx
+}
+
+// withThumbnailCache records the thumbnails which are generated, failing with errFn's error if set.
+func withThumbnailCache(t *testing.T, errFn func(width int, method string) error) *[]string {
+	generated := make([]string, 0)
+	original := getOrGenerateThumbnail
+	getOrGenerateThumbnail = func(media *types.Media, width int, height int, animated bool, method string, format string, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+		if errFn != nil {
+			if err := errFn(width, method); err != nil {
+				return nil, err
+			}
+		}
+		generated = append(generated, fmt.Sprintf("%dx%d %s animated=%t", width, height, method, animated))
+		return &types.Thumbnail{Origin: media.Origin, MediaId: media.MediaId, Width: width, Height: height, Method: method, Animated: animated}, nil
+	}
+	t.Cleanup(func() {
+		getOrGenerateThumbnail = original
+	})
+	return &generated
+}
+
+func TestPregenerateThumbnails(t *testing.T) {
+	tests := []struct {
+		name              string
+		modify            func(ctx *rcontext.RequestContext)
+		errFn             func(width int, method string) error
+		expectedGenerated []string
+	}{
+		{
+			name: "standard sizes",
+			modify: func(ctx *rcontext.RequestContext) {
+				ctx.Config.Thumbnails.Sizes = []config.ThumbnailSize{{Width: 32, Height: 32}, {Width: 96, Height: 96, Method: "scale"}}
+			},
+			expectedGenerated: []string{"32x32 crop animated=false", "32x32 scale animated=false", "96x96 scale animated=false"},
+		},
+		{
+			name: "animated by default",
+			modify: func(ctx *rcontext.RequestContext) {
+				ctx.Config.Thumbnails.AllowAnimated = true
+				ctx.Config.Thumbnails.DefaultAnimated = true
+			},
+			expectedGenerated: []string{"32x32 crop animated=true", "32x32 scale animated=true"},
+		},
+		{
+			name: "thumbnailer busy",
+			modify: func(ctx *rcontext.RequestContext) {
+				ctx.Config.Thumbnails.Sizes = []config.ThumbnailSize{{Width: 32, Height: 32}, {Width: 96, Height: 96}}
+			},
+			errFn: func(width int, method string) error {
+				if width == 96 {
+					return common.ErrThumbnailQueueFull
+				}
+				return nil
+			},
+			expectedGenerated: []string{"32x32 crop animated=false", "32x32 scale animated=false"},
+		},
+		{
+			name: "failed method",
+			errFn: func(width int, method string) error {
+				if method == "crop" {
+					return errors.New("failed to decode image")
+				}
+				return nil
+			},
+			expectedGenerated: []string{"32x32 scale animated=false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := pregenerateContext()
+			if tt.modify != nil {
+				tt.modify(&ctx)
+			}
+			generated := withThumbnailCache(t, tt.errFn)
+
+			media := &types.Media{Origin: "example.org", MediaId: "abc123", ContentType: "image/png", SizeBytes: 4096}
+			PregenerateThumbnails(media, ctx)
+
+			if !reflect.DeepEqual(*generated, tt.expectedGenerated) {
+				t.Errorf("got %v, expected %v", *generated, tt.expectedGenerated)
+			}
+		})
+	}
+}
+
+func TestPregenerateThumbnailsSkips(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(ctx *rcontext.RequestContext, media *types.Media)
+	}{
+		{name: "disabled", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			ctx.Config.Uploads.PregenerateThumbnails = false
+		}},
+		{name: "unsupported type", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			media.ContentType = "application/octet-stream"
+			ctx.Config.Thumbnails.Types = append(ctx.Config.Thumbnails.Types, "application/octet-stream")
+		}},
+		{name: "type not allowed", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			ctx.Config.Thumbnails.Types = []string{"image/jpeg"}
+		}},
+		{name: "too large", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			ctx.Config.Thumbnails.MaxSourceBytes = 1024
+		}},
+		{name: "original is small enough", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			// PNGs can be animated, so their originals aren't served in place of a thumbnail
+			media.ContentType = "image/jpeg"
+			ctx.Config.Thumbnails.Types = []string{"image/jpeg"}
+			width, height := 16, 16
+			media.Width = &width
+			media.Height = &height
+		}},
+		{name: "no sizes", modify: func(ctx *rcontext.RequestContext, media *types.Media) {
+			ctx.Config.Thumbnails.Sizes = nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := pregenerateContext()
+			media := &types.Media{Origin: "example.org", MediaId: "abc123", ContentType: "image/png", SizeBytes: 4096}
+			tt.modify(&ctx, media)
+			generated := withThumbnailCache(t, nil)
+
+			PregenerateThumbnails(media, ctx)
+
+			if len(*generated) != 0 {
+				t.Errorf("got %v, expected no thumbnails to be generated", *generated)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package thumbnail_controller
+
+import (
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// How many media items to process between progress updates on the task
+const regenerationProgressInterval = 25
+
+// StartThumbnailRegeneration starts a background task which regenerates the existing thumbnails
+// of a single media item, all the media for an origin, or all media if the origin is empty. The
+// task's params carry the queued, done, and failed counts as it progresses.
+func StartThumbnailRegeneration(origin string, mediaId string, purgeFirst bool, ctx rcontext.RequestContext) (*types.BackgroundTask, error) {
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	params := map[string]interface{}{
+		"origin":      origin,
+		"media_id":    mediaId,
+		"purge_first": purgeFirst,
+		"queued":      0,
+		"done":        0,
+		"failed":      0,
+	}
+	task, err := db.CreateBackgroundTask("regenerate_thumbnails", params)
+	if err != nil {
+		return nil, err
+	}
+
+	// The regeneration outlives the request which started it
+	ctx = ctx.Detached().LogWithFields(logrus.Fields{"taskId": task.ID})
+
+	go func() {
+		ctx.Log.Info("Starting thumbnail regeneration")
+
+		db := storage.GetDatabase().GetMetadataStore(ctx)
+		updateProgress := func() {
+			err := db.UpdateBackgroundTaskParams(task.ID, params)
+			if err != nil {
+				ctx.Log.Warn("Error updating task progress: ", err)
+				sentry.CaptureException(err)
+			}
+		}
+
+		queued := 0
+		done := 0
+		failed := 0
+		err := forEachMediaToRegenerate(origin, mediaId, func(media []*types.Media) {
+			queued += len(media)
+			params["queued"] = queued
+			updateProgress()
+
+			for i, m := range media {
+				rctx := ctx.LogWithFields(logrus.Fields{"origin": m.Origin, "mediaId": m.MediaId})
+				err := regenerateThumbnailsFor(m, purgeFirst, rctx)
+				if err != nil {
+					rctx.Log.Error("Error regenerating thumbnails: ", err)
+					sentry.CaptureException(err)
+					failed++
+				} else {
+					done++
+				}
+
+				if (i+1)%regenerationProgressInterval == 0 {
+					params["done"] = done
+					params["failed"] = failed
+					updateProgress()
+				}
+			}
+		}, ctx)
+		params["done"] = done
+		params["failed"] = failed
+		updateProgress()
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+			return
+		}
+
+		err = db.FinishedBackgroundTask(task.ID)
+		if err != nil {
+			ctx.Log.Error(err)
+			ctx.Log.Error("Failed to flag task as finished")
+			sentry.CaptureException(err)
+		}
+		ctx.Log.Infof("Finished thumbnail regeneration: %d done, %d failed", done, failed)
+	}()
+
+	return task, nil
+}
+
+// forEachMediaToRegenerate calls the function with batches of the media to regenerate, so that
+// every media record doesn't need to be held in memory.
+func forEachMediaToRegenerate(origin string, mediaId string, fn func(media []*types.Media), ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetMediaStore(ctx)
+
+	if mediaId != "" {
+		media, err := db.Get(origin, mediaId)
+		if err != nil {
+			return err
+		}
+		fn([]*types.Media{media})
+		return nil
+	}
+
+	// How many media records to load from the database at a time
+	batchSize := config.Get().Maintenance.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	afterOrigin := ""
+	afterMediaId := ""
+	for {
+		media, err := db.GetMediaPage(origin, afterOrigin, afterMediaId, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(media) == 0 {
+			return nil
+		}
+		fn(media)
+
+		last := media[len(media)-1]
+		afterOrigin = last.Origin
+		afterMediaId = last.MediaId
+	}
+}
+
+// regenerateThumbnailsFor replaces each of the media's thumbnails with a newly generated one of
+// the same size, method, and format. Unless purgeFirst is set, the old thumbnails are only
+// replaced once every new thumbnail has been generated, so a failure leaves them untouched.
+func regenerateThumbnailsFor(media *types.Media, purgeFirst bool, ctx rcontext.RequestContext) error {
+	db := storage.GetDatabase().GetThumbnailStore(ctx)
+	oldThumbs, err := db.GetAllForMedia(media.Origin, media.MediaId)
+	if err != nil {
+		return err
+	}
+	if len(oldThumbs) == 0 {
+		return nil
+	}
+
+	if purgeFirst {
+		err = deleteThumbnailFiles(media, oldThumbs, nil, ctx)
+		if err != nil {
+			return err
+		}
+		err = db.DeleteAllForMedia(media.Origin, media.MediaId)
+		if err != nil {
+			return err
+		}
+	}
+
+	newThumbs := make([]*types.Thumbnail, 0, len(oldThumbs))
+	for _, old := range oldThumbs {
+		newThumb, err := regenerateThumbnail(media, old, ctx)
+		if err != nil {
+			if !purgeFirst {
+				// Don't leave the files we've already generated lying around
+				_ = deleteThumbnailFiles(media, newThumbs, oldThumbs, ctx)
+			}
+			return err
+		}
+		newThumbs = append(newThumbs, newThumb)
+	}
+
+	if !purgeFirst {
+		err = db.DeleteAllForMedia(media.Origin, media.MediaId)
+		if err != nil {
+			return err
+		}
+		err = deleteThumbnailFiles(media, oldThumbs, newThumbs, ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, thumb := range newThumbs {
+		err = db.Insert(thumb)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func regenerateThumbnail(media *types.Media, old *types.Thumbnail, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+	// Wait as long as it takes for a slot: the regeneration isn't holding up a request
+	release, ok := acquireGenerationSlot()
+	for !ok {
+		release, ok = acquireGenerationSlot()
+	}
+	defer release()
+
+	quality := thumbnailQuality(old.Format, ctx)
+	generated, err := GenerateThumbnail(media, old.Width, old.Height, old.Method, old.Animated, old.Format, quality, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Thumbnail{
+		Origin:      media.Origin,
+		MediaId:     media.MediaId,
+		Width:       old.Width,
+		Height:      old.Height,
+		Method:      old.Method,
+		Animated:    old.Animated,
+		CreationTs:  util.NowMillis(),
+		ContentType: generated.ContentType,
+		DatastoreId: generated.DatastoreId,
+		Location:    generated.DatastoreLocation,
+		SizeBytes:   generated.SizeBytes,
+		Sha256Hash:  generated.Sha256Hash,
+		Format:      old.Format,
+		Quality:     quality,
+	}, nil
+}
+
+// deleteThumbnailFiles deletes the files for the given thumbnails, skipping any which are the
+// media itself or are in use by one of the kept thumbnails.
+func deleteThumbnailFiles(media *types.Media, thumbs []*types.Thumbnail, keep []*types.Thumbnail, ctx rcontext.RequestContext) error {
+	inUse := func(thumb *types.Thumbnail) bool {
+		if thumb.DatastoreId == media.DatastoreId && thumb.Location == media.Location {
+			return true
+		}
+		for _, k := range keep {
+			if thumb.DatastoreId == k.DatastoreId && thumb.Location == k.Location {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, thumb := range thumbs {
+		if inUse(thumb) {
+			continue
+		}
+
+		ctx.Log.Info("Deleting thumbnail with hash: ", thumb.Sha256Hash)
+		ds, err := datastore.LocateDatastore(ctx, thumb.DatastoreId)
+		if err != nil {
+			return err
+		}
+		err = ds.DeleteObject(thumb.Location)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package thumbnail_controller
+
+import (
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestDeleteThumbnailFilesKeepsFilesInUse(t *testing.T) {
+	media := &types.Media{DatastoreId: "ds1", Location: "media/file"}
+	kept := []*types.Thumbnail{
+		{DatastoreId: "ds1", Location: "thumbs/kept"},
+		{DatastoreId: "ds2", Location: "thumbs/other"},
+	}
+
+	// None of these thumbnails may be deleted, so the datastores are never looked up
+	tests := []struct {
+		name   string
+		thumbs []*types.Thumbnail
+		keep   []*types.Thumbnail
+	}{
+		{name: "no thumbnails", thumbs: nil, keep: kept},
+		{name: "same file as the media", thumbs: []*types.Thumbnail{{DatastoreId: "ds1", Location: "media/file"}}},
+		{name: "same file as a kept thumbnail", thumbs: []*types.Thumbnail{{DatastoreId: "ds1", Location: "thumbs/kept"}}, keep: kept},
+		{name: "mixed", thumbs: []*types.Thumbnail{
+			{DatastoreId: "ds1", Location: "media/file"},
+			{DatastoreId: "ds2", Location: "thumbs/other"},
+			{DatastoreId: "ds1", Location: "thumbs/kept"},
+		}, keep: kept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := deleteThumbnailFiles(media, tt.thumbs, tt.keep, rcontext.RequestContext{}); err != nil {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
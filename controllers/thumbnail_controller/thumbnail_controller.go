@@ -11,14 +11,17 @@ import (
 	"github.com/disintegration/imaging"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/globals"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/controllers/download_controller"
 	"github.com/turt2live/matrix-media-repo/controllers/quarantine_controller"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/metrics"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/last_access"
 	"github.com/turt2live/matrix-media-repo/thumbnailing"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
@@ -26,7 +29,7 @@ import (
 
 var localCache = cache.New(30*time.Second, 60*time.Second)
 
-func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight int, animated bool, method string, downloadRemote bool, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight int, animated bool, method string, format string, downloadRemote bool, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
 	media, err := download_controller.FindMediaRecord(origin, mediaId, downloadRemote, ctx)
 	if err != nil {
 		return nil, err
@@ -34,48 +37,31 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 
 	mediaContentType := util.FixContentType(media.ContentType)
 
+	usePlaceholder := false
 	if !thumbnailing.IsSupported(mediaContentType) {
 		ctx.Log.Warn("Cannot generate thumbnail for " + mediaContentType + " because it is not supported")
-		return nil, errors.New("cannot generate thumbnail for this media's content type")
-	}
-
-	if !util.ArrayContains(ctx.Config.Thumbnails.Types, mediaContentType) {
+		usePlaceholder = true
+	} else if !util.ArrayContains(ctx.Config.Thumbnails.Types, mediaContentType) {
 		ctx.Log.Warn("Cannot generate thumbnail for " + mediaContentType + " because it is not listed in the config")
+		usePlaceholder = true
+	}
+	if usePlaceholder && !ctx.Config.Thumbnails.Placeholders.Enabled {
 		return nil, errors.New("cannot generate thumbnail for this media's content type")
 	}
 
 	if media.Quarantined {
 		ctx.Log.Warn("Quarantined media accessed")
 
-		if ctx.Config.Quarantine.ReplaceThumbnails {
-			ctx.Log.Info("Replacing thumbnail with a quarantined one")
-
-			img, err := quarantine_controller.GenerateQuarantineThumbnail(desiredWidth, desiredHeight, ctx)
-			if err != nil {
-				return nil, err
-			}
+		return quarantinedThumbnail(media, desiredWidth, desiredHeight, method, ctx)
+	}
 
-			data := &bytes.Buffer{}
-			_ = imaging.Encode(data, img, imaging.PNG)
-			return &types.StreamedThumbnail{
-				Stream: util.BufferToStream(data),
-				Thumbnail: &types.Thumbnail{
-					// We lie about the details to ensure we keep our contract
-					Width:       img.Bounds().Max.X,
-					Height:      img.Bounds().Max.Y,
-					MediaId:     media.MediaId,
-					Origin:      media.Origin,
-					Location:    "",
-					ContentType: "image/png",
-					Animated:    false,
-					Method:      method,
-					CreationTs:  util.NowMillis(),
-					SizeBytes:   int64(data.Len()),
-				},
-			}, nil
+	if usePlaceholder {
+		width, height, method, err := pickThumbnailDimensions(desiredWidth, desiredHeight, method, ctx)
+		if err != nil {
+			return nil, err
 		}
-
-		return nil, common.ErrMediaQuarantined
+		ctx.Log.Info("Returning a placeholder thumbnail")
+		return generatePlaceholderThumbnail(media, mediaContentType, width, height, method, ctx)
 	}
 
 	if animated && ctx.Config.Thumbnails.MaxAnimateSizeBytes > 0 && ctx.Config.Thumbnails.MaxAnimateSizeBytes < media.SizeBytes {
@@ -98,7 +84,40 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		return nil, err
 	}
 
-	cacheKey := fmt.Sprintf("%s/%s?w=%d&h=%d&m=%s&a=%t", media.Origin, media.MediaId, width, height, method, animated)
+	if !thumbnailing.IsAnimationSupported(mediaContentType) && media.Width != nil && media.Height != nil && width >= *media.Width && height >= *media.Height {
+		// We'd only end up returning the original image, so skip decoding it
+		ctx.Log.Info("Requested thumbnail is at least as large as the source image - returning raw image")
+		mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location, media.Encoded)
+		if err != nil {
+			return nil, err
+		}
+		return &types.StreamedThumbnail{
+			Stream: mediaStream,
+			Thumbnail: &types.Thumbnail{
+				Width:       *media.Width,
+				Height:      *media.Height,
+				MediaId:     media.MediaId,
+				Origin:      media.Origin,
+				Location:    media.Location,
+				DatastoreId: media.DatastoreId,
+				ContentType: mediaContentType,
+				Animated:    false,
+				Method:      method,
+				CreationTs:  media.CreationTs,
+				SizeBytes:   media.SizeBytes,
+				Sha256Hash:  media.Sha256Hash,
+				Encoded:     media.Encoded,
+			},
+		}, nil
+	}
+
+	if format != "" && animated {
+		// We only convert static thumbnails
+		format = ""
+	}
+
+	quality := thumbnailQuality(format, ctx)
+	cacheKey := thumbnailCacheKey(media, width, height, method, animated, format, quality)
 
 	v, _, err := globals.DefaultRequestGroup.Do(cacheKey, func() (interface{}, error) {
 		db := storage.GetDatabase().GetThumbnailStore(ctx)
@@ -107,13 +126,15 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		item, found := localCache.Get(cacheKey)
 		if found {
 			thumbnail = item.(*types.Thumbnail)
+			metrics.CacheHits.With(prometheus.Labels{"cache": "thumbnails"}).Inc()
 		} else {
 			ctx.Log.Info("Getting thumbnail record from database")
-			dbThumb, err := db.Get(media.Origin, media.MediaId, width, height, method, animated)
+			dbThumb, err := db.Get(media.Origin, media.MediaId, width, height, method, animated, format, quality)
 			if err != nil {
 				if err == sql.ErrNoRows {
 					ctx.Log.Info("Thumbnail does not exist, attempting to generate it")
-					genThumb, err2 := GetOrGenerateThumbnail(media, width, height, animated, method, ctx)
+					metrics.CacheMisses.With(prometheus.Labels{"cache": "thumbnails"}).Inc()
+					genThumb, err2 := GetOrGenerateThumbnail(media, width, height, animated, method, format, ctx)
 					if err2 != nil {
 						return nil, err2
 					}
@@ -124,6 +145,7 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 				}
 			} else {
 				thumbnail = dbThumb
+				metrics.CacheHits.With(prometheus.Labels{"cache": "thumbnails"}).Inc()
 			}
 		}
 
@@ -132,10 +154,7 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 			return nil, common.ErrMediaNotFound
 		}
 
-		err = storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(thumbnail.Sha256Hash, util.NowMillis())
-		if err != nil {
-			ctx.Log.Warn("Failed to upsert the last access time: ", err)
-		}
+		last_access.Track(thumbnail.Sha256Hash, ctx)
 
 		localCache.Set(cacheKey, thumbnail, cache.DefaultExpiration)
 
@@ -151,7 +170,7 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 		}
 
 		ctx.Log.Info("Reading thumbnail from datastore")
-		mediaStream, err := datastore.DownloadStream(ctx, thumbnail.DatastoreId, thumbnail.Location)
+		mediaStream, err := datastore.DownloadStream(ctx, thumbnail.DatastoreId, thumbnail.Location, thumbnail.Encoded)
 		if err != nil {
 			return nil, err
 		}
@@ -186,9 +205,16 @@ func GetThumbnail(origin string, mediaId string, desiredWidth int, desiredHeight
 	return value, err
 }
 
-func GetOrGenerateThumbnail(media *types.Media, width int, height int, animated bool, method string, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
+// thumbnailCacheKey identifies a thumbnail in the cache. The format is part of the key so that
+// thumbnails converted for one client are never served to another which can't read them.
+func thumbnailCacheKey(media *types.Media, width int, height int, method string, animated bool, format string, quality int) string {
+	return fmt.Sprintf("%s/%s?w=%d&h=%d&m=%s&a=%t&f=%s&q=%d", media.Origin, media.MediaId, width, height, method, animated, format, quality)
+}
+
+func GetOrGenerateThumbnail(media *types.Media, width int, height int, animated bool, method string, format string, ctx rcontext.RequestContext) (*types.Thumbnail, error) {
 	db := storage.GetDatabase().GetThumbnailStore(ctx)
-	thumbnail, err := db.Get(media.Origin, media.MediaId, width, height, method, animated)
+	quality := thumbnailQuality(format, ctx)
+	thumbnail, err := db.Get(media.Origin, media.MediaId, width, height, method, animated, format, quality)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -199,13 +225,22 @@ func GetOrGenerateThumbnail(media *types.Media, width int, height int, animated
 
 	ctx.Log.Info("Generating thumbnail")
 
-	thumbnailChan := getResourceHandler().GenerateThumbnail(media, width, height, method, animated)
+	thumbnailChan := getResourceHandler().GenerateThumbnail(media, width, height, method, animated, format, quality)
 	defer close(thumbnailChan)
 
 	result := <-thumbnailChan
 	return result.thumbnail, result.err
 }
 
+// thumbnailQuality returns the configured encoder quality for thumbnails in the format, which
+// is part of what identifies a thumbnail so that changing it doesn't serve old thumbnails.
+func thumbnailQuality(format string, ctx rcontext.RequestContext) int {
+	if format == "webp" {
+		return ctx.Config.Thumbnails.WebpQuality
+	}
+	return ctx.Config.Thumbnails.JpegQuality
+}
+
 func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod string, ctx rcontext.RequestContext) (int, int, string, error) {
 	if desiredWidth <= 0 {
 		return 0, 0, "", errors.New("width must be positive")
@@ -225,6 +260,11 @@ func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod
 	desiredAspectRatio := float32(desiredWidth) / float32(desiredHeight)
 
 	for _, size := range ctx.Config.Thumbnails.Sizes {
+		// Sizes can be limited to a single method
+		if size.Method != "" && size.Method != desiredMethod {
+			continue
+		}
+
 		largestWidth = util.MaxInt(largestWidth, size.Width)
 		largestHeight = util.MaxInt(largestHeight, size.Height)
 
@@ -244,6 +284,15 @@ func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod
 		}
 	}
 
+	if largestWidth == 0 || largestHeight == 0 {
+		return 0, 0, "", common.ErrInvalidThumbnailSize
+	}
+
+	if ctx.Config.Thumbnails.StrictSizes && !ctx.Config.Thumbnails.DynamicSizing {
+		// We didn't get an exact match above, so reject the request
+		return 0, 0, "", common.ErrInvalidThumbnailSize
+	}
+
 	if ctx.Config.Thumbnails.DynamicSizing {
 		return util.MinInt(largestWidth, desiredWidth), util.MinInt(largestHeight, desiredHeight), desiredMethod, nil
 	}
@@ -266,3 +315,37 @@ func pickThumbnailDimensions(desiredWidth int, desiredHeight int, desiredMethod
 
 	return targetWidth, targetHeight, desiredMethod, nil
 }
+
+// quarantinedThumbnail returns the replacement thumbnail for quarantined media, or ErrMediaQuarantined
+// if it shouldn't be replaced.
+func quarantinedThumbnail(media *types.Media, desiredWidth int, desiredHeight int, method string, ctx rcontext.RequestContext) (*types.StreamedThumbnail, error) {
+	if ctx.Config.Quarantine.ReplaceThumbnails {
+		ctx.Log.Info("Replacing thumbnail with a quarantined one")
+
+		img, err := quarantine_controller.GenerateQuarantineThumbnail(desiredWidth, desiredHeight, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		data := &bytes.Buffer{}
+		_ = imaging.Encode(data, img, imaging.PNG)
+		return &types.StreamedThumbnail{
+			Stream: util.BufferToStream(data),
+			Thumbnail: &types.Thumbnail{
+				// We lie about the details to ensure we keep our contract
+				Width:       img.Bounds().Max.X,
+				Height:      img.Bounds().Max.Y,
+				MediaId:     media.MediaId,
+				Origin:      media.Origin,
+				Location:    "",
+				ContentType: "image/png",
+				Animated:    false,
+				Method:      method,
+				CreationTs:  util.NowMillis(),
+				SizeBytes:   int64(data.Len()),
+			},
+		}, nil
+	}
+
+	return nil, common.ErrMediaQuarantined
+}
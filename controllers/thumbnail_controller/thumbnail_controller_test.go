@@ -0,0 +1,151 @@
+package thumbnail_controller
+
+import (
+	"context"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestThumbnailCacheKey(t *testing.T) {
+	media := &types.Media{Origin: "example.org", MediaId: "abc"}
+
+	original := thumbnailCacheKey(media, 32, 32, "crop", false, "", 0)
+	if original != thumbnailCacheKey(media, 32, 32, "crop", false, "", 0) {
+		t.Error("expected the same thumbnail to have the same key")
+	}
+	if original == thumbnailCacheKey(media, 32, 32, "crop", false, "webp", 0) {
+		t.Error("expected webp thumbnails to be cached separately")
+	}
+	if original == thumbnailCacheKey(media, 32, 32, "crop", true, "", 0) {
+		t.Error("expected animated thumbnails to be cached separately")
+	}
+	if original == thumbnailCacheKey(media, 64, 32, "crop", false, "", 0) {
+		t.Error("expected different sizes to be cached separately")
+	}
+	if original == thumbnailCacheKey(media, 32, 32, "crop", false, "", 50) {
+		t.Error("expected different qualities to be cached separately")
+	}
+}
+
+func TestQuarantinedThumbnail(t *testing.T) {
+	media := &types.Media{Origin: "example.org", MediaId: "abc", ContentType: "image/png", Quarantined: true}
+
+	ctx := testContext()
+	ctx.Config.Quarantine.ReplaceThumbnails = false
+	thumb, err := quarantinedThumbnail(media, 96, 64, "scale", ctx)
+	if err != common.ErrMediaQuarantined || thumb != nil {
+		t.Errorf("got %v, expected ErrMediaQuarantined", err)
+	}
+
+	ctx.Config.Quarantine.ReplaceThumbnails = true
+	thumb, err = quarantinedThumbnail(media, 96, 64, "scale", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thumb.Stream.Close()
+	if thumb.Thumbnail.ContentType != "image/png" || thumb.Thumbnail.Location != "" {
+		t.Errorf("got %s at %q, expected the quarantine image", thumb.Thumbnail.ContentType, thumb.Thumbnail.Location)
+	}
+	img, err := png.Decode(thumb.Stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 96 || img.Bounds().Dy() != 64 {
+		t.Errorf("got %v, expected a 96x64 image", img.Bounds())
+	}
+}
+
+func TestPickThumbnailDimensions(t *testing.T) {
+	sizes := []config.ThumbnailSize{
+		{Width: 32, Height: 32},
+		{Width: 96, Height: 96},
+		{Width: 320, Height: 240, Method: "scale"},
+		{Width: 640, Height: 480, Method: "scale"},
+	}
+
+	tests := []struct {
+		name        string
+		sizes       []config.ThumbnailSize
+		strict      bool
+		width       int
+		height      int
+		method      string
+		wantWidth   int
+		wantHeight  int
+		wantErr     bool
+		wantInvalid bool
+	}{
+		{name: "exact size", sizes: sizes, width: 96, height: 96, method: "crop", wantWidth: 96, wantHeight: 96},
+		{name: "next size up", sizes: sizes, width: 300, height: 200, method: "scale", wantWidth: 320, wantHeight: 240},
+		{name: "sizes for another method are skipped", sizes: sizes, width: 300, height: 200, method: "crop", wantWidth: 96, wantHeight: 64},
+		{name: "larger than every size", sizes: sizes, width: 1000, height: 1000, method: "scale", wantWidth: 640, wantHeight: 480},
+		{name: "strict exact size", sizes: sizes, strict: true, width: 32, height: 32, method: "crop", wantWidth: 32, wantHeight: 32},
+		{name: "strict other size", sizes: sizes, strict: true, width: 300, height: 200, method: "scale", wantErr: true, wantInvalid: true},
+		{name: "no sizes for the method", sizes: sizes[2:], width: 32, height: 32, method: "crop", wantErr: true, wantInvalid: true},
+		{name: "invalid width", sizes: sizes, width: 0, height: 32, method: "crop", wantErr: true},
+		{name: "invalid method", sizes: sizes, width: 32, height: 32, method: "stretch", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.Sizes = tt.sizes
+			ctx.Config.Thumbnails.StrictSizes = tt.strict
+
+			width, height, method, err := pickThumbnailDimensions(tt.width, tt.height, tt.method, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected an error: %t", err, tt.wantErr)
+			}
+			if tt.wantInvalid && err != common.ErrInvalidThumbnailSize {
+				t.Errorf("got error %v, expected %v", err, common.ErrInvalidThumbnailSize)
+			}
+			if err != nil {
+				return
+			}
+			if width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("got %dx%d, expected %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+			if method != tt.method {
+				t.Errorf("got method %s, expected %s", method, tt.method)
+			}
+		})
+	}
+}
+
+func TestThumbnailQuality(t *testing.T) {
+	ctx := rcontext.RequestContext{}
+	ctx.Config.Thumbnails.JpegQuality = 85
+	ctx.Config.Thumbnails.WebpQuality = 70
+
+	tests := []struct {
+		format   string
+		expected int
+	}{
+		{format: "", expected: 85},
+		{format: "jpeg", expected: 85},
+		{format: "png", expected: 85},
+		{format: "webp", expected: 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if quality := thumbnailQuality(tt.format, ctx); quality != tt.expected {
+				t.Errorf("got quality %d for format %q, expected %d", quality, tt.format, tt.expected)
+			}
+		})
+	}
+}
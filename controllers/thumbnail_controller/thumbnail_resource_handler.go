@@ -1,12 +1,12 @@
 package thumbnail_controller
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io/ioutil"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -17,9 +17,12 @@ import (
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
 	"github.com/turt2live/matrix-media-repo/thumbnailing"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/resource_handler"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
 
 type thumbnailResourceHandler struct {
@@ -32,6 +35,8 @@ type thumbnailRequest struct {
 	height   int
 	method   string
 	animated bool
+	format   string
+	quality  int
 }
 
 type thumbnailResponse struct {
@@ -46,6 +51,7 @@ type GeneratedThumbnail struct {
 	SizeBytes         int64
 	Animated          bool
 	Sha256Hash        string
+	Encoded           bool
 }
 
 var resHandlerInstance *thumbnailResourceHandler
@@ -78,6 +84,8 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 		"worker_height":    info.height,
 		"worker_method":    info.method,
 		"worker_animated":  info.animated,
+		"worker_format":    info.format,
+		"worker_quality":   info.quality,
 	})
 
 	resp = &thumbnailResponse{}
@@ -90,14 +98,21 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 		}
 	}()
 
+	// Identical requests have already been combined into this one, so they share the slot
+	release, ok := acquireGenerationSlot()
+	if !ok {
+		ctx.Log.Warn("Timed out waiting for a free thumbnail generation slot")
+		return &thumbnailResponse{err: common.ErrThumbnailQueueFull}
+	}
+	defer release()
+
 	ctx.Log.Info("Processing thumbnail request")
 
-	generated, err := GenerateThumbnail(info.media, info.width, info.height, info.method, info.animated, ctx)
+	generated, err := GenerateThumbnail(info.media, info.width, info.height, info.method, info.animated, info.format, info.quality, ctx)
 	if err != nil {
 		return &thumbnailResponse{err: err}
 	}
 
-
 	if info.animated != generated.Animated {
 		ctx.Log.Warn("Animation state changed to ", generated.Animated)
 
@@ -118,6 +133,9 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 		Location:    generated.DatastoreLocation,
 		SizeBytes:   generated.SizeBytes,
 		Sha256Hash:  generated.Sha256Hash,
+		Format:      info.format,
+		Encoded:     generated.Encoded,
+		Quality:     info.quality,
 	}
 
 	db := storage.GetDatabase().GetThumbnailStore(ctx)
@@ -132,16 +150,18 @@ func thumbnailWorkFn(request *resource_handler.WorkRequest) (resp *thumbnailResp
 	return resp
 }
 
-func (h *thumbnailResourceHandler) GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool) chan *thumbnailResponse {
+func (h *thumbnailResourceHandler) GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool, format string, quality int) chan *thumbnailResponse {
 	resultChan := make(chan *thumbnailResponse)
 	go func() {
-		reqId := fmt.Sprintf("thumbnail_%s_%s_%d_%d_%s_%t", media.Origin, media.MediaId, width, height, method, animated)
+		reqId := fmt.Sprintf("thumbnail_%s_%s_%d_%d_%s_%t_%s_%d", media.Origin, media.MediaId, width, height, method, animated, format, quality)
 		c := h.resourceHandler.GetResource(reqId, &thumbnailRequest{
 			media:    media,
 			width:    width,
 			height:   height,
 			method:   method,
 			animated: animated,
+			format:   format,
+			quality:  quality,
 		})
 		defer close(c)
 		result := <-c
@@ -150,11 +170,24 @@ func (h *thumbnailResourceHandler) GenerateThumbnail(media *types.Media, width i
 	return resultChan
 }
 
-func GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*GeneratedThumbnail, error) {
+// GenerateThumbnail generates and stores a thumbnail of the media. The quality is used by the
+// encoder for the format, as given by thumbnailQuality.
+func GenerateThumbnail(media *types.Media, width int, height int, method string, animated bool, format string, quality int, ctx rcontext.RequestContext) (*GeneratedThumbnail, error) {
 	allowAnimated := ctx.Config.Thumbnails.AllowAnimated
 	animated = animated && allowAnimated
 
-	mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location)
+	// WebP thumbnails are converted from what the generators produce, which uses the JPEG quality
+	jpegQuality := ctx.Config.Thumbnails.JpegQuality
+	if format != "webp" {
+		jpegQuality = quality
+	}
+
+	start := time.Now()
+	defer func() {
+		metrics.ThumbnailDuration.With(prometheus.Labels{"animated": strconv.FormatBool(animated)}).Observe(time.Since(start).Seconds())
+	}()
+
+	mediaStream, err := datastore.DownloadStream(ctx, media.DatastoreId, media.Location, media.Encoded)
 	if err != nil {
 		ctx.Log.Error("Error getting file: ", err)
 		return nil, err
@@ -162,7 +195,12 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 
 	mediaContentType := util.FixContentType(media.ContentType)
 
-	thumbImg, err := thumbnailing.GenerateThumbnail(mediaStream, mediaContentType, width, height, method, animated, ctx)
+	var thumbImg *m.Thumbnail
+	if method == TranscodeMethod {
+		thumbImg, err = transcodeHeif(mediaStream, ctx)
+	} else {
+		thumbImg, err = thumbnailing.GenerateThumbnail(mediaStream, mediaContentType, width, height, method, animated, jpegQuality, ctx)
+	}
 	if err != nil {
 		ctx.Log.Error("Error generating thumbnail: ", err)
 		return nil, err
@@ -187,6 +225,7 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 		thumb.DatastoreLocation = media.Location
 		thumb.SizeBytes = media.SizeBytes
 		thumb.Sha256Hash = media.Sha256Hash
+		thumb.Encoded = media.Encoded
 		ctx.Log.Warn("Image too small, returning raw image")
 		metric.Inc()
 		return thumb, nil
@@ -198,11 +237,23 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 		return nil, err
 	}
 
-	ds, err := datastore.PickDatastore(common.KindThumbnails, ctx)
+	if format == "webp" && !thumbImg.Animated && thumbImg.ContentType != "image/webp" {
+		webpBytes, err := u.EncodeWebp(ctx, b, quality)
+		if err != nil {
+			// Not fatal - we'll just serve the thumbnail as it was generated
+			ctx.Log.Warn("Error converting thumbnail to webp: ", err)
+			sentry.CaptureException(err)
+		} else {
+			b = webpBytes
+			thumbImg.ContentType = "image/webp"
+		}
+	}
+
+	ds, err := datastore.PickThumbnailDatastore(ctx)
 	if err != nil {
 		return nil, err
 	}
-	info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewBuffer(b)), int64(len(b)), ctx)
+	info, err := ds.UploadFile(util_byte_seeker.NewByteSeeker(b), int64(len(b)), ctx)
 	if err != nil {
 		ctx.Log.Error("Unexpected error saving thumbnail: " + err.Error())
 		return nil, err
@@ -214,6 +265,7 @@ func GenerateThumbnail(media *types.Media, width int, height int, method string,
 	thumb.ContentType = thumbImg.ContentType
 	thumb.SizeBytes = info.SizeBytes
 	thumb.Sha256Hash = info.Sha256Hash
+	thumb.Encoded = info.Encoded
 
 	metric.Inc()
 	return thumb, nil
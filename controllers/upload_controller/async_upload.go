@@ -0,0 +1,289 @@
+package upload_controller
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"github.com/turt2live/matrix-media-repo/util/resource_handler"
+)
+
+const (
+	UploadJobPending  = "pending"
+	UploadJobComplete = "complete"
+	UploadJobFailed   = "failed"
+)
+
+type UploadJob struct {
+	ID        string
+	UserId    string
+	Status    string
+	MxcUri    string
+	SizeBytes int64
+	Error     error
+
+	lock sync.RWMutex
+}
+
+type asyncUploadRequest struct {
+	job            *UploadJob
+	tempFile       string
+	sanitized      bool
+	contentType    string
+	filename       string
+	origin         string
+	mediaId        string
+	idempotencyKey string
+	ctx            rcontext.RequestContext
+}
+
+var uploadJobs = cache.New(24*time.Hour, 1*time.Hour)
+
+// storeAsyncUpload is swapped out by tests
+var storeAsyncUpload = storeUpload
+var asyncHandler *resource_handler.ResourceHandler
+var asyncHandlerLock = &sync.Once{}
+
+func getAsyncHandler() *resource_handler.ResourceHandler {
+	if asyncHandler == nil {
+		asyncHandlerLock.Do(func() {
+			handler, err := resource_handler.New(config.Get().Uploads.Async.NumWorkers, func(r *resource_handler.WorkRequest) interface{} {
+				asyncUploadWorkFn(r.Metadata.(*asyncUploadRequest))
+				return nil
+			})
+			if err != nil {
+				sentry.CaptureException(err)
+				panic(err)
+			}
+
+			asyncHandler = handler
+		})
+	}
+
+	return asyncHandler
+}
+
+// Snapshot returns the status, MXC URI, and error of the job at the time of calling.
+func (j *UploadJob) Snapshot() (string, string, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.Status, j.MxcUri, j.Error
+}
+
+func (j *UploadJob) finish(media *types.Media, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err != nil {
+		j.Status = UploadJobFailed
+		j.Error = err
+	} else {
+		j.Status = UploadJobComplete
+		j.MxcUri = media.MxcUri()
+	}
+}
+
+// UploadMediaAsync reads the upload and returns a job while the media is stored in the background. The
+// MXC URI on the job is populated immediately, though the media will not be available until the job
+// is complete. The idempotency key, if any, is recorded once the media is stored.
+func UploadMediaAsync(contents io.ReadCloser, contentType string, filename string, userId string, origin string, idempotencyKey string, ctx rcontext.RequestContext) (*UploadJob, error) {
+	defer cleanup.DumpAndCloseStream(contents)
+
+	ctx = withUploadPolicy(userId, ctx)
+	contentType = util.NormalizeContentType(contentType, ctx.Config.Uploads.ContentTypeParameters)
+
+	filename = util.SanitizeFilename(filename, ctx.Config.Uploads.MaxFilenameLength)
+
+	dataBytes, sanitized, err := readUpload(contents, contentType, filename, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return queueUpload(dataBytes, sanitized, contentType, filename, userId, origin, mediaId, idempotencyKey, ctx)
+}
+
+func queueUpload(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, idempotencyKey string, ctx rcontext.RequestContext) (*UploadJob, error) {
+	jobId, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &UploadJob{
+		ID:        jobId,
+		UserId:    userId,
+		Status:    UploadJobPending,
+		MxcUri:    (&types.Media{Origin: origin, MediaId: mediaId}).MxcUri(),
+		SizeBytes: int64(len(dataBytes)),
+	}
+
+	// Queued uploads are kept on disk rather than in memory until a worker picks them up
+	tempFile, err := spoolUpload(dataBytes, ctx)
+	if err != nil {
+		return nil, err
+	}
+	uploadJobs.Set(jobId, job, cache.DefaultExpiration)
+
+	req := &asyncUploadRequest{
+		job:            job,
+		tempFile:       tempFile,
+		sanitized:      sanitized,
+		contentType:    contentType,
+		filename:       filename,
+		origin:         origin,
+		mediaId:        mediaId,
+		idempotencyKey: idempotencyKey,
+		ctx:            ctx.Detached().LogWithFields(logrus.Fields{"uploadJobId": jobId}),
+	}
+	go func() {
+		// We don't care about the result: the job is updated by the worker
+		<-getAsyncHandler().GetResource("async_upload:"+jobId, req)
+	}()
+
+	ctx.Log.Info("Queued upload job ", jobId)
+	return job, nil
+}
+
+// RemoveOrphanedAsyncUploads deletes uploads spooled to the async temp paths by a previous run of
+// the media repo. Upload jobs are only tracked in memory, so nothing would pick these up again.
+func RemoveOrphanedAsyncUploads() {
+	tempPaths := []string{config.Get().Uploads.Async.TempPath}
+	for _, domain := range config.AllDomains() {
+		tempPaths = append(tempPaths, domain.Uploads.Async.TempPath)
+	}
+	removed := removeSpooledUploads(tempPaths)
+	if removed > 0 {
+		logrus.Warnf("Removed %d asynchronous uploads which were not stored before the media repo last stopped", removed)
+	}
+}
+
+// removeSpooledUploads deletes the files spoolUpload created in each of the temp paths, returning
+// how many were deleted.
+func removeSpooledUploads(tempPaths []string) int {
+	removed := 0
+	seen := make(map[string]bool)
+	for _, tempPath := range tempPaths {
+		if tempPath == "" {
+			tempPath = os.TempDir()
+		}
+		if seen[tempPath] {
+			continue
+		}
+		seen[tempPath] = true
+
+		files, err := filepath.Glob(filepath.Join(tempPath, "mr-async-*"))
+		if err != nil {
+			logrus.Warn("Failed to list asynchronous uploads in ", tempPath, ": ", err)
+			continue
+		}
+		for _, f := range files {
+			if err = os.Remove(f); err != nil {
+				logrus.Warn("Failed to remove asynchronous upload ", f, ": ", err)
+				continue
+			}
+			removed++
+		}
+	}
+	return removed
+}
+
+// spoolUpload writes the upload to a new file in the async temp path, returning the file's path.
+func spoolUpload(dataBytes []byte, ctx rcontext.RequestContext) (string, error) {
+	tempPath := ctx.Config.Uploads.Async.TempPath
+	if tempPath != "" {
+		err := os.MkdirAll(tempPath, 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f, err := ioutil.TempFile(tempPath, "mr-async-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(dataBytes)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func asyncUploadWorkFn(req *asyncUploadRequest) {
+	defer func() {
+		if err := recover(); err != nil {
+			req.ctx.Log.Error("Caught panic: ", err)
+			sentry.CurrentHub().Recover(err)
+			releaseAsyncIdempotencyKey(req)
+			req.job.finish(nil, util.PanicToError(err))
+		}
+	}()
+
+	req.ctx.Log.Info("Processing upload job")
+	dataBytes, err := ioutil.ReadFile(req.tempFile)
+	if removeErr := os.Remove(req.tempFile); removeErr != nil {
+		req.ctx.Log.Warn("Failed to remove temporary file for upload job: ", removeErr)
+	}
+	if err != nil {
+		req.ctx.Log.Error("Upload job failed: ", err)
+		releaseAsyncIdempotencyKey(req)
+		req.job.finish(nil, err)
+		return
+	}
+	media, err := storeAsyncUpload(dataBytes, req.sanitized, req.contentType, req.filename, req.job.UserId, req.origin, req.mediaId, true, req.ctx)
+	if err != nil {
+		req.ctx.Log.Error("Upload job failed: ", err)
+		releaseAsyncIdempotencyKey(req)
+	} else {
+		req.ctx.Log.Info("Upload job complete")
+
+		// Recorded before the job finishes, so retries after the client sees the result get the same media
+		recordErr := RecordIdempotentUpload(req.job.UserId, req.idempotencyKey, media, req.ctx)
+		if recordErr != nil {
+			// The upload itself succeeded, so only retries are affected
+			req.ctx.Log.Warn("Failed to record idempotency key: " + recordErr.Error())
+			sentry.CaptureException(recordErr)
+		}
+	}
+	req.job.finish(media, err)
+}
+
+// releaseAsyncIdempotencyKey gives up the job's claim on its idempotency key, so the upload can be
+// retried.
+func releaseAsyncIdempotencyKey(req *asyncUploadRequest) {
+	if err := ReleaseIdempotencyKey(req.job.UserId, req.idempotencyKey, req.ctx); err != nil {
+		req.ctx.Log.Warn("Failed to release idempotency key: " + err.Error())
+		sentry.CaptureException(err)
+	}
+}
+
+// GetUploadJob returns the job with the given ID, or nil if the job does not exist or belongs to a different user.
+func GetUploadJob(jobId string, userId string) *UploadJob {
+	v, found := uploadJobs.Get(jobId)
+	if !found {
+		return nil
+	}
+	job := v.(*UploadJob)
+	if job.UserId != userId {
+		return nil
+	}
+	return job
+}
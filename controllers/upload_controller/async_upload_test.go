@@ -0,0 +1,241 @@
+package upload_controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/scanners"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util/resource_handler"
+)
+
+// slowScanner holds on to every scan until it is released.
+type slowScanner struct {
+	clean   bool
+	release chan bool
+}
+
+func (s *slowScanner) Scan(path string) (bool, string, error) {
+	<-s.release
+	return s.clean, "Eicar-Signature", nil
+}
+
+func waitForJob(t *testing.T, job *UploadJob) (string, string, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, mxc, err := job.Snapshot()
+		if status != UploadJobPending {
+			return status, mxc, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the upload job")
+	return "", "", nil
+}
+
+// useTestAsyncHandler sets up the async upload workers without reading the worker count from the config.
+func useTestAsyncHandler(t *testing.T) {
+	if asyncHandler == nil {
+		handler, err := resource_handler.New(2, func(r *resource_handler.WorkRequest) interface{} {
+			asyncUploadWorkFn(r.Metadata.(*asyncUploadRequest))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		asyncHandler = handler
+	}
+}
+
+func TestUploadJobStatus(t *testing.T) {
+	useTestAsyncHandler(t)
+
+	tests := []struct {
+		name       string
+		clean      bool
+		wantStatus string
+		wantErr    error
+		wantFiles  int
+	}{
+		{name: "clean upload completes", clean: true, wantStatus: UploadJobComplete, wantFiles: 1},
+		{name: "infected upload fails", clean: false, wantStatus: UploadJobFailed, wantErr: common.ErrMediaInfected, wantFiles: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.Async.TempPath = t.TempDir()
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+			scanner := &slowScanner{clean: tt.clean, release: make(chan bool)}
+			defer func(original func(config.ScannerConfig) (scanners.Scanner, error)) {
+				getScanner = original
+			}(getScanner)
+			getScanner = func(config.ScannerConfig) (scanners.Scanner, error) {
+				return scanner, nil
+			}
+
+			// Store the upload the same way StoreDirect does, minus the database
+			defer func(original func([]byte, bool, string, string, string, string, string, bool, rcontext.RequestContext) (*types.Media, error)) {
+				storeAsyncUpload = original
+			}(storeAsyncUpload)
+			storeAsyncUpload = func(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, filterUserDuplicates bool, ctx rcontext.RequestContext) (*types.Media, error) {
+				info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(dataBytes)), int64(len(dataBytes)), ctx)
+				if err != nil {
+					return nil, err
+				}
+				err = rejectInfected(ds, info.Location, dataBytes, common.KindLocalMedia, ctx)
+				if err != nil {
+					return nil, err
+				}
+				return &types.Media{Origin: origin, MediaId: mediaId, UserId: userId, Location: info.Location}, nil
+			}
+
+			job, err := queueUpload([]byte("hello world"), false, "text/plain", "test.txt", "@alice:example.org", "example.org", "abc123", "", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if GetUploadJob(job.ID, "@alice:example.org") != job {
+				t.Fatal("expected to find the job")
+			}
+			if GetUploadJob(job.ID, "@bob:example.org") != nil {
+				t.Error("expected the job to be hidden from other users")
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			status, mxc, err := job.Snapshot()
+			if status != UploadJobPending || err != nil {
+				t.Errorf("got (%s, %v) while scanning, expected a pending job", status, err)
+			}
+			if mxc != "mxc://example.org/abc123" {
+				t.Errorf("got %s, expected the MXC URI to be known up front", mxc)
+			}
+
+			close(scanner.release)
+			status, mxc, err = waitForJob(t, job)
+			if status != tt.wantStatus || err != tt.wantErr {
+				t.Errorf("got (%s, %v), expected (%s, %v)", status, err, tt.wantStatus, tt.wantErr)
+			}
+			if tt.wantErr == nil && mxc != "mxc://example.org/abc123" {
+				t.Errorf("got %s, expected mxc://example.org/abc123", mxc)
+			}
+			if n := countFiles(t, ds.Uri); n != tt.wantFiles {
+				t.Errorf("got %d files in the datastore, expected %d", n, tt.wantFiles)
+			}
+			if n := countFiles(t, ctx.Config.Uploads.Async.TempPath); n != 0 {
+				t.Errorf("got %d files left in the temp path, expected 0", n)
+			}
+		})
+	}
+}
+
+func TestSpoolUpload(t *testing.T) {
+	ctx := testContext()
+	ctx.Config.Uploads.Async.TempPath = path.Join(t.TempDir(), "async")
+	contents := []byte("hello world")
+
+	tempFile, err := spoolUpload(contents, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := filepath.Dir(tempFile); dir != ctx.Config.Uploads.Async.TempPath {
+		t.Errorf("got the file in %s, expected %s", dir, ctx.Config.Uploads.Async.TempPath)
+	}
+	b, err := ioutil.ReadFile(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Errorf("got %q, expected %q", b, contents)
+	}
+}
+
+func TestRemoveSpooledUploads(t *testing.T) {
+	ctx := testContext()
+	ctx.Config.Uploads.Async.TempPath = path.Join(t.TempDir(), "async")
+	for i := 0; i < 2; i++ {
+		if _, err := spoolUpload([]byte("hello world"), ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := path.Join(ctx.Config.Uploads.Async.TempPath, "other.txt")
+	if err := ioutil.WriteFile(other, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths shared by several domains are only swept once, and missing paths are skipped
+	tempPaths := []string{ctx.Config.Uploads.Async.TempPath, ctx.Config.Uploads.Async.TempPath, path.Join(t.TempDir(), "missing")}
+	if removed := removeSpooledUploads(tempPaths); removed != 2 {
+		t.Errorf("got %d removed uploads, expected 2", removed)
+	}
+	if n := countFiles(t, ctx.Config.Uploads.Async.TempPath); n != 1 {
+		t.Errorf("got %d files left in the temp path, expected only the unrelated file", n)
+	}
+}
+
+func TestUploadJobRecordsIdempotencyKey(t *testing.T) {
+	useTestAsyncHandler(t)
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus string
+		wantMedia  bool
+	}{
+		{name: "completed upload", wantStatus: UploadJobComplete, wantMedia: true},
+		{name: "failed upload", err: common.ErrMediaInfected, wantStatus: UploadJobFailed, wantMedia: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.Async.TempPath = t.TempDir()
+			ctx.Config.Uploads.IdempotencyKeys.Enabled = true
+			ctx.Config.Uploads.IdempotencyKeys.ExpireAfterMinutes = 60
+
+			media := map[string]*types.Media{}
+			useTestIdempotencyKeys(t, media)
+
+			defer func(original func([]byte, bool, string, string, string, string, string, bool, rcontext.RequestContext) (*types.Media, error)) {
+				storeAsyncUpload = original
+			}(storeAsyncUpload)
+			storeAsyncUpload = func(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, filterUserDuplicates bool, ctx rcontext.RequestContext) (*types.Media, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				m := &types.Media{Origin: origin, MediaId: mediaId, UserId: userId}
+				media[origin+"/"+mediaId] = m
+				return m, nil
+			}
+
+			if _, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx); err != nil {
+				t.Fatal(err)
+			}
+			job, err := queueUpload([]byte("hello world"), false, "text/plain", "test.txt", "@alice:example.org", "example.org", "abc123", "retry-1", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, _, _ := waitForJob(t, job); status != tt.wantStatus {
+				t.Fatalf("got %s, expected %s", status, tt.wantStatus)
+			}
+
+			// Failed uploads give up the key, so the retry can upload again
+			existing, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantMedia && (existing == nil || existing.MxcUri() != "mxc://example.org/abc123") {
+				t.Errorf("got %v, expected the retry to find mxc://example.org/abc123", existing)
+			}
+			if !tt.wantMedia && existing != nil {
+				t.Errorf("got %s, expected the retry to find nothing", existing.MxcUri())
+			}
+		})
+	}
+}
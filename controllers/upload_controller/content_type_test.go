@@ -0,0 +1,62 @@
+package upload_controller
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestDetectContentTypeFallback(t *testing.T) {
+	unknown := []byte{0x00, 0x01, 0x02, 0x03}
+	text := []byte("hello world")
+
+	tests := []struct {
+		name     string
+		b        []byte
+		fallback string
+		expected string
+	}{
+		{name: "unknown without fallback", b: unknown, fallback: "", expected: "application/octet-stream"},
+		{name: "unknown with fallback", b: unknown, fallback: "application/x-unknown", expected: "application/x-unknown"},
+		{name: "known with fallback", b: text, fallback: "application/x-unknown", expected: "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MimeDetection = util.MimeDetectionGo
+			ctx.Config.Uploads.UnknownTypeFallback = tt.fallback
+			if got := detectContentType(tt.b, ctx); got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadUploadDeniesFallbackType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		deniedTypes []string
+		expectedErr error
+	}{
+		{name: "unknown upload", contents: "\x00\x01\x02\x03", deniedTypes: []string{"application/x-unknown"}, expectedErr: common.ErrMediaTypeDenied},
+		{name: "known upload", contents: "hello world", deniedTypes: []string{"application/x-unknown"}},
+		{name: "fallback allowed", contents: "\x00\x01\x02\x03", deniedTypes: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MimeDetection = util.MimeDetectionGo
+			ctx.Config.Uploads.UnknownTypeFallback = "application/x-unknown"
+			ctx.Config.Uploads.DeniedTypes = tt.deniedTypes
+
+			_, _, err := readUpload(ioutil.NopCloser(strings.NewReader(tt.contents)), "application/octet-stream", "", ctx)
+			if err != tt.expectedErr {
+				t.Errorf("got error %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package upload_controller
+
+import (
+	"sync"
+	"time"
+)
+
+// How long an upload will wait on another upload of the same content before giving up on deduplicating
+const hashLockTimeout = 30 * time.Second
+
+var hashLocksMu = &sync.Mutex{}
+var hashLocks = make(map[string]chan struct{})
+
+// lockHash waits for any other in-flight upload of the same hash to finish, then claims the hash
+// until the returned function is called. If the wait exceeds the timeout, the returned function
+// is a no-op and false is returned so the caller can carry on without the lock.
+func lockHash(sha256hash string, timeout time.Duration) (func(), bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		hashLocksMu.Lock()
+		ch, held := hashLocks[sha256hash]
+		if !held {
+			ch = make(chan struct{})
+			hashLocks[sha256hash] = ch
+			hashLocksMu.Unlock()
+			return func() {
+				hashLocksMu.Lock()
+				delete(hashLocks, sha256hash)
+				close(ch)
+				hashLocksMu.Unlock()
+			}, true
+		}
+		hashLocksMu.Unlock()
+
+		select {
+		case <-ch:
+			// Released - try to claim it for ourselves
+		case <-timer.C:
+			return func() {}, false
+		}
+	}
+}
+
+// LockHash claims the hash like uploads do, so that they don't deduplicate against media whose
+// file is being changed. False is returned if the hash couldn't be claimed in time.
+func LockHash(sha256hash string) (func(), bool) {
+	return lockHash(sha256hash, hashLockTimeout)
+}
@@ -0,0 +1,160 @@
+package upload_controller
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestLockHash(t *testing.T) {
+	tests := []struct {
+		name        string
+		heldFor     time.Duration // how long another upload holds the hash, or zero for not at all
+		timeout     time.Duration
+		wantLocked  bool
+		wantWaitMin time.Duration
+	}{
+		{name: "free hash", heldFor: 0, timeout: time.Second, wantLocked: true},
+		{name: "released in time", heldFor: 50 * time.Millisecond, timeout: time.Second, wantLocked: true, wantWaitMin: 50 * time.Millisecond},
+		{name: "held past the timeout", heldFor: time.Second, timeout: 50 * time.Millisecond, wantLocked: false, wantWaitMin: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := "hash-lock-test-" + tt.name
+			if tt.heldFor > 0 {
+				unlockOther, ok := lockHash(hash, time.Second)
+				if !ok {
+					t.Fatal("unable to claim the hash for the other upload")
+				}
+				timer := time.AfterFunc(tt.heldFor, unlockOther)
+				defer func() {
+					if timer.Stop() {
+						unlockOther()
+					}
+				}()
+			}
+
+			start := time.Now()
+			unlock, locked := lockHash(hash, tt.timeout)
+			waited := time.Since(start)
+			unlock()
+
+			if locked != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", locked, tt.wantLocked)
+			}
+			if waited < tt.wantWaitMin {
+				t.Errorf("waited %s, want at least %s", waited, tt.wantWaitMin)
+			}
+		})
+	}
+}
+
+func TestLockHashReleasesForOthers(t *testing.T) {
+	unlock, ok := lockHash("hash-lock-test-release", time.Second)
+	if !ok {
+		t.Fatal("unable to claim the hash")
+	}
+	unlock()
+
+	unlock, ok = lockHash("hash-lock-test-release", 10*time.Millisecond)
+	defer unlock()
+	if !ok {
+		t.Error("hash was not released by the unlock function")
+	}
+}
+
+func TestStoreDirectConcurrentUploads(t *testing.T) {
+	const uploads = 8
+	contents := []byte("the same file, uploaded by everyone at once")
+
+	ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+	defer func(original func(string, int64, string, string, rcontext.RequestContext) (*datastore.DatastoreRef, error)) {
+		selectDatastore = original
+	}(selectDatastore)
+	selectDatastore = func(forKind string, size int64, contentType string, origin string, ctx rcontext.RequestContext) (*datastore.DatastoreRef, error) {
+		return ds, nil
+	}
+	defer func(original func(string, rcontext.RequestContext) (bool, error)) {
+		isHashBlocked = original
+	}(isHashBlocked)
+	isHashBlocked = func(sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+
+	// An in-memory media table
+	var recordsLock sync.Mutex
+	var records []*types.Media
+	defer func(original func(string, rcontext.RequestContext) ([]*types.Media, error)) {
+		getMediaByHash = original
+	}(getMediaByHash)
+	getMediaByHash = func(sha256Hash string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+		recordsLock.Lock()
+		found := make([]*types.Media, 0)
+		for _, r := range records {
+			if r.Sha256Hash == sha256Hash {
+				found = append(found, r.Clone())
+			}
+		}
+		recordsLock.Unlock()
+
+		// Take as long as a database might, so uploads without the hash lock would all miss each other
+		time.Sleep(10 * time.Millisecond)
+		return found, nil
+	}
+	defer func(original func(*types.Media, rcontext.RequestContext) error) {
+		insertMediaRecord = original
+	}(insertMediaRecord)
+	insertMediaRecord = func(media *types.Media, ctx rcontext.RequestContext) error {
+		recordsLock.Lock()
+		defer recordsLock.Unlock()
+		records = append(records, media.Clone())
+		return nil
+	}
+
+	// The config is normally loaded at startup rather than by the first upload
+	config.Get()
+
+	start := make(chan struct{})
+	errs := make(chan error, uploads)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			userId := fmt.Sprintf("@user%d:example.org", i)
+			mediaId := fmt.Sprintf("media%d", i)
+			_, err := StoreDirect(nil, ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", "same.txt", userId, "example.org", mediaId, common.KindLocalMedia, testContext(), true)
+			errs <- err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := countFiles(t, ds.Uri); n != 1 {
+		t.Errorf("got %d files in the datastore, expected 1", n)
+	}
+	if len(records) != uploads {
+		t.Fatalf("got %d media records, expected %d", len(records), uploads)
+	}
+	for _, r := range records {
+		if r.DatastoreId != records[0].DatastoreId || r.Location != records[0].Location {
+			t.Errorf("got %s stored at %s/%s, expected %s/%s", r.MediaId, r.DatastoreId, r.Location, records[0].DatastoreId, records[0].Location)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Keys are chosen by clients, so don't let them store arbitrarily large values
+const maxIdempotencyKeyLength = 255
+
+// How long an upload holds its idempotency key while the upload is being stored. Retries are told the
+// upload is in progress until then, after which they can take the key over in case the upload was
+// lost, such as by a restart.
+const idempotencyClaimTime = 1 * time.Hour
+
+// getIdempotencyKey is swapped out by tests
+var getIdempotencyKey = func(userId string, key string, ctx rcontext.RequestContext) (string, string, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).GetIdempotencyKey(userId, key)
+}
+
+// setIdempotencyKey is swapped out by tests
+var setIdempotencyKey = func(userId string, key string, origin string, mediaId string, expiresTs int64, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMetadataStore(ctx).SetIdempotencyKey(userId, key, origin, mediaId, expiresTs)
+}
+
+// claimIdempotencyKey is swapped out by tests
+var claimIdempotencyKey = func(userId string, key string, expiresTs int64, ctx rcontext.RequestContext) (bool, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).ClaimIdempotencyKey(userId, key, expiresTs)
+}
+
+// reclaimIdempotencyKey is swapped out by tests
+var reclaimIdempotencyKey = func(userId string, key string, origin string, mediaId string, expiresTs int64, ctx rcontext.RequestContext) (bool, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).ReclaimIdempotencyKey(userId, key, origin, mediaId, expiresTs)
+}
+
+// releaseIdempotencyKey is swapped out by tests
+var releaseIdempotencyKey = func(userId string, key string, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMetadataStore(ctx).DeletePendingIdempotencyKey(userId, key)
+}
+
+// getMediaRecord is swapped out by tests
+var getMediaRecord = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+}
+
+func idempotencyKeyApplies(userId string, key string, ctx rcontext.RequestContext) bool {
+	return ctx.Config.Uploads.IdempotencyKeys.Enabled && userId != NoApplicableUploadUser && key != "" && len(key) <= maxIdempotencyKeyLength
+}
+
+// ClaimIdempotencyKey claims the user's idempotency key for an upload which is about to be read, so
+// that retries sent while the upload is being stored don't create media of their own. If the user's
+// previous upload with the same key created media, that media is returned instead and nothing is
+// claimed. Uploads which were since deleted are treated as though they never happened. If another
+// upload holds the key, common.ErrUploadInProgress is returned.
+//
+// An upload which claimed the key must finish with RecordIdempotentUpload or ReleaseIdempotencyKey.
+// Nothing is claimed if idempotency keys are disabled.
+func ClaimIdempotencyKey(userId string, key string, ctx rcontext.RequestContext) (*types.Media, error) {
+	if !idempotencyKeyApplies(userId, key, ctx) {
+		return nil, nil
+	}
+
+	expiresTs := util.NowMillis() + idempotencyClaimTime.Milliseconds()
+	claimed, err := claimIdempotencyKey(userId, key, expiresTs, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	origin, mediaId, err := getIdempotencyKey(userId, key, ctx)
+	if err == sql.ErrNoRows {
+		// The key expired after we tried to claim it, which the client can retry
+		return nil, common.ErrUploadInProgress
+	} else if err != nil {
+		return nil, err
+	}
+	if mediaId == "" {
+		ctx.Log.Info("Upload repeats idempotency key of an upload which is in progress - rejecting")
+		return nil, common.ErrUploadInProgress
+	}
+
+	media, err := getMediaRecord(origin, mediaId, ctx)
+	if err == sql.ErrNoRows {
+		claimed, err = reclaimIdempotencyKey(userId, key, origin, mediaId, expiresTs, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			return nil, common.ErrUploadInProgress
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Upload repeats idempotency key of previous upload ", media.MxcUri(), " - returning that media instead")
+	return media, nil
+}
+
+// RecordIdempotentUpload records that the user's upload which claimed the given idempotency key
+// created the media, so retries of the upload can return it. Media recorded by another upload with
+// the key is never replaced. Nothing is recorded if idempotency keys are disabled.
+func RecordIdempotentUpload(userId string, key string, media *types.Media, ctx rcontext.RequestContext) error {
+	if !idempotencyKeyApplies(userId, key, ctx) {
+		return nil
+	}
+
+	expiresTs := util.NowMillis() + (time.Duration(ctx.Config.Uploads.IdempotencyKeys.ExpireAfterMinutes) * time.Minute).Milliseconds()
+	return setIdempotencyKey(userId, key, media.Origin, media.MediaId, expiresTs, ctx)
+}
+
+// ReleaseIdempotencyKey gives up the claim on the user's idempotency key after the upload which
+// claimed it failed, so the upload can be retried straight away.
+func ReleaseIdempotencyKey(userId string, key string, ctx rcontext.RequestContext) error {
+	if !idempotencyKeyApplies(userId, key, ctx) {
+		return nil
+	}
+	return releaseIdempotencyKey(userId, key, ctx)
+}
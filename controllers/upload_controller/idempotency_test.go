@@ -0,0 +1,226 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// useTestIdempotencyKeys keeps idempotency keys and media in memory instead of the database. Keys
+// with an empty media ID are claimed by an upload which hasn't finished.
+func useTestIdempotencyKeys(t *testing.T, media map[string]*types.Media) map[string]int64 {
+	expiries := make(map[string]int64)
+	mediaIds := make(map[string]string)
+
+	originalGet := getIdempotencyKey
+	originalSet := setIdempotencyKey
+	originalClaim := claimIdempotencyKey
+	originalReclaim := reclaimIdempotencyKey
+	originalRelease := releaseIdempotencyKey
+	originalMedia := getMediaRecord
+	t.Cleanup(func() {
+		getIdempotencyKey = originalGet
+		setIdempotencyKey = originalSet
+		claimIdempotencyKey = originalClaim
+		reclaimIdempotencyKey = originalReclaim
+		releaseIdempotencyKey = originalRelease
+		getMediaRecord = originalMedia
+	})
+
+	active := func(k string) bool {
+		_, ok := mediaIds[k]
+		return ok && expiries[k] > util.NowMillis()
+	}
+	getIdempotencyKey = func(userId string, key string, ctx rcontext.RequestContext) (string, string, error) {
+		if !active(userId + "|" + key) {
+			return "", "", sql.ErrNoRows
+		}
+		parts := strings.SplitN(mediaIds[userId+"|"+key], "/", 2)
+		return parts[0], parts[1], nil
+	}
+	setIdempotencyKey = func(userId string, key string, origin string, mediaId string, expiresTs int64, ctx rcontext.RequestContext) error {
+		if active(userId+"|"+key) && mediaIds[userId+"|"+key] != "/" {
+			return nil
+		}
+		mediaIds[userId+"|"+key] = origin + "/" + mediaId
+		expiries[userId+"|"+key] = expiresTs
+		return nil
+	}
+	claimIdempotencyKey = func(userId string, key string, expiresTs int64, ctx rcontext.RequestContext) (bool, error) {
+		if active(userId + "|" + key) {
+			return false, nil
+		}
+		mediaIds[userId+"|"+key] = "/"
+		expiries[userId+"|"+key] = expiresTs
+		return true, nil
+	}
+	reclaimIdempotencyKey = func(userId string, key string, origin string, mediaId string, expiresTs int64, ctx rcontext.RequestContext) (bool, error) {
+		if mediaIds[userId+"|"+key] != origin+"/"+mediaId {
+			return false, nil
+		}
+		mediaIds[userId+"|"+key] = "/"
+		expiries[userId+"|"+key] = expiresTs
+		return true, nil
+	}
+	releaseIdempotencyKey = func(userId string, key string, ctx rcontext.RequestContext) error {
+		if mediaIds[userId+"|"+key] == "/" {
+			delete(mediaIds, userId+"|"+key)
+		}
+		return nil
+	}
+	getMediaRecord = func(origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+		if m, ok := media[origin+"/"+mediaId]; ok {
+			return m, nil
+		}
+		return nil, sql.ErrNoRows
+	}
+	return expiries
+}
+
+func TestIdempotencyKeyApplies(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		userId   string
+		key      string
+		expected bool
+	}{
+		{name: "enabled", enabled: true, userId: "@alice:example.org", key: "retry-1", expected: true},
+		{name: "disabled", enabled: false, userId: "@alice:example.org", key: "retry-1", expected: false},
+		{name: "no key", enabled: true, userId: "@alice:example.org", key: "", expected: false},
+		{name: "no user", enabled: true, userId: NoApplicableUploadUser, key: "retry-1", expected: false},
+		{name: "longest key", enabled: true, userId: "@alice:example.org", key: strings.Repeat("k", maxIdempotencyKeyLength), expected: true},
+		{name: "key too long", enabled: true, userId: "@alice:example.org", key: strings.Repeat("k", maxIdempotencyKeyLength+1), expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.IdempotencyKeys.Enabled = tt.enabled
+			ctx.Config.Uploads.IdempotencyKeys.ExpireAfterMinutes = 1440
+
+			if applies := idempotencyKeyApplies(tt.userId, tt.key, ctx); applies != tt.expected {
+				t.Errorf("got %t, expected %t", applies, tt.expected)
+			}
+			if !tt.expected {
+				// Nothing should be looked up or recorded, so the database is never touched
+				media, err := ClaimIdempotencyKey(tt.userId, tt.key, ctx)
+				if media != nil || err != nil {
+					t.Errorf("got %v (error %v), expected nothing", media, err)
+				}
+				if err := RecordIdempotentUpload(tt.userId, tt.key, nil, ctx); err != nil {
+					t.Errorf("got error %v, expected nothing to be recorded", err)
+				}
+				if err := ReleaseIdempotencyKey(tt.userId, tt.key, ctx); err != nil {
+					t.Errorf("got error %v, expected nothing to be released", err)
+				}
+			}
+		})
+	}
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	original := &types.Media{Origin: "example.org", MediaId: "original", UserId: "@alice:example.org"}
+
+	tests := []struct {
+		name        string
+		userId      string
+		key         string
+		deleted     bool
+		expired     bool
+		expectedMxc string
+	}{
+		{name: "repeated key", userId: "@alice:example.org", key: "retry-1", expectedMxc: original.MxcUri()},
+		{name: "different key", userId: "@alice:example.org", key: "retry-2"},
+		{name: "different user", userId: "@bob:example.org", key: "retry-1"},
+		{name: "expired key", userId: "@alice:example.org", key: "retry-1", expired: true},
+		{name: "deleted media", userId: "@alice:example.org", key: "retry-1", deleted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media := map[string]*types.Media{"example.org/original": original}
+			expiries := useTestIdempotencyKeys(t, media)
+
+			ctx := testContext()
+			ctx.Config.Uploads.IdempotencyKeys.Enabled = true
+			ctx.Config.Uploads.IdempotencyKeys.ExpireAfterMinutes = 1440
+
+			if _, err := ClaimIdempotencyKey(original.UserId, "retry-1", ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := RecordIdempotentUpload(original.UserId, "retry-1", original, ctx); err != nil {
+				t.Fatal(err)
+			}
+			if tt.expired {
+				for k := range expiries {
+					expiries[k] = util.NowMillis() - 1
+				}
+			}
+			if tt.deleted {
+				delete(media, "example.org/original")
+			}
+
+			found, err := ClaimIdempotencyKey(tt.userId, tt.key, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expectedMxc == "" {
+				if found != nil {
+					t.Errorf("got %s, expected a new upload", found.MxcUri())
+				}
+			} else if found == nil || found.MxcUri() != tt.expectedMxc {
+				t.Errorf("got %v, expected %s", found, tt.expectedMxc)
+			}
+		})
+	}
+}
+
+func TestClaimIdempotencyKeyInProgress(t *testing.T) {
+	media := map[string]*types.Media{}
+	useTestIdempotencyKeys(t, media)
+
+	ctx := testContext()
+	ctx.Config.Uploads.IdempotencyKeys.Enabled = true
+	ctx.Config.Uploads.IdempotencyKeys.ExpireAfterMinutes = 1440
+
+	if existing, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx); existing != nil || err != nil {
+		t.Fatalf("got (%v, %v), expected the key to be claimed", existing, err)
+	}
+
+	// Retries sent while the upload is being stored don't get to upload again
+	if _, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx); err != common.ErrUploadInProgress {
+		t.Errorf("got error %v, expected %v", err, common.ErrUploadInProgress)
+	}
+
+	// Failed uploads can be retried straight away
+	if err := ReleaseIdempotencyKey("@alice:example.org", "retry-1", ctx); err != nil {
+		t.Fatal(err)
+	}
+	if existing, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx); existing != nil || err != nil {
+		t.Fatalf("got (%v, %v), expected the released key to be claimed again", existing, err)
+	}
+
+	stored := &types.Media{Origin: "example.org", MediaId: "stored", UserId: "@alice:example.org"}
+	media["example.org/stored"] = stored
+	if err := RecordIdempotentUpload("@alice:example.org", "retry-1", stored, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Media recorded for the key is never replaced by another upload, or released
+	other := &types.Media{Origin: "example.org", MediaId: "other", UserId: "@alice:example.org"}
+	media["example.org/other"] = other
+	if err := RecordIdempotentUpload("@alice:example.org", "retry-1", other, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseIdempotencyKey("@alice:example.org", "retry-1", ctx); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := ClaimIdempotencyKey("@alice:example.org", "retry-1", ctx)
+	if err != nil || existing == nil || existing.MxcUri() != stored.MxcUri() {
+		t.Errorf("got (%v, %v), expected %s", existing, err, stored.MxcUri())
+	}
+}
@@ -0,0 +1,56 @@
+package upload_controller
+
+import (
+	"sync"
+	"time"
+)
+
+var inFlightLock = &sync.Mutex{}
+var inFlightCount = 0
+var draining = false
+var drained chan bool
+
+// beginStore records that media is being stored, returning false if the media repo is shutting
+// down and no more media should be stored.
+func beginStore() bool {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+
+	if draining {
+		return false
+	}
+	inFlightCount++
+	return true
+}
+
+func endStore() {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+
+	inFlightCount--
+	if draining && inFlightCount == 0 {
+		close(drained)
+	}
+}
+
+// Drain stops any more media from being stored and waits up to the timeout for media currently
+// being stored to finish. Returns false if the timeout was reached first.
+func Drain(timeout time.Duration) bool {
+	inFlightLock.Lock()
+	if !draining {
+		draining = true
+		drained = make(chan bool)
+		if inFlightCount == 0 {
+			close(drained)
+		}
+	}
+	ch := drained
+	inFlightLock.Unlock()
+
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package upload_controller
+
+import (
+	"testing"
+	"time"
+)
+
+func resetInFlight() {
+	inFlightLock.Lock()
+	defer inFlightLock.Unlock()
+
+	inFlightCount = 0
+	draining = false
+	drained = nil
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		inFlight  int
+		finishIn  time.Duration // how long the in-flight stores take to finish
+		timeout   time.Duration
+		wantDrain bool
+	}{
+		{name: "nothing in flight", inFlight: 0, timeout: 10 * time.Millisecond, wantDrain: true},
+		{name: "finishes in time", inFlight: 3, finishIn: 20 * time.Millisecond, timeout: time.Second, wantDrain: true},
+		{name: "times out", inFlight: 1, finishIn: time.Second, timeout: 20 * time.Millisecond, wantDrain: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetInFlight()
+			defer resetInFlight()
+
+			for i := 0; i < tt.inFlight; i++ {
+				if !beginStore() {
+					t.Fatal("unable to begin storing before draining")
+				}
+			}
+			finished := make(chan bool)
+			go func() {
+				time.Sleep(tt.finishIn)
+				for i := 0; i < tt.inFlight; i++ {
+					endStore()
+				}
+				close(finished)
+			}()
+
+			if drained := Drain(tt.timeout); drained != tt.wantDrain {
+				t.Errorf("Drain() = %v, want %v", drained, tt.wantDrain)
+			}
+			if beginStore() {
+				t.Error("media can still be stored after draining started")
+			}
+			<-finished
+		})
+	}
+}
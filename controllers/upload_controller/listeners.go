@@ -0,0 +1,22 @@
+package upload_controller
+
+import (
+	"sync"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+// UploadListener is called in the background with media uploaded by local users, once it is stored.
+type UploadListener func(media *types.Media, ctx rcontext.RequestContext)
+
+var uploadListeners = make([]UploadListener, 0)
+var uploadListenersLock = &sync.RWMutex{}
+
+// AddUploadListener calls the listener for every later local upload. This lets controllers which
+// depend on this one (and so can't be imported here) react to uploads.
+func AddUploadListener(listener UploadListener) {
+	uploadListenersLock.Lock()
+	defer uploadListenersLock.Unlock()
+	uploadListeners = append(uploadListeners, listener)
+}
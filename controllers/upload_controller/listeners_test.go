@@ -0,0 +1,63 @@
+package upload_controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestMain(m *testing.M) {
+	// Webhooks are read from the config when uploads are announced, so give the tests a default config
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestNotifyUploadListeners(t *testing.T) {
+	notified := make(chan *types.Media, 10)
+	AddUploadListener(func(media *types.Media, ctx rcontext.RequestContext) {
+		notified <- media
+	})
+
+	tests := []struct {
+		name           string
+		kind           string
+		expectedNotify bool
+	}{
+		{name: "local media", kind: common.KindLocalMedia, expectedNotify: true},
+		{name: "remote media", kind: common.KindRemoteMedia, expectedNotify: false},
+		{name: "thumbnail", kind: common.KindThumbnails, expectedNotify: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			media := &types.Media{Origin: "example.org", MediaId: tt.name}
+			notifyUpload(tt.kind, media, testContext())
+
+			select {
+			case got := <-notified:
+				if !tt.expectedNotify {
+					t.Fatal("expected the listener not to be called")
+				}
+				if got != media {
+					t.Errorf("got %s, expected %s", got.MxcUri(), media.MxcUri())
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.expectedNotify {
+					t.Fatal("expected the listener to be called")
+				}
+			}
+		})
+	}
+}
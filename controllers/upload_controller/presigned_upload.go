@@ -0,0 +1,288 @@
+package upload_controller
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+var ErrPresignedUploadMissing = errors.New("presigned upload has not been uploaded to")
+var ErrPresignedUploadHashMismatch = errors.New("presigned upload does not match the expected hash")
+
+// How much of a presigned upload to read when detecting its content type
+const presignedSniffBytes = 3072
+
+// PresignedUpload is an upload which the client sends directly to the datastore, using a presigned
+// URL, before asking the media repo to store it as media.
+type PresignedUpload struct {
+	ID          string
+	UserId      string
+	Origin      string
+	Filename    string
+	ContentType string
+	UploadUrl   string
+	ExpiresTs   int64
+
+	ds        *datastore.DatastoreRef
+	location  string
+	finalized bool
+	lock      sync.Mutex
+}
+
+// Uploads which were lost by a restart are only known about through the database, which the
+// recurring purge cleans up. Everything else is cleaned up when it is evicted from here.
+var presignedUploads = newPresignedUploadCache()
+
+func newPresignedUploadCache() *cache.Cache {
+	c := cache.New(time.Hour, 5*time.Minute)
+	c.OnEvicted(func(id string, v interface{}) {
+		// Anything uploaded to an expired upload would otherwise never be cleaned up
+		upload := v.(*PresignedUpload)
+		upload.lock.Lock()
+		defer upload.lock.Unlock()
+		if !upload.finalized {
+			ctx := rcontext.Initial()
+			if err := upload.ds.DeleteObject(upload.location); err != nil && !os.IsNotExist(err) {
+				ctx.Log.Warn("Failed to delete expired presigned upload, leaving it for the purge task: ", err)
+				return
+			}
+			forgetPresignedUploadObject(upload, ctx)
+		}
+	})
+	return c
+}
+
+// recordPresignedUpload is swapped out by tests
+var recordPresignedUpload = func(datastoreId string, location string, expiresTs int64, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMetadataStore(ctx).UpsertPresignedUpload(datastoreId, location, expiresTs)
+}
+
+// forgetPresignedUpload is swapped out by tests
+var forgetPresignedUpload = func(datastoreId string, location string, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMetadataStore(ctx).DeletePresignedUpload(datastoreId, location)
+}
+
+// forgetPresignedUploadObject stops the purge task from deleting the upload's object, once it has
+// been stored as media or deleted already.
+func forgetPresignedUploadObject(upload *PresignedUpload, ctx rcontext.RequestContext) {
+	if err := forgetPresignedUpload(upload.ds.DatastoreId, upload.location, ctx); err != nil {
+		ctx.Log.Warn("Failed to forget presigned upload: ", err)
+		sentry.CaptureException(err)
+	}
+}
+
+func presignedExpiryOf(ctx rcontext.RequestContext) time.Duration {
+	return time.Duration(ctx.Config.Uploads.Presigned.ExpireAfterMinutes) * time.Minute
+}
+
+// storePresignedUpload is swapped out by tests
+var storePresignedUpload = StoreDirect
+
+// CreatePresignedUpload picks a datastore for the upload and generates a URL the client can upload
+// the file to directly. The file is not checked against the upload policy until the upload is
+// finalized. Returns datastore.ErrPresignUploadUnsupported if the picked datastore can't accept
+// uploads directly.
+func CreatePresignedUpload(sizeBytes int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*PresignedUpload, error) {
+	ctx = withUploadPolicy(userId, ctx)
+	contentType = util.NormalizeContentType(contentType, ctx.Config.Uploads.ContentTypeParameters)
+
+	// The file is stored exactly as the client uploads it, so it can't be altered first
+	if ctx.Config.Uploads.StripMetadata || ctx.Config.Uploads.RecompressImages {
+		return nil, datastore.ErrPresignUploadUnsupported
+	}
+
+	ds, err := selectDatastore(common.KindLocalMedia, sizeBytes, contentType, origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+
+	// The URL expires with the upload so nothing can be uploaded after the upload is discarded
+	location, uploadUrl, err := ds.PresignUpload(presignedExpiryOf(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &PresignedUpload{
+		ID:          id,
+		UserId:      userId,
+		Origin:      origin,
+		Filename:    util.SanitizeFilename(filename, ctx.Config.Uploads.MaxFilenameLength),
+		ContentType: contentType,
+		UploadUrl:   uploadUrl,
+		ExpiresTs:   util.NowMillis() + presignedExpiryOf(ctx).Milliseconds(),
+		ds:          ds,
+		location:    location,
+	}
+
+	// Recorded before the client gets the URL, so the object can't outlive a restart
+	if err = recordPresignedUpload(ds.DatastoreId, location, upload.ExpiresTs, ctx); err != nil {
+		return nil, err
+	}
+	presignedUploads.Set(id, upload, presignedExpiryOf(ctx))
+
+	ctx.Log.Info("Created presigned upload ", id, " in datastore ", ds.DatastoreId)
+	return upload, nil
+}
+
+// GetPresignedUpload returns the presigned upload with the given ID, or nil if the upload does not
+// exist or belongs to a different user.
+func GetPresignedUpload(id string, userId string) *PresignedUpload {
+	v, found := presignedUploads.Get(id)
+	if !found {
+		return nil
+	}
+	upload := v.(*PresignedUpload)
+	if upload.UserId != userId {
+		return nil
+	}
+	return upload
+}
+
+// FinalizePresignedUpload checks the file the client uploaded against the upload policy and stores
+// it as media. Files which are not allowed are deleted from the datastore. If expectedHash is not
+// empty, the file must also have that hash. The upload can't be finalized again afterwards, unless
+// nothing had been uploaded to it yet.
+func FinalizePresignedUpload(upload *PresignedUpload, expectedHash string, ctx rcontext.RequestContext) (*types.Media, error) {
+	ctx = withUploadPolicy(upload.UserId, ctx)
+
+	upload.lock.Lock()
+	if upload.finalized {
+		upload.lock.Unlock()
+		return nil, ErrPresignedUploadMissing
+	}
+	sizeBytes, err := upload.ds.ObjectSize(upload.location)
+	if os.IsNotExist(err) {
+		upload.lock.Unlock()
+		return nil, ErrPresignedUploadMissing
+	}
+	if err != nil {
+		upload.lock.Unlock()
+		return nil, err
+	}
+	// From here on, the object is either stored as media or deleted here rather than when the
+	// upload is removed
+	upload.finalized = true
+	upload.lock.Unlock()
+	presignedUploads.Delete(upload.ID)
+	defer forgetPresignedUploadObject(upload, ctx)
+
+	info, err := readPresignedUpload(upload, sizeBytes, expectedHash, ctx)
+	if err != nil {
+		_ = upload.ds.DeleteObject(upload.location)
+		return nil, err
+	}
+
+	mediaId, err := generateMediaId(upload.Origin, ctx)
+	if err != nil {
+		_ = upload.ds.DeleteObject(upload.location)
+		return nil, err
+	}
+
+	// Storing the media deletes the object if it is rejected from here on
+	f := &AlreadyUploadedFile{DS: upload.ds, ObjectInfo: info}
+	return storePresignedUpload(f, nil, sizeBytes, upload.ContentType, upload.Filename, upload.UserId, upload.Origin, mediaId, common.KindLocalMedia, ctx, true)
+}
+
+// readPresignedUpload applies the upload policy to the uploaded file, checking as much as possible
+// before downloading the whole file.
+func readPresignedUpload(upload *PresignedUpload, sizeBytes int64, expectedHash string, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	if sizeBytes <= 0 {
+		return nil, common.ErrMediaEmpty
+	}
+	if IsRequestTooLarge(sizeBytes, "", ctx) {
+		ctx.Log.Warnf("Presigned upload of %d bytes is larger than the maximum of %d bytes", sizeBytes, ctx.Config.Uploads.MaxSizeBytes)
+		return nil, common.ErrMediaTooLarge
+	}
+	if IsRequestTooSmall(sizeBytes, "", ctx) {
+		return nil, common.ErrMediaEmpty
+	}
+	inQuota, err := isUserWithinQuota(ctx, upload.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if !inQuota {
+		return nil, common.ErrQuotaExceeded
+	}
+
+	start, err := upload.ds.DownloadFileStart(upload.location, presignedSniffBytes)
+	if err != nil {
+		return nil, err
+	}
+	startBytes, err := ioutil.ReadAll(start)
+	start.Close()
+	if err != nil {
+		return nil, err
+	}
+	detectedType := detectContentType(startBytes, ctx)
+	if IsTypeDenied(detectedType, ctx) {
+		ctx.Log.Warn("Rejecting presigned upload with denied content type: ", detectedType)
+		return nil, common.ErrMediaTypeDenied
+	}
+	if IsExtensionMismatched(upload.Filename, detectedType, ctx) {
+		ctx.Log.Warn("Rejecting presigned upload with an extension which doesn't match the detected content type: ", detectedType)
+		return nil, common.ErrMediaExtensionMismatch
+	}
+	if IsTooLargeForType(sizeBytes, detectedType, ctx) {
+		return nil, common.ErrMediaTooLargeForType
+	}
+	if ctx.Config.Uploads.SanitizeSvg && (util.IsSvgContentType(detectedType) || util.IsSvgContentType(upload.ContentType)) {
+		// SVGs are sanitized by rewriting them, which can't be done to a file the client uploaded directly
+		ctx.Log.Warn("Rejecting presigned upload of an SVG, which would need sanitizing")
+		return nil, common.ErrMediaTypeDenied
+	}
+
+	stream, err := upload.ds.DownloadFile(upload.location, false)
+	if err != nil {
+		return nil, err
+	}
+	contentBytes, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contentBytes)) != sizeBytes {
+		// The file was replaced while it was being checked
+		return nil, common.ErrMediaCorrupt
+	}
+
+	hash, err := util.GetHashOfStream(util_byte_seeker.NewByteSeeker(contentBytes))
+	if err != nil {
+		return nil, err
+	}
+	if expectedHash != "" && util.NormalizeHash(expectedHash) != hash {
+		ctx.Log.Warn("Rejecting presigned upload which doesn't match the expected hash")
+		return nil, ErrPresignedUploadHashMismatch
+	}
+
+	if ctx.Config.Uploads.ValidateImages {
+		err = validateImage(contentBytes, detectedType, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := &types.ObjectInfo{
+		Location:        upload.location,
+		Sha256Hash:      hash,
+		SizeBytes:       sizeBytes,
+		StoredSizeBytes: sizeBytes,
+	}
+	return info, nil
+}
@@ -0,0 +1,340 @@
+package upload_controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// fakeBucket is an in-memory stand in for an S3 bucket, handling the requests made by clients
+// uploading to presigned URLs and by the datastore checking what they uploaded.
+type fakeBucket struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		w.WriteHeader(http.StatusOK) // bucket operations
+		return
+	}
+	key := parts[1]
+
+	switch r.Method {
+	case http.MethodPut:
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.objects[key] = contents
+	case http.MethodGet, http.MethodHead:
+		contents, ok := b.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(contents))
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *fakeBucket) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.objects)
+}
+
+// useTestPresignedRecords keeps the records of presigned uploads awaiting finalization in memory for
+// the rest of the test, keyed by datastore ID and location.
+func useTestPresignedRecords(t *testing.T) map[string]int64 {
+	records := make(map[string]int64)
+
+	originalRecord := recordPresignedUpload
+	originalForget := forgetPresignedUpload
+	t.Cleanup(func() {
+		recordPresignedUpload = originalRecord
+		forgetPresignedUpload = originalForget
+	})
+
+	recordPresignedUpload = func(datastoreId string, location string, expiresTs int64, ctx rcontext.RequestContext) error {
+		records[datastoreId+"/"+location] = expiresTs
+		return nil
+	}
+	forgetPresignedUpload = func(datastoreId string, location string, ctx rcontext.RequestContext) error {
+		delete(records, datastoreId+"/"+location)
+		return nil
+	}
+	return records
+}
+
+// usePresignedTestDatastore picks an s3 datastore backed by a fake bucket for uploads, and records
+// stored media in memory, for the rest of the test.
+func usePresignedTestDatastore(t *testing.T) (*fakeBucket, map[string]*AlreadyUploadedFile) {
+	bucket := &fakeBucket{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(bucket)
+	t.Cleanup(srv.Close)
+
+	_, err := ds_s3.GetOrCreateS3Datastore(t.Name(), config.DatastoreConfig{Type: "s3", Options: map[string]string{
+		"endpoint":     strings.TrimPrefix(srv.URL, "http://"),
+		"bucketName":   "media",
+		"accessKeyId":  "access",
+		"accessSecret": "secret",
+		"region":       "us-east-1",
+		"ssl":          "false",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &datastore.DatastoreRef{DatastoreId: t.Name(), Type: "s3"}
+	stored := make(map[string]*AlreadyUploadedFile)
+	useTestPresignedRecords(t)
+
+	originalSelect := selectDatastore
+	originalStore := storePresignedUpload
+	originalReserved := isMediaIdReserved
+	originalInUse := isMediaIdInUse
+	t.Cleanup(func() {
+		selectDatastore = originalSelect
+		storePresignedUpload = originalStore
+		isMediaIdReserved = originalReserved
+		isMediaIdInUse = originalInUse
+	})
+
+	selectDatastore = func(forKind string, size int64, contentType string, origin string, ctx rcontext.RequestContext) (*datastore.DatastoreRef, error) {
+		return ds, nil
+	}
+	storePresignedUpload = func(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool) (*types.Media, error) {
+		stored[mediaId] = f
+		return &types.Media{Origin: origin, MediaId: mediaId, UserId: userId, ContentType: contentType, SizeBytes: f.ObjectInfo.SizeBytes, Sha256Hash: f.ObjectInfo.Sha256Hash}, nil
+	}
+	isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+	isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+	return bucket, stored
+}
+
+func presignedTestContext() rcontext.RequestContext {
+	ctx := testContext()
+	ctx.Config.Uploads.MimeDetection = util.MimeDetectionGo
+	ctx.Config.Uploads.Presigned.Enabled = true
+	ctx.Config.Uploads.Presigned.ExpireAfterMinutes = 15
+	return ctx
+}
+
+func uploadToPresignedUrl(t *testing.T, upload *PresignedUpload, contents []byte) {
+	req, err := http.NewRequest(http.MethodPut, upload.UploadUrl, bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d uploading to the presigned URL, expected 200", res.StatusCode)
+	}
+}
+
+func TestPresignedUpload(t *testing.T) {
+	bucket, stored := usePresignedTestDatastore(t)
+	records := useTestPresignedRecords(t)
+	ctx := presignedTestContext()
+	contents := []byte("hello world, uploaded directly")
+
+	upload, err := CreatePresignedUpload(int64(len(contents)), "text/plain", "hello.txt", "@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresTs, ok := records[upload.ds.DatastoreId+"/"+upload.location]; !ok || expiresTs != upload.ExpiresTs {
+		t.Errorf("got record (%d, %t), expected the upload to be recorded until %d", expiresTs, ok, upload.ExpiresTs)
+	}
+	if GetPresignedUpload(upload.ID, "@alice:example.org") != upload {
+		t.Fatal("expected to find the upload")
+	}
+	if GetPresignedUpload(upload.ID, "@bob:example.org") != nil {
+		t.Error("expected the upload to be hidden from other users")
+	}
+
+	if _, err = FinalizePresignedUpload(upload, "", ctx); err != ErrPresignedUploadMissing {
+		t.Errorf("got %v finalizing before uploading, expected %v", err, ErrPresignedUploadMissing)
+	}
+
+	uploadToPresignedUrl(t, upload, contents)
+	hash := sha256.Sum256(contents)
+	media, err := FinalizePresignedUpload(upload, "sha256:"+hex.EncodeToString(hash[:]), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.Origin != "example.org" || media.UserId != "@alice:example.org" || media.ContentType != "text/plain" {
+		t.Errorf("got media %s from %s (%s), expected example.org media from @alice:example.org", media.MxcUri(), media.UserId, media.ContentType)
+	}
+	f, ok := stored[media.MediaId]
+	if !ok {
+		t.Fatal("expected the upload to be stored")
+	}
+	if f.ObjectInfo.Sha256Hash != "sha256:"+hex.EncodeToString(hash[:]) {
+		t.Errorf("got hash %s, expected sha256:%s", f.ObjectInfo.Sha256Hash, hex.EncodeToString(hash[:]))
+	}
+	if f.ObjectInfo.SizeBytes != int64(len(contents)) {
+		t.Errorf("got size %d, expected %d", f.ObjectInfo.SizeBytes, len(contents))
+	}
+	if !f.DS.ObjectExists(f.ObjectInfo.Location) {
+		t.Error("expected the uploaded object to be kept")
+	}
+
+	// Each upload can only be stored once
+	if GetPresignedUpload(upload.ID, "@alice:example.org") != nil {
+		t.Error("expected the upload to be removed once finalized")
+	}
+	if _, err = FinalizePresignedUpload(upload, "", ctx); err != ErrPresignedUploadMissing {
+		t.Errorf("got %v finalizing again, expected %v", err, ErrPresignedUploadMissing)
+	}
+	if n := bucket.count(); n != 1 {
+		t.Errorf("got %d objects in the bucket, expected 1", n)
+	}
+	if len(records) != 0 {
+		t.Error("expected the stored upload not to be left for the purge task")
+	}
+}
+
+func TestExpiredPresignedUploadDeleted(t *testing.T) {
+	bucket, _ := usePresignedTestDatastore(t)
+	records := useTestPresignedRecords(t)
+	ctx := presignedTestContext()
+
+	upload, err := CreatePresignedUpload(5, "text/plain", "hello.txt", "@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadToPresignedUrl(t, upload, []byte("hello"))
+
+	presignedUploads.Set(upload.ID, upload, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	presignedUploads.DeleteExpired()
+
+	if GetPresignedUpload(upload.ID, "@alice:example.org") != nil {
+		t.Error("expected the upload to be gone")
+	}
+	if n := bucket.count(); n != 0 {
+		t.Errorf("got %d objects in the bucket, expected the upload to be deleted", n)
+	}
+	if len(records) != 0 {
+		t.Error("expected the deleted upload not to be left for the purge task")
+	}
+}
+
+func TestPresignedUploadPolicyViolations(t *testing.T) {
+	contents := []byte("hello world, uploaded directly")
+
+	tests := []struct {
+		name         string
+		configure    func(ctx *rcontext.RequestContext)
+		expectedHash string
+		expectedErr  error
+	}{
+		{
+			name:        "too large",
+			configure:   func(ctx *rcontext.RequestContext) { ctx.Config.Uploads.MaxSizeBytes = 10 },
+			expectedErr: common.ErrMediaTooLarge,
+		},
+		{
+			name:        "denied type",
+			configure:   func(ctx *rcontext.RequestContext) { ctx.Config.Uploads.DeniedTypes = []string{"text/*"} },
+			expectedErr: common.ErrMediaTypeDenied,
+		},
+		{
+			name:        "too large for type",
+			configure:   func(ctx *rcontext.RequestContext) { ctx.Config.Uploads.MaxSizeByType = map[string]int64{"text/*": 10} },
+			expectedErr: common.ErrMediaTooLargeForType,
+		},
+		{
+			name:         "hash mismatch",
+			expectedHash: hex.EncodeToString(make([]byte, sha256.Size)),
+			expectedErr:  ErrPresignedUploadHashMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, stored := usePresignedTestDatastore(t)
+			records := useTestPresignedRecords(t)
+			ctx := presignedTestContext()
+
+			// The client is only held to the limits by what it actually uploads
+			upload, err := CreatePresignedUpload(5, "text/plain", "hello.txt", "@alice:example.org", "example.org", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uploadToPresignedUrl(t, upload, contents)
+			if n := bucket.count(); n != 1 {
+				t.Fatalf("got %d objects in the bucket after uploading, expected 1", n)
+			}
+
+			if tt.configure != nil {
+				tt.configure(&ctx)
+			}
+			media, err := FinalizePresignedUpload(upload, tt.expectedHash, ctx)
+			if media != nil || err != tt.expectedErr {
+				t.Fatalf("got (%v, %v), expected %v", media, err, tt.expectedErr)
+			}
+			if len(stored) != 0 {
+				t.Error("expected the upload not to be stored")
+			}
+			if n := bucket.count(); n != 0 {
+				t.Errorf("got %d objects in the bucket, expected the upload to be deleted", n)
+			}
+			if len(records) != 0 {
+				t.Error("expected the deleted upload not to be left for the purge task")
+			}
+		})
+	}
+}
+
+func TestPresignedUploadUnsupported(t *testing.T) {
+	usePresignedTestDatastore(t)
+	ctx := presignedTestContext()
+	ctx.Config.Uploads.StripMetadata = true
+
+	_, err := CreatePresignedUpload(5, "image/jpeg", "photo.jpg", "@alice:example.org", "example.org", ctx)
+	if err != datastore.ErrPresignUploadUnsupported {
+		t.Errorf("got %v, expected presigned uploads to be unavailable when stripping metadata", err)
+	}
+
+	ds := &datastore.DatastoreRef{DatastoreId: "file", Type: "file", Uri: t.TempDir()}
+	selectDatastore = func(forKind string, size int64, contentType string, origin string, ctx rcontext.RequestContext) (*datastore.DatastoreRef, error) {
+		return ds, nil
+	}
+	ctx.Config.Uploads.StripMetadata = false
+	_, err = CreatePresignedUpload(5, "text/plain", "hello.txt", "@alice:example.org", "example.org", ctx)
+	if err != datastore.ErrPresignUploadUnsupported {
+		t.Errorf("got %v, expected presigned uploads to be unavailable for file datastores", err)
+	}
+}
@@ -0,0 +1,47 @@
+package upload_controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+var readOnlyLock = &sync.RWMutex{}
+var readOnlyOverride *bool
+
+// IsReadOnly returns true if uploads should currently be rejected. An override set through the
+// admin API takes priority over the config.
+func IsReadOnly() bool {
+	readOnlyLock.RLock()
+	defer readOnlyLock.RUnlock()
+
+	if readOnlyOverride != nil {
+		return *readOnlyOverride
+	}
+	return config.Get().Maintenance.ReadOnly
+}
+
+// IsReadOnlyOverridden returns true if read-only mode was set through the admin API rather than
+// coming from the config.
+func IsReadOnlyOverridden() bool {
+	readOnlyLock.RLock()
+	defer readOnlyLock.RUnlock()
+
+	return readOnlyOverride != nil
+}
+
+// SetReadOnly overrides the config's read-only mode until the media repo restarts. Passing nil
+// clears the override, going back to the config.
+func SetReadOnly(readOnly *bool) {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+
+	readOnlyOverride = readOnly
+}
+
+// ReadOnlyRetryAfter returns how long clients are told to wait before retrying an upload which
+// was rejected because of read-only mode.
+func ReadOnlyRetryAfter() time.Duration {
+	return time.Duration(config.Get().Maintenance.RetryAfterSeconds) * time.Second
+}
@@ -0,0 +1,39 @@
+package upload_controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadOnlyOverride(t *testing.T) {
+	enabled := true
+	disabled := false
+	defer SetReadOnly(nil)
+
+	tests := []struct {
+		name               string
+		override           *bool
+		expectedReadOnly   bool
+		expectedOverridden bool
+	}{
+		{name: "config", override: nil, expectedReadOnly: false, expectedOverridden: false},
+		{name: "enabled", override: &enabled, expectedReadOnly: true, expectedOverridden: true},
+		{name: "disabled", override: &disabled, expectedReadOnly: false, expectedOverridden: true},
+		{name: "reset", override: nil, expectedReadOnly: false, expectedOverridden: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetReadOnly(tt.override)
+			if got := IsReadOnly(); got != tt.expectedReadOnly {
+				t.Errorf("got read-only = %t, expected %t", got, tt.expectedReadOnly)
+			}
+			if got := IsReadOnlyOverridden(); got != tt.expectedOverridden {
+				t.Errorf("got overridden = %t, expected %t", got, tt.expectedOverridden)
+			}
+		})
+	}
+
+	if got := ReadOnlyRetryAfter(); got != 5*time.Minute {
+		t.Errorf("got %s, expected the default of 5m", got)
+	}
+}
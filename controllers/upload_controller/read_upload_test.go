@@ -0,0 +1,91 @@
+package upload_controller
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func TestReadUploadMaxSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int
+		maxBytes    int64
+		expectedErr error
+	}{
+		{name: "under the limit", size: 99, maxBytes: 100},
+		{name: "at the limit", size: 100, maxBytes: 100},
+		{name: "one byte over", size: 101, maxBytes: 100, expectedErr: common.ErrMediaTooLarge},
+		{name: "well over", size: 5000, maxBytes: 100, expectedErr: common.ErrMediaTooLarge},
+		{name: "no limit", size: 5000, maxBytes: 0},
+		{name: "empty", size: 0, maxBytes: 100, expectedErr: common.ErrMediaEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MaxSizeBytes = tt.maxBytes
+
+			contents := ioutil.NopCloser(strings.NewReader(strings.Repeat("a", tt.size)))
+			b, _, err := readUpload(contents, "application/octet-stream", "file.txt", ctx)
+			if err != tt.expectedErr {
+				t.Fatalf("got error %v, expected %v", err, tt.expectedErr)
+			}
+			if tt.expectedErr == nil && len(b) != tt.size {
+				t.Errorf("got %d bytes, expected all %d", len(b), tt.size)
+			}
+		})
+	}
+}
+
+func TestReadUploadSanitizesSvg(t *testing.T) {
+	malicious := `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10" onload="alert(1)"><script>alert(2)</script><rect width="10" height="10" fill="red"/></svg>`
+
+	tests := []struct {
+		name              string
+		sanitize          bool
+		contentType       string
+		expectedSanitized bool
+	}{
+		{name: "sanitizing enabled", sanitize: true, contentType: "image/svg+xml", expectedSanitized: true},
+		{name: "declared as another type", sanitize: true, contentType: "application/octet-stream", expectedSanitized: true},
+		{name: "sanitizing disabled", sanitize: false, contentType: "image/svg+xml", expectedSanitized: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.SanitizeSvg = tt.sanitize
+
+			b, sanitized, err := readUpload(ioutil.NopCloser(strings.NewReader(malicious)), tt.contentType, "image.svg", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sanitized != tt.expectedSanitized {
+				t.Errorf("got sanitized = %t, expected %t", sanitized, tt.expectedSanitized)
+			}
+			if !tt.expectedSanitized {
+				if string(b) != malicious {
+					t.Errorf("got %s, expected the upload to be unchanged", b)
+				}
+				return
+			}
+			if strings.Contains(string(b), "alert") {
+				t.Errorf("got %s, expected the scripts to be removed", b)
+			}
+			if !strings.Contains(string(b), `<rect width="10" height="10" fill="red"></rect>`) {
+				t.Errorf("got %s, expected the shape to be kept", b)
+			}
+		})
+	}
+}
+
+func TestReadUploadInvalidSvg(t *testing.T) {
+	ctx := testContext()
+	ctx.Config.Uploads.SanitizeSvg = true
+
+	_, _, err := readUpload(ioutil.NopCloser(strings.NewReader("<svg><rect>")), "image/svg+xml", "image.svg", ctx)
+	if err != common.ErrSvgSanitizeFailed {
+		t.Errorf("got error %v, expected %v", err, common.ErrSvgSanitizeFailed)
+	}
+}
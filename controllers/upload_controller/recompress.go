@@ -0,0 +1,55 @@
+package upload_controller
+
+import (
+	"bytes"
+
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// recompressImage decodes and re-encodes JPEG and PNG images, discarding anything which isn't
+// part of the image itself (metadata, trailing data, etc). Other kinds of files are returned as-is.
+func recompressImage(b []byte, ctx rcontext.RequestContext) ([]byte, error) {
+	contentType := util.DetectContentTypeUsing(b, ctx.Config.Uploads.MimeDetection)
+
+	var format imaging.Format
+	switch contentType {
+	case "image/jpeg":
+		format = imaging.JPEG
+	case "image/png":
+		if util.IsAnimatedPNG(b) {
+			return b, nil // re-encoding would lose the animation
+		}
+		format = imaging.PNG
+	default:
+		return b, nil
+	}
+
+	// Check the dimensions before decoding the whole thing to avoid decompression bombs
+	width, height, err := util.GetImageDimensions(b)
+	if err != nil {
+		ctx.Log.Warn("Failed to read image header for recompression: " + err.Error())
+		return nil, common.ErrInvalidImage
+	}
+	if util.ExceedsMaxPixels(width, height, ctx.Config.Thumbnails.MaxPixels) {
+		ctx.Log.Warnf("Image is too large to recompress: %dx%d", width, height)
+		return nil, common.ErrImageTooLarge
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		ctx.Log.Warn("Failed to decode image for recompression: " + err.Error())
+		return nil, common.ErrInvalidImage
+	}
+
+	buf := &bytes.Buffer{}
+	err = imaging.Encode(buf, img, format, imaging.JPEGQuality(90))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Infof("Recompressed %s from %d bytes to %d bytes", contentType, len(b), buf.Len())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,99 @@
+package upload_controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func encodedTestImage(t *testing.T, encode func(*bytes.Buffer, image.Image) error) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngBomb builds a PNG header claiming enormous dimensions without the pixel data to back it up.
+func pngBomb() []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:8], 100000)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // truecolour
+
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(ihdr)))
+	copy(chunk[4:8], "IHDR")
+	chunk = append(chunk, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	return append([]byte("\x89PNG\r\n\x1a\n"), chunk...)
+}
+
+func TestRecompressImage(t *testing.T) {
+	jpegBytes := encodedTestImage(t, func(b *bytes.Buffer, img image.Image) error { return jpeg.Encode(b, img, nil) })
+	pngBytes := encodedTestImage(t, func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) })
+	trailer := []byte("PK\x03\x04this is actually a zip file")
+	polyglot := append(append([]byte{}, jpegBytes...), trailer...)
+
+	tests := []struct {
+		name       string
+		input      []byte
+		wantErr    error
+		wantSame   bool
+		wantDecode func([]byte) (image.Image, error)
+	}{
+		{name: "jpeg", input: jpegBytes, wantDecode: func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }},
+		{name: "png", input: pngBytes, wantDecode: func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) }},
+		{name: "polyglot", input: polyglot, wantDecode: func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) }},
+		{name: "not an image", input: []byte("just some text"), wantSame: true},
+		{name: "decompression bomb", input: pngBomb(), wantErr: common.ErrImageTooLarge},
+		{name: "corrupt image", input: []byte("\x89PNG\r\n\x1a\nnot really"), wantErr: common.ErrInvalidImage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.MaxPixels = 32000000
+
+			b, err := recompressImage(tt.input, ctx)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, expected %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantSame {
+				if !bytes.Equal(b, tt.input) {
+					t.Errorf("expected the input to be returned unaltered")
+				}
+				return
+			}
+			if bytes.Contains(b, trailer) {
+				t.Errorf("expected trailing data to be discarded")
+			}
+			img, err := tt.wantDecode(b)
+			if err != nil {
+				t.Fatalf("recompressed image doesn't decode: %v", err)
+			}
+			if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 16 {
+				t.Errorf("got %v, expected a 16x16 image", img.Bounds())
+			}
+		})
+	}
+}
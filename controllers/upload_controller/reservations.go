@@ -0,0 +1,156 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"io"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// reservationStore is the part of the metadata store which keeps track of media reservations
+type reservationStore interface {
+	InsertMediaReservation(origin string, mediaId string, userId string, expiresTs int64) error
+	GetMediaReservation(origin string, mediaId string) (string, int64, error)
+	GetPendingMediaReservationCount(userId string) (int64, error)
+	ClaimMediaReservation(origin string, mediaId string, userId string) (bool, error)
+}
+
+// getReservationStore is swapped out by tests
+var getReservationStore = func(ctx rcontext.RequestContext) reservationStore {
+	return storage.GetDatabase().GetMetadataStore(ctx)
+}
+
+// storeReservedUpload is swapped out by tests
+var storeReservedUpload = storeUpload
+
+// CreateMediaReservation reserves a media ID for the user to upload to later (MSC2246), returning
+// the media ID and when the reservation expires if it isn't uploaded to.
+func CreateMediaReservation(userId string, origin string, ctx rcontext.RequestContext) (string, int64, error) {
+	if mayStoreOnIpfs(ctx) {
+		return "", 0, common.ErrMediaReservationsUnavailable
+	}
+
+	db := getReservationStore(ctx)
+
+	if ctx.Config.Uploads.Reservations.MaxPending > 0 {
+		pending, err := db.GetPendingMediaReservationCount(userId)
+		if err != nil {
+			return "", 0, err
+		}
+		if pending >= ctx.Config.Uploads.Reservations.MaxPending {
+			ctx.Log.Warnf("User already has %d pending media reservations", pending)
+			return "", 0, common.ErrTooManyMediaReservations
+		}
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	expiresTs := util.NowMillis() + (time.Duration(ctx.Config.Uploads.Reservations.ExpireAfterMinutes) * time.Minute).Milliseconds()
+	err = db.InsertMediaReservation(origin, mediaId, userId, expiresTs)
+	if err != nil {
+		return "", 0, err
+	}
+
+	ctx.Log.Info("Reserved media ID ", mediaId, " for a later upload")
+	return mediaId, expiresTs, nil
+}
+
+// UploadMediaToReservation stores the upload as the media the user previously reserved. Each
+// reservation can only be uploaded to once: later attempts get common.ErrMediaAlreadyUploaded.
+func UploadMediaToReservation(contents io.ReadCloser, contentType string, filename string, userId string, origin string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	defer cleanup.DumpAndCloseStream(contents)
+
+	ctx = withUploadPolicy(userId, ctx)
+	contentType = util.NormalizeContentType(contentType, ctx.Config.Uploads.ContentTypeParameters)
+
+	// The datastores may have changed since the reservation was made
+	if mayStoreOnIpfs(ctx) {
+		return nil, common.ErrMediaReservationsUnavailable
+	}
+
+	// Check the reservation before reading what could be a large upload
+	_, expiresTs, err := checkMediaReservation(userId, origin, mediaId, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filename = util.SanitizeFilename(filename, ctx.Config.Uploads.MaxFilenameLength)
+
+	dataBytes, sanitized, err := readUpload(contents, contentType, filename, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Claiming the reservation stops concurrent uploads to it from both being stored
+	db := getReservationStore(ctx)
+	claimed, err := db.ClaimMediaReservation(origin, mediaId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, reservationGoneError(origin, mediaId, ctx)
+	}
+
+	// The reserved media ID has to be kept, so the upload can't be swapped for an existing copy
+	media, err := storeReservedUpload(dataBytes, sanitized, contentType, filename, userId, origin, mediaId, false, ctx)
+	if err != nil {
+		// Give the reservation back so the client can try again
+		rerr := db.InsertMediaReservation(origin, mediaId, userId, expiresTs)
+		if rerr != nil {
+			ctx.Log.Warn("Failed to restore media reservation after a failed upload: ", rerr)
+			sentry.CaptureException(rerr)
+		}
+		return nil, err
+	}
+
+	return media, nil
+}
+
+// mayStoreOnIpfs determines if uploads could be stored on IPFS, which picks the media ID from the
+// file's content and so can't keep a reserved media ID.
+func mayStoreOnIpfs(ctx rcontext.RequestContext) bool {
+	for _, dsConf := range ctx.Config.DataStores {
+		if dsConf.Enabled && dsConf.Type == "ipfs" && common.HasKind(dsConf.MediaKinds, common.KindLocalMedia) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMediaReservation returns the owner and expiry time of the media ID's reservation, or the
+// error explaining why it can't be uploaded to by the user.
+func checkMediaReservation(userId string, origin string, mediaId string, ctx rcontext.RequestContext) (string, int64, error) {
+	ownerId, expiresTs, err := getReservationStore(ctx).GetMediaReservation(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return "", 0, reservationGoneError(origin, mediaId, ctx)
+	} else if err != nil {
+		return "", 0, err
+	}
+	if ownerId != userId {
+		return "", 0, common.ErrMediaReservationNotOwned
+	}
+	return ownerId, expiresTs, nil
+}
+
+// reservationGoneError works out why a media ID no longer has a reservation: either it was
+// uploaded to already, or it expired (or never existed).
+func reservationGoneError(origin string, mediaId string, ctx rcontext.RequestContext) error {
+	inUse, err := isMediaIdInUse(origin, mediaId, ctx)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return common.ErrMediaAlreadyUploaded
+	}
+	return common.ErrMediaReservationNotFound
+}
@@ -0,0 +1,296 @@
+package upload_controller
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+type fakeReservation struct {
+	userId    string
+	expiresTs int64
+}
+
+type fakeReservationStore struct {
+	reservations map[string]*fakeReservation
+	media        map[string]*types.Media
+}
+
+func (s *fakeReservationStore) InsertMediaReservation(origin string, mediaId string, userId string, expiresTs int64) error {
+	s.reservations[origin+"/"+mediaId] = &fakeReservation{userId: userId, expiresTs: expiresTs}
+	return nil
+}
+
+func (s *fakeReservationStore) GetMediaReservation(origin string, mediaId string) (string, int64, error) {
+	r, ok := s.reservations[origin+"/"+mediaId]
+	if !ok || r.expiresTs <= util.NowMillis() {
+		return "", 0, sql.ErrNoRows
+	}
+	return r.userId, r.expiresTs, nil
+}
+
+func (s *fakeReservationStore) GetPendingMediaReservationCount(userId string) (int64, error) {
+	count := int64(0)
+	for _, r := range s.reservations {
+		if r.userId == userId && r.expiresTs > util.NowMillis() {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *fakeReservationStore) ClaimMediaReservation(origin string, mediaId string, userId string) (bool, error) {
+	if _, _, err := s.GetMediaReservation(origin, mediaId); err != nil {
+		return false, nil
+	}
+	if s.reservations[origin+"/"+mediaId].userId != userId {
+		return false, nil
+	}
+	delete(s.reservations, origin+"/"+mediaId)
+	return true, nil
+}
+
+// useTestReservations keeps reservations and stored media in memory for the rest of the test.
+func useTestReservations(t *testing.T) *fakeReservationStore {
+	store := &fakeReservationStore{reservations: make(map[string]*fakeReservation), media: make(map[string]*types.Media)}
+
+	originalGetStore := getReservationStore
+	originalStore := storeReservedUpload
+	originalReserved := isMediaIdReserved
+	originalInUse := isMediaIdInUse
+	t.Cleanup(func() {
+		getReservationStore = originalGetStore
+		storeReservedUpload = originalStore
+		isMediaIdReserved = originalReserved
+		isMediaIdInUse = originalInUse
+	})
+
+	getReservationStore = func(ctx rcontext.RequestContext) reservationStore {
+		return store
+	}
+	storeReservedUpload = func(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, filterUserDuplicates bool, ctx rcontext.RequestContext) (*types.Media, error) {
+		if filterUserDuplicates {
+			t.Error("expected uploads to reservations to keep their media ID")
+		}
+		media := &types.Media{Origin: origin, MediaId: mediaId, UserId: userId, ContentType: contentType, SizeBytes: int64(len(dataBytes))}
+		store.media[origin+"/"+mediaId] = media
+		return media, nil
+	}
+	isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		_, _, err := store.GetMediaReservation(origin, mediaId)
+		return err == nil, nil
+	}
+	isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		_, ok := store.media[origin+"/"+mediaId]
+		return ok, nil
+	}
+	return store
+}
+
+func reservationTestContext() rcontext.RequestContext {
+	ctx := testContext()
+	ctx.Config.Uploads.MimeDetection = util.MimeDetectionGo
+	ctx.Config.Uploads.Reservations.Enabled = true
+	ctx.Config.Uploads.Reservations.ExpireAfterMinutes = 60
+	return ctx
+}
+
+func uploadToReservation(userId string, mediaId string, ctx rcontext.RequestContext) (*types.Media, error) {
+	contents := ioutil.NopCloser(strings.NewReader("hello world"))
+	return UploadMediaToReservation(contents, "text/plain", "hello.txt", userId, "example.org", mediaId, ctx)
+}
+
+func TestReserveThenUpload(t *testing.T) {
+	useTestReservations(t)
+	ctx := reservationTestContext()
+
+	mediaId, expiresTs, err := CreateMediaReservation("@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedExpiry := util.NowMillis() + time.Hour.Milliseconds()
+	if expiresTs < expectedExpiry-1000 || expiresTs > expectedExpiry {
+		t.Errorf("got expiry %d, expected about %d", expiresTs, expectedExpiry)
+	}
+
+	if _, err = uploadToReservation("@bob:example.org", mediaId, ctx); err != common.ErrMediaReservationNotOwned {
+		t.Errorf("got error %v for another user's upload, expected %v", err, common.ErrMediaReservationNotOwned)
+	}
+
+	media, err := uploadToReservation("@alice:example.org", mediaId, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media.MediaId != mediaId || media.Origin != "example.org" {
+		t.Errorf("got media %s/%s, expected example.org/%s", media.Origin, media.MediaId, mediaId)
+	}
+
+	// The media can't be overwritten once it exists
+	if _, err = uploadToReservation("@alice:example.org", mediaId, ctx); err != common.ErrMediaAlreadyUploaded {
+		t.Errorf("got error %v for a second upload, expected %v", err, common.ErrMediaAlreadyUploaded)
+	}
+
+	if _, err = uploadToReservation("@alice:example.org", "unknown", ctx); err != common.ErrMediaReservationNotFound {
+		t.Errorf("got error %v for an unknown media ID, expected %v", err, common.ErrMediaReservationNotFound)
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	store := useTestReservations(t)
+	ctx := reservationTestContext()
+
+	mediaId, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.reservations["example.org/"+mediaId].expiresTs = util.NowMillis() - 1
+
+	if _, err = uploadToReservation("@alice:example.org", mediaId, ctx); err != common.ErrMediaReservationNotFound {
+		t.Errorf("got error %v, expected %v", err, common.ErrMediaReservationNotFound)
+	}
+	if _, ok := store.media["example.org/"+mediaId]; ok {
+		t.Error("expected nothing to be stored for an expired reservation")
+	}
+}
+
+func TestMaxPendingReservations(t *testing.T) {
+	store := useTestReservations(t)
+	ctx := reservationTestContext()
+	ctx.Config.Uploads.Reservations.MaxPending = 2
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx); err != common.ErrTooManyMediaReservations {
+		t.Errorf("got error %v, expected %v", err, common.ErrTooManyMediaReservations)
+	}
+	if _, _, err := CreateMediaReservation("@bob:example.org", "example.org", ctx); err != nil {
+		t.Errorf("got error %v for another user, expected none", err)
+	}
+
+	// Expired reservations don't count towards the limit
+	for _, r := range store.reservations {
+		if r.userId == "@alice:example.org" {
+			r.expiresTs = util.NowMillis() - 1
+		}
+	}
+	if _, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx); err != nil {
+		t.Errorf("got error %v after the reservations expired, expected none", err)
+	}
+}
+
+func TestFailedUploadKeepsReservation(t *testing.T) {
+	store := useTestReservations(t)
+	ctx := reservationTestContext()
+
+	mediaId, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeErr := errors.New("datastore is down")
+	storeReservedUpload = func(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, filterUserDuplicates bool, ctx rcontext.RequestContext) (*types.Media, error) {
+		return nil, storeErr
+	}
+	if _, err = uploadToReservation("@alice:example.org", mediaId, ctx); err != storeErr {
+		t.Fatalf("got error %v, expected %v", err, storeErr)
+	}
+	if _, _, err = store.GetMediaReservation("example.org", mediaId); err != nil {
+		t.Errorf("got error %v, expected the reservation to be given back", err)
+	}
+}
+
+func TestUploadMediaToReservationNormalizesContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{contentType: "TEXT/PLAIN; charset=utf-8", expected: "text/plain"},
+		{contentType: "video/mp4; codecs=avc1.42E01E; foo=bar", expected: "video/mp4; codecs=avc1.42E01E"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			useTestReservations(t)
+			ctx := reservationTestContext()
+			ctx.Config.Uploads.ContentTypeParameters = []string{"codecs"}
+
+			mediaId, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents := ioutil.NopCloser(strings.NewReader("hello world"))
+			media, err := UploadMediaToReservation(contents, tt.contentType, "hello.txt", "@alice:example.org", "example.org", mediaId, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if media.ContentType != tt.expected {
+				t.Errorf("got %q, expected %q", media.ContentType, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMayStoreOnIpfs(t *testing.T) {
+	tests := []struct {
+		name       string
+		datastores []config.DatastoreConfig
+		expected   bool
+	}{
+		{name: "no datastores", datastores: nil, expected: false},
+		{name: "file only", datastores: []config.DatastoreConfig{{Type: "file", Enabled: true, MediaKinds: common.AllKinds}}, expected: false},
+		{name: "ipfs for local media", datastores: []config.DatastoreConfig{
+			{Type: "file", Enabled: true, MediaKinds: common.AllKinds},
+			{Type: "ipfs", Enabled: true, MediaKinds: []string{common.KindLocalMedia}},
+		}, expected: true},
+		{name: "ipfs for everything", datastores: []config.DatastoreConfig{{Type: "ipfs", Enabled: true, MediaKinds: []string{common.KindAll}}}, expected: true},
+		{name: "ipfs for remote media", datastores: []config.DatastoreConfig{{Type: "ipfs", Enabled: true, MediaKinds: []string{common.KindRemoteMedia}}}, expected: false},
+		{name: "disabled ipfs", datastores: []config.DatastoreConfig{{Type: "ipfs", Enabled: false, MediaKinds: common.AllKinds}}, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.DataStores = tt.datastores
+			if got := mayStoreOnIpfs(ctx); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReservationsUnavailableWithIpfs(t *testing.T) {
+	ctx := testContext()
+	ctx.Config.Uploads.Reservations.Enabled = true
+	ctx.Config.DataStores = []config.DatastoreConfig{{Type: "ipfs", Enabled: true, MediaKinds: common.AllKinds}}
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{name: "create", fn: func() error {
+			_, _, err := CreateMediaReservation("@alice:example.org", "example.org", ctx)
+			return err
+		}},
+		{name: "upload", fn: func() error {
+			_, err := uploadToReservation("@alice:example.org", "abc123", ctx)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); err != common.ErrMediaReservationsUnavailable {
+				t.Errorf("got error %v, expected %v", err, common.ErrMediaReservationsUnavailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package upload_controller
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/quota"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+var ErrResumableOffsetMismatch = errors.New("upload offset does not match")
+
+type ResumableUpload struct {
+	ID          string
+	UserId      string
+	Origin      string
+	Filename    string
+	ContentType string
+	Length      int64
+	Offset      int64
+	ExpiresTs   int64
+
+	tempFile string
+	lock     sync.Mutex
+}
+
+var resumableUploads = newResumableUploadCache()
+var resumableUploadsLock = &sync.Mutex{}
+
+// uploadRejections are the errors from storing an upload which mean it will never be accepted, as
+// opposed to errors which may go away if storing it is tried again.
+var uploadRejections = []error{
+	common.ErrMediaTooLarge,
+	common.ErrMediaTooLargeForType,
+	common.ErrImageTooLarge,
+	common.ErrMediaEmpty,
+	common.ErrMediaTypeDenied,
+	common.ErrMediaExtensionMismatch,
+	common.ErrContentTypeTooLong,
+	common.ErrInvalidContentType,
+	common.ErrMediaQuarantined,
+	common.ErrMediaBlocked,
+	common.ErrMediaInfected,
+	common.ErrInvalidImage,
+	common.ErrMediaCorrupt,
+	common.ErrSvgSanitizeFailed,
+	common.ErrMetadataStripFailed,
+	common.ErrQuotaExceeded,
+}
+
+// isUserWithinQuota and storeResumableMedia are swapped out by tests
+var isUserWithinQuota = quota.IsUserWithinQuota
+var storeResumableMedia = UploadMedia
+
+func newResumableUploadCache() *cache.Cache {
+	c := cache.New(time.Hour, 5*time.Minute)
+	c.OnEvicted(func(id string, v interface{}) {
+		upload := v.(*ResumableUpload)
+		if err := os.Remove(upload.tempFile); err != nil && !os.IsNotExist(err) {
+			logrus.Warn("Failed to remove temporary file for resumable upload ", id, ": ", err)
+		}
+	})
+	return c
+}
+
+func expiryOf(ctx rcontext.RequestContext) time.Duration {
+	return time.Duration(ctx.Config.Uploads.Resumable.ExpireAfterMinutes) * time.Minute
+}
+
+func isUploadRejected(err error) bool {
+	for _, rejection := range uploadRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+func countResumableUploads(userId string) int {
+	count := 0
+	for _, item := range resumableUploads.Items() {
+		if item.Object.(*ResumableUpload).UserId == userId {
+			count++
+		}
+	}
+	return count
+}
+
+func CreateResumableUpload(length int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*ResumableUpload, error) {
+	resumableUploadsLock.Lock()
+	defer resumableUploadsLock.Unlock()
+
+	maxPending := ctx.Config.Uploads.Resumable.MaxPending
+	if maxPending > 0 {
+		if pending := countResumableUploads(userId); pending >= maxPending {
+			ctx.Log.Warnf("User already has %d resumable uploads in progress", pending)
+			return nil, common.ErrTooManyResumableUploads
+		}
+	}
+
+	id, err := util.GenerateRandomString(64)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(ctx.Config.Uploads.Resumable.TempPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	tempFile := path.Join(ctx.Config.Uploads.Resumable.TempPath, id)
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+
+	upload := &ResumableUpload{
+		ID:          id,
+		UserId:      userId,
+		Origin:      origin,
+		Filename:    filename,
+		ContentType: contentType,
+		Length:      length,
+		Offset:      0,
+		ExpiresTs:   util.NowMillis() + expiryOf(ctx).Milliseconds(),
+		tempFile:    tempFile,
+	}
+	resumableUploads.Set(id, upload, expiryOf(ctx))
+
+	ctx.Log.Info("Created resumable upload ", id)
+	return upload, nil
+}
+
+// GetResumableUpload returns the in-progress upload with the given ID, or nil if the upload
+// does not exist or belongs to a different user.
+func GetResumableUpload(id string, userId string) *ResumableUpload {
+	v, found := resumableUploads.Get(id)
+	if !found {
+		return nil
+	}
+	upload := v.(*ResumableUpload)
+	if upload.UserId != userId {
+		return nil
+	}
+	return upload
+}
+
+// AppendToResumableUpload writes the given contents to the upload at the given offset. When the
+// upload is complete, it is stored as regular media and the resulting record is returned. If storing
+// the media fails for a reason other than the media being rejected, the upload is kept so storing it
+// can be tried again by appending nothing at the final offset.
+func AppendToResumableUpload(upload *ResumableUpload, offset int64, contents io.Reader, ctx rcontext.RequestContext) (*types.Media, error) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+
+	if offset != upload.Offset {
+		return nil, ErrResumableOffsetMismatch
+	}
+
+	f, err := os.OpenFile(upload.tempFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record whatever we managed to write, even on error, so the client can resume from there
+	written, err := io.Copy(f, io.LimitReader(contents, upload.Length-upload.Offset))
+	upload.Offset += written
+	upload.ExpiresTs = util.NowMillis() + expiryOf(ctx).Milliseconds()
+	resumableUploads.Set(upload.ID, upload, expiryOf(ctx))
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.Offset < upload.Length {
+		return nil, nil
+	}
+
+	ctx.Log.Info("Resumable upload ", upload.ID, " is complete - storing media")
+	media, err := storeResumableUpload(upload, ctx)
+	if err == nil || isUploadRejected(err) {
+		resumableUploads.Delete(upload.ID)
+	}
+	return media, err
+}
+
+func storeResumableUpload(upload *ResumableUpload, ctx rcontext.RequestContext) (*types.Media, error) {
+	// The quota was checked when the upload was created, but the user may have uploaded other
+	// media since then.
+	inQuota, err := isUserWithinQuota(ctx, upload.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if !inQuota {
+		return nil, common.ErrQuotaExceeded
+	}
+
+	f, err := os.Open(upload.tempFile)
+	if err != nil {
+		return nil, err
+	}
+	return storeResumableMedia(f, upload.Length, upload.ContentType, upload.Filename, upload.UserId, upload.Origin, ctx)
+}
+
+func CancelResumableUpload(upload *ResumableUpload) {
+	resumableUploads.Delete(upload.ID)
+}
@@ -0,0 +1,199 @@
+package upload_controller
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func resumableTestContext(t *testing.T) rcontext.RequestContext {
+	ctx := testContext()
+	ctx.Config.Uploads.Resumable.Enabled = true
+	ctx.Config.Uploads.Resumable.TempPath = t.TempDir()
+	ctx.Config.Uploads.Resumable.ExpireAfterMinutes = 60
+	return ctx
+}
+
+func TestResumableUploadAppend(t *testing.T) {
+	ctx := resumableTestContext(t)
+
+	upload, err := CreateResumableUpload(10, "text/plain", "test.txt", "@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CancelResumableUpload(upload)
+
+	if GetResumableUpload(upload.ID, "@alice:example.org") != upload {
+		t.Fatal("expected to find the upload")
+	}
+	if GetResumableUpload(upload.ID, "@bob:example.org") != nil {
+		t.Error("expected the upload to be hidden from other users")
+	}
+
+	media, err := AppendToResumableUpload(upload, 0, strings.NewReader("hello"), ctx)
+	if err != nil || media != nil {
+		t.Fatalf("got (%v, %v), expected an incomplete upload", media, err)
+	}
+	if upload.Offset != 5 {
+		t.Errorf("got offset %d, expected 5", upload.Offset)
+	}
+
+	_, err = AppendToResumableUpload(upload, 2, strings.NewReader("world"), ctx)
+	if err != ErrResumableOffsetMismatch {
+		t.Errorf("got %v, expected an offset mismatch", err)
+	}
+	if upload.Offset != 5 {
+		t.Errorf("got offset %d after a mismatch, expected 5", upload.Offset)
+	}
+
+	b, err := ioutil.ReadFile(upload.tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("got %q in the temporary file, expected %q", b, "hello")
+	}
+}
+
+func TestResumableUploadRemovesTempFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(upload *ResumableUpload)
+	}{
+		{
+			name: "cancelled",
+			remove: func(upload *ResumableUpload) {
+				CancelResumableUpload(upload)
+			},
+		},
+		{
+			name: "expired",
+			remove: func(upload *ResumableUpload) {
+				resumableUploads.Set(upload.ID, upload, time.Millisecond)
+				time.Sleep(5 * time.Millisecond)
+				resumableUploads.DeleteExpired()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := resumableTestContext(t)
+
+			upload, err := CreateResumableUpload(10, "text/plain", "test.txt", "@alice:example.org", "example.org", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = AppendToResumableUpload(upload, 0, strings.NewReader("hello"), ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.remove(upload)
+
+			if GetResumableUpload(upload.ID, "@alice:example.org") != nil {
+				t.Error("expected the upload to be gone")
+			}
+			if _, err = os.Stat(upload.tempFile); !os.IsNotExist(err) {
+				t.Errorf("expected the temporary file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResumableUploadQuotaRechecked(t *testing.T) {
+	ctx := resumableTestContext(t)
+
+	defer func(orig func(rcontext.RequestContext, string) (bool, error)) { isUserWithinQuota = orig }(isUserWithinQuota)
+	isUserWithinQuota = func(ctx rcontext.RequestContext, userId string) (bool, error) {
+		return false, nil
+	}
+
+	upload, err := CreateResumableUpload(5, "text/plain", "test.txt", "@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := AppendToResumableUpload(upload, 0, strings.NewReader("hello"), ctx)
+	if err != common.ErrQuotaExceeded {
+		t.Fatalf("got (%v, %v), expected the quota to be exceeded", media, err)
+	}
+	if _, err = os.Stat(upload.tempFile); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestResumableUploadKeptAfterStoreFailure(t *testing.T) {
+	ctx := resumableTestContext(t)
+
+	storeErr := errors.New("database unavailable")
+	defer func(orig func(io.ReadCloser, int64, string, string, string, string, rcontext.RequestContext) (*types.Media, error)) {
+		storeResumableMedia = orig
+	}(storeResumableMedia)
+	storeResumableMedia = func(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.Media, error) {
+		defer contents.Close()
+		if storeErr != nil {
+			return nil, storeErr
+		}
+		return &types.Media{Origin: origin, MediaId: "stored"}, nil
+	}
+
+	upload, err := CreateResumableUpload(5, "text/plain", "test.txt", "@alice:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := AppendToResumableUpload(upload, 0, strings.NewReader("hello"), ctx)
+	if err != storeErr {
+		t.Fatalf("got (%v, %v), expected the store to fail", media, err)
+	}
+	if GetResumableUpload(upload.ID, "@alice:example.org") != upload {
+		t.Fatal("expected the upload to be kept after a failure which may go away")
+	}
+	if _, err = os.Stat(upload.tempFile); err != nil {
+		t.Fatalf("expected the temporary file to be kept, got %v", err)
+	}
+
+	// Appending nothing at the final offset tries storing the upload again
+	storeErr = nil
+	media, err = AppendToResumableUpload(upload, 5, strings.NewReader(""), ctx)
+	if err != nil || media == nil || media.MediaId != "stored" {
+		t.Fatalf("got (%v, %v), expected the upload to be stored", media, err)
+	}
+	if GetResumableUpload(upload.ID, "@alice:example.org") != nil {
+		t.Error("expected the upload to be gone once stored")
+	}
+	if _, err = os.Stat(upload.tempFile); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestResumableUploadMaxPending(t *testing.T) {
+	ctx := resumableTestContext(t)
+	ctx.Config.Uploads.Resumable.MaxPending = 2
+
+	for i := 0; i < 2; i++ {
+		upload, err := CreateResumableUpload(10, "text/plain", "test.txt", "@pending:example.org", "example.org", ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer CancelResumableUpload(upload)
+	}
+
+	if _, err := CreateResumableUpload(10, "text/plain", "test.txt", "@pending:example.org", "example.org", ctx); err != common.ErrTooManyResumableUploads {
+		t.Errorf("got error %v, expected %v", err, common.ErrTooManyResumableUploads)
+	}
+
+	// Other users have their own limit
+	upload, err := CreateResumableUpload(10, "text/plain", "test.txt", "@other:example.org", "example.org", ctx)
+	if err != nil {
+		t.Fatalf("got error %v for another user, expected the upload to be created", err)
+	}
+	CancelResumableUpload(upload)
+}
@@ -0,0 +1,93 @@
+package upload_controller
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/scanners"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+)
+
+type fakeScanner struct {
+	clean   bool
+	reason  string
+	err     error
+	scanned []byte
+}
+
+func (s *fakeScanner) Scan(path string) (bool, string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, "", err
+	}
+	s.scanned = b
+	return s.clean, s.reason, s.err
+}
+
+func TestRejectInfected(t *testing.T) {
+	contents := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+
+	tests := []struct {
+		name       string
+		scanner    *fakeScanner
+		kind       string
+		wantErr    error
+		wantStored bool
+		wantScan   bool
+	}{
+		{name: "infected", scanner: &fakeScanner{clean: false, reason: "Eicar-Signature"}, kind: common.KindLocalMedia, wantErr: common.ErrMediaInfected, wantStored: false, wantScan: true},
+		{name: "clean", scanner: &fakeScanner{clean: true}, kind: common.KindLocalMedia, wantStored: true, wantScan: true},
+		{name: "scanner error", scanner: &fakeScanner{err: errors.New("clamd went away")}, kind: common.KindLocalMedia, wantErr: errors.New("clamd went away"), wantStored: false, wantScan: true},
+		{name: "remote media isn't scanned", scanner: &fakeScanner{clean: false}, kind: common.KindRemoteMedia, wantStored: true, wantScan: false},
+		{name: "no scanner", kind: common.KindLocalMedia, wantStored: true, wantScan: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mmr-scan-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			defer func(original func(config.ScannerConfig) (scanners.Scanner, error)) {
+				getScanner = original
+			}(getScanner)
+			getScanner = func(config.ScannerConfig) (scanners.Scanner, error) {
+				if tt.scanner == nil {
+					return nil, nil
+				}
+				return tt.scanner, nil
+			}
+
+			ctx := testContext()
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: dir}
+			info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = rejectInfected(ds, info.Location, contents, tt.kind, ctx)
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(path.Join(dir, info.Location))
+			if stored := statErr == nil; stored != tt.wantStored {
+				t.Errorf("got stored = %t, expected %t", stored, tt.wantStored)
+			}
+			if tt.scanner != nil {
+				if scanned := tt.scanner.scanned != nil; scanned != tt.wantScan {
+					t.Errorf("got scanned = %t, expected %t", scanned, tt.wantScan)
+				} else if scanned && !bytes.Equal(tt.scanner.scanned, contents) {
+					t.Errorf("scanner was given different contents to the upload")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package upload_controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func TestUploaderTokenHash(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("pepper"))
+	mac.Write([]byte("secret_token"))
+	tokenHash := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name          string
+		enabled       bool
+		kind          string
+		authorization string
+		url           string
+		noRequest     bool
+		expected      string
+	}{
+		{name: "header token", enabled: true, kind: common.KindLocalMedia, authorization: "Bearer secret_token", url: "/upload", expected: tokenHash},
+		{name: "query token", enabled: true, kind: common.KindLocalMedia, url: "/upload?access_token=secret_token", expected: tokenHash},
+		{name: "disabled", enabled: false, kind: common.KindLocalMedia, authorization: "Bearer secret_token", url: "/upload", expected: ""},
+		{name: "remote media", enabled: true, kind: common.KindRemoteMedia, authorization: "Bearer secret_token", url: "/upload", expected: ""},
+		{name: "no token", enabled: true, kind: common.KindLocalMedia, url: "/upload", expected: ""},
+		{name: "no request", enabled: true, kind: common.KindLocalMedia, noRequest: true, expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.TokenAudit.Enabled = tt.enabled
+			ctx.Config.Uploads.TokenAudit.Salt = "pepper"
+			if !tt.noRequest {
+				ctx.Request = httptest.NewRequest("POST", tt.url, nil)
+				if tt.authorization != "" {
+					ctx.Request.Header.Set("Authorization", tt.authorization)
+				}
+			}
+
+			got := uploaderTokenHash(tt.kind, ctx)
+			if got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+			if got == "secret_token" {
+				t.Error("the access token was returned as-is")
+			}
+		})
+	}
+}
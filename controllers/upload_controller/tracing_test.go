@@ -0,0 +1,144 @@
+package upload_controller
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// spanRecorder keeps ended spans in memory.
+type spanRecorder struct {
+	lock  sync.Mutex
+	ended []sdktrace.ReadOnlySpan
+}
+
+func (r *spanRecorder) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+}
+
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ended = append(r.ended, s)
+}
+
+func (r *spanRecorder) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (r *spanRecorder) ForceFlush() {
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestUploadMediaSpans(t *testing.T) {
+	recorder := &spanRecorder{}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(provider)
+
+	ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+	defer func(original func(string, int64, string, string, rcontext.RequestContext) (*datastore.DatastoreRef, error)) {
+		selectDatastore = original
+	}(selectDatastore)
+	selectDatastore = func(forKind string, size int64, contentType string, origin string, ctx rcontext.RequestContext) (*datastore.DatastoreRef, error) {
+		return ds, nil
+	}
+	defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+		isMediaIdReserved = original
+	}(isMediaIdReserved)
+	isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+	defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+		isMediaIdInUse = original
+	}(isMediaIdInUse)
+	isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+	// Stop the upload before it reaches the database
+	defer func(original func(string, rcontext.RequestContext) (bool, error)) {
+		isHashBlocked = original
+	}(isHashBlocked)
+	isHashBlocked = func(sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+		return true, nil
+	}
+
+	ctx := testContext()
+	ctx.Config.Uploads.MaxSizeBytes = 1024
+	root, parent := provider.Tracer("test").Start(context.Background(), "request")
+	ctx.Context = root
+
+	contents := []byte("hello world, this is traced")
+	_, err := UploadMedia(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), "text/plain", "hello.txt", "@alice:example.org", "example.org", ctx)
+	parent.End()
+	if err != common.ErrMediaBlocked {
+		t.Fatalf("got %v, expected the upload to be blocked", err)
+	}
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.ended {
+		spans[s.Name()] = append(spans[s.Name()], s)
+	}
+	if len(spans["request"]) != 1 || len(spans["UploadMedia"]) != 1 {
+		t.Fatalf("expected one request and one UploadMedia span, got %v", spans)
+	}
+	request := spans["request"][0]
+	upload := spans["UploadMedia"][0]
+	if upload.Parent().SpanID != request.SpanContext().SpanID {
+		t.Error("expected UploadMedia to be a child of the request")
+	}
+	if upload.StatusCode() != codes.Error {
+		t.Error("expected UploadMedia to record the error")
+	}
+	if v, ok := spanAttribute(upload, "media.content_type"); !ok || v.AsString() != "text/plain" {
+		t.Errorf("got content type attribute %v, expected text/plain", v.AsString())
+	}
+	if v, ok := spanAttribute(upload, "media.content_length"); !ok || v.AsInt64() != int64(len(contents)) {
+		t.Errorf("got content length attribute %d, expected %d", v.AsInt64(), len(contents))
+	}
+
+	// The mime type is detected when reading the upload and again when storing it
+	tests := []struct {
+		name  string
+		count int
+	}{
+		{name: "GetMimeType", count: 2},
+		{name: "PersistFile", count: 1},
+	}
+	for _, tt := range tests {
+		if len(spans[tt.name]) != tt.count {
+			t.Errorf("got %d %s spans, expected %d", len(spans[tt.name]), tt.name, tt.count)
+		}
+		for _, s := range spans[tt.name] {
+			if s.Parent().SpanID != upload.SpanContext().SpanID {
+				t.Errorf("expected %s to be a child of UploadMedia", tt.name)
+			}
+		}
+	}
+
+	persist := spans["PersistFile"][0]
+	if v, ok := spanAttribute(persist, "media.size_bytes"); !ok || v.AsInt64() != int64(len(contents)) {
+		t.Errorf("got size attribute %d, expected %d", v.AsInt64(), len(contents))
+	}
+	if v, ok := spanAttribute(persist, "datastore.id"); !ok || v.AsString() != "test" {
+		t.Errorf("got datastore attribute %q, expected test", v.AsString())
+	}
+}
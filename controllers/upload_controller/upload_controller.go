@@ -1,26 +1,45 @@
 package upload_controller
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"io"
 	"io/ioutil"
+	"mime"
+	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/internal_cache"
+	"github.com/turt2live/matrix-media-repo/metrics"
 	"github.com/turt2live/matrix-media-repo/plugins"
+	"github.com/turt2live/matrix-media-repo/scanners"
 	"github.com/turt2live/matrix-media-repo/storage"
 	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/storage/last_access"
+	"github.com/turt2live/matrix-media-repo/tracing"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
 	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+	"github.com/turt2live/matrix-media-repo/util/util_exif"
+	"github.com/turt2live/matrix-media-repo/util/util_svg"
+	"github.com/turt2live/matrix-media-repo/webhooks"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const NoApplicableUploadUser = ""
@@ -74,6 +93,71 @@ func IsRequestTooSmall(contentLength int64, contentLengthHeader string, ctx rcon
 	return false // We can only assume
 }
 
+func IsTooLargeForType(sizeBytes int64, contentType string, ctx rcontext.RequestContext) bool {
+	var limit int64 = -1
+	for typeGlob, maxBytes := range ctx.Config.Uploads.MaxSizeByType {
+		if maxBytes <= 0 || !glob.Glob(typeGlob, contentType) {
+			continue
+		}
+		if limit < 0 || maxBytes < limit {
+			limit = maxBytes
+		}
+	}
+
+	return limit >= 0 && sizeBytes > limit
+}
+
+// IsTypeDenied determines if the content type is not allowed to be uploaded. This should be given
+// the detected content type of the upload, as clients can claim any type.
+func IsTypeDenied(contentType string, ctx rcontext.RequestContext) bool {
+	return util.GlobMatchesAny(ctx.Config.Uploads.DeniedTypes, contentType)
+}
+
+// ValidateUploadMetadata rejects uploads with a content type or uploader which shouldn't be stored,
+// such as absurdly long or malformed values. This is only applied to uploads made by clients, as
+// media the media repo stores on its own behalf (like URL preview images) comes from elsewhere.
+func ValidateUploadMetadata(contentType string, userId string, ctx rcontext.RequestContext) error {
+	if ctx.Config.Uploads.MaxContentTypeLength > 0 && len(contentType) > ctx.Config.Uploads.MaxContentTypeLength {
+		ctx.Log.Warnf("Rejecting upload with a content type of %d characters", len(contentType))
+		return common.ErrContentTypeTooLong
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		ctx.Log.Warn("Rejecting upload with an invalid content type: ", err)
+		return common.ErrInvalidContentType
+	}
+	if userId != NoApplicableUploadUser && !util.IsValidUserId(userId) {
+		ctx.Log.Warn("Rejecting upload from an invalid user ID")
+		return common.ErrInvalidUserId
+	}
+	return nil
+}
+
+// detectContentType detects the content type of an upload, using the configured fallback type
+// for uploads which can't be identified.
+func detectContentType(b []byte, ctx rcontext.RequestContext) string {
+	contentType := util.DetectContentTypeUsing(b, ctx.Config.Uploads.MimeDetection)
+	if contentType == "application/octet-stream" && ctx.Config.Uploads.UnknownTypeFallback != "" {
+		ctx.Log.Info("Unable to identify the upload's content type - using fallback type ", ctx.Config.Uploads.UnknownTypeFallback)
+		return ctx.Config.Uploads.UnknownTypeFallback
+	}
+	return contentType
+}
+
+// IsExtensionMismatched determines if the upload's filename has an extension which doesn't match
+// its detected content type, when uploads are required to match.
+func IsExtensionMismatched(filename string, contentType string, ctx rcontext.RequestContext) bool {
+	if !ctx.Config.Uploads.EnforceExtensionMatch {
+		return false
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	for _, exempt := range ctx.Config.Uploads.ExtensionMatchExemptions {
+		if strings.ToLower(strings.TrimPrefix(exempt, ".")) == ext {
+			return false
+		}
+	}
+	return !util.ExtensionMatchesContentType(filename, contentType)
+}
+
 func EstimateContentLength(contentLength int64, contentLengthHeader string) int64 {
 	if contentLength >= 0 {
 		return contentLength
@@ -92,58 +176,228 @@ func EstimateContentLength(contentLength int64, contentLengthHeader string) int6
 	return -1 // unknown
 }
 
+// withUploadPolicy applies the anonymous upload policy to uploads which aren't made by a user.
+func withUploadPolicy(userId string, ctx rcontext.RequestContext) rcontext.RequestContext {
+	if userId == NoApplicableUploadUser {
+		ctx.Config.Uploads = config.UploadsForAnonymous(ctx.Config.Uploads)
+	}
+	return ctx
+}
+
 func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string, filename string, userId string, origin string, ctx rcontext.RequestContext) (*types.Media, error) {
 	defer cleanup.DumpAndCloseStream(contents)
 
+	ctx = withUploadPolicy(userId, ctx)
+	contentType = util.NormalizeContentType(contentType, ctx.Config.Uploads.ContentTypeParameters)
+
+	start := time.Now()
+	defer func() {
+		metrics.UploadDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	ctx, span := tracing.StartSpan(ctx, "UploadMedia",
+		attribute.Int64("media.content_length", contentLength),
+		attribute.String("media.content_type", contentType),
+		attribute.String("media.origin", origin))
+	var err error
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	filename = util.SanitizeFilename(filename, ctx.Config.Uploads.MaxFilenameLength)
+
+	dataBytes, sanitized, err := readUpload(contents, contentType, filename, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaId, err := generateMediaId(origin, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := storeUpload(dataBytes, sanitized, contentType, filename, userId, origin, mediaId, true, ctx)
+	if media != nil {
+		span.SetAttributes(attribute.Int64("media.size_bytes", media.SizeBytes), attribute.String("media.sha256", media.Sha256Hash))
+	}
+	return media, err
+}
+
+// readUpload reads and pre-processes the upload, applying any limits which don't require the media to be stored.
+// The returned flag is true if the upload is an SVG which was sanitized.
+func readUpload(contents io.ReadCloser, contentType string, filename string, ctx rcontext.RequestContext) ([]byte, bool, error) {
 	var data io.ReadCloser
 	if ctx.Config.Uploads.MaxSizeBytes > 0 {
-		data = ioutil.NopCloser(io.LimitReader(contents, ctx.Config.Uploads.MaxSizeBytes))
+		// Read one byte past the limit so oversized uploads are rejected rather than truncated
+		data = ioutil.NopCloser(util.LimitPastMax(contents, ctx.Config.Uploads.MaxSizeBytes))
 	} else {
 		data = contents
 	}
 
 	dataBytes, err := ioutil.ReadAll(data)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if len(dataBytes) == 0 {
+		return nil, false, common.ErrMediaEmpty
+	}
+	if ctx.Config.Uploads.MaxSizeBytes > 0 && int64(len(dataBytes)) > ctx.Config.Uploads.MaxSizeBytes {
+		ctx.Log.Warnf("Upload is larger than the maximum of %d bytes", ctx.Config.Uploads.MaxSizeBytes)
+		return nil, false, common.ErrMediaTooLarge
+	}
+
+	if ctx.Config.Uploads.StripMetadata || ctx.Config.Uploads.RecompressImages || ctx.Config.Uploads.ValidateImages {
+		// Processing images can require decoding them, so don't let oversized images through
+		width, height, err := util.GetImageDimensions(dataBytes)
+		if err == nil && util.ExceedsMaxPixels(width, height, ctx.Config.Thumbnails.MaxPixels) {
+			ctx.Log.Warnf("Upload declares image dimensions of %dx%d, which is more than the maximum of %d pixels", width, height, ctx.Config.Thumbnails.MaxPixels)
+			return nil, false, common.ErrImageTooLarge
+		}
+	}
+
+	if ctx.Config.Uploads.StripMetadata {
+		// Strip before anything else so the hash (and therefore de-duplication) is of the cleaned file
+		stripped, err := util_exif.StripMetadata(dataBytes)
+		if err != nil {
+			ctx.Log.Warn("Failed to strip metadata from upload: " + err.Error())
+			return nil, false, common.ErrMetadataStripFailed
+		}
+		dataBytes = stripped
 	}
 
+	if ctx.Config.Uploads.RecompressImages {
+		recompressed, err := recompressImage(dataBytes, ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		dataBytes = recompressed
+	}
+
+	_, span := tracing.StartSpan(ctx, "GetMimeType")
+	detectedType := detectContentType(dataBytes, ctx)
+	span.End()
+
+	if IsTypeDenied(detectedType, ctx) {
+		ctx.Log.Warn("Rejecting upload with denied content type: ", detectedType)
+		return nil, false, common.ErrMediaTypeDenied
+	}
+	if IsExtensionMismatched(filename, detectedType, ctx) {
+		ctx.Log.Warn("Rejecting upload with an extension which doesn't match the detected content type: ", detectedType)
+		return nil, false, common.ErrMediaExtensionMismatch
+	}
+	svgSanitized := false
+	// Clients can claim an upload is an SVG regardless of what it looks like, so check both types
+	if ctx.Config.Uploads.SanitizeSvg && (util.IsSvgContentType(detectedType) || util.IsSvgContentType(contentType)) {
+		sanitized, err := util_svg.Sanitize(dataBytes)
+		if err != nil {
+			ctx.Log.Warn("Failed to sanitize SVG upload: " + err.Error())
+			return nil, false, common.ErrSvgSanitizeFailed
+		}
+		dataBytes = sanitized
+		svgSanitized = true
+	}
+	if IsTooLargeForType(int64(len(dataBytes)), detectedType, ctx) {
+		return nil, false, common.ErrMediaTooLargeForType
+	}
+
+	if ctx.Config.Uploads.ValidateImages {
+		err = validateImage(dataBytes, detectedType, ctx)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return dataBytes, svgSanitized, nil
+}
+
+// isMediaIdReserved is swapped out by tests
+var isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
 	metadataDb := storage.GetDatabase().GetMetadataStore(ctx)
+	reserved, err := metadataDb.IsReserved(origin, mediaId)
+	if err != nil || reserved {
+		return reserved, err
+	}
 
+	// Media created by clients ahead of uploading it doesn't exist yet, but its ID is still taken
+	_, _, err = metadataDb.GetMediaReservation(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// isMediaIdInUse is swapped out by tests
+var isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+	_, err := storage.GetDatabase().GetMediaStore(ctx).Get(origin, mediaId)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func generateMediaId(origin string, ctx rcontext.RequestContext) (string, error) {
 	mediaTaken := true
 	var mediaId string
+	var err error
 	attempts := 0
 	for mediaTaken {
 		attempts += 1
 		if attempts > 10 {
-			return nil, errors.New("failed to generate a media ID after 10 rounds")
+			return "", errors.New("failed to generate a media ID after 10 rounds")
 		}
 
-		mediaId, err = util.GenerateRandomString(64)
-		if err != nil {
-			return nil, err
-		}
-		mediaId, err = util.GetSha1OfString(mediaId + strconv.FormatInt(util.NowMillis(), 10))
-		if err != nil {
-			return nil, err
+		if ctx.Config.Uploads.MediaIdLength > 0 {
+			mediaId, err = util.GenerateRandomStringFromAlphabet(ctx.Config.Uploads.MediaIdLength, ctx.Config.Uploads.MediaIdAlphabet)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			mediaId, err = util.GenerateRandomString(64)
+			if err != nil {
+				return "", err
+			}
+			mediaId, err = util.GetSha1OfString(mediaId + strconv.FormatInt(util.NowMillis(), 10))
+			if err != nil {
+				return "", err
+			}
 		}
 
-		// Because we use the current time in the media ID, we don't need to worry about
-		// collisions from the database.
 		if _, present := recentMediaIds.Get(mediaId); present {
 			mediaTaken = true
 			continue
 		}
 
-		mediaTaken, err = metadataDb.IsReserved(origin, mediaId)
+		mediaTaken, err = isMediaIdReserved(origin, mediaId, ctx)
 		if err != nil {
-			return nil, err
+			return "", err
+		}
+		if mediaTaken {
+			continue
+		}
+
+		// Shorter media IDs can collide with ones already in use, so try again if that happens
+		mediaTaken, err = isMediaIdInUse(origin, mediaId, ctx)
+		if err != nil {
+			return "", err
+		}
+		if mediaTaken {
+			ctx.Log.Warn("Generated media ID is already in use, trying again: ", mediaId)
 		}
 	}
 
 	_ = recentMediaIds.Add(mediaId, true, cache.DefaultExpiration)
 
+	return mediaId, nil
+}
+
+// selectDatastore is swapped out by tests
+var selectDatastore = datastore.SelectDatastore
+
+func storeUpload(dataBytes []byte, sanitized bool, contentType string, filename string, userId string, origin string, mediaId string, filterUserDuplicates bool, ctx rcontext.RequestContext) (*types.Media, error) {
+	contentLength := int64(len(dataBytes))
+
 	var existingFile *AlreadyUploadedFile = nil
-	ds, err := datastore.PickDatastore(common.KindLocalMedia, ctx)
+	ds, err := selectDatastore(common.KindLocalMedia, contentLength, contentType, origin, ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -160,10 +414,20 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 		mediaId = fmt.Sprintf("ipfs:%s", info.Location[len("ipfs/"):])
 	}
 
-	m, err := StoreDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, true)
+	m, err := StoreDirect(existingFile, util_byte_seeker.NewByteSeeker(dataBytes), contentLength, contentType, filename, userId, origin, mediaId, common.KindLocalMedia, ctx, filterUserDuplicates)
 	if err != nil {
 		return m, err
 	}
+	if m != nil && sanitized && !m.Sanitized {
+		err = storage.GetDatabase().GetMediaStore(ctx).SetSanitized(m.Origin, m.MediaId, true)
+		if err != nil {
+			// Not fatal - the media is just downloaded as an attachment instead
+			ctx.Log.Warn("Unexpected error recording that the media was sanitized: " + err.Error())
+			sentry.CaptureException(err)
+		} else {
+			m.Sanitized = true
+		}
+	}
 	if m != nil {
 		err = internal_cache.Get().UploadMedia(m.Sha256Hash, util_byte_seeker.NewByteSeeker(dataBytes), ctx)
 		if err != nil {
@@ -174,10 +438,7 @@ func UploadMedia(contents io.ReadCloser, contentLength int64, contentType string
 }
 
 func trackUploadAsLastAccess(ctx rcontext.RequestContext, media *types.Media) {
-	err := storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(media.Sha256Hash, util.NowMillis())
-	if err != nil {
-		logrus.Warn("Failed to upsert the last access time: ", err)
-	}
+	last_access.Track(media.Sha256Hash, ctx)
 }
 
 func checkSpam(contents []byte, filename string, contentType string, userId string, origin string, mediaId string) error {
@@ -193,26 +454,196 @@ func checkSpam(contents []byte, filename string, contentType string, userId stri
 	return nil
 }
 
+// getScanner is swapped out by tests
+var getScanner = scanners.GetScanner
+
+func checkInfected(contents []byte, ctx rcontext.RequestContext) error {
+	scanner, err := getScanner(ctx.Config.Uploads.Scanner)
+	if err != nil {
+		return err
+	}
+	if scanner == nil {
+		return nil
+	}
+
+	// Scanners work on files, but the upload might not be in a local datastore
+	f, err := ioutil.TempFile("", "mmr-scan")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(contents)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	clean, reason, err := scanner.Scan(f.Name())
+	if err != nil {
+		return err
+	}
+	if !clean {
+		ctx.Log.Warn("Scanner rejected upload: " + reason)
+		return common.ErrMediaInfected
+	}
+	return nil
+}
+
+// isHashBlocked and isHashQuarantined are swapped out by tests
+var isHashBlocked = func(sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).IsHashBlocked(sha256Hash)
+}
+var isHashQuarantined = func(sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).IsQuarantined(sha256Hash)
+}
+
+// checkHashAllowed returns ErrMediaBlocked if the media's hash is on the blocklist. Blocklists are
+// usually made of SHA-256 hashes, and media quarantined before the hash algorithm was changed only
+// has its SHA-256 hash recorded, so media hashed with another algorithm also has its SHA-256 hash
+// checked against the blocklist and quarantined media. Quarantined media with the same hash as the
+// media is found when looking for duplicates.
+func checkHashAllowed(hash string, contentBytes []byte, ctx rcontext.RequestContext) error {
+	hashes := []string{hash}
+	sha256Hash := ""
+	if util.HashAlgorithmOf(hash) != config.HashAlgorithmSha256 {
+		var err error
+		sha256Hash, err = util.GetHashOfStreamWith(config.HashAlgorithmSha256, util_byte_seeker.NewByteSeeker(contentBytes))
+		if err != nil {
+			return errors.Wrap(err, "error calculating sha256 hash")
+		}
+		hashes = append(hashes, sha256Hash)
+	}
+
+	for _, h := range hashes {
+		blocked, err := isHashBlocked(h, ctx)
+		if err != nil {
+			return errors.Wrap(err, "error checking hash blocklist")
+		}
+		if blocked {
+			ctx.Log.Warn("Media hash is blocked - rejecting")
+			return common.ErrMediaBlocked
+		}
+	}
+
+	if sha256Hash != "" {
+		quarantined, err := isHashQuarantined(sha256Hash, ctx)
+		if err != nil {
+			return errors.Wrap(err, "error checking quarantined media")
+		}
+		if quarantined {
+			ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
+			return common.ErrMediaQuarantined
+		}
+	}
+
+	return nil
+}
+
+// rejectInfected scans local uploads, deleting the stored object if the scanner rejects it.
+func rejectInfected(ds *datastore.DatastoreRef, location string, contents []byte, kind string, ctx rcontext.RequestContext) error {
+	if kind != common.KindLocalMedia {
+		return nil
+	}
+
+	err := checkInfected(contents, ctx)
+	if err != nil {
+		ds.DeleteObject(location) // delete temp object
+	}
+	return err
+}
+
+// canonicalContentType picks the content type to store for the media. Local uploads can use the
+// detected content type rather than trusting the type reported by the client.
+func canonicalContentType(reportedContentType string, contentBytes []byte, kind string, ctx rcontext.RequestContext) string {
+	if kind != common.KindLocalMedia || !ctx.Config.Uploads.UseDetectedContentType {
+		return reportedContentType
+	}
+
+	contentType := detectContentType(contentBytes, ctx)
+	if contentType != reportedContentType {
+		ctx.Log.Info(fmt.Sprintf("Using detected content type %s instead of reported type %s", contentType, reportedContentType))
+	}
+	return contentType
+}
+
+// scopeDuplicates limits the records which media can be de-duplicated against to those allowed by
+// the configured de-duplication scope and uploads.noDedupTypes. Quarantined media is considered
+// regardless of scope.
+func scopeDuplicates(records []*types.Media, origin string, userId string, mediaId string, contentType string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+	// Some types always get their own file, so only consider the record being stored
+	noDedup := util.GlobMatchesAny(ctx.Config.Uploads.NoDedupTypes, contentType)
+
+	scope := ctx.Config.Uploads.DeduplicationScope
+	if !noDedup && (scope == "" || scope == common.DedupeScopeGlobal) {
+		return records, nil
+	}
+
+	scoped := make([]*types.Media, 0)
+	for _, record := range records {
+		if record.Quarantined {
+			ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
+			return nil, common.ErrMediaQuarantined
+		}
+		if noDedup {
+			if record.Origin == origin && record.MediaId == mediaId {
+				scoped = append(scoped, record)
+			}
+			continue
+		}
+		if record.Origin != origin {
+			continue
+		}
+		if scope == common.DedupeScopeUser && record.UserId != userId {
+			continue
+		}
+		scoped = append(scoped, record)
+	}
+
+	return scoped, nil
+}
+
 func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize int64, contentType string, filename string, userId string, origin string, mediaId string, kind string, ctx rcontext.RequestContext, filterUserDuplicates bool) (*types.Media, error) {
+	if !beginStore() {
+		if f == nil {
+			cleanup.DumpAndCloseStream(contents)
+		}
+		return nil, common.ErrShuttingDown
+	}
+	defer endStore()
+
 	var err error
 	var ds *datastore.DatastoreRef
 	var info *types.ObjectInfo
 	var contentBytes []byte
 	if f == nil {
-		dsPicked, err := datastore.PickDatastore(kind, ctx)
+		contentBytes, err = ioutil.ReadAll(contents)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "error reading upload")
+		}
+		if len(contentBytes) == 0 {
+			// Don't bother uploading anything - we'll just have to delete it
+			return nil, common.ErrMediaEmpty
 		}
-		ds = dsPicked
 
-		contentBytes, err = ioutil.ReadAll(contents)
+		dsPicked, err := selectDatastore(kind, int64(len(contentBytes)), contentType, origin, ctx)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrap(err, "error selecting datastore")
 		}
+		ds = dsPicked
 
-		fInfo, err := ds.UploadFile(util.BytesToStream(contentBytes), expectedSize, ctx)
+		persistCtx, span := tracing.StartSpan(ctx, "PersistFile", attribute.String("datastore.id", ds.DatastoreId), attribute.String("datastore.type", ds.Type))
+		fInfo, err := ds.UploadFile(util_byte_seeker.NewByteSeeker(contentBytes), expectedSize, persistCtx)
+		if err == nil {
+			// The hash is calculated while the file is being persisted
+			span.SetAttributes(attribute.Int64("media.size_bytes", fInfo.SizeBytes), attribute.String("media.sha256", fInfo.Sha256Hash))
+		}
+		tracing.EndSpan(span, err)
 		if err != nil {
-			return nil, err
+			// The datastore removes anything it partially wrote before returning an error
+			return nil, errors.Wrap(err, "error persisting file")
 		}
 		info = fInfo
 	} else {
@@ -220,23 +651,56 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		info = f.ObjectInfo
 
 		// download the contents for antispam
-		contents, err = ds.DownloadFile(info.Location)
+		contents, err = ds.DownloadFile(info.Location, info.Encoded)
 		if err != nil {
-			return nil, err
+			ds.DeleteObject(info.Location) // delete temp object
+			return nil, errors.Wrap(err, "error reading persisted file")
 		}
 		contentBytes, err = ioutil.ReadAll(contents)
+		cleanup.DumpAndCloseStream(contents)
 		if err != nil {
-			return nil, err
+			ds.DeleteObject(info.Location) // delete temp object
+			return nil, errors.Wrap(err, "error reading persisted file")
+		}
+		if len(contentBytes) == 0 {
+			ds.DeleteObject(info.Location) // delete temp object
+			return nil, common.ErrMediaEmpty
 		}
 	}
 
-	db := storage.GetDatabase().GetMediaStore(ctx)
-	records, err := db.GetByHash(info.Sha256Hash)
+	reportedContentType := contentType
+	_, span := tracing.StartSpan(ctx, "GetMimeType")
+	contentType = canonicalContentType(reportedContentType, contentBytes, kind, ctx)
+	span.End()
+
+	// Wait for any concurrent upload of the same content to finish so we can deduplicate against it
+	unlockHash, locked := lockHash(info.Sha256Hash, hashLockTimeout)
+	defer unlockHash()
+	if !locked {
+		ctx.Log.Warn("Timed out waiting for another upload of hash ", info.Sha256Hash, " - continuing without deduplicating against it")
+	}
+
+	// Check the blocklist before anything else so blocked media can never be linked to
+	err = checkHashAllowed(info.Sha256Hash, contentBytes, ctx)
 	if err != nil {
 		ds.DeleteObject(info.Location) // delete temp object
 		return nil, err
 	}
 
+	_, span = tracing.StartSpan(ctx, "GetMediaByHash")
+	records, err := getMediaByHash(info.Sha256Hash, ctx)
+	tracing.EndSpan(span, err)
+	if err != nil {
+		ds.DeleteObject(info.Location) // delete temp object
+		return nil, errors.Wrap(err, "error looking up media by hash")
+	}
+
+	records, err = scopeDuplicates(records, origin, userId, mediaId, contentType, ctx)
+	if err != nil {
+		ds.DeleteObject(info.Location) // delete temp object
+		return nil, errors.Wrap(err, "error looking up media by hash")
+	}
+
 	if len(records) > 0 {
 		ctx.Log.Info("Duplicate media for hash ", info.Sha256Hash)
 
@@ -247,12 +711,14 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 			for _, record := range records {
 				if record.Quarantined {
 					ctx.Log.Warn("User attempted to upload quarantined content - rejecting")
+					ds.DeleteObject(info.Location) // delete temp object
 					return nil, common.ErrMediaQuarantined
 				}
 				if record.UserId == userId && record.Origin == origin && record.ContentType == contentType {
 					ctx.Log.Info("User has already uploaded this media before - returning unaltered media record")
 					ds.DeleteObject(info.Location) // delete temp object
 					trackUploadAsLastAccess(ctx, record)
+					countUpload(kind, "deduplicated", ctx)
 					return record, nil
 				}
 			}
@@ -264,6 +730,11 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 			return nil, err
 		}
 
+		err = rejectInfected(ds, info.Location, contentBytes, kind, ctx)
+		if err != nil {
+			return nil, err
+		}
+
 		// We'll use the location from the first record
 		record := records[0]
 		if record.Quarantined {
@@ -278,54 +749,77 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 				ctx.Log.Info("Duplicate media record found - returning unaltered record")
 				ds.DeleteObject(info.Location) // delete temp object
 				trackUploadAsLastAccess(ctx, knownRecord)
+				countUpload(kind, "deduplicated", ctx)
 				return knownRecord, nil
 			}
 		}
 
-		media := record
+		// Copy the record rather than changing the existing media's record in place
+		media := record.Clone()
 		media.Origin = origin
 		media.MediaId = mediaId
 		media.UserId = userId
 		media.UploadName = filename
 		media.ContentType = contentType
+		media.ReportedContentType = reportedContentType
+		media.UploaderTokenHash = uploaderTokenHash(kind, ctx)
 		media.CreationTs = util.NowMillis()
 
-		err = db.Insert(media)
+		err = insertMedia(media, ctx)
 		if err != nil {
 			ds.DeleteObject(info.Location) // delete temp object
-			return nil, err
+			return nil, errors.Wrap(err, "error inserting media record")
 		}
 
 		// If the media's file exists, we'll delete the temp file
 		// If the media's file doesn't exist, we'll move the temp file to where the media expects it to be
-		if media.DatastoreId != ds.DatastoreId && media.Location != info.Location {
-			ds2, err := datastore.LocateDatastore(ctx, media.DatastoreId)
-			if err != nil {
-				ds.DeleteObject(info.Location) // delete temp object
-				return nil, err
+		if media.DatastoreId != ds.DatastoreId || media.Location != info.Location {
+			ds2 := ds
+			if media.DatastoreId != ds.DatastoreId {
+				ds2, err = datastore.LocateDatastore(ctx, media.DatastoreId)
+				if err != nil {
+					ds.DeleteObject(info.Location) // delete temp object
+					return nil, errors.Wrap(err, "error locating datastore of duplicate media")
+				}
 			}
 			if !ds2.ObjectExists(media.Location) {
-				stream, err := ds.DownloadFile(info.Location)
+				stream, err := ds.DownloadFile(info.Location, info.Encoded)
 				if err != nil {
-					return nil, err
+					ds.DeleteObject(info.Location) // delete temp object
+					return nil, errors.Wrap(err, "error reading persisted file")
 				}
 
-				ds2.OverwriteObject(media.Location, stream, ctx)
+				encoded, err := ds2.OverwriteObject(media.Location, stream, ctx)
 				ds.DeleteObject(info.Location)
+				if err != nil {
+					return nil, errors.Wrap(err, "error restoring file of duplicate media")
+				}
+				if encoded != media.Encoded {
+					// The restored file may be encoded differently, so update everything which uses it. Its
+					// stored size isn't known, so the records fall back to the media's size.
+					err = storage.GetDatabase().GetMetadataStore(ctx).ChangeDatastoreOfLocation(media.DatastoreId, media.Location, media.DatastoreId, media.Location, 0, encoded)
+					if err != nil {
+						return nil, errors.Wrap(err, "error updating records of duplicate media")
+					}
+					media.Encoded = encoded
+				}
 			} else {
 				ds.DeleteObject(info.Location)
 			}
 		}
 
 		trackUploadAsLastAccess(ctx, media)
+		storeUploadBlurhash(kind, media, contentBytes, ctx)
+		countUpload(kind, "deduplicated", ctx)
+		notifyUpload(kind, media, ctx)
 		return media, nil
 	}
 
 	// The media doesn't already exist - save it as new
 
 	if info.SizeBytes <= 0 {
-		ds.DeleteObject(info.Location)
-		return nil, errors.New("file has no contents")
+		ds.DeleteObject(info.Location) // delete temp object
+		return nil, common.ErrMediaEmpty
 	}
 
 	err = checkSpam(contentBytes, filename, contentType, userId, origin, mediaId)
@@ -334,27 +828,159 @@ func StoreDirect(f *AlreadyUploadedFile, contents io.ReadCloser, expectedSize in
 		return nil, err
 	}
 
+	err = rejectInfected(ds, info.Location, contentBytes, kind, ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx.Log.Info("Persisting new media record")
 
 	media := &types.Media{
-		Origin:      origin,
-		MediaId:     mediaId,
-		UploadName:  filename,
-		ContentType: contentType,
-		UserId:      userId,
-		Sha256Hash:  info.Sha256Hash,
-		SizeBytes:   info.SizeBytes,
-		DatastoreId: ds.DatastoreId,
-		Location:    info.Location,
-		CreationTs:  util.NowMillis(),
-	}
-
-	err = db.Insert(media)
+		Origin:              origin,
+		MediaId:             mediaId,
+		UploadName:          filename,
+		ContentType:         contentType,
+		ReportedContentType: reportedContentType,
+		UserId:              userId,
+		Sha256Hash:          info.Sha256Hash,
+		SizeBytes:           info.SizeBytes,
+		StoredSizeBytes:     info.StoredSizeBytes,
+		Encoded:             info.Encoded,
+		DatastoreId:         ds.DatastoreId,
+		Location:            info.Location,
+		CreationTs:          util.NowMillis(),
+		UploaderTokenHash:   uploaderTokenHash(kind, ctx),
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		width, height, err := util.GetImageDimensions(contentBytes)
+		if err == nil {
+			media.Width = &width
+			media.Height = &height
+		} else {
+			ctx.Log.Warn("Unable to read image dimensions: ", err.Error())
+		}
+	}
+
+	err = insertMedia(media, ctx)
 	if err != nil {
 		ds.DeleteObject(info.Location) // delete temp object
-		return nil, err
+		return nil, errors.Wrap(err, "error inserting media record")
 	}
 
 	trackUploadAsLastAccess(ctx, media)
+	storeUploadBlurhash(kind, media, contentBytes, ctx)
+	countUpload(kind, "stored", ctx)
+	notifyUpload(kind, media, ctx)
 	return media, nil
 }
+
+// getBlurhash is swapped out by tests
+var getBlurhash = func(sha256Hash string, ctx rcontext.RequestContext) (string, error) {
+	return storage.GetDatabase().GetMetadataStore(ctx).GetBlurhash(sha256Hash)
+}
+
+// insertBlurhash is swapped out by tests
+var insertBlurhash = func(sha256Hash string, blurhash string, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMetadataStore(ctx).InsertBlurhash(sha256Hash, blurhash)
+}
+
+// storeUploadBlurhash calculates and stores the blurhash of locally uploaded images, if enabled. Failures
+// only mean the media has no blurhash until one is requested, so they don't fail the upload.
+func storeUploadBlurhash(kind string, media *types.Media, contentBytes []byte, ctx rcontext.RequestContext) {
+	conf := ctx.Config.Features.MSC2448Blurhash
+	if kind != common.KindLocalMedia || !conf.Enabled || !conf.GenerateOnUpload || !strings.HasPrefix(media.ContentType, "image/") {
+		return
+	}
+
+	// Check the dimensions before decoding the whole image, as huge images use a lot of memory
+	var width, height int
+	if media.Width != nil && media.Height != nil {
+		width, height = *media.Width, *media.Height
+	} else {
+		var err error
+		width, height, err = util.GetImageDimensions(contentBytes)
+		if err != nil {
+			ctx.Log.Warn("Unable to read image dimensions for blurhash: ", err.Error())
+			return
+		}
+	}
+	if util.ExceedsMaxPixels(width, height, ctx.Config.Thumbnails.MaxPixels) {
+		return
+	}
+
+	existing, err := getBlurhash(media.Sha256Hash, ctx)
+	if err == nil && existing != "" {
+		return
+	}
+
+	_, span := tracing.StartSpan(ctx, "CalculateBlurhash")
+	encoded, err := util.CalculateBlurhash(contentBytes, conf)
+	span.End()
+	if err != nil {
+		ctx.Log.Warn("Unable to calculate blurhash for upload: ", err.Error())
+		return
+	}
+	err = insertBlurhash(media.Sha256Hash, encoded, ctx)
+	if err != nil {
+		ctx.Log.Warn("Unable to store blurhash for upload: ", err.Error())
+	}
+}
+
+// notifyUpload sends the new media record to any configured webhooks and upload listeners, if it
+// was uploaded locally
+func notifyUpload(kind string, media *types.Media, ctx rcontext.RequestContext) {
+	if kind != common.KindLocalMedia {
+		return
+	}
+	webhooks.NotifyUpload(media)
+
+	uploadListenersLock.RLock()
+	defer uploadListenersLock.RUnlock()
+	for _, listener := range uploadListeners {
+		go listener(media, ctx.Detached())
+	}
+}
+
+// getMediaByHash is swapped out by tests
+var getMediaByHash = func(sha256Hash string, ctx rcontext.RequestContext) ([]*types.Media, error) {
+	return storage.GetDatabase().GetMediaStore(ctx).GetByHash(sha256Hash)
+}
+
+// insertMediaRecord is swapped out by tests
+var insertMediaRecord = func(media *types.Media, ctx rcontext.RequestContext) error {
+	return storage.GetDatabase().GetMediaStore(ctx).Insert(media)
+}
+
+func insertMedia(media *types.Media, ctx rcontext.RequestContext) error {
+	_, span := tracing.StartSpan(ctx, "InsertMedia")
+	err := insertMediaRecord(media, ctx)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+// uploaderTokenHash returns a salted hash of the access token the media is being uploaded with, if
+// enabled by uploads.tokenAudit, so uploads from the same session can be correlated without storing
+// the token itself.
+func uploaderTokenHash(kind string, ctx rcontext.RequestContext) string {
+	conf := ctx.Config.Uploads.TokenAudit
+	if kind != common.KindLocalMedia || !conf.Enabled || ctx.Request == nil {
+		return ""
+	}
+	accessToken := util.GetAccessTokenFromRequest(ctx.Request)
+	if accessToken == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(conf.Salt))
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// countUpload records the result of storing local media in the upload metrics and trace
+func countUpload(kind string, result string, ctx rcontext.RequestContext) {
+	tracing.SetAttributes(ctx, attribute.String("media.upload_result", result))
+	if kind != common.KindLocalMedia {
+		return
+	}
+	metrics.MediaUploaded.With(prometheus.Labels{"result": result}).Inc()
+}
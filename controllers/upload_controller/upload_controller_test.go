@@ -0,0 +1,653 @@
+package upload_controller
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestIsTooLargeForType(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxSizeBytes int64
+		maxByType    map[string]int64
+		sizeBytes    int64
+		contentType  string
+		wantTooLarge bool
+	}{
+		{name: "under the type limit", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 500}, sizeBytes: 400, contentType: "video/mp4", wantTooLarge: false},
+		{name: "over the type limit but under the global limit", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 500}, sizeBytes: 600, contentType: "video/mp4", wantTooLarge: true},
+		{name: "other types use the global limit", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 500}, sizeBytes: 600, contentType: "image/png", wantTooLarge: false},
+		{name: "other types over the global limit", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 500}, sizeBytes: 1200, contentType: "image/png", wantTooLarge: true},
+		{name: "wildcard limit", maxSizeBytes: 1000, maxByType: map[string]int64{"*": 100}, sizeBytes: 200, contentType: "application/octet-stream", wantTooLarge: true},
+		{name: "smallest matching limit wins", maxSizeBytes: 1000, maxByType: map[string]int64{"*": 800, "image/*": 300}, sizeBytes: 400, contentType: "image/png", wantTooLarge: true},
+		{name: "type limits can't raise the global limit", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 5000}, sizeBytes: 2000, contentType: "video/mp4", wantTooLarge: true},
+		{name: "zero type limits are ignored", maxSizeBytes: 1000, maxByType: map[string]int64{"video/*": 0}, sizeBytes: 600, contentType: "video/mp4", wantTooLarge: false},
+		{name: "no limits", sizeBytes: 600, contentType: "video/mp4", wantTooLarge: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MaxSizeBytes = tt.maxSizeBytes
+			ctx.Config.Uploads.MaxSizeByType = tt.maxByType
+
+			// The global limit is checked while the upload is streamed, and the type limit once the
+			// type is known.
+			tooLarge := IsRequestTooLarge(tt.sizeBytes, "", ctx) || IsTooLargeForType(tt.sizeBytes, tt.contentType, ctx)
+			if tooLarge != tt.wantTooLarge {
+				t.Errorf("got too large = %t, expected %t", tooLarge, tt.wantTooLarge)
+			}
+		})
+	}
+}
+
+func TestIsRequestTooLargeForOrigin(t *testing.T) {
+	stricter := int64(1000)
+	uploads := config.UploadsConfig{
+		MaxSizeBytes: 10000,
+		PerOrigin: map[string]config.OriginUploadsConfig{
+			"strict.example.org": {MaxSizeBytes: &stricter},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		origin       string
+		sizeBytes    int64
+		wantTooLarge bool
+	}{
+		{name: "under the origin limit", origin: "strict.example.org", sizeBytes: 800, wantTooLarge: false},
+		{name: "over the origin limit but under the global limit", origin: "strict.example.org", sizeBytes: 2000, wantTooLarge: true},
+		{name: "origin without an override", origin: "example.org", sizeBytes: 2000, wantTooLarge: false},
+		{name: "origin without an override over the global limit", origin: "example.org", sizeBytes: 20000, wantTooLarge: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads = config.UploadsForOrigin(uploads, tt.origin)
+
+			if tooLarge := IsRequestTooLarge(tt.sizeBytes, "", ctx); tooLarge != tt.wantTooLarge {
+				t.Errorf("got too large = %t, expected %t", tooLarge, tt.wantTooLarge)
+			}
+		})
+	}
+}
+
+func TestCanonicalContentType(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+
+	tests := []struct {
+		name            string
+		useDetected     bool
+		kind            string
+		reportedType    string
+		wantContentType string
+	}{
+		{name: "mismatched upload is corrected", useDetected: true, kind: common.KindLocalMedia, reportedType: "image/png", wantContentType: "application/pdf"},
+		{name: "matching upload is unchanged", useDetected: true, kind: common.KindLocalMedia, reportedType: "application/pdf", wantContentType: "application/pdf"},
+		{name: "reported type is trusted by default", useDetected: false, kind: common.KindLocalMedia, reportedType: "image/png", wantContentType: "image/png"},
+		{name: "remote media keeps its type", useDetected: true, kind: common.KindRemoteMedia, reportedType: "image/png", wantContentType: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.UseDetectedContentType = tt.useDetected
+
+			contentType := canonicalContentType(tt.reportedType, pdf, tt.kind, ctx)
+			if contentType != tt.wantContentType {
+				t.Errorf("got %s, expected %s", contentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestReadUploadDecompressionBomb(t *testing.T) {
+	tests := []struct {
+		name             string
+		stripMetadata    bool
+		recompressImages bool
+		wantErr          error
+	}{
+		{name: "stripping metadata", stripMetadata: true, wantErr: common.ErrImageTooLarge},
+		{name: "recompressing images", recompressImages: true, wantErr: common.ErrImageTooLarge},
+		{name: "stored as-is", wantErr: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.MaxPixels = 32000000
+			ctx.Config.Uploads.StripMetadata = tt.stripMetadata
+			ctx.Config.Uploads.RecompressImages = tt.recompressImages
+
+			_, _, err := readUpload(ioutil.NopCloser(bytes.NewReader(pngBomb())), "application/octet-stream", "bomb.png", ctx)
+			if err != tt.wantErr {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadUploadDeniedTypes(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+
+	tests := []struct {
+		name        string
+		deniedTypes []string
+		maxByType   map[string]int64
+		wantErr     error
+	}{
+		{name: "denied type", deniedTypes: []string{"application/pdf"}, wantErr: common.ErrMediaTypeDenied},
+		{name: "denied by glob", deniedTypes: []string{"application/*"}, wantErr: common.ErrMediaTypeDenied},
+		{name: "denied type with its own size allowance", deniedTypes: []string{"application/pdf"}, maxByType: map[string]int64{"application/pdf": 1024 * 1024}, wantErr: common.ErrMediaTypeDenied},
+		{name: "other types denied", deniedTypes: []string{"image/*", "application/x-msdownload"}, wantErr: nil},
+		{name: "nothing denied", wantErr: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.DeniedTypes = tt.deniedTypes
+			ctx.Config.Uploads.MaxSizeByType = tt.maxByType
+
+			// The type is detected from the contents, so there is no reported type for a client to lie with
+			_, _, err := readUpload(ioutil.NopCloser(bytes.NewReader(pdf)), "application/octet-stream", "document.pdf", ctx)
+			if err != tt.wantErr {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type abortedReader struct{}
+
+func (r abortedReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func countFiles(t *testing.T, dir string) int {
+	count := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStoreDirectLeavesNoTempFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		uploaded func(t *testing.T, ds *datastore.DatastoreRef) *AlreadyUploadedFile
+		contents io.Reader
+		wantErr  error // nil for any error
+	}{
+		{
+			name:     "empty body",
+			contents: &bytes.Buffer{},
+			wantErr:  common.ErrMediaEmpty,
+		},
+		{
+			name:     "aborted body",
+			contents: abortedReader{},
+			wantErr:  io.ErrUnexpectedEOF,
+		},
+		{
+			name: "empty object",
+			uploaded: func(t *testing.T, ds *datastore.DatastoreRef) *AlreadyUploadedFile {
+				info, err := ds.UploadFile(ioutil.NopCloser(&bytes.Buffer{}), 0, testContext())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &AlreadyUploadedFile{DS: ds, ObjectInfo: info}
+			},
+			wantErr: common.ErrMediaEmpty,
+		},
+		{
+			name: "unreadable object",
+			uploaded: func(t *testing.T, ds *datastore.DatastoreRef) *AlreadyUploadedFile {
+				// Reading a directory fails part way through, like an interrupted download would
+				if err := os.Mkdir(path.Join(ds.Uri, "unreadable"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				return &AlreadyUploadedFile{DS: ds, ObjectInfo: &types.ObjectInfo{Location: "unreadable"}}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+			var f *AlreadyUploadedFile
+			if tt.uploaded != nil {
+				f = tt.uploaded(t, ds)
+			}
+			contents := ioutil.NopCloser(&bytes.Buffer{})
+			if tt.contents != nil {
+				contents = ioutil.NopCloser(tt.contents)
+			}
+
+			media, err := StoreDirect(f, contents, -1, "text/plain", "test.txt", "@alice:example.org", "example.org", "test", common.KindLocalMedia, ctx, true)
+			if media != nil || err == nil {
+				t.Fatalf("got (%v, %v), expected an error", media, err)
+			}
+			if tt.wantErr != nil && errors.Cause(err) != tt.wantErr {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+			if n := countFiles(t, ds.Uri); n != 0 {
+				t.Errorf("expected no files to remain in the datastore, found %d", n)
+			}
+			if f != nil {
+				if _, err = os.Stat(path.Join(ds.Uri, f.ObjectInfo.Location)); !os.IsNotExist(err) {
+					t.Errorf("expected the uploaded object to be removed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestScopeDuplicates(t *testing.T) {
+	sameUser := &types.Media{Origin: "example.org", MediaId: "a", UserId: "@alice:example.org", Location: "shared/a"}
+	sameOrigin := &types.Media{Origin: "example.org", MediaId: "b", UserId: "@bob:example.org", Location: "shared/b"}
+	otherOrigin := &types.Media{Origin: "other.example.org", MediaId: "c", UserId: "@alice:other.example.org", Location: "shared/c"}
+	records := []*types.Media{sameUser, sameOrigin, otherOrigin}
+
+	tests := []struct {
+		name         string
+		scope        string
+		noDedupTypes []string
+		origin       string
+		mediaId      string
+		contentType  string
+		wantShared   []*types.Media
+	}{
+		{name: "default shares globally", scope: "", origin: "example.org", wantShared: records},
+		{name: "global", scope: common.DedupeScopeGlobal, origin: "example.org", wantShared: records},
+		{name: "origin", scope: common.DedupeScopeOrigin, origin: "example.org", wantShared: []*types.Media{sameUser, sameOrigin}},
+		{name: "user", scope: common.DedupeScopeUser, origin: "example.org", wantShared: []*types.Media{sameUser}},
+		{name: "new origin gets its own copy", scope: common.DedupeScopeOrigin, origin: "new.example.org", wantShared: []*types.Media{}},
+		{name: "exempt type", noDedupTypes: []string{"text/*"}, origin: "example.org", contentType: "text/plain", wantShared: []*types.Media{}},
+		{name: "exempt type keeps its own record", noDedupTypes: []string{"text/*"}, origin: "example.org", mediaId: "a", contentType: "text/plain", wantShared: []*types.Media{sameUser}},
+		{name: "other types aren't exempt", noDedupTypes: []string{"text/*"}, origin: "example.org", wantShared: records},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.DeduplicationScope = tt.scope
+			ctx.Config.Uploads.NoDedupTypes = tt.noDedupTypes
+			mediaId := tt.mediaId
+			if mediaId == "" {
+				mediaId = "new"
+			}
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "image/png"
+			}
+
+			shared, err := scopeDuplicates(records, tt.origin, "@alice:example.org", mediaId, contentType, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shared) != len(tt.wantShared) {
+				t.Fatalf("got %d records to share a file with, expected %d", len(shared), len(tt.wantShared))
+			}
+			for i := range shared {
+				if shared[i] != tt.wantShared[i] {
+					t.Errorf("got %s at %d, expected %s", shared[i].MediaId, i, tt.wantShared[i].MediaId)
+				}
+			}
+		})
+	}
+}
+
+func TestScopeDuplicatesQuarantined(t *testing.T) {
+	records := []*types.Media{{Origin: "other.example.org", MediaId: "a", Quarantined: true}}
+
+	for _, scope := range []string{common.DedupeScopeOrigin, common.DedupeScopeUser} {
+		t.Run(scope, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.DeduplicationScope = scope
+
+			_, err := scopeDuplicates(records, "example.org", "@alice:example.org", "new", "image/png", ctx)
+			if err != common.ErrMediaQuarantined {
+				t.Errorf("got %v, expected quarantined media to be rejected", err)
+			}
+		})
+	}
+}
+
+func TestStoreDirectBlockedHash(t *testing.T) {
+	contents := []byte("this content has been taken down")
+
+	tests := []struct {
+		name    string
+		blocked bool
+		err     error
+		wantErr error
+	}{
+		{name: "blocked", blocked: true, wantErr: common.ErrMediaBlocked},
+		{name: "blocklist unavailable", err: io.ErrClosedPipe, wantErr: io.ErrClosedPipe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ds := &datastore.DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+			info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checked := ""
+			defer func(original func(string, rcontext.RequestContext) (bool, error)) {
+				isHashBlocked = original
+			}(isHashBlocked)
+			isHashBlocked = func(sha256Hash string, ctx rcontext.RequestContext) (bool, error) {
+				checked = sha256Hash
+				return tt.blocked, tt.err
+			}
+
+			f := &AlreadyUploadedFile{DS: ds, ObjectInfo: info}
+			media, err := StoreDirect(f, nil, -1, "text/plain", "test.txt", "@alice:example.org", "example.org", "test", common.KindLocalMedia, ctx, true)
+			if media != nil || errors.Cause(err) != tt.wantErr {
+				t.Fatalf("got (%v, %v), expected %v", media, err, tt.wantErr)
+			}
+			if checked != info.Sha256Hash {
+				t.Errorf("got %q checked against the blocklist, expected %q", checked, info.Sha256Hash)
+			}
+			if n := countFiles(t, ds.Uri); n != 0 {
+				t.Errorf("expected the upload to be removed, found %d files", n)
+			}
+		})
+	}
+}
+
+func TestCheckHashAllowedOtherAlgorithm(t *testing.T) {
+	contents := []byte("this content has been taken down")
+	sha512Hash, err := util.GetHashOfStreamWith(config.HashAlgorithmSha512, ioutil.NopCloser(bytes.NewReader(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Hash, err := util.GetHashOfStreamWith(config.HashAlgorithmSha256, ioutil.NopCloser(bytes.NewReader(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		hash        string
+		blocked     string
+		quarantined string
+		wantErr     error
+	}{
+		{name: "allowed", hash: sha512Hash},
+		{name: "blocked", hash: sha512Hash, blocked: sha512Hash, wantErr: common.ErrMediaBlocked},
+		{name: "sha256 blocked", hash: sha512Hash, blocked: sha256Hash, wantErr: common.ErrMediaBlocked},
+		{name: "sha256 quarantined", hash: sha512Hash, quarantined: sha256Hash, wantErr: common.ErrMediaQuarantined},
+		// Quarantined media with the same hash is found when looking for duplicates instead
+		{name: "sha256 media", hash: sha256Hash, quarantined: sha256Hash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(original func(string, rcontext.RequestContext) (bool, error)) {
+				isHashBlocked = original
+			}(isHashBlocked)
+			isHashBlocked = func(hash string, ctx rcontext.RequestContext) (bool, error) {
+				return hash == tt.blocked, nil
+			}
+			defer func(original func(string, rcontext.RequestContext) (bool, error)) {
+				isHashQuarantined = original
+			}(isHashQuarantined)
+			isHashQuarantined = func(hash string, ctx rcontext.RequestContext) (bool, error) {
+				return hash == tt.quarantined, nil
+			}
+
+			if err := checkHashAllowed(tt.hash, contents, testContext()); err != tt.wantErr {
+				t.Errorf("got error %v, expected %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGenerateMediaId(t *testing.T) {
+	defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+		isMediaIdReserved = original
+	}(isMediaIdReserved)
+	isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+		return false, nil
+	}
+	defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+		isMediaIdInUse = original
+	}(isMediaIdInUse)
+
+	tests := []struct {
+		name           string
+		length         int
+		alphabet       string
+		inUse          int
+		expectedLength int
+		expectedChecks int
+		wantErr        bool
+	}{
+		{name: "default", expectedLength: 40, expectedChecks: 1},
+		{name: "custom length", length: 12, alphabet: "0123456789abcdef", expectedLength: 12, expectedChecks: 1},
+		{name: "collision", length: 12, alphabet: "0123456789abcdef", inUse: 3, expectedLength: 12, expectedChecks: 4},
+		{name: "always in use", length: 12, alphabet: "0123456789abcdef", inUse: 100, expectedChecks: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := 0
+			isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+				checks++
+				return checks <= tt.inUse, nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Uploads.MediaIdLength = tt.length
+			ctx.Config.Uploads.MediaIdAlphabet = tt.alphabet
+			mediaId, err := generateMediaId("example.org", ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if checks != tt.expectedChecks {
+				t.Errorf("got %d checks against the media table, expected %d", checks, tt.expectedChecks)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(mediaId) != tt.expectedLength {
+				t.Errorf("got %q, expected %d characters", mediaId, tt.expectedLength)
+			}
+			if tt.alphabet != "" && strings.Trim(mediaId, tt.alphabet) != "" {
+				t.Errorf("got %q, expected only characters from %q", mediaId, tt.alphabet)
+			}
+		})
+	}
+}
+
+func TestValidateUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		userId      string
+		expectedErr error
+	}{
+		{name: "valid", contentType: "image/png", userId: "@alice:example.org"},
+		{name: "parameters", contentType: "text/plain; charset=utf-8", userId: "@alice:example.org"},
+		{name: "no user", contentType: "image/png", userId: NoApplicableUploadUser},
+		{name: "long content type", contentType: "application/" + strings.Repeat("x", 300), userId: "@alice:example.org", expectedErr: common.ErrContentTypeTooLong},
+		{name: "malformed content type", contentType: "image/png/extra", userId: "@alice:example.org", expectedErr: common.ErrInvalidContentType},
+		{name: "empty content type", contentType: "", userId: "@alice:example.org", expectedErr: common.ErrInvalidContentType},
+		{name: "invalid user", contentType: "image/png", userId: "alice", expectedErr: common.ErrInvalidUserId},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MaxContentTypeLength = 255
+			if err := ValidateUploadMetadata(tt.contentType, tt.userId, ctx); err != tt.expectedErr {
+				t.Errorf("got error %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestStoreUploadBlurhash(t *testing.T) {
+	defer func(original func(string, rcontext.RequestContext) (string, error)) {
+		getBlurhash = original
+	}(getBlurhash)
+	getBlurhash = func(sha256Hash string, ctx rcontext.RequestContext) (string, error) {
+		return "", nil
+	}
+	defer func(original func(string, string, rcontext.RequestContext) error) {
+		insertBlurhash = original
+	}(insertBlurhash)
+
+	pngBytes := encodedTestImage(t, func(b *bytes.Buffer, img image.Image) error { return png.Encode(b, img) })
+
+	tests := []struct {
+		name          string
+		disabled      bool
+		kind          string
+		contentType   string
+		contents      []byte
+		expectedStore bool
+	}{
+		{name: "image", kind: common.KindLocalMedia, contentType: "image/png", contents: pngBytes, expectedStore: true},
+		{name: "not an image", kind: common.KindLocalMedia, contentType: "text/plain", contents: []byte("hello world")},
+		{name: "claims to be an image", kind: common.KindLocalMedia, contentType: "image/png", contents: []byte("hello world")},
+		{name: "remote media", kind: common.KindRemoteMedia, contentType: "image/png", contents: pngBytes},
+		{name: "disabled", disabled: true, kind: common.KindLocalMedia, contentType: "image/png", contents: pngBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := make(map[string]string)
+			insertBlurhash = func(sha256Hash string, blurhash string, ctx rcontext.RequestContext) error {
+				stored[sha256Hash] = blurhash
+				return nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Features.MSC2448Blurhash.Enabled = true
+			ctx.Config.Features.MSC2448Blurhash.GenerateOnUpload = !tt.disabled
+			ctx.Config.Features.MSC2448Blurhash.GenerateWidth = 64
+			ctx.Config.Features.MSC2448Blurhash.GenerateHeight = 64
+			ctx.Config.Features.MSC2448Blurhash.XComponents = 4
+			ctx.Config.Features.MSC2448Blurhash.YComponents = 3
+			media := &types.Media{Sha256Hash: "hash", ContentType: tt.contentType}
+
+			storeUploadBlurhash(tt.kind, media, tt.contents, ctx)
+			if _, ok := stored["hash"]; ok != tt.expectedStore {
+				t.Errorf("got %v stored, expected a blurhash to be stored = %t", stored, tt.expectedStore)
+			}
+		})
+	}
+}
+
+func TestWithUploadPolicy(t *testing.T) {
+	anonymousMax := int64(1024)
+	large := bytes.Repeat([]byte{0x00, 0x01}, 1024)
+
+	tests := []struct {
+		name        string
+		userId      string
+		contents    []byte
+		expectedErr error
+	}{
+		{name: "user upload", userId: "@alice:example.org", contents: large},
+		{name: "user upload of denied type", userId: "@alice:example.org", contents: []byte("hello world"), expectedErr: common.ErrMediaTypeDenied},
+		{name: "anonymous upload too large", userId: NoApplicableUploadUser, contents: large, expectedErr: common.ErrMediaTooLarge},
+		{name: "anonymous upload of allowed type", userId: NoApplicableUploadUser, contents: []byte("hello world")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.MimeDetection = util.MimeDetectionGo
+			ctx.Config.Uploads.MaxSizeBytes = 104857600
+			ctx.Config.Uploads.DeniedTypes = []string{"text/plain"}
+			ctx.Config.Uploads.AnonymousPolicy = &config.OriginUploadsConfig{MaxSizeBytes: &anonymousMax, DeniedTypes: []string{}}
+
+			ctx = withUploadPolicy(tt.userId, ctx)
+			_, _, err := readUpload(ioutil.NopCloser(bytes.NewReader(tt.contents)), "application/octet-stream", "", ctx)
+			if err != tt.expectedErr {
+				t.Errorf("got error %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestUploadMediaNormalizesContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{contentType: "IMAGE/JPEG; charset=utf-8", expected: "image/jpeg"},
+		{contentType: "video/mp4; codecs=avc1.42E01E; foo=bar", expected: "video/mp4; codecs=avc1.42E01E"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			selected := ""
+			defer func(original func(string, int64, string, string, rcontext.RequestContext) (*datastore.DatastoreRef, error)) {
+				selectDatastore = original
+			}(selectDatastore)
+			// Stop the upload once the datastore has been picked for it
+			selectDatastore = func(forKind string, size int64, contentType string, origin string, ctx rcontext.RequestContext) (*datastore.DatastoreRef, error) {
+				selected = contentType
+				return nil, io.ErrClosedPipe
+			}
+			defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+				isMediaIdReserved = original
+			}(isMediaIdReserved)
+			isMediaIdReserved = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+				return false, nil
+			}
+			defer func(original func(string, string, rcontext.RequestContext) (bool, error)) {
+				isMediaIdInUse = original
+			}(isMediaIdInUse)
+			isMediaIdInUse = func(origin string, mediaId string, ctx rcontext.RequestContext) (bool, error) {
+				return false, nil
+			}
+
+			ctx := testContext()
+			ctx.Config.Uploads.ContentTypeParameters = []string{"codecs"}
+			contents := []byte("hello world")
+			_, err := UploadMedia(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), tt.contentType, "", "@alice:example.org", "example.org", ctx)
+			if errors.Cause(err) != io.ErrClosedPipe {
+				t.Fatalf("got %v, expected the upload to reach the datastore selection", err)
+			}
+			if selected != tt.expected {
+				t.Errorf("got %q, expected %q", selected, tt.expected)
+			}
+		})
+	}
+}
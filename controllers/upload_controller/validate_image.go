@@ -0,0 +1,45 @@
+package upload_controller
+
+import (
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/tracing"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// The image types which can be fully decoded to check they are valid
+var validatedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// validateImage fully decodes images of the supported types, rejecting those which are truncated or
+// otherwise can't be decoded. Such images can still have a valid header, so they pass the content
+// type detection. Other kinds of files are not checked.
+func validateImage(b []byte, contentType string, ctx rcontext.RequestContext) error {
+	if !validatedImageTypes[contentType] {
+		return nil
+	}
+
+	// Check the dimensions before decoding the whole thing to avoid decompression bombs
+	width, height, err := util.GetImageDimensions(b)
+	if err != nil {
+		ctx.Log.Warn("Failed to read image header for validation: " + err.Error())
+		return common.ErrMediaCorrupt
+	}
+	if util.ExceedsMaxPixels(width, height, ctx.Config.Thumbnails.MaxPixels) {
+		ctx.Log.Warnf("Image is too large to validate: %dx%d", width, height)
+		return common.ErrImageTooLarge
+	}
+
+	_, span := tracing.StartSpan(ctx, "ValidateImage")
+	_, err = util.DecodeImage(b)
+	span.End()
+	if err != nil {
+		ctx.Log.Warn("Rejecting upload of image which could not be decoded: " + err.Error())
+		return common.ErrMediaCorrupt
+	}
+	return nil
+}
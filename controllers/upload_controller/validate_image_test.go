@@ -0,0 +1,50 @@
+package upload_controller
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func TestValidateImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+	// The header survives, so the dimensions can still be read
+	truncated := full[:len(full)/2]
+
+	tests := []struct {
+		name        string
+		b           []byte
+		contentType string
+		maxPixels   int
+		expectedErr error
+	}{
+		{name: "valid jpeg", b: full, contentType: "image/jpeg"},
+		{name: "truncated jpeg", b: truncated, contentType: "image/jpeg", expectedErr: common.ErrMediaCorrupt},
+		{name: "not an image", b: []byte("hello world"), contentType: "image/png", expectedErr: common.ErrMediaCorrupt},
+		{name: "too many pixels", b: full, contentType: "image/jpeg", maxPixels: 100, expectedErr: common.ErrImageTooLarge},
+		{name: "unvalidated type", b: truncated, contentType: "image/svg+xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.MaxPixels = tt.maxPixels
+			if err := validateImage(tt.b, tt.contentType, ctx); err != tt.expectedErr {
+				t.Errorf("got error %v, expected %v", err, tt.expectedErr)
+			}
+		})
+	}
+}
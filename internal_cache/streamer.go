@@ -10,12 +10,12 @@ import (
 
 func StreamerForMedia(media *types.Media) FetchFunction {
 	return func() (io.ReadCloser, error) {
-		return datastore.DownloadStream(rcontext.Initial(), media.DatastoreId, media.Location)
+		return datastore.DownloadStream(rcontext.Initial(), media.DatastoreId, media.Location, media.Encoded)
 	}
 }
 
 func StreamerForThumbnail(media *types.Thumbnail) FetchFunction {
 	return func() (io.ReadCloser, error) {
-		return datastore.DownloadStream(rcontext.Initial(), media.DatastoreId, media.Location)
+		return datastore.DownloadStream(rcontext.Initial(), media.DatastoreId, media.Location, media.Encoded)
 	}
 }
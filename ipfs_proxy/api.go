@@ -33,8 +33,8 @@ func Reload() {
 		}
 		implementation = impl
 	} else {
-		logrus.Info("Using localhost IPFS HTTP agent...")
-		impl, err := ipfs_local.NewLocalIPFSImplementation()
+		logrus.Info("Using IPFS HTTP agent...")
+		impl, err := ipfs_local.NewLocalIPFSImplementation(config.Get().Features.IPFS.ApiUrl)
 		if err != nil {
 			sentry.CaptureException(err)
 			panic(err)
@@ -2,6 +2,7 @@ package ipfs_local
 
 import (
 	"bytes"
+	"errors"
 	"github.com/ipfs/go-cid"
 	httpapi "github.com/ipfs/go-ipfs-api"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
@@ -15,8 +16,16 @@ type IPFSLocal struct {
 	client *httpapi.Shell
 }
 
-func NewLocalIPFSImplementation() (IPFSLocal, error) {
-	client := httpapi.NewLocalShell()
+func NewLocalIPFSImplementation(apiUrl string) (IPFSLocal, error) {
+	var client *httpapi.Shell
+	if apiUrl != "" {
+		client = httpapi.NewShell(apiUrl)
+	} else {
+		client = httpapi.NewLocalShell()
+	}
+	if client == nil {
+		return IPFSLocal{}, errors.New("unable to locate an IPFS HTTP API")
+	}
 	return IPFSLocal{
 		client: client,
 	}, nil
@@ -0,0 +1,49 @@
+package ipfs_local
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNewLocalIPFSImplementation(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiUrl  string
+		apiFile string // contents of the api file in IPFS_PATH, if any
+		wantErr bool
+	}{
+		{name: "configured api url", apiUrl: "localhost:5001"},
+		{name: "configured multiaddr", apiUrl: "/ip4/127.0.0.1/tcp/5001"},
+		{name: "local node", apiFile: "/ip4/127.0.0.1/tcp/5001"},
+		{name: "no local node", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipfsPath := t.TempDir()
+			if tt.apiFile != "" {
+				if err := ioutil.WriteFile(path.Join(ipfsPath, "api"), []byte(tt.apiFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			oldPath, hadPath := os.LookupEnv("IPFS_PATH")
+			os.Setenv("IPFS_PATH", ipfsPath)
+			defer func() {
+				if hadPath {
+					os.Setenv("IPFS_PATH", oldPath)
+				} else {
+					os.Unsetenv("IPFS_PATH")
+				}
+			}()
+
+			impl, err := NewLocalIPFSImplementation(tt.apiUrl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && impl.client == nil {
+				t.Error("no client was created")
+			}
+		})
+	}
+}
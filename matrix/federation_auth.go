@@ -0,0 +1,267 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/singleflight-counter"
+)
+
+var ErrNoFederationAuth = errors.New("request does not have an X-Matrix authorization header")
+var ErrInvalidFederationAuth = errors.New("X-Matrix authorization is invalid")
+
+// How long to remember a server's signing keys, or that they couldn't be fetched
+const serverKeyCacheTime = 1 * time.Hour
+const serverKeyFailureCacheTime = 5 * time.Minute
+
+var serverKeysCache = cache.New(serverKeyCacheTime, 2*serverKeyCacheTime)
+
+// Anyone can claim to be any server with any key ID, so a server's keys are only fetched this often
+// no matter which key is asked for. This stops made up key IDs from making us contact a server over
+// and over.
+const serverKeyFetchInterval = 1 * time.Minute
+
+var serverKeyFetches = cache.New(serverKeyFetchInterval, 2*serverKeyFetchInterval)
+var serverKeyFetchGroup singleflight_counter.Group
+
+// fetchServerKey is swapped out by tests
+var fetchServerKey = fetchServerKeyFromOrigin
+
+type XMatrixAuth struct {
+	Origin      string
+	Destination string
+	KeyId       string
+	Signature   string
+}
+
+type serverKeysResponse struct {
+	ServerName   string `json:"server_name"`
+	ValidUntilTs int64  `json:"valid_until_ts"`
+	VerifyKeys   map[string]struct {
+		Key string `json:"key"`
+	} `json:"verify_keys"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// ParseXMatrixAuth reads the parameters of an X-Matrix Authorization header, returning false if the
+// header isn't one or is missing required parameters.
+func ParseXMatrixAuth(header string) (*XMatrixAuth, bool) {
+	if !strings.HasPrefix(header, "X-Matrix ") {
+		return nil, false
+	}
+
+	auth := &XMatrixAuth{}
+	for _, param := range strings.Split(strings.TrimPrefix(header, "X-Matrix "), ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(parts[1], "\"")
+		switch strings.ToLower(parts[0]) {
+		case "origin":
+			auth.Origin = strings.ToLower(value)
+		case "destination":
+			auth.Destination = strings.ToLower(value)
+		case "key":
+			auth.KeyId = value
+		case "sig":
+			auth.Signature = value
+		}
+	}
+	if auth.Origin == "" || auth.KeyId == "" || auth.Signature == "" {
+		return nil, false
+	}
+	return auth, true
+}
+
+// VerifyFederationRequest checks the signature in the request's X-Matrix Authorization header
+// against the origin server's signing keys, returning the origin if the request was signed by it.
+// ErrNoFederationAuth is returned if the request doesn't have the header at all.
+func VerifyFederationRequest(r *http.Request, ctx rcontext.RequestContext) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "X-Matrix ") {
+		return "", ErrNoFederationAuth
+	}
+	auth, ok := ParseXMatrixAuth(header)
+	if !ok {
+		return "", ErrInvalidFederationAuth
+	}
+	if auth.Destination != "" && !util.IsServerOurs(auth.Destination) {
+		return "", ErrInvalidFederationAuth
+	}
+
+	signature, err := decodeUnpaddedBase64(auth.Signature)
+	if err != nil {
+		return "", ErrInvalidFederationAuth
+	}
+	message, err := signedRequestJson(r.Method, r.RequestURI, auth.Origin, auth.Destination)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := getServerKey(auth.Origin, auth.KeyId, ctx)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(key, message, signature) {
+		return "", ErrInvalidFederationAuth
+	}
+	return auth.Origin, nil
+}
+
+func signedRequestJson(method string, uri string, origin string, destination string) ([]byte, error) {
+	request := map[string]string{
+		"method": method,
+		"uri":    uri,
+		"origin": origin,
+	}
+	if destination != "" {
+		request["destination"] = destination
+	}
+	return canonicalJson(request)
+}
+
+// canonicalJson encodes the value with sorted keys, no extra whitespace, and no HTML escaping.
+func canonicalJson(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func decodeUnpaddedBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func getCachedServerKey(cacheKey string) (ed25519.PublicKey, bool) {
+	record, found := serverKeysCache.Get(cacheKey)
+	if !found {
+		return nil, false
+	}
+	key, _ := record.(ed25519.PublicKey)
+	return key, true
+}
+
+func getServerKey(serverName string, keyId string, ctx rcontext.RequestContext) (ed25519.PublicKey, error) {
+	cacheKey := serverName + "/" + keyId
+	if key, found := getCachedServerKey(cacheKey); found {
+		if key == nil {
+			return nil, ErrInvalidFederationAuth
+		}
+		return key, nil
+	}
+
+	// Concurrent requests signed with the same key share one fetch
+	v, _, err := serverKeyFetchGroup.DoWithoutPost(cacheKey, func() (interface{}, error) {
+		// The key may have been fetched while we were waiting
+		if key, found := getCachedServerKey(cacheKey); found {
+			if key == nil {
+				return nil, ErrInvalidFederationAuth
+			}
+			return key, nil
+		}
+
+		if err := serverKeyFetches.Add(serverName, true, serverKeyFetchInterval); err != nil {
+			return nil, ErrInvalidFederationAuth
+		}
+
+		key, validUntilTs, err := fetchServerKey(serverName, keyId, ctx)
+		if err != nil {
+			ctx.Log.Warn("Unable to get signing key ", keyId, " for ", serverName, ": ", err)
+			serverKeysCache.Set(cacheKey, false, serverKeyFailureCacheTime)
+			return nil, ErrInvalidFederationAuth
+		}
+
+		expiry := serverKeyCacheTime
+		if validFor := time.Duration(validUntilTs-util.NowMillis()) * time.Millisecond; validFor < expiry {
+			expiry = validFor
+		}
+		if expiry > 0 {
+			serverKeysCache.Set(cacheKey, key, expiry)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(ed25519.PublicKey), nil
+}
+
+func fetchServerKeyFromOrigin(serverName string, keyId string, ctx rcontext.RequestContext) (ed25519.PublicKey, int64, error) {
+	url, hostname, err := GetServerApiUrl(serverName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := FederatedGet(url+"/_matrix/key/v2/server", hostname, ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.New("server keys were not found")
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := &serverKeysResponse{}
+	if err = json.Unmarshal(raw, keys); err != nil {
+		return nil, 0, err
+	}
+	if strings.ToLower(keys.ServerName) != serverName {
+		return nil, 0, errors.New("server keys are for a different server")
+	}
+	if keys.ValidUntilTs <= util.NowMillis() {
+		return nil, 0, errors.New("server keys have expired")
+	}
+
+	verifyKey, ok := keys.VerifyKeys[keyId]
+	if !ok {
+		return nil, 0, errors.New("server does not have the key")
+	}
+	decoded, err := decodeUnpaddedBase64(verifyKey.Key)
+	if err != nil || len(decoded) != ed25519.PublicKeySize {
+		return nil, 0, errors.New("server key is not a valid ed25519 key")
+	}
+	key := ed25519.PublicKey(decoded)
+
+	// The response has to be signed by the key itself, as the connection may not have verified the
+	// server's certificate
+	selfSignature, err := decodeUnpaddedBase64(keys.Signatures[keys.ServerName][keyId])
+	if err != nil {
+		return nil, 0, err
+	}
+	unsigned := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err = decoder.Decode(&unsigned); err != nil {
+		return nil, 0, err
+	}
+	delete(unsigned, "signatures")
+	delete(unsigned, "unsigned")
+	message, err := canonicalJson(unsigned)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ed25519.Verify(key, message, selfSignature) {
+		return nil, 0, errors.New("server keys are not signed by the key")
+	}
+
+	return key, keys.ValidUntilTs, nil
+}
@@ -0,0 +1,239 @@
+package matrix
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestMain(m *testing.M) {
+	// The destination of a request has to be one of our servers
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	err = ioutil.WriteFile(config.Path, []byte("homeservers:\n  - name: example.org\n    csApi: \"https://example.org/\"\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestParseXMatrixAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		expectedAuth *XMatrixAuth
+	}{
+		{
+			name:         "quoted",
+			header:       `X-Matrix origin="Remote.org",destination="example.org",key="ed25519:abc",sig="c2lnbmF0dXJl"`,
+			expectedAuth: &XMatrixAuth{Origin: "remote.org", Destination: "example.org", KeyId: "ed25519:abc", Signature: "c2lnbmF0dXJl"},
+		},
+		{
+			name:         "unquoted with spaces",
+			header:       `X-Matrix origin=remote.org, key="ed25519:abc", sig="c2lnbmF0dXJl"`,
+			expectedAuth: &XMatrixAuth{Origin: "remote.org", KeyId: "ed25519:abc", Signature: "c2lnbmF0dXJl"},
+		},
+		{name: "missing signature", header: `X-Matrix origin=remote.org,key="ed25519:abc"`},
+		{name: "missing origin", header: `X-Matrix key="ed25519:abc",sig="c2lnbmF0dXJl"`},
+		{name: "bearer token", header: "Bearer abc123"},
+		{name: "empty", header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, ok := ParseXMatrixAuth(tt.header)
+			if ok != (tt.expectedAuth != nil) {
+				t.Fatalf("got ok = %t, expected %t", ok, tt.expectedAuth != nil)
+			}
+			if tt.expectedAuth != nil && *auth != *tt.expectedAuth {
+				t.Errorf("got %+v, expected %+v", auth, tt.expectedAuth)
+			}
+		})
+	}
+}
+
+func TestCanonicalJson(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        interface{}
+		expectedJson string
+	}{
+		{name: "sorted keys", value: map[string]string{"uri": "/a", "method": "GET", "origin": "remote.org"}, expectedJson: `{"method":"GET","origin":"remote.org","uri":"/a"}`},
+		{name: "no html escaping", value: map[string]string{"uri": "/a?b=1&c=<2>"}, expectedJson: `{"uri":"/a?b=1&c=<2>"}`},
+		{name: "nested", value: map[string]interface{}{"b": []int{1, 2}, "a": map[string]bool{"y": true, "x": false}}, expectedJson: `{"a":{"x":false,"y":true},"b":[1,2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := canonicalJson(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expectedJson {
+				t.Errorf("got %s, expected %s", b, tt.expectedJson)
+			}
+		})
+	}
+}
+
+func TestDecodeUnpaddedBase64(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+		wantErr  bool
+	}{
+		{s: "aGVsbG8", expected: "hello"},
+		{s: "aGVsbG8=", expected: "hello"},
+		{s: "aGk", expected: "hi"},
+		{s: "not base64!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			b, err := decodeUnpaddedBase64(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("got %q, expected %q", b, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVerifyFederationRequest(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys are cached so that tests don't need to fetch them from the origin
+	serverKeysCache.Set("remote.org/ed25519:good", publicKey, serverKeyCacheTime)
+	serverKeysCache.Set("remote.org/ed25519:failed", false, serverKeyCacheTime)
+
+	uri := "/_matrix/media/r0/download/example.org/abc123?allow_remote=false"
+	sign := func(method string, uri string, destination string) string {
+		message, err := signedRequestJson(method, uri, "remote.org", destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawStdEncoding.EncodeToString(ed25519.Sign(privateKey, message))
+	}
+
+	tests := []struct {
+		name           string
+		header         string
+		expectedOrigin string
+		expectedErr    error
+	}{
+		{name: "signed", header: `X-Matrix origin=remote.org,key="ed25519:good",sig="` + sign("GET", uri, "") + `"`, expectedOrigin: "remote.org"},
+		{name: "signed with destination", header: `X-Matrix origin=remote.org,destination=example.org,key="ed25519:good",sig="` + sign("GET", uri, "example.org") + `"`, expectedOrigin: "remote.org"},
+		{name: "other destination", header: `X-Matrix origin=remote.org,destination=other.org,key="ed25519:good",sig="` + sign("GET", uri, "other.org") + `"`, expectedErr: ErrInvalidFederationAuth},
+		{name: "signed for another uri", header: `X-Matrix origin=remote.org,key="ed25519:good",sig="` + sign("GET", "/somewhere/else", "") + `"`, expectedErr: ErrInvalidFederationAuth},
+		{name: "signed for another method", header: `X-Matrix origin=remote.org,key="ed25519:good",sig="` + sign("POST", uri, "") + `"`, expectedErr: ErrInvalidFederationAuth},
+		{name: "unknown key", header: `X-Matrix origin=remote.org,key="ed25519:failed",sig="` + sign("GET", uri, "") + `"`, expectedErr: ErrInvalidFederationAuth},
+		{name: "bad signature encoding", header: `X-Matrix origin=remote.org,key="ed25519:good",sig="!!"`, expectedErr: ErrInvalidFederationAuth},
+		{name: "missing parameters", header: `X-Matrix origin=remote.org`, expectedErr: ErrInvalidFederationAuth},
+		{name: "no header", header: "", expectedErr: ErrNoFederationAuth},
+		{name: "access token", header: "Bearer abc123", expectedErr: ErrNoFederationAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", uri, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			origin, err := VerifyFederationRequest(r, testContext())
+			if err != tt.expectedErr {
+				t.Fatalf("got error %v, expected %v", err, tt.expectedErr)
+			}
+			if origin != tt.expectedOrigin {
+				t.Errorf("got %q, expected %q", origin, tt.expectedOrigin)
+			}
+		})
+	}
+}
+
+func TestServerKeyFetchesAreLimited(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int32
+	defer func(original func(string, string, rcontext.RequestContext) (ed25519.PublicKey, int64, error)) {
+		fetchServerKey = original
+	}(fetchServerKey)
+	fetchServerKey = func(serverName string, keyId string, ctx rcontext.RequestContext) (ed25519.PublicKey, int64, error) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(20 * time.Millisecond)
+		if keyId != "ed25519:real" {
+			return nil, 0, errors.New("server does not have the key")
+		}
+		return publicKey, time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond), nil
+	}
+
+	t.Run("made up key ids", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		for i := 0; i < 5; i++ {
+			if _, err := getServerKey("made-up.example.org", fmt.Sprintf("ed25519:fake%d", i), testContext()); err != ErrInvalidFederationAuth {
+				t.Errorf("got error %v, expected %v", err, ErrInvalidFederationAuth)
+			}
+		}
+		if n := atomic.LoadInt32(&fetches); n != 1 {
+			t.Errorf("got %d fetches, expected 1", n)
+		}
+	})
+
+	t.Run("concurrent requests", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		wg := &sync.WaitGroup{}
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				key, err := getServerKey("busy.example.org", "ed25519:real", testContext())
+				if err == nil && !key.Equal(publicKey) {
+					err = errors.New("got the wrong key")
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		if n := atomic.LoadInt32(&fetches); n != 1 {
+			t.Errorf("got %d fetches, expected 1", n)
+		}
+	})
+}
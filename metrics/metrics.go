@@ -43,6 +43,29 @@ var MediaDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
 var UrlPreviewsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "media_url_previews_generated_total",
 }, []string{"type"})
+var MediaUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_uploads_total",
+}, []string{"result"})
+var UploadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "media_upload_duration_seconds",
+	Buckets: prometheus.DefBuckets,
+})
+var ThumbnailDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "media_thumbnail_generation_duration_seconds",
+	Buckets: prometheus.DefBuckets,
+}, []string{"animated"})
+var BytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "media_bytes_served_total",
+}, []string{"host", "action"})
+var DeduplicationLogicalBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_deduplication_logical_bytes",
+})
+var DeduplicationPhysicalBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_deduplication_physical_bytes",
+})
+var DeduplicationRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "media_deduplication_ratio",
+})
 
 func init() {
 	prometheus.MustRegister(HttpRequests)
@@ -58,4 +81,11 @@ func init() {
 	prometheus.MustRegister(ThumbnailsGenerated)
 	prometheus.MustRegister(MediaDownloaded)
 	prometheus.MustRegister(UrlPreviewsGenerated)
+	prometheus.MustRegister(MediaUploaded)
+	prometheus.MustRegister(UploadDuration)
+	prometheus.MustRegister(ThumbnailDuration)
+	prometheus.MustRegister(BytesServed)
+	prometheus.MustRegister(DeduplicationLogicalBytes)
+	prometheus.MustRegister(DeduplicationPhysicalBytes)
+	prometheus.MustRegister(DeduplicationRatio)
 }
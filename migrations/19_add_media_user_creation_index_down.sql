@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_user_id_creation_ts_media;
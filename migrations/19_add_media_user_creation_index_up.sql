@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_user_id_creation_ts_media ON media (user_id, creation_ts);
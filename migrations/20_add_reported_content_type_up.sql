@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN reported_content_type TEXT NOT NULL DEFAULT '';
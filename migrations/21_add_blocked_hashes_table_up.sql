@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS blocked_hashes (
+	sha256_hash TEXT PRIMARY KEY NOT NULL,
+	reason TEXT NOT NULL,
+	blocked_ts BIGINT NOT NULL
+);
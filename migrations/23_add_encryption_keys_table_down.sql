@@ -0,0 +1 @@
+DROP TABLE encryption_keys;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS encryption_keys (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	key_id TEXT NOT NULL,
+	wrapped_key BYTEA NOT NULL,
+	key_nonce BYTEA NOT NULL,
+	base_nonce BYTEA NOT NULL,
+	PRIMARY KEY (datastore_id, location)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE export_parts DROP COLUMN encoded;
+ALTER TABLE thumbnails DROP COLUMN encoded;
+ALTER TABLE media DROP COLUMN encoded;
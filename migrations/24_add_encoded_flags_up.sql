@@ -0,0 +1,6 @@
+ALTER TABLE media ADD COLUMN encoded BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE thumbnails ADD COLUMN encoded BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE export_parts ADD COLUMN encoded BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE media SET encoded = TRUE WHERE (datastore_id, location) IN (SELECT datastore_id, location FROM encryption_keys);
+UPDATE thumbnails SET encoded = TRUE WHERE (datastore_id, location) IN (SELECT datastore_id, location FROM encryption_keys);
+UPDATE export_parts SET encoded = TRUE WHERE (datastore_id, location) IN (SELECT datastore_id, location FROM encryption_keys);
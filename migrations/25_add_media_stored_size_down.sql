@@ -0,0 +1 @@
+ALTER TABLE media DROP COLUMN stored_size_bytes;
@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN stored_size_bytes BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE media ADD COLUMN width INT NULL;
+ALTER TABLE media ADD COLUMN height INT NULL;
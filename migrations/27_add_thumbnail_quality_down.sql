@@ -0,0 +1,4 @@
+DELETE FROM thumbnails WHERE quality <> 0;
+DROP INDEX thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, format);
+ALTER TABLE thumbnails DROP COLUMN quality;
@@ -0,0 +1,3 @@
+ALTER TABLE thumbnails ADD COLUMN quality INT NOT NULL DEFAULT 0;
+DROP INDEX thumbnails_index;
+CREATE UNIQUE INDEX IF NOT EXISTS thumbnails_index ON thumbnails (media_id, origin, width, height, method, animated, format, quality);
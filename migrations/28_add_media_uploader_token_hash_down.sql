@@ -0,0 +1 @@
+ALTER TABLE media DROP COLUMN uploader_token_hash;
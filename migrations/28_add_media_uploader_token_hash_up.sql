@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN uploader_token_hash TEXT NOT NULL DEFAULT '';
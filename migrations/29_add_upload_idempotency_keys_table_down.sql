@@ -0,0 +1 @@
+DROP TABLE upload_idempotency_keys;
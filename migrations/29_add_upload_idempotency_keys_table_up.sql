@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS upload_idempotency_keys (
+	user_id TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	expires_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS upload_idempotency_keys_index ON upload_idempotency_keys (user_id, idempotency_key);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS media_reservations (
+	origin TEXT NOT NULL,
+	media_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	expires_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS media_reservations_index ON media_reservations (origin, media_id);
+CREATE INDEX IF NOT EXISTS media_reservations_user_id_index ON media_reservations (user_id);
@@ -0,0 +1 @@
+DROP TABLE migration_jobs;
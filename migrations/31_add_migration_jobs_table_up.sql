@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS migration_jobs (
+	task_id INT PRIMARY KEY,
+	source_datastore_id TEXT NOT NULL,
+	target_datastore_id TEXT NOT NULL,
+	before_ts BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	phase TEXT NOT NULL,
+	last_sha256_hash TEXT NOT NULL,
+	migrated_count BIGINT NOT NULL,
+	failed_count BIGINT NOT NULL,
+	migrated_bytes BIGINT NOT NULL,
+	updated_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS migration_jobs_status_index ON migration_jobs (status);
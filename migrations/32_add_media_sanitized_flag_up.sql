@@ -0,0 +1 @@
+ALTER TABLE media ADD COLUMN sanitized BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,6 @@
+UPDATE media SET sha256_hash = SUBSTRING(sha256_hash FROM 8) WHERE sha256_hash LIKE 'sha256:%';
+UPDATE thumbnails SET sha256_hash = SUBSTRING(sha256_hash FROM 8) WHERE sha256_hash LIKE 'sha256:%';
+UPDATE blurhashes SET sha256_hash = SUBSTRING(sha256_hash FROM 8) WHERE sha256_hash LIKE 'sha256:%';
+UPDATE blocked_hashes SET sha256_hash = SUBSTRING(sha256_hash FROM 8) WHERE sha256_hash LIKE 'sha256:%';
+UPDATE last_access SET sha256_hash = SUBSTRING(sha256_hash FROM 8) WHERE sha256_hash LIKE 'sha256:%';
+UPDATE migration_jobs SET last_sha256_hash = SUBSTRING(last_sha256_hash FROM 8) WHERE last_sha256_hash LIKE 'sha256:%';
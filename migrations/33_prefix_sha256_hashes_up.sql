@@ -0,0 +1,6 @@
+UPDATE media SET sha256_hash = 'sha256:' || sha256_hash WHERE sha256_hash <> '' AND sha256_hash NOT LIKE '%:%';
+UPDATE thumbnails SET sha256_hash = 'sha256:' || sha256_hash WHERE sha256_hash <> '' AND sha256_hash NOT LIKE '%:%';
+UPDATE blurhashes SET sha256_hash = 'sha256:' || sha256_hash WHERE sha256_hash NOT LIKE '%:%';
+UPDATE blocked_hashes SET sha256_hash = 'sha256:' || sha256_hash WHERE sha256_hash NOT LIKE '%:%';
+UPDATE last_access SET sha256_hash = 'sha256:' || sha256_hash WHERE sha256_hash <> '' AND sha256_hash NOT LIKE '%:%';
+UPDATE migration_jobs SET last_sha256_hash = 'sha256:' || last_sha256_hash WHERE last_sha256_hash <> '' AND last_sha256_hash NOT LIKE '%:%';
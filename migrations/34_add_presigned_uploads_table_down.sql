@@ -0,0 +1 @@
+DROP TABLE presigned_uploads;
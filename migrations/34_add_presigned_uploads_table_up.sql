@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS presigned_uploads (
+	datastore_id TEXT NOT NULL,
+	location TEXT NOT NULL,
+	expires_ts BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS presigned_uploads_index ON presigned_uploads (datastore_id, location);
+CREATE INDEX IF NOT EXISTS presigned_uploads_expires_ts_index ON presigned_uploads (expires_ts);
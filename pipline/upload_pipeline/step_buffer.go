@@ -4,9 +4,19 @@ import (
 	"io"
 	"io/ioutil"
 
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 )
 
 func bufferStream(ctx rcontext.RequestContext, r io.ReadCloser) ([]byte, error) {
-	return ioutil.ReadAll(r)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The stream is limited to one byte past the maximum, so anything over means it was too large
+	if ctx.Config.Uploads.MaxSizeBytes > 0 && int64(len(b)) > ctx.Config.Uploads.MaxSizeBytes {
+		return nil, common.ErrMediaTooLarge
+	}
+	return b, nil
 }
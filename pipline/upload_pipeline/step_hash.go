@@ -8,5 +8,5 @@ import (
 )
 
 func hashFile(ctx rcontext.RequestContext, r io.ReadCloser) (string, error) {
-	return util.GetSha256HashOfStream(r)
+	return util.GetHashOfStream(r)
 }
@@ -5,11 +5,12 @@ import (
 	"io/ioutil"
 
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 func limitStreamLength(ctx rcontext.RequestContext, r io.ReadCloser) io.ReadCloser {
 	if ctx.Config.Uploads.MaxSizeBytes > 0 {
-		return ioutil.NopCloser(io.LimitReader(r, ctx.Config.Uploads.MaxSizeBytes))
+		return ioutil.NopCloser(util.LimitPastMax(r, ctx.Config.Uploads.MaxSizeBytes))
 	} else {
 		return r
 	}
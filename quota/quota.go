@@ -6,27 +6,48 @@ import (
 	"github.com/ryanuber/go-glob"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
+// uploadStats is the part of the metadata store needed to check quotas.
+type uploadStats interface {
+	GetUserStats(userId string) (*types.UserStats, error)
+	GetUserUploadedBytesSince(userId string, sinceTs int64, excludeDuplicates bool) (int64, error)
+}
+
 func IsUserWithinQuota(ctx rcontext.RequestContext, userId string) (bool, error) {
 	if !ctx.Config.Uploads.Quota.Enabled {
 		return true, nil
 	}
 
-	db := storage.GetDatabase().GetMetadataStore(ctx)
-	stat, err := db.GetUserStats(userId)
-	if err == sql.ErrNoRows {
-		return true, nil // no stats == within quota
-	}
-	if err != nil {
-		return false, err
-	}
+	return isUserWithinQuota(ctx, userId, storage.GetDatabase().GetMetadataStore(ctx), util.NowMillis())
+}
 
+func isUserWithinQuota(ctx rcontext.RequestContext, userId string, db uploadStats, nowTs int64) (bool, error) {
 	for _, q := range ctx.Config.Uploads.Quota.UserQuotas {
 		if glob.Glob(q.Glob, userId) {
 			if q.MaxBytes == 0 {
 				return true, nil // infinite quota
 			}
+
+			if q.WindowSeconds > 0 {
+				// Uploads made exactly at the start of the window still count
+				sinceTs := nowTs - (q.WindowSeconds * 1000)
+				uploaded, err := db.GetUserUploadedBytesSince(userId, sinceTs, ctx.Config.Uploads.Quota.IgnoreDuplicates)
+				if err != nil {
+					return false, err
+				}
+				return uploaded < q.MaxBytes, nil
+			}
+
+			stat, err := db.GetUserStats(userId)
+			if err == sql.ErrNoRows {
+				return true, nil // no stats == within quota
+			}
+			if err != nil {
+				return false, err
+			}
 			return stat.UploadedBytes < q.MaxBytes, nil
 		}
 	}
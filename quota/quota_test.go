@@ -0,0 +1,187 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+type upload struct {
+	userId     string
+	sha256Hash string
+	sizeBytes  int64
+	creationTs int64
+}
+
+// fakeUploadStats answers quota queries from a list of uploads, the same way the metadata store's
+// queries do.
+type fakeUploadStats struct {
+	uploads []upload
+}
+
+func (f *fakeUploadStats) GetUserStats(userId string) (*types.UserStats, error) {
+	stat := &types.UserStats{UserId: userId}
+	for _, u := range f.uploads {
+		if u.userId == userId {
+			stat.UploadedBytes += u.sizeBytes
+		}
+	}
+	if stat.UploadedBytes == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return stat, nil
+}
+
+func (f *fakeUploadStats) GetUserUploadedBytesSince(userId string, sinceTs int64, excludeDuplicates bool) (int64, error) {
+	var total int64
+	for _, u := range f.uploads {
+		if u.userId != userId || u.creationTs < sinceTs {
+			continue
+		}
+		if excludeDuplicates && f.hasEarlierCopy(u) {
+			continue
+		}
+		total += u.sizeBytes
+	}
+	return total, nil
+}
+
+func (f *fakeUploadStats) hasEarlierCopy(u upload) bool {
+	for _, o := range f.uploads {
+		if o.sha256Hash == u.sha256Hash && o.creationTs < u.creationTs {
+			return true
+		}
+	}
+	return false
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+	ctx.Config.Uploads.Quota.Enabled = true
+	return ctx
+}
+
+func TestIsUserWithinQuotaWindow(t *testing.T) {
+	const user = "@alice:example.org"
+	const nowTs = int64(1000000000)
+	const windowSeconds = int64(3600)
+	windowStartTs := nowTs - (windowSeconds * 1000)
+
+	tests := []struct {
+		name             string
+		uploads          []upload
+		ignoreDuplicates bool
+		wantWithinQuota  bool
+	}{
+		{
+			name:            "upload inside the window counts",
+			uploads:         []upload{{user, "a", 100, nowTs - 1000}},
+			wantWithinQuota: false,
+		},
+		{
+			name:            "upload at the start of the window counts",
+			uploads:         []upload{{user, "a", 100, windowStartTs}},
+			wantWithinQuota: false,
+		},
+		{
+			name:            "upload just before the window has expired",
+			uploads:         []upload{{user, "a", 100, windowStartTs - 1}},
+			wantWithinQuota: true,
+		},
+		{
+			name:            "only uploads inside the window add up",
+			uploads:         []upload{{user, "a", 60, windowStartTs - 1}, {user, "b", 60, windowStartTs + 1}},
+			wantWithinQuota: true,
+		},
+		{
+			name:            "uploads inside the window add up",
+			uploads:         []upload{{user, "a", 60, windowStartTs}, {user, "b", 60, windowStartTs + 1}},
+			wantWithinQuota: false,
+		},
+		{
+			name:            "other users don't count",
+			uploads:         []upload{{"@bob:example.org", "a", 100, nowTs}},
+			wantWithinQuota: true,
+		},
+		{
+			name:             "duplicates can be ignored",
+			uploads:          []upload{{"@bob:example.org", "a", 100, windowStartTs - 1}, {user, "a", 100, nowTs}},
+			ignoreDuplicates: true,
+			wantWithinQuota:  true,
+		},
+		{
+			name:            "duplicates count by default",
+			uploads:         []upload{{"@bob:example.org", "a", 100, windowStartTs - 1}, {user, "a", 100, nowTs}},
+			wantWithinQuota: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.Quota.IgnoreDuplicates = tt.ignoreDuplicates
+			ctx.Config.Uploads.Quota.UserQuotas = []config.QuotaUserConfig{
+				{Glob: "@alice:*", MaxBytes: 100, WindowSeconds: windowSeconds},
+			}
+
+			within, err := isUserWithinQuota(ctx, user, &fakeUploadStats{uploads: tt.uploads}, nowTs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if within != tt.wantWithinQuota {
+				t.Errorf("got within quota = %t, expected %t", within, tt.wantWithinQuota)
+			}
+		})
+	}
+}
+
+func TestIsUserWithinQuotaRules(t *testing.T) {
+	const nowTs = int64(1000000000)
+	stats := &fakeUploadStats{uploads: []upload{
+		{"@alice:example.org", "a", 100, 1},
+		{"@bob:example.org", "b", 100, 1},
+	}}
+
+	tests := []struct {
+		name            string
+		userId          string
+		quotas          []config.QuotaUserConfig
+		wantWithinQuota bool
+	}{
+		{name: "no rules", userId: "@alice:example.org", wantWithinQuota: true},
+		{name: "lifetime quota reached", userId: "@alice:example.org", quotas: []config.QuotaUserConfig{{Glob: "*", MaxBytes: 100}}, wantWithinQuota: false},
+		{name: "lifetime quota not reached", userId: "@alice:example.org", quotas: []config.QuotaUserConfig{{Glob: "*", MaxBytes: 200}}, wantWithinQuota: true},
+		{name: "no uploads yet", userId: "@carol:example.org", quotas: []config.QuotaUserConfig{{Glob: "*", MaxBytes: 100}}, wantWithinQuota: true},
+		{name: "infinite quota", userId: "@alice:example.org", quotas: []config.QuotaUserConfig{{Glob: "*", MaxBytes: 0}}, wantWithinQuota: true},
+		{
+			name:            "first matching rule wins",
+			userId:          "@bob:example.org",
+			quotas:          []config.QuotaUserConfig{{Glob: "@bob:*", MaxBytes: 0}, {Glob: "*", MaxBytes: 100}},
+			wantWithinQuota: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Uploads.Quota.UserQuotas = tt.quotas
+
+			within, err := isUserWithinQuota(ctx, tt.userId, stats, nowTs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if within != tt.wantWithinQuota {
+				t.Errorf("got within quota = %t, expected %t", within, tt.wantWithinQuota)
+			}
+		})
+	}
+}
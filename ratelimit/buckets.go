@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/redis_cache"
+)
+
+type bucket struct {
+	lock    sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+var localBuckets = cache.New(10*time.Minute, 20*time.Minute)
+var localBucketsLock = &sync.Mutex{}
+
+// now is swapped out by tests
+var now = time.Now
+
+var redisInstance *redis_cache.RedisCache
+var redisLock = &sync.Once{}
+
+func getRedis() *redis_cache.RedisCache {
+	redisLock.Do(func() {
+		if config.Get().Redis.Enabled || config.Get().Features.Redis.Enabled {
+			logrus.Info("Setting up Redis for rate limiting")
+			redisInstance = redis_cache.NewCache()
+		}
+	})
+	return redisInstance
+}
+
+// takeTokens takes the amount from the named bucket, which holds up to the capacity and fully
+// refills over the interval. If there aren't enough tokens, the time to wait before trying again
+// is returned. Requests for more than the capacity are allowed once the bucket is full, leaving the
+// bucket in debt.
+func takeTokens(ctx rcontext.RequestContext, key string, capacity int64, interval time.Duration, amount int64, useRedis bool) time.Duration {
+	refillPerMs := float64(capacity) / float64(interval.Milliseconds())
+
+	if useRedis {
+		if r := getRedis(); r != nil {
+			wait, err := r.TakeTokens(ctx, key, float64(capacity), refillPerMs, float64(amount))
+			if err == nil {
+				return wait
+			}
+			ctx.Log.Warn("Falling back to local rate limiting after error contacting Redis: ", err)
+		}
+	}
+
+	localBucketsLock.Lock()
+	var b *bucket
+	if v, ok := localBuckets.Get(key); ok {
+		b = v.(*bucket)
+	} else {
+		b = &bucket{tokens: float64(capacity), updated: now()}
+	}
+	// Keep the bucket around for at least as long as it takes to refill
+	localBuckets.Set(key, b, interval+time.Minute)
+	localBucketsLock.Unlock()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	updated := now()
+	elapsedMs := float64(updated.Sub(b.updated).Milliseconds())
+	b.tokens = math.Min(float64(capacity), b.tokens+(elapsedMs*refillPerMs))
+	b.updated = updated
+
+	needed := math.Min(float64(amount), float64(capacity))
+	if b.tokens < needed {
+		return time.Duration(math.Ceil((needed-b.tokens)/refillPerMs)) * time.Millisecond
+	}
+	b.tokens -= float64(amount)
+	return 0
+}
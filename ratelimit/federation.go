@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// TakeFederationRequest counts a request from another homeserver against its server name's and IP
+// address's download limits, returning how long to wait before trying again if a limit has been
+// reached. The server name should be empty if it isn't known.
+func TakeFederationRequest(ctx rcontext.RequestContext, serverName string, ip string) time.Duration {
+	conf := ctx.Config.Downloads.FederationRateLimit
+	if !conf.Enabled || conf.IntervalSeconds <= 0 || conf.RequestsPerInterval <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(conf.IntervalSeconds) * time.Second
+	for _, key := range federationKeys(serverName, ip) {
+		if wait := takeTokens(ctx, key+":requests", conf.RequestsPerInterval, interval, 1, conf.UseRedis); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+// TakeFederationBytes counts the bytes about to be served to another homeserver against its server
+// name's and IP address's download limits, returning how long to wait before trying again if a
+// limit has been reached.
+func TakeFederationBytes(ctx rcontext.RequestContext, serverName string, ip string, sizeBytes int64) time.Duration {
+	conf := ctx.Config.Downloads.FederationRateLimit
+	if !conf.Enabled || conf.IntervalSeconds <= 0 || conf.BytesPerInterval <= 0 || sizeBytes <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(conf.IntervalSeconds) * time.Second
+	for _, key := range federationKeys(serverName, ip) {
+		if wait := takeTokens(ctx, key+":bytes", conf.BytesPerInterval, interval, sizeBytes, conf.UseRedis); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+func federationKeys(serverName string, ip string) []string {
+	keys := make([]string, 0)
+	if serverName != "" {
+		keys = append(keys, "mr:ratelimit:federation:server:"+serverName)
+	}
+	if ip != "" {
+		keys = append(keys, "mr:ratelimit:federation:ip:"+ip)
+	}
+	return keys
+}
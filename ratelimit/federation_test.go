@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func federationContext(conf config.FederationRateLimitConfig) rcontext.RequestContext {
+	ctx := testContext(config.UploadRateLimitConfig{})
+	ctx.Config.Downloads.FederationRateLimit = conf
+	return ctx
+}
+
+func TestFederationKeys(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverName   string
+		ip           string
+		expectedKeys []string
+	}{
+		{name: "both", serverName: "remote.org", ip: "10.0.0.1", expectedKeys: []string{"mr:ratelimit:federation:server:remote.org", "mr:ratelimit:federation:ip:10.0.0.1"}},
+		{name: "unverified server", serverName: "", ip: "10.0.0.1", expectedKeys: []string{"mr:ratelimit:federation:ip:10.0.0.1"}},
+		{name: "neither", expectedKeys: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if keys := federationKeys(tt.serverName, tt.ip); !reflect.DeepEqual(keys, tt.expectedKeys) {
+				t.Errorf("got %v, expected %v", keys, tt.expectedKeys)
+			}
+		})
+	}
+}
+
+func TestTakeFederationRequest(t *testing.T) {
+	ctx := federationContext(config.FederationRateLimitConfig{Enabled: true, IntervalSeconds: 60, RequestsPerInterval: 3})
+
+	tests := []struct {
+		name            string
+		serverName      string
+		ip              string
+		expectedLimited bool
+	}{
+		{name: "same server and ip", serverName: "remote.org", ip: "10.0.0.1", expectedLimited: true},
+		{name: "same server from another ip", serverName: "remote.org", ip: "10.0.0.2", expectedLimited: true},
+		{name: "another server from the same ip", serverName: "other.org", ip: "10.0.0.1", expectedLimited: true},
+		{name: "unverified server from the same ip", serverName: "", ip: "10.0.0.1", expectedLimited: true},
+		{name: "another server and ip", serverName: "other.org", ip: "10.0.0.2", expectedLimited: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withClock(t)
+			for i := 0; i < 3; i++ {
+				if wait := TakeFederationRequest(ctx, "remote.org", "10.0.0.1"); wait != 0 {
+					t.Fatalf("request %d was limited for %s", i, wait)
+				}
+			}
+
+			wait := TakeFederationRequest(ctx, tt.serverName, tt.ip)
+			if !tt.expectedLimited {
+				if wait != 0 {
+					t.Errorf("expected the request to be allowed, got a wait of %s", wait)
+				}
+				return
+			}
+			// One request's worth of tokens refills every 20 seconds
+			if wait != 20*time.Second {
+				t.Errorf("got a wait of %s, expected 20s", wait)
+			}
+		})
+	}
+}
+
+func TestTakeFederationRequestRefills(t *testing.T) {
+	ctx := federationContext(config.FederationRateLimitConfig{Enabled: true, IntervalSeconds: 60, RequestsPerInterval: 2})
+	advance := withClock(t)
+
+	for i := 0; i < 2; i++ {
+		if wait := TakeFederationRequest(ctx, "refill.org", ""); wait != 0 {
+			t.Fatalf("request %d was limited for %s", i, wait)
+		}
+	}
+	wait := TakeFederationRequest(ctx, "refill.org", "")
+	if wait != 30*time.Second {
+		t.Fatalf("got a wait of %s, expected 30s", wait)
+	}
+
+	advance(wait - time.Second)
+	if wait = TakeFederationRequest(ctx, "refill.org", ""); wait != time.Second {
+		t.Errorf("got a wait of %s before the bucket refilled, expected 1s", wait)
+	}
+
+	advance(time.Second)
+	if wait = TakeFederationRequest(ctx, "refill.org", ""); wait != 0 {
+		t.Errorf("expected the request to be allowed after refilling, got a wait of %s", wait)
+	}
+
+	// A whole interval refills the bucket completely, but no further
+	advance(10 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if wait = TakeFederationRequest(ctx, "refill.org", ""); wait != 0 {
+			t.Fatalf("request %d was limited for %s after refilling", i, wait)
+		}
+	}
+	if wait = TakeFederationRequest(ctx, "refill.org", ""); wait == 0 {
+		t.Error("expected the bucket to be exhausted again")
+	}
+}
+
+func TestTakeFederationBytes(t *testing.T) {
+	ctx := federationContext(config.FederationRateLimitConfig{Enabled: true, IntervalSeconds: 60, BytesPerInterval: 600})
+	advance := withClock(t)
+
+	if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 400); wait != 0 {
+		t.Fatalf("got a wait of %s, expected the first download to be allowed", wait)
+	}
+	if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 400); wait != 20*time.Second {
+		t.Fatalf("got a wait of %s, expected 20s for the missing 200 bytes", wait)
+	}
+	if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 0); wait != 0 {
+		t.Errorf("got a wait of %s, expected nothing to serve to be allowed", wait)
+	}
+
+	// Files larger than the whole budget are still served once the bucket is full
+	advance(time.Minute)
+	if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 5000); wait != 0 {
+		t.Fatalf("got a wait of %s, expected the large download to be allowed", wait)
+	}
+	if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 1); wait == 0 {
+		t.Errorf("got a wait of %s, expected the debt to be paid off first", wait)
+	}
+}
+
+func TestTakeFederationDisabled(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.FederationRateLimitConfig
+	}{
+		{name: "disabled", conf: config.FederationRateLimitConfig{Enabled: false, IntervalSeconds: 60, RequestsPerInterval: 1, BytesPerInterval: 1}},
+		{name: "no interval", conf: config.FederationRateLimitConfig{Enabled: true, RequestsPerInterval: 1, BytesPerInterval: 1}},
+		{name: "no limits", conf: config.FederationRateLimitConfig{Enabled: true, IntervalSeconds: 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withClock(t)
+			ctx := federationContext(tt.conf)
+			for i := 0; i < 5; i++ {
+				if wait := TakeFederationRequest(ctx, "remote.org", "10.0.0.1"); wait != 0 {
+					t.Fatalf("request %d was limited for %s", i, wait)
+				}
+				if wait := TakeFederationBytes(ctx, "remote.org", "10.0.0.1", 100); wait != 0 {
+					t.Fatalf("download %d was limited for %s", i, wait)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// TakeUpload counts an upload against the user's and IP address's upload limits, returning how
+// long to wait before uploading if a limit has been reached. The size should be zero if it isn't
+// known yet, in which case it can be counted later with TakeUploadBytes.
+func TakeUpload(ctx rcontext.RequestContext, userId string, ip string, sizeBytes int64) time.Duration {
+	conf := ctx.Config.Uploads.RateLimit
+	if !conf.Enabled || conf.IntervalSeconds <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(conf.IntervalSeconds) * time.Second
+	for _, key := range uploadKeys(userId, ip) {
+		if conf.RequestsPerInterval > 0 {
+			if wait := takeTokens(ctx, key+":requests", conf.RequestsPerInterval, interval, 1, conf.UseRedis); wait > 0 {
+				return wait
+			}
+		}
+	}
+
+	return TakeUploadBytes(ctx, userId, ip, sizeBytes)
+}
+
+// TakeUploadBytes counts bytes against the user's and IP address's upload limits, returning how
+// long to wait before uploading if a limit has been reached.
+func TakeUploadBytes(ctx rcontext.RequestContext, userId string, ip string, sizeBytes int64) time.Duration {
+	conf := ctx.Config.Uploads.RateLimit
+	if !conf.Enabled || conf.IntervalSeconds <= 0 || conf.BytesPerInterval <= 0 || sizeBytes <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(conf.IntervalSeconds) * time.Second
+	for _, key := range uploadKeys(userId, ip) {
+		if wait := takeTokens(ctx, key+":bytes", conf.BytesPerInterval, interval, sizeBytes, conf.UseRedis); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+func uploadKeys(userId string, ip string) []string {
+	keys := make([]string, 0)
+	if userId != "" {
+		keys = append(keys, "mr:ratelimit:upload:user:"+userId)
+	}
+	if ip != "" {
+		keys = append(keys, "mr:ratelimit:upload:ip:"+ip)
+	}
+	return keys
+}
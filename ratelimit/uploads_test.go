@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func testContext(conf config.UploadRateLimitConfig) rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+	ctx.Config.Uploads.RateLimit = conf
+	return ctx
+}
+
+// withClock empties the buckets and freezes the time seen by the rate limiter, returning a function
+// to move it forwards.
+func withClock(t *testing.T) func(d time.Duration) {
+	localBuckets.Flush()
+	current := time.Now()
+	now = func() time.Time {
+		return current
+	}
+	t.Cleanup(func() {
+		now = time.Now
+	})
+	return func(d time.Duration) {
+		current = current.Add(d)
+	}
+}
+
+func TestTakeUploadRequests(t *testing.T) {
+	ctx := testContext(config.UploadRateLimitConfig{Enabled: true, IntervalSeconds: 60, RequestsPerInterval: 3})
+
+	tests := []struct {
+		name        string
+		userId      string
+		ip          string
+		wantLimited bool
+	}{
+		{name: "same user and ip", userId: "@alice:example.org", ip: "10.0.0.1", wantLimited: true},
+		{name: "same user from another ip", userId: "@alice:example.org", ip: "10.0.0.2", wantLimited: true},
+		{name: "another user from the same ip", userId: "@bob:example.org", ip: "10.0.0.1", wantLimited: true},
+		{name: "another user and ip", userId: "@bob:example.org", ip: "10.0.0.2", wantLimited: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withClock(t)
+			for i := 0; i < 3; i++ {
+				if wait := TakeUpload(ctx, "@alice:example.org", "10.0.0.1", 0); wait != 0 {
+					t.Fatalf("upload %d was limited for %s", i, wait)
+				}
+			}
+
+			wait := TakeUpload(ctx, tt.userId, tt.ip, 0)
+			if !tt.wantLimited {
+				if wait != 0 {
+					t.Errorf("expected the upload to be allowed, got a wait of %s", wait)
+				}
+				return
+			}
+			// One request's worth of tokens refills every 20 seconds
+			if wait != 20*time.Second {
+				t.Errorf("got a wait of %s, expected 20s", wait)
+			}
+		})
+	}
+}
+
+func TestTakeUploadRefills(t *testing.T) {
+	ctx := testContext(config.UploadRateLimitConfig{Enabled: true, IntervalSeconds: 60, RequestsPerInterval: 2})
+	advance := withClock(t)
+
+	for i := 0; i < 2; i++ {
+		if wait := TakeUpload(ctx, "@refill:example.org", "", 0); wait != 0 {
+			t.Fatalf("upload %d was limited for %s", i, wait)
+		}
+	}
+	wait := TakeUpload(ctx, "@refill:example.org", "", 0)
+	if wait != 30*time.Second {
+		t.Fatalf("got a wait of %s, expected 30s", wait)
+	}
+
+	advance(wait - time.Second)
+	if wait = TakeUpload(ctx, "@refill:example.org", "", 0); wait != time.Second {
+		t.Errorf("got a wait of %s before the bucket refilled, expected 1s", wait)
+	}
+
+	advance(time.Second)
+	if wait = TakeUpload(ctx, "@refill:example.org", "", 0); wait != 0 {
+		t.Errorf("expected the upload to be allowed after refilling, got a wait of %s", wait)
+	}
+
+	// A whole interval refills the bucket completely, but no further
+	advance(10 * time.Minute)
+	for i := 0; i < 2; i++ {
+		if wait = TakeUpload(ctx, "@refill:example.org", "", 0); wait != 0 {
+			t.Fatalf("upload %d was limited for %s after refilling", i, wait)
+		}
+	}
+	if wait = TakeUpload(ctx, "@refill:example.org", "", 0); wait == 0 {
+		t.Error("expected the bucket to be exhausted again")
+	}
+}
+
+func TestTakeUploadBytes(t *testing.T) {
+	ctx := testContext(config.UploadRateLimitConfig{Enabled: true, IntervalSeconds: 100, BytesPerInterval: 1000})
+	advance := withClock(t)
+
+	if wait := TakeUploadBytes(ctx, "@bytes:example.org", "", 600); wait != 0 {
+		t.Fatalf("got a wait of %s, expected the first upload to be allowed", wait)
+	}
+	if wait := TakeUploadBytes(ctx, "@bytes:example.org", "", 600); wait != 20*time.Second {
+		t.Fatalf("got a wait of %s, expected 20s for the missing 200 bytes", wait)
+	}
+
+	// Uploads larger than the bucket are allowed once it is full, leaving it in debt
+	advance(100 * time.Second)
+	if wait := TakeUploadBytes(ctx, "@bytes:example.org", "", 5000); wait != 0 {
+		t.Fatalf("got a wait of %s, expected the large upload to be allowed", wait)
+	}
+	if wait := TakeUploadBytes(ctx, "@bytes:example.org", "", 1); wait != 400*time.Second+100*time.Millisecond {
+		t.Errorf("got a wait of %s, expected the debt to be paid off first", wait)
+	}
+}
+
+func TestTakeUploadDisabled(t *testing.T) {
+	ctx := testContext(config.UploadRateLimitConfig{Enabled: false, IntervalSeconds: 60, RequestsPerInterval: 1, BytesPerInterval: 1})
+	withClock(t)
+
+	for i := 0; i < 5; i++ {
+		if wait := TakeUpload(ctx, "@disabled:example.org", "10.0.0.3", 1000); wait != 0 {
+			t.Fatalf("upload %d was limited for %s with rate limiting disabled", i, wait)
+		}
+	}
+}
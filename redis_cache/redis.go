@@ -96,3 +96,45 @@ func (c *RedisCache) GetBytes(ctx rcontext.RequestContext, key string) ([]byte,
 	b, err := r.Bytes()
 	return b, err
 }
+
+// takeTokensScript implements a token bucket. The bucket starts full, refills continuously, and
+// may go into debt so that requests larger than the bucket can still be made once it is full.
+var takeTokensScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local refillPerMs = tonumber(ARGV[2])
+local amount = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local updated = tonumber(redis.call("HGET", KEYS[1], "updated"))
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+tokens = math.min(capacity, tokens + ((now - updated) * refillPerMs))
+
+local needed = math.min(amount, capacity)
+local waitMs = 0
+if tokens >= needed then
+	tokens = tokens - amount
+else
+	waitMs = math.ceil((needed - tokens) / refillPerMs)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity - tokens) / refillPerMs) + 1000)
+return waitMs
+`)
+
+// TakeTokens takes tokens from the named bucket, returning how long to wait before trying again
+// if there are not enough tokens available.
+func (c *RedisCache) TakeTokens(ctx rcontext.RequestContext, key string, capacity float64, refillPerMs float64, amount float64) (time.Duration, error) {
+	if c.ring.PoolStats().TotalConns == 0 {
+		return 0, ErrCacheDown
+	}
+	waitMs, err := takeTokensScript.Run(ctx.Context, c.ring, []string{key}, capacity, refillPerMs, amount, time.Now().UnixNano()/int64(time.Millisecond)).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(waitMs) * time.Millisecond, nil
+}
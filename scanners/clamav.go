@@ -0,0 +1,98 @@
+package scanners
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const clamChunkSize = 64 * 1024
+
+type clamAVScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func NewClamAVScanner(address string, timeoutSeconds int) Scanner {
+	return &clamAVScanner{
+		address: address,
+		timeout: time.Duration(timeoutSeconds) * time.Second,
+	}
+}
+
+// Scan streams the file to clamd using the INSTREAM command, as clamd may not be able to see
+// the file itself.
+func (s *clamAVScanner) Scan(path string) (bool, string, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return false, "", err
+	}
+	defer cleanup.DumpAndCloseStream(r)
+
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+
+	if s.timeout > 0 {
+		err = conn.SetDeadline(time.Now().Add(s.timeout))
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+
+	buf := make([]byte, clamChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = conn.Write(size); err != nil {
+				return false, "", err
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return false, "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false, "", readErr
+		}
+	}
+
+	// A zero-length chunk ends the stream
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return false, "", err
+	}
+	result := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND", or "<reason> ERROR"
+	if strings.HasSuffix(result, " OK") {
+		return true, "", nil
+	}
+	if strings.HasSuffix(result, " FOUND") {
+		reason := strings.TrimSuffix(strings.TrimPrefix(result, "stream: "), " FOUND")
+		return false, reason, nil
+	}
+	return false, "", errors.New("clamav: unexpected reply: " + result)
+}
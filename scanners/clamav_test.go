@@ -0,0 +1,104 @@
+package scanners
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+// fakeClamd accepts a single INSTREAM command, replying with the given reply once the stream ends.
+// The streamed content is sent to the returned channel.
+func fakeClamd(t *testing.T, reply string) (string, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		cmd := make([]byte, len("zINSTREAM\x00"))
+		if _, err = io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+			received <- nil
+			return
+		}
+		content := &bytes.Buffer{}
+		size := make([]byte, 4)
+		for {
+			if _, err = io.ReadFull(conn, size); err != nil {
+				received <- nil
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err = io.CopyN(content, conn, int64(n)); err != nil {
+				received <- nil
+				return
+			}
+		}
+		received <- content.Bytes()
+		_, _ = conn.Write([]byte(reply + "\x00"))
+	}()
+	return l.Addr().String(), received
+}
+
+func TestClamAVScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmr-clamav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := bytes.Repeat([]byte("media "), 20000) // more than one chunk
+	f := path.Join(dir, "upload")
+	if err = ioutil.WriteFile(f, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		reply      string
+		wantClean  bool
+		wantReason string
+		wantErr    bool
+	}{
+		{name: "clean", reply: "stream: OK", wantClean: true},
+		{name: "infected", reply: "stream: Eicar-Signature FOUND", wantClean: false, wantReason: "Eicar-Signature"},
+		{name: "error", reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, received := fakeClamd(t, tt.reply)
+
+			clean, reason, err := NewClamAVScanner(addr, 5).Scan(f)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if clean != tt.wantClean || reason != tt.wantReason {
+				t.Errorf("got clean = %t and reason %q, expected %t and %q", clean, reason, tt.wantClean, tt.wantReason)
+			}
+			if b := <-received; !bytes.Equal(b, contents) {
+				t.Errorf("clamd received %d bytes, expected %d", len(b), len(contents))
+			}
+		})
+	}
+}
+
+func TestClamAVScanMissingFile(t *testing.T) {
+	_, _, err := NewClamAVScanner("127.0.0.1:1", 1).Scan(path.Join(os.TempDir(), "mmr-does-not-exist"))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
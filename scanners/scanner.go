@@ -0,0 +1,25 @@
+package scanners
+
+import (
+	"errors"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+type Scanner interface {
+	// Scan reads the file at the given path and determines if it is safe to store. When the
+	// content is not clean, a human-readable reason is returned.
+	Scan(path string) (clean bool, reason string, err error)
+}
+
+// GetScanner returns the scanner described by the given config, or nil if scanning is disabled.
+func GetScanner(conf config.ScannerConfig) (Scanner, error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case "clamav":
+		return NewClamAVScanner(conf.Address, conf.TimeoutSeconds), nil
+	default:
+		return nil, errors.New("unknown scanner type: " + conf.Type)
+	}
+}
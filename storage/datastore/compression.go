@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Compressed objects are stored with a short header naming the algorithm, followed by the
+// compressed file. Compression happens before encryption, so encrypted objects carry this
+// header inside the encrypted stream, using compressionNone if the file wasn't compressed.
+// Whether an object has these headers at all is recorded against the media rather than
+// guessed from the file, as uploads can start with the same bytes.
+
+var compressionMagic = []byte{'M', 'M', 'R', 'Z'}
+
+const compressionNone = byte(0)
+const compressionGzip = byte(1)
+const compressionZstd = byte(2)
+
+// Sniffing the content type needs the start of the file. This matches what the mimetype
+// library reads by default.
+const compressionSniffBytes = 3072
+
+// These types are already compressed, so compressing them again only costs CPU time.
+var incompressibleTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/webp",
+	"image/heic",
+	"image/heif",
+	"image/avif",
+	"video/*",
+	"audio/*",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/pdf",
+}
+
+func getCompressionAlgorithm(conf config.DatastoreCompressionConfig) (byte, error) {
+	switch conf.Algorithm {
+	case "":
+		return 0, nil
+	case "gzip":
+		return compressionGzip, nil
+	case "zstd":
+		return compressionZstd, nil
+	default:
+		return 0, errors.New("unknown compression algorithm: " + conf.Algorithm)
+	}
+}
+
+func shouldCompress(contentType string, conf config.DatastoreCompressionConfig) bool {
+	if util.GlobMatchesAny(incompressibleTypes, contentType) {
+		return false
+	}
+	return util.GlobMatchesAny(conf.ContentTypes, contentType)
+}
+
+// compressStream compresses the file if the datastore is configured to compress files of its
+// (detected) content type, otherwise the file is returned unaltered.
+func compressStream(file io.ReadCloser, conf config.DatastoreCompressionConfig) (io.ReadCloser, bool, error) {
+	algorithm, err := getCompressionAlgorithm(conf)
+	if err != nil || algorithm == 0 {
+		return file, false, err
+	}
+
+	source := bufio.NewReaderSize(file, compressionSniffBytes)
+	start, err := source.Peek(compressionSniffBytes)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	buffered := &bufferedReadCloser{source, file}
+	if !shouldCompress(util.DetectContentType(start), conf) {
+		return buffered, false, nil
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		defer buffered.Close()
+
+		_, err := w.Write(compressionHeader(algorithm))
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+
+		var compressor io.WriteCloser
+		if algorithm == compressionZstd {
+			compressor, err = zstd.NewWriter(w)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		} else {
+			compressor = gzip.NewWriter(w)
+		}
+
+		_, err = io.Copy(compressor, buffered)
+		if err != nil {
+			compressor.Close()
+			w.CloseWithError(err)
+			return
+		}
+		w.CloseWithError(compressor.Close())
+	}()
+
+	return r, true, nil
+}
+
+func compressionHeader(algorithm byte) []byte {
+	return append(append([]byte{}, compressionMagic...), algorithm)
+}
+
+type headerReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// withCompressionHeader marks an uncompressed file as such, for storing inside an encrypted object.
+func withCompressionHeader(file io.ReadCloser) io.ReadCloser {
+	return &headerReadCloser{io.MultiReader(bytes.NewReader(compressionHeader(compressionNone)), file), file}
+}
+
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	closer io.Closer
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return z.closer.Close()
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	closer io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	_ = g.Reader.Close()
+	return g.closer.Close()
+}
+
+// decompressStream reads the compression header of an encoded object, decompressing the object
+// if needed.
+func decompressStream(stored io.ReadCloser) (io.ReadCloser, error) {
+	source := bufio.NewReader(stored)
+	header := make([]byte, len(compressionMagic)+1)
+	if _, err := io.ReadFull(source, header); err != nil || !bytes.Equal(header[:len(compressionMagic)], compressionMagic) {
+		stored.Close()
+		return nil, errors.New("stored object is missing its compression header")
+	}
+	algorithm := header[len(compressionMagic)]
+
+	switch algorithm {
+	case compressionNone:
+		return &bufferedReadCloser{source, stored}, nil
+	case compressionGzip:
+		gz, err := gzip.NewReader(source)
+		if err != nil {
+			stored.Close()
+			return nil, err
+		}
+		return &gzipReadCloser{gz, stored}, nil
+	case compressionZstd:
+		zs, err := zstd.NewReader(source)
+		if err != nil {
+			stored.Close()
+			return nil, err
+		}
+		return &zstdReadCloser{zs, stored}, nil
+	default:
+		stored.Close()
+		return nil, errors.New("unknown compression algorithm in stored object")
+	}
+}
@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func compressingDatastore(t *testing.T, algorithm string, contentTypes []string) *DatastoreRef {
+	return &DatastoreRef{
+		DatastoreId: "test",
+		Type:        "file",
+		Uri:         t.TempDir(),
+		config: config.DatastoreConfig{
+			Compression: config.DatastoreCompressionConfig{Algorithm: algorithm, ContentTypes: contentTypes},
+		},
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("All work and no play makes Jack a dull boy.\n", 5000))
+
+	tests := []struct {
+		name      string
+		algorithm string
+		encrypted bool
+	}{
+		{name: "gzip", algorithm: "gzip"},
+		{name: "zstd", algorithm: "zstd"},
+		{name: "gzip and encryption", algorithm: "gzip", encrypted: true},
+		{name: "zstd and encryption", algorithm: "zstd", encrypted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncryption(t, tt.encrypted, "key1", map[string]string{"key1": randomKey(t)})
+			ds := compressingDatastore(t, tt.algorithm, []string{"text/*"})
+
+			info := uploadBytes(t, ds, text)
+
+			// Quotas work on the original size, while the stored size is tracked separately
+			if info.SizeBytes != int64(len(text)) {
+				t.Errorf("got %d bytes, expected the uncompressed size of %d", info.SizeBytes, len(text))
+			}
+			stored, err := ioutil.ReadFile(path.Join(ds.Uri, info.Location))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.StoredSizeBytes != int64(len(stored)) {
+				t.Errorf("got %d stored bytes, expected %d", info.StoredSizeBytes, len(stored))
+			}
+			if !info.Encoded {
+				t.Error("expected the object to be marked as encoded")
+			}
+			if info.StoredSizeBytes >= info.SizeBytes {
+				t.Errorf("expected the file to be compressed, stored %d of %d bytes", info.StoredSizeBytes, info.SizeBytes)
+			}
+
+			downloaded, err := downloadBytes(ds, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(downloaded, text) {
+				t.Error("expected the download to match the uploaded file")
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsIncompressibleTypes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rand.Intn(256))
+	}
+	img.Set(0, 0, color.White)
+	pngBytes := &bytes.Buffer{}
+	if err := png.Encode(pngBytes, img); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		contentTypes []string
+		contents     []byte
+	}{
+		{name: "image matching the glob", contentTypes: []string{"*"}, contents: pngBytes.Bytes()},
+		{name: "text not matching the glob", contentTypes: []string{"application/json"}, contents: []byte("plain text, which isn't configured to be compressed")},
+		{name: "file which looks compressed", contentTypes: []string{"application/json"}, contents: append(compressionHeader(compressionGzip), "not actually compressed"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncryption(t, false, "", nil)
+			ds := compressingDatastore(t, "zstd", tt.contentTypes)
+
+			info := uploadBytes(t, ds, tt.contents)
+
+			stored, err := ioutil.ReadFile(path.Join(ds.Uri, info.Location))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, tt.contents) {
+				t.Error("expected the file to be stored as-is")
+			}
+			if info.StoredSizeBytes != info.SizeBytes {
+				t.Errorf("got %d stored bytes, expected %d", info.StoredSizeBytes, info.SizeBytes)
+			}
+			if info.Encoded {
+				t.Error("expected the object to be stored unencoded")
+			}
+
+			downloaded, err := downloadBytes(ds, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(downloaded, tt.contents) {
+				t.Error("expected the download to match the uploaded file")
+			}
+		})
+	}
+}
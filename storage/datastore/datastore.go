@@ -5,13 +5,17 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/turt2live/matrix-media-repo/common"
 	"io"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
 	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 func GetAvailableDatastores(ctx rcontext.RequestContext) ([]*types.Datastore, error) {
@@ -48,12 +52,12 @@ func LocateDatastore(ctx rcontext.RequestContext, datastoreId string) (*Datastor
 	return newDatastoreRef(ds, conf), nil
 }
 
-func DownloadStream(ctx rcontext.RequestContext, datastoreId string, location string) (io.ReadCloser, error) {
+func DownloadStream(ctx rcontext.RequestContext, datastoreId string, location string, encoded bool) (io.ReadCloser, error) {
 	ref, err := LocateDatastore(ctx, datastoreId)
 	if err != nil {
 		return nil, err
 	}
-	return ref.DownloadFile(location)
+	return ref.DownloadFile(location, encoded)
 }
 
 func GetDatastoreConfig(ds *types.Datastore) (config.DatastoreConfig, error) {
@@ -87,6 +91,13 @@ func GetUriForDatastore(dsConf config.DatastoreConfig) string {
 		} else {
 			return fmt.Sprintf("s3://%s/%s", endpoint, bucket)
 		}
+	} else if dsConf.Type == "azure" {
+		container, containerFound := dsConf.Options["container"]
+		if _, accountFound := dsConf.Options["accountName"]; !accountFound || !containerFound {
+			sentry.CaptureException(errors.New("Missing 'accountName' or 'container' on azure datastore"))
+			logrus.Fatal("Missing 'accountName' or 'container' on azure datastore")
+		}
+		return fmt.Sprintf("azure://%s/%s", strings.TrimPrefix(strings.TrimPrefix(ds_azure.GetEndpoint(dsConf), "https://"), "http://"), container)
 	} else if dsConf.Type == "ipfs" {
 		return "ipfs://localhost"
 	} else {
@@ -100,12 +111,12 @@ func GetUriForDatastore(dsConf config.DatastoreConfig) string {
 func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
 	ctx.Log.Info("Finding a suitable datastore to pick for " + forKind)
 	confDatastores := ctx.Config.DataStores
-	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
 
 	// Figure out which datastores are likely to be useful for us to check against first. This
 	// helps speed up later checks which could require significant DB resources (estimating the
 	// size of the datastore).
 	var possibleDatastores = make([]config.DatastoreConfig, 0)
+	lowOnSpace := 0
 	for _, dsConf := range confDatastores {
 		if !dsConf.Enabled {
 			continue
@@ -115,10 +126,21 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 		if !allowed {
 			continue
 		}
+		if isLowOnSpace(dsConf, ctx) {
+			lowOnSpace++
+			continue
+		}
 
 		possibleDatastores = append(possibleDatastores, dsConf)
 	}
 
+	if len(possibleDatastores) == 0 && lowOnSpace > 0 {
+		// Every datastore which could have been used is too full to write to
+		err := fmt.Errorf("%d datastores are below their minimum free space", lowOnSpace)
+		return nil, &common.DatastoreUnavailableError{DatastoreId: "(any)", OutOfStorage: true, Err: err}
+	}
+
+	mediaStore := storage.GetDatabase().GetMediaStore(ctx)
 	var targetDs *types.Datastore
 	var targetDsConf config.DatastoreConfig
 	var dsSize int64
@@ -157,6 +179,129 @@ func PickDatastore(forKind string, ctx rcontext.RequestContext) (*DatastoreRef,
 	return nil, errors.New("failed to pick a datastore: none available")
 }
 
+// SelectDatastore picks a datastore for the given media using the configured datastore rules. The
+// first rule to match the media decides the datastore, falling back to PickDatastore when no rules
+// match. Rules which point at a datastore that can't accept the kind of media are skipped.
+func SelectDatastore(forKind string, sizeBytes int64, contentType string, origin string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	for i, rule := range ctx.Config.DatastoreRules {
+		if !ruleMatches(rule, sizeBytes, contentType, origin) {
+			continue
+		}
+
+		ds, err := datastoreForRule(rule.DatastoreId, forKind, ctx)
+		if err != nil {
+			ctx.Log.Warn(fmt.Sprintf("Error getting datastore %s for datastore rule %d: %s", rule.DatastoreId, i, err.Error()))
+			sentry.CaptureException(err)
+			continue
+		}
+		if ds == nil {
+			continue
+		}
+		if isLowOnSpace(ds.config, ctx) {
+			ctx.Log.Warn(fmt.Sprintf("Skipping datastore %s for datastore rule %d as it is low on free space", rule.DatastoreId, i))
+			continue
+		}
+
+		ctx.Log.Info(fmt.Sprintf("Using %s due to datastore rule %d", ds.Uri, i))
+		return ds, nil
+	}
+
+	return pickDatastore(forKind, ctx)
+}
+
+// datastoreForRule, pickDatastore, and locateDatastore are swapped out by tests
+var pickDatastore = PickDatastore
+var locateDatastore = LocateDatastore
+var datastoreForRule = func(datastoreId string, forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	ds, err := storage.GetDatabase().GetMediaStore(ctx).GetDatastore(datastoreId)
+	if err != nil {
+		return nil, err
+	}
+	dsConf, err := GetDatastoreConfig(ds)
+	if err != nil {
+		return nil, err
+	}
+	if !dsConf.Enabled || !common.HasKind(dsConf.MediaKinds, forKind) {
+		return nil, nil // the datastore can't accept this media
+	}
+	return newDatastoreRef(ds, dsConf), nil
+}
+
+// PickThumbnailDatastore picks a datastore for a new thumbnail. When the thumbnails.datastore option is
+// set, thumbnails are only ever stored in that datastore (regardless of its forKinds), and an error is
+// returned if it can't be used. Otherwise a datastore is picked with PickDatastore.
+func PickThumbnailDatastore(ctx rcontext.RequestContext) (*DatastoreRef, error) {
+	datastoreId := ctx.Config.Thumbnails.Datastore
+	if datastoreId == "" {
+		return pickDatastore(common.KindThumbnails, ctx)
+	}
+
+	ds, err := locateDatastore(ctx, datastoreId)
+	if err != nil {
+		return nil, &common.DatastoreUnavailableError{DatastoreId: datastoreId, Err: err}
+	}
+	if err = checkThumbnailDatastore(ds, ctx); err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info("Using ", ds.Uri, " for thumbnails")
+	return ds, nil
+}
+
+// checkThumbnailDatastore determines if thumbnails can be stored in the datastore, returning a
+// DatastoreUnavailableError if not.
+func checkThumbnailDatastore(ds *DatastoreRef, ctx rcontext.RequestContext) error {
+	if !ds.config.Enabled {
+		return &common.DatastoreUnavailableError{DatastoreId: ds.DatastoreId, Err: errors.New("datastore is not enabled")}
+	}
+	if isLowOnSpace(ds.config, ctx) {
+		err := fmt.Errorf("datastore is below its minimum free space")
+		return &common.DatastoreUnavailableError{DatastoreId: ds.DatastoreId, OutOfStorage: true, Err: err}
+	}
+	return nil
+}
+
+func ruleMatches(rule config.DatastoreSelectionRule, sizeBytes int64, contentType string, origin string) bool {
+	if rule.MinBytes > 0 && sizeBytes < rule.MinBytes {
+		return false
+	}
+	if rule.MaxBytes > 0 && sizeBytes > rule.MaxBytes {
+		return false
+	}
+	if len(rule.ContentTypes) > 0 && !util.GlobMatchesAny(rule.ContentTypes, contentType) {
+		return false
+	}
+	if len(rule.Origins) > 0 && !util.GlobMatchesAny(rule.Origins, origin) {
+		return false
+	}
+	return true
+}
+
 func estimatedDatastoreSize(ds *types.Datastore, ctx rcontext.RequestContext) (int64, error) {
 	return storage.GetDatabase().GetMetadataStore(ctx).GetEstimatedSizeOfDatastore(ds.DatastoreId)
 }
+
+// getFreeBytes is swapped out by tests
+var getFreeBytes = ds_file.GetFreeBytes
+
+// isLowOnSpace determines if the datastore is a file datastore with less free space than its
+// minFreeBytes option allows. Errors checking the free space are logged, and the datastore is
+// assumed to have enough space.
+func isLowOnSpace(dsConf config.DatastoreConfig, ctx rcontext.RequestContext) bool {
+	if dsConf.Type != "file" || dsConf.MinFreeBytes <= 0 {
+		return false
+	}
+
+	basePath := GetUriForDatastore(dsConf)
+	freeBytes, err := getFreeBytes(basePath)
+	if err != nil {
+		ctx.Log.Warn("Error checking free space of ", basePath, ": ", err.Error())
+		sentry.CaptureException(err)
+		return false
+	}
+	if freeBytes < dsConf.MinFreeBytes {
+		ctx.Log.Warnf("Datastore %s has %d bytes free, which is below the minimum of %d bytes", basePath, freeBytes, dsConf.MinFreeBytes)
+		return true
+	}
+	return false
+}
@@ -1,21 +1,32 @@
 package datastore
 
 import (
+	"database/sql"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
 	config2 "github.com/turt2live/matrix-media-repo/common/config"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_file"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_ipfs"
 	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_s3"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
 )
 
+var ErrPresignUnsupported = errors.New("datastore does not support presigned downloads")
+var ErrPresignUploadUnsupported = errors.New("datastore does not support presigned uploads")
+
 type DatastoreRef struct {
 	// TODO: Don't blindly copy properties from types.Datastore
 	DatastoreId string
@@ -39,14 +50,158 @@ func newDatastoreRef(ds *types.Datastore, config config2.DatastoreConfig) *Datas
 func (d *DatastoreRef) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	ctx = ctx.LogWithFields(logrus.Fields{"datastoreId": d.DatastoreId, "datastoreUri": d.Uri})
 
+	// Uploads can only be retried if the file can be read again
+	seeker, canRetry := file.(io.Seeker)
+	if !canRetry || d.config.Retries.MaxRetries <= 0 {
+		return d.encodeAndUploadFile(file, expectedLength, ctx)
+	}
+
+	defer cleanup.DumpAndCloseStream(file)
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	var info *types.ObjectInfo
+	err = d.withRetries("upload", func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		info, err = d.encodeAndUploadFile(ioutil.NopCloser(file), expectedLength, ctx)
+		return err
+	})
+	return info, err
+}
+
+func (d *DatastoreRef) encodeAndUploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	if !d.transformsFiles() {
+		info, err := d.uploadFile(file, expectedLength, ctx)
+		if err != nil {
+			return nil, err
+		}
+		info.StoredSizeBytes = info.SizeBytes
+		return info, nil
+	}
+
+	defer cleanup.DumpAndCloseStream(file)
+	tracker, err := newPlaintextTracker()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := d.encodeForStorage(ioutil.NopCloser(io.TeeReader(file, tracker)), expectedLength, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer encoded.Close() // stops the encoding if the upload fails part way
+	info, err := d.uploadFile(encoded, encoded.length, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded.key != nil {
+		encoded.key.DatastoreId = d.DatastoreId
+		encoded.key.Location = info.Location
+		err = getEncryptionKeyStore(ctx).UpsertEncryptionKey(encoded.key)
+		if err != nil {
+			// The object can't be read without its key, so there's no point keeping it
+			_ = d.deleteObject(info.Location)
+			return nil, err
+		}
+	}
+
+	// Report the original file's hash and size so de-duplication and quotas are unaffected
+	info.StoredSizeBytes = info.SizeBytes
+	info.Sha256Hash = tracker.Sha256Hash()
+	info.SizeBytes = tracker.sizeBytes
+	info.Encoded = encoded.encoded
+	return info, nil
+}
+
+// transformsFiles determines if files are compressed or encrypted before being stored.
+func (d *DatastoreRef) transformsFiles() bool {
+	if d.Type == "ipfs" {
+		// IPFS objects are content addressed and public, so they are stored as-is
+		return false
+	}
+	return isEncryptionEnabled(d.Type) || d.config.Compression.Algorithm != ""
+}
+
+type encodedStream struct {
+	io.ReadCloser
+	length  int64                // The length of the stream, or -1 if unknown
+	encoded bool                 // False if the file is stored as-is, and must not be decoded
+	key     *types.EncryptionKey // The key which must be stored for encrypted files
+}
+
+// encodeForStorage compresses and encrypts the file as configured.
+func (d *DatastoreRef) encodeForStorage(stream io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*encodedStream, error) {
+	if d.Type == "ipfs" {
+		return &encodedStream{ReadCloser: stream, length: expectedLength}, nil
+	}
+
+	compressed, isCompressed, err := compressStream(stream, d.config.Compression)
+	if err != nil {
+		cleanup.DumpAndCloseStream(stream)
+		return nil, err
+	}
+	stream = compressed
+	if isCompressed {
+		expectedLength = -1
+	}
+
+	if !isEncryptionEnabled(d.Type) {
+		return &encodedStream{ReadCloser: stream, length: expectedLength, encoded: isCompressed}, nil
+	}
+
+	if !isCompressed {
+		// Once decrypted, the file needs to say that it isn't compressed
+		stream = withCompressionHeader(stream)
+		if expectedLength > 0 {
+			expectedLength += int64(len(compressionMagic) + 1)
+		}
+	}
+	keyId := config2.Get().Encryption.KeyId
+	masterKey, err := getMasterKey(keyId)
+	if err != nil {
+		cleanup.DumpAndCloseStream(stream)
+		return nil, err
+	}
+	encrypted, key, err := encryptStream(ctx, stream, keyId, masterKey)
+	if err != nil {
+		cleanup.DumpAndCloseStream(stream)
+		return nil, err
+	}
+	if expectedLength > 0 {
+		expectedLength = encryptedLength(expectedLength)
+	}
+	return &encodedStream{ReadCloser: encrypted, length: expectedLength, encoded: true, key: key}, nil
+}
+
+func (d *DatastoreRef) uploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	if d.Type == "file" {
-		return ds_file.PersistFile(d.Uri, file, ctx)
+		// The datastore may have filled up since it was picked, so check again before writing to it
+		if isLowOnSpace(d.config, ctx) {
+			cleanup.DumpAndCloseStream(file)
+			err := errors.New("below the minimum free space")
+			return nil, &common.DatastoreUnavailableError{DatastoreId: d.DatastoreId, OutOfStorage: true, Err: err}
+		}
+		info, err := ds_file.PersistFile(d.Uri, file, ctx)
+		if err != nil {
+			return nil, d.checkUnavailable(err)
+		}
+		return info, nil
 	} else if d.Type == "s3" {
 		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
 		if err != nil {
 			return nil, err
 		}
 		return s3.UploadFile(file, expectedLength, ctx)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return azure.UploadFile(file, expectedLength, ctx)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.UploadFile(file, ctx)
 	} else {
@@ -54,7 +209,34 @@ func (d *DatastoreRef) UploadFile(file io.ReadCloser, expectedLength int64, ctx
 	}
 }
 
+// checkUnavailable converts errors caused by the datastore being full, read-only, or otherwise
+// not writable into a common.DatastoreUnavailableError.
+func (d *DatastoreRef) checkUnavailable(err error) error {
+	if isOutOfStorage(err) {
+		return &common.DatastoreUnavailableError{DatastoreId: d.DatastoreId, OutOfStorage: true, Err: err}
+	}
+	if isReadOnlyFilesystem(err) || os.IsPermission(err) {
+		return &common.DatastoreUnavailableError{DatastoreId: d.DatastoreId, Err: err}
+	}
+	return err
+}
+
 func (d *DatastoreRef) DeleteObject(location string) error {
+	err := d.withRetries("delete", func() error {
+		return d.deleteObject(location)
+	})
+	if (err != nil && !os.IsNotExist(err)) || !isEncryptionConfigured(d.Type) {
+		return err
+	}
+
+	// Clean up the object's key too, even if the object itself was already gone
+	if keyErr := getEncryptionKeyStore(rcontext.Initial()).DeleteEncryptionKey(d.DatastoreId, location); keyErr != nil {
+		return keyErr
+	}
+	return err
+}
+
+func (d *DatastoreRef) deleteObject(location string) error {
 	if d.Type == "file" {
 		return ds_file.DeletePersistedFile(d.Uri, location)
 	} else if d.Type == "s3" {
@@ -63,6 +245,12 @@ func (d *DatastoreRef) DeleteObject(location string) error {
 			return err
 		}
 		return s3.DeleteObject(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.DeleteObject(location)
 	} else if d.Type == "ipfs" {
 		// TODO: Support deleting from IPFS - will need a "delete reason" to avoid deleting duplicates
 		logrus.Warn("Unsupported operation: deleting from IPFS datastore")
@@ -72,7 +260,83 @@ func (d *DatastoreRef) DeleteObject(location string) error {
 	}
 }
 
-func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
+// ListObjects calls the function for every object stored in the datastore. The function should
+// return an error to stop listing objects.
+func (d *DatastoreRef) ListObjects(fn func(location string, sizeBytes int64, modified time.Time) error) error {
+	if d.Type == "file" {
+		return ds_file.ListFiles(d.Uri, func(location string, info os.FileInfo) error {
+			return fn(location, info.Size(), info.ModTime())
+		})
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return s3.ListObjects(fn)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.ListObjects(fn)
+	} else if d.Type == "ipfs" {
+		return errors.New("unsupported operation: listing objects in IPFS datastore")
+	} else {
+		return errors.New("unknown datastore type")
+	}
+}
+
+// MayContainForeignObjects determines if objects which weren't stored by the media repo could be
+// listed in the datastore. An s3 bucket may be shared with other applications unless the datastore
+// says otherwise, and those objects can't be told apart from orphaned files.
+func (d *DatastoreRef) MayContainForeignObjects() bool {
+	if d.Type != "s3" {
+		return false
+	}
+	dedicated, _ := strconv.ParseBool(d.config.Options["dedicatedBucket"])
+	return !dedicated
+}
+
+// DownloadFile downloads the file at the location, decoding it if the record for the file says that
+// it was encoded (compressed or encrypted) when it was stored.
+func (d *DatastoreRef) DownloadFile(location string, encoded bool) (io.ReadCloser, error) {
+	var stream io.ReadCloser
+	err := d.withRetries("download", func() error {
+		var err error
+		stream, err = d.downloadFile(location)
+		return err
+	})
+	if err != nil || !encoded {
+		return stream, err
+	}
+
+	stream, err = d.decryptObject(location, stream)
+	if err != nil {
+		return nil, err
+	}
+	return decompressStream(stream)
+}
+
+// decryptObject decrypts the object if it was stored encrypted. Encoded objects without a key were
+// only compressed.
+func (d *DatastoreRef) decryptObject(location string, stream io.ReadCloser) (io.ReadCloser, error) {
+	key, err := getEncryptionKeyStore(rcontext.Initial()).GetEncryptionKey(d.DatastoreId, location)
+	if err == sql.ErrNoRows {
+		return stream, nil
+	}
+	if err != nil {
+		cleanup.DumpAndCloseStream(stream)
+		return nil, err
+	}
+	masterKey, err := getMasterKey(key.KeyId)
+	if err != nil {
+		cleanup.DumpAndCloseStream(stream)
+		return nil, err
+	}
+	return decryptStream(stream, key, masterKey)
+}
+
+func (d *DatastoreRef) downloadFile(location string) (io.ReadCloser, error) {
 	if d.Type == "file" {
 		return os.Open(path.Join(d.Uri, location))
 	} else if d.Type == "s3" {
@@ -81,6 +345,12 @@ func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
 			return nil, err
 		}
 		return s3.DownloadObject(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return azure.DownloadObject(location)
 	} else if d.Type == "ipfs" {
 		return ds_ipfs.DownloadFile(location)
 	} else {
@@ -88,6 +358,120 @@ func (d *DatastoreRef) DownloadFile(location string) (io.ReadCloser, error) {
 	}
 }
 
+// PresignDownload generates a short-lived URL for downloading the media directly from the datastore,
+// with the given content disposition. Media which is stored encrypted or compressed can't be served
+// directly, so ErrPresignUnsupported is returned for it.
+func (d *DatastoreRef) PresignDownload(media *types.Media, expiry time.Duration, disposition string) (string, error) {
+	// Files stored while encryption or compression was enabled are still encoded, even if it has
+	// since been disabled
+	if d.Type != "s3" || d.transformsFiles() || media.Encoded {
+		return "", ErrPresignUnsupported
+	}
+
+	s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("response-content-type", media.ContentType)
+	params.Set("response-content-disposition", disposition)
+	signed, err := s3.PresignDownload(media.Location, expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return signed.String(), nil
+}
+
+// PresignUpload generates a location for a new object and a short-lived URL which the object can be
+// uploaded to directly with a PUT request. The object is stored exactly as uploaded, so datastores
+// which compress or encrypt files return ErrPresignUploadUnsupported.
+func (d *DatastoreRef) PresignUpload(expiry time.Duration) (string, string, error) {
+	if d.Type != "s3" || d.transformsFiles() {
+		return "", "", ErrPresignUploadUnsupported
+	}
+
+	s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+	if err != nil {
+		return "", "", err
+	}
+	location, signed, err := s3.PresignUpload(expiry)
+	if err != nil {
+		return "", "", err
+	}
+	return location, signed.String(), nil
+}
+
+// ObjectSize returns the stored size of the object without downloading it, or an error matching
+// os.IsNotExist if the object doesn't exist.
+func (d *DatastoreRef) ObjectSize(location string) (int64, error) {
+	if d.Type == "file" {
+		info, err := os.Stat(path.Join(d.Uri, location))
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return 0, err
+		}
+		return s3.ObjectSize(location)
+	} else {
+		return 0, errors.New("unsupported operation: reading object size in " + d.Type + " datastore")
+	}
+}
+
+// DownloadFileStart downloads up to the first length bytes of an object which is stored as-is, such
+// as to detect its content type without downloading all of it.
+func (d *DatastoreRef) DownloadFileStart(location string, length int64) (io.ReadCloser, error) {
+	if d.Type == "file" {
+		f, err := os.Open(path.Join(d.Uri, location))
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, length), f}, nil
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return nil, err
+		}
+		return s3.DownloadObjectStart(location, length)
+	} else {
+		return nil, errors.New("unsupported operation: partially downloading from " + d.Type + " datastore")
+	}
+}
+
+// CheckHealth verifies the datastore can be reached, and optionally that it can be written to
+// where possible.
+func (d *DatastoreRef) CheckHealth(checkWrites bool) error {
+	if d.Type == "file" {
+		if checkWrites {
+			return ds_file.CheckWritable(d.Uri)
+		}
+		return ds_file.CheckExists(d.Uri)
+	} else if d.Type == "s3" {
+		s3, err := ds_s3.GetOrCreateS3Datastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return s3.EnsureBucketExists()
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.EnsureContainerExists()
+	} else if d.Type == "ipfs" {
+		// The IPFS daemon is embedded, so there's nothing to reach
+		return nil
+	} else {
+		return errors.New("unknown datastore type")
+	}
+}
+
 func (d *DatastoreRef) ObjectExists(location string) bool {
 	if d.Type == "file" {
 		ok, err := util.FileExists(path.Join(d.Uri, location))
@@ -101,6 +485,12 @@ func (d *DatastoreRef) ObjectExists(location string) bool {
 			return false
 		}
 		return s3.ObjectExists(location)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return false
+		}
+		return azure.ObjectExists(location)
 	} else if d.Type == "ipfs" {
 		// TODO: Support checking file existence in IPFS
 		logrus.Warn("Unsupported operation: existence in IPFS datastore")
@@ -110,7 +500,37 @@ func (d *DatastoreRef) ObjectExists(location string) bool {
 	}
 }
 
-func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
+// OverwriteObject replaces the file at the location, returning whether the new file was encoded.
+func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) (bool, error) {
+	var key *types.EncryptionKey
+	encoded := false
+	if d.transformsFiles() {
+		encodedFile, err := d.encodeForStorage(stream, -1, ctx)
+		if err != nil {
+			return false, err
+		}
+		defer encodedFile.Close()
+		stream = encodedFile
+		key = encodedFile.key
+		encoded = encodedFile.encoded
+	}
+
+	err := d.overwriteObject(location, stream, ctx)
+	if err != nil || !isEncryptionConfigured(d.Type) {
+		return encoded, err
+	}
+
+	keys := getEncryptionKeyStore(ctx)
+	if key == nil {
+		// The object is no longer encrypted
+		return encoded, keys.DeleteEncryptionKey(d.DatastoreId, location)
+	}
+	key.DatastoreId = d.DatastoreId
+	key.Location = location
+	return encoded, keys.UpsertEncryptionKey(key)
+}
+
+func (d *DatastoreRef) overwriteObject(location string, stream io.ReadCloser, ctx rcontext.RequestContext) error {
 	if d.Type == "file" {
 		_, _, err := ds_file.PersistFileAtLocation(path.Join(d.Uri, location), stream, ctx)
 		return err
@@ -120,6 +540,12 @@ func (d *DatastoreRef) OverwriteObject(location string, stream io.ReadCloser, ct
 			return err
 		}
 		return s3.OverwriteObject(location, stream)
+	} else if d.Type == "azure" {
+		azure, err := ds_azure.GetOrCreateAzureDatastore(d.DatastoreId, d.config)
+		if err != nil {
+			return err
+		}
+		return azure.OverwriteObject(location, stream)
 	} else if d.Type == "ipfs" {
 		// TODO: Support overwriting in IPFS
 		logrus.Warn("Unsupported operation: overwriting file in IPFS datastore")
@@ -0,0 +1,245 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func TestSelectDatastore(t *testing.T) {
+	rules := []config.DatastoreSelectionRule{
+		{DatastoreId: "thumbnails-only", ContentTypes: []string{"image/*"}},
+		{DatastoreId: "bulk", MinBytes: 100 * 1024 * 1024, ContentTypes: []string{"video/*"}},
+		{DatastoreId: "ssd", MaxBytes: 1024 * 1024, ContentTypes: []string{"image/*"}},
+		{DatastoreId: "tenant", Origins: []string{"*.example.org"}},
+		{DatastoreId: "broken"},
+	}
+
+	tests := []struct {
+		name        string
+		forKind     string
+		sizeBytes   int64
+		contentType string
+		origin      string
+		want        string
+	}{
+		{name: "large video", forKind: common.KindLocalMedia, sizeBytes: 200 * 1024 * 1024, contentType: "video/mp4", origin: "example.org", want: "bulk"},
+		{name: "small image", forKind: common.KindLocalMedia, sizeBytes: 1024, contentType: "image/png", origin: "example.org", want: "ssd"},
+		{name: "thumbnail", forKind: common.KindThumbnails, sizeBytes: 1024, contentType: "image/png", origin: "example.org", want: "thumbnails-only"},
+		{name: "earlier rules win", forKind: common.KindLocalMedia, sizeBytes: 1024, contentType: "image/png", origin: "a.example.org", want: "ssd"},
+		{name: "origin", forKind: common.KindLocalMedia, sizeBytes: 10 * 1024 * 1024, contentType: "image/png", origin: "a.example.org", want: "tenant"},
+		{name: "broken datastores are skipped", forKind: common.KindLocalMedia, sizeBytes: 1024, contentType: "text/plain", origin: "example.org", want: "default"},
+		{name: "small video falls back", forKind: common.KindLocalMedia, sizeBytes: 1024, contentType: "video/mp4", origin: "other.org", want: "default"},
+	}
+
+	defer func(original func(string, string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		datastoreForRule = original
+	}(datastoreForRule)
+	datastoreForRule = func(datastoreId string, forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		if datastoreId == "broken" {
+			return nil, common.ErrMediaNotFound
+		}
+		if datastoreId == "thumbnails-only" && forKind != common.KindThumbnails {
+			return nil, nil
+		}
+		return &DatastoreRef{DatastoreId: datastoreId}, nil
+	}
+	defer func(original func(string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		pickDatastore = original
+	}(pickDatastore)
+	pickDatastore = func(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		return &DatastoreRef{DatastoreId: "default"}, nil
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.DatastoreRules = rules
+
+			ds, err := SelectDatastore(tt.forKind, tt.sizeBytes, tt.contentType, tt.origin, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ds.DatastoreId != tt.want {
+				t.Errorf("got %s, expected %s", ds.DatastoreId, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectDatastoreWithoutRules(t *testing.T) {
+	defer func(original func(string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		pickDatastore = original
+	}(pickDatastore)
+	pickDatastore = func(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		return &DatastoreRef{DatastoreId: "default"}, nil
+	}
+
+	ds, err := SelectDatastore(common.KindLocalMedia, 1024, "image/png", "example.org", testContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.DatastoreId != "default" {
+		t.Errorf("got %s, expected the default datastore", ds.DatastoreId)
+	}
+}
+
+func TestPresignDownloadUnsupported(t *testing.T) {
+	tests := []struct {
+		name      string
+		dsType    string
+		encrypted bool
+		encoded   bool
+	}{
+		{name: "file datastore", dsType: "file"},
+		{name: "ipfs datastore", dsType: "ipfs"},
+		{name: "encrypted s3 datastore", dsType: "s3", encrypted: true},
+		{name: "media stored encoded", dsType: "s3", encoded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEncryption(t, tt.encrypted, "key1", map[string]string{"key1": randomKey(t)})
+			ds := &DatastoreRef{DatastoreId: "test", Type: tt.dsType, Uri: t.TempDir()}
+			media := &types.Media{ContentType: "image/png", Location: "ab/cd/efgh", Encoded: tt.encoded}
+
+			if _, err := ds.PresignDownload(media, time.Minute, "inline"); err != ErrPresignUnsupported {
+				t.Errorf("got error %v, expected %v", err, ErrPresignUnsupported)
+			}
+		})
+	}
+}
+
+func TestMayContainForeignObjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		dsType   string
+		options  map[string]string
+		expected bool
+	}{
+		{name: "file datastore", dsType: "file", expected: false},
+		{name: "azure datastore", dsType: "azure", expected: false},
+		{name: "s3 datastore", dsType: "s3", expected: true},
+		{name: "s3 datastore with a dedicated bucket", dsType: "s3", options: map[string]string{"dedicatedBucket": "true"}, expected: false},
+		{name: "s3 datastore with a shared bucket", dsType: "s3", options: map[string]string{"dedicatedBucket": "false"}, expected: true},
+		{name: "s3 datastore with an invalid option", dsType: "s3", options: map[string]string{"dedicatedBucket": "yes please"}, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &DatastoreRef{DatastoreId: "test", Type: tt.dsType, config: config.DatastoreConfig{Options: tt.options}}
+			if got := ds.MayContainForeignObjects(); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckThumbnailDatastore(t *testing.T) {
+	withFreeBytes(t, map[string]int64{"/data/thumbs": 100})
+
+	tests := []struct {
+		name                 string
+		dsConf               config.DatastoreConfig
+		expectedUnavailable  bool
+		expectedOutOfStorage bool
+	}{
+		{name: "enabled", dsConf: fileDatastoreConfig("/data/thumbs", 0)},
+		{name: "enough space", dsConf: fileDatastoreConfig("/data/thumbs", 100)},
+		{name: "disabled", dsConf: config.DatastoreConfig{Type: "file", Enabled: false, Options: map[string]string{"path": "/data/thumbs"}}, expectedUnavailable: true},
+		{name: "low on space", dsConf: fileDatastoreConfig("/data/thumbs", 101), expectedUnavailable: true, expectedOutOfStorage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &DatastoreRef{DatastoreId: "thumbs", Type: "file", Uri: "/data/thumbs", config: tt.dsConf}
+			err := checkThumbnailDatastore(ds, testContext())
+
+			var unavailable *common.DatastoreUnavailableError
+			if errors.As(err, &unavailable) != tt.expectedUnavailable {
+				t.Fatalf("got error %v, expected unavailable = %t", err, tt.expectedUnavailable)
+			}
+			if tt.expectedUnavailable {
+				if unavailable.DatastoreId != "thumbs" {
+					t.Errorf("got %s, expected thumbs", unavailable.DatastoreId)
+				}
+				if unavailable.OutOfStorage != tt.expectedOutOfStorage {
+					t.Errorf("got OutOfStorage = %t, expected %t", unavailable.OutOfStorage, tt.expectedOutOfStorage)
+				}
+			}
+		})
+	}
+}
+
+func TestPickThumbnailDatastore(t *testing.T) {
+	withFreeBytes(t, map[string]int64{"/data/ssd": 100})
+
+	defer func(original func(string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		pickDatastore = original
+	}(pickDatastore)
+	pickDatastore = func(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		return &DatastoreRef{DatastoreId: "s3"}, nil
+	}
+	defer func(original func(rcontext.RequestContext, string) (*DatastoreRef, error)) {
+		locateDatastore = original
+	}(locateDatastore)
+	locateDatastore = func(ctx rcontext.RequestContext, datastoreId string) (*DatastoreRef, error) {
+		switch datastoreId {
+		case "ssd":
+			return &DatastoreRef{DatastoreId: "ssd", Type: "file", Uri: "/data/ssd", config: fileDatastoreConfig("/data/ssd", 0)}, nil
+		case "full":
+			return &DatastoreRef{DatastoreId: "full", Type: "file", Uri: "/data/ssd", config: fileDatastoreConfig("/data/ssd", 101)}, nil
+		}
+		return nil, errors.New("datastore not found")
+	}
+
+	tests := []struct {
+		name                   string
+		thumbnailDatastore     string
+		expectedThumbnailStore string
+		expectedUnavailable    bool
+	}{
+		{name: "configured", thumbnailDatastore: "ssd", expectedThumbnailStore: "ssd"},
+		{name: "not configured", thumbnailDatastore: "", expectedThumbnailStore: "s3"},
+		{name: "unknown", thumbnailDatastore: "missing", expectedUnavailable: true},
+		{name: "low on space", thumbnailDatastore: "full", expectedUnavailable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.Datastore = tt.thumbnailDatastore
+
+			ds, err := PickThumbnailDatastore(ctx)
+			var unavailable *common.DatastoreUnavailableError
+			if errors.As(err, &unavailable) != tt.expectedUnavailable {
+				t.Fatalf("got error %v, expected unavailable = %t", err, tt.expectedUnavailable)
+			}
+			if !tt.expectedUnavailable && ds.DatastoreId != tt.expectedThumbnailStore {
+				t.Errorf("got %s for thumbnails, expected %s", ds.DatastoreId, tt.expectedThumbnailStore)
+			}
+
+			// Originals are never stored in the thumbnail datastore
+			original, err := SelectDatastore(common.KindLocalMedia, 1024, "image/png", "example.org", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if original.DatastoreId != "s3" {
+				t.Errorf("got %s for originals, expected s3", original.DatastoreId)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package ds_azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+const defaultBlockSizeBytes = 4 * 1024 * 1024 // 4mb
+
+var stores = make(map[string]*azureDatastore)
+var storesLock = &sync.Mutex{}
+
+type azureDatastore struct {
+	conf      config.DatastoreConfig
+	dsId      string
+	client    azblob.ContainerClient
+	baseUrl   string
+	container string
+	blockSize int64
+}
+
+func GetOrCreateAzureDatastore(dsId string, conf config.DatastoreConfig) (*azureDatastore, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	if s, ok := stores[dsId]; ok {
+		return s, nil
+	}
+
+	accountName, accountFound := conf.Options["accountName"]
+	container, containerFound := conf.Options["container"]
+	if !accountFound || !containerFound {
+		return nil, errors.New("invalid configuration: missing azure options")
+	}
+
+	var err error
+	blockSize := int64(defaultBlockSizeBytes)
+	if blockSizeStr, found := conf.Options["blockSizeBytes"]; found && blockSizeStr != "" {
+		blockSize, err = strconv.ParseInt(blockSizeStr, 10, 64)
+		if err != nil || blockSize <= 0 {
+			return nil, errors.New("invalid configuration: blockSizeBytes must be a positive number")
+		}
+	}
+
+	baseUrl := GetEndpoint(conf)
+	var client azblob.ServiceClient
+	useManagedIdentity, _ := strconv.ParseBool(conf.Options["useManagedIdentity"])
+	if useManagedIdentity {
+		var cred azcore.TokenCredential
+		cred, err = newManagedIdentityCredential(conf.Options["managedIdentityClientId"])
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewServiceClient(baseUrl, cred, nil)
+	} else {
+		accountKey, keyFound := conf.Options["accountKey"]
+		if !keyFound {
+			return nil, errors.New("invalid configuration: missing accountKey, and not using a managed identity")
+		}
+		if _, err = base64.StdEncoding.DecodeString(accountKey); err != nil {
+			return nil, errors.New("invalid configuration: accountKey must be base64 encoded")
+		}
+		var cred *azblob.SharedKeyCredential
+		cred, err = azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewServiceClientWithSharedKey(baseUrl, cred, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	azds := &azureDatastore{
+		conf:      conf,
+		dsId:      dsId,
+		client:    client.NewContainerClient(container),
+		baseUrl:   baseUrl,
+		container: container,
+		blockSize: blockSize,
+	}
+	stores[dsId] = azds
+	return azds, nil
+}
+
+func newManagedIdentityCredential(clientId string) (*azidentity.ManagedIdentityCredential, error) {
+	opts := &azidentity.ManagedIdentityCredentialOptions{}
+	if clientId != "" {
+		opts.ID = azidentity.ClientID(clientId)
+	}
+	return azidentity.NewManagedIdentityCredential(opts)
+}
+
+// GetEndpoint returns the blob service endpoint for the datastore, such as an emulator's
+// endpoint or the account's default endpoint.
+func GetEndpoint(conf config.DatastoreConfig) string {
+	if endpoint, found := conf.Options["endpoint"]; found && endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net", conf.Options["accountName"])
+}
+
+func isNotFound(err error) bool {
+	return StatusCodeOf(err) == http.StatusNotFound
+}
+
+// StatusCodeOf returns the HTTP status code of an error response from azure, or zero if the error
+// didn't come from a response.
+func StatusCodeOf(err error) int {
+	var storageErr *azblob.StorageError
+	if errors.As(err, &storageErr) && storageErr.Response() != nil {
+		return storageErr.StatusCode()
+	}
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode
+	}
+	return 0
+}
+
+func (s *azureDatastore) EnsureContainerExists() error {
+	_, err := s.client.GetProperties(context.Background(), nil)
+	if isNotFound(err) {
+		return errors.New("container not found")
+	}
+	return err
+}
+
+func (s *azureDatastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
+	defer cleanup.DumpAndCloseStream(file)
+
+	objectName, err := util.GenerateRandomString(512)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := util.NewHasher()
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Uploading file...")
+	sizeBytes, err := s.putBlob(ctx, objectName, io.TeeReader(file, hasher))
+	if err != nil {
+		return nil, err
+	}
+	ctx.Log.Info("Uploaded ", sizeBytes, " bytes to azure")
+
+	return &types.ObjectInfo{
+		Location:   objectName,
+		Sha256Hash: hasher.HashString(),
+		SizeBytes:  sizeBytes,
+	}, nil
+}
+
+// putBlob streams the contents to a block blob, one block at a time. Contents which fit in a
+// single block are uploaded in one request.
+func (s *azureDatastore) putBlob(ctx context.Context, location string, r io.Reader) (int64, error) {
+	blob := s.client.NewBlockBlobClient(location)
+	buf := make([]byte, s.blockSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = blob.Upload(ctx, streaming.NopCloser(bytes.NewReader(buf[:n])), nil)
+		return int64(n), err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	blockIds := make([]string, 0)
+	sizeBytes := int64(0)
+	for n > 0 {
+		blockId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blockIds))))
+		_, err = blob.StageBlock(ctx, blockId, streaming.NopCloser(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "error uploading block")
+		}
+		blockIds = append(blockIds, blockId)
+		sizeBytes += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			// The uncommitted blocks are discarded by azure after a week
+			return 0, err
+		}
+	}
+
+	_, err = blob.CommitBlockList(ctx, blockIds, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error committing blocks")
+	}
+	return sizeBytes, nil
+}
+
+func (s *azureDatastore) DeleteObject(location string) error {
+	logrus.Info("Deleting object from container ", s.container, ": ", location)
+	_, err := s.client.NewBlobClient(location).Delete(context.Background(), nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *azureDatastore) DownloadObject(location string) (io.ReadCloser, error) {
+	logrus.Info("Downloading object from container ", s.container, ": ", location)
+	res, err := s.client.NewBlobClient(location).Download(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body(nil), nil
+}
+
+func (s *azureDatastore) ObjectExists(location string) bool {
+	res, err := s.client.NewBlobClient(location).GetProperties(context.Background(), nil)
+	if err != nil {
+		return false
+	}
+	return res.ContentLength != nil && *res.ContentLength > 0
+}
+
+func (s *azureDatastore) OverwriteObject(location string, stream io.ReadCloser) error {
+	defer cleanup.DumpAndCloseStream(stream)
+	_, err := s.putBlob(context.Background(), location, stream)
+	return err
+}
+
+func (s *azureDatastore) ListObjects(fn func(location string, sizeBytes int64, modified time.Time) error) error {
+	ctx := context.Background()
+	pager := s.client.ListBlobsFlat(&azblob.ContainerListBlobFlatSegmentOptions{})
+	for pager.NextPage(ctx) {
+		segment := pager.PageResponse().Segment
+		if segment == nil {
+			continue
+		}
+		for _, blob := range segment.BlobItems {
+			if blob.Name == nil {
+				continue
+			}
+			sizeBytes := int64(0)
+			modified := time.Time{}
+			if blob.Properties != nil {
+				if blob.Properties.ContentLength != nil {
+					sizeBytes = *blob.Properties.ContentLength
+				}
+				if blob.Properties.LastModified != nil {
+					modified = *blob.Properties.LastModified
+				}
+			}
+			if err := fn(*blob.Name, sizeBytes, modified); err != nil {
+				return err
+			}
+		}
+	}
+	return pager.Err()
+}
@@ -0,0 +1,315 @@
+package ds_azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestMain(m *testing.M) {
+	// Blobs are hashed with the configured algorithm as they are uploaded, so give the tests a default config
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeAzure is an in-memory stand in for the parts of the blob service API the datastore uses.
+type fakeAzure struct {
+	lock   sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string]map[string][]byte
+	puts   int
+	staged int
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server) {
+	f := &fakeAzure{blobs: make(map[string][]byte), blocks: make(map[string]map[string][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeAzure) notFound(w http.ResponseWriter, r *http.Request, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>not found</Message></Error>", code)
+	}
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Paths are /account/container[/blob], as used by the storage emulator
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] != "media" {
+		f.notFound(w, r, "ContainerNotFound")
+		return
+	}
+	query := r.URL.Query()
+
+	if len(parts) < 3 || parts[2] == "" {
+		switch {
+		case r.Method == http.MethodGet && query.Get("comp") == "list":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprint(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><EnumerationResults ContainerName=\"media\"><Blobs>")
+			for name, b := range f.blobs {
+				fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>Fri, 01 Jan 2021 00:00:00 GMT</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>", name, len(b))
+			}
+			fmt.Fprint(w, "</Blobs><NextMarker /></EnumerationResults>")
+		default:
+			w.WriteHeader(http.StatusOK) // container properties
+		}
+		return
+	}
+	name := parts[2]
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		b, _ := ioutil.ReadAll(r.Body)
+		if _, ok := f.blocks[name]; !ok {
+			f.blocks[name] = make(map[string][]byte)
+		}
+		f.blocks[name][query.Get("blockid")] = b
+		f.staged++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		list := struct {
+			Latest []string `xml:"Latest"`
+		}{}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(b, &list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		blob := &bytes.Buffer{}
+		for _, id := range list.Latest {
+			blob.Write(f.blocks[name][id])
+		}
+		f.blobs[name] = blob.Bytes()
+		delete(f.blocks, name)
+		w.Header().Set("ETag", "\"blob\"")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		f.blobs[name] = b
+		f.puts++
+		w.Header().Set("ETag", "\"blob\"")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.blobs[name]
+		if !ok {
+			f.notFound(w, r, "BlobNotFound")
+			return
+		}
+		w.Header().Set("ETag", "\"blob\"")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			f.notFound(w, r, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func testDatastore(t *testing.T, srv *httptest.Server, options map[string]string) *azureDatastore {
+	conf := config.DatastoreConfig{Type: "azure", Options: map[string]string{
+		"accountName": "account",
+		"container":   "media",
+		"accountKey":  base64.StdEncoding.EncodeToString([]byte("not a real key")),
+		"endpoint":    srv.URL + "/account",
+	}}
+	for k, v := range options {
+		conf.Options[k] = v
+	}
+	ds, err := GetOrCreateAzureDatastore(t.Name()+"-"+conf.Options["container"], conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestGetOrCreateAzureDatastore(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("not a real key"))
+
+	tests := []struct {
+		name              string
+		options           map[string]string
+		wantErr           bool
+		expectedEndpoint  string
+		expectedBlockSize int64
+	}{
+		{
+			name:              "shared key",
+			options:           map[string]string{"accountName": "account", "container": "media", "accountKey": key},
+			expectedEndpoint:  "https://account.blob.core.windows.net",
+			expectedBlockSize: defaultBlockSizeBytes,
+		},
+		{
+			name:              "managed identity with an emulator",
+			options:           map[string]string{"accountName": "account", "container": "media", "useManagedIdentity": "true", "endpoint": "http://127.0.0.1:10000/account/"},
+			expectedEndpoint:  "http://127.0.0.1:10000/account",
+			expectedBlockSize: defaultBlockSizeBytes,
+		},
+		{
+			name:              "custom block size",
+			options:           map[string]string{"accountName": "account", "container": "media", "accountKey": key, "blockSizeBytes": "1024"},
+			expectedEndpoint:  "https://account.blob.core.windows.net",
+			expectedBlockSize: 1024,
+		},
+		{name: "missing container", options: map[string]string{"accountName": "account", "accountKey": key}, wantErr: true},
+		{name: "missing key", options: map[string]string{"accountName": "account", "container": "media"}, wantErr: true},
+		{name: "key not base64", options: map[string]string{"accountName": "account", "container": "media", "accountKey": "not base64!"}, wantErr: true},
+		{name: "invalid block size", options: map[string]string{"accountName": "account", "container": "media", "accountKey": key, "blockSizeBytes": "-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds, err := GetOrCreateAzureDatastore(t.Name(), config.DatastoreConfig{Type: "azure", Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ds.baseUrl != tt.expectedEndpoint {
+				t.Errorf("got endpoint %s, expected %s", ds.baseUrl, tt.expectedEndpoint)
+			}
+			if ds.blockSize != tt.expectedBlockSize {
+				t.Errorf("got block size %d, expected %d", ds.blockSize, tt.expectedBlockSize)
+			}
+		})
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	tests := []struct {
+		name           string
+		options        map[string]string
+		contents       []byte
+		expectedStaged int
+	}{
+		{name: "single block", contents: []byte("hello world")},
+		{name: "staged blocks", options: map[string]string{"blockSizeBytes": "4"}, contents: []byte("hello world"), expectedStaged: 3},
+		{name: "exact block multiple", options: map[string]string{"blockSizeBytes": "4"}, contents: []byte("hello world!"), expectedStaged: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeAzure(t)
+			ds := testDatastore(t, srv, tt.options)
+
+			info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(tt.contents)), int64(len(tt.contents)), testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hash := sha256.Sum256(tt.contents)
+			if info.Sha256Hash != "sha256:"+hex.EncodeToString(hash[:]) {
+				t.Errorf("got hash %s, expected sha256:%s", info.Sha256Hash, hex.EncodeToString(hash[:]))
+			}
+			if info.SizeBytes != int64(len(tt.contents)) {
+				t.Errorf("got size %d, expected %d", info.SizeBytes, len(tt.contents))
+			}
+			if fake.staged != tt.expectedStaged {
+				t.Errorf("got %d staged blocks, expected %d", fake.staged, tt.expectedStaged)
+			}
+
+			if !ds.ObjectExists(info.Location) {
+				t.Fatal("expected the object to exist")
+			}
+			stream, err := ds.DownloadObject(info.Location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			b, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.contents) {
+				t.Errorf("downloaded %q, expected %q", b, tt.contents)
+			}
+
+			listed := 0
+			err = ds.ListObjects(func(location string, sizeBytes int64, modified time.Time) error {
+				listed++
+				if location != info.Location || sizeBytes != info.SizeBytes || modified.IsZero() {
+					t.Errorf("got listed object %s (%d bytes, modified %s), expected %s (%d bytes)", location, sizeBytes, modified, info.Location, info.SizeBytes)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if listed != 1 {
+				t.Errorf("got %d listed objects, expected 1", listed)
+			}
+
+			if err = ds.DeleteObject(info.Location); err != nil {
+				t.Fatal(err)
+			}
+			if ds.ObjectExists(info.Location) {
+				t.Error("expected the object to be deleted")
+			}
+		})
+	}
+}
+
+func TestMissingObjects(t *testing.T) {
+	_, srv := newFakeAzure(t)
+	ds := testDatastore(t, srv, nil)
+
+	if ds.ObjectExists("missing") {
+		t.Error("expected a missing object to not exist")
+	}
+	if err := ds.DeleteObject("missing"); err != nil {
+		t.Errorf("got error %v deleting a missing object, expected none", err)
+	}
+	if err := ds.EnsureContainerExists(); err != nil {
+		t.Errorf("got error %v, expected the container to exist", err)
+	}
+
+	other := testDatastore(t, srv, map[string]string{"container": "other"})
+	if err := other.EnsureContainerExists(); err == nil {
+		t.Error("expected an error for a missing container")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
@@ -55,8 +56,18 @@ func PersistFile(basePath string, file io.ReadCloser, ctx rcontext.RequestContex
 		return nil, err
 	}
 
-	sizeBytes, hash, err := PersistFileAtLocation(targetFile, file, ctx)
+	var sizeBytes int64
+	var hash string
+	if ctx.Config.Uploads.TempPath != "" {
+		sizeBytes, hash, err = persistFileViaTemp(ctx.Config.Uploads.TempPath, targetFile, file, ctx)
+	} else {
+		sizeBytes, hash, err = PersistFileAtLocation(targetFile, file, ctx)
+	}
 	if err != nil {
+		// Don't leave a partially written file behind
+		if rmErr := os.Remove(targetFile); rmErr != nil && !os.IsNotExist(rmErr) {
+			ctx.Log.Warn("Error removing partially written file: ", rmErr)
+		}
 		return nil, err
 	}
 
@@ -91,7 +102,7 @@ func PersistFileAtLocation(targetFile string, file io.ReadCloser, ctx rcontext.R
 	go func() {
 		defer wfile.Close()
 		ctx.Log.Info("Calculating hash of stream...")
-		hash, hashErr = util.GetSha256HashOfStream(ioutil.NopCloser(tr))
+		hash, hashErr = util.GetHashOfStream(ioutil.NopCloser(tr))
 		ctx.Log.Info("Hash of file is ", hash)
 		done <- true
 	}()
@@ -119,6 +130,107 @@ func PersistFileAtLocation(targetFile string, file io.ReadCloser, ctx rcontext.R
 	return sizeBytes, hash, nil
 }
 
+// persistFileViaTemp buffers the file in the temp path before moving it to the target file, so
+// the datastore only ever sees complete files.
+func persistFileViaTemp(tempPath string, targetFile string, file io.ReadCloser, ctx rcontext.RequestContext) (int64, string, error) {
+	defer cleanup.DumpAndCloseStream(file)
+
+	err := os.MkdirAll(tempPath, 0755)
+	if err != nil {
+		return 0, "", err
+	}
+	f, err := ioutil.TempFile(tempPath, "mr*")
+	if err != nil {
+		return 0, "", err
+	}
+	tempFile := f.Name()
+	cleanup.DumpAndCloseStream(f)
+	defer os.Remove(tempFile) // no-op once moved
+
+	sizeBytes, hash, err := PersistFileAtLocation(tempFile, file, ctx)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = moveFile(tempFile, targetFile, ctx)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return sizeBytes, hash, nil
+}
+
+// moveFile renames the file into place when possible, otherwise copying it (such as when the
+// source and target are on different filesystems) and deleting the source.
+func moveFile(sourceFile string, targetFile string, ctx rcontext.RequestContext) error {
+	err := os.Rename(sourceFile, targetFile)
+	if err == nil {
+		// Temp files are only readable by us, so match the permissions of other files
+		return os.Chmod(targetFile, 0644)
+	}
+	ctx.Log.Info("Unable to rename file into place, copying instead: ", err)
+
+	src, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer cleanup.DumpAndCloseStream(src)
+
+	dst, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Remove(sourceFile)
+}
+
+// CheckWritable verifies the datastore's directory exists and a file can be created in it.
+func CheckWritable(basePath string) error {
+	f, err := ioutil.TempFile(basePath, ".health*")
+	if err != nil {
+		return err
+	}
+	cleanup.DumpAndCloseStream(f)
+	return os.Remove(f.Name())
+}
+
+// CheckExists verifies the datastore's directory exists.
+func CheckExists(basePath string) error {
+	info, err := os.Stat(basePath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("datastore path is not a directory")
+	}
+	return nil
+}
+
 func DeletePersistedFile(basePath string, location string) error {
 	return os.Remove(path.Join(basePath, location))
 }
+
+// ListFiles calls the function for every file in the datastore, giving the file's location.
+func ListFiles(basePath string, fn func(location string, info os.FileInfo) error) error {
+	return filepath.Walk(basePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		location, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(location), info)
+	})
+}
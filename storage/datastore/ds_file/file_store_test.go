@@ -0,0 +1,198 @@
+package ds_file
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestMain(m *testing.M) {
+	// Files are hashed with the configured algorithm, so give the tests a default config
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func testContext(tempPath string) rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	ctx := rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+	ctx.Config.Uploads.TempPath = tempPath
+	return ctx
+}
+
+// failingReader returns some of the file before failing, like an upload which is cut off.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func countFiles(t *testing.T, dir string) int {
+	count := 0
+	err := ListFiles(dir, func(location string, info os.FileInfo) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPersistFile(t *testing.T) {
+	contents := strings.Repeat("media repo test file ", 1000)
+	hash := sha256.Sum256([]byte(contents))
+
+	tests := []struct {
+		name     string
+		failing  bool
+		wantErr  bool
+		wantSize int64
+	}{
+		{name: "complete", wantSize: int64(len(contents))},
+		{name: "cut off", failing: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basePath := t.TempDir()
+
+			var r io.Reader = strings.NewReader(contents)
+			if tt.failing {
+				r = &failingReader{r: r}
+			}
+
+			info, err := PersistFile(basePath, ioutil.NopCloser(r), testContext(""))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			wantFiles := 1
+			if tt.wantErr {
+				wantFiles = 0
+			} else {
+				if info.SizeBytes != tt.wantSize {
+					t.Errorf("SizeBytes = %d, want %d", info.SizeBytes, tt.wantSize)
+				}
+				if info.Sha256Hash != "sha256:"+hex.EncodeToString(hash[:]) {
+					t.Errorf("Sha256Hash = %s", info.Sha256Hash)
+				}
+				b, err := ioutil.ReadFile(path.Join(basePath, info.Location))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != contents {
+					t.Error("persisted file does not match the upload")
+				}
+			}
+			if n := countFiles(t, basePath); n != wantFiles {
+				t.Errorf("datastore has %d files, want %d", n, wantFiles)
+			}
+		})
+	}
+}
+
+func TestPersistFileViaTempPath(t *testing.T) {
+	contents := strings.Repeat("media repo test file ", 1000)
+
+	tests := []struct {
+		name      string
+		failing   bool
+		wantErr   bool
+		wantFiles int
+	}{
+		{name: "complete", wantFiles: 1},
+		{name: "cut off", failing: true, wantErr: true, wantFiles: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basePath := t.TempDir()
+			// The temp path doesn't have to exist yet
+			tempPath := path.Join(t.TempDir(), "uploads")
+
+			var r io.Reader = strings.NewReader(contents)
+			if tt.failing {
+				r = &failingReader{r: r}
+			}
+
+			info, err := PersistFile(basePath, ioutil.NopCloser(r), testContext(tempPath))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				stat, err := os.Stat(path.Join(basePath, info.Location))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stat.Mode().Perm() != 0644 {
+					t.Errorf("file permissions = %o, want 644", stat.Mode().Perm())
+				}
+			}
+			if n := countFiles(t, basePath); n != tt.wantFiles {
+				t.Errorf("datastore has %d files, want %d", n, tt.wantFiles)
+			}
+			if n := countFiles(t, tempPath); n != 0 {
+				t.Errorf("temp path has %d files left behind", n)
+			}
+		})
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		basePath        string
+		wantExistsErr   bool
+		wantWritableErr bool
+	}{
+		{name: "directory", basePath: dir},
+		{name: "missing", basePath: path.Join(dir, "missing"), wantExistsErr: true, wantWritableErr: true},
+		{name: "file", basePath: file, wantExistsErr: true, wantWritableErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckExists(tt.basePath); (err != nil) != tt.wantExistsErr {
+				t.Errorf("CheckExists() err = %v, wantErr %v", err, tt.wantExistsErr)
+			}
+			if err := CheckWritable(tt.basePath); (err != nil) != tt.wantWritableErr {
+				t.Errorf("CheckWritable() err = %v, wantErr %v", err, tt.wantWritableErr)
+			}
+		})
+	}
+
+	// The writable check must not leave anything behind in the datastore
+	if n := countFiles(t, dir); n != 1 {
+		t.Errorf("datastore has %d files, want only the test file", n)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package ds_file
+
+import (
+	"syscall"
+)
+
+// GetFreeBytes returns how many bytes can be written to the filesystem the path is on by
+// unprivileged users.
+func GetFreeBytes(basePath string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(basePath, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package ds_file
+
+import (
+	"path"
+	"testing"
+)
+
+func TestGetFreeBytes(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		basePath string
+		wantErr  bool
+	}{
+		{name: "directory", basePath: dir},
+		{name: "missing", basePath: path.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			freeBytes, err := GetFreeBytes(tt.basePath)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && freeBytes <= 0 {
+				t.Errorf("got %d free bytes, expected more than zero", freeBytes)
+			}
+		})
+	}
+}
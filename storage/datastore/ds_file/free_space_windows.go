@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package ds_file
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// GetFreeBytes returns how many bytes can be written to the volume the path is on by the
+// current user.
+func GetFreeBytes(basePath string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(basePath)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	err = windows.GetDiskFreeSpaceEx(path, &available, &total, &free)
+	if err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -15,43 +15,18 @@ import (
 func UploadFile(file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectInfo, error) {
 	defer cleanup.DumpAndCloseStream(file)
 
-	b, err := ioutil.ReadAll(file)
+	b, hash, err := readAndHash(file)
 	if err != nil {
 		return nil, err
 	}
+	ctx.Log.Info("Hash of file is ", hash)
 
-	done := make(chan bool)
-	defer close(done)
-
-	var cid string
-	var hash string
-	var hashErr error
-	var writeErr error
-
-	go func() {
-		ctx.Log.Info("Writing file...")
-		cid, writeErr = ipfs_proxy.PutObject(bytes.NewBuffer(b), ctx)
-		ctx.Log.Info("Wrote file to IPFS")
-		done <- true
-	}()
-
-	go func() {
-		ctx.Log.Info("Calculating hash of stream...")
-		hash, hashErr = util.GetSha256HashOfStream(ioutil.NopCloser(bytes.NewBuffer(b)))
-		ctx.Log.Info("Hash of file is ", hash)
-		done <- true
-	}()
-
-	for c := 0; c < 2; c++ {
-		<-done
-	}
-
-	if hashErr != nil {
-		return nil, hashErr
-	}
-	if writeErr != nil {
-		return nil, writeErr
+	ctx.Log.Info("Writing file...")
+	cid, err := ipfs_proxy.PutObject(bytes.NewBuffer(b), ctx)
+	if err != nil {
+		return nil, err
 	}
+	ctx.Log.Info("Wrote file to IPFS")
 
 	return &types.ObjectInfo{
 		Location:   "ipfs/" + cid,
@@ -60,6 +35,20 @@ func UploadFile(file io.ReadCloser, ctx rcontext.RequestContext) (*types.ObjectI
 	}, nil
 }
 
+// readAndHash reads the whole file, calculating its hash at the same time. IPFS needs the whole
+// object in memory anyways, so this avoids going over the buffer a second time.
+func readAndHash(file io.Reader) ([]byte, string, error) {
+	hasher, err := util.NewHasher()
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := ioutil.ReadAll(io.TeeReader(file, hasher))
+	if err != nil {
+		return nil, "", err
+	}
+	return b, hasher.HashString(), nil
+}
+
 func DownloadFile(location string) (io.ReadCloser, error) {
 	cid := location[len("ipfs/"):]
 	ctx := rcontext.Initial()
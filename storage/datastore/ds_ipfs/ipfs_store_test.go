@@ -0,0 +1,65 @@
+package ds_ipfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestMain(m *testing.M) {
+	// readAndHash uses the configured hash algorithm, so give the tests a default config
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestReadAndHash(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "mmr-ipfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "empty", contents: []byte{}},
+		{name: "text", contents: []byte("hello world")},
+		{name: "larger than a read buffer", contents: bytes.Repeat([]byte{0x00, 0x7f, 0xff}, 100000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := path.Join(tmpDir, tt.name)
+			err := ioutil.WriteFile(f, tt.contents, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectedHash, err := util.GetFileHash(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, hash, err := readAndHash(bytes.NewReader(tt.contents))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hash != expectedHash {
+				t.Errorf("got hash %s, expected %s", hash, expectedHash)
+			}
+			if !bytes.Equal(b, tt.contents) {
+				t.Errorf("got %d bytes back, expected %d", len(b), len(tt.contents))
+			}
+		})
+	}
+}
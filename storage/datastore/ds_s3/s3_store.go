@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v6"
 	"github.com/pkg/errors"
@@ -20,6 +22,9 @@ import (
 
 var stores = make(map[string]*s3Datastore)
 
+// s3 rejects multipart uploads with parts smaller than this, other than the last part
+const minPartSizeBytes = 5 * 1024 * 1024
+
 type s3Datastore struct {
 	conf     config.DatastoreConfig
 	dsId     string
@@ -27,6 +32,7 @@ type s3Datastore struct {
 	bucket   string
 	region string
 	tempPath string
+	putOpts  minio.PutObjectOptions
 }
 
 func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datastore, error) {
@@ -43,6 +49,7 @@ func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datast
 	if !epFound || !bucketFound || !keyFound || !secretFound {
 		return nil, errors.New("invalid configuration: missing s3 options")
 	}
+	var err error
 	if !tempPathFound {
 		logrus.Warn("Datastore ", dsId, " (s3) does not have a tempPath set - this could lead to excessive memory usage by the media repo")
 	}
@@ -53,8 +60,26 @@ func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datast
 		useSsl, _ = strconv.ParseBool(useSslStr)
 	}
 
+	// Large uploads are sent using multipart uploads, which can be tuned here
+	putOpts := minio.PutObjectOptions{}
+	if partSizeStr, found := conf.Options["multipartPartSizeBytes"]; found && partSizeStr != "" {
+		putOpts.PartSize, err = strconv.ParseUint(partSizeStr, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid configuration: multipartPartSizeBytes must be a number")
+		}
+		if putOpts.PartSize < minPartSizeBytes {
+			return nil, fmt.Errorf("invalid configuration: multipartPartSizeBytes must be at least %d", minPartSizeBytes)
+		}
+	}
+	if threadsStr, found := conf.Options["multipartThreads"]; found && threadsStr != "" {
+		threads, err := strconv.ParseUint(threadsStr, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid configuration: multipartThreads must be a number")
+		}
+		putOpts.NumThreads = uint(threads)
+	}
+
 	var s3client *minio.Client
-	var err error
 
 	if regionFound {
 		s3client, err = minio.NewWithRegion(endpoint, accessKeyId, accessSecret, useSsl, region)
@@ -72,6 +97,7 @@ func GetOrCreateS3Datastore(dsId string, conf config.DatastoreConfig) (*s3Datast
 		bucket:   bucket,
 		region: region,
 		tempPath: tempPath,
+		putOpts:  putOpts,
 	}
 	stores[dsId] = s3ds
 	return s3ds, nil
@@ -145,7 +171,7 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 	go func() {
 		defer ws3.Close()
 		ctx.Log.Info("Calculating hash of stream...")
-		hash, hashErr = util.GetSha256HashOfStream(ioutil.NopCloser(tr))
+		hash, hashErr = util.GetHashOfStream(ioutil.NopCloser(tr))
 		ctx.Log.Info("Hash of file is ", hash)
 		done <- true
 	}()
@@ -164,6 +190,10 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 				defer os.Remove(f.Name())
 				expectedLength, uploadErr = io.Copy(f, rs3)
 				cleanup.DumpAndCloseStream(f)
+				if uploadErr != nil {
+					done <- true
+					return
+				}
 				f, uploadErr = os.Open(f.Name())
 				if uploadErr != nil {
 					done <- true
@@ -177,7 +207,7 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 			}
 		}
 		ctx.Log.Info("Uploading file...")
-		sizeBytes, uploadErr = s.client.PutObjectWithContext(ctx, s.bucket, objectName, rs3, expectedLength, minio.PutObjectOptions{})
+		sizeBytes, uploadErr = s.client.PutObjectWithContext(ctx, s.bucket, objectName, rs3, expectedLength, s.putOpts)
 		ctx.Log.Info("Uploaded ", sizeBytes, " bytes to s3")
 		done <- true
 	}()
@@ -198,6 +228,10 @@ func (s *s3Datastore) UploadFile(file io.ReadCloser, expectedLength int64, ctx r
 	}
 
 	if uploadErr != nil {
+		// Don't leave the parts of a failed multipart upload lying around in the bucket
+		if err := s.client.RemoveIncompleteUpload(s.bucket, objectName); err != nil {
+			ctx.Log.Warn("Error removing incomplete upload: ", err)
+		}
 		return nil, uploadErr
 	}
 
@@ -227,3 +261,56 @@ func (s *s3Datastore) OverwriteObject(location string, stream io.ReadCloser) err
 	_, err := s.client.PutObject(s.bucket, location, stream, -1, minio.PutObjectOptions{})
 	return err
 }
+
+func (s *s3Datastore) ListObjects(fn func(location string, sizeBytes int64, modified time.Time) error) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for obj := range s.client.ListObjectsV2(s.bucket, "", true, doneCh) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(obj.Key, obj.Size, obj.LastModified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignUpload generates a new object name and a URL which the object can be uploaded to directly
+// with a PUT request, until the URL expires.
+func (s *s3Datastore) PresignUpload(expiry time.Duration) (string, *url.URL, error) {
+	objectName, err := util.GenerateRandomString(512)
+	if err != nil {
+		return "", nil, err
+	}
+	signed, err := s.client.PresignedPutObject(s.bucket, objectName, expiry)
+	if err != nil {
+		return "", nil, err
+	}
+	return objectName, signed, nil
+}
+
+// ObjectSize returns the size of the object from its metadata, without downloading it.
+func (s *s3Datastore) ObjectSize(location string) (int64, error) {
+	stat, err := s.client.StatObject(s.bucket, location, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, os.ErrNotExist
+		}
+		return 0, err
+	}
+	return stat.Size, nil
+}
+
+// DownloadObjectStart downloads up to the first length bytes of the object.
+func (s *s3Datastore) DownloadObjectStart(location string, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, length-1); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(s.bucket, location, opts)
+}
+
+func (s *s3Datastore) PresignDownload(location string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return s.client.PresignedGetObject(s.bucket, location, expiry, params)
+}
@@ -0,0 +1,328 @@
+package ds_s3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func TestMain(m *testing.M) {
+	// Uploads are hashed with the configured algorithm, so give the tests a default config
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fakeS3 is an in-memory stand in for the parts of the S3 API the datastore uses.
+type fakeS3 struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	puts     int
+	parts    int
+	uploadId int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// readBody reads the request body, undoing the chunked signing used over plain HTTP.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	decoded := &bytes.Buffer{}
+	br := bufio.NewReader(r.Body)
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.CopyN(decoded, br, size); err != nil {
+			return nil, err
+		}
+		if _, err = br.Discard(2); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return decoded.Bytes(), nil
+		}
+	}
+}
+
+func has(query url.Values, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		w.WriteHeader(http.StatusOK) // bucket operations
+		return
+	}
+	key := parts[1]
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && has(query, "uploads"):
+		f.uploadId++
+		id := strconv.Itoa(f.uploadId)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", parts[0], key, id)
+	case r.Method == http.MethodPut && has(query, "partNumber"):
+		b, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][n] = b
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf("\"part%d\"", n))
+	case r.Method == http.MethodPost && has(query, "uploadId"):
+		uploaded := f.uploads[query.Get("uploadId")]
+		object := &bytes.Buffer{}
+		for n := 1; n <= len(uploaded); n++ {
+			object.Write(uploaded[n])
+		}
+		f.objects[key] = object.Bytes()
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"complete\"</ETag></CompleteMultipartUploadResult>", parts[0], key)
+	case r.Method == http.MethodPut:
+		b, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+		f.puts++
+		w.Header().Set("ETag", "\"object\"")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			}
+			return
+		}
+		w.Header().Set("ETag", "\"object\"")
+		http.ServeContent(w, r, key, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(b))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func testDatastore(t *testing.T, srv *httptest.Server, options map[string]string) *s3Datastore {
+	conf := config.DatastoreConfig{Type: "s3", Options: map[string]string{
+		"endpoint":     strings.TrimPrefix(srv.URL, "http://"),
+		"bucketName":   "media",
+		"accessKeyId":  "access",
+		"accessSecret": "secret",
+		"region":       "us-east-1",
+		"ssl":          "false",
+	}}
+	for k, v := range options {
+		conf.Options[k] = v
+	}
+	ds, err := GetOrCreateS3Datastore(t.Name(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestUploadFile(t *testing.T) {
+	large := make([]byte, 11*1024*1024)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		options        map[string]string
+		contents       []byte
+		expectedLength int64
+		wantMultipart  bool
+	}{
+		{name: "small", contents: []byte("hello world"), expectedLength: 11},
+		{name: "unknown length buffered to disk", options: map[string]string{"tempPath": ""}, contents: []byte("hello world"), expectedLength: -1},
+		{name: "multipart", options: map[string]string{"multipartPartSizeBytes": strconv.Itoa(5 * 1024 * 1024), "multipartThreads": "2"}, contents: large, expectedLength: int64(len(large)), wantMultipart: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeS3(t)
+			if _, ok := tt.options["tempPath"]; ok {
+				tt.options["tempPath"] = t.TempDir()
+			}
+			ds := testDatastore(t, srv, tt.options)
+
+			info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(tt.contents)), tt.expectedLength, testContext())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hash := sha256.Sum256(tt.contents)
+			if info.Sha256Hash != "sha256:"+hex.EncodeToString(hash[:]) {
+				t.Errorf("got hash %s, expected sha256:%s", info.Sha256Hash, hex.EncodeToString(hash[:]))
+			}
+			if info.SizeBytes != int64(len(tt.contents)) {
+				t.Errorf("got size %d, expected %d", info.SizeBytes, len(tt.contents))
+			}
+			if multipart := fake.parts > 1; multipart != tt.wantMultipart {
+				t.Errorf("got %d parts and %d single uploads, expected multipart = %t", fake.parts, fake.puts, tt.wantMultipart)
+			}
+
+			// Existing objects are how de-duplicated media is found again
+			if !ds.ObjectExists(info.Location) {
+				t.Fatal("expected the object to exist")
+			}
+			stream, err := ds.DownloadObject(info.Location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			b, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.contents) {
+				t.Errorf("downloaded %d bytes which don't match the %d uploaded", len(b), len(tt.contents))
+			}
+
+			if err = ds.DeleteObject(info.Location); err != nil {
+				t.Fatal(err)
+			}
+			if ds.ObjectExists(info.Location) {
+				t.Error("expected the object to be deleted")
+			}
+		})
+	}
+}
+
+func TestObjectExistsMissing(t *testing.T) {
+	_, srv := newFakeS3(t)
+	ds := testDatastore(t, srv, nil)
+	if ds.ObjectExists("missing") {
+		t.Error("expected a missing object to not exist")
+	}
+}
+
+func TestGetOrCreateS3DatastoreInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+	}{
+		{name: "missing options", options: map[string]string{"endpoint": "localhost"}},
+		{name: "invalid part size", options: map[string]string{"endpoint": "localhost", "bucketName": "media", "accessKeyId": "a", "accessSecret": "b", "multipartPartSizeBytes": "big"}},
+		{name: "part size too small", options: map[string]string{"endpoint": "localhost", "bucketName": "media", "accessKeyId": "a", "accessSecret": "b", "multipartPartSizeBytes": "5242879"}},
+		{name: "invalid threads", options: map[string]string{"endpoint": "localhost", "bucketName": "media", "accessKeyId": "a", "accessSecret": "b", "multipartThreads": "many"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GetOrCreateS3Datastore(t.Name(), config.DatastoreConfig{Type: "s3", Options: tt.options})
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestPresignUpload(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	ds := testDatastore(t, srv, nil)
+
+	location, signed, err := ds.PresignUpload(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ds.ObjectSize(location); !os.IsNotExist(err) {
+		t.Errorf("got %v before uploading, expected the object to not exist", err)
+	}
+
+	contents := []byte("uploaded without the media repo")
+	req, err := http.NewRequest(http.MethodPut, signed.String(), bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !bytes.Equal(fake.objects[location], contents) {
+		t.Fatalf("got %q uploaded to %s, expected %q", fake.objects[location], location, contents)
+	}
+
+	size, err := ds.ObjectSize(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(contents)) {
+		t.Errorf("got size %d, expected %d", size, len(contents))
+	}
+
+	stream, err := ds.DownloadObjectStart(location, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	b, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "uploaded" {
+		t.Errorf("got %q, expected the first 8 bytes", b)
+	}
+}
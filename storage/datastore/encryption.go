@@ -0,0 +1,280 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/types"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Encrypted objects are stored as the file in AES-256-GCM sealed chunks, with nothing else added.
+// The file key is randomly generated per object and sealed with the master key identified by the
+// key ID. The sealed key, key ID, and nonces are kept in the encryption_keys table rather than the
+// object so that objects are only ever the file itself. Storing the key ID lets old objects be read
+// after the master key is rotated. Each chunk is sealed with the base nonce XOR'd with the chunk
+// index, and the chunk index plus a final chunk marker are used as additional data so that chunks
+// cannot be reordered or truncated.
+
+const encryptionChunkSize = 64 * 1024
+const encryptionKeySize = 32
+const encryptionNonceSize = 12
+const encryptionTagSize = 16
+
+var ErrUnknownEncryptionKey = errors.New("object is encrypted with an unknown key")
+
+type encryptionKeyStore interface {
+	GetEncryptionKey(datastoreId string, location string) (*types.EncryptionKey, error)
+	UpsertEncryptionKey(key *types.EncryptionKey) error
+	DeleteEncryptionKey(datastoreId string, location string) error
+}
+
+// getEncryptionKeyStore is swapped out by tests
+var getEncryptionKeyStore = func(ctx rcontext.RequestContext) encryptionKeyStore {
+	return storage.GetDatabase().GetMetadataStore(ctx)
+}
+
+func getMasterKey(keyId string) ([]byte, error) {
+	encoded, ok := config.Get().Encryption.Keys[keyId]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryptionKeySize {
+		return nil, errors.New("encryption keys must be 32 bytes")
+	}
+	return key, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(baseNonce []byte, index uint64) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	copy(nonce, baseNonce)
+	counter := binary.BigEndian.Uint64(nonce[encryptionNonceSize-8:]) ^ index
+	binary.BigEndian.PutUint64(nonce[encryptionNonceSize-8:], counter)
+	return nonce
+}
+
+func chunkAdditionalData(index uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// encryptedLength calculates the stored size of a plaintext of the given length.
+func encryptedLength(plaintextLength int64) int64 {
+	chunks := plaintextLength / encryptionChunkSize
+	if plaintextLength%encryptionChunkSize != 0 || chunks == 0 {
+		chunks++
+	}
+	return plaintextLength + (chunks * encryptionTagSize)
+}
+
+func isEncryptionEnabled(dsType string) bool {
+	return config.Get().Encryption.Enabled && dsType != "ipfs"
+}
+
+// isEncryptionConfigured returns true if objects in the datastore might be encrypted. This is the
+// case even if encryption is disabled, as it might have been enabled previously.
+func isEncryptionConfigured(dsType string) bool {
+	return len(config.Get().Encryption.Keys) > 0 && dsType != "ipfs"
+}
+
+// encryptStream encrypts the plaintext with a new file key, wrapped by the given master key. The
+// returned key must be stored to be able to decrypt the object again. Encryption stops if the
+// returned stream is closed or the context is cancelled.
+func encryptStream(ctx context.Context, plaintext io.ReadCloser, keyId string, masterKey []byte) (io.ReadCloser, *types.EncryptionKey, error) {
+	masterGcm, err := newGcm(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileKey := make([]byte, encryptionKeySize)
+	keyNonce := make([]byte, encryptionNonceSize)
+	baseNonce := make([]byte, encryptionNonceSize)
+	for _, b := range [][]byte{fileKey, keyNonce, baseNonce} {
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	fileGcm, err := newGcm(fileKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := &types.EncryptionKey{
+		KeyId:      keyId,
+		WrappedKey: masterGcm.Seal(nil, keyNonce, fileKey, []byte(keyId)),
+		KeyNonce:   keyNonce,
+		BaseNonce:  baseNonce,
+	}
+
+	r, w := io.Pipe()
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(done)
+		defer plaintext.Close()
+
+		// We read ahead by one chunk so we know which chunk is the final one
+		reader := bufio.NewReaderSize(plaintext, encryptionChunkSize)
+		chunk := make([]byte, encryptionChunkSize)
+		for index := uint64(0); ; index++ {
+			n, err := io.ReadFull(reader, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				w.CloseWithError(err)
+				return
+			}
+			final := err != nil
+			if !final {
+				if _, err = reader.Peek(1); err == io.EOF {
+					final = true
+				} else if err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+
+			sealed := fileGcm.Seal(nil, chunkNonce(baseNonce, index), chunk[:n], chunkAdditionalData(index, final))
+			if _, err = w.Write(sealed); err != nil {
+				return // the reader was closed or the context was cancelled
+			}
+			if final {
+				w.Close()
+				return
+			}
+		}
+	}()
+
+	return r, key, nil
+}
+
+// plaintextTracker records the hash and size of the plaintext as it is being encrypted, so that
+// de-duplication continues to work on the original file contents.
+type plaintextTracker struct {
+	hasher    *util.Hasher
+	sizeBytes int64
+}
+
+func newPlaintextTracker() (*plaintextTracker, error) {
+	hasher, err := util.NewHasher()
+	if err != nil {
+		return nil, err
+	}
+	return &plaintextTracker{hasher: hasher}, nil
+}
+
+func (t *plaintextTracker) Write(p []byte) (int, error) {
+	t.sizeBytes += int64(len(p))
+	return t.hasher.Write(p)
+}
+
+func (t *plaintextTracker) Sha256Hash() string {
+	return t.hasher.HashString()
+}
+
+type decryptingReader struct {
+	source    *bufio.Reader
+	closer    io.Closer
+	gcm       cipher.AEAD
+	baseNonce []byte
+	index     uint64
+	buf       []byte
+	done      bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		chunk := make([]byte, encryptionChunkSize+encryptionTagSize)
+		n, err := io.ReadFull(r.source, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF // the final chunk went missing
+			}
+			return 0, err
+		}
+		final := err != nil
+		if !final {
+			if _, err = r.source.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		plain, err := r.gcm.Open(nil, chunkNonce(r.baseNonce, r.index), chunk[:n], chunkAdditionalData(r.index, final))
+		if err != nil {
+			return 0, err
+		}
+		r.buf = plain
+		r.index++
+		r.done = final
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.closer.Close()
+}
+
+// decryptStream decrypts an object which was encrypted with the given key.
+func decryptStream(stored io.ReadCloser, key *types.EncryptionKey, masterKey []byte) (io.ReadCloser, error) {
+	masterGcm, err := newGcm(masterKey)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+	fileKey, err := masterGcm.Open(nil, key.KeyNonce, key.WrappedKey, []byte(key.KeyId))
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+	fileGcm, err := newGcm(fileKey)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+
+	return &decryptingReader{
+		source:    bufio.NewReaderSize(stored, encryptionChunkSize+encryptionTagSize),
+		closer:    stored,
+		gcm:       fileGcm,
+		baseNonce: key.BaseNonce,
+	}, nil
+}
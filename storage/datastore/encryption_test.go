@@ -0,0 +1,330 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-datastore-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type fakeEncryptionKeys struct {
+	err  error
+	keys map[string]*types.EncryptionKey
+}
+
+func (s *fakeEncryptionKeys) GetEncryptionKey(datastoreId string, location string) (*types.EncryptionKey, error) {
+	key, ok := s.keys[datastoreId+"/"+location]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (s *fakeEncryptionKeys) UpsertEncryptionKey(key *types.EncryptionKey) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.keys[key.DatastoreId+"/"+key.Location] = key
+	return nil
+}
+
+func (s *fakeEncryptionKeys) DeleteEncryptionKey(datastoreId string, location string) error {
+	delete(s.keys, datastoreId+"/"+location)
+	return nil
+}
+
+func randomKey(t *testing.T) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// withEncryption enables encryption with the given keys for the duration of the test, storing the
+// objects' keys in memory.
+func withEncryption(t *testing.T, enabled bool, keyId string, keys map[string]string) *fakeEncryptionKeys {
+	original := config.Get().Encryption
+	config.Get().Encryption = config.EncryptionConfig{Enabled: enabled, KeyId: keyId, Keys: keys}
+
+	store := &fakeEncryptionKeys{keys: make(map[string]*types.EncryptionKey)}
+	originalStore := getEncryptionKeyStore
+	getEncryptionKeyStore = func(ctx rcontext.RequestContext) encryptionKeyStore {
+		return store
+	}
+
+	t.Cleanup(func() {
+		config.Get().Encryption = original
+		getEncryptionKeyStore = originalStore
+	})
+	return store
+}
+
+func uploadBytes(t *testing.T, ds *DatastoreRef, contents []byte) *types.ObjectInfo {
+	info, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader(contents)), int64(len(contents)), testContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func downloadBytes(ds *DatastoreRef, info *types.ObjectInfo) ([]byte, error) {
+	stream, err := ds.DownloadFile(info.Location, info.Encoded)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return ioutil.ReadAll(stream)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "small", size: 100},
+		{name: "exactly one chunk", size: encryptionChunkSize},
+		{name: "several chunks", size: encryptionChunkSize*2 + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := withEncryption(t, true, "key1", map[string]string{"key1": randomKey(t)})
+			ds := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+			contents := make([]byte, tt.size)
+			if _, err := rand.Read(contents); err != nil {
+				t.Fatal(err)
+			}
+			info := uploadBytes(t, ds, contents)
+
+			// De-duplication and quotas work on the plaintext
+			hash := sha256.Sum256(contents)
+			if info.Sha256Hash != "sha256:"+hex.EncodeToString(hash[:]) || info.SizeBytes != int64(tt.size) {
+				t.Errorf("got hash %s of %d bytes, expected the plaintext's", info.Sha256Hash, info.SizeBytes)
+			}
+
+			stored, err := ioutil.ReadFile(path.Join(ds.Uri, info.Location))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The uncompressed file is stored with a header saying so
+			expectedLength := encryptedLength(int64(tt.size + len(compressionMagic) + 1))
+			if int64(len(stored)) != expectedLength || info.StoredSizeBytes != expectedLength {
+				t.Errorf("got %d bytes stored, expected %d", len(stored), expectedLength)
+			}
+			if !info.Encoded {
+				t.Error("expected the object to be marked as encoded")
+			}
+			if tt.size > 0 && bytes.Contains(stored, contents[:16]) {
+				t.Error("expected the stored object to be encrypted")
+			}
+
+			key, ok := keys.keys["test/"+info.Location]
+			if !ok || key.KeyId != "key1" || len(key.WrappedKey) == 0 || len(key.KeyNonce) == 0 || len(key.BaseNonce) == 0 {
+				t.Fatalf("expected the object's key to be stored, got %+v", key)
+			}
+
+			downloaded, err := downloadBytes(ds, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(downloaded, contents) {
+				t.Error("expected the download to be decrypted")
+			}
+
+			if err = ds.DeleteObject(info.Location); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok = keys.keys["test/"+info.Location]; ok {
+				t.Error("expected the object's key to be deleted with it")
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	keys := map[string]string{"key1": randomKey(t), "key2": randomKey(t)}
+	store := withEncryption(t, true, "key1", keys)
+	ds := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+	plaintext := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: ds.Uri}
+	config.Get().Encryption.Enabled = false
+	old := uploadBytes(t, plaintext, []byte("stored before encryption was enabled"))
+	config.Get().Encryption.Enabled = true
+
+	first := uploadBytes(t, ds, []byte("encrypted with the first key"))
+	config.Get().Encryption.KeyId = "key2"
+	second := uploadBytes(t, ds, []byte("encrypted with the second key"))
+
+	if store.keys["test/"+first.Location].KeyId != "key1" || store.keys["test/"+second.Location].KeyId != "key2" {
+		t.Error("expected new objects to use the current key")
+	}
+
+	expected := map[*types.ObjectInfo]string{
+		old:    "stored before encryption was enabled",
+		first:  "encrypted with the first key",
+		second: "encrypted with the second key",
+	}
+	for info, contents := range expected {
+		downloaded, err := downloadBytes(ds, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(downloaded) != contents {
+			t.Errorf("got %q, expected %q", downloaded, contents)
+		}
+	}
+
+	// Objects can't be read once their key is removed
+	delete(keys, "key1")
+	if _, err := downloadBytes(ds, first); err != ErrUnknownEncryptionKey {
+		t.Errorf("got %v, expected ErrUnknownEncryptionKey", err)
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	withEncryption(t, true, "key1", map[string]string{"key1": randomKey(t)})
+
+	tests := []struct {
+		name   string
+		tamper func(stored []byte) []byte
+	}{
+		{name: "modified", tamper: func(stored []byte) []byte {
+			stored[10] ^= 0xff
+			return stored
+		}},
+		{name: "truncated", tamper: func(stored []byte) []byte {
+			return stored[:encryptionChunkSize+encryptionTagSize]
+		}},
+		{name: "reordered", tamper: func(stored []byte) []byte {
+			size := encryptionChunkSize + encryptionTagSize
+			reordered := append([]byte{}, stored[size:size*2]...)
+			reordered = append(reordered, stored[:size]...)
+			return append(reordered, stored[size*2:]...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+			info := uploadBytes(t, ds, make([]byte, encryptionChunkSize*2+5))
+
+			file := path.Join(ds.Uri, info.Location)
+			stored, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(file, tt.tamper(stored), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = downloadBytes(ds, info); err == nil {
+				t.Error("expected the tampered object to fail decryption")
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyNotStored(t *testing.T) {
+	store := withEncryption(t, true, "key1", map[string]string{"key1": randomKey(t)})
+	store.err = errors.New("database unavailable")
+	ds := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: t.TempDir()}
+
+	_, err := ds.UploadFile(ioutil.NopCloser(bytes.NewReader([]byte("unreadable without a key"))), 24, testContext())
+	if err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+
+	files := 0
+	_ = filepath.Walk(ds.Uri, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if files != 0 {
+		t.Errorf("expected the object to be deleted, found %d files", files)
+	}
+}
+
+// endlessReader never runs out of data, and records when it is closed.
+type endlessReader struct {
+	closed chan bool
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *endlessReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestEncryptStreamStops(t *testing.T) {
+	masterKey := make([]byte, encryptionKeySize)
+
+	tests := []struct {
+		name string
+		stop func(encrypted io.ReadCloser, cancel context.CancelFunc)
+	}{
+		{name: "stream closed", stop: func(encrypted io.ReadCloser, cancel context.CancelFunc) {
+			encrypted.Close()
+		}},
+		{name: "context cancelled", stop: func(encrypted io.ReadCloser, cancel context.CancelFunc) {
+			cancel()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			plaintext := &endlessReader{closed: make(chan bool)}
+
+			encrypted, _, err := encryptStream(ctx, plaintext, "key1", masterKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadFull(encrypted, make([]byte, encryptionChunkSize*3)); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.stop(encrypted, cancel)
+			select {
+			case <-plaintext.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the encryption to stop")
+			}
+			if _, err = io.ReadFull(encrypted, make([]byte, encryptionChunkSize*3)); err == nil {
+				t.Error("expected reading to fail once the encryption stopped")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// withFreeBytes makes every file datastore report the given free space, or an error if
+// freeBytes is negative.
+func withFreeBytes(t *testing.T, freeBytes map[string]int64) {
+	original := getFreeBytes
+	t.Cleanup(func() {
+		getFreeBytes = original
+	})
+	getFreeBytes = func(basePath string) (int64, error) {
+		free, ok := freeBytes[basePath]
+		if !ok || free < 0 {
+			return 0, errors.New("no such file or directory")
+		}
+		return free, nil
+	}
+}
+
+func fileDatastoreConfig(basePath string, minFreeBytes int64) config.DatastoreConfig {
+	return config.DatastoreConfig{
+		Type:         "file",
+		Enabled:      true,
+		MediaKinds:   []string{common.KindLocalMedia},
+		Options:      map[string]string{"path": basePath},
+		MinFreeBytes: minFreeBytes,
+	}
+}
+
+func TestIsLowOnSpace(t *testing.T) {
+	withFreeBytes(t, map[string]int64{"/data/full": 100, "/data/broken": -1})
+
+	tests := []struct {
+		name     string
+		dsConf   config.DatastoreConfig
+		expected bool
+	}{
+		{name: "no minimum", dsConf: fileDatastoreConfig("/data/full", 0)},
+		{name: "enough space", dsConf: fileDatastoreConfig("/data/full", 100)},
+		{name: "not enough space", dsConf: fileDatastoreConfig("/data/full", 101), expected: true},
+		{name: "not a file datastore", dsConf: config.DatastoreConfig{Type: "s3", MinFreeBytes: 101}},
+		{name: "unable to check", dsConf: fileDatastoreConfig("/data/broken", 101)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lowOnSpace := isLowOnSpace(tt.dsConf, testContext())
+			if lowOnSpace != tt.expected {
+				t.Errorf("got %t, expected %t", lowOnSpace, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUploadFileBelowMinFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	withFreeBytes(t, map[string]int64{dir: 100})
+	d := &DatastoreRef{
+		DatastoreId: "test",
+		Type:        "file",
+		Uri:         dir,
+		config:      fileDatastoreConfig(dir, 1024),
+	}
+
+	_, err := d.uploadFile(ioutil.NopCloser(strings.NewReader("hello world")), 11, testContext())
+	var unavailable *common.DatastoreUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("got error %v, expected a DatastoreUnavailableError", err)
+	}
+	if !unavailable.OutOfStorage {
+		t.Error("got OutOfStorage = false, expected true")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files in the datastore, expected none", len(files))
+	}
+}
+
+func TestSelectDatastoreSkipsFullDatastores(t *testing.T) {
+	withFreeBytes(t, map[string]int64{"/data/full": 100, "/data/spare": 1024 * 1024})
+
+	defer func(original func(string, string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		datastoreForRule = original
+	}(datastoreForRule)
+	datastoreForRule = func(datastoreId string, forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		return &DatastoreRef{DatastoreId: datastoreId, Type: "file", config: fileDatastoreConfig("/data/"+datastoreId, 1024)}, nil
+	}
+	defer func(original func(string, rcontext.RequestContext) (*DatastoreRef, error)) {
+		pickDatastore = original
+	}(pickDatastore)
+	pickDatastore = func(forKind string, ctx rcontext.RequestContext) (*DatastoreRef, error) {
+		return &DatastoreRef{DatastoreId: "default"}, nil
+	}
+
+	tests := []struct {
+		name       string
+		rules      []config.DatastoreSelectionRule
+		expectedId string
+	}{
+		{name: "next rule", rules: []config.DatastoreSelectionRule{{DatastoreId: "full"}, {DatastoreId: "spare"}}, expectedId: "spare"},
+		{name: "no other rules", rules: []config.DatastoreSelectionRule{{DatastoreId: "full"}}, expectedId: "default"},
+		{name: "enough space", rules: []config.DatastoreSelectionRule{{DatastoreId: "spare"}, {DatastoreId: "full"}}, expectedId: "spare"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.DatastoreRules = tt.rules
+
+			ds, err := SelectDatastore(common.KindLocalMedia, 1024, "image/png", "example.org", ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ds.DatastoreId != tt.expectedId {
+				t.Errorf("got %s, expected %s", ds.DatastoreId, tt.expectedId)
+			}
+		})
+	}
+}
+
+func TestPickDatastoreAllFull(t *testing.T) {
+	withFreeBytes(t, map[string]int64{"/data/one": 100, "/data/two": 100})
+
+	ctx := testContext()
+	ctx.Config.DataStores = []config.DatastoreConfig{
+		fileDatastoreConfig("/data/one", 1024),
+		fileDatastoreConfig("/data/two", 1024),
+	}
+
+	_, err := PickDatastore(common.KindLocalMedia, ctx)
+	var unavailable *common.DatastoreUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("got error %v, expected a DatastoreUnavailableError", err)
+	}
+	if !unavailable.OutOfStorage {
+		t.Error("got OutOfStorage = false, expected true")
+	}
+}
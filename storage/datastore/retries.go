@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/storage/datastore/ds_azure"
+)
+
+const defaultRetryBaseDelay = 250 * time.Millisecond
+
+// isTransientError determines if the error from a datastore is likely to go away if the operation
+// is tried again, such as server errors and dropped connections. Anything else, such as the object
+// not existing or the request being denied, is considered permanent.
+func isTransientError(err error) bool {
+	if statusCode := ds_azure.StatusCodeOf(err); statusCode != 0 {
+		return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+	}
+	if s3Err := minio.ToErrorResponse(err); s3Err.StatusCode != 0 {
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay picks how long to wait before the given retry (starting at zero), doubling the base
+// delay each time. The delay is jittered so many failed requests don't all retry at once.
+func retryDelay(baseDelay time.Duration, retry int) time.Duration {
+	delay := baseDelay << uint(retry)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// withRetries calls the function until it succeeds, fails with a permanent error, or has been
+// retried as many times as the datastore is configured for.
+func (d *DatastoreRef) withRetries(operation string, fn func() error) error {
+	baseDelay := time.Duration(d.config.Retries.BaseDelayMs) * time.Millisecond
+	if baseDelay <= 0 {
+		baseDelay = defaultRetryBaseDelay
+	}
+
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry >= d.config.Retries.MaxRetries || !isTransientError(err) {
+			return err
+		}
+
+		delay := retryDelay(baseDelay, retry)
+		logrus.WithFields(logrus.Fields{
+			"datastoreId": d.DatastoreId,
+			"operation":   operation,
+			"retry":       retry + 1,
+		}).Warnf("Transient datastore error, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+	}
+}
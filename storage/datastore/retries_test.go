@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/minio/minio-go/v6"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// flakyStream fails part way through being read until it has been rewound enough times.
+type flakyStream struct {
+	util_byte_seeker.ByteSeeker
+	failures int
+	reads    int
+}
+
+func (s *flakyStream) Read(p []byte) (int, error) {
+	if s.failures > 0 {
+		s.reads++
+		if s.reads > 1 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if len(p) > 4 {
+			p = p[:4]
+		}
+	}
+	return s.ByteSeeker.Read(p)
+}
+
+func (s *flakyStream) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart && s.reads > 0 {
+		s.failures--
+		s.reads = 0
+	}
+	return s.ByteSeeker.Seek(offset, whence)
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "azure server error", err: &azcore.ResponseError{StatusCode: 503, ErrorCode: "ServerBusy"}, expected: true},
+		{name: "azure throttled", err: &azcore.ResponseError{StatusCode: 429}, expected: true},
+		{name: "azure not found", err: &azcore.ResponseError{StatusCode: 404, ErrorCode: "BlobNotFound"}, expected: false},
+		{name: "wrapped azure error", err: fmt.Errorf("upload failed: %w", &azcore.ResponseError{StatusCode: 500}), expected: true},
+		{name: "s3 server error", err: minio.ErrorResponse{StatusCode: 500, Code: "InternalError"}, expected: true},
+		{name: "s3 throttled", err: minio.ErrorResponse{StatusCode: 429, Code: "SlowDown"}, expected: true},
+		{name: "s3 denied", err: minio.ErrorResponse{StatusCode: 403, Code: "AccessDenied"}, expected: false},
+		{name: "timeout", err: timeoutError{}, expected: true},
+		{name: "connection reset", err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}, expected: true},
+		{name: "connection refused", err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}, expected: true},
+		{name: "truncated", err: io.ErrUnexpectedEOF, expected: true},
+		{name: "other error", err: errors.New("something went wrong"), expected: false},
+		{name: "missing file", err: os.ErrNotExist, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		retry       int
+		expectedMin time.Duration
+		expectedMax time.Duration
+	}{
+		{retry: 0, expectedMin: 50 * time.Millisecond, expectedMax: 100 * time.Millisecond},
+		{retry: 1, expectedMin: 100 * time.Millisecond, expectedMax: 200 * time.Millisecond},
+		{retry: 3, expectedMin: 400 * time.Millisecond, expectedMax: 800 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.retry), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := retryDelay(100*time.Millisecond, tt.retry)
+				if delay < tt.expectedMin || delay > tt.expectedMax {
+					t.Fatalf("got delay %s, expected between %s and %s", delay, tt.expectedMin, tt.expectedMax)
+				}
+			}
+		})
+	}
+}
+
+func TestWithRetries(t *testing.T) {
+	transient := io.ErrUnexpectedEOF
+	permanent := errors.New("permanent")
+
+	tests := []struct {
+		name          string
+		maxRetries    int
+		errs          []error // returned by each attempt in turn, then nil
+		expectedErr   error
+		expectedCalls int
+	}{
+		{name: "success", maxRetries: 3, errs: nil, expectedCalls: 1},
+		{name: "disabled", maxRetries: 0, errs: []error{transient}, expectedErr: transient, expectedCalls: 1},
+		{name: "recovers", maxRetries: 3, errs: []error{transient, transient}, expectedCalls: 3},
+		{name: "gives up", maxRetries: 2, errs: []error{transient, transient, transient, transient}, expectedErr: transient, expectedCalls: 3},
+		{name: "permanent error", maxRetries: 3, errs: []error{permanent}, expectedErr: permanent, expectedCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := &DatastoreRef{DatastoreId: "test", Type: "file"}
+			ref.config = config.DatastoreConfig{Retries: config.DatastoreRetriesConfig{MaxRetries: tt.maxRetries, BaseDelayMs: 1}}
+
+			calls := 0
+			err := ref.withRetries("test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if err != tt.expectedErr {
+				t.Errorf("got error %v, expected %v", err, tt.expectedErr)
+			}
+			if calls != tt.expectedCalls {
+				t.Errorf("got %d calls, expected %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestUploadFileRetries(t *testing.T) {
+	contents := []byte("media which takes a few tries to store")
+
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int
+		wantErr    bool
+	}{
+		{name: "fails twice then succeeds", maxRetries: 3, failures: 2},
+		{name: "fails too many times", maxRetries: 1, failures: 2, wantErr: true},
+		{name: "retries disabled", maxRetries: 0, failures: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ref := &DatastoreRef{DatastoreId: "test", Type: "file", Uri: dir}
+			ref.config = config.DatastoreConfig{Retries: config.DatastoreRetriesConfig{MaxRetries: tt.maxRetries, BaseDelayMs: 1}}
+
+			stream := &flakyStream{ByteSeeker: util_byte_seeker.NewByteSeeker(contents), failures: tt.failures}
+			info, err := ref.UploadFile(stream, int64(len(contents)), testContext())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+
+			// Failed attempts must not leave partial files behind
+			files := 0
+			err = ref.ListObjects(func(location string, sizeBytes int64, modified time.Time) error {
+				files++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if files != 0 {
+					t.Errorf("got %d files, expected none", files)
+				}
+				return
+			}
+			if files != 1 {
+				t.Errorf("got %d files, expected 1", files)
+			}
+			b, err := ioutil.ReadFile(path.Join(dir, info.Location))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != string(contents) {
+				t.Errorf("got %q, expected %q", b, contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package datastore
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isOutOfStorage determines if the error was caused by the filesystem or quota being full.
+func isOutOfStorage(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// isReadOnlyFilesystem determines if the error was caused by the filesystem being read-only.
+func isReadOnlyFilesystem(err error) bool {
+	return errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package datastore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+func TestCheckUnavailable(t *testing.T) {
+	tests := []struct {
+		name             string
+		err              error
+		wantUnavailable  bool
+		wantOutOfStorage bool
+	}{
+		{name: "disk full", err: &os.PathError{Op: "write", Path: "/media/file", Err: syscall.ENOSPC}, wantUnavailable: true, wantOutOfStorage: true},
+		{name: "quota exceeded", err: &os.PathError{Op: "write", Path: "/media/file", Err: syscall.EDQUOT}, wantUnavailable: true, wantOutOfStorage: true},
+		{name: "read-only filesystem", err: &os.PathError{Op: "open", Path: "/media/file", Err: syscall.EROFS}, wantUnavailable: true},
+		{name: "permission denied", err: &os.PathError{Op: "open", Path: "/media/file", Err: syscall.EACCES}, wantUnavailable: true},
+		{name: "other error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DatastoreRef{DatastoreId: "test"}
+			err := d.checkUnavailable(tt.err)
+
+			if errors.Is(err, common.ErrDatastoreUnavailable) != tt.wantUnavailable {
+				t.Fatalf("errors.Is(%v, ErrDatastoreUnavailable) = %v, want %v", err, !tt.wantUnavailable, tt.wantUnavailable)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("original error %v is not wrapped by %v", tt.err, err)
+			}
+			var dsErr *common.DatastoreUnavailableError
+			if errors.As(err, &dsErr) {
+				if dsErr.DatastoreId != "test" {
+					t.Errorf("DatastoreId = %q, want %q", dsErr.DatastoreId, "test")
+				}
+				if dsErr.OutOfStorage != tt.wantOutOfStorage {
+					t.Errorf("OutOfStorage = %v, want %v", dsErr.OutOfStorage, tt.wantOutOfStorage)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isOutOfStorage determines if the error was caused by the volume or quota being full.
+func isOutOfStorage(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL) || errors.Is(err, windows.ERROR_DISK_QUOTA_EXCEEDED)
+}
+
+// isReadOnlyFilesystem determines if the error was caused by the volume being write-protected.
+func isReadOnlyFilesystem(err error) bool {
+	return errors.Is(err, windows.ERROR_WRITE_PROTECT)
+}
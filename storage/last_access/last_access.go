@@ -0,0 +1,57 @@
+package last_access
+
+import (
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Last access times waiting to be written to the database, by sha256 hash
+var pending = make(map[string]int64)
+var pendingLock = &sync.Mutex{}
+
+// Track records that the file with the given hash was just accessed. Depending on the config,
+// this is either written to the database immediately or held until the next Flush.
+func Track(sha256Hash string, ctx rcontext.RequestContext) {
+	if !config.Get().Metadata.TrackLastAccess {
+		return
+	}
+
+	if config.Get().Metadata.FlushIntervalSeconds <= 0 {
+		upsert(sha256Hash, util.NowMillis(), ctx)
+		return
+	}
+
+	pendingLock.Lock()
+	pending[sha256Hash] = util.NowMillis()
+	pendingLock.Unlock()
+}
+
+// Flush writes any pending last access times to the database.
+func Flush(ctx rcontext.RequestContext) {
+	pendingLock.Lock()
+	toWrite := pending
+	pending = make(map[string]int64)
+	pendingLock.Unlock()
+
+	if len(toWrite) == 0 {
+		return
+	}
+
+	ctx.Log.Infof("Writing %d last access times", len(toWrite))
+	for hash, ts := range toWrite {
+		upsert(hash, ts, ctx)
+	}
+}
+
+func upsert(sha256Hash string, ts int64, ctx rcontext.RequestContext) {
+	err := storage.GetDatabase().GetMetadataStore(ctx).UpsertLastAccess(sha256Hash, ts)
+	if err != nil {
+		sentry.CaptureException(err)
+		ctx.Log.Warn("Failed to upsert the last access time: ", err)
+	}
+}
@@ -0,0 +1,73 @@
+package last_access
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+func TestMain(m *testing.M) {
+	// Buffer the last access times so the tests never need a database
+	dir, err := ioutil.TempDir("", "mr-test-config")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+	err = ioutil.WriteFile(config.Path, []byte("metadata:\n  trackLastAccess: true\n  flushIntervalSeconds: 60\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestTrack(t *testing.T) {
+	tests := []struct {
+		name       string
+		hashes     []string
+		wantHashes []string
+	}{
+		{name: "nothing tracked", hashes: []string{}, wantHashes: []string{}},
+		{name: "one hash", hashes: []string{"a"}, wantHashes: []string{"a"}},
+		{name: "repeated hashes are written once", hashes: []string{"a", "b", "a", "a"}, wantHashes: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pendingLock.Lock()
+			pending = make(map[string]int64)
+			pendingLock.Unlock()
+
+			logger := logrus.New()
+			logger.Out = ioutil.Discard
+			ctx := rcontext.RequestContext{Context: context.Background(), Log: logrus.NewEntry(logger)}
+
+			before := util.NowMillis()
+			for _, hash := range tt.hashes {
+				Track(hash, ctx)
+			}
+
+			pendingLock.Lock()
+			defer pendingLock.Unlock()
+			if len(pending) != len(tt.wantHashes) {
+				t.Errorf("%d pending hashes, want %d", len(pending), len(tt.wantHashes))
+			}
+			for _, hash := range tt.wantHashes {
+				ts, ok := pending[hash]
+				if !ok {
+					t.Errorf("hash %s is not pending", hash)
+				} else if ts < before {
+					t.Errorf("hash %s has last access %d, before the test started at %d", hash, ts, before)
+				}
+			}
+			pending = make(map[string]int64) // nothing to flush to
+		})
+	}
+}
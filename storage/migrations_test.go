@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/DavidHuie/gomigrate"
+	"github.com/sirupsen/logrus"
+)
+
+const migrationsDir = "../migrations"
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_([\w-]+)_(up|down)\.sql$`)
+
+// testDatabase opens the postgres database named by MEDIA_REPO_TEST_POSTGRES, skipping the test if
+// it isn't set. The database should be empty: the tests run the migrations against it.
+func testDatabase(t *testing.T) *sql.DB {
+	connectionString := os.Getenv("MEDIA_REPO_TEST_POSTGRES")
+	if connectionString == "" {
+		t.Skip("MEDIA_REPO_TEST_POSTGRES is not set")
+	}
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTo runs the migrations up to and including the given number.
+func migrateTo(t *testing.T, db *sql.DB, number int) {
+	files, err := ioutil.ReadDir(migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, f := range files {
+		m := migrationFileRegex.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		if n, _ := strconv.Atoi(m[1]); n > number {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(migrationsDir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path.Join(dir, f.Name()), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrator, err := gomigrate.NewMigratorWithLogger(db, gomigrate.Postgres{}, dir+"/", logrus.StandardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodedFlagsBackfill(t *testing.T) {
+	db := testDatabase(t)
+
+	// Files which were encrypted before the encoded flags existed only have a key recorded
+	migrateTo(t, db, 23)
+	statements := []string{
+		"INSERT INTO encryption_keys (datastore_id, location, key_id, wrapped_key, key_nonce, base_nonce) VALUES ('ds', 'encrypted', 'key1', '', '', '');",
+		"INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, location, creation_ts, datastore_id) VALUES ('example.org', 'encrypted', '', 'image/png', '@alice:example.org', 'hash', 1, 'encrypted', 0, 'ds');",
+		"INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, location, creation_ts, datastore_id) VALUES ('example.org', 'plain', '', 'image/png', '@alice:example.org', 'hash', 1, 'plain', 0, 'ds');",
+		"INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, location, creation_ts, datastore_id) VALUES ('example.org', 'other_ds', '', 'image/png', '@alice:example.org', 'hash', 1, 'encrypted', 0, 'other');",
+		"INSERT INTO thumbnails (origin, media_id, width, height, method, content_type, size_bytes, location, creation_ts, sha256_hash, datastore_id) VALUES ('example.org', 'encrypted', 32, 32, 'scale', 'image/png', 1, 'encrypted', 0, 'hash', 'ds');",
+		"INSERT INTO thumbnails (origin, media_id, width, height, method, content_type, size_bytes, location, creation_ts, sha256_hash, datastore_id) VALUES ('example.org', 'plain', 32, 32, 'scale', 'image/png', 1, 'plain', 0, 'hash', 'ds');",
+		"INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location) VALUES ('export', 1, 1, 'part1.tgz', 'ds', 'encrypted');",
+		"INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location) VALUES ('export', 2, 1, 'part2.tgz', 'ds', 'plain');",
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateTo(t, db, 24)
+
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"SELECT encoded FROM media WHERE media_id = 'encrypted';", true},
+		{"SELECT encoded FROM media WHERE media_id = 'plain';", false},
+		{"SELECT encoded FROM media WHERE media_id = 'other_ds';", false},
+		{"SELECT encoded FROM thumbnails WHERE media_id = 'encrypted';", true},
+		{"SELECT encoded FROM thumbnails WHERE media_id = 'plain';", false},
+		{"SELECT encoded FROM export_parts WHERE index = 1;", true},
+		{"SELECT encoded FROM export_parts WHERE index = 2;", false},
+	}
+	for _, tt := range tests {
+		var encoded bool
+		if err := db.QueryRow(tt.query).Scan(&encoded); err != nil {
+			t.Fatal(err)
+		}
+		if encoded != tt.expected {
+			t.Errorf("%s: got %t, expected %t", tt.query, encoded, tt.expected)
+		}
+	}
+}
+
+func TestSha256HashPrefixBackfill(t *testing.T) {
+	db := testDatabase(t)
+
+	// Hashes were stored as bare SHA-256 hex strings before other algorithms were supported
+	migrateTo(t, db, 32)
+	statements := []string{
+		"INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, location, creation_ts, datastore_id) VALUES ('example.org', 'bare_hash', '', 'image/png', '@alice:example.org', 'abc123', 1, 'bare', 0, 'ds');",
+		"INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, location, creation_ts, datastore_id) VALUES ('example.org', 'sha512_hash', '', 'image/png', '@alice:example.org', 'sha512:def456', 1, 'sha512', 0, 'ds');",
+		"INSERT INTO thumbnails (origin, media_id, width, height, method, content_type, size_bytes, location, creation_ts, sha256_hash, datastore_id) VALUES ('example.org', 'no_hash', 32, 32, 'scale', 'image/png', 1, 'no_hash', 0, '', 'ds');",
+		"INSERT INTO blocked_hashes (sha256_hash, reason, blocked_ts) VALUES ('blocked123', '', 0);",
+	}
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateTo(t, db, 33)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT sha256_hash FROM media WHERE media_id = 'bare_hash';", "sha256:abc123"},
+		{"SELECT sha256_hash FROM media WHERE media_id = 'sha512_hash';", "sha512:def456"},
+		{"SELECT sha256_hash FROM thumbnails WHERE media_id = 'no_hash';", ""},
+		{"SELECT sha256_hash FROM blocked_hashes WHERE sha256_hash LIKE '%blocked123';", "sha256:blocked123"},
+	}
+	for _, tt := range tests {
+		var hash string
+		if err := db.QueryRow(tt.query).Scan(&hash); err != nil {
+			t.Fatal(err)
+		}
+		if hash != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.query, hash, tt.expected)
+		}
+	}
+}
+
+func TestMigrationsAreContiguous(t *testing.T) {
+	files, err := ioutil.ReadDir(migrationsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gomigrate keys migrations by number, so a reused number silently replaces another migration
+	names := make(map[int]string)
+	directions := make(map[int]map[string]bool)
+	for _, f := range files {
+		m := migrationFileRegex.FindStringSubmatch(f.Name())
+		if m == nil {
+			t.Errorf("unexpected file in migrations: %s", f.Name())
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if name, ok := names[n]; ok && name != m[2] {
+			t.Errorf("migration %d is used by both %s and %s", n, name, m[2])
+		}
+		names[n] = m[2]
+		if directions[n] == nil {
+			directions[n] = make(map[string]bool)
+		}
+		directions[n][m[3]] = true
+	}
+
+	for n := 1; n <= len(names); n++ {
+		if _, ok := names[n]; !ok {
+			t.Errorf("migration %d is missing, got %d migrations", n, len(names))
+			continue
+		}
+		if !directions[n]["up"] || !directions[n]["down"] {
+			t.Errorf("migration %d (%s) needs both an up and a down file", n, names[n])
+		}
+	}
+}
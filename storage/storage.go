@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"github.com/getsentry/sentry-go"
 	"sync"
@@ -45,6 +46,11 @@ func GetDatabase() *Database {
 	return dbInstance
 }
 
+// Ping verifies the connection to the database is still alive.
+func (d *Database) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
 func ReloadDatabase() {
 	if dbInstance != nil {
 		if err := dbInstance.db.Close(); err != nil {
@@ -8,10 +8,10 @@ import (
 )
 
 const insertExportMetadata = "INSERT INTO exports (export_id, entity) VALUES ($1, $2);"
-const insertExportPart = "INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location) VALUES ($1, $2, $3, $4, $5, $6);"
+const insertExportPart = "INSERT INTO export_parts (export_id, index, size_bytes, file_name, datastore_id, location, encoded) VALUES ($1, $2, $3, $4, $5, $6, $7);"
 const selectExportMetadata = "SELECT export_id, entity FROM exports WHERE export_id = $1;"
-const selectExportParts = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1;"
-const selectExportPart = "SELECT export_id, index, size_bytes, file_name, datastore_id, location FROM export_parts WHERE export_id = $1 AND index = $2;"
+const selectExportParts = "SELECT export_id, index, size_bytes, file_name, datastore_id, location, encoded FROM export_parts WHERE export_id = $1;"
+const selectExportPart = "SELECT export_id, index, size_bytes, file_name, datastore_id, location, encoded FROM export_parts WHERE export_id = $1 AND index = $2;"
 const deleteExportParts = "DELETE FROM export_parts WHERE export_id = $1;"
 const deleteExport = "DELETE FROM exports WHERE export_id = $1;"
 
@@ -80,8 +80,8 @@ func (s *ExportStore) InsertExport(exportId string, entity string) error {
 	return err
 }
 
-func (s *ExportStore) InsertExportPart(exportId string, index int, size int64, name string, datastoreId string, location string) error {
-	_, err := s.statements.insertExportPart.ExecContext(s.ctx, exportId, index, size, name, datastoreId, location)
+func (s *ExportStore) InsertExportPart(exportId string, index int, size int64, name string, datastoreId string, location string, encoded bool) error {
+	_, err := s.statements.insertExportPart.ExecContext(s.ctx, exportId, index, size, name, datastoreId, location, encoded)
 	return err
 }
 
@@ -110,6 +110,7 @@ func (s *ExportStore) GetExportParts(exportId string) ([]*types.ExportPart, erro
 			&obj.FileName,
 			&obj.DatastoreID,
 			&obj.Location,
+			&obj.Encoded,
 		)
 		if err != nil {
 			return nil, err
@@ -129,6 +130,7 @@ func (s *ExportStore) GetExportPart(exportId string, index int) (*types.ExportPa
 		&m.FileName,
 		&m.DatastoreID,
 		&m.Location,
+		&m.Encoded,
 	)
 	return m, err
 }
@@ -9,58 +9,68 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const selectMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 and media_id = $2;"
-const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE sha256_hash = $1;"
-const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
-const selectOldMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, quarantined FROM media AS m WHERE m.origin <> ANY($1) AND m.creation_ts < $2 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
+const selectMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE origin = $1 and media_id = $2;"
+const selectMediaByHash = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE sha256_hash = $1;"
+const insertMedia = "INSERT INTO media (origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18);"
+const selectOldMedia = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media AS m WHERE m.origin <> ANY($1) AND m.creation_ts < $2 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.creation_ts >= $2) = 0 AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0;"
+const selectRemoteMediaPageByLastAccess = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, m.quarantined, m.reported_content_type, m.stored_size_bytes, m.encoded, m.width, m.height, m.uploader_token_hash, sanitized, COALESCE(a.last_access_ts, m.creation_ts) AS access_ts FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE m.origin <> ALL($1) AND m.quarantined = FALSE AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0 AND (COALESCE(a.last_access_ts, m.creation_ts), m.origin, m.media_id) > ($2, $3, $4) ORDER BY access_ts, m.origin, m.media_id LIMIT $5;"
+const selectRemoteMediaSize = "SELECT COALESCE(SUM(f.size_bytes), 0) FROM (SELECT DISTINCT ON (m.datastore_id, m.location) m.size_bytes FROM media AS m WHERE m.origin <> ALL($1) AND m.quarantined = FALSE AND (SELECT COUNT(*) FROM media AS d WHERE d.sha256_hash = m.sha256_hash AND d.origin = ANY($1)) = 0) AS f;"
 const selectOrigins = "SELECT DISTINCT origin FROM media;"
 const deleteMedia = "DELETE FROM media WHERE origin = $1 AND media_id = $2;"
 const updateQuarantined = "UPDATE media SET quarantined = $3 WHERE origin = $1 AND media_id = $2;"
+const updateSanitized = "UPDATE media SET sanitized = $3 WHERE origin = $1 AND media_id = $2;"
 const selectDatastore = "SELECT datastore_id, ds_type, uri FROM datastores WHERE datastore_id = $1;"
 const selectDatastoreByUri = "SELECT datastore_id, ds_type, uri FROM datastores WHERE uri = $1;"
 const insertDatastore = "INSERT INTO datastores (datastore_id, ds_type, uri) VALUES ($1, $2, $3);"
-const selectMediaWithoutDatastore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE datastore_id IS NULL OR datastore_id = '';"
+const selectMediaWithoutDatastore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE datastore_id IS NULL OR datastore_id = '';"
 const updateMediaDatastoreAndLocation = "UPDATE media SET location = $4, datastore_id = $3 WHERE origin = $1 AND media_id = $2;"
 const selectAllDatastores = "SELECT datastore_id, ds_type, uri FROM datastores;"
-const selectAllMediaForServer = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1"
-const selectAllMediaForServerUsers = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND user_id = ANY($2)"
-const selectAllMediaForServerIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND media_id = ANY($2)"
-const selectQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE quarantined = true;"
-const selectServerQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE quarantined = true AND origin = $1;"
-const selectMediaByUser = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE user_id = $1"
-const selectMediaByUserBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE user_id = $1 AND creation_ts <= $2"
-const selectMediaByDomainBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE origin = $1 AND creation_ts <= $2"
-const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined FROM media WHERE datastore_id = $1 AND location = $2"
+const selectAllMediaForServer = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE origin = $1"
+const selectMediaPage = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE ($1::TEXT = '' OR origin = $1::TEXT) AND (origin > $2 OR (origin = $2 AND media_id > $3)) ORDER BY origin, media_id LIMIT $4;"
+const selectAllMediaForServerUsers = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE origin = $1 AND user_id = ANY($2)"
+const selectAllMediaForServerIds = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE origin = $1 AND media_id = ANY($2)"
+const selectQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE quarantined = true;"
+const selectServerQuarantinedMedia = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE quarantined = true AND origin = $1;"
+const selectMediaByUser = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE user_id = $1"
+const selectMediaByUserBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE user_id = $1 AND creation_ts <= $2"
+const selectMediaByDomainBefore = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE origin = $1 AND creation_ts <= $2"
+const selectMediaByLocation = "SELECT origin, media_id, upload_name, content_type, user_id, sha256_hash, size_bytes, datastore_id, location, creation_ts, quarantined, reported_content_type, stored_size_bytes, encoded, width, height, uploader_token_hash, sanitized FROM media WHERE datastore_id = $1 AND location = $2"
 const selectIfQuarantined = "SELECT 1 FROM media WHERE sha256_hash = $1 AND quarantined = $2 LIMIT 1;"
+const selectMediaInventory = "SELECT m.origin, m.media_id, m.upload_name, m.content_type, m.user_id, m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, m.quarantined, m.reported_content_type, m.stored_size_bytes, m.width, m.height, m.uploader_token_hash, COALESCE(a.last_access_ts, 0) FROM media AS m LEFT JOIN last_access AS a ON a.sha256_hash = m.sha256_hash WHERE ($1::TEXT = '' OR m.origin = $1::TEXT) AND ($2::BIGINT <= 0 OR m.creation_ts >= $2::BIGINT) AND ($3::BIGINT <= 0 OR m.creation_ts < $3::BIGINT) ORDER BY m.origin, m.media_id;"
 
 var dsCacheByPath = sync.Map{} // [string] => Datastore
 var dsCacheById = sync.Map{}   // [string] => Datastore
 
 type mediaStoreStatements struct {
-	selectMedia                     *sql.Stmt
-	selectMediaByHash               *sql.Stmt
-	insertMedia                     *sql.Stmt
-	selectOldMedia                  *sql.Stmt
-	selectOrigins                   *sql.Stmt
-	deleteMedia                     *sql.Stmt
-	updateQuarantined               *sql.Stmt
-	selectDatastore                 *sql.Stmt
-	selectDatastoreByUri            *sql.Stmt
-	insertDatastore                 *sql.Stmt
-	selectMediaWithoutDatastore     *sql.Stmt
-	updateMediaDatastoreAndLocation *sql.Stmt
-	selectAllDatastores             *sql.Stmt
-	selectMediaInDatastoreOlderThan *sql.Stmt
-	selectAllMediaForServer         *sql.Stmt
-	selectAllMediaForServerUsers    *sql.Stmt
-	selectAllMediaForServerIds      *sql.Stmt
-	selectQuarantinedMedia          *sql.Stmt
-	selectServerQuarantinedMedia    *sql.Stmt
-	selectMediaByUser               *sql.Stmt
-	selectMediaByUserBefore         *sql.Stmt
-	selectMediaByDomainBefore       *sql.Stmt
-	selectMediaByLocation           *sql.Stmt
-	selectIfQuarantined             *sql.Stmt
+	selectMedia                       *sql.Stmt
+	selectMediaByHash                 *sql.Stmt
+	insertMedia                       *sql.Stmt
+	selectOldMedia                    *sql.Stmt
+	selectRemoteMediaPageByLastAccess *sql.Stmt
+	selectRemoteMediaSize             *sql.Stmt
+	selectOrigins                     *sql.Stmt
+	deleteMedia                       *sql.Stmt
+	updateQuarantined                 *sql.Stmt
+	updateSanitized                   *sql.Stmt
+	selectDatastore                   *sql.Stmt
+	selectDatastoreByUri              *sql.Stmt
+	insertDatastore                   *sql.Stmt
+	selectMediaWithoutDatastore       *sql.Stmt
+	updateMediaDatastoreAndLocation   *sql.Stmt
+	selectAllDatastores               *sql.Stmt
+	selectMediaInDatastoreOlderThan   *sql.Stmt
+	selectAllMediaForServer           *sql.Stmt
+	selectMediaPage                   *sql.Stmt
+	selectAllMediaForServerUsers      *sql.Stmt
+	selectAllMediaForServerIds        *sql.Stmt
+	selectQuarantinedMedia            *sql.Stmt
+	selectServerQuarantinedMedia      *sql.Stmt
+	selectMediaByUser                 *sql.Stmt
+	selectMediaByUserBefore           *sql.Stmt
+	selectMediaByDomainBefore         *sql.Stmt
+	selectMediaByLocation             *sql.Stmt
+	selectIfQuarantined               *sql.Stmt
+	selectMediaInventory              *sql.Stmt
 }
 
 type MediaStoreFactory struct {
@@ -92,6 +102,12 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectOldMedia, err = store.sqlDb.Prepare(selectOldMedia); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectRemoteMediaPageByLastAccess, err = store.sqlDb.Prepare(selectRemoteMediaPageByLastAccess); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectRemoteMediaSize, err = store.sqlDb.Prepare(selectRemoteMediaSize); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectOrigins, err = store.sqlDb.Prepare(selectOrigins); err != nil {
 		return nil, err
 	}
@@ -101,6 +117,9 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.updateQuarantined, err = store.sqlDb.Prepare(updateQuarantined); err != nil {
 		return nil, err
 	}
+	if store.stmts.updateSanitized, err = store.sqlDb.Prepare(updateSanitized); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectDatastore, err = store.sqlDb.Prepare(selectDatastore); err != nil {
 		return nil, err
 	}
@@ -122,6 +141,9 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectAllMediaForServer, err = store.sqlDb.Prepare(selectAllMediaForServer); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectMediaPage, err = store.sqlDb.Prepare(selectMediaPage); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectAllMediaForServerUsers, err = store.sqlDb.Prepare(selectAllMediaForServerUsers); err != nil {
 		return nil, err
 	}
@@ -149,6 +171,9 @@ func InitMediaStore(sqlDb *sql.DB) (*MediaStoreFactory, error) {
 	if store.stmts.selectIfQuarantined, err = store.sqlDb.Prepare(selectIfQuarantined); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectMediaInventory, err = store.sqlDb.Prepare(selectMediaInventory); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -175,6 +200,13 @@ func (s *MediaStore) Insert(media *types.Media) error {
 		media.Location,
 		media.CreationTs,
 		media.Quarantined,
+		media.ReportedContentType,
+		media.StoredSizeBytes,
+		media.Encoded,
+		media.Width,
+		media.Height,
+		media.UploaderTokenHash,
+		media.Sanitized,
 	)
 	return err
 }
@@ -200,6 +232,13 @@ func (s *MediaStore) GetByHash(hash string) ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -224,6 +263,13 @@ func (s *MediaStore) Get(origin string, mediaId string) (*types.Media, error) {
 		&m.Location,
 		&m.CreationTs,
 		&m.Quarantined,
+		&m.ReportedContentType,
+		&m.StoredSizeBytes,
+		&m.Encoded,
+		&m.Width,
+		&m.Height,
+		&m.UploaderTokenHash,
+		&m.Sanitized,
 	)
 	return m, err
 }
@@ -249,6 +295,13 @@ func (s *MediaStore) GetOldMedia(exceptOrigins []string, beforeTs int64) ([]*typ
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -259,6 +312,59 @@ func (s *MediaStore) GetOldMedia(exceptOrigins []string, beforeTs int64) ([]*typ
 	return results, nil
 }
 
+// GetRemoteMediaPageByLastAccess returns up to limit media records which can be evicted from the
+// remote media cache, least recently accessed first. Media from the excepted origins, media sharing
+// a file with them, and quarantined media are never returned. Pages follow the given access time,
+// origin, and media ID, and the access time of the last record is returned for the next page. Pass
+// -1 and empty strings to get the first page.
+func (s *MediaStore) GetRemoteMediaPageByLastAccess(exceptOrigins []string, afterAccessTs int64, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, int64, error) {
+	rows, err := s.statements.selectRemoteMediaPageByLastAccess.QueryContext(s.ctx, pq.Array(exceptOrigins), afterAccessTs, afterOrigin, afterMediaId, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []*types.Media
+	lastAccessTs := afterAccessTs
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
+			&lastAccessTs,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, lastAccessTs, nil
+}
+
+// GetRemoteMediaSize returns how many bytes the media returned by GetRemoteMediaPageByLastAccess
+// uses, counting files shared by several records once.
+func (s *MediaStore) GetRemoteMediaSize(exceptOrigins []string) (int64, error) {
+	var size int64
+	err := s.statements.selectRemoteMediaSize.QueryRowContext(s.ctx, pq.Array(exceptOrigins)).Scan(&size)
+	return size, err
+}
+
 func (s *MediaStore) GetOrigins() ([]string, error) {
 	rows, err := s.statements.selectOrigins.QueryContext(s.ctx)
 	if err != nil {
@@ -288,6 +394,12 @@ func (s *MediaStore) SetQuarantined(origin string, mediaId string, isQuarantined
 	return err
 }
 
+// SetSanitized records whether the media's file was produced by the SVG sanitizer.
+func (s *MediaStore) SetSanitized(origin string, mediaId string, sanitized bool) error {
+	_, err := s.statements.updateSanitized.ExecContext(s.ctx, origin, mediaId, sanitized)
+	return err
+}
+
 func (s *MediaStore) UpdateDatastoreAndLocation(media *types.Media) error {
 	_, err := s.statements.updateMediaDatastoreAndLocation.ExecContext(
 		s.ctx,
@@ -396,6 +508,13 @@ func (s *MediaStore) GetAllWithoutDatastore() ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -450,6 +569,54 @@ func (s *MediaStore) GetAllMediaForServer(serverName string) ([]*types.Media, er
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+// GetMediaPage returns up to limit media records, ordered by origin and media ID, which come after
+// the given origin and media ID. If serverName is not empty, only media for that server is returned.
+// Pass empty strings for afterOrigin and afterMediaId to get the first page.
+func (s *MediaStore) GetMediaPage(serverName string, afterOrigin string, afterMediaId string, limit int) ([]*types.Media, error) {
+	rows, err := s.statements.selectMediaPage.QueryContext(s.ctx, serverName, afterOrigin, afterMediaId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*types.Media
+	for rows.Next() {
+		obj := &types.Media{}
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -481,6 +648,13 @@ func (s *MediaStore) GetAllMediaForServerUsers(serverName string, userIds []stri
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -512,6 +686,13 @@ func (s *MediaStore) GetAllMediaInIds(serverName string, mediaIds []string) ([]*
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -543,6 +724,13 @@ func (s *MediaStore) GetAllQuarantinedMedia() ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -574,6 +762,13 @@ func (s *MediaStore) GetQuarantinedMediaFor(serverName string) ([]*types.Media,
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -605,6 +800,13 @@ func (s *MediaStore) GetMediaByUser(userId string) ([]*types.Media, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -636,6 +838,13 @@ func (s *MediaStore) GetMediaByUserBefore(userId string, beforeTs int64) ([]*typ
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -667,6 +876,13 @@ func (s *MediaStore) GetMediaByDomainBefore(serverName string, beforeTs int64) (
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -698,6 +914,13 @@ func (s *MediaStore) GetMediaByLocation(datastoreId string, location string) ([]
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Encoded,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&obj.Sanitized,
 		)
 		if err != nil {
 			return nil, err
@@ -719,3 +942,48 @@ func (s *MediaStore) IsQuarantined(sha256hash string) (bool, error) {
 	}
 	return true, nil
 }
+
+// StreamInventory calls fn with each media record matching the filters, along with when it was last
+// accessed (zero if never), without loading all of the records into memory. An empty origin matches
+// every origin, and a zero timestamp doesn't limit the creation time in that direction. The first
+// error returned by fn stops the iteration and is returned.
+func (s *MediaStore) StreamInventory(origin string, sinceTs int64, beforeTs int64, fn func(media *types.Media, lastAccessTs int64) error) error {
+	rows, err := s.statements.selectMediaInventory.QueryContext(s.ctx, origin, sinceTs, beforeTs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		obj := &types.Media{}
+		var lastAccessTs int64
+		err = rows.Scan(
+			&obj.Origin,
+			&obj.MediaId,
+			&obj.UploadName,
+			&obj.ContentType,
+			&obj.UserId,
+			&obj.Sha256Hash,
+			&obj.SizeBytes,
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.CreationTs,
+			&obj.Quarantined,
+			&obj.ReportedContentType,
+			&obj.StoredSizeBytes,
+			&obj.Width,
+			&obj.Height,
+			&obj.UploaderTokenHash,
+			&lastAccessTs,
+		)
+		if err != nil {
+			return err
+		}
+		err = fn(obj, lastAccessTs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -3,7 +3,9 @@ package stores
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 
+	"github.com/lib/pq"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/types"
 	"github.com/turt2live/matrix-media-repo/util"
@@ -13,12 +15,14 @@ type folderSize struct {
 	Size int64
 }
 
-const selectSizeOfDatastore = "SELECT COALESCE(SUM(size_bytes), 0) + COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE datastore_id = $1), 0) AS size_total FROM media WHERE datastore_id = $1;"
+const selectSizeOfDatastore = "SELECT COALESCE(SUM(CASE WHEN stored_size_bytes > 0 THEN stored_size_bytes ELSE size_bytes END), 0) + COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE datastore_id = $1), 0) AS size_total FROM media WHERE datastore_id = $1;"
 const upsertLastAccessed = "INSERT INTO last_access (sha256_hash, last_access_ts) VALUES ($1, $2) ON CONFLICT (sha256_hash) DO UPDATE SET last_access_ts = $2"
-const selectMediaLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
-const selectThumbnailsLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
+const selectMediaLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.encoded FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
+const selectThumbnailsLastAccessedBeforeInDatastore = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.encoded FROM thumbnails AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1 AND m.datastore_id = $2"
 const changeDatastoreOfMediaHash = "UPDATE media SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
 const changeDatastoreOfThumbnailHash = "UPDATE thumbnails SET datastore_id = $1, location = $2 WHERE sha256_hash = $3"
+const changeDatastoreOfMediaLocation = "UPDATE media SET datastore_id = $3, location = $4, stored_size_bytes = $5, encoded = $6 WHERE datastore_id = $1 AND location = $2"
+const changeDatastoreOfThumbnailLocation = "UPDATE thumbnails SET datastore_id = $3, location = $4, encoded = $5 WHERE datastore_id = $1 AND location = $2"
 const selectUploadCountsForServer = "SELECT COALESCE((SELECT COUNT(origin) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT COUNT(origin) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
 const selectUploadSizesForServer = "SELECT COALESCE((SELECT SUM(size_bytes) FROM media WHERE origin = $1), 0) AS media, COALESCE((SELECT SUM(size_bytes) FROM thumbnails WHERE origin = $1), 0) AS thumbnails"
 const selectUsersForServer = "SELECT DISTINCT user_id FROM media WHERE origin = $1 AND user_id IS NOT NULL AND LENGTH(user_id) > 0"
@@ -26,12 +30,44 @@ const insertNewBackgroundTask = "INSERT INTO background_tasks (task, params, sta
 const selectBackgroundTask = "SELECT id, task, params, start_ts, end_ts FROM background_tasks WHERE id = $1"
 const updateBackgroundTask = "UPDATE background_tasks SET end_ts = $2 WHERE id = $1"
 const selectAllBackgroundTasks = "SELECT id, task, params, start_ts, end_ts FROM background_tasks"
+const updateBackgroundTaskParams = "UPDATE background_tasks SET params = $2 WHERE id = $1"
 const insertReservation = "INSERT INTO reserved_media (origin, media_id, reason) VALUES ($1, $2, $3);"
 const selectReservation = "SELECT origin, media_id, reason FROM reserved_media WHERE origin = $1 AND media_id = $2;"
-const selectMediaLastAccessed = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1;"
+const selectMediaLastAccessed = "SELECT m.sha256_hash, m.size_bytes, m.datastore_id, m.location, m.creation_ts, a.last_access_ts, m.encoded FROM media AS m JOIN last_access AS a ON m.sha256_hash = a.sha256_hash WHERE a.last_access_ts < $1;"
 const insertBlurhash = "INSERT INTO blurhashes (sha256_hash, blurhash) VALUES ($1, $2);"
 const selectBlurhash = "SELECT blurhash FROM blurhashes WHERE sha256_hash = $1;"
 const selectUserStats = "SELECT user_id, uploaded_bytes FROM user_stats WHERE user_id = $1;"
+const insertBlockedHash = "INSERT INTO blocked_hashes (sha256_hash, reason, blocked_ts) VALUES ($1, $2, $3) ON CONFLICT (sha256_hash) DO UPDATE SET reason = $2;"
+const deleteBlockedHash = "DELETE FROM blocked_hashes WHERE sha256_hash = $1;"
+const selectBlockedHash = "SELECT 1 FROM blocked_hashes WHERE sha256_hash = $1;"
+const selectAllBlockedHashes = "SELECT sha256_hash, reason, blocked_ts FROM blocked_hashes;"
+const selectEncryptionKey = "SELECT datastore_id, location, key_id, wrapped_key, key_nonce, base_nonce FROM encryption_keys WHERE datastore_id = $1 AND location = $2;"
+const upsertEncryptionKey = "INSERT INTO encryption_keys (datastore_id, location, key_id, wrapped_key, key_nonce, base_nonce) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (datastore_id, location) DO UPDATE SET key_id = $3, wrapped_key = $4, key_nonce = $5, base_nonce = $6;"
+const deleteEncryptionKey = "DELETE FROM encryption_keys WHERE datastore_id = $1 AND location = $2;"
+const selectUserUploadedBytesSince = "SELECT COALESCE(SUM(size_bytes), 0) FROM media WHERE user_id = $1 AND creation_ts >= $2;"
+const selectReferencedLocationsInDatastore = "SELECT location FROM media WHERE datastore_id = $1 AND location = ANY($2) UNION SELECT location FROM thumbnails WHERE datastore_id = $1 AND location = ANY($2) UNION SELECT location FROM export_parts WHERE datastore_id = $1 AND location = ANY($2);"
+const selectMediaUsageByDatastore = "SELECT h.datastore_id, SUM(h.records), SUM(h.record_bytes), COUNT(*), SUM(h.hash_bytes) FROM (SELECT datastore_id, sha256_hash, COUNT(*) AS records, SUM(size_bytes) AS record_bytes, MAX(size_bytes) AS hash_bytes FROM media GROUP BY datastore_id, sha256_hash) AS h GROUP BY h.datastore_id;"
+const upsertIdempotencyKey = "INSERT INTO upload_idempotency_keys (user_id, idempotency_key, origin, media_id, expires_ts) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, idempotency_key) DO UPDATE SET origin = $3, media_id = $4, expires_ts = $5 WHERE upload_idempotency_keys.media_id = '' OR upload_idempotency_keys.expires_ts <= $6;"
+const claimIdempotencyKey = "INSERT INTO upload_idempotency_keys (user_id, idempotency_key, origin, media_id, expires_ts) VALUES ($1, $2, '', '', $3) ON CONFLICT (user_id, idempotency_key) DO UPDATE SET origin = '', media_id = '', expires_ts = $3 WHERE upload_idempotency_keys.expires_ts <= $4;"
+const reclaimIdempotencyKey = "UPDATE upload_idempotency_keys SET origin = '', media_id = '', expires_ts = $5 WHERE user_id = $1 AND idempotency_key = $2 AND origin = $3 AND media_id = $4 AND media_id <> '';"
+const deletePendingIdempotencyKey = "DELETE FROM upload_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND media_id = '';"
+const selectIdempotencyKey = "SELECT origin, media_id FROM upload_idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND expires_ts > $3;"
+const deleteExpiredIdempotencyKeys = "DELETE FROM upload_idempotency_keys WHERE expires_ts <= $1;"
+const insertMediaReservation = "INSERT INTO media_reservations (origin, media_id, user_id, expires_ts) VALUES ($1, $2, $3, $4) ON CONFLICT (origin, media_id) DO UPDATE SET user_id = $3, expires_ts = $4 WHERE media_reservations.expires_ts <= $5;"
+const selectMediaReservation = "SELECT user_id, expires_ts FROM media_reservations WHERE origin = $1 AND media_id = $2 AND expires_ts > $3;"
+const selectPendingMediaReservationCount = "SELECT COUNT(*) FROM media_reservations WHERE user_id = $1 AND expires_ts > $2;"
+const deleteClaimedMediaReservation = "DELETE FROM media_reservations WHERE origin = $1 AND media_id = $2 AND user_id = $3 AND expires_ts > $4;"
+const deleteExpiredMediaReservations = "DELETE FROM media_reservations WHERE expires_ts <= $1;"
+const upsertPresignedUpload = "INSERT INTO presigned_uploads (datastore_id, location, expires_ts) VALUES ($1, $2, $3) ON CONFLICT (datastore_id, location) DO UPDATE SET expires_ts = $3;"
+const deletePresignedUpload = "DELETE FROM presigned_uploads WHERE datastore_id = $1 AND location = $2;"
+const selectExpiredPresignedUploads = "SELECT datastore_id, location, expires_ts FROM presigned_uploads WHERE expires_ts <= $1;"
+const insertMigrationJob = "INSERT INTO migration_jobs (task_id, source_datastore_id, target_datastore_id, before_ts, status, phase, last_sha256_hash, migrated_count, failed_count, migrated_bytes, updated_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);"
+const selectMigrationJob = "SELECT task_id, source_datastore_id, target_datastore_id, before_ts, status, phase, last_sha256_hash, migrated_count, failed_count, migrated_bytes, updated_ts FROM migration_jobs WHERE task_id = $1;"
+const selectStaleMigrationJobs = "SELECT task_id, source_datastore_id, target_datastore_id, before_ts, status, phase, last_sha256_hash, migrated_count, failed_count, migrated_bytes, updated_ts FROM migration_jobs WHERE status = 'running' AND updated_ts < $1;"
+const updateMigrationJobProgress = "UPDATE migration_jobs SET phase = $2, last_sha256_hash = $3, migrated_count = $4, failed_count = $5, migrated_bytes = $6, updated_ts = $7 WHERE task_id = $1 AND status = 'running';"
+const updateMigrationJobStatus = "UPDATE migration_jobs SET status = $2, updated_ts = $3 WHERE task_id = $1 AND status = 'running';"
+const claimStaleMigrationJob = "UPDATE migration_jobs SET updated_ts = $3 WHERE task_id = $1 AND status = 'running' AND updated_ts = $2;"
+const selectUserUploadedUniqueBytesSince = "SELECT COALESCE(SUM(m.size_bytes), 0) FROM media AS m WHERE m.user_id = $1 AND m.creation_ts >= $2 AND NOT EXISTS (SELECT 1 FROM media AS o WHERE o.sha256_hash = m.sha256_hash AND o.creation_ts < m.creation_ts);"
 
 type metadataStoreStatements struct {
 	upsertLastAccessed                            *sql.Stmt
@@ -40,6 +76,8 @@ type metadataStoreStatements struct {
 	selectThumbnailsLastAccessedBeforeInDatastore *sql.Stmt
 	changeDatastoreOfMediaHash                    *sql.Stmt
 	changeDatastoreOfThumbnailHash                *sql.Stmt
+	changeDatastoreOfMediaLocation                *sql.Stmt
+	changeDatastoreOfThumbnailLocation            *sql.Stmt
 	selectUploadCountsForServer                   *sql.Stmt
 	selectUploadSizesForServer                    *sql.Stmt
 	selectUsersForServer                          *sql.Stmt
@@ -47,12 +85,44 @@ type metadataStoreStatements struct {
 	selectBackgroundTask                          *sql.Stmt
 	updateBackgroundTask                          *sql.Stmt
 	selectAllBackgroundTasks                      *sql.Stmt
+	updateBackgroundTaskParams                    *sql.Stmt
 	insertReservation                             *sql.Stmt
 	selectReservation                             *sql.Stmt
 	selectMediaLastAccessed                       *sql.Stmt
 	insertBlurhash                                *sql.Stmt
 	selectBlurhash                                *sql.Stmt
 	selectUserStats                               *sql.Stmt
+	selectUserUploadedBytesSince                  *sql.Stmt
+	selectUserUploadedUniqueBytesSince            *sql.Stmt
+	insertBlockedHash                             *sql.Stmt
+	deleteBlockedHash                             *sql.Stmt
+	selectBlockedHash                             *sql.Stmt
+	selectAllBlockedHashes                        *sql.Stmt
+	selectEncryptionKey                           *sql.Stmt
+	upsertEncryptionKey                           *sql.Stmt
+	deleteEncryptionKey                           *sql.Stmt
+	selectReferencedLocationsInDatastore          *sql.Stmt
+	selectMediaUsageByDatastore                   *sql.Stmt
+	upsertIdempotencyKey                          *sql.Stmt
+	claimIdempotencyKey                           *sql.Stmt
+	reclaimIdempotencyKey                         *sql.Stmt
+	deletePendingIdempotencyKey                   *sql.Stmt
+	selectIdempotencyKey                          *sql.Stmt
+	deleteExpiredIdempotencyKeys                  *sql.Stmt
+	insertMediaReservation                        *sql.Stmt
+	selectMediaReservation                        *sql.Stmt
+	selectPendingMediaReservationCount            *sql.Stmt
+	deleteClaimedMediaReservation                 *sql.Stmt
+	deleteExpiredMediaReservations                *sql.Stmt
+	upsertPresignedUpload                         *sql.Stmt
+	deletePresignedUpload                         *sql.Stmt
+	selectExpiredPresignedUploads                 *sql.Stmt
+	insertMigrationJob                            *sql.Stmt
+	selectMigrationJob                            *sql.Stmt
+	selectStaleMigrationJobs                      *sql.Stmt
+	updateMigrationJobProgress                    *sql.Stmt
+	updateMigrationJobStatus                      *sql.Stmt
+	claimStaleMigrationJob                        *sql.Stmt
 }
 
 type MetadataStoreFactory struct {
@@ -90,6 +160,12 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.changeDatastoreOfThumbnailHash, err = store.sqlDb.Prepare(changeDatastoreOfThumbnailHash); err != nil {
 		return nil, err
 	}
+	if store.stmts.changeDatastoreOfMediaLocation, err = store.sqlDb.Prepare(changeDatastoreOfMediaLocation); err != nil {
+		return nil, err
+	}
+	if store.stmts.changeDatastoreOfThumbnailLocation, err = store.sqlDb.Prepare(changeDatastoreOfThumbnailLocation); err != nil {
+		return nil, err
+	}
 	if store.stmts.selectUsersForServer, err = store.sqlDb.Prepare(selectUsersForServer); err != nil {
 		return nil, err
 	}
@@ -111,6 +187,9 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectAllBackgroundTasks, err = store.sqlDb.Prepare(selectAllBackgroundTasks); err != nil {
 		return nil, err
 	}
+	if store.stmts.updateBackgroundTaskParams, err = store.sqlDb.Prepare(updateBackgroundTaskParams); err != nil {
+		return nil, err
+	}
 	if store.stmts.insertReservation, err = store.sqlDb.Prepare(insertReservation); err != nil {
 		return nil, err
 	}
@@ -129,6 +208,101 @@ func InitMetadataStore(sqlDb *sql.DB) (*MetadataStoreFactory, error) {
 	if store.stmts.selectUserStats, err = store.sqlDb.Prepare(selectUserStats); err != nil {
 		return nil, err
 	}
+	if store.stmts.selectUserUploadedBytesSince, err = store.sqlDb.Prepare(selectUserUploadedBytesSince); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectUserUploadedUniqueBytesSince, err = store.sqlDb.Prepare(selectUserUploadedUniqueBytesSince); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertBlockedHash, err = store.sqlDb.Prepare(insertBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteBlockedHash, err = store.sqlDb.Prepare(deleteBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectBlockedHash, err = store.sqlDb.Prepare(selectBlockedHash); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectAllBlockedHashes, err = store.sqlDb.Prepare(selectAllBlockedHashes); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectEncryptionKey, err = store.sqlDb.Prepare(selectEncryptionKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertEncryptionKey, err = store.sqlDb.Prepare(upsertEncryptionKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteEncryptionKey, err = store.sqlDb.Prepare(deleteEncryptionKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectReferencedLocationsInDatastore, err = store.sqlDb.Prepare(selectReferencedLocationsInDatastore); err != nil {
+		return nil, err
+	}
+
+	if store.stmts.selectMediaUsageByDatastore, err = store.sqlDb.Prepare(selectMediaUsageByDatastore); err != nil {
+		return nil, err
+	}
+
+	if store.stmts.upsertIdempotencyKey, err = store.sqlDb.Prepare(upsertIdempotencyKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.claimIdempotencyKey, err = store.sqlDb.Prepare(claimIdempotencyKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.reclaimIdempotencyKey, err = store.sqlDb.Prepare(reclaimIdempotencyKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.deletePendingIdempotencyKey, err = store.sqlDb.Prepare(deletePendingIdempotencyKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectIdempotencyKey, err = store.sqlDb.Prepare(selectIdempotencyKey); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteExpiredIdempotencyKeys, err = store.sqlDb.Prepare(deleteExpiredIdempotencyKeys); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMediaReservation, err = store.sqlDb.Prepare(insertMediaReservation); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMediaReservation, err = store.sqlDb.Prepare(selectMediaReservation); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectPendingMediaReservationCount, err = store.sqlDb.Prepare(selectPendingMediaReservationCount); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteClaimedMediaReservation, err = store.sqlDb.Prepare(deleteClaimedMediaReservation); err != nil {
+		return nil, err
+	}
+	if store.stmts.deleteExpiredMediaReservations, err = store.sqlDb.Prepare(deleteExpiredMediaReservations); err != nil {
+		return nil, err
+	}
+	if store.stmts.upsertPresignedUpload, err = store.sqlDb.Prepare(upsertPresignedUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.deletePresignedUpload, err = store.sqlDb.Prepare(deletePresignedUpload); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectExpiredPresignedUploads, err = store.sqlDb.Prepare(selectExpiredPresignedUploads); err != nil {
+		return nil, err
+	}
+	if store.stmts.insertMigrationJob, err = store.sqlDb.Prepare(insertMigrationJob); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectMigrationJob, err = store.sqlDb.Prepare(selectMigrationJob); err != nil {
+		return nil, err
+	}
+	if store.stmts.selectStaleMigrationJobs, err = store.sqlDb.Prepare(selectStaleMigrationJobs); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateMigrationJobProgress, err = store.sqlDb.Prepare(updateMigrationJobProgress); err != nil {
+		return nil, err
+	}
+	if store.stmts.updateMigrationJobStatus, err = store.sqlDb.Prepare(updateMigrationJobStatus); err != nil {
+		return nil, err
+	}
+	if store.stmts.claimStaleMigrationJob, err = store.sqlDb.Prepare(claimStaleMigrationJob); err != nil {
+		return nil, err
+	}
 
 	return &store, nil
 }
@@ -158,6 +332,17 @@ func (s *MetadataStore) ChangeDatastoreOfHash(datastoreId string, location strin
 	return nil
 }
 
+// ChangeDatastoreOfLocation points all media and thumbnails using the file at the old location to
+// the file at the new location instead, which may be stored and encoded differently.
+func (s *MetadataStore) ChangeDatastoreOfLocation(oldDatastoreId string, oldLocation string, datastoreId string, location string, storedSizeBytes int64, encoded bool) error {
+	_, err := s.statements.changeDatastoreOfMediaLocation.ExecContext(s.ctx, oldDatastoreId, oldLocation, datastoreId, location, storedSizeBytes, encoded)
+	if err != nil {
+		return err
+	}
+	_, err = s.statements.changeDatastoreOfThumbnailLocation.ExecContext(s.ctx, oldDatastoreId, oldLocation, datastoreId, location, encoded)
+	return err
+}
+
 func (s *MetadataStore) GetEstimatedSizeOfDatastore(datastoreId string) (int64, error) {
 	r := &folderSize{}
 	err := s.statements.selectSizeOfDatastore.QueryRowContext(s.ctx, datastoreId).Scan(&r.Size)
@@ -180,6 +365,7 @@ func (s *MetadataStore) GetOldMedia(beforeTs int64) ([]*types.MinimalMediaMetada
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.LastAccessTs,
+			&obj.Encoded,
 		)
 		if err != nil {
 			return nil, err
@@ -206,6 +392,7 @@ func (s *MetadataStore) GetOldMediaInDatastore(datastoreId string, beforeTs int6
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.LastAccessTs,
+			&obj.Encoded,
 		)
 		if err != nil {
 			return nil, err
@@ -232,6 +419,7 @@ func (s *MetadataStore) GetOldThumbnailsInDatastore(datastoreId string, beforeTs
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.LastAccessTs,
+			&obj.Encoded,
 		)
 		if err != nil {
 			return nil, err
@@ -261,6 +449,54 @@ func (s *MetadataStore) GetUsersForServer(serverName string) ([]string, error) {
 	return results, nil
 }
 
+// GetReferencedLocationsInDatastore returns which of the given locations in the datastore are used
+// by media, thumbnails, or export parts.
+func (s *MetadataStore) GetReferencedLocationsInDatastore(datastoreId string, locations []string) ([]string, error) {
+	rows, err := s.statements.selectReferencedLocationsInDatastore.QueryContext(s.ctx, datastoreId, pq.Array(locations))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]string, 0)
+	for rows.Next() {
+		v := ""
+		err = rows.Scan(&v)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, v)
+	}
+
+	return results, nil
+}
+
+// GetMediaUsageByDatastore returns how many media records and bytes each datastore holds, along
+// with how many of those are unique hashes. Datastores without media are not included.
+func (s *MetadataStore) GetMediaUsageByDatastore() ([]*types.DatastoreUsage, error) {
+	rows, err := s.statements.selectMediaUsageByDatastore.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.DatastoreUsage, 0)
+	for rows.Next() {
+		obj := &types.DatastoreUsage{}
+		err = rows.Scan(
+			&obj.DatastoreId,
+			&obj.MediaRecords,
+			&obj.MediaBytes,
+			&obj.UniqueHashes,
+			&obj.UniqueBytes,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
 func (s *MetadataStore) GetByteUsageForServer(serverName string) (int64, int64, error) {
 	row := s.statements.selectUploadSizesForServer.QueryRowContext(s.ctx, serverName)
 
@@ -313,6 +549,15 @@ func (s *MetadataStore) FinishedBackgroundTask(id int) error {
 	return err
 }
 
+func (s *MetadataStore) UpdateBackgroundTaskParams(id int, params map[string]interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	_, err = s.statements.updateBackgroundTaskParams.ExecContext(s.ctx, id, string(b))
+	return err
+}
+
 func (s *MetadataStore) GetBackgroundTask(id int) (*types.BackgroundTask, error) {
 	r := s.statements.selectBackgroundTask.QueryRowContext(s.ctx, id)
 	task := &types.BackgroundTask{}
@@ -427,3 +672,350 @@ func (s *MetadataStore) GetUserStats(userId string) (*types.UserStats, error) {
 	}
 	return stat, nil
 }
+
+func (s *MetadataStore) GetUserUploadedBytesSince(userId string, sinceTs int64, excludeDuplicates bool) (int64, error) {
+	stmt := s.statements.selectUserUploadedBytesSince
+	if excludeDuplicates {
+		stmt = s.statements.selectUserUploadedUniqueBytesSince
+	}
+
+	var total int64
+	err := stmt.QueryRowContext(s.ctx, userId, sinceTs).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (s *MetadataStore) BlockHash(sha256Hash string, reason string) error {
+	_, err := s.statements.insertBlockedHash.ExecContext(s.ctx, sha256Hash, reason, util.NowMillis())
+	return err
+}
+
+func (s *MetadataStore) UnblockHash(sha256Hash string) error {
+	_, err := s.statements.deleteBlockedHash.ExecContext(s.ctx, sha256Hash)
+	return err
+}
+
+func (s *MetadataStore) IsHashBlocked(sha256Hash string) (bool, error) {
+	r := s.statements.selectBlockedHash.QueryRowContext(s.ctx, sha256Hash)
+	var i int
+	err := r.Scan(&i)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *MetadataStore) GetAllBlockedHashes() ([]*types.BlockedHash, error) {
+	rows, err := s.statements.selectAllBlockedHashes.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.BlockedHash, 0)
+	for rows.Next() {
+		obj := &types.BlockedHash{}
+		err = rows.Scan(
+			&obj.Sha256Hash,
+			&obj.Reason,
+			&obj.BlockedTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) GetEncryptionKey(datastoreId string, location string) (*types.EncryptionKey, error) {
+	r := s.statements.selectEncryptionKey.QueryRowContext(s.ctx, datastoreId, location)
+	obj := &types.EncryptionKey{}
+	err := r.Scan(
+		&obj.DatastoreId,
+		&obj.Location,
+		&obj.KeyId,
+		&obj.WrappedKey,
+		&obj.KeyNonce,
+		&obj.BaseNonce,
+	)
+	return obj, err
+}
+
+func (s *MetadataStore) UpsertEncryptionKey(key *types.EncryptionKey) error {
+	_, err := s.statements.upsertEncryptionKey.ExecContext(s.ctx, key.DatastoreId, key.Location, key.KeyId, key.WrappedKey, key.KeyNonce, key.BaseNonce)
+	return err
+}
+
+func (s *MetadataStore) DeleteEncryptionKey(datastoreId string, location string) error {
+	_, err := s.statements.deleteEncryptionKey.ExecContext(s.ctx, datastoreId, location)
+	return err
+}
+
+// SetIdempotencyKey records that the user's upload with the given idempotency key created the media.
+// This replaces a pending claim on the key or an expired use of it, but never media recorded by
+// another upload with the key.
+func (s *MetadataStore) SetIdempotencyKey(userId string, key string, origin string, mediaId string, expiresTs int64) error {
+	_, err := s.statements.upsertIdempotencyKey.ExecContext(s.ctx, userId, key, origin, mediaId, expiresTs, util.NowMillis())
+	return err
+}
+
+// ClaimIdempotencyKey records a pending claim on the user's idempotency key until the given time,
+// returning false if the key is already claimed or used and hasn't expired.
+func (s *MetadataStore) ClaimIdempotencyKey(userId string, key string, expiresTs int64) (bool, error) {
+	r, err := s.statements.claimIdempotencyKey.ExecContext(s.ctx, userId, key, expiresTs, util.NowMillis())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+// ReclaimIdempotencyKey replaces the user's use of an idempotency key for the given media with a
+// pending claim, returning false if the key is no longer used for that media.
+func (s *MetadataStore) ReclaimIdempotencyKey(userId string, key string, origin string, mediaId string, expiresTs int64) (bool, error) {
+	r, err := s.statements.reclaimIdempotencyKey.ExecContext(s.ctx, userId, key, origin, mediaId, expiresTs)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	return n > 0, err
+}
+
+// DeletePendingIdempotencyKey removes a pending claim on the user's idempotency key.
+func (s *MetadataStore) DeletePendingIdempotencyKey(userId string, key string) error {
+	_, err := s.statements.deletePendingIdempotencyKey.ExecContext(s.ctx, userId, key)
+	return err
+}
+
+// GetIdempotencyKey returns the origin and media ID of the media created by the user's upload with
+// the given idempotency key, or sql.ErrNoRows if the key is unknown or has expired. Both are empty
+// if the key is claimed by an upload which hasn't finished yet.
+func (s *MetadataStore) GetIdempotencyKey(userId string, key string) (string, string, error) {
+	origin := ""
+	mediaId := ""
+	err := s.statements.selectIdempotencyKey.QueryRowContext(s.ctx, userId, key, util.NowMillis()).Scan(&origin, &mediaId)
+	return origin, mediaId, err
+}
+
+func (s *MetadataStore) DeleteExpiredIdempotencyKeys() error {
+	_, err := s.statements.deleteExpiredIdempotencyKeys.ExecContext(s.ctx, util.NowMillis())
+	return err
+}
+
+// InsertMediaReservation reserves the media ID for an upload by the user which has to happen before
+// the expiry time. Expired reservations which haven't been deleted yet are replaced.
+func (s *MetadataStore) InsertMediaReservation(origin string, mediaId string, userId string, expiresTs int64) error {
+	r, err := s.statements.insertMediaReservation.ExecContext(s.ctx, origin, mediaId, userId, expiresTs, util.NowMillis())
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("media ID is already reserved")
+	}
+	return nil
+}
+
+// GetMediaReservation returns the user ID and expiry time of the reservation for the media ID, or
+// sql.ErrNoRows if there is no such reservation or it has expired.
+func (s *MetadataStore) GetMediaReservation(origin string, mediaId string) (string, int64, error) {
+	userId := ""
+	expiresTs := int64(0)
+	err := s.statements.selectMediaReservation.QueryRowContext(s.ctx, origin, mediaId, util.NowMillis()).Scan(&userId, &expiresTs)
+	return userId, expiresTs, err
+}
+
+// GetPendingMediaReservationCount returns how many reservations the user has which are yet to be
+// uploaded to and haven't expired.
+func (s *MetadataStore) GetPendingMediaReservationCount(userId string) (int64, error) {
+	count := int64(0)
+	err := s.statements.selectPendingMediaReservationCount.QueryRowContext(s.ctx, userId, util.NowMillis()).Scan(&count)
+	return count, err
+}
+
+// ClaimMediaReservation removes the user's reservation for the media ID so it can be uploaded to,
+// returning false if there was no unexpired reservation to claim. Only one caller can claim each
+// reservation.
+func (s *MetadataStore) ClaimMediaReservation(origin string, mediaId string, userId string) (bool, error) {
+	r, err := s.statements.deleteClaimedMediaReservation.ExecContext(s.ctx, origin, mediaId, userId, util.NowMillis())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *MetadataStore) DeleteExpiredMediaReservations() error {
+	_, err := s.statements.deleteExpiredMediaReservations.ExecContext(s.ctx, util.NowMillis())
+	return err
+}
+
+// UpsertPresignedUpload records that a client can upload to the location until the given time, so
+// the object can be deleted if the upload is never finalized.
+func (s *MetadataStore) UpsertPresignedUpload(datastoreId string, location string, expiresTs int64) error {
+	_, err := s.statements.upsertPresignedUpload.ExecContext(s.ctx, datastoreId, location, expiresTs)
+	return err
+}
+
+func (s *MetadataStore) DeletePresignedUpload(datastoreId string, location string) error {
+	_, err := s.statements.deletePresignedUpload.ExecContext(s.ctx, datastoreId, location)
+	return err
+}
+
+// GetExpiredPresignedUploads returns the presigned uploads which expired at or before the given time
+// without being finalized.
+func (s *MetadataStore) GetExpiredPresignedUploads(beforeTs int64) ([]*types.PresignedObject, error) {
+	rows, err := s.statements.selectExpiredPresignedUploads.QueryContext(s.ctx, beforeTs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*types.PresignedObject
+	for rows.Next() {
+		obj := &types.PresignedObject{}
+		err = rows.Scan(
+			&obj.DatastoreId,
+			&obj.Location,
+			&obj.ExpiresTs,
+		)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, obj)
+	}
+
+	return results, nil
+}
+
+func (s *MetadataStore) InsertMigrationJob(job *types.MigrationJob) error {
+	_, err := s.statements.insertMigrationJob.ExecContext(s.ctx,
+		job.TaskID,
+		job.SourceDatastoreId,
+		job.TargetDatastoreId,
+		job.BeforeTs,
+		job.Status,
+		job.Phase,
+		job.LastSha256Hash,
+		job.MigratedCount,
+		job.FailedCount,
+		job.MigratedBytes,
+		job.UpdatedTs,
+	)
+	return err
+}
+
+func (s *MetadataStore) GetMigrationJob(taskId int) (*types.MigrationJob, error) {
+	return scanMigrationJob(s.statements.selectMigrationJob.QueryRowContext(s.ctx, taskId))
+}
+
+// GetStaleMigrationJobs returns the running migration jobs which haven't been updated since the
+// given time, most likely because the process running them stopped.
+func (s *MetadataStore) GetStaleMigrationJobs(updatedBeforeTs int64) ([]*types.MigrationJob, error) {
+	rows, err := s.statements.selectStaleMigrationJobs.QueryContext(s.ctx, updatedBeforeTs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*types.MigrationJob, 0)
+	for rows.Next() {
+		job, err := scanMigrationJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, job)
+	}
+
+	return results, nil
+}
+
+// UpdateMigrationJobProgress saves the job's checkpoint and counts, returning false if the job is no
+// longer running (such as when it was cancelled).
+func (s *MetadataStore) UpdateMigrationJobProgress(job *types.MigrationJob) (bool, error) {
+	job.UpdatedTs = util.NowMillis()
+	r, err := s.statements.updateMigrationJobProgress.ExecContext(s.ctx,
+		job.TaskID,
+		job.Phase,
+		job.LastSha256Hash,
+		job.MigratedCount,
+		job.FailedCount,
+		job.MigratedBytes,
+		job.UpdatedTs,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetMigrationJobStatus finishes or cancels a running job, returning false if it wasn't running.
+func (s *MetadataStore) SetMigrationJobStatus(taskId int, status string) (bool, error) {
+	r, err := s.statements.updateMigrationJobStatus.ExecContext(s.ctx, taskId, status, util.NowMillis())
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ClaimStaleMigrationJob marks a stale job as updated so only one process resumes it, returning
+// false if another process got to it first.
+func (s *MetadataStore) ClaimStaleMigrationJob(job *types.MigrationJob) (bool, error) {
+	now := util.NowMillis()
+	r, err := s.statements.claimStaleMigrationJob.ExecContext(s.ctx, job.TaskID, job.UpdatedTs, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		job.UpdatedTs = now
+	}
+	return n > 0, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMigrationJob(row rowScanner) (*types.MigrationJob, error) {
+	job := &types.MigrationJob{}
+	err := row.Scan(
+		&job.TaskID,
+		&job.SourceDatastoreId,
+		&job.TargetDatastoreId,
+		&job.BeforeTs,
+		&job.Status,
+		&job.Phase,
+		&job.LastSha256Hash,
+		&job.MigratedCount,
+		&job.FailedCount,
+		&job.MigratedBytes,
+		&job.UpdatedTs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
@@ -7,16 +7,16 @@ import (
 	"github.com/turt2live/matrix-media-repo/types"
 )
 
-const selectThumbnail = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12);"
-const updateThumbnailHash = "UPDATE thumbnails SET sha256_hash = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const selectThumbnailsWithoutHash = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE sha256_hash IS NULL OR sha256_hash = '';"
-const selectThumbnailsWithoutDatastore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE datastore_id IS NULL OR datastore_id = '';"
-const updateThumbnailDatastoreAndLocation = "UPDATE thumbnails SET location = $8, datastore_id = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6;"
-const selectThumbnailsForMedia = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE origin = $1 AND media_id = $2;"
+const selectThumbnail = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality FROM thumbnails WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and format = $7 and quality = $8;"
+const insertThumbnail = "INSERT INTO thumbnails (origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);"
+const updateThumbnailHash = "UPDATE thumbnails SET sha256_hash = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and format = $8 and quality = $9;"
+const selectThumbnailsWithoutHash = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality FROM thumbnails WHERE sha256_hash IS NULL OR sha256_hash = '';"
+const selectThumbnailsWithoutDatastore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality FROM thumbnails WHERE datastore_id IS NULL OR datastore_id = '';"
+const updateThumbnailDatastoreAndLocation = "UPDATE thumbnails SET location = $8, datastore_id = $7 WHERE origin = $1 and media_id = $2 and width = $3 and height = $4 and method = $5 and animated = $6 and format = $9 and quality = $10;"
+const selectThumbnailsForMedia = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality FROM thumbnails WHERE origin = $1 AND media_id = $2;"
 const deleteThumbnailsForMedia = "DELETE FROM thumbnails WHERE origin = $1 AND media_id = $2;"
-const selectThumbnailsCreatedBefore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash FROM thumbnails WHERE creation_ts < $1;"
-const deleteThumbnailsWithHash = "DELETE FROM thumbnails WHERE sha256_hash = $1;"
+const selectThumbnailsCreatedBefore = "SELECT origin, media_id, width, height, method, animated, content_type, size_bytes, datastore_id, location, creation_ts, sha256_hash, format, encoded, quality FROM thumbnails WHERE creation_ts < $1;"
+const deleteThumbnailsWithLocation = "DELETE FROM thumbnails WHERE datastore_id = $1 AND location = $2;"
 
 type thumbnailStatements struct {
 	selectThumbnail                     *sql.Stmt
@@ -28,7 +28,7 @@ type thumbnailStatements struct {
 	selectThumbnailsForMedia            *sql.Stmt
 	deleteThumbnailsForMedia            *sql.Stmt
 	selectThumbnailsCreatedBefore       *sql.Stmt
-	deleteThumbnailsWithHash            *sql.Stmt
+	deleteThumbnailsWithLocation        *sql.Stmt
 }
 
 type ThumbnailStoreFactory struct {
@@ -75,7 +75,7 @@ func InitThumbnailStore(sqlDb *sql.DB) (*ThumbnailStoreFactory, error) {
 	if store.stmts.selectThumbnailsCreatedBefore, err = store.sqlDb.Prepare(selectThumbnailsCreatedBefore); err != nil {
 		return nil, err
 	}
-	if store.stmts.deleteThumbnailsWithHash, err = store.sqlDb.Prepare(deleteThumbnailsWithHash); err != nil {
+	if store.stmts.deleteThumbnailsWithLocation, err = store.sqlDb.Prepare(deleteThumbnailsWithLocation); err != nil {
 		return nil, err
 	}
 
@@ -105,14 +105,17 @@ func (s *ThumbnailStore) Insert(thumbnail *types.Thumbnail) error {
 		thumbnail.Location,
 		thumbnail.CreationTs,
 		thumbnail.Sha256Hash,
+		thumbnail.Format,
+		thumbnail.Encoded,
+		thumbnail.Quality,
 	)
 
 	return err
 }
 
-func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height int, method string, animated bool) (*types.Thumbnail, error) {
+func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height int, method string, animated bool, format string, quality int) (*types.Thumbnail, error) {
 	t := &types.Thumbnail{}
-	err := s.statements.selectThumbnail.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated).Scan(
+	err := s.statements.selectThumbnail.QueryRowContext(s.ctx, origin, mediaId, width, height, method, animated, format, quality).Scan(
 		&t.Origin,
 		&t.MediaId,
 		&t.Width,
@@ -125,6 +128,9 @@ func (s *ThumbnailStore) Get(origin string, mediaId string, width int, height in
 		&t.Location,
 		&t.CreationTs,
 		&t.Sha256Hash,
+		&t.Format,
+		&t.Encoded,
+		&t.Quality,
 	)
 	return t, err
 }
@@ -139,6 +145,8 @@ func (s *ThumbnailStore) UpdateHash(thumbnail *types.Thumbnail) error {
 		thumbnail.Method,
 		thumbnail.Animated,
 		thumbnail.Sha256Hash,
+		thumbnail.Format,
+		thumbnail.Quality,
 	)
 
 	return err
@@ -155,6 +163,8 @@ func (s *ThumbnailStore) UpdateDatastoreAndLocation(thumbnail *types.Thumbnail)
 		thumbnail.Animated,
 		thumbnail.DatastoreId,
 		thumbnail.Location,
+		thumbnail.Format,
+		thumbnail.Quality,
 	)
 
 	return err
@@ -182,6 +192,9 @@ func (s *ThumbnailStore) GetAllWithoutHash() ([]*types.Thumbnail, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.Format,
+			&obj.Encoded,
+			&obj.Quality,
 		)
 		if err != nil {
 			return nil, err
@@ -214,6 +227,9 @@ func (s *ThumbnailStore) GetAllWithoutDatastore() ([]*types.Thumbnail, error) {
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.Format,
+			&obj.Encoded,
+			&obj.Quality,
 		)
 		if err != nil {
 			return nil, err
@@ -246,6 +262,9 @@ func (s *ThumbnailStore) GetAllForMedia(origin string, mediaId string) ([]*types
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.Format,
+			&obj.Encoded,
+			&obj.Quality,
 		)
 		if err != nil {
 			return nil, err
@@ -286,6 +305,9 @@ func (s *ThumbnailStore) GetOldThumbnails(beforeTs int64) ([]*types.Thumbnail, e
 			&obj.Location,
 			&obj.CreationTs,
 			&obj.Sha256Hash,
+			&obj.Format,
+			&obj.Encoded,
+			&obj.Quality,
 		)
 		if err != nil {
 			return nil, err
@@ -296,8 +318,9 @@ func (s *ThumbnailStore) GetOldThumbnails(beforeTs int64) ([]*types.Thumbnail, e
 	return results, nil
 }
 
-func (s *ThumbnailStore) DeleteWithHash(sha256hash string) error {
-	_, err := s.statements.deleteThumbnailsWithHash.ExecContext(s.ctx, sha256hash)
+// DeleteWithLocation deletes the records of every thumbnail using the file at the location.
+func (s *ThumbnailStore) DeleteWithLocation(datastoreId string, location string) error {
+	_, err := s.statements.deleteThumbnailsWithLocation.ExecContext(s.ctx, datastoreId, location)
 	if err != nil {
 		return err
 	}
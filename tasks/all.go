@@ -4,10 +4,24 @@ func StartAll() {
 	StartRemoteMediaPurgeRecurring()
 	StartThumbnailPurgeRecurring()
 	StartPreviewsPurgeRecurring()
+	StartLastAccessFlushRecurring()
+	StartIdempotencyKeysPurgeRecurring()
+	StartMediaReservationsPurgeRecurring()
+	StartPresignedUploadsPurgeRecurring()
+	StartDeduplicationStatsRecurring()
+	StartStorageMigrationResumeRecurring()
+	StartExpiredMediaPurgeRecurring()
 }
 
 func StopAll() {
 	StopRemoteMediaPurgeRecurring()
 	StopThumbnailPurgeRecurring()
 	StopPreviewsPurgeRecurring()
+	StopLastAccessFlushRecurring()
+	StopIdempotencyKeysPurgeRecurring()
+	StopMediaReservationsPurgeRecurring()
+	StopPresignedUploadsPurgeRecurring()
+	StopDeduplicationStatsRecurring()
+	StopStorageMigrationResumeRecurring()
+	StopExpiredMediaPurgeRecurring()
 }
@@ -0,0 +1,51 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage/last_access"
+)
+
+var lastAccessFlushDone chan bool
+
+func StartLastAccessFlushRecurring() {
+	lastAccessFlushDone = make(chan bool)
+
+	interval := config.Get().Metadata.FlushIntervalSeconds
+	if interval <= 0 {
+		// Last access times are written immediately - just wait to be stopped
+		go func() {
+			defer close(lastAccessFlushDone)
+			<-lastAccessFlushDone
+		}()
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+
+	go func() {
+		defer close(lastAccessFlushDone)
+		for {
+			select {
+			case <-lastAccessFlushDone:
+				ticker.Stop()
+				doLastAccessFlush() // don't lose anything pending
+				return
+			case <-ticker.C:
+				doLastAccessFlush()
+			}
+		}
+	}()
+}
+
+func StopLastAccessFlushRecurring() {
+	lastAccessFlushDone <- true
+}
+
+func doLastAccessFlush() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_flush_last_access"})
+	last_access.Flush(ctx)
+}
@@ -0,0 +1,55 @@
+package tasks
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var expiredMediaPurgeDone chan bool
+
+func StartExpiredMediaPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	expiredMediaPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(expiredMediaPurgeDone)
+		for {
+			select {
+			case <-expiredMediaPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				if !config.Get().Retention.Enabled || len(config.Get().Retention.Rules) == 0 {
+					continue
+				}
+
+				doRecurringExpiredMediaPurge()
+			}
+		}
+	}()
+}
+
+func StopExpiredMediaPurgeRecurring() {
+	expiredMediaPurgeDone <- true
+}
+
+func doRecurringExpiredMediaPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_expired_media"})
+	ctx.Log.Info("Starting expired media purge task")
+
+	purged, err := maintenance_controller.PurgeExpiredMedia(ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Purge task completed: %d expired media purged", purged))
+}
@@ -0,0 +1,50 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+var idempotencyKeysPurgeDone chan bool
+
+func StartIdempotencyKeysPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	idempotencyKeysPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(idempotencyKeysPurgeDone)
+		for {
+			select {
+			case <-idempotencyKeysPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringIdempotencyKeysPurge()
+			}
+		}
+	}()
+}
+
+func StopIdempotencyKeysPurgeRecurring() {
+	idempotencyKeysPurgeDone <- true
+}
+
+func doRecurringIdempotencyKeysPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_idempotency_keys"})
+	ctx.Log.Info("Starting upload idempotency key purge task")
+
+	// Keys expire at different times depending on the domain's config, so the expiry is stored with them
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	err := db.DeleteExpiredIdempotencyKeys()
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+	ctx.Log.Info("Purge task completed")
+}
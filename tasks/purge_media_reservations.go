@@ -0,0 +1,50 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+)
+
+var mediaReservationsPurgeDone chan bool
+
+func StartMediaReservationsPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	mediaReservationsPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(mediaReservationsPurgeDone)
+		for {
+			select {
+			case <-mediaReservationsPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringMediaReservationsPurge()
+			}
+		}
+	}()
+}
+
+func StopMediaReservationsPurgeRecurring() {
+	mediaReservationsPurgeDone <- true
+}
+
+func doRecurringMediaReservationsPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_media_reservations"})
+	ctx.Log.Info("Starting expired media reservation purge task")
+
+	// Reservations expire at different times depending on the domain's config, so the expiry is stored with them
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	err := db.DeleteExpiredMediaReservations()
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+	ctx.Log.Info("Purge task completed")
+}
@@ -0,0 +1,76 @@
+package tasks
+
+import (
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/storage"
+	"github.com/turt2live/matrix-media-repo/storage/datastore"
+	"github.com/turt2live/matrix-media-repo/util"
+)
+
+// Uploads which are being finalized as they expire are given time to finish before being purged
+const presignedUploadsPurgeGrace = 1 * time.Hour
+
+var presignedUploadsPurgeDone chan bool
+
+func StartPresignedUploadsPurgeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((1 * time.Hour) + (time.Duration(r.Intn(15)) * time.Minute))
+	presignedUploadsPurgeDone = make(chan bool)
+
+	go func() {
+		defer close(presignedUploadsPurgeDone)
+		for {
+			select {
+			case <-presignedUploadsPurgeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringPresignedUploadsPurge()
+			}
+		}
+	}()
+}
+
+func StopPresignedUploadsPurgeRecurring() {
+	presignedUploadsPurgeDone <- true
+}
+
+func doRecurringPresignedUploadsPurge() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_presigned_uploads"})
+	ctx.Log.Info("Starting expired presigned upload purge task")
+
+	// Uploads are normally cleaned up when they expire, but that is forgotten about if the media repo restarts
+	db := storage.GetDatabase().GetMetadataStore(ctx)
+	uploads, err := db.GetExpiredPresignedUploads(util.NowMillis() - presignedUploadsPurgeGrace.Milliseconds())
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+
+	for _, upload := range uploads {
+		ds, err := datastore.LocateDatastore(ctx, upload.DatastoreId)
+		if err != nil {
+			ctx.Log.Error("Error locating datastore ", upload.DatastoreId, " for presigned upload: ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		// Clients don't always upload anything to the URL they were given
+		if err = ds.DeleteObject(upload.Location); err != nil && !os.IsNotExist(err) {
+			ctx.Log.Error("Error deleting presigned upload ", upload.Location, ": ", err)
+			sentry.CaptureException(err)
+			continue
+		}
+		if err = db.DeletePresignedUpload(upload.DatastoreId, upload.Location); err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+		}
+	}
+	ctx.Log.Infof("Purge task completed, deleted up to %d presigned uploads", len(uploads))
+}
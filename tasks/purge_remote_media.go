@@ -27,7 +27,7 @@ func StartRemoteMediaPurgeRecurring() {
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				if config.Get().Downloads.ExpireDays <= 0 {
+				if config.Get().Downloads.ExpireDays <= 0 && config.Get().Downloads.MaxRemoteBytes <= 0 {
 					continue
 				}
 
@@ -45,13 +45,23 @@ func doRecurringRemoteMediaPurge() {
 	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_purge_remote_media"})
 	ctx.Log.Info("Starting remote media purge task")
 
-	// We get media that is N days old to make sure it gets cleared safely.
-	beforeTs := util.NowMillis() - int64(config.Get().Downloads.ExpireDays*24*60*60*1000)
+	if config.Get().Downloads.ExpireDays > 0 {
+		// We get media that is N days old to make sure it gets cleared safely.
+		beforeTs := util.NowMillis() - int64(config.Get().Downloads.ExpireDays*24*60*60*1000)
 
-	_, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, ctx)
-	if err != nil {
-		ctx.Log.Error(err)
-		sentry.CaptureException(err)
+		_, err := maintenance_controller.PurgeRemoteMediaBefore(beforeTs, ctx)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+		}
+	}
+
+	if config.Get().Downloads.MaxRemoteBytes > 0 {
+		_, err := maintenance_controller.PurgeRemoteMediaOverSize(config.Get().Downloads.MaxRemoteBytes, ctx)
+		if err != nil {
+			ctx.Log.Error(err)
+			sentry.CaptureException(err)
+		}
 	}
 	ctx.Log.Info("Purge task completed")
 }
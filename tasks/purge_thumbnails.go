@@ -72,8 +72,10 @@ func doRecurringThumbnailPurge() {
 			continue
 		}
 
+		// Thumbnails with the same hash can have their own files, so only the records using this
+		// file are removed
 		ctx.Log.Info("Deleting thumbnails with hash: ", thumb.Sha256Hash)
-		err = db.DeleteWithHash(thumb.Sha256Hash)
+		err = db.DeleteWithLocation(thumb.DatastoreId, thumb.Location)
 		if err != nil {
 			ctx.Log.Error(err)
 			sentry.CaptureException(err)
@@ -0,0 +1,48 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var storageMigrationResumeDone chan bool
+
+func StartStorageMigrationResumeRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((5 * time.Minute) + (time.Duration(r.Intn(60)) * time.Second))
+	storageMigrationResumeDone = make(chan bool)
+
+	go func() {
+		defer close(storageMigrationResumeDone)
+		doRecurringStorageMigrationResume() // pick up migrations interrupted by a restart
+		for {
+			select {
+			case <-storageMigrationResumeDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringStorageMigrationResume()
+			}
+		}
+	}()
+}
+
+func StopStorageMigrationResumeRecurring() {
+	storageMigrationResumeDone <- true
+}
+
+func doRecurringStorageMigrationResume() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_resume_storage_migrations"})
+
+	// Running migrations regularly mark themselves as alive, so only stopped ones are resumed
+	err := maintenance_controller.ResumeStorageMigrations(ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+	}
+}
@@ -0,0 +1,49 @@
+package tasks
+
+import (
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/controllers/maintenance_controller"
+)
+
+var deduplicationStatsDone chan bool
+
+func StartDeduplicationStatsRecurring() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker((15 * time.Minute) + (time.Duration(r.Intn(5)) * time.Minute))
+	deduplicationStatsDone = make(chan bool)
+
+	go func() {
+		defer close(deduplicationStatsDone)
+		for {
+			select {
+			case <-deduplicationStatsDone:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				doRecurringDeduplicationStats()
+			}
+		}
+	}()
+}
+
+func StopDeduplicationStatsRecurring() {
+	deduplicationStatsDone <- true
+}
+
+func doRecurringDeduplicationStats() {
+	ctx := rcontext.Initial().LogWithFields(logrus.Fields{"task": "recurring_deduplication_stats"})
+
+	// This keeps the metrics up to date, even if nobody asks for the stats through the admin API
+	stats, err := maintenance_controller.GetDeduplicationStats(false, ctx)
+	if err != nil {
+		ctx.Log.Error(err)
+		sentry.CaptureException(err)
+		return
+	}
+	ctx.Log.Infof("Deduplication is saving %d bytes (ratio %.2f)", stats.SavedBytes, stats.Ratio)
+}
@@ -9,7 +9,7 @@ type Generator interface {
 	supportedContentTypes() []string
 	supportsAnimation() bool
 	matches(img []byte, contentType string) bool
-	GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error)
+	GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error)
 	GetOriginDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error)
 }
 
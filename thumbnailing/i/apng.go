@@ -10,6 +10,7 @@ import (
 	"github.com/kettek/apng"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
 	"github.com/turt2live/matrix-media-repo/util"
 )
 
@@ -36,9 +37,9 @@ func (d apngGenerator) GetOriginDimensions(b []byte, contentType string, ctx rco
 	return true, i.Width, i.Height, nil
 }
 
-func (d apngGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d apngGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	if !animated {
-		return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, ctx)
+		return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, quality, ctx)
 	}
 
 	p, err := apng.DecodeAll(bytes.NewBuffer(b))
@@ -46,6 +47,11 @@ func (d apngGenerator) GenerateThumbnail(b []byte, contentType string, width int
 		return nil, errors.New("apng: error decoding image: " + err.Error())
 	}
 
+	bounds := p.Frames[0].Image.Bounds()
+	if !u.CanAnimate(len(p.Frames), bounds.Dx(), bounds.Dy(), ctx) {
+		return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, quality, ctx)
+	}
+
 	// prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(p.Frames[0].Image.Bounds())
 
@@ -12,6 +12,7 @@ import (
 	"github.com/disintegration/imaging"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
 )
 
 type gifGenerator struct {
@@ -33,12 +34,16 @@ func (d gifGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 	return pngGenerator{}.GetOriginDimensions(b, contentType, ctx)
 }
 
-func (d gifGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d gifGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	g, err := gif.DecodeAll(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, errors.New("gif: error decoding image: " + err.Error())
 	}
 
+	if animated && !u.CanAnimate(len(g.Image), g.Config.Width, g.Config.Height, ctx) {
+		animated = false
+	}
+
 	// Prepare a blank frame to use as swap space
 	frameImg := image.NewRGBA(image.Rectangle{Min: image.Point{X: 0, Y: 0}, Max: image.Point{X: g.Config.Width, Y: g.Config.Height}})
 
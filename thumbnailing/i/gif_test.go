@@ -0,0 +1,118 @@
+package i
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+func animatedGif(t *testing.T, frames int, width int, height int) []byte {
+	g := &gif.GIF{}
+	for f := 0; f < frames; f++ {
+		img := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				img.Set(x, y, color.RGBA{R: uint8(f * 60), G: uint8(x * 4), B: uint8(y * 4), A: 255})
+			}
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10*(f+1))
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGifThumbnail(t *testing.T) {
+	source := animatedGif(t, 4, 64, 48)
+
+	tests := []struct {
+		name             string
+		animated         bool
+		maxAnimateFrames int
+		maxPixels        int
+		wantAnimated     bool
+	}{
+		{name: "animated", animated: true, wantAnimated: true},
+		{name: "still frame requested", animated: false, wantAnimated: false},
+		{name: "too many frames", animated: true, maxAnimateFrames: 3, wantAnimated: false},
+		{name: "frame limit not reached", animated: true, maxAnimateFrames: 4, wantAnimated: true},
+		{name: "too many pixels", animated: true, maxPixels: 4 * 64 * 48, wantAnimated: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.MaxAnimateFrames = tt.maxAnimateFrames
+			ctx.Config.Thumbnails.MaxPixels = tt.maxPixels
+
+			thumb, err := gifGenerator{}.GenerateThumbnail(source, "image/gif", 32, 24, "scale", tt.animated, 0, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(thumb.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thumb.Animated != tt.wantAnimated {
+				t.Fatalf("got animated = %t, expected %t", thumb.Animated, tt.wantAnimated)
+			}
+
+			if !tt.wantAnimated {
+				if thumb.ContentType != "image/png" {
+					t.Errorf("got %s, expected a png still frame", thumb.ContentType)
+				}
+				img, err := png.Decode(bytes.NewReader(b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if img.Bounds().Dx() != 32 || img.Bounds().Dy() != 24 {
+					t.Errorf("got %v, expected a 32x24 thumbnail", img.Bounds())
+				}
+				return
+			}
+
+			if thumb.ContentType != "image/gif" {
+				t.Errorf("got %s, expected a gif", thumb.ContentType)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(g.Image) != 4 {
+				t.Errorf("got %d frames, expected 4", len(g.Image))
+			}
+			for i, frame := range g.Image {
+				if frame.Bounds().Dx() != 32 || frame.Bounds().Dy() != 24 {
+					t.Errorf("got frame %d as %v, expected 32x24", i, frame.Bounds())
+				}
+				if g.Delay[i] != 10*(i+1) {
+					t.Errorf("got frame %d delay %d, expected %d", i, g.Delay[i], 10*(i+1))
+				}
+			}
+			if g.Config.Width != 32 || g.Config.Height != 24 {
+				t.Errorf("got %dx%d, expected 32x24", g.Config.Width, g.Config.Height)
+			}
+		})
+	}
+}
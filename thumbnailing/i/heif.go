@@ -1,31 +1,57 @@
 package i
 
 import (
+	"errors"
+
+	"github.com/turt2live/matrix-media-repo/common"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type heifGenerator struct {
 }
 
 func (d heifGenerator) supportedContentTypes() []string {
-	return []string{"image/heif"}
+	return []string{"image/heif", "image/heic", "image/heif-sequence", "image/heic-sequence"}
 }
 
 func (d heifGenerator) supportsAnimation() bool {
-	return true
+	return false
 }
 
 func (d heifGenerator) matches(img []byte, contentType string) bool {
-	return contentType == "image/heif"
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
 }
 
 func (d heifGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
-	return pngGenerator{}.GetOriginDimensions(b, contentType, ctx)
+	// Go can't read the dimensions of HEIF images, so the decoder has to be trusted with them
+	return false, 0, 0, nil
 }
 
-func (d heifGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
-	return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, ctx)
+func (d heifGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	if !u.HeifDecoderEnabled(ctx.Config.Thumbnails.Heif) {
+		return nil, errors.New("heif: no decoder configured")
+	}
+
+	// PNG keeps any transparency, which the png generator then preserves in the thumbnail
+	png, err := u.TranscodeHeifToPng(b, ctx.Config.Thumbnails.Heif)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now that the image is decoded we can make sure it isn't too large to thumbnail
+	dimensional, w, h, err := pngGenerator{}.GetOriginDimensions(png, "image/png", ctx)
+	if err != nil {
+		return nil, errors.New("heif: error reading dimensions: " + err.Error())
+	}
+	if dimensional && util.ExceedsMaxPixels(w, h, ctx.Config.Thumbnails.MaxPixels) {
+		return nil, common.ErrImageTooLarge
+	}
+
+	// The decoder applies the orientation, so the jpg generator isn't used to avoid applying it twice
+	return pngGenerator{}.GenerateThumbnail(png, "image/png", width, height, method, false, quality, ctx)
 }
 
 func init() {
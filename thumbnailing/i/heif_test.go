@@ -0,0 +1,102 @@
+package i
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common"
+)
+
+// fixtureHeic is the start of a HEIC file: just enough for the decoder stand in to recognise it.
+var fixtureHeic = []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+
+// fakeHeifConvert writes a stand in for heif-convert which checks it was given the fixture and
+// writes a 200x300 PNG with a transparent top half. The returned path is used as the decoder's
+// binaryPath.
+func fakeHeifConvert(t *testing.T, script string) string {
+	dir := t.TempDir()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 300))
+	for x := 0; x < 200; x++ {
+		for y := 150; y < 300; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded := path.Join(dir, "decoded.png")
+	if err := ioutil.WriteFile(decoded, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if script == "" {
+		// Called as: heif-convert input.heic output.png
+		script = "grep -q ftypheic \"$1\" || exit 1\ncp " + decoded + " \"$2\""
+	}
+	binary := path.Join(dir, "heif-convert")
+	if err := ioutil.WriteFile(binary, []byte("#!/bin/sh\n"+script+"\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestHeifThumbnail(t *testing.T) {
+	tests := []struct {
+		name        string
+		decoder     string
+		script      string
+		maxPixels   int
+		wantErr     bool
+		expectedErr error
+	}{
+		{name: "decoded", decoder: "heif-convert"},
+		{name: "no decoder", decoder: "", wantErr: true},
+		{name: "decoder fails", decoder: "heif-convert", script: "exit 1", wantErr: true},
+		{name: "decoder times out", decoder: "heif-convert", script: "exec sleep 5", wantErr: true},
+		{name: "decoded image too large", decoder: "heif-convert", maxPixels: 1000, wantErr: true, expectedErr: common.ErrImageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := testContext()
+			ctx.Config.Thumbnails.Heif.Decoder = tt.decoder
+			ctx.Config.Thumbnails.Heif.BinaryPath = fakeHeifConvert(t, tt.script)
+			ctx.Config.Thumbnails.Heif.TimeoutSeconds = 1
+			ctx.Config.Thumbnails.MaxPixels = tt.maxPixels
+
+			thumb, err := heifGenerator{}.GenerateThumbnail(fixtureHeic, "image/heic", 100, 100, "scale", false, 0, ctx)
+			if tt.wantErr {
+				if err == nil || (tt.expectedErr != nil && err != tt.expectedErr) {
+					t.Errorf("got error %v, expected an error (%v)", err, tt.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if thumb.ContentType != "image/png" || thumb.Animated {
+				t.Errorf("got %s (animated = %t), expected a static png", thumb.ContentType, thumb.Animated)
+			}
+			img, err := png.Decode(thumb.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Dx() != 66 || img.Bounds().Dy() != 100 {
+				t.Errorf("got %v, expected a 66x100 thumbnail", img.Bounds())
+			}
+			if _, _, _, a := img.At(33, 10).RGBA(); a != 0 {
+				t.Errorf("got alpha %d, expected the transparent area to stay transparent", a)
+			}
+			if r, g, b, a := img.At(33, 90).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+				t.Errorf("got (%d, %d, %d, %d), expected the opaque area to stay white", r, g, b, a)
+			}
+		})
+	}
+}
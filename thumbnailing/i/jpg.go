@@ -32,7 +32,7 @@ func (d jpgGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 	return pngGenerator{}.GetOriginDimensions(b, contentType, ctx)
 }
 
-func (d jpgGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d jpgGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	src, err := imaging.Decode(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, errors.New("jpg: error decoding thumbnail: " + err.Error())
@@ -55,7 +55,11 @@ func (d jpgGenerator) GenerateThumbnail(b []byte, contentType string, width int,
 	}
 
 	imgData := &bytes.Buffer{}
-	err = imaging.Encode(imgData, thumb, imaging.JPEG)
+	opts := make([]imaging.EncodeOption, 0)
+	if quality > 0 {
+		opts = append(opts, imaging.JPEGQuality(quality))
+	}
+	err = imaging.Encode(imgData, thumb, imaging.JPEG, opts...)
 	if err != nil {
 		return nil, errors.New("jpg: error encoding thumbnail: " + err.Error())
 	}
@@ -50,7 +50,7 @@ func (d mp3Generator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 	return false, 0, 0, nil
 }
 
-func (d mp3Generator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d mp3Generator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	audio, format, err := d.decode(b)
 	if err != nil {
 		return nil, err
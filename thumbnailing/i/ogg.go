@@ -38,7 +38,7 @@ func (d oggGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 	return false, 0, 0, nil
 }
 
-func (d oggGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d oggGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	audio, format, err := d.decode(b)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,123 @@
+package i
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// pdfRenderer renders the first page of a PDF to a PNG using an external program.
+type pdfRenderer interface {
+	defaultBinary() string
+	renderFirstPage(ctx context.Context, binary string, pdfFile string, pngFile string) error
+}
+
+type pdftoppmRenderer struct {
+}
+
+func (r pdftoppmRenderer) defaultBinary() string {
+	return "pdftoppm"
+}
+
+func (r pdftoppmRenderer) renderFirstPage(ctx context.Context, binary string, pdfFile string, pngFile string) error {
+	// pdftoppm appends the extension itself when using -singlefile
+	outPrefix := pngFile[:len(pngFile)-len(path.Ext(pngFile))]
+	return exec.CommandContext(ctx, binary, "-f", "1", "-l", "1", "-singlefile", "-png", pdfFile, outPrefix).Run()
+}
+
+type mutoolRenderer struct {
+}
+
+func (r mutoolRenderer) defaultBinary() string {
+	return "mutool"
+}
+
+func (r mutoolRenderer) renderFirstPage(ctx context.Context, binary string, pdfFile string, pngFile string) error {
+	return exec.CommandContext(ctx, binary, "draw", "-F", "png", "-o", pngFile, pdfFile, "1").Run()
+}
+
+var pdfRenderers = map[string]pdfRenderer{
+	"pdftoppm": pdftoppmRenderer{},
+	"mutool":   mutoolRenderer{},
+}
+
+type pdfGenerator struct {
+}
+
+func (d pdfGenerator) supportedContentTypes() []string {
+	return []string{"application/pdf"}
+}
+
+func (d pdfGenerator) supportsAnimation() bool {
+	return false
+}
+
+func (d pdfGenerator) matches(img []byte, contentType string) bool {
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
+}
+
+func (d pdfGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	return false, 0, 0, nil
+}
+
+func (d pdfGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	renderer, ok := pdfRenderers[ctx.Config.Thumbnails.Pdf.Renderer]
+	if !ok {
+		return nil, errors.New("pdf: no known renderer configured")
+	}
+	binary := ctx.Config.Thumbnails.Pdf.BinaryPath
+	if binary == "" {
+		binary = renderer.defaultBinary()
+	}
+
+	key, err := util.GenerateRandomString(16)
+	if err != nil {
+		return nil, errors.New("pdf: error generating temp key: " + err.Error())
+	}
+
+	tempFile1 := path.Join(os.TempDir(), "media_repo."+key+".1.pdf")
+	tempFile2 := path.Join(os.TempDir(), "media_repo."+key+".2.png")
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+
+	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.New("pdf: error writing temp pdf file: " + err.Error())
+	}
+	_, err = f.Write(b)
+	cleanup.DumpAndCloseStream(f)
+	if err != nil {
+		return nil, errors.New("pdf: error writing temp pdf file: " + err.Error())
+	}
+
+	// Malicious PDFs can keep the renderer busy forever, so don't wait on it for too long
+	timeout := time.Duration(ctx.Config.Thumbnails.Pdf.TimeoutSeconds) * time.Second
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = renderer.renderFirstPage(runCtx, binary, tempFile1, tempFile2)
+	if err != nil {
+		return nil, errors.New("pdf: error rendering pdf file: " + err.Error())
+	}
+
+	b, err = ioutil.ReadFile(tempFile2)
+	if err != nil {
+		return nil, errors.New("pdf: error reading temp png file: " + err.Error())
+	}
+
+	return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, quality, ctx)
+}
+
+func init() {
+	generators = append(generators, pdfGenerator{})
+}
@@ -0,0 +1,113 @@
+package i
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+const fixturePdf = "%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 200 300] >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n"
+
+// stubRenderer pretends to render a 200x300 page, like the fixture PDF describes.
+type stubRenderer struct {
+	err      error
+	rendered []byte
+	binary   string
+}
+
+func (r *stubRenderer) defaultBinary() string {
+	return "stub"
+}
+
+func (r *stubRenderer) renderFirstPage(ctx context.Context, binary string, pdfFile string, pngFile string) error {
+	r.binary = binary
+	if r.err != nil {
+		return r.err
+	}
+	if binary == "slow" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	b, err := ioutil.ReadFile(pdfFile)
+	if err != nil {
+		return err
+	}
+	r.rendered = b
+
+	img := image.NewRGBA(image.Rect(0, 0, 200, 300))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 300; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err = png.Encode(buf, img); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pngFile, buf.Bytes(), 0640)
+}
+
+func TestPdfThumbnail(t *testing.T) {
+	tests := []struct {
+		name       string
+		renderer   string
+		binaryPath string
+		err        error
+		wantErr    bool
+		wantBinary string
+	}{
+		{name: "rendered", renderer: "stub", wantBinary: "stub"},
+		{name: "configured binary", renderer: "stub", binaryPath: "/opt/stub", wantBinary: "/opt/stub"},
+		{name: "no renderer", renderer: "", wantErr: true},
+		{name: "unknown renderer", renderer: "ghostscript", wantErr: true},
+		{name: "renderer fails", renderer: "stub", err: errors.New("exit status 1"), wantErr: true, wantBinary: "stub"},
+		{name: "renderer times out", renderer: "stub", binaryPath: "slow", wantErr: true, wantBinary: "slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubRenderer{err: tt.err}
+			pdfRenderers["stub"] = stub
+			defer delete(pdfRenderers, "stub")
+
+			ctx := testContext()
+			ctx.Config.Thumbnails.Pdf.Renderer = tt.renderer
+			ctx.Config.Thumbnails.Pdf.BinaryPath = tt.binaryPath
+			ctx.Config.Thumbnails.Pdf.TimeoutSeconds = 1
+
+			thumb, err := pdfGenerator{}.GenerateThumbnail([]byte(fixturePdf), "application/pdf", 100, 100, "scale", false, 0, ctx)
+			if stub.binary != tt.wantBinary {
+				t.Errorf("got renderer binary %q, expected %q", stub.binary, tt.wantBinary)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(stub.rendered) != fixturePdf {
+				t.Error("expected the renderer to be given the pdf")
+			}
+			if thumb.ContentType != "image/png" || thumb.Animated {
+				t.Errorf("got %s (animated = %t), expected a static png", thumb.ContentType, thumb.Animated)
+			}
+			img, err := png.Decode(thumb.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Scaling keeps the aspect ratio of the page
+			if img.Bounds().Dx() != 66 || img.Bounds().Dy() != 100 {
+				t.Errorf("got %v, expected a 66x100 thumbnail", img.Bounds())
+			}
+		})
+	}
+}
@@ -4,13 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"image"
-	_ "image/png"
 	"io/ioutil"
 
 	"github.com/disintegration/imaging"
 	"github.com/turt2live/matrix-media-repo/common/rcontext"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
 	"github.com/turt2live/matrix-media-repo/thumbnailing/u"
+	"github.com/turt2live/matrix-media-repo/util"
 )
 
 type pngGenerator struct {
@@ -29,14 +29,14 @@ func (d pngGenerator) matches(img []byte, contentType string) bool {
 }
 
 func (d pngGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
-	i, _, err := image.DecodeConfig(bytes.NewBuffer(b))
+	w, h, err := util.GetImageDimensions(b)
 	if err != nil {
 		return false, 0, 0, err
 	}
-	return true, i.Width, i.Height, nil
+	return true, w, h, nil
 }
 
-func (d pngGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d pngGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	src, err := imaging.Decode(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, errors.New("png: error decoding thumbnail: " + err.Error())
@@ -0,0 +1,42 @@
+package i
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestPngThumbnailKeepsTransparency(t *testing.T) {
+	// A transparent image with an opaque red square in the middle
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	for x := 50; x < 150; x++ {
+		for y := 50; y < 150; y++ {
+			img.Set(x, y, color.NRGBA{R: 0xff, A: 0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, err := pngGenerator{}.GenerateThumbnail(buf.Bytes(), "image/png", 100, 100, "scale", false, 0, testContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.ContentType != "image/png" {
+		t.Errorf("got %s, expected image/png", thumb.ContentType)
+	}
+	decoded, err := png.Decode(thumb.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, a := decoded.At(5, 5).RGBA(); a != 0 {
+		t.Errorf("got alpha %d in the corner, expected it to stay transparent rather than turn black", a)
+	}
+	if r, g, b, a := decoded.At(50, 50).RGBA(); r != 0xffff || g != 0 || b != 0 || a != 0xffff {
+		t.Errorf("got (%d, %d, %d, %d) in the middle, expected opaque red", r, g, b, a)
+	}
+}
@@ -32,7 +32,7 @@ func (d svgGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcon
 	return false, 0, 0, nil
 }
 
-func (d svgGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d svgGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	key, err := util.GenerateRandomString(16)
 	if err != nil {
 		return nil, errors.New("svg: error generating temp key: " + err.Error())
@@ -61,7 +61,7 @@ func (d svgGenerator) GenerateThumbnail(b []byte, contentType string, width int,
 		return nil, errors.New("svg: error reading temp png file: " + err.Error())
 	}
 
-	return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, ctx)
+	return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, quality, ctx)
 }
 
 func init() {
@@ -0,0 +1,126 @@
+package i
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"github.com/turt2live/matrix-media-repo/thumbnailing/m"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// Extracted frames are kept for a little while so that generating several sizes of thumbnail
+// for the same video doesn't need ffmpeg to run each time.
+var videoFrameCache = cache.New(5*time.Minute, 10*time.Minute)
+
+type videoGenerator struct {
+}
+
+func (d videoGenerator) supportedContentTypes() []string {
+	return []string{"video/mp4", "video/webm", "video/quicktime", "video/x-matroska", "video/ogg"}
+}
+
+func (d videoGenerator) supportsAnimation() bool {
+	return false
+}
+
+func (d videoGenerator) matches(img []byte, contentType string) bool {
+	return util.ArrayContains(d.supportedContentTypes(), contentType)
+}
+
+func (d videoGenerator) GetOriginDimensions(b []byte, contentType string, ctx rcontext.RequestContext) (bool, int, int, error) {
+	return false, 0, 0, nil
+}
+
+func (d videoGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+	// MP4 thumbnails have always been available, so only the other video types need enabling
+	if !ctx.Config.Thumbnails.Video.Enabled && contentType != "video/mp4" {
+		return nil, errors.New("video: video thumbnails are not enabled")
+	}
+
+	hash := sha256.Sum256(b)
+	cacheKey := hex.EncodeToString(hash[:])
+	if frame, found := videoFrameCache.Get(cacheKey); found {
+		ctx.Log.Info("Using cached frame from video")
+		return pngGenerator{}.GenerateThumbnail(frame.([]byte), "image/png", width, height, method, false, quality, ctx)
+	}
+
+	key, err := util.GenerateRandomString(16)
+	if err != nil {
+		return nil, errors.New("video: error generating temp key: " + err.Error())
+	}
+
+	tempFile1 := path.Join(os.TempDir(), "media_repo."+key+".1.video")
+	tempFile2 := path.Join(os.TempDir(), "media_repo."+key+".2.png")
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+
+	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.New("video: error writing temp video file: " + err.Error())
+	}
+	_, err = f.Write(b)
+	cleanup.DumpAndCloseStream(f)
+	if err != nil {
+		return nil, errors.New("video: error writing temp video file: " + err.Error())
+	}
+
+	timeout := time.Duration(ctx.Config.Thumbnails.Video.TimeoutSeconds) * time.Second
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Try to pick a frame a little way into the video, as the first frame is often black
+	offset := 0.0
+	duration, err := probeVideoDuration(runCtx, tempFile1, ctx)
+	if err != nil {
+		ctx.Log.Warn("Error determining video duration, using first frame: ", err)
+	} else {
+		offset = duration * 0.1
+	}
+
+	ffmpeg := ctx.Config.Thumbnails.Video.FfmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	err = exec.CommandContext(runCtx, ffmpeg, "-ss", fmt.Sprintf("%.3f", offset), "-i", tempFile1, "-frames:v", "1", tempFile2).Run()
+	if err != nil {
+		return nil, errors.New("video: error converting video file: " + err.Error())
+	}
+
+	b, err = ioutil.ReadFile(tempFile2)
+	if err != nil {
+		return nil, errors.New("video: error reading temp png file: " + err.Error())
+	}
+
+	videoFrameCache.Set(cacheKey, b, cache.DefaultExpiration)
+	return pngGenerator{}.GenerateThumbnail(b, "image/png", width, height, method, false, quality, ctx)
+}
+
+func probeVideoDuration(runCtx context.Context, file string, ctx rcontext.RequestContext) (float64, error) {
+	ffprobe := ctx.Config.Thumbnails.Video.FfprobePath
+	if ffprobe == "" {
+		ffprobe = "ffprobe"
+	}
+	out, err := exec.CommandContext(runCtx, ffprobe, "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", file).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+func init() {
+	generators = append(generators, videoGenerator{})
+}
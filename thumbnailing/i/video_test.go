@@ -0,0 +1,122 @@
+package i
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Stand-ins for ffprobe and ffmpeg: the video is 10 seconds long, and every frame
+// is the same 320x240 png. Each run of ffmpeg records its arguments in a log file.
+const stubFfprobe = "#!/bin/sh\necho 10.0\n"
+const stubFfmpeg = "#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/ffmpeg.log\"\nfor last; do true; done\ncp \"$(dirname \"$0\")/frame.png\" \"$last\"\n"
+
+// fixtureVideo is only ever read by the stubbed ffmpeg, so it doesn't need to be a real video.
+var fixtureVideo = []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+
+func stubVideoTools(t *testing.T) string {
+	dir := t.TempDir()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 320, 240))); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"ffprobe":   []byte(stubFfprobe),
+		"ffmpeg":    []byte(stubFfmpeg),
+		"frame.png": buf.Bytes(),
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), b, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func ffmpegRuns(t *testing.T, dir string) []string {
+	b, err := ioutil.ReadFile(path.Join(dir, "ffmpeg.log"))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestVideoThumbnail(t *testing.T) {
+	dir := stubVideoTools(t)
+	videoFrameCache.Flush()
+	defer videoFrameCache.Flush()
+
+	ctx := testContext()
+	ctx.Config.Thumbnails.Video.Enabled = true
+	ctx.Config.Thumbnails.Video.FfmpegPath = path.Join(dir, "ffmpeg")
+	ctx.Config.Thumbnails.Video.FfprobePath = path.Join(dir, "ffprobe")
+	ctx.Config.Thumbnails.Video.TimeoutSeconds = 10
+
+	sizes := []struct {
+		width  int
+		height int
+	}{{96, 96}, {32, 32}}
+	for _, size := range sizes {
+		thumb, err := videoGenerator{}.GenerateThumbnail(fixtureVideo, "video/webm", size.width, size.height, "scale", false, 0, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumb.ContentType != "image/png" {
+			t.Errorf("got %s, expected image/png", thumb.ContentType)
+		}
+		cfg, err := png.DecodeConfig(thumb.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != size.width || cfg.Height != size.width*3/4 {
+			t.Errorf("got %dx%d, expected %dx%d", cfg.Width, cfg.Height, size.width, size.width*3/4)
+		}
+	}
+
+	runs := ffmpegRuns(t, dir)
+	if len(runs) != 1 {
+		t.Fatalf("expected ffmpeg to run once for both sizes, ran %d times", len(runs))
+	}
+	if !strings.HasPrefix(runs[0], "-ss 1.000 -i ") || !strings.Contains(runs[0], " -frames:v 1 ") {
+		t.Errorf("expected a single frame at 10%% of the duration, got arguments %q", runs[0])
+	}
+}
+
+func TestVideoThumbnailFallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		ffmpeg      string
+		contentType string
+	}{
+		{name: "disabled", enabled: false, ffmpeg: "ffmpeg", contentType: "video/webm"},
+		{name: "missing ffmpeg", enabled: true, ffmpeg: "missing", contentType: "video/webm"},
+		{name: "missing ffmpeg for mp4", enabled: false, ffmpeg: "missing", contentType: "video/mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := stubVideoTools(t)
+			videoFrameCache.Flush()
+			defer videoFrameCache.Flush()
+
+			ctx := testContext()
+			ctx.Config.Thumbnails.Video.Enabled = tt.enabled
+			ctx.Config.Thumbnails.Video.FfmpegPath = path.Join(dir, tt.ffmpeg)
+			// A missing ffprobe only means the first frame gets used
+			ctx.Config.Thumbnails.Video.FfprobePath = path.Join(dir, "missing")
+			ctx.Config.Thumbnails.Video.TimeoutSeconds = 10
+
+			thumb, err := videoGenerator{}.GenerateThumbnail(fixtureVideo, tt.contentType, 96, 96, "scale", false, 0, ctx)
+			if err == nil || thumb != nil {
+				t.Error("expected an error and no thumbnail")
+			}
+			if len(ffmpegRuns(t, dir)) != 0 {
+				t.Error("expected ffmpeg not to run")
+			}
+		})
+	}
+}
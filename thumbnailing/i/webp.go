@@ -31,7 +31,7 @@ func (d webpGenerator) GetOriginDimensions(b []byte, contentType string, ctx rco
 	return true, i.Width, i.Height, nil
 }
 
-func (d webpGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func (d webpGenerator) GenerateThumbnail(b []byte, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	src, err := webp.Decode(bytes.NewBuffer(b))
 	if err != nil {
 		return nil, errors.New("webp: error decoding thumbnail: " + err.Error())
@@ -24,7 +24,7 @@ func IsAnimationSupported(contentType string) bool {
 	return util.ArrayContains(i.GetSupportedAnimationTypes(), contentType)
 }
 
-func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
+func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, height int, method string, animated bool, quality int, ctx rcontext.RequestContext) (*m.Thumbnail, error) {
 	if !IsSupported(contentType) {
 		return nil, ErrUnsupported
 	}
@@ -47,11 +47,12 @@ func GenerateThumbnail(imgStream io.ReadCloser, contentType string, width int, h
 	if err != nil {
 		return nil, err
 	}
-	if dimensional && (w * h) >= ctx.Config.Thumbnails.MaxPixels {
-		return nil, common.ErrMediaTooLarge
+	if dimensional && util.ExceedsMaxPixels(w, h, ctx.Config.Thumbnails.MaxPixels) {
+		ctx.Log.Warnf("Image declares dimensions of %dx%d, which is more than the maximum of %d pixels - refusing to decode", w, h, ctx.Config.Thumbnails.MaxPixels)
+		return nil, common.ErrImageTooLarge
 	}
 
-	return generator.GenerateThumbnail(b, contentType, width, height, method, animated, ctx)
+	return generator.GenerateThumbnail(b, contentType, width, height, method, animated, quality, ctx)
 }
 
 func GetGenerator(imgStream io.ReadCloser, contentType string, animated bool) (i.Generator, error) {
@@ -0,0 +1,62 @@
+package thumbnailing
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+func testContext() rcontext.RequestContext {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return rcontext.RequestContext{
+		Context: context.Background(),
+		Log:     logrus.NewEntry(logger),
+	}
+}
+
+// pngBomb builds a PNG header claiming 100000x100000 pixels without the pixel data to back it up.
+func pngBomb() []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:8], 100000)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // truecolour
+
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(ihdr)))
+	copy(chunk[4:8], "IHDR")
+	chunk = append(chunk, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	return append([]byte("\x89PNG\r\n\x1a\n"), chunk...)
+}
+
+func TestGenerateThumbnailDecompressionBomb(t *testing.T) {
+	ctx := testContext()
+	ctx.Config.Thumbnails.MaxPixels = 32000000
+
+	before := &runtime.MemStats{}
+	runtime.ReadMemStats(before)
+	_, err := GenerateThumbnail(ioutil.NopCloser(bytes.NewReader(pngBomb())), "image/png", 320, 240, "scale", false, 0, ctx)
+	after := &runtime.MemStats{}
+	runtime.ReadMemStats(after)
+
+	if err != common.ErrImageTooLarge {
+		t.Fatalf("got error %v, expected %v", err, common.ErrImageTooLarge)
+	}
+	// Decoding the image would need tens of gigabytes, so anything close to that means it was decoded
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 10*1024*1024 {
+		t.Errorf("allocated %d bytes rejecting the image, expected it to be rejected from the header alone", allocated)
+	}
+}
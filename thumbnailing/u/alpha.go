@@ -0,0 +1,44 @@
+package u
+
+import (
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// HasAlpha determines if any part of the image is transparent.
+func HasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Flatten composites the image onto a solid background, for formats which can't store transparency.
+// Without this, transparent areas usually turn black.
+func Flatten(img image.Image, background color.Color) image.Image {
+	bg := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), background)
+	return imaging.Overlay(bg, img, image.Pt(0, 0), 1.0)
+}
+
+// ParseBackgroundColor parses a hex color like "#ffffff", as used by the thumbnails.backgroundColor
+// config option. White is returned if the color can't be parsed.
+func ParseBackgroundColor(hex string) color.Color {
+	v, err := strconv.ParseUint(strings.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil || len(hex) != 7 {
+		return color.White
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
@@ -0,0 +1,98 @@
+package u
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestHasAlpha(t *testing.T) {
+	opaque := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			opaque.Set(x, y, color.NRGBA{R: 10, G: 20, B: 30, A: 0xff})
+		}
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	partial := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			partial.Set(x, y, color.NRGBA{A: 0xff})
+		}
+	}
+	partial.Set(3, 3, color.NRGBA{A: 0x80})
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		expected bool
+	}{
+		{name: "opaque", img: opaque, expected: false},
+		{name: "transparent", img: transparent, expected: true},
+		{name: "one translucent pixel", img: partial, expected: true},
+		{name: "grayscale", img: gray, expected: false},
+		{name: "uniform opaque", img: image.NewUniform(color.Black), expected: false},
+		{name: "uniform transparent", img: image.NewUniform(color.Transparent), expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hasAlpha := HasAlpha(tt.img)
+			if hasAlpha != tt.expected {
+				t.Errorf("got %t, expected %t", hasAlpha, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+	// The second pixel is left fully transparent
+
+	tests := []struct {
+		name          string
+		background    color.Color
+		expectedColor color.NRGBA
+	}{
+		{name: "white", background: color.White, expectedColor: color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{name: "blue", background: color.NRGBA{B: 0xff, A: 0xff}, expectedColor: color.NRGBA{B: 0xff, A: 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flattened := Flatten(img, tt.background)
+			if HasAlpha(flattened) {
+				t.Error("got a transparent image, expected it to be flattened")
+			}
+			if c := color.NRGBAModel.Convert(flattened.At(0, 0)); c != (color.NRGBA{R: 0xff, A: 0xff}) {
+				t.Errorf("got %v for the opaque pixel, expected it to be unchanged", c)
+			}
+			if c := color.NRGBAModel.Convert(flattened.At(1, 0)); c != tt.expectedColor {
+				t.Errorf("got %v for the transparent pixel, expected %v", c, tt.expectedColor)
+			}
+		})
+	}
+}
+
+func TestParseBackgroundColor(t *testing.T) {
+	tests := []struct {
+		hex      string
+		expected color.Color
+	}{
+		{hex: "#ffffff", expected: color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{hex: "#1a2B3c", expected: color.NRGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff}},
+		{hex: "#000000", expected: color.NRGBA{A: 0xff}},
+		{hex: "#fff", expected: color.White},
+		{hex: "ffffff", expected: color.White},
+		{hex: "#gggggg", expected: color.White},
+		{hex: "", expected: color.White},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hex, func(t *testing.T) {
+			c := ParseBackgroundColor(tt.hex)
+			if c != tt.expected {
+				t.Errorf("got %v, expected %v", c, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package u
+
+import (
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+)
+
+// CanAnimate determines if an animation is within the configured limits for producing an animated
+// thumbnail. Animations outside of the limits should be thumbnailed as a still frame instead.
+func CanAnimate(numFrames int, width int, height int, ctx rcontext.RequestContext) bool {
+	if ctx.Config.Thumbnails.MaxAnimateFrames > 0 && numFrames > ctx.Config.Thumbnails.MaxAnimateFrames {
+		ctx.Log.Warnf("Animation has %d frames, which is more than the maximum of %d", numFrames, ctx.Config.Thumbnails.MaxAnimateFrames)
+		return false
+	}
+
+	// Every frame is rendered at full size, so treat the pixel limit as a budget for the whole animation
+	if ctx.Config.Thumbnails.MaxPixels > 0 && int64(numFrames)*int64(width)*int64(height) >= int64(ctx.Config.Thumbnails.MaxPixels) {
+		ctx.Log.Warnf("Animation has %d frames of %dx%d, which is more than the maximum of %d pixels", numFrames, width, height, ctx.Config.Thumbnails.MaxPixels)
+		return false
+	}
+
+	return true
+}
@@ -4,9 +4,12 @@ import (
 	"image"
 )
 
+// AdjustProperties determines whether the image needs thumbnailing and at which size. Images which
+// already fit within the desired size are never scaled up, regardless of method.
 func AdjustProperties(img image.Image, desiredWidth int, desiredHeight int, wantAnimated bool, canAnimate bool, method string) (bool, int, int, bool, string) {
-	srcWidth := img.Bounds().Max.X
-	srcHeight := img.Bounds().Max.Y
+	// Bounds don't always start at the origin (such as for sub-images), so measure rather than using Max
+	srcWidth := img.Bounds().Dx()
+	srcHeight := img.Bounds().Dy()
 
 	aspectRatio := float32(srcHeight) / float32(srcWidth)
 	targetAspectRatio := float32(desiredHeight) / float32(desiredWidth)
@@ -0,0 +1,40 @@
+package u
+
+import (
+	"image"
+	"testing"
+)
+
+func TestAdjustProperties(t *testing.T) {
+	full := image.NewRGBA(image.Rect(0, 0, 1000, 1000))
+
+	tests := []struct {
+		name           string
+		img            image.Image
+		width          int
+		height         int
+		animated       bool
+		canAnimate     bool
+		expectedShould bool
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "larger source", img: image.NewRGBA(image.Rect(0, 0, 1000, 200)), width: 96, height: 96, expectedShould: true, expectedWidth: 96, expectedHeight: 96},
+		{name: "source fits", img: image.NewRGBA(image.Rect(0, 0, 50, 50)), width: 96, height: 96, expectedShould: false},
+		{name: "source fits but animated", img: image.NewRGBA(image.Rect(0, 0, 50, 50)), width: 96, height: 96, animated: true, expectedShould: true, expectedWidth: 50, expectedHeight: 50},
+		// A sub-image's bounds don't start at the origin, so Max would make it look 950x950
+		{name: "small sub-image", img: full.SubImage(image.Rect(900, 900, 950, 950)), width: 96, height: 96, expectedShould: false},
+		{name: "large sub-image", img: full.SubImage(image.Rect(100, 100, 600, 300)), width: 96, height: 96, expectedShould: true, expectedWidth: 96, expectedHeight: 96},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			should, width, height, _, _ := AdjustProperties(tt.img, tt.width, tt.height, tt.animated, tt.canAnimate, "scale")
+			if should != tt.expectedShould {
+				t.Fatalf("got should thumbnail = %t, expected %t", should, tt.expectedShould)
+			}
+			if should && (width != tt.expectedWidth || height != tt.expectedHeight) {
+				t.Errorf("got %dx%d, expected %dx%d", width, height, tt.expectedWidth, tt.expectedHeight)
+			}
+		})
+	}
+}
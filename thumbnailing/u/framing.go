@@ -12,6 +12,9 @@ import (
 	"github.com/turt2live/matrix-media-repo/util/util_exif"
 )
 
+// MakeThumbnail resizes the image with the given method, as defined by the Matrix spec. The scale
+// method fits the image within the box while preserving its aspect ratio, never scaling it up. The
+// crop method fills the box exactly, cropping whatever doesn't fit around the center.
 func MakeThumbnail(src image.Image, method string, width int, height int) (image.Image, error) {
 	var result image.Image
 	if method == "scale" {
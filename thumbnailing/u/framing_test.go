@@ -0,0 +1,73 @@
+package u
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+var (
+	edgeColour   = color.RGBA{B: 255, A: 255}
+	middleColour = color.RGBA{R: 255, A: 255}
+)
+
+// isColour compares colours loosely, as resizing blends neighbouring pixels together
+func isColour(c color.Color, expected color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	near := func(v uint32, e uint8) bool {
+		d := int(v>>8) - int(e)
+		return d > -32 && d < 32
+	}
+	return near(r, expected.R) && near(g, expected.G) && near(b, expected.B)
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	// The middle of a wide source is a different colour to its ends, so crops show which part was kept
+	src := image.NewRGBA(image.Rect(0, 0, 1000, 200))
+	draw.Draw(src, src.Bounds(), &image.Uniform{C: edgeColour}, image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(350, 0, 650, 200), &image.Uniform{C: middleColour}, image.Point{}, draw.Src)
+
+	tests := []struct {
+		name           string
+		method         string
+		width          int
+		height         int
+		expectedWidth  int
+		expectedHeight int
+		expectedCorner color.RGBA
+		wantErr        bool
+	}{
+		{name: "crop", method: "crop", width: 96, height: 96, expectedWidth: 96, expectedHeight: 96, expectedCorner: middleColour},
+		{name: "scale", method: "scale", width: 96, height: 96, expectedWidth: 96, expectedHeight: 19, expectedCorner: edgeColour},
+		{name: "scale larger than source", method: "scale", width: 2000, height: 2000, expectedWidth: 1000, expectedHeight: 200, expectedCorner: edgeColour},
+		{name: "unknown method", method: "stretch", width: 96, height: 96, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thumb, err := MakeThumbnail(src, tt.method, tt.width, tt.height)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			b := thumb.Bounds()
+			if b.Dx() != tt.expectedWidth || b.Dy() != tt.expectedHeight {
+				t.Fatalf("got a %dx%d thumbnail, expected %dx%d", b.Dx(), b.Dy(), tt.expectedWidth, tt.expectedHeight)
+			}
+
+			// Every method keeps the middle of the source in the middle of the thumbnail
+			center := image.Pt(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2)
+			if c := thumb.At(center.X, center.Y); !isColour(c, middleColour) {
+				t.Errorf("got %v in the middle, expected %v", c, middleColour)
+			}
+			corners := []image.Point{b.Min, image.Pt(b.Max.X-1, b.Min.Y), image.Pt(b.Min.X, b.Max.Y-1), b.Max.Sub(image.Pt(1, 1))}
+			for _, p := range corners {
+				if c := thumb.At(p.X, p.Y); !isColour(c, tt.expectedCorner) {
+					t.Errorf("got %v at %v, expected %v", c, p, tt.expectedCorner)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package u
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+)
+
+// heifDecoder converts a HEIF/HEIC file to a PNG using an external program. PNG is used so
+// that transparency is kept.
+type heifDecoder interface {
+	defaultBinary() string
+	convertToPng(ctx context.Context, binary string, heifFile string, pngFile string) error
+}
+
+type heifConvertDecoder struct {
+}
+
+func (d heifConvertDecoder) defaultBinary() string {
+	return "heif-convert"
+}
+
+func (d heifConvertDecoder) convertToPng(ctx context.Context, binary string, heifFile string, pngFile string) error {
+	// The output format is picked from the file extension
+	return exec.CommandContext(ctx, binary, heifFile, pngFile).Run()
+}
+
+type imagemagickHeifDecoder struct {
+}
+
+func (d imagemagickHeifDecoder) defaultBinary() string {
+	return "convert"
+}
+
+func (d imagemagickHeifDecoder) convertToPng(ctx context.Context, binary string, heifFile string, pngFile string) error {
+	// Only the primary image is converted, as multi-image files would otherwise produce several files
+	return exec.CommandContext(ctx, binary, heifFile+"[0]", "-auto-orient", "png:"+pngFile).Run()
+}
+
+var heifDecoders = map[string]heifDecoder{
+	"heif-convert": heifConvertDecoder{},
+	"imagemagick":  imagemagickHeifDecoder{},
+}
+
+// IsHeifContentType determines if the content type is one of the HEIF/HEIC image types.
+func IsHeifContentType(contentType string) bool {
+	return util.ArrayContains([]string{"image/heif", "image/heic", "image/heif-sequence", "image/heic-sequence"}, contentType)
+}
+
+// HeifDecoderEnabled determines if a known decoder is configured for HEIF/HEIC images.
+func HeifDecoderEnabled(conf config.HeifConfig) bool {
+	_, ok := heifDecoders[conf.Decoder]
+	return ok
+}
+
+// TranscodeHeifToPng converts a HEIF/HEIC image to a PNG with the configured decoder.
+func TranscodeHeifToPng(b []byte, conf config.HeifConfig) ([]byte, error) {
+	decoder, ok := heifDecoders[conf.Decoder]
+	if !ok {
+		return nil, errors.New("heif: no known decoder configured")
+	}
+	binary := conf.BinaryPath
+	if binary == "" {
+		binary = decoder.defaultBinary()
+	}
+
+	key, err := util.GenerateRandomString(16)
+	if err != nil {
+		return nil, errors.New("heif: error generating temp key: " + err.Error())
+	}
+
+	tempFile1 := path.Join(os.TempDir(), "media_repo."+key+".1.heic")
+	tempFile2 := path.Join(os.TempDir(), "media_repo."+key+".2.png")
+
+	defer os.Remove(tempFile1)
+	defer os.Remove(tempFile2)
+
+	f, err := os.OpenFile(tempFile1, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.New("heif: error writing temp heif file: " + err.Error())
+	}
+	_, err = f.Write(b)
+	cleanup.DumpAndCloseStream(f)
+	if err != nil {
+		return nil, errors.New("heif: error writing temp heif file: " + err.Error())
+	}
+
+	// Don't let a malformed file keep the decoder busy forever
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	err = decoder.convertToPng(ctx, binary, tempFile1, tempFile2)
+	if err != nil {
+		return nil, errors.New("heif: error converting heif file: " + err.Error())
+	}
+
+	b, err = ioutil.ReadFile(tempFile2)
+	if err != nil {
+		return nil, errors.New("heif: error reading temp png file: " + err.Error())
+	}
+	return b, nil
+}
+
+// TranscodeHeifToJpeg converts a HEIF/HEIC image to a JPEG with the configured decoder. As JPEGs
+// can't be transparent, transparent images are composited onto the background color.
+func TranscodeHeifToJpeg(b []byte, conf config.HeifConfig, background color.Color) ([]byte, error) {
+	png, err := TranscodeHeifToPng(b, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(png))
+	if err != nil {
+		return nil, errors.New("heif: error decoding converted image: " + err.Error())
+	}
+	if HasAlpha(img) {
+		img = Flatten(img, background)
+	}
+
+	out := &bytes.Buffer{}
+	err = imaging.Encode(out, img, imaging.JPEG, imaging.JPEGQuality(90))
+	if err != nil {
+		return nil, errors.New("heif: error encoding jpeg: " + err.Error())
+	}
+	return out.Bytes(), nil
+}
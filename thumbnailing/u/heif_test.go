@@ -0,0 +1,72 @@
+package u
+
+import (
+	"image/color"
+	"path"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func TestIsHeifContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "image/heif", expected: true},
+		{contentType: "image/heic", expected: true},
+		{contentType: "image/heif-sequence", expected: true},
+		{contentType: "image/heic-sequence", expected: true},
+		{contentType: "image/jpeg", expected: false},
+		{contentType: "image/avif", expected: false},
+		{contentType: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if isHeif := IsHeifContentType(tt.contentType); isHeif != tt.expected {
+				t.Errorf("got %t for %q, expected %t", isHeif, tt.contentType, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHeifDecoderEnabled(t *testing.T) {
+	tests := []struct {
+		decoder  string
+		expected bool
+	}{
+		{decoder: "heif-convert", expected: true},
+		{decoder: "imagemagick", expected: true},
+		{decoder: "", expected: false},
+		{decoder: "ffmpeg", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.decoder, func(t *testing.T) {
+			if enabled := HeifDecoderEnabled(config.HeifConfig{Decoder: tt.decoder}); enabled != tt.expected {
+				t.Errorf("got %t for decoder %q, expected %t", enabled, tt.decoder, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTranscodeHeifToJpegErrors(t *testing.T) {
+	missingBinary := path.Join(t.TempDir(), "missing-decoder")
+
+	tests := []struct {
+		name string
+		conf config.HeifConfig
+	}{
+		{name: "no decoder", conf: config.HeifConfig{TimeoutSeconds: 5}},
+		{name: "unknown decoder", conf: config.HeifConfig{Decoder: "ffmpeg", TimeoutSeconds: 5}},
+		{name: "missing heif-convert", conf: config.HeifConfig{Decoder: "heif-convert", BinaryPath: missingBinary, TimeoutSeconds: 5}},
+		{name: "missing imagemagick", conf: config.HeifConfig{Decoder: "imagemagick", BinaryPath: missingBinary, TimeoutSeconds: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := TranscodeHeifToJpeg([]byte("not really a heif file"), tt.conf, color.White)
+			if err == nil {
+				t.Errorf("got %d bytes, expected an error", len(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package u
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// How long to wait for ImageMagick before giving up on the conversion
+const webpTimeout = 30 * time.Second
+
+// EncodeWebp converts an image to WebP using ImageMagick, as Go doesn't have an encoder available.
+// A quality of 0 uses ImageMagick's default. The conversion is abandoned if the context is done.
+func EncodeWebp(ctx context.Context, b []byte, quality int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, webpTimeout)
+	defer cancel()
+
+	out := &bytes.Buffer{}
+	args := []string{"-"}
+	if quality > 0 {
+		args = append(args, "-quality", strconv.Itoa(quality))
+	}
+	cmd := exec.CommandContext(ctx, "convert", append(args, "webp:-")...)
+	cmd.Stdin = bytes.NewBuffer(b)
+	cmd.Stdout = out
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.New("webp: error converting image: " + err.Error())
+	}
+	return out.Bytes(), nil
+}
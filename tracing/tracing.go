@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/common/rcontext"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	"go.opentelemetry.io/otel/propagation"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/turt2live/matrix-media-repo"
+
+var provider *sdktrace.TracerProvider
+
+func init() {
+	// Always accept trace context from callers, even if we aren't exporting anything ourselves
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func Init() {
+	if !config.Get().Tracing.Enabled {
+		logrus.Info("Tracing disabled")
+		return
+	}
+
+	exporter, err := createExporter(config.Get().Tracing)
+	if err != nil {
+		sentry.CaptureException(err)
+		logrus.Error("Failed to set up tracing exporter: ", err)
+		return
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithConfig(sdktrace.Config{
+			DefaultSampler: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Get().Tracing.SampleRate)),
+			Resource:       resource.NewWithAttributes(semconv.ServiceNameKey.String("matrix-media-repo")),
+		}),
+	)
+	otel.SetTracerProvider(provider)
+	logrus.WithField("exporter", config.Get().Tracing.Exporter).Info("Started tracing")
+}
+
+func createExporter(conf config.TracingConfig) (export.SpanExporter, error) {
+	switch conf.Exporter {
+	case "otlp":
+		driver := otlpgrpc.NewDriver(otlpgrpc.WithEndpoint(conf.Endpoint), otlpgrpc.WithInsecure())
+		return otlp.NewExporter(context.Background(), driver)
+	case "jaeger":
+		return jaeger.NewRawExporter(jaeger.WithCollectorEndpoint(conf.Endpoint))
+	default:
+		return nil, errors.New("unknown tracing exporter: " + conf.Exporter)
+	}
+}
+
+func Stop() {
+	if provider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logrus.Warn("Error shutting down tracing: ", err)
+		}
+		provider = nil
+	}
+}
+
+// StartRequestSpan starts a server span for the request, continuing any trace supplied by the caller.
+func StartRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// TraceIdOf returns the ID of the trace active on the context, or an empty string if there is no
+// trace. When we aren't tracing, this is the trace supplied by the caller, if any.
+func TraceIdOf(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		spanContext = trace.RemoteSpanContextFromContext(ctx)
+	}
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID.String()
+}
+
+// StartSpan starts a span as a child of whatever span is active on the given context. The returned
+// context should be passed to any work which is part of the span.
+func StartSpan(ctx rcontext.RequestContext, name string, attrs ...attribute.KeyValue) (rcontext.RequestContext, trace.Span) {
+	spanCtx, span := otel.Tracer(tracerName).Start(ctx.Context, name, trace.WithAttributes(attrs...))
+	ctx.Context = spanCtx
+	return ctx, span
+}
+
+// SetAttributes sets attributes on the span active on the given context, if any.
+func SetAttributes(ctx rcontext.RequestContext, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx.Context).SetAttributes(attrs...)
+}
+
+// EndSpan ends the span, marking it as failed if an error is given.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
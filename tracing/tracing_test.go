@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartRequestSpan(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(provider)
+
+	tests := []struct {
+		name        string
+		traceparent string
+		wantTraceId string
+		wantParent  string
+	}{
+		{
+			name:        "continues the caller's trace",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantTraceId: "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantParent:  "00f067aa0ba902b7",
+		},
+		{name: "starts a new trace", traceparent: ""},
+		{name: "ignores invalid trace context", traceparent: "not a trace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/config", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+
+			_, span := StartRequestSpan(r, "config")
+			defer span.End()
+
+			sc := span.SpanContext()
+			if !sc.IsValid() {
+				t.Fatal("expected a valid span")
+			}
+			if tt.wantTraceId != "" && sc.TraceID.String() != tt.wantTraceId {
+				t.Errorf("got trace %s, expected %s", sc.TraceID, tt.wantTraceId)
+			}
+			parent := span.(sdktrace.ReadOnlySpan).Parent()
+			if tt.wantParent != "" && parent.SpanID.String() != tt.wantParent {
+				t.Errorf("got parent %s, expected %s", parent.SpanID, tt.wantParent)
+			}
+			if tt.wantParent == "" && parent.IsValid() {
+				t.Errorf("expected no parent span, got %s", parent.SpanID)
+			}
+		})
+	}
+}
+
+func TestTraceIdOf(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	tests := []struct {
+		name        string
+		traceparent string
+		expected    string
+	}{
+		{name: "caller's trace", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expected: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "no trace", traceparent: "", expected: ""},
+		{name: "invalid trace", traceparent: "not a trace", expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/_matrix/media/r0/config", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+
+			// Tracing isn't enabled, so this relies on the caller's trace
+			ctx, span := StartRequestSpan(r, "test")
+			defer span.End()
+			if got := TraceIdOf(ctx); got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
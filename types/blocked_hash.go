@@ -0,0 +1,7 @@
+package types
+
+type BlockedHash struct {
+	Sha256Hash string
+	Reason     string
+	BlockedTs  int64
+}
@@ -16,3 +16,34 @@ type DatastoreMigrationEstimate struct {
 	TotalHashesAffected     int64 `json:"total_hashes_affected"`
 	TotalBytes              int64 `json:"total_bytes"`
 }
+
+type OrphanedFile struct {
+	Location  string `json:"location"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+type OrphanedFilesReport struct {
+	Files        []*OrphanedFile `json:"files"`
+	TotalBytes   int64           `json:"total_bytes"`
+	ScannedFiles int64           `json:"scanned_files"`
+	Deleted      bool            `json:"deleted"`
+}
+
+type DatastoreUsage struct {
+	DatastoreId       string `json:"-"`
+	MediaRecords      int64  `json:"media_records"`
+	MediaBytes        int64  `json:"media_bytes"`
+	UniqueHashes      int64  `json:"unique_hashes"`
+	UniqueBytes       int64  `json:"unique_bytes"`
+	DeduplicatedBytes int64  `json:"deduplicated_bytes"`       // Bytes saved by storing duplicate uploads once
+	StoredObjects     *int64 `json:"stored_objects,omitempty"` // Only set when the datastore was measured
+	StoredBytes       *int64 `json:"stored_bytes,omitempty"`
+}
+
+type DeduplicationStats struct {
+	LogicalBytes  int64   `json:"logical_bytes"`  // The size of every media record added together
+	PhysicalBytes int64   `json:"physical_bytes"` // The size of each unique file in each datastore
+	SavedBytes    int64   `json:"saved_bytes"`
+	Ratio         float64 `json:"ratio"` // Logical bytes per physical byte, or 1 when there's no media
+	CalculatedTs  int64   `json:"calculated_ts"`
+}
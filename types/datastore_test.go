@@ -0,0 +1,39 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDatastoreUsageJson(t *testing.T) {
+	objects := int64(3)
+	bytes := int64(2048)
+
+	tests := []struct {
+		name  string
+		usage DatastoreUsage
+		want  string
+	}{
+		{
+			name:  "not measured",
+			usage: DatastoreUsage{DatastoreId: "ds1", MediaRecords: 4, MediaBytes: 4096, UniqueHashes: 2, UniqueBytes: 2048, DeduplicatedBytes: 2048},
+			want:  `{"media_records":4,"media_bytes":4096,"unique_hashes":2,"unique_bytes":2048,"deduplicated_bytes":2048}`,
+		},
+		{
+			name:  "measured",
+			usage: DatastoreUsage{DatastoreId: "ds1", MediaRecords: 4, MediaBytes: 4096, UniqueHashes: 2, UniqueBytes: 2048, DeduplicatedBytes: 2048, StoredObjects: &objects, StoredBytes: &bytes},
+			want:  `{"media_records":4,"media_bytes":4096,"unique_hashes":2,"unique_bytes":2048,"deduplicated_bytes":2048,"stored_objects":3,"stored_bytes":2048}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.usage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("json = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package types
+
+// EncryptionKey is the key material for an object which was encrypted at rest.
+type EncryptionKey struct {
+	DatastoreId string
+	Location    string
+	KeyId       string // the master key used to wrap the object's key
+	WrappedKey  []byte // the object's key, sealed with the master key
+	KeyNonce    []byte
+	BaseNonce   []byte
+}
@@ -12,4 +12,5 @@ type ExportPart struct {
 	SizeBytes   int64
 	DatastoreID string
 	Location    string
+	Encoded     bool
 }
@@ -3,17 +3,24 @@ package types
 import "io"
 
 type Media struct {
-	Origin      string
-	MediaId     string
-	UploadName  string
-	ContentType string
-	UserId      string
-	Sha256Hash  string
-	SizeBytes   int64
-	DatastoreId string
-	Location    string
-	CreationTs  int64
-	Quarantined bool
+	Origin              string
+	MediaId             string
+	UploadName          string
+	ContentType         string
+	UserId              string
+	Sha256Hash          string
+	SizeBytes           int64
+	DatastoreId         string
+	Location            string
+	CreationTs          int64
+	Quarantined         bool
+	ReportedContentType string
+	StoredSizeBytes     int64 // The size of the file in the datastore, or zero if unknown
+	Encoded             bool  // True if the file is compressed or encrypted in the datastore
+	Width               *int  // The dimensions of images, or nil if not an image or unknown
+	Height              *int
+	UploaderTokenHash   string // A salted hash of the uploader's access token, if enabled, for auditing
+	Sanitized           bool   // True if the file was produced by the SVG sanitizer
 }
 
 type MinimalMedia struct {
@@ -33,8 +40,24 @@ type MinimalMediaMetadata struct {
 	CreationTs   int64
 	LastAccessTs int64
 	DatastoreId  string
+	Encoded      bool
 }
 
 func (m *Media) MxcUri() string {
 	return "mxc://" + m.Origin + "/" + m.MediaId
 }
+
+// Clone returns a copy of the media record which shares nothing with the original, so changes to
+// the copy never affect the original.
+func (m *Media) Clone() *Media {
+	c := *m
+	if m.Width != nil {
+		width := *m.Width
+		c.Width = &width
+	}
+	if m.Height != nil {
+		height := *m.Height
+		c.Height = &height
+	}
+	return &c
+}
@@ -0,0 +1,45 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMediaClone(t *testing.T) {
+	width := 640
+	height := 480
+
+	tests := []struct {
+		name  string
+		media *Media
+	}{
+		{name: "image", media: &Media{Origin: "example.org", MediaId: "abc123", UserId: "@alice:example.org", Width: &width, Height: &height}},
+		{name: "no dimensions", media: &Media{Origin: "example.org", MediaId: "def456", UserId: "@alice:example.org"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := *tt.media
+			c := tt.media.Clone()
+			if c == tt.media {
+				t.Fatal("clone is the same record")
+			}
+			if !reflect.DeepEqual(c, tt.media) {
+				t.Fatalf("got %+v, expected a copy of %+v", c, tt.media)
+			}
+
+			c.Origin = "other.example.org"
+			c.MediaId = "changed"
+			c.UserId = "@bob:other.example.org"
+			if c.Width != nil {
+				*c.Width = 1
+				*c.Height = 1
+			}
+			if tt.media.Origin != original.Origin || tt.media.MediaId != original.MediaId || tt.media.UserId != original.UserId {
+				t.Errorf("changing the clone changed the original: %+v", tt.media)
+			}
+			if tt.media.Width != nil && (*tt.media.Width != 640 || *tt.media.Height != 480) {
+				t.Errorf("changing the clone's dimensions changed the original to %dx%d", *tt.media.Width, *tt.media.Height)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package types
+
+const (
+	MigrationJobRunning   = "running"
+	MigrationJobFinished  = "finished"
+	MigrationJobCancelled = "cancelled"
+)
+
+const (
+	MigrationPhaseMedia      = "media"
+	MigrationPhaseThumbnails = "thumbnails"
+)
+
+// MigrationJob is the progress of a datastore migration, which shares its ID with the migration's
+// background task. Records are migrated in order of hash, so everything before LastSha256Hash in the
+// current phase has been handled. Records with LastSha256Hash itself may have been.
+type MigrationJob struct {
+	TaskID            int    `json:"task_id"`
+	SourceDatastoreId string `json:"source_datastore_id"`
+	TargetDatastoreId string `json:"target_datastore_id"`
+	BeforeTs          int64  `json:"before_ts"`
+	Status            string `json:"status"`
+	Phase             string `json:"phase"`
+	LastSha256Hash    string `json:"last_sha256_hash"`
+	MigratedCount     int64  `json:"migrated_count"`
+	FailedCount       int64  `json:"failed_count"`
+	MigratedBytes     int64  `json:"migrated_bytes"`
+	UpdatedTs         int64  `json:"updated_ts"`
+}
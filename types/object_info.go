@@ -1,7 +1,9 @@
 package types
 
 type ObjectInfo struct {
-	Location   string
-	Sha256Hash string
-	SizeBytes  int64
+	Location        string
+	Sha256Hash      string
+	SizeBytes       int64
+	StoredSizeBytes int64
+	Encoded         bool // True if the file was compressed or encrypted before being stored
 }
@@ -0,0 +1,9 @@
+package types
+
+// PresignedObject is where a client was given a presigned URL to upload to, which is deleted unless
+// the upload is finalized before it expires.
+type PresignedObject struct {
+	DatastoreId string
+	Location    string
+	ExpiresTs   int64
+}
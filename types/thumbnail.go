@@ -17,6 +17,9 @@ type Thumbnail struct {
 	Location    string
 	CreationTs  int64
 	Sha256Hash  string
+	Format      string // "" for the generator's choice, or "webp"
+	Encoded     bool   // True if the file is compressed or encrypted in the datastore
+	Quality     int    // The encoder quality for the format, or 0 for the encoder's default
 }
 
 type StreamedThumbnail struct {
@@ -0,0 +1,22 @@
+package util
+
+import (
+	"bytes"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+// CalculateBlurhash decodes the image and calculates its blurhash with the given options. Callers
+// should check the image isn't too large to decode first.
+func CalculateBlurhash(b []byte, conf config.MSC2448Config) (string, error) {
+	imgSrc, err := imaging.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+
+	// Resize the image to make the blurhash a bit more reasonable to calculate
+	smallImg := imaging.Fill(imgSrc, conf.GenerateWidth, conf.GenerateHeight, imaging.Center, imaging.Lanczos)
+	return blurhash.Encode(conf.XComponents, conf.YComponents, smallImg)
+}
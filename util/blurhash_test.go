@@ -0,0 +1,53 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func TestCalculateBlurhash(t *testing.T) {
+	conf := config.MSC2448Config{GenerateWidth: 64, GenerateHeight: 64, XComponents: 4, YComponents: 3}
+
+	tests := []struct {
+		name     string
+		b        []byte
+		expected string
+		wantErr  bool
+	}{
+		{name: "png", b: encodeTestImage(t, "png", 100, 50), expected: "L35|zo2csUW[mwa#fQf8g0fQfQfQ"},
+		{name: "jpeg", b: encodeTestImage(t, "jpeg", 20, 80)},
+		{name: "not an image", b: []byte("hello world"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := CalculateBlurhash(tt.b, conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			x, y, err := blurhash.Components(hash)
+			if err != nil {
+				t.Fatalf("%q is not a valid blurhash: %v", hash, err)
+			}
+			if x != conf.XComponents || y != conf.YComponents {
+				t.Errorf("got %dx%d components, expected %dx%d", x, y, conf.XComponents, conf.YComponents)
+			}
+			if tt.expected != "" && hash != tt.expected {
+				t.Errorf("got %q, expected %q", hash, tt.expected)
+			}
+
+			// The same image should always get the same blurhash
+			again, err := CalculateBlurhash(tt.b, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != hash {
+				t.Errorf("got %q the second time, expected %q", again, hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SanitizeFilename makes a client-supplied filename safe to store and later use in headers. Any
+// directory components and control characters are removed, and the name is truncated to maxLength
+// bytes (when greater than zero) while trying to keep the extension intact.
+func SanitizeFilename(filename string, maxLength int) string {
+	filename = strings.ReplaceAll(filename, "\\", "/")
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(path.Base(filename))
+	if filename == "." || filename == ".." || filename == "/" {
+		return ""
+	}
+
+	if maxLength <= 0 || len(filename) <= maxLength {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	if len(ext) >= maxLength/2 {
+		ext = "" // the extension is unreasonable, so don't bother keeping it
+	}
+	return truncateUtf8(strings.TrimSuffix(filename, ext), maxLength-len(ext)) + ext
+}
+
+func truncateUtf8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name      string
+		filename  string
+		maxLength int
+		want      string
+	}{
+		{name: "plain", filename: "cat.png", maxLength: 255, want: "cat.png"},
+		{name: "parent directory", filename: "../../etc/passwd", maxLength: 255, want: "passwd"},
+		{name: "windows separators", filename: "..\\..\\boot.ini", maxLength: 255, want: "boot.ini"},
+		{name: "only dots", filename: "..", maxLength: 255, want: ""},
+		{name: "trailing separator", filename: "photos/", maxLength: 255, want: "photos"},
+		{name: "newlines", filename: "evil\r\nSet-Cookie: a=b.txt", maxLength: 255, want: "evilSet-Cookie: a=b.txt"},
+		{name: "other control characters", filename: "a\x00b\x1fc\x7f.txt", maxLength: 255, want: "abc.txt"},
+		{name: "invalid utf8", filename: "a\xffb.txt", maxLength: 255, want: "ab.txt"},
+		{name: "truncated keeping the extension", filename: "abcdefghij.png", maxLength: 10, want: "abcdef.png"},
+		{name: "unreasonable extension is dropped", filename: "a.bcdefghijkl", maxLength: 8, want: "a.bcdefg"},
+		{name: "multibyte runes aren't split", filename: "日本語のファイル.txt", maxLength: 14, want: "日本語.txt"},
+		{name: "no limit", filename: "abcdefghij.png", maxLength: 0, want: "abcdefghij.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeFilename(tt.filename, tt.maxLength)
+			if got != tt.want {
+				t.Errorf("got %q, expected %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("got invalid utf8 %q", got)
+			}
+			if tt.maxLength > 0 && len(got) > tt.maxLength {
+				t.Errorf("got %d bytes, expected at most %d", len(got), tt.maxLength)
+			}
+		})
+	}
+}
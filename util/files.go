@@ -35,5 +35,5 @@ func GetFileHash(filePath string) (string, error) {
 	}
 	defer cleanup.DumpAndCloseStream(f)
 
-	return GetSha256HashOfStream(f)
+	return GetHashOfStream(f)
 }
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/util/cleanup"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Hasher calculates the hash of a file with a particular algorithm.
+type Hasher struct {
+	hash.Hash
+	algorithm string
+}
+
+// NewHasher returns a hasher for the configured hash algorithm.
+func NewHasher() (*Hasher, error) {
+	return NewHasherFor(config.Get().HashAlgorithm)
+}
+
+// NewHasherFor returns a hasher for the named algorithm, as used by HashAlgorithmOf.
+func NewHasherFor(algorithm string) (*Hasher, error) {
+	var h hash.Hash
+	switch algorithm {
+	case config.HashAlgorithmSha256:
+		h = sha256.New()
+	case config.HashAlgorithmSha512:
+		h = sha512.New()
+	case config.HashAlgorithmBlake2b:
+		h, _ = blake2b.New512(nil) // only fails for invalid keys
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", algorithm)
+	}
+	return &Hasher{Hash: h, algorithm: algorithm}, nil
+}
+
+// HashString returns the hash of everything written so far, in the form it is stored in. Hashes
+// are prefixed with the algorithm's name, like "sha512:...", so they never match a hash from
+// another algorithm.
+func (h *Hasher) HashString() string {
+	return h.algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// HashAlgorithmOf returns the name of the algorithm the hash was calculated with. Hashes without
+// a prefix are SHA-256, as every hash was before other algorithms were supported.
+func HashAlgorithmOf(hash string) string {
+	if i := strings.Index(hash, ":"); i >= 0 {
+		return hash[:i]
+	}
+	return config.HashAlgorithmSha256
+}
+
+// NormalizeHash converts a hash supplied from outside the media repo, such as by an admin or in an
+// import, to the form it is stored in so that it can be looked up. Hashes without a prefix are
+// SHA-256.
+func NormalizeHash(hash string) string {
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if hash == "" || strings.Contains(hash, ":") {
+		return hash
+	}
+	return config.HashAlgorithmSha256 + ":" + hash
+}
+
+// GetHashOfStream hashes the stream with the configured hash algorithm, closing it afterwards.
+func GetHashOfStream(r io.ReadCloser) (string, error) {
+	defer cleanup.DumpAndCloseStream(r)
+
+	hasher, err := NewHasher()
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hasher.HashString(), nil
+}
+
+// GetHashOfStreamWith hashes the stream with the named algorithm, closing it afterwards. This is
+// used to check files against hashes which may have been calculated with a different algorithm
+// than the one currently configured.
+func GetHashOfStreamWith(algorithm string, r io.ReadCloser) (string, error) {
+	defer cleanup.DumpAndCloseStream(r)
+
+	hasher, err := NewHasherFor(algorithm)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return hasher.HashString(), nil
+}
@@ -0,0 +1,147 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+const helloSha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+const helloSha512 = "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"
+const helloBlake2b = "e4cfa39a3d37be31c59609e807970799caa68a19bfaa15135f165085e01d41a65ba1e1b146aeb6bd0092b49eac214c103ccfa3a365954bbbe52f74a2b3620c94"
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "mmr-util-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = path.Join(dir, "media-repo.yaml")
+
+	// Files are hashed with the configured algorithm
+	err = ioutil.WriteFile(config.Path, []byte("hashAlgorithm: sha512\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestGetHashOfStream(t *testing.T) {
+	hash, err := GetHashOfStream(ioutil.NopCloser(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "sha512:"+helloSha512 {
+		t.Errorf("got %s, expected the configured algorithm to be used", hash)
+	}
+}
+
+func TestGetHashOfStreamWith(t *testing.T) {
+	tests := []struct {
+		algorithm    string
+		expectedHash string
+		wantErr      bool
+	}{
+		{algorithm: "sha256", expectedHash: "sha256:" + helloSha256},
+		{algorithm: "sha512", expectedHash: "sha512:" + helloSha512},
+		{algorithm: "blake2b", expectedHash: "blake2b:" + helloBlake2b},
+		{algorithm: "md5", wantErr: true},
+		{algorithm: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			hash, err := GetHashOfStreamWith(tt.algorithm, ioutil.NopCloser(strings.NewReader("hello")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error = %t", err, tt.wantErr)
+			}
+			if hash != tt.expectedHash {
+				t.Errorf("got %s, expected %s", hash, tt.expectedHash)
+			}
+			if !tt.wantErr && HashAlgorithmOf(hash) != tt.algorithm {
+				t.Errorf("got algorithm %s, expected %s", HashAlgorithmOf(hash), tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestHashesOnlyMatchWithinAnAlgorithm(t *testing.T) {
+	// De-duplication looks media up by the whole hash string
+	algorithms := []string{config.HashAlgorithmSha256, config.HashAlgorithmSha512, config.HashAlgorithmBlake2b}
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			first, err := GetHashOfStreamWith(algorithm, ioutil.NopCloser(strings.NewReader("hello")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := GetHashOfStreamWith(algorithm, ioutil.NopCloser(strings.NewReader("hello")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != second {
+				t.Errorf("got %s and %s, expected the same file to have the same hash", first, second)
+			}
+
+			for _, other := range algorithms {
+				if other == algorithm {
+					continue
+				}
+				otherHash, err := GetHashOfStreamWith(other, ioutil.NopCloser(strings.NewReader("hello")))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if NormalizeHash(otherHash) == NormalizeHash(first) {
+					t.Errorf("got %s for both %s and %s, expected the algorithms not to match", first, algorithm, other)
+				}
+			}
+		})
+	}
+}
+
+func TestHashAlgorithmOf(t *testing.T) {
+	tests := []struct {
+		hash              string
+		expectedAlgorithm string
+	}{
+		{hash: "sha256:" + helloSha256, expectedAlgorithm: "sha256"},
+		{hash: helloSha256, expectedAlgorithm: "sha256"},
+		{hash: "sha512:" + helloSha512, expectedAlgorithm: "sha512"},
+		{hash: "blake2b:" + helloBlake2b, expectedAlgorithm: "blake2b"},
+		{hash: "", expectedAlgorithm: "sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expectedAlgorithm+" "+tt.hash, func(t *testing.T) {
+			if algorithm := HashAlgorithmOf(tt.hash); algorithm != tt.expectedAlgorithm {
+				t.Errorf("got %s, expected %s", algorithm, tt.expectedAlgorithm)
+			}
+		})
+	}
+}
+
+func TestNormalizeHash(t *testing.T) {
+	tests := []struct {
+		name         string
+		hash         string
+		expectedHash string
+	}{
+		{name: "bare sha256", hash: helloSha256, expectedHash: "sha256:" + helloSha256},
+		{name: "prefixed sha256", hash: "sha256:" + helloSha256, expectedHash: "sha256:" + helloSha256},
+		{name: "uppercase", hash: "SHA256:" + strings.ToUpper(helloSha256), expectedHash: "sha256:" + helloSha256},
+		{name: "whitespace", hash: " " + helloSha256 + "\n", expectedHash: "sha256:" + helloSha256},
+		{name: "empty", hash: "", expectedHash: ""},
+		{name: "sha512", hash: "sha512:" + helloSha512, expectedHash: "sha512:" + helloSha512},
+		{name: "uppercase blake2b", hash: "BLAKE2B:" + strings.ToUpper(helloBlake2b), expectedHash: "blake2b:" + helloBlake2b},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if hash := NormalizeHash(tt.hash); hash != tt.expectedHash {
+				t.Errorf("got %s, expected %s", hash, tt.expectedHash)
+			}
+		})
+	}
+}
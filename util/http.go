@@ -1,7 +1,9 @@
 package util
 
 import (
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
@@ -37,3 +39,53 @@ func GetLogSafeQueryString(r *http.Request) string {
 
 	return qs.Encode()
 }
+
+// ETagMatches determines if an If-None-Match header value matches the given (unquoted) ETag.
+func ETagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == "\""+etag+"\"" {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsContentType determines if an Accept header value explicitly lists the given content type.
+func AcceptsContentType(accept string, contentType string) bool {
+	for _, candidate := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(candidate))
+		if err != nil || mediaType != contentType {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if qv, err := strconv.ParseFloat(q, 64); err == nil && qv <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// AcceptsEncoding determines if an Accept-Encoding header value allows the given content coding,
+// either explicitly or through a wildcard.
+func AcceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, candidate := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(candidate, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if qv, err := strconv.ParseFloat(param[2:], 64); err == nil && qv <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       bool
+	}{
+		{acceptEncoding: "gzip", expected: true},
+		{acceptEncoding: "gzip, deflate, br", expected: true},
+		{acceptEncoding: "deflate, GZIP", expected: true},
+		{acceptEncoding: "br;q=1.0, gzip;q=0.8", expected: true},
+		{acceptEncoding: "*", expected: true},
+		{acceptEncoding: "gzip;q=0", expected: false},
+		{acceptEncoding: "*;q=0", expected: false},
+		{acceptEncoding: "deflate, br", expected: false},
+		{acceptEncoding: "identity", expected: false},
+		{acceptEncoding: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			if got := AcceptsEncoding(tt.acceptEncoding, "gzip"); got != tt.expected {
+				t.Errorf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
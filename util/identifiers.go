@@ -39,3 +39,31 @@ func SplitUserId(userId string) (string, string, error) {
 
 	return localpart, domain, nil
 }
+
+// The longest user ID the Matrix spec allows
+const maxUserIdLength = 255
+
+// IsValidUserId determines if the user ID follows the Matrix grammar: an @, a localpart, a colon, and
+// a server name, up to 255 characters in total. Historical localparts are allowed, so the localpart
+// can be any printable ASCII other than a colon.
+func IsValidUserId(userId string) bool {
+	if len(userId) > maxUserIdLength {
+		return false
+	}
+	localpart, domain, err := SplitUserId(userId)
+	if err != nil || localpart == "" || domain == "" {
+		return false
+	}
+	for _, c := range localpart {
+		if c < 0x21 || c > 0x7E {
+			return false
+		}
+	}
+	for _, c := range domain {
+		isAlphanumeric := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphanumeric && !strings.ContainsRune(".-:[]", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidUserId(t *testing.T) {
+	tests := []struct {
+		userId   string
+		expected bool
+	}{
+		{userId: "@alice:example.org", expected: true},
+		{userId: "@alice:example.org:8448", expected: true},
+		{userId: "@alice:[::1]:8448", expected: true},
+		{userId: "@Alice_Historical!:example.org", expected: true},
+		{userId: "@" + strings.Repeat("a", 242) + ":example.org", expected: true},
+		{userId: "@" + strings.Repeat("a", 243) + ":example.org", expected: false},
+		{userId: "alice:example.org", expected: false},
+		{userId: "@alice", expected: false},
+		{userId: "@:example.org", expected: false},
+		{userId: "@alice:", expected: false},
+		{userId: "@ali ce:example.org", expected: false},
+		{userId: "@alicé:example.org", expected: false},
+		{userId: "@alice:exa_mple.org", expected: false},
+		{userId: "@alice:example.org/path", expected: false},
+		{userId: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.userId, func(t *testing.T) {
+			if got := IsValidUserId(tt.userId); got != tt.expected {
+				t.Errorf("got %t for %q, expected %t", got, tt.userId, tt.expected)
+			}
+		})
+	}
+}
@@ -1,5 +1,48 @@
 package util
 
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// GetImageDimensions reads the dimensions declared in an image's header without decoding the
+// rest of the image. Only formats supported by the standard library (and WebP) can be read.
+func GetImageDimensions(b []byte) (int, int, error) {
+	var conf image.Config
+	var err error
+	if bytes.HasPrefix(b, pngSignature) {
+		// Other decoders (such as APNG) register themselves for PNGs too, and not all of them
+		// handle reading just the header, so we go straight to the standard library's decoder.
+		conf, err = png.DecodeConfig(bytes.NewReader(b))
+	} else {
+		conf, _, err = image.DecodeConfig(bytes.NewReader(b))
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return conf.Width, conf.Height, nil
+}
+
+// DecodeImage fully decodes an image, which fails if any of the image is missing or unreadable.
+// Only the formats supported by GetImageDimensions can be decoded.
+func DecodeImage(b []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	return img, err
+}
+
+// ExceedsMaxPixels determines if an image of the given dimensions has more pixels than allowed.
+// A maximum of zero or less means there is no limit.
+func ExceedsMaxPixels(width int, height int, maxPixels int) bool {
+	return maxPixels > 0 && int64(width)*int64(height) > int64(maxPixels)
+}
+
 func IsAnimatedPNG(b []byte) bool {
 	IDAT := []byte{0x49, 0x44, 0x41, 0x54}
 	acTL := []byte{0x61, 0x63, 0x54, 0x4C}
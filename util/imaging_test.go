@@ -0,0 +1,121 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, format string, width int, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(buf, img)
+	case "jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		t.Fatalf("unknown test image format %s", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader builds just the header of a PNG, declaring the given dimensions without any pixel data.
+func pngHeader(width uint32, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // truecolour
+
+	chunk := make([]byte, 8)
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(ihdr)))
+	copy(chunk[4:8], "IHDR")
+	chunk = append(chunk, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	return append([]byte("\x89PNG\r\n\x1a\n"), chunk...)
+}
+
+// gifHeader builds just the header of a GIF, declaring the given dimensions without any frames.
+func gifHeader(width uint16, height uint16) []byte {
+	b := []byte("GIF89a")
+	dims := make([]byte, 4)
+	binary.LittleEndian.PutUint16(dims[0:2], width)
+	binary.LittleEndian.PutUint16(dims[2:4], height)
+	b = append(b, dims...)
+	return append(b, 0x00, 0x00, 0x00) // no global colour table
+}
+
+func TestGetImageDimensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		b          []byte
+		wantWidth  int
+		wantHeight int
+		wantErr    bool
+	}{
+		{name: "png", b: encodeTestImage(t, "png", 40, 30), wantWidth: 40, wantHeight: 30},
+		{name: "jpeg", b: encodeTestImage(t, "jpeg", 17, 64), wantWidth: 17, wantHeight: 64},
+		{name: "gif", b: encodeTestImage(t, "gif", 8, 8), wantWidth: 8, wantHeight: 8},
+		{name: "png bomb", b: pngHeader(100000, 100000), wantWidth: 100000, wantHeight: 100000},
+		{name: "small png", b: pngHeader(16, 9), wantWidth: 16, wantHeight: 9},
+		{name: "gif bomb", b: gifHeader(65535, 65535), wantWidth: 65535, wantHeight: 65535},
+		{name: "not an image", b: []byte("just some text"), wantErr: true},
+		{name: "empty", b: []byte{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, err := GetImageDimensions(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected an error: %t", err, tt.wantErr)
+			}
+			if width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("got %dx%d, expected %dx%d", width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestExceedsMaxPixels(t *testing.T) {
+	tests := []struct {
+		name      string
+		width     int
+		height    int
+		maxPixels int
+		want      bool
+	}{
+		{name: "under the limit", width: 1000, height: 1000, maxPixels: 32000000, want: false},
+		{name: "exactly the limit", width: 8000, height: 4000, maxPixels: 32000000, want: false},
+		{name: "over the limit", width: 8001, height: 4000, maxPixels: 32000000, want: true},
+		{name: "would overflow 32 bits", width: 100000, height: 100000, maxPixels: 32000000, want: true},
+		{name: "no limit", width: 100000, height: 100000, maxPixels: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExceedsMaxPixels(tt.width, tt.height, tt.maxPixels); got != tt.want {
+				t.Errorf("got %t, expected %t", got, tt.want)
+			}
+		})
+	}
+}
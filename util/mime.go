@@ -1,9 +1,205 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
+const MimeDetectionGo = "go"
+const MimeDetectionLibmagic = "libmagic"
+const MimeDetectionAuto = "auto"
+
+var libmagicAvailable bool
+var libmagicCheck = &sync.Once{}
+
 func FixContentType(ct string) string {
 	return strings.Split(ct, ";")[0]
 }
+
+// NormalizeContentType lowercases the content type and removes any parameters which aren't in keepParams,
+// so types like `IMAGE/JPEG; charset=utf-8` and `image/jpeg` are treated the same. Content types which
+// can't be parsed are lowercased with their parameters removed.
+func NormalizeContentType(ct string, keepParams []string) string {
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(FixContentType(ct)))
+	}
+
+	kept := make(map[string]string)
+	for _, k := range keepParams {
+		// Parameter names are lowercased when parsed
+		if v, ok := params[strings.ToLower(k)]; ok {
+			kept[strings.ToLower(k)] = v
+		}
+	}
+	normalized := mime.FormatMediaType(mediaType, kept)
+	if normalized == "" {
+		return mediaType
+	}
+	return normalized
+}
+
+// IsSvgContentType determines if the content type is an SVG image, ignoring any parameters like charset.
+func IsSvgContentType(ct string) bool {
+	return strings.EqualFold(strings.TrimSpace(FixContentType(ct)), "image/svg+xml")
+}
+
+// DetectContentType sniffs the content type of the given bytes, ignoring any parameters like charset.
+// This is pure Go: types in the extended sniffing table are checked first, then the mimetype library,
+// then the standard library's sniffer.
+func DetectContentType(b []byte) string {
+	if ct := sniffExtendedContentType(b); ct != "" {
+		return ct
+	}
+	ct := FixContentType(mimetype.Detect(b).String())
+	if ct == "application/octet-stream" {
+		ct = FixContentType(http.DetectContentType(b))
+	}
+	return ct
+}
+
+// DetectContentTypeUsing sniffs the content type of the given bytes with the given detection method,
+// one of the MimeDetection constants. The libmagic method uses the `file` command, falling back to
+// DetectContentType if it fails. The auto method uses libmagic only if the command is available.
+func DetectContentTypeUsing(b []byte, method string) string {
+	if method == MimeDetectionAuto {
+		libmagicCheck.Do(func() {
+			_, err := exec.LookPath("file")
+			libmagicAvailable = err == nil
+		})
+		if libmagicAvailable {
+			method = MimeDetectionLibmagic
+		}
+	}
+
+	if method == MimeDetectionLibmagic {
+		if ct, err := detectContentTypeLibmagic(b); err == nil && ct != "" {
+			return ct
+		}
+	}
+	return DetectContentType(b)
+}
+
+// How long to wait for libmagic before falling back to the built-in detection
+const libmagicTimeout = 10 * time.Second
+
+func detectContentTypeLibmagic(b []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), libmagicTimeout)
+	defer cancel()
+
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "file", "--brief", "--mime-type", "-")
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = out
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+	return FixContentType(strings.TrimSpace(out.String())), nil
+}
+
+// Preferred extensions for common types, where mime.ExtensionsByType would pick an unusual one
+var contentTypeExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/apng": ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+}
+
+// ExtensionForContentType returns the file extension (with a leading dot) for the content type, or
+// an empty string if the type has no known extension.
+func ExtensionForContentType(contentType string) string {
+	ct := strings.ToLower(strings.TrimSpace(FixContentType(contentType)))
+	if ext, ok := contentTypeExtensions[ct]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(ct)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// Content types which files with the given extension are expected to have. Files which are built
+// on top of other formats (like office documents on zip) also allow the underlying type, as the
+// detection can't always tell them apart.
+var extensionContentTypes = map[string][]string{
+	"jpg":  {"image/jpeg"},
+	"jpeg": {"image/jpeg"},
+	"png":  {"image/png", "image/vnd.mozilla.apng"},
+	"apng": {"image/png", "image/vnd.mozilla.apng"},
+	"gif":  {"image/gif"},
+	"webp": {"image/webp"},
+	"bmp":  {"image/bmp"},
+	"tif":  {"image/tiff"},
+	"tiff": {"image/tiff"},
+	"ico":  {"image/x-icon"},
+	"heic": {"image/heic", "image/heic-sequence", "image/heif", "image/heif-sequence"},
+	"heif": {"image/heic", "image/heic-sequence", "image/heif", "image/heif-sequence"},
+	"avif": {"image/avif"},
+	"jxl":  {"image/jxl"},
+	"svg":  {"image/svg+xml", "text/xml", "text/plain"},
+	"mp3":  {"audio/mpeg"},
+	"flac": {"audio/flac"},
+	"wav":  {"audio/wav"},
+	"ogg":  {"application/ogg", "audio/ogg", "video/ogg"},
+	"oga":  {"application/ogg", "audio/ogg"},
+	"opus": {"application/ogg", "audio/ogg"},
+	"ogv":  {"application/ogg", "video/ogg"},
+	"m4a":  {"audio/x-m4a", "audio/mp4", "video/mp4"},
+	"mp4":  {"video/mp4", "audio/mp4", "video/x-m4v"},
+	"m4v":  {"video/x-m4v", "video/mp4"},
+	"webm": {"video/webm"},
+	"mkv":  {"video/x-matroska"},
+	"mov":  {"video/quicktime"},
+	"avi":  {"video/x-msvideo"},
+	"pdf":  {"application/pdf"},
+	"zip":  {"application/zip"},
+	"gz":   {"application/gzip"},
+	"7z":   {"application/x-7z-compressed"},
+	"rar":  {"application/x-rar-compressed"},
+	"tar":  {"application/x-tar"},
+	"docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip"},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/zip"},
+	"pptx": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", "application/zip"},
+	"odt":  {"application/vnd.oasis.opendocument.text", "application/zip"},
+	"ods":  {"application/vnd.oasis.opendocument.spreadsheet", "application/zip"},
+	"odp":  {"application/vnd.oasis.opendocument.presentation", "application/zip"},
+	"doc":  {"application/msword", "application/x-ole-storage"},
+	"xls":  {"application/vnd.ms-excel", "application/x-ole-storage"},
+	"ppt":  {"application/vnd.ms-powerpoint", "application/x-ole-storage"},
+	"txt":  {"text/plain"},
+	"log":  {"text/plain"},
+	"csv":  {"text/csv", "text/plain"},
+	"json": {"application/json", "text/plain"},
+	"xml":  {"text/xml", "text/plain"},
+	"html": {"text/html", "text/plain"},
+	"htm":  {"text/html", "text/plain"},
+	"exe":  {"application/vnd.microsoft.portable-executable"},
+}
+
+// ExtensionMatchesContentType determines if the filename's extension is compatible with the given
+// content type. Filenames without an extension, or with an extension we don't know about, always
+// match.
+func ExtensionMatchesContentType(filename string, contentType string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filename), "."))
+	if ext == "" {
+		return true
+	}
+	types, known := extensionContentTypes[ext]
+	if !known {
+		return true
+	}
+	return ArrayContains(types, FixContentType(contentType))
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"bytes"
+)
+
+// ISO base media file brands which the mimetype library doesn't know about
+var extendedFtypBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+// sniffExtendedContentType detects types which the other sniffers get wrong or miss entirely,
+// returning an empty string if the bytes aren't one of them.
+func sniffExtendedContentType(b []byte) string {
+	// JPEG XL, as a bare codestream or in its container
+	if bytes.HasPrefix(b, []byte{0xFF, 0x0A}) || bytes.HasPrefix(b, []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A")) {
+		return "image/jxl"
+	}
+
+	// ISO base media files (mp4, heic, avif, ...) start with an ftyp box listing the major brand
+	// followed by compatible brands. Only the major brand is trusted here.
+	if len(b) >= 12 && string(b[4:8]) == "ftyp" {
+		if ct, ok := extendedFtypBrands[string(b[8:12])]; ok {
+			return ct
+		}
+	}
+
+	return ""
+}
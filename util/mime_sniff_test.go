@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestSniffExtendedContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{name: "jxl codestream", b: []byte{0xFF, 0x0A, 0x01, 0x02}, want: "image/jxl"},
+		{name: "jxl container", b: []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A\x00\x00"), want: "image/jxl"},
+		{name: "avif", b: []byte("\x00\x00\x00\x1CftypavifmifI"), want: "image/avif"},
+		{name: "avif sequence", b: []byte("\x00\x00\x00\x1Cftypavismsf1"), want: "image/avif"},
+		{name: "avif only as a compatible brand", b: []byte("\x00\x00\x00\x1Cftypheicavif"), want: ""},
+		{name: "mp4", b: []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), want: ""},
+		{name: "short ftyp", b: []byte("\x00\x00\x00\x1Cftypav"), want: ""},
+		{name: "jpeg", b: []byte{0xFF, 0xD8, 0xFF, 0xE0}, want: ""},
+		{name: "empty", b: []byte{}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffExtendedContentType(tt.b); got != tt.want {
+				t.Errorf("sniffExtendedContentType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestExtensionMatchesContentType(t *testing.T) {
+	tests := []struct {
+		filename    string
+		contentType string
+		want        bool
+	}{
+		{filename: "photo.jpg", contentType: "image/jpeg", want: true},
+		{filename: "photo.JPEG", contentType: "image/jpeg", want: true},
+		{filename: "photo.jpg", contentType: "image/png", want: false},
+		{filename: "animation.png", contentType: "image/vnd.mozilla.apng", want: true},
+		{filename: "notes.txt", contentType: "text/plain; charset=utf-8", want: true},
+		{filename: "notes.txt", contentType: "application/pdf", want: false},
+		{filename: "report.docx", contentType: "application/zip", want: true},
+		{filename: "setup.exe", contentType: "image/png", want: false},
+		{filename: "no-extension", contentType: "application/octet-stream", want: true},
+		{filename: "archive.unknownext", contentType: "image/png", want: true},
+		{filename: "", contentType: "image/png", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename+"/"+tt.contentType, func(t *testing.T) {
+			if got := ExtensionMatchesContentType(tt.filename, tt.contentType); got != tt.want {
+				t.Errorf("ExtensionMatchesContentType(%q, %q) = %v, want %v", tt.filename, tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectContentTypeUsing(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		method string
+		want   string
+	}{
+		{name: "png", b: encodeTestImage(t, "png", 4, 4), method: MimeDetectionGo, want: "image/png"},
+		{name: "jpeg", b: encodeTestImage(t, "jpeg", 4, 4), method: MimeDetectionGo, want: "image/jpeg"},
+		{name: "avif", b: []byte("\x00\x00\x00\x1CftypavifmifI"), method: MimeDetectionGo, want: "image/avif"},
+		{name: "jxl", b: []byte{0xFF, 0x0A, 0x01, 0x02}, method: MimeDetectionGo, want: "image/jxl"},
+		{name: "text without charset", b: []byte("hello world"), method: MimeDetectionGo, want: "text/plain"},
+		{name: "unknown", b: []byte{0x00, 0x01, 0x02, 0x03}, method: MimeDetectionGo, want: "application/octet-stream"},
+		// Whether or not libmagic is installed, these must be detected the same way
+		{name: "png with libmagic", b: encodeTestImage(t, "png", 4, 4), method: MimeDetectionLibmagic, want: "image/png"},
+		{name: "png with auto", b: encodeTestImage(t, "png", 4, 4), method: MimeDetectionAuto, want: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentTypeUsing(tt.b, tt.method); got != tt.want {
+				t.Errorf("DetectContentTypeUsing(%s) = %q, want %q", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSvgContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "image/svg+xml", expected: true},
+		{contentType: "IMAGE/SVG+XML", expected: true},
+		{contentType: "image/svg+xml; charset=utf-8", expected: true},
+		{contentType: " image/svg+xml ", expected: true},
+		{contentType: "image/png", expected: false},
+		{contentType: "text/xml", expected: false},
+		{contentType: "", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			isSvg := IsSvgContentType(tt.contentType)
+			if isSvg != tt.expected {
+				t.Errorf("got %t, expected %t", isSvg, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		keepParams  []string
+		expected    string
+	}{
+		{contentType: "IMAGE/JPEG; charset=utf-8", keepParams: []string{"codecs"}, expected: "image/jpeg"},
+		{contentType: "image/jpeg", keepParams: []string{"codecs"}, expected: "image/jpeg"},
+		{contentType: " Text/Plain ; CHARSET=utf-8", keepParams: nil, expected: "text/plain"},
+		{contentType: "text/plain; charset=utf-8", keepParams: []string{"charset"}, expected: "text/plain; charset=utf-8"},
+		{contentType: "video/mp4; codecs=\"avc1.42E01E, mp4a.40.2\"; foo=bar", keepParams: []string{"codecs"}, expected: "video/mp4; codecs=\"avc1.42E01E, mp4a.40.2\""},
+		{contentType: "VIDEO/WEBM; Codecs=vp9", keepParams: []string{"CODECS"}, expected: "video/webm; codecs=vp9"},
+		{contentType: "Not A Type; charset=utf-8", keepParams: []string{"charset"}, expected: "not a type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			normalized := NormalizeContentType(tt.contentType, tt.keepParams)
+			if normalized != tt.expected {
+				t.Errorf("got %q, expected %q", normalized, tt.expected)
+			}
+		})
+	}
+}
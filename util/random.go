@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"math/big"
 )
 
 func GenerateRandomBytes(n int) ([]byte, error) {
@@ -26,6 +27,22 @@ func GenerateRandomString(nBytes int) (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
+// GenerateRandomStringFromAlphabet generates a string of the given length where each character is
+// picked at random from the alphabet.
+func GenerateRandomStringFromAlphabet(length int, alphabet string) (string, error) {
+	chars := []rune(alphabet)
+	max := big.NewInt(int64(len(chars)))
+	result := make([]rune, length)
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = chars[n.Int64()]
+	}
+	return string(result), nil
+}
+
 func GetSha1OfString(str string) (string, error) {
 	hasher := sha1.New()
 	hasher.Write([]byte(str))
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateRandomStringFromAlphabet(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		alphabet string
+	}{
+		{name: "hex", length: 12, alphabet: "0123456789abcdef"},
+		{name: "alphanumeric", length: 40, alphabet: "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"},
+		{name: "single character", length: 8, alphabet: "x"},
+		{name: "empty", length: 0, alphabet: "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := GenerateRandomStringFromAlphabet(tt.length, tt.alphabet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s) != tt.length {
+				t.Errorf("got %d characters, expected %d", len(s), tt.length)
+			}
+			for _, c := range s {
+				if !strings.ContainsRune(tt.alphabet, c) {
+					t.Errorf("%q is not in the alphabet", c)
+				}
+			}
+		})
+	}
+}
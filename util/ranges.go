@@ -0,0 +1,95 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+var ErrInvalidRange = errors.New("invalid range")
+
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRangeHeader parses a Range header value against a resource of the given size. Ranges which
+// fall outside of the resource are dropped, and if none remain then ErrRangeNotSatisfiable is returned.
+func ParseRangeHeader(header string, size int64) ([]ByteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, ErrInvalidRange
+	}
+
+	var ranges []ByteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, ErrInvalidRange
+		}
+		startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		r := ByteRange{}
+		if startStr == "" {
+			// Suffix range, like "-500" for the last 500 bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, ErrInvalidRange
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.Start = size - n
+			r.Length = n
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, ErrInvalidRange
+			}
+			end := size - 1
+			if endStr != "" {
+				end, err = strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < start {
+					return nil, ErrInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r.Start = start
+			r.Length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// RangesAreSequential determines if the ranges can be served in a single forward pass over a stream.
+func RangesAreSequential(ranges []ByteRange) bool {
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i].Start < ranges[i-1].Start+ranges[i-1].Length {
+			return false
+		}
+	}
+	return true
+}
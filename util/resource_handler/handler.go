@@ -1,7 +1,9 @@
 package resource_handler
 
 import (
+	"errors"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jeffail/tunny"
@@ -10,10 +12,18 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// ErrQueueFull is returned by TryGetResource when the handler has too much work queued.
+var ErrQueueFull = errors.New("resource handler queue is full")
+
 type ResourceHandler struct {
 	pool      *tunny.Pool
 	eventBus  *emitter.Emitter
 	itemCache *cache.Cache
+	maxQueued int
+
+	// The number of requests being worked on or waiting for a worker. The pool only counts requests
+	// once they reach it, so a burst of requests would otherwise all get past the queue limit.
+	pending int64
 }
 
 type resource struct {
@@ -27,13 +37,19 @@ type WorkRequest struct {
 }
 
 func New(workers int, fetchFn func(object *WorkRequest) interface{}) (*ResourceHandler, error) {
+	return NewWithQueueLimit(workers, 0, fetchFn)
+}
+
+// NewWithQueueLimit creates a handler which, through TryGetResource, refuses new work while more
+// than maxQueued requests are waiting for one of the workers. Zero or less means no limit.
+func NewWithQueueLimit(workers int, maxQueued int, fetchFn func(object *WorkRequest) interface{}) (*ResourceHandler, error) {
 	workFn := func(i interface{}) interface{} { return fetchFn(i.(*WorkRequest)) }
 	pool := tunny.NewFunc(workers, workFn)
 
 	bus := &emitter.Emitter{}
 	itemCache := cache.New(30*time.Second, 1*time.Minute) // cache work for 30ish seconds
 
-	handler := &ResourceHandler{pool, bus, itemCache}
+	handler := &ResourceHandler{pool: pool, eventBus: bus, itemCache: itemCache, maxQueued: maxQueued}
 	return handler, nil
 }
 
@@ -43,6 +59,29 @@ func (h *ResourceHandler) Close() {
 }
 
 func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan interface{} {
+	resultChan, _ := h.getResource(id, metadata, false)
+	return resultChan
+}
+
+// TryGetResource is like GetResource, but returns ErrQueueFull rather than queueing the work if the
+// handler's queue limit has been reached. Requests for a resource which is already being worked on
+// are always accepted as they share the existing work.
+func (h *ResourceHandler) TryGetResource(id string, metadata interface{}) (chan interface{}, error) {
+	return h.getResource(id, metadata, true)
+}
+
+// takeQueueSlot counts a new request as pending, returning false (and not counting it) if that
+// would exceed the queue limit.
+func (h *ResourceHandler) takeQueueSlot(limitQueue bool) bool {
+	pending := atomic.AddInt64(&h.pending, 1)
+	if limitQueue && h.maxQueued > 0 && pending > int64(h.pool.GetSize()+h.maxQueued) {
+		atomic.AddInt64(&h.pending, -1)
+		return false
+	}
+	return true
+}
+
+func (h *ResourceHandler) getResource(id string, metadata interface{}, limitQueue bool) (chan interface{}, error) {
 	resultChan := make(chan interface{})
 
 	// First see if we have already cached this request
@@ -57,7 +96,7 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 				logrus.Warn("Returning cached reply from resource handler for resource ID " + id)
 				resultChan <- res.result
 			}()
-			return resultChan
+			return resultChan, nil
 		}
 
 		// Otherwise queue a wait function to handle the resource when it is complete
@@ -66,7 +105,11 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 			resultChan <- result.Args[0]
 		}()
 
-		return resultChan
+		return resultChan, nil
+	}
+
+	if !h.takeQueueSlot(limitQueue) {
+		return nil, ErrQueueFull
 	}
 
 	// Cache that we're starting the request (never expire)
@@ -75,6 +118,7 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 	go func() {
 		// Queue the work (ignore errors)
 		result := h.pool.Process(&WorkRequest{id, metadata})
+		atomic.AddInt64(&h.pending, -1)
 		h.eventBus.Emit("complete_"+id, result)
 
 		// Cache the result for future callers
@@ -88,5 +132,5 @@ func (h *ResourceHandler) GetResource(id string, metadata interface{}) chan inte
 		resultChan <- result
 	}()
 
-	return resultChan
+	return resultChan, nil
 }
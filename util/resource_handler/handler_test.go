@@ -0,0 +1,111 @@
+package resource_handler
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// newBlockedHandler creates a handler with one worker, which doesn't finish any work until released
+func newBlockedHandler(t *testing.T, maxQueued int) (*ResourceHandler, chan bool) {
+	release := make(chan bool)
+	h, err := NewWithQueueLimit(1, maxQueued, func(r *WorkRequest) interface{} {
+		<-release
+		return r.Id
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, release
+}
+
+func TestTryGetResource(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxQueued       int
+		expectedRefused bool
+	}{
+		{name: "no limit", maxQueued: 0, expectedRefused: false},
+		{name: "limit reached", maxQueued: 1, expectedRefused: true},
+		{name: "limit not reached", maxQueued: 2, expectedRefused: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, release := newBlockedHandler(t, tt.maxQueued)
+			defer h.Close()
+
+			// One request is being worked on and the other is waiting for the worker
+			running, err := h.TryGetResource("running", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			queued, err := h.TryGetResource("queued", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Requests for work which is already happening are always accepted
+			if _, err = h.TryGetResource("running", nil); err != nil {
+				t.Errorf("got error %v for existing work, expected it to be accepted", err)
+			}
+
+			extra, err := h.TryGetResource("extra", nil)
+			if tt.expectedRefused {
+				if err != ErrQueueFull {
+					t.Errorf("got error %v, expected %v", err, ErrQueueFull)
+				}
+			} else if err != nil {
+				t.Errorf("got error %v, expected the request to be queued", err)
+			}
+
+			close(release)
+			if r := <-running; r != "running" {
+				t.Errorf("got %v, expected the running result", r)
+			}
+			if r := <-queued; r != "queued" {
+				t.Errorf("got %v, expected the queued result", r)
+			}
+			if extra != nil {
+				if r := <-extra; r != "extra" {
+					t.Errorf("got %v, expected the extra result", r)
+				}
+			}
+		})
+	}
+}
+
+func TestTryGetResourceBurst(t *testing.T) {
+	const maxQueued = 3
+	h, release := newBlockedHandler(t, maxQueued)
+	defer h.Close()
+
+	// With one thread, none of the work can reach the pool until the burst is over, so the pool
+	// hasn't counted any of it when the queue limit is checked
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	results := make([]chan interface{}, 0)
+	for i := 0; i < 50; i++ {
+		resultChan, err := h.TryGetResource(fmt.Sprintf("burst-%d", i), nil)
+		if err == nil {
+			results = append(results, resultChan)
+		} else if err != ErrQueueFull {
+			t.Errorf("got error %v, expected %v", err, ErrQueueFull)
+		}
+	}
+
+	expected := h.pool.GetSize() + maxQueued
+	if len(results) != expected {
+		t.Errorf("got %d accepted requests, expected %d", len(results), expected)
+	}
+
+	close(release)
+	for _, resultChan := range results {
+		<-resultChan
+	}
+
+	// Finished work frees up the queue again
+	after, err := h.TryGetResource("after", nil)
+	if err != nil {
+		t.Fatalf("got error %v after the queue emptied, expected the request to be queued", err)
+	}
+	<-after
+}
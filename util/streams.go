@@ -2,12 +2,10 @@ package util
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"math"
 
-	"github.com/turt2live/matrix-media-repo/util/cleanup"
 	"github.com/turt2live/matrix-media-repo/util/util_byte_seeker"
 )
 
@@ -20,6 +18,15 @@ func BytesToStream(b []byte) io.ReadCloser {
 	return ioutil.NopCloser(bytes.NewBuffer(b))
 }
 
+// LimitPastMax limits the reader to one byte past max, so that callers can reject rather than
+// truncate anything larger than max. A max of math.MaxInt64 can't be exceeded, so isn't limited.
+func LimitPastMax(r io.Reader, max int64) io.Reader {
+	if max == math.MaxInt64 {
+		return r
+	}
+	return io.LimitReader(r, max+1)
+}
+
 func CloneReader(input io.ReadCloser, numReaders int) []io.ReadCloser {
 	readers := make([]io.ReadCloser, 0)
 	writers := make([]io.WriteCloser, 0)
@@ -44,18 +51,6 @@ func CloneReader(input io.ReadCloser, numReaders int) []io.ReadCloser {
 	return readers
 }
 
-func GetSha256HashOfStream(r io.ReadCloser) (string, error) {
-	defer cleanup.DumpAndCloseStream(r)
-
-	hasher := sha256.New()
-
-	if _, err := io.Copy(hasher, r); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hasher.Sum(nil)), nil
-}
-
 func ClonedBufReader(buf bytes.Buffer) util_byte_seeker.ByteSeeker {
 	return util_byte_seeker.NewByteSeeker(buf.Bytes())
 }
\ No newline at end of file
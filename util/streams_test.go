@@ -0,0 +1,34 @@
+package util
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLimitPastMax(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		max          int64
+		expectedRead int
+	}{
+		{name: "under the max", size: 5, max: 10, expectedRead: 5},
+		{name: "at the max", size: 10, max: 10, expectedRead: 10},
+		{name: "over the max", size: 50, max: 10, expectedRead: 11},
+		{name: "zero max", size: 50, max: 0, expectedRead: 1},
+		{name: "largest max", size: 50, max: math.MaxInt64, expectedRead: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := ioutil.ReadAll(LimitPastMax(strings.NewReader(strings.Repeat("a", tt.size)), tt.max))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != tt.expectedRead {
+				t.Errorf("got %d bytes, expected %d", len(b), tt.expectedRead)
+			}
+		})
+	}
+}
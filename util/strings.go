@@ -2,6 +2,8 @@ package util
 
 import (
 	"strings"
+
+	"github.com/ryanuber/go-glob"
 )
 
 func HasAnyPrefix(val string, prefixes []string) bool {
@@ -12,3 +14,12 @@ func HasAnyPrefix(val string, prefixes []string) bool {
 	}
 	return false
 }
+
+func GlobMatchesAny(globs []string, val string) bool {
+	for _, g := range globs {
+		if glob.Glob(g, val) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package util_exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var pngSignature = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// StripMetadata removes EXIF, XMP, and similar textual metadata from JPEG, PNG, and WebP images. The
+// type of image is determined from the bytes themselves rather than a reported content type. Anything
+// which isn't a supported image is returned unaltered.
+func StripMetadata(b []byte) ([]byte, error) {
+	if len(b) >= 3 && b[0] == 0xFF && b[1] == 0xD8 && b[2] == 0xFF {
+		return stripJpeg(b)
+	}
+	if len(b) >= len(pngSignature) && bytes.Equal(b[:len(pngSignature)], pngSignature) {
+		return stripPng(b)
+	}
+	if len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP" {
+		return stripWebp(b)
+	}
+	return b, nil
+}
+
+func stripJpeg(b []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+	out.Write(b[0:2]) // SOI
+
+	i := 2
+	for i < len(b) {
+		if b[i] != 0xFF {
+			return nil, errors.New("exif: invalid jpeg marker")
+		}
+		if i+1 >= len(b) {
+			return nil, errors.New("exif: unexpected end of jpeg")
+		}
+		marker := b[i+1]
+		if marker == 0xFF {
+			// Fill byte - skip it
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Standalone markers have no length
+			out.Write(b[i : i+2])
+			i += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: everything else is image data
+			out.Write(b[i:])
+			break
+		}
+
+		if i+4 > len(b) {
+			return nil, errors.New("exif: unexpected end of jpeg")
+		}
+		segmentLen := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		end := i + 2 + segmentLen
+		if segmentLen < 2 || end > len(b) {
+			return nil, errors.New("exif: invalid jpeg segment length")
+		}
+
+		// APP1 is EXIF/XMP, APP13 is IPTC, and COM is free text. Everything else (like ICC profiles) is kept.
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+
+	return out.Bytes(), nil
+}
+
+func stripPng(b []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+	out.Write(pngSignature)
+
+	i := len(pngSignature)
+	for i < len(b) {
+		if i+8 > len(b) {
+			return nil, errors.New("exif: unexpected end of png")
+		}
+		chunkLen := int(binary.BigEndian.Uint32(b[i : i+4]))
+		chunkType := string(b[i+4 : i+8])
+		end := i + 12 + chunkLen // length + type + data + crc
+		if chunkLen < 0 || end > len(b) {
+			return nil, errors.New("exif: invalid png chunk length")
+		}
+
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			// dropped
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func stripWebp(b []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+	out.Write(b[0:12]) // RIFF header, size is fixed up later
+
+	i := 12
+	for i < len(b) {
+		if i+8 > len(b) {
+			return nil, errors.New("exif: unexpected end of webp")
+		}
+		chunkType := string(b[i : i+4])
+		chunkLen := int(binary.LittleEndian.Uint32(b[i+4 : i+8]))
+		end := i + 8 + chunkLen
+		if chunkLen < 0 || end > len(b) {
+			return nil, errors.New("exif: invalid webp chunk length")
+		}
+		end += chunkLen % 2 // chunks are padded to an even size
+		if end > len(b) {
+			// Some encoders leave the padding off the final chunk
+			end = len(b)
+		}
+
+		switch chunkType {
+		case "EXIF", "XMP ":
+			// dropped
+		case "VP8X":
+			chunk := make([]byte, end-i)
+			copy(chunk, b[i:end])
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // clear the EXIF and XMP flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(b[i:end])
+		}
+		i = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
@@ -0,0 +1,227 @@
+package util_exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 3; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 60), G: uint8(y * 80), B: 100, A: 255})
+		}
+	}
+	return img
+}
+
+// gpsExif builds a little endian TIFF structure with a GPS IFD holding a latitude reference.
+func gpsExif() []byte {
+	b := &bytes.Buffer{}
+	b.WriteString("II*\x00")
+	_ = binary.Write(b, binary.LittleEndian, uint32(8)) // IFD0 offset
+
+	// IFD0: a single pointer to the GPS IFD
+	_ = binary.Write(b, binary.LittleEndian, uint16(1))
+	_ = binary.Write(b, binary.LittleEndian, []uint16{0x8825, 4}) // GPSInfo, LONG
+	_ = binary.Write(b, binary.LittleEndian, []uint32{1, 26})
+	_ = binary.Write(b, binary.LittleEndian, uint32(0))
+
+	// GPS IFD: GPSLatitudeRef = "N"
+	_ = binary.Write(b, binary.LittleEndian, uint16(1))
+	_ = binary.Write(b, binary.LittleEndian, []uint16{0x0001, 2}) // GPSLatitudeRef, ASCII
+	_ = binary.Write(b, binary.LittleEndian, uint32(2))
+	b.WriteString("N\x00\x00\x00")
+	_ = binary.Write(b, binary.LittleEndian, uint32(0))
+	return b.Bytes()
+}
+
+func jpegWithExif(t *testing.T) []byte {
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := append([]byte("Exif\x00\x00"), gpsExif()...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(payload)+2))
+	app1 = append(app1, payload...)
+	com := append([]byte{0xFF, 0xFE, 0, 8}, []byte("camera")...)
+
+	b := encoded.Bytes()
+	out := append([]byte{}, b[:2]...) // SOI
+	out = append(out, app1...)
+	out = append(out, com...)
+	return append(out, b[2:]...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(data)))
+	copy(b[4:8], chunkType)
+	b = append(b, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b[4:]))
+	return append(b, crc...)
+}
+
+func pngWithMetadata(t *testing.T) []byte {
+	encoded := &bytes.Buffer{}
+	if err := png.Encode(encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := encoded.Bytes()
+	ihdrEnd := len(pngSignature) + 12 + 13
+	out := append([]byte{}, b[:ihdrEnd]...)
+	out = append(out, pngChunk("eXIf", gpsExif())...)
+	out = append(out, pngChunk("tEXt", []byte("Comment\x00taken at home"))...)
+	return append(out, b[ihdrEnd:]...)
+}
+
+func webpChunk(chunkType string, data []byte, pad bool) []byte {
+	b := make([]byte, 8, 9+len(data))
+	copy(b[0:4], chunkType)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(data)))
+	b = append(b, data...)
+	if pad && len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func webpWithMetadata(padLastChunk bool) []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04 // EXIF and XMP flags
+
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x, true)...)
+	body = append(body, webpChunk("EXIF", gpsExif(), true)...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta/>"), true)...)
+	body = append(body, webpChunk("VP8L", []byte("image data"), true)...)
+	body = append(body, webpChunk("ALPH", []byte("odd"), padLastChunk)...) // odd length
+
+	header := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(body)))
+	return append(header, body...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     []byte
+		removed   [][]byte
+		kept      [][]byte
+		decode    func([]byte) (image.Image, error)
+		unaltered bool
+	}{
+		{
+			name:    "jpeg with gps exif",
+			input:   jpegWithExif(t),
+			removed: [][]byte{[]byte("Exif\x00\x00"), []byte("camera"), gpsExif()},
+			decode: func(b []byte) (image.Image, error) {
+				return jpeg.Decode(bytes.NewReader(b))
+			},
+		},
+		{
+			name:    "png with exif and text",
+			input:   pngWithMetadata(t),
+			removed: [][]byte{[]byte("eXIf"), []byte("tEXt"), []byte("taken at home")},
+			decode: func(b []byte) (image.Image, error) {
+				return png.Decode(bytes.NewReader(b))
+			},
+		},
+		{
+			name:    "webp with exif and xmp",
+			input:   webpWithMetadata(true),
+			removed: [][]byte{[]byte("EXIF"), []byte("XMP "), gpsExif()},
+			kept:    [][]byte{[]byte("VP8X"), []byte("image data"), []byte("odd")},
+		},
+		{
+			name:    "webp without padding on the final chunk",
+			input:   webpWithMetadata(false),
+			removed: [][]byte{[]byte("EXIF"), []byte("XMP ")},
+			kept:    [][]byte{[]byte("VP8L"), []byte("ALPH\x03\x00\x00\x00odd")},
+		},
+		{
+			name:      "not an image",
+			input:     []byte("Exif\x00\x00 is just text here"),
+			unaltered: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripped, err := StripMetadata(tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.unaltered {
+				if !bytes.Equal(stripped, tt.input) {
+					t.Errorf("expected the input to be returned unaltered")
+				}
+				return
+			}
+			for _, r := range tt.removed {
+				if bytes.Contains(stripped, r) {
+					t.Errorf("expected %q to be removed", r)
+				}
+			}
+			for _, k := range tt.kept {
+				if !bytes.Contains(stripped, k) {
+					t.Errorf("expected %q to be kept", k)
+				}
+			}
+			if tt.decode != nil {
+				img, err := tt.decode(stripped)
+				if err != nil {
+					t.Fatalf("stripped image doesn't decode: %v", err)
+				}
+				if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 3 {
+					t.Errorf("got %v, expected a 4x3 image", img.Bounds())
+				}
+			}
+		})
+	}
+}
+
+func TestStripWebpFlagsAndSize(t *testing.T) {
+	stripped, err := StripMetadata(webpWithMetadata(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if riffSize := binary.LittleEndian.Uint32(stripped[4:8]); int(riffSize) != len(stripped)-8 {
+		t.Errorf("got RIFF size %d, expected %d", riffSize, len(stripped)-8)
+	}
+	flags := stripped[20]
+	if flags&(0x08|0x04) != 0 {
+		t.Errorf("expected the EXIF and XMP flags to be cleared, got %08b", flags)
+	}
+}
+
+func TestStripMetadataErrors(t *testing.T) {
+	truncatedWebp := webpWithMetadata(true)
+	truncatedWebp = truncatedWebp[:len(truncatedWebp)-3]
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "jpeg with a bad segment length", input: []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 0x00}},
+		{name: "png with a bad chunk length", input: append(append([]byte{}, pngSignature...), 0xFF, 0xFF, 0xFF, 0x00, 'I', 'H', 'D', 'R')},
+		{name: "webp with a truncated chunk", input: truncatedWebp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := StripMetadata(tt.input)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package util_svg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Elements which can run scripts or embed other documents. They are removed along with everything inside them.
+var scriptableElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// Unlike xml.EscapeText, these leave whitespace alone so the image keeps its formatting
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+
+var cssImportRegex = regexp.MustCompile(`(?i)@import[^;]*;?`)
+var cssUrlRegex = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)]*))\s*\)`)
+
+// Sanitize removes scripts, event handler attributes, and references to external resources from an
+// SVG image, leaving the shapes it draws intact. References within the image (such as "#gradient")
+// and embedded raster images are kept. Comments, processing instructions other than the XML
+// declaration, and DOCTYPEs are dropped. An error is returned if the image can't be parsed.
+func Sanitize(b []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	out := bytes.NewBuffer(make([]byte, 0, len(b)))
+
+	stack := make([]string, 0)
+	skipDepth := 0 // how deep we are inside an element being removed
+	sawRoot := false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("svg: error parsing image: " + err.Error())
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				if sawRoot {
+					return nil, errors.New("svg: more than one root element")
+				}
+				if strings.ToLower(t.Name.Local) != "svg" {
+					return nil, errors.New("svg: root element is not an svg")
+				}
+				sawRoot = true
+			}
+			stack = append(stack, qualifiedName(t.Name))
+
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+			if isScriptable(t) {
+				skipDepth = 1
+				continue
+			}
+
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				value, keep := sanitizeAttr(attr)
+				if !keep {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + "=\"" + attrEscaper.Replace(value) + "\"")
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != qualifiedName(t.Name) {
+				return nil, errors.New("svg: unexpected closing tag " + qualifiedName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if len(stack) == 0 {
+				// Only whitespace is allowed outside of the root element, and it isn't needed
+				continue
+			}
+			text := string(t)
+			if strings.ToLower(stack[len(stack)-1]) == "style" {
+				text = sanitizeCss(text)
+			}
+			out.WriteString(textEscaper.Replace(text))
+		case xml.ProcInst:
+			// The XML declaration is harmless, but others (like xml-stylesheet) can load external resources
+			if t.Target == "xml" && !sawRoot {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+	}
+
+	if !sawRoot {
+		return nil, errors.New("svg: no root element")
+	}
+	if len(stack) > 0 {
+		return nil, errors.New("svg: unexpected end of image")
+	}
+
+	return out.Bytes(), nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func isScriptable(e xml.StartElement) bool {
+	local := strings.ToLower(e.Name.Local)
+	if scriptableElements[local] {
+		return true
+	}
+
+	// Animations can change links to point at scripts after the image has been loaded
+	if local == "set" || local == "animate" {
+		for _, attr := range e.Attr {
+			if strings.ToLower(attr.Name.Local) == "attributename" && strings.HasSuffix(strings.ToLower(attr.Value), "href") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sanitizeAttr returns the value to keep for the attribute, or false if it should be removed.
+func sanitizeAttr(attr xml.Attr) (string, bool) {
+	local := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(local, "on") {
+		return "", false
+	}
+	if local == "href" || local == "src" {
+		return attr.Value, isSafeReference(attr.Value)
+	}
+	if strings.Contains(compactLower(attr.Value), "javascript:") {
+		return "", false
+	}
+	if local == "style" {
+		return sanitizeCss(attr.Value), true
+	}
+	if strings.Contains(strings.ToLower(attr.Value), "url(") {
+		// Presentation attributes like fill can reference other resources too
+		return sanitizeCss(attr.Value), true
+	}
+	return attr.Value, true
+}
+
+// isSafeReference determines if a link points within the image itself, or is an embedded raster
+// image, rather than at an external resource.
+func isSafeReference(ref string) bool {
+	ref = compactLower(ref)
+	if strings.HasPrefix(ref, "#") {
+		return true
+	}
+	return strings.HasPrefix(ref, "data:image/") && !strings.HasPrefix(ref, "data:image/svg")
+}
+
+// sanitizeCss removes imports and external url() references from CSS.
+func sanitizeCss(css string) string {
+	css = cssImportRegex.ReplaceAllString(css, "")
+	return cssUrlRegex.ReplaceAllStringFunc(css, func(s string) string {
+		m := cssUrlRegex.FindStringSubmatch(s)
+		if isSafeReference(m[1] + m[2] + m[3]) {
+			return s
+		}
+		return "none"
+	})
+}
+
+// compactLower lowercases the string and removes whitespace and control characters, which browsers
+// ignore in places like "java\tscript:".
+func compactLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+}
@@ -0,0 +1,116 @@
+package util_svg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name            string
+		svg             string
+		expected        string
+		expectedRemoved []string
+	}{
+		{
+			name:     "harmless image",
+			svg:      `<?xml version="1.0"?>` + "\n" + `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="red"/></svg>`,
+			expected: `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10" fill="red"></rect></svg>`,
+		},
+		{
+			name:            "script",
+			svg:             `<svg><script>alert(1)</script><circle r="5"/></svg>`,
+			expected:        `<svg><circle r="5"></circle></svg>`,
+			expectedRemoved: []string{"script", "alert"},
+		},
+		{
+			name:            "foreign object",
+			svg:             `<svg><foreignObject><iframe src="https://example.org"></iframe></foreignObject></svg>`,
+			expected:        `<svg></svg>`,
+			expectedRemoved: []string{"iframe", "example.org"},
+		},
+		{
+			name:            "event handler",
+			svg:             `<svg onload="alert(1)"><rect onclick="alert(2)" width="1"/></svg>`,
+			expected:        `<svg><rect width="1"></rect></svg>`,
+			expectedRemoved: []string{"alert"},
+		},
+		{
+			name:            "javascript link",
+			svg:             `<svg><a href="java	script:alert(1)"><text>hi</text></a></svg>`,
+			expected:        `<svg><a><text>hi</text></a></svg>`,
+			expectedRemoved: []string{"script"},
+		},
+		{
+			name:     "internal reference",
+			svg:      `<svg><use href="#shape"/><rect fill="url(#gradient)"/></svg>`,
+			expected: `<svg><use href="#shape"></use><rect fill="url(#gradient)"></rect></svg>`,
+		},
+		{
+			name:            "external references",
+			svg:             `<svg><image href="https://example.org/tracker.png"/><rect style="fill: url('https://example.org/a.svg')"/></svg>`,
+			expected:        `<svg><image></image><rect style="fill: none"></rect></svg>`,
+			expectedRemoved: []string{"example.org"},
+		},
+		{
+			name:            "style import",
+			svg:             `<svg><style>@import url(https://example.org/evil.css); rect { fill: red; }</style></svg>`,
+			expected:        `<svg><style> rect { fill: red; }</style></svg>`,
+			expectedRemoved: []string{"@import", "example.org"},
+		},
+		{
+			name:            "href animation",
+			svg:             `<svg><a><set attributeName="href" to="javascript:alert(1)"/></a></svg>`,
+			expected:        `<svg><a></a></svg>`,
+			expectedRemoved: []string{"javascript"},
+		},
+		{
+			name:            "stylesheet instruction and comment",
+			svg:             `<?xml-stylesheet href="https://example.org/evil.css"?><!-- hidden --><svg></svg>`,
+			expected:        `<svg></svg>`,
+			expectedRemoved: []string{"example.org", "hidden"},
+		},
+		{
+			name:     "embedded raster image",
+			svg:      `<svg><image href="data:image/png;base64,AAAA"/></svg>`,
+			expected: `<svg><image href="data:image/png;base64,AAAA"></image></svg>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Sanitize([]byte(tt.svg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("got %s, expected %s", b, tt.expected)
+			}
+			for _, removed := range tt.expectedRemoved {
+				if strings.Contains(string(b), removed) {
+					t.Errorf("got %s, expected %q to be removed", b, removed)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		svg  string
+	}{
+		{name: "not xml", svg: "hello world"},
+		{name: "not an svg", svg: "<html></html>"},
+		{name: "two roots", svg: "<svg></svg><svg></svg>"},
+		{name: "unclosed", svg: "<svg><rect>"},
+		{name: "mismatched tags", svg: "<svg><rect></circle></svg>"},
+		{name: "empty", svg: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if b, err := Sanitize([]byte(tt.svg)); err == nil {
+				t.Errorf("got %s, expected an error", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/turt2live/matrix-media-repo/common/config"
+	"github.com/turt2live/matrix-media-repo/types"
+)
+
+const SignatureHeader = "X-MediaRepo-Signature"
+
+const maxRetryDelay = 1 * time.Minute
+
+type UploadEvent struct {
+	Type        string `json:"type"`
+	MediaId     string `json:"media_id"`
+	Origin      string `json:"origin"`
+	UserId      string `json:"user_id"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Sha256Hash  string `json:"sha256"`
+	Timestamp   int64  `json:"ts"`
+}
+
+// NotifyUpload sends an upload event for the media to every configured webhook. Delivery
+// happens in the background, so this never blocks.
+func NotifyUpload(media *types.Media) {
+	conf := config.Get().Webhooks
+	if len(conf.Hooks) == 0 {
+		return
+	}
+
+	event := &UploadEvent{
+		Type:        "upload",
+		MediaId:     media.MediaId,
+		Origin:      media.Origin,
+		UserId:      media.UserId,
+		ContentType: media.ContentType,
+		SizeBytes:   media.SizeBytes,
+		Sha256Hash:  media.Sha256Hash,
+		Timestamp:   media.CreationTs,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logrus.Error("Error encoding webhook event: ", err)
+		return
+	}
+
+	for _, hook := range conf.Hooks {
+		go deliver(hook, body, conf.MaxAttempts, time.Duration(conf.TimeoutSeconds)*time.Second)
+	}
+}
+
+func deliver(hook config.WebhookConfig, body []byte, maxAttempts int, timeout time.Duration) {
+	log := logrus.WithFields(logrus.Fields{"webhookUrl": hook.Url})
+	client := &http.Client{Timeout: timeout}
+
+	delay := 1 * time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := send(client, hook, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= maxAttempts {
+			// Record the undelivered event so it can be replayed by hand
+			log.WithFields(logrus.Fields{"attempts": attempt, "event": string(body)}).Error("Giving up on delivering webhook: ", err)
+			return
+		}
+
+		log.Warn(fmt.Sprintf("Error delivering webhook (attempt %d of %d), retrying in %s: %s", attempt, maxAttempts, delay, err.Error()))
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// send makes a single delivery attempt, returning whether the attempt should be retried if
+// it failed.
+func send(client *http.Client, hook config.WebhookConfig, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "matrix-media-repo")
+	if hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(body, hook.Secret))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	err = errors.New(fmt.Sprintf("unexpected status code %d", res.StatusCode))
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Sign calculates the value of the signature header for the given body.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/turt2live/matrix-media-repo/common/config"
+)
+
+func TestSend(t *testing.T) {
+	body := []byte(`{"type":"upload"}`)
+
+	tests := []struct {
+		name          string
+		status        int
+		secret        string
+		wantErr       bool
+		wantRetry     bool
+		wantSignature bool
+	}{
+		{name: "delivered", status: http.StatusOK},
+		{name: "delivered with a signature", status: http.StatusNoContent, secret: "secret", wantSignature: true},
+		{name: "rejected", status: http.StatusBadRequest, wantErr: true, wantRetry: false},
+		{name: "not found", status: http.StatusNotFound, wantErr: true, wantRetry: false},
+		{name: "rate limited", status: http.StatusTooManyRequests, wantErr: true, wantRetry: true},
+		{name: "server error", status: http.StatusBadGateway, wantErr: true, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody []byte
+			var gotSignature string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotBody, _ = ioutil.ReadAll(r.Body)
+				gotSignature = r.Header.Get(SignatureHeader)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			retry, err := send(server.Client(), config.WebhookConfig{Url: server.URL, Secret: tt.secret}, body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if string(gotBody) != string(body) {
+				t.Errorf("body = %s, want %s", gotBody, body)
+			}
+			if (gotSignature != "") != tt.wantSignature {
+				t.Errorf("signature = %q, wantSignature %v", gotSignature, tt.wantSignature)
+			}
+			if tt.wantSignature && gotSignature != Sign(body, tt.secret) {
+				t.Errorf("signature = %q, want %q", gotSignature, Sign(body, tt.secret))
+			}
+		})
+	}
+}
+
+func TestSendUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	retry, err := send(http.DefaultClient, config.WebhookConfig{Url: url}, []byte("{}"))
+	if err == nil {
+		t.Fatal("expected an error delivering to a closed server")
+	}
+	if !retry {
+		t.Error("connection errors should be retried")
+	}
+}
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		body   string
+		secret string
+	}{
+		{body: `{"type":"upload"}`, secret: "secret"},
+		{body: "", secret: "secret"},
+		{body: `{"type":"upload"}`, secret: "another secret"},
+	}
+	for _, tt := range tests {
+		mac := hmac.New(sha256.New, []byte(tt.secret))
+		mac.Write([]byte(tt.body))
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if got := Sign([]byte(tt.body), tt.secret); got != want {
+			t.Errorf("Sign(%q, %q) = %s, want %s", tt.body, tt.secret, got, want)
+		}
+	}
+}